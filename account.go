@@ -1,6 +1,8 @@
 package photoshare
 
 import (
+	"github.com/dchest/uniuri"
+	"github.com/lib/pq"
 	"net/http"
 	"strings"
 	"time"
@@ -8,6 +10,10 @@ import (
 
 func getAuthRedirectURL(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
+	if err := ctx.requireFeature(featureOAuth); err != nil {
+		return err
+	}
+
 	url, err := ctx.auth.getRedirectURL(r, ctx.params.get("provider"))
 	if err != nil {
 		return err
@@ -28,7 +34,12 @@ func authCallback(ctx *context, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	authToken, err := ctx.session.createToken(user.ID)
+	session, err := newSession(ctx, r, user)
+	if err != nil {
+		return err
+	}
+
+	authToken, err := ctx.session.createToken(user.ID, session.Key)
 
 	if err != nil {
 		return err
@@ -45,13 +56,92 @@ func authCallback(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// creates a session record for the user with the client details, ending
+// the session the client had so that its key is not kept past login
+func newSession(ctx *context, r *http.Request, user *user) (*session, error) {
+	if err := endClientSession(ctx, r); err != nil {
+		return nil, err
+	}
+	session := &session{
+		UserID:    user.ID,
+		Key:       uniuri.NewLen(32),
+		IP:        getRemoteIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := ctx.datamapper.createSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ends the session of the token sent with the request, if any
+func endClientSession(ctx *context, r *http.Request) error {
+	userID, key, err := ctx.session.readToken(r)
+	if err != nil || userID == 0 {
+		return err
+	}
+	previous, err := ctx.datamapper.getSession(key)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil
+		}
+		return err
+	}
+	if err := ctx.datamapper.deleteSession(previous.UserID, previous.ID); err != nil && !isErrSqlNoRows(err) {
+		return err
+	}
+	return nil
+}
+
+// gives the session of the user a new key and writes the new auth token to
+// the response, see sessionBinding
+func rotateSession(ctx *context, w http.ResponseWriter) error {
+	key := uniuri.NewLen(32)
+	if err := ctx.datamapper.rotateSessionKey(ctx.user.ID, ctx.user.SessionID, key); err != nil {
+		return err
+	}
+	return ctx.session.writeToken(w, ctx.user.ID, key)
+}
+
+// creates a new session and writes the auth token to the response
+func startSession(ctx *context, w http.ResponseWriter, r *http.Request, user *user) error {
+	session, err := newSession(ctx, r, user)
+	if err != nil {
+		return err
+	}
+	user.SessionID = session.ID
+	return ctx.session.writeToken(w, user.ID, session.Key)
+}
+
+func getSessions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	sessions, err := ctx.datamapper.getSessions(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	for i := range sessions {
+		sessions[i].IsCurrent = sessions[i].ID == ctx.user.SessionID
+	}
+	return renderJSON(w, sessions, http.StatusOK)
+}
+
+func revokeSession(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.deleteSession(ctx.user.ID, ctx.params.getInt("id")); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Session revoked")
+}
+
 func logout(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	if err := ctx.session.writeToken(w, 0); err != nil {
+	if err := ctx.datamapper.deleteSession(ctx.user.ID, ctx.user.SessionID); err != nil && !isErrSqlNoRows(err) {
+		return err
+	}
+
+	if err := ctx.session.writeToken(w, 0, ""); err != nil {
 		return err
 	}
 
-	sendMessage(&socketMessage{ctx.user.Name, "", 0, "logout"})
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", 0, "logout"})
 	return renderJSON(w, newSessionInfo(&user{}), http.StatusOK)
 
 }
@@ -78,38 +168,61 @@ func login(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	}
 
 	user, err := ctx.datamapper.getUserByNameOrEmail(s.Identifier)
-	if err != nil {
-		if isErrSqlNoRows(err) {
+	if err != nil && !isErrSqlNoRows(err) {
+		return err
+	}
+	// users without a local account, or another password, may be in the
+	// directory (see ldap.go)
+	if err != nil || !user.checkPassword(s.Password) {
+		if user, err = loginDirectory(ctx, r, s.Identifier, s.Password); err != nil {
+			return err
+		}
+		if user == nil {
 			return invalidLogin
 		}
-		return err
+	} else {
+		ctx.rehasher.submit(ctx.datamapper, user, s.Password)
 	}
-	if !user.checkPassword(s.Password) {
-		return invalidLogin
+
+	if user.IsBanned {
+		return errBanned
+	}
+
+	if user.isSuspended() {
+		return errSuspended
 	}
 
-	if err := ctx.session.writeToken(w, user.ID); err != nil {
+	if err := startSession(ctx, w, r, user); err != nil {
 		return err
 	}
 
 	user.IsAuthenticated = true
 
-	sendMessage(&socketMessage{user.Name, "", 0, "login"})
+	sendMessage(ctx.site.ID, &socketMessage{user.Name, "", 0, "login"})
 	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
 }
 
 func signup(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
+	if err := ctx.requireFeature(featureRegistration); err != nil {
+		return err
+	}
+
 	s := &struct {
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Captcha  string `json:"captcha"`
 	}{}
 
 	if err := decodeJSON(r, s); err != nil {
 		return err
 	}
 
+	if err := checkCaptcha(ctx, s.Captcha); err != nil {
+		return err
+	}
+
 	user := &user{
 		Name:     s.Name,
 		Email:    strings.ToLower(s.Email),
@@ -123,7 +236,7 @@ func signup(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	if err := ctx.datamapper.createUser(user); err != nil {
 		return err
 	}
-	if err := ctx.session.writeToken(w, user.ID); err != nil {
+	if err := startSession(ctx, w, r, user); err != nil {
 		return err
 	}
 
@@ -156,14 +269,14 @@ func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 	}
 
 	if s.RecoveryCode == "" {
-		if user, err = ctx.authenticate(r, authLevelLogin); err != nil {
+		if err = authorize(ctx.user, authLevelLogin); err != nil {
 			return err
 		}
+		user = ctx.user
 	} else {
-		if user, err = ctx.datamapper.getUserByRecoveryCode(s.RecoveryCode); err != nil {
+		if user, err = getUserByRecoveryCode(ctx, s.RecoveryCode); err != nil {
 			return err
 		}
-		user.resetRecoveryCode()
 	}
 
 	if err = user.changePassword(s.Password); err != nil {
@@ -172,9 +285,26 @@ func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 	if err := ctx.validate(user, r); err != nil {
 		return err
 	}
+	if s.RecoveryCode != "" {
+		if err := claimRecoveryCode(ctx, user, s.RecoveryCode); err != nil {
+			return err
+		}
+	}
 	if err := ctx.datamapper.updateUser(user); err != nil {
 		return err
 	}
+	// sessions started with the old password are ended, but for the one
+	// changing it
+	if s.RecoveryCode == "" {
+		if err := ctx.datamapper.deleteOtherSessions(user.ID, ctx.user.SessionID); err != nil {
+			return err
+		}
+		if err := rotateSession(ctx, w); err != nil {
+			return err
+		}
+	} else if err := ctx.datamapper.deleteUserSessions(user.ID); err != nil {
+		return err
+	}
 
 	return renderString(w, http.StatusOK, "Password changed")
 }
@@ -202,12 +332,16 @@ func emailExists(ctx *context, w http.ResponseWriter, r *http.Request) error {
 func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	s := &struct {
-		Email string `json:"email"`
+		Email   string `json:"email"`
+		Captcha string `json:"captcha"`
 	}{}
 
 	if err := decodeJSON(r, s); err != nil {
 		return err
 	}
+	if err := checkCaptcha(ctx, s.Captcha); err != nil {
+		return err
+	}
 	if s.Email == "" {
 		return httpError{http.StatusBadRequest, "Missing email address"}
 	}
@@ -232,3 +366,182 @@ func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 
 	return renderString(w, http.StatusOK, "Password reset")
 }
+
+// the new address is only used once the change is confirmed through the
+// link sent to it, and the current password is required
+func changeEmail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	// users of a directory or single sign-on don't know their password,
+	// and only confirm with the link sent to the new address
+	if !ctx.user.RandomPassword && !ctx.user.checkPassword(s.Password) {
+		return httpError{http.StatusForbidden, "Invalid password"}
+	}
+
+	email := strings.ToLower(strings.TrimSpace(s.Email))
+
+	if !validateEmail(email) {
+		return validationFailure{map[string]string{"email": "Invalid email address"}}
+	}
+	if msg := checkEmailDomain(ctx.cfg, email); msg != "" {
+		return validationFailure{map[string]string{"email": msg}}
+	}
+
+	ok, err := ctx.datamapper.isUserEmailAvailable(&user{ID: ctx.user.ID, Email: email})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return validationFailure{map[string]string{"email": "Email already taken"}}
+	}
+
+	code, err := ctx.user.requestEmailChange(email)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+
+	user := ctx.user
+
+	go func() {
+		if err := ctx.mailer.sendChangeEmailMail(user, code, r); err != nil {
+			logError(err)
+		}
+	}()
+
+	return renderString(w, http.StatusOK, "Confirmation sent")
+}
+
+func confirmEmailChange(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	user, err := ctx.datamapper.getUserByEmailChangeCode(hashRecoveryCode(s.Code))
+	if err != nil {
+		return err
+	}
+
+	if user.isEmailChangeExpired() {
+		user.cancelEmailChange()
+		if err := ctx.datamapper.updateUser(user); err != nil {
+			return err
+		}
+		return httpError{http.StatusBadRequest, "This link has expired"}
+	}
+
+	// the address may have been taken since the change was requested
+	candidate := *user
+	candidate.Email = user.NewEmail.String
+
+	ok, err := ctx.datamapper.isUserEmailAvailable(&candidate)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		user.cancelEmailChange()
+		if err := ctx.datamapper.updateUser(user); err != nil {
+			return err
+		}
+		return httpError{http.StatusBadRequest, "Email already taken"}
+	}
+
+	user.confirmEmailChange()
+
+	if err := ctx.datamapper.updateUser(user); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "Email changed")
+}
+
+func changeName(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Name string `json:"name"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if !ctx.user.canChangeName() {
+		return httpError{http.StatusForbidden, "You have changed your name too recently"}
+	}
+
+	oldName := ctx.user.Name
+	name := strings.TrimSpace(s.Name)
+
+	if name == oldName {
+		return renderJSON(w, newSessionInfo(ctx.user), http.StatusOK)
+	}
+
+	errors := make(map[string]string)
+	if err := validateNewName(ctx, name, errors); err != nil {
+		return err
+	}
+	if len(errors) > 0 {
+		return validationFailure{errors}
+	}
+
+	ctx.user.Name = name
+
+	if err := ctx.validate(ctx.user, r); err != nil {
+		return err
+	}
+
+	ctx.user.NameChangedAt = pq.NullTime{Time: utcNow(), Valid: true}
+
+	if err := ctx.datamapper.changeUserName(ctx.user, oldName); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, newSessionInfo(ctx.user), http.StatusOK)
+}
+
+// returns the public profile for a user name. Previous names of a user
+// redirect to the current profile URL.
+func getProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	name := ctx.params.get("name")
+
+	user, err := ctx.datamapper.getUserByName(name)
+	if err == nil {
+		return renderProfile(ctx, w, user)
+	}
+	if !isErrSqlNoRows(err) {
+		return err
+	}
+
+	user, err = ctx.datamapper.getUserByPreviousName(name)
+	if err != nil {
+		return err
+	}
+
+	url, err := ctx.router.Get("profile").URL("name", user.Name)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+	return nil
+}
@@ -0,0 +1,73 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChangeEmail(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	sender := &recordingSender{}
+	app.mailer.sender = sender
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	local := &user{Name: "local", Email: "local@example.com"}
+	if err := local.changePassword("password"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := dm.login(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := send("PUT", "/api/user/email", token, `{"email": "new@example.com", "password": "wrong"}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected the password to be checked, got %d", res.Code)
+	}
+
+	// users of single sign-on don't know their password
+	sso := &user{Name: "sso", Email: "sso@example.com"}
+	if err := sso.setRandomPassword(); err != nil {
+		t.Fatal(err)
+	}
+	token, err = dm.login(sso)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := send("PUT", "/api/user/email", token, `{"email": "new@example.com"}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	var code string
+	for i := 0; i < 100 && code == ""; i++ {
+		time.Sleep(time.Millisecond)
+		if len(sender.messages) > 0 {
+			body := string(sender.messages[0].body)
+			code = body[strings.Index(body, "code=")+5:]
+			code = code[:strings.Index(code, "\n")]
+		}
+	}
+	if u, _ := dm.getUser(sso.ID); code == "" || u.EmailChangeCode.String != hashRecoveryCode(code) {
+		t.Fatalf("Expected only the hash of the code emailed to be stored, got %q", u.EmailChangeCode.String)
+	}
+
+	if res := send("PUT", "/api/user/email/confirm", "", `{"code": "`+hashRecoveryCode(code)+`"}`); res.Code != http.StatusNotFound {
+		t.Errorf("Expected the stored hash not to confirm the change, got %d", res.Code)
+	}
+	if res := send("PUT", "/api/user/email/confirm", "", `{"code": "`+code+`"}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if u, _ := dm.getUser(sso.ID); u.Email != "new@example.com" {
+		t.Errorf("Expected the email to be changed, got %s", u.Email)
+	}
+}
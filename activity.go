@@ -0,0 +1,28 @@
+package photoshare
+
+import (
+	"net/http"
+	"time"
+)
+
+// The activity of a user lists the votes and comments others made on their
+// photos in the last activityDays days, newest first, as a digest of what
+// push and in-app notifications told them one at a time. There are no
+// favorites to list: votes are how users mark photos they like.
+
+const activityDays = 30
+
+func getActivity(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	since := utcNow().Add(-activityDays * 24 * time.Hour)
+	list, err := ctx.datamapper.getActivity(getPage(r), ctx.user.ID, since)
+	if err != nil {
+		return err
+	}
+
+	loc := ctx.user.location()
+	for i := range list.Items {
+		list.Items[i].Created = newDisplayTime(list.Items[i].CreatedAt, loc)
+	}
+	return renderJSON(w, list, http.StatusOK)
+}
@@ -0,0 +1,54 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type activityDataMapper struct {
+	mockDataMapper
+	page  int64
+	since time.Time
+}
+
+func (m *activityDataMapper) getActivity(page *page, userID int64, since time.Time) (*activityList, error) {
+	m.page, m.since = page.index, since
+	return newActivityList([]activity{
+		{Type: "comment", PhotoID: 1, UserID: 2, Body: "Nice", CreatedAt: utcNow()},
+	}, 1, page.index), nil
+}
+
+func TestGetActivity(t *testing.T) {
+
+	dm := &activityDataMapper{}
+	c := &context{
+		app:        &app{datamapper: dm},
+		params:     &params{make(map[string]string)},
+		user:       &user{ID: 1, IsAuthenticated: true, Timezone: "Europe/Paris"},
+		datamapper: dm,
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/user/activity?page=2", nil)
+	res := httptest.NewRecorder()
+	if err := getActivity(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if dm.page != 2 {
+		t.Errorf("Expected the page asked for, got %d", dm.page)
+	}
+	if age := utcNow().Sub(dm.since); age < 29*24*time.Hour || age > 31*24*time.Hour {
+		t.Errorf("Expected the activity of the last 30 days, got %s", age)
+	}
+
+	result := &activityList{}
+	if err := json.Unmarshal(res.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 || result.Items[0].Created == nil || result.Items[0].Created.Timezone != "Europe/Paris" {
+		t.Errorf("Expected the activity in the user's timezone, got %s", res.Body)
+	}
+}
@@ -0,0 +1,733 @@
+package photoshare
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ActivityPub federation, publish side. Each user is an actor that remote
+// servers (Mastodon, Pixelfed...) can discover with WebFinger and follow;
+// new photos are delivered to the inboxes of followers as Create activities.
+// Requests between servers are signed with HTTP Signatures (rsa-sha256).
+
+const (
+	activityContentType    = "application/activity+json"
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	publicAddress          = "https://www.w3.org/ns/activitystreams#Public"
+	actorKeyBits           = 2048
+	maxSignatureAge        = 12 * time.Hour
+)
+
+var (
+	errNotFederated     = httpError{http.StatusNotFound, "Not found"}
+	errInvalidSignature = httpError{http.StatusUnauthorized, "Invalid signature"}
+)
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apActor struct {
+	Context           []string    `json:"@context"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name"`
+	URL               string      `json:"url"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox"`
+	Followers         string      `json:"followers"`
+	Published         string      `json:"published"`
+	PublicKey         apPublicKey `json:"publicKey"`
+}
+
+type apAttachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+	Name      string `json:"name"`
+}
+
+type apTag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+type apObject struct {
+	Context      string         `json:"@context,omitempty"`
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	AttributedTo string         `json:"attributedTo"`
+	Content      string         `json:"content"`
+	URL          string         `json:"url"`
+	Published    string         `json:"published"`
+	To           []string       `json:"to"`
+	Cc           []string       `json:"cc"`
+	Attachment   []apAttachment `json:"attachment"`
+	Tag          []apTag        `json:"tag"`
+}
+
+type apActivity struct {
+	Context   string      `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Published string      `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object"`
+}
+
+type apCollection struct {
+	Context      string        `json:"@context"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	TotalItems   int64         `json:"totalItems"`
+	OrderedItems []*apActivity `json:"orderedItems,omitempty"`
+}
+
+// the parts of a remote actor we need to verify and deliver to it
+type remoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey apPublicKey `json:"publicKey"`
+}
+
+// returns the shared inbox of the actor's server if it has one
+func (a *remoteActor) deliveryInbox() string {
+	if a.Endpoints.SharedInbox != "" {
+		return a.Endpoints.SharedInbox
+	}
+	return a.Inbox
+}
+
+func actorURL(baseURL string, userID int64) string {
+	return fmt.Sprintf("%s/ap/users/%d", baseURL, userID)
+}
+
+func photoObjectURL(baseURL string, photoID int64) string {
+	return fmt.Sprintf("%s/ap/photos/%d", baseURL, photoID)
+}
+
+// returns true if the user is published to other servers
+func isFederated(app *app, user *user) bool {
+	return !user.IsBanned && !user.IsShadowBanned &&
+		app.features.forSite(user.SiteID).isEnabled(featureFederation, user)
+}
+
+func renderActivity(w http.ResponseWriter, value interface{}, status int) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, body, status, activityContentType)
+}
+
+func newActor(baseURL string, user *user, publicKey string) *apActor {
+	id := actorURL(baseURL, user.ID)
+	return &apActor{
+		Context:           []string{activityStreamsContext, securityContext},
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: user.Name,
+		Name:              user.Name,
+		URL:               fmt.Sprintf("%s/#/user/%d/%s", baseURL, user.ID, user.Name),
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		Published:         user.CreatedAt.UTC().Format(time.RFC3339),
+		PublicKey: apPublicKey{
+			ID:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: publicKey,
+		},
+	}
+}
+
+func newPhotoObject(baseURL string, photo *photo) *apObject {
+	actor := actorURL(baseURL, photo.OwnerID)
+	imageURL := fmt.Sprintf("%s/uploads/%s", baseURL, photo.Filename)
+
+	content := "<p>" + html.EscapeString(photo.Title) + "</p>"
+
+	tags := []apTag{}
+	for _, name := range photo.Tags {
+		href := fmt.Sprintf("%s/#/search/?q=%s", baseURL, url.QueryEscape(name))
+		tags = append(tags, apTag{"Hashtag", "#" + name, href})
+		content += fmt.Sprintf(` <a href="%s" class="mention hashtag" rel="tag">#%s</a>`,
+			html.EscapeString(href), html.EscapeString(name))
+	}
+
+	return &apObject{
+		ID:           photoObjectURL(baseURL, photo.ID),
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      content,
+		URL:          fmt.Sprintf("%s/#/detail/%d", baseURL, photo.ID),
+		Published:    photo.CreatedAt.UTC().Format(time.RFC3339),
+		To:           []string{publicAddress},
+		Cc:           []string{actor + "/followers"},
+		Attachment: []apAttachment{{
+			Type:      "Image",
+			MediaType: mime.TypeByExtension(path.Ext(photo.Filename)),
+			URL:       imageURL,
+			Name:      photo.altText(),
+		}},
+		Tag: tags,
+	}
+}
+
+func newCreateActivity(baseURL string, photo *photo) *apActivity {
+	object := newPhotoObject(baseURL, photo)
+	return &apActivity{
+		ID:        object.ID + "/activity",
+		Type:      "Create",
+		Actor:     object.AttributedTo,
+		Published: object.Published,
+		To:        object.To,
+		Cc:        object.Cc,
+		Object:    object,
+	}
+}
+
+// returns the key pair of the user, generating it on first use
+func getActorKey(datamapper dataMapper, userID int64) (*actorKey, error) {
+	key, err := datamapper.getActorKey(userID)
+	if err == nil || !isErrSqlNoRows(err) {
+		return key, err
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, actorKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key = &actorKey{
+		UserID: userID,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		})),
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: publicKey,
+		})),
+	}
+	if err := datamapper.createActorKey(key); err != nil {
+		return nil, err
+	}
+	// another request may have stored a key first
+	return datamapper.getActorKey(userID)
+}
+
+func parsePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func parsePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// headers signed in requests we send, and required in requests we receive
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, name := range headers {
+		var value string
+		switch name {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		default:
+			value = r.Header.Get(name)
+		}
+		lines[i] = name + ": " + value
+	}
+	return strings.Join(lines, "\n")
+}
+
+func signRequest(r *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", bodyDigest(body))
+
+	hash := sha256.Sum256([]byte(signingString(r, signedHeaders)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+var signatureParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// verifies the HTTP signature of a request, returning the actor who signed
+// it. getActor fetches the actor owning a key ID.
+func verifySignature(r *http.Request, body []byte, getActor func(string) (*remoteActor, error)) (*remoteActor, error) {
+
+	params := make(map[string]string)
+	for _, m := range signatureParamRegex.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+
+	keyID := params["keyId"]
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if keyID == "" || err != nil || len(signature) == 0 {
+		return nil, errInvalidSignature
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return nil, errInvalidSignature
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	for _, required := range signedHeaders {
+		found := false
+		for _, name := range headers {
+			if name == required {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errInvalidSignature
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	if age := time.Since(date); age > maxSignatureAge || age < -maxSignatureAge {
+		return nil, errInvalidSignature
+	}
+	if r.Header.Get("Digest") != bodyDigest(body) {
+		return nil, errInvalidSignature
+	}
+
+	actor, err := getActor(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if actor.PublicKey.ID != keyID || actor.PublicKey.Owner != actor.ID || !sameHost(keyID, actor.ID) {
+		return nil, errInvalidSignature
+	}
+	publicKey, err := parsePublicKey(actor.PublicKey.PublicKeyPem)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, headers)))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, errInvalidSignature
+	}
+	return actor, nil
+}
+
+// returns true if the URLs are all absolute and on the same host, so that
+// a server can't sign for actors of another
+func sameHost(urls ...string) bool {
+	host := ""
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return false
+		}
+		if host == "" {
+			host = strings.ToLower(u.Host)
+		} else if strings.ToLower(u.Host) != host {
+			return false
+		}
+	}
+	return true
+}
+
+// fetches the actor owning a key ID
+func fetchActor(client *http.Client, keyID string) (*remoteActor, error) {
+
+	u, err := url.Parse(keyID)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	u.Fragment = ""
+	if err := checkFetchURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityContentType)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, httpError{http.StatusBadRequest, "Unable to fetch actor"}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, httpError{http.StatusBadRequest, "Unable to fetch actor"}
+	}
+
+	actor := &remoteActor{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxJSONSize)).Decode(actor); err != nil {
+		return nil, httpError{http.StatusBadRequest, "Invalid actor"}
+	}
+	return actor, nil
+}
+
+// posts a signed activity to an inbox
+func postActivity(client *http.Client, inbox, keyID string, key *rsa.PrivateKey, body []byte) error {
+
+	u, err := url.Parse(inbox)
+	if err != nil {
+		return err
+	}
+	if err := checkFetchURL(u); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", activityContentType)
+	if err := signRequest(req, keyID, key, body); err != nil {
+		return err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", inbox, res.Status)
+	}
+	return nil
+}
+
+// delivers an activity of the user to each inbox, logging any failures
+func deliverActivity(app *app, user *user, baseURL string, inboxes []string, activity *apActivity) {
+
+	key, err := getActorKey(app.datamapper, user.ID)
+	if err != nil {
+		logError(err)
+		return
+	}
+	privateKey, err := parsePrivateKey(key.PrivateKey)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	activity.Context = activityStreamsContext
+	body, err := json.Marshal(activity)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	keyID := actorURL(baseURL, user.ID) + "#main-key"
+
+	for _, inbox := range inboxes {
+		if err := postActivity(app.fetcher, inbox, keyID, privateKey, body); err != nil {
+			log.Printf("Delivery to %s failed: %s", inbox, err)
+		}
+	}
+}
+
+// delivers a new photo to the followers of its owner
+func deliverPhoto(app *app, owner *user, photo *photo, baseURL string) {
+
+	followers, err := app.datamapper.getFollowers(owner.ID)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	// followers on the same server usually share an inbox
+	var inboxes []string
+	seen := make(map[string]bool)
+	for _, f := range followers {
+		if !seen[f.Inbox] {
+			seen[f.Inbox] = true
+			inboxes = append(inboxes, f.Inbox)
+		}
+	}
+	if len(inboxes) == 0 {
+		return
+	}
+
+	deliverActivity(app, owner, baseURL, inboxes, newCreateActivity(baseURL, photo))
+}
+
+// returns the user of the route if they are published to other servers
+func getFederatedUser(ctx *context) (*user, error) {
+	user, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return nil, err
+	}
+	if !isFederated(ctx.app, user) {
+		return nil, errNotFederated
+	}
+	return user, nil
+}
+
+// resolves "acct:name@host" resources to actors
+func webfinger(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	resource := r.FormValue("resource")
+	parts := strings.SplitN(strings.TrimPrefix(resource, "acct:"), "@", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[1], r.Host) {
+		return errNotFederated
+	}
+
+	user, err := ctx.datamapper.getUserByName(parts[0])
+	if err != nil {
+		return err
+	}
+	if !isFederated(ctx.app, user) {
+		return errNotFederated
+	}
+
+	baseURL := getBaseURL(r)
+
+	jrd := map[string]interface{}{
+		"subject": fmt.Sprintf("acct:%s@%s", user.Name, r.Host),
+		"aliases": []string{actorURL(baseURL, user.ID)},
+		"links": []map[string]string{
+			{
+				"rel":  "self",
+				"type": activityContentType,
+				"href": actorURL(baseURL, user.ID),
+			},
+			{
+				"rel":  "http://webfinger.net/rel/profile-page",
+				"type": "text/html",
+				"href": fmt.Sprintf("%s/#/user/%d/%s", baseURL, user.ID, user.Name),
+			},
+		},
+	}
+
+	body, err := json.Marshal(jrd)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	return writeBody(w, body, http.StatusOK, "application/jrd+json")
+}
+
+func getActor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := getFederatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	key, err := getActorKey(ctx.datamapper, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return renderActivity(w, newActor(getBaseURL(r), user, key.PublicKey), http.StatusOK)
+}
+
+// returns the most recent photos of the user as Create activities
+func getOutbox(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := getFederatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), user.ID, 0)
+	if err != nil {
+		return err
+	}
+
+	baseURL := getBaseURL(r)
+
+	outbox := &apCollection{
+		Context:    activityStreamsContext,
+		ID:         actorURL(baseURL, user.ID) + "/outbox",
+		Type:       "OrderedCollection",
+		TotalItems: photos.Total,
+	}
+	for i := range photos.Items {
+		outbox.OrderedItems = append(outbox.OrderedItems, newCreateActivity(baseURL, &photos.Items[i]))
+	}
+
+	return renderActivity(w, outbox, http.StatusOK)
+}
+
+// returns the number of followers; the followers themselves are private
+func getFollowersCollection(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := getFederatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	num, err := ctx.datamapper.countFollowers(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return renderActivity(w, &apCollection{
+		Context:    activityStreamsContext,
+		ID:         actorURL(getBaseURL(r), user.ID) + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: num,
+	}, http.StatusOK)
+}
+
+func getPhotoObject(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	// only photos visible to anyone are federated
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), &user{})
+	if err != nil {
+		return err
+	}
+
+	owner, err := ctx.datamapper.getActiveUser(photo.OwnerID)
+	if err != nil {
+		return err
+	}
+	if !isFederated(ctx.app, owner) {
+		return errNotFederated
+	}
+
+	object := newPhotoObject(getBaseURL(r), &photo.photo)
+	object.Context = activityStreamsContext
+	return renderActivity(w, object, http.StatusOK)
+}
+
+// accepts Follow and Undo Follow activities; others are ignored
+func postInbox(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := getFederatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxJSONSize))
+	if err != nil {
+		return err
+	}
+
+	activity := &struct {
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}{}
+	if err := json.Unmarshal(body, activity); err != nil {
+		return httpError{http.StatusBadRequest, "Invalid activity"}
+	}
+
+	actor, err := verifySignature(r, body, func(keyID string) (*remoteActor, error) {
+		return fetchActor(ctx.fetcher, keyID)
+	})
+	if err != nil {
+		return err
+	}
+	if actor.ID != activity.Actor || !sameHost(actor.PublicKey.ID, actor.ID, activity.Actor) {
+		return errInvalidSignature
+	}
+
+	baseURL := getBaseURL(r)
+	self := actorURL(baseURL, user.ID)
+
+	switch activity.Type {
+
+	case "Follow":
+		var object string
+		if err := json.Unmarshal(activity.Object, &object); err != nil || object != self {
+			return httpError{http.StatusBadRequest, "Invalid follow"}
+		}
+		f := &follower{UserID: user.ID, Actor: actor.ID, Inbox: actor.deliveryInbox()}
+		if err := ctx.datamapper.addFollower(f); err != nil {
+			return err
+		}
+		accept := &apActivity{
+			ID:     fmt.Sprintf("%s#accepts/%d", self, time.Now().UnixNano()),
+			Type:   "Accept",
+			Actor:  self,
+			Object: json.RawMessage(body),
+		}
+		go deliverActivity(ctx.app, user, baseURL, []string{f.Inbox}, accept)
+		if err := notifyFollow(ctx, r, user, actor.ID); err != nil {
+			return err
+		}
+
+	case "Undo":
+		object := &struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(activity.Object, object); err == nil && object.Type == "Follow" {
+			if err := ctx.datamapper.removeFollower(user.ID, actor.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
@@ -0,0 +1,155 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebfingerAndActor(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	u := &user{Name: "tester", Email: "tester@localhost"}
+	if err := dm.createUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/.well-known/webfinger?resource=acct:tester@example.com", nil)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Webfinger should return 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), `"href":"http://example.com/ap/users/1"`) {
+		t.Errorf("Webfinger should link to the actor: %s", res.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/.well-known/webfinger?resource=acct:tester@other.com", nil)
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Webfinger for another host should return 404, got %d", res.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/ap/users/1", nil)
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Actor should return 200, got %d", res.Code)
+	}
+
+	actor := &remoteActor{}
+	if err := json.Unmarshal(res.Body.Bytes(), actor); err != nil {
+		t.Fatal(err)
+	}
+	if actor.Inbox != "http://example.com/ap/users/1/inbox" {
+		t.Errorf("Unexpected inbox %s", actor.Inbox)
+	}
+	if _, err := parsePublicKey(actor.PublicKey.PublicKeyPem); err != nil {
+		t.Errorf("Actor should have a public key: %s", err)
+	}
+}
+
+func TestGetPhotoObject(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	u := &user{Name: "tester", Email: "tester@example.com", IsActive: true}
+	if err := dm.createUser(u); err != nil {
+		t.Fatal(err)
+	}
+	public := &photo{Title: "public", Filename: "public.jpg", OwnerID: u.ID}
+	private := &photo{Title: "private", Filename: "private.jpg", OwnerID: u.ID, Private: true}
+	for _, p := range []*photo{public, private} {
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		photo  *photo
+		status int
+	}{
+		{public, http.StatusOK},
+		{private, http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/ap/photos/%d", tc.photo.ID), nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.photo.Title, tc.status, res.Code)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	key, err := getActorKey(dm, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := parsePrivateKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := &remoteActor{ID: "https://remote/users/1"}
+	signer.PublicKey = apPublicKey{signer.ID + "#main-key", signer.ID, key.PublicKey}
+	getActor := func(keyID string) (*remoteActor, error) {
+		return signer, nil
+	}
+
+	body := []byte(`{"type": "Follow"}`)
+
+	req, _ := http.NewRequest("POST", "http://example.com/ap/users/1/inbox", strings.NewReader(string(body)))
+	if err := signRequest(req, signer.PublicKey.ID, privateKey, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifySignature(req, body, getActor); err != nil {
+		t.Errorf("Signature should be valid: %s", err)
+	}
+
+	if _, err := verifySignature(req, []byte(`{"type": "Undo"}`), getActor); err != errInvalidSignature {
+		t.Error("Signature should not be valid for another body")
+	}
+
+	req.URL.Path = "/ap/users/2/inbox"
+	if _, err := verifySignature(req, body, getActor); err != errInvalidSignature {
+		t.Error("Signature should not be valid for another inbox")
+	}
+
+	// a key of one server claiming an actor of another
+	req, _ = http.NewRequest("POST", "http://example.com/ap/users/1/inbox", strings.NewReader(string(body)))
+	signer.ID = "https://other/users/1"
+	signer.PublicKey.Owner = signer.ID
+	if err := signRequest(req, signer.PublicKey.ID, privateKey, body); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySignature(req, body, getActor); err != errInvalidSignature {
+		t.Error("Signature should not be valid for an actor of another host")
+	}
+}
+
+func TestSameHost(t *testing.T) {
+	for _, tc := range []struct {
+		urls     []string
+		expected bool
+	}{
+		{[]string{"https://remote/users/1#main-key", "https://remote/users/1", "https://REMOTE/users/1"}, true},
+		{[]string{"https://remote/users/1#main-key", "https://other/users/1"}, false},
+		{[]string{"https://remote/users/1", "/users/1"}, false},
+		{[]string{"https://remote:8443/users/1", "https://remote/users/1"}, false},
+	} {
+		if sameHost(tc.urls...) != tc.expected {
+			t.Errorf("%v: expected %t", tc.urls, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// records an admin action in the audit log
+func writeAuditLog(ctx *context, action string, targetID int64, details string) error {
+	entry := &auditEntry{
+		UserID:   ctx.user.ID,
+		Action:   action,
+		TargetID: targetID,
+		Details:  details,
+		IP:       ctx.remoteIP,
+	}
+	return ctx.datamapper.createAuditEntry(entry)
+}
+
+func getAuditLog(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	entries, err := ctx.datamapper.getAuditLog(getPage(r))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, entries, http.StatusOK)
+}
+
+// bans or shadow-bans a user. Banned users cannot log in; photos of
+// shadow-banned users are only visible to themselves.
+func banUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Banned       bool   `json:"banned"`
+		ShadowBanned bool   `json:"shadowBanned"`
+		Reason       string `json:"reason"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if target.IsAdmin {
+		return httpError{http.StatusForbidden, "Admins cannot be banned"}
+	}
+
+	target.IsBanned = s.Banned
+	target.IsShadowBanned = s.ShadowBanned
+
+	if err := ctx.datamapper.updateUser(target); err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("banned=%t shadowBanned=%t reason=%s", s.Banned, s.ShadowBanned, s.Reason)
+	if err := writeAuditLog(ctx, "ban", target.ID, details); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, newAdminUser(target), http.StatusOK)
+}
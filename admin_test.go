@@ -0,0 +1,47 @@
+package photoshare
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBanUser(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "admin", Email: "admin@example.com", IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &user{
+		Name:         "target",
+		Email:        "target@example.com",
+		Password:     "secret-hash",
+		RecoveryCode: sql.NullString{String: "secret-code", Valid: true},
+		IsActive:     true,
+	}
+	if err := dm.createUser(target); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/admin/users/%d/ban", target.ID),
+		strings.NewReader(`{"shadowBanned": true, "reason": "spam"}`))
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if u, _ := dm.getUser(target.ID); !u.IsShadowBanned || u.IsBanned {
+		t.Errorf("User should be shadow-banned, got %+v", u)
+	}
+	if body := res.Body.String(); strings.Contains(body, "secret") {
+		t.Errorf("Secrets should not be rendered, got %s", body)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 )
 
 // authentication behaviours
@@ -17,17 +18,42 @@ const (
 	authLevelAdmin                   // admin required, 401 if no user, 403 if not admin
 )
 
+// how often the last seen time of a session is updated
+const sessionTouchInterval = time.Minute
+
 // contains all the objects needed to run the application
 type app struct {
 	cfg        *config
 	db         *sql.DB
+	replica    *sql.DB
 	mailer     *mailer
 	router     *mux.Router
 	datamapper dataMapper
 	filestore  fileStorage
 	session    sessionManager
 	auth       authenticator
+	directory  directory
+	oidc       *oidcProvider
 	cache      cache
+	features   featureFlags
+	assets     *assets
+	proxies    *trustedProxies
+	fetcher    *http.Client
+	sites      siteResolver
+	translator *translator
+	labeler    labeler
+	captcha    captchaVerifier
+	reporter   errorReporter
+	checkout   checkoutProvider
+	limiter    *rateLimiter
+	previews   *previewTracker
+	processing *processingPool
+
+	// failed attempts at recovery codes, see recoverycodes.go
+	recoveryLimiter *rateLimiter
+
+	// passwords hashed again on login, see passwords.go
+	rehasher *passwordRehasher
 }
 
 // our custom handler
@@ -48,14 +74,52 @@ func newApp() (*app, error) {
 		return app, err
 	}
 
-	app.datamapper, err = newDataMapper(app.db, app.cfg.LogSql)
+	app.datamapper, err = newDataMapper(app.db, app.replica, app.cfg.LogSql)
+	if err != nil {
+		return app, err
+	}
+	app.sites = newSiteResolver(app.datamapper)
+
+	app.proxies, err = newTrustedProxies(app.cfg.TrustedProxies)
+	if err != nil {
+		return app, err
+	}
+
+	app.assets, err = newAssets(app.cfg)
+	if err != nil {
+		return app, err
+	}
+
+	app.translator, err = newTranslator(app.assets)
+	if err != nil {
+		return app, err
+	}
+
+	app.filestore, err = newFileStorage(app.cfg)
 	if err != nil {
 		return app, err
 	}
-	app.filestore = newFileStorage(app.cfg)
-	app.mailer = newMailer(app.cfg)
+	app.fetcher = newFetchClient()
+	app.labeler = newLabeler(app.cfg)
+	app.captcha = newCaptchaVerifier(app.cfg)
+	app.reporter = newErrorReporter(app.cfg)
+	app.checkout = newCheckoutProvider(app.cfg)
+	app.limiter = newRateLimiter(time.Duration(app.cfg.RateLimitWindow) * time.Second)
+	app.previews = newPreviewTracker(app.cfg)
+	app.recoveryLimiter = newRateLimiter(recoveryCodeWindow)
+	app.rehasher = newPasswordRehasher()
+	setPasswordPolicy(app.cfg)
+	app.processing = newProcessingPool(app.cfg)
+	app.mailer = newMailer(app.cfg, app.assets)
 	app.cache = newCache(app.cfg)
 	app.auth = newAuthenticator(app.cfg)
+	app.directory = newDirectory(app.cfg)
+	app.oidc = newOIDCProvider(app.cfg)
+
+	app.features, err = newFeatureFlags(app.cfg, app.datamapper)
+	if err != nil {
+		return app, err
+	}
 
 	app.session, err = newSessionManager(app.cfg)
 	if err != nil {
@@ -68,7 +132,13 @@ func newApp() (*app, error) {
 }
 
 func (app *app) close() {
+	if s, ok := app.filestore.(*replicatedStorage); ok {
+		s.close()
+	}
 	app.db.Close()
+	if app.replica != nil {
+		app.replica.Close()
+	}
 }
 
 func (app *app) initDB() error {
@@ -81,68 +151,150 @@ func (app *app) initDB() error {
 		return err
 	}
 	app.db = db
+
+	// the site keeps running on the primary without the replica
+	if app.cfg.DBReplicaHost != "" {
+		if app.replica, err = dbConnect(app.cfg.DBUser,
+			app.cfg.DBPassword,
+			app.cfg.DBName,
+			app.cfg.DBReplicaHost); err != nil {
+			logError(err)
+		}
+	}
 	return nil
 }
 
+// Errors returned when a request is not allowed. 401 means the request may
+// succeed after logging in; 403 means the logged in user is not allowed.
+var (
+	errLoginRequired = httpError{http.StatusUnauthorized, "You must be logged in"}
+	errAdminRequired = httpError{http.StatusForbidden, "You must be an admin"}
+	errBanned        = httpError{http.StatusForbidden, "Your account has been banned"}
+)
+
 // the handler should create a new context on each request, and handle any returned
-// errors appropriately.
+// errors appropriately. Every route goes through the same chain: find the
+// site, count the request against the rate limit, refuse writes in
+// maintenance, load the user from the session, then authorize the user for
+// the auth level.
 func (app *app) handler(h handlerFunc, level authLevel) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		defer app.recoverPanic(w, r)
 		handleError(w, r, func() error {
-			user, err := app.authenticate(r, level)
+			site, err := app.sites.resolve(r.Host)
 			if err != nil {
 				return err
 			}
-			return h(newContext(app, r, user), w, r)
-		}())
+			if err := app.checkRateLimit(w, r, site); err != nil {
+				return err
+			}
+			if err := app.checkMaintenance(w, r, site); err != nil {
+				return err
+			}
+			current := &user{}
+			if level != authLevelIgnore {
+				if current, err = app.loadUser(r, site); err != nil {
+					return err
+				}
+			}
+			if err := authorize(current, level); err != nil {
+				return err
+			}
+			// banned and suspended users are otherwise treated as logged out
+			if current.IsBanned || current.isSuspended() {
+				current = &user{}
+			}
+			ctx := newContext(app, r, site, current)
+			if current.Impersonator != nil {
+				if err := noteImpersonation(ctx, w, r); err != nil {
+					return err
+				}
+			}
+			return h(ctx, w, r)
+		}(), app.translator)
 	}
 }
 
-// lazily fetches the current session user
-func (app *app) authenticate(r *http.Request, level authLevel) (*user, error) {
+// returns the user of the current session, or an anonymous user if there is
+// no valid session for a user of the site
+func (app *app) loadUser(r *http.Request, site *site) (*user, error) {
+
+	anonymous := &user{}
+	datamapper := app.datamapper.forSite(site.ID)
 
-	if level == authLevelIgnore {
-		return &user{}, nil
+	userID, sessionKey, err := app.session.readToken(r)
+	if err != nil {
+		return nil, err
+	}
+	if userID == 0 {
+		return anonymous, nil
 	}
-	var errLoginRequired = httpError{http.StatusUnauthorized, "You must be logged in"}
 
-	var checkAuthLevel = func(user *user) error {
-		switch level {
-		case authLevelLogin:
-			if !user.IsAuthenticated {
-				return errLoginRequired
-			}
-			break
-		case authLevelAdmin:
-			if !user.IsAuthenticated {
-				return errLoginRequired
-			}
-			if !user.IsAdmin {
-				return httpError{http.StatusForbidden, "You must be an admin"}
-			}
+	// the session may have been revoked
+	session, err := datamapper.getSession(sessionKey)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return anonymous, nil
 		}
-		return nil
+		return nil, err
+	}
+	if session.UserID != userID || !app.session.allows(session, r) {
+		return anonymous, nil
 	}
 
-	user := &user{}
-
-	userID, err := app.session.readToken(r)
-	if err != nil {
-		return user, err
+	// an admin acting as the user, until the session expires
+	var admin *impersonator
+	if session.ImpersonatorID != nil {
+		if admin, err = loadImpersonator(datamapper, session); err != nil {
+			return nil, err
+		}
+		if admin == nil {
+			return anonymous, nil
+		}
 	}
-	if userID == 0 {
-		return user, checkAuthLevel(user)
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if err := datamapper.touchSession(session); err != nil {
+			return nil, err
+		}
 	}
-	user, err = app.datamapper.getActiveUser(userID)
+
+	user, err := datamapper.getActiveUser(userID)
 	if err != nil {
 		if isErrSqlNoRows(err) {
-			return user, checkAuthLevel(user)
+			return anonymous, nil
 		}
 		return nil, err
 	}
-	user.IsAuthenticated = true
 
-	return user, checkAuthLevel(user)
+	// banned and suspended users keep their identity so authorize can tell
+	// them why they are refused, but are not authenticated
+	if !user.IsBanned && !user.isSuspended() {
+		user.IsAuthenticated = true
+		user.SessionID = session.ID
+		user.Impersonator = admin
+	}
+	return user, nil
+}
+
+// checks the user is allowed routes of the auth level
+func authorize(user *user, level authLevel) error {
+	if level == authLevelIgnore || level == authLevelCheck {
+		return nil
+	}
+	if user.IsBanned {
+		return errBanned
+	}
+	if user.isSuspended() {
+		return errSuspended
+	}
+	if !user.IsAuthenticated {
+		return errLoginRequired
+	}
+	if level == authLevelAdmin && !user.IsAdmin {
+		return errAdminRequired
+	}
+	return nil
 }
 
 // generates the routes for the API
@@ -154,17 +306,37 @@ func (app *app) initRouter() {
 
 	photos := api.PathPrefix("/photos/").Subrouter()
 
-	photos.HandleFunc("/", app.handler(getPhotos, authLevelIgnore)).Methods("GET").Name("photos")
-	photos.HandleFunc("/", app.handler(upload, authLevelLogin)).Methods("POST").Name("photos")
-	photos.HandleFunc("/search", app.handler(searchPhotos, authLevelIgnore)).Methods("GET").Name("search")
-	photos.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(photosByOwnerID, authLevelIgnore)).Methods("GET").Name("owner")
+	photos.HandleFunc("/", app.handler(getPhotos, authLevelCheck)).Methods("GET").Name("photos")
+	photos.HandleFunc("/", app.handler(idempotent(upload), authLevelLogin)).Methods("POST").Name("photos")
+	photos.HandleFunc("/import", app.handler(importPhoto, authLevelLogin)).Methods("POST").Name("importPhoto")
+	photos.HandleFunc("/search", app.handler(searchPhotos, authLevelCheck)).Methods("GET").Name("search")
+	photos.HandleFunc("/search/download", app.handler(downloadSearch, authLevelCheck)).Methods("GET").Name("downloadSearch")
+	photos.HandleFunc("/random", app.handler(getRandomPhotos, authLevelCheck)).Methods("GET").Name("randomPhotos")
+	photos.HandleFunc("/staffpicks", app.handler(getStaffPicks, authLevelCheck)).Methods("GET").Name("staffPicks")
+	photos.HandleFunc("/lookup", app.handler(lookupPhotos, authLevelCheck)).Methods("POST").Name("lookupPhotos")
+	photos.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(photosByOwnerID, authLevelCheck)).Methods("GET").Name("owner")
 
 	photos.HandleFunc("/{id:[0-9]+}", app.handler(getPhotoDetail, authLevelCheck)).Methods("GET").Name("photoDetail")
 	photos.HandleFunc("/{id:[0-9]+}", app.handler(deletePhoto, authLevelLogin)).Methods("DELETE").Name("deletePhoto")
 	photos.HandleFunc("/{id:[0-9]+}/title", app.handler(editPhotoTitle, authLevelLogin)).Methods("PATCH").Name("editPhotoTitle")
+	photos.HandleFunc("/{id:[0-9]+}/alt", app.handler(editPhotoAltText, authLevelLogin)).Methods("PATCH").Name("editPhotoAltText")
+	photos.HandleFunc("/{id:[0-9]+}/original", app.handler(getOriginal, authLevelLogin)).Methods("GET", "HEAD").Name("original")
+	photos.HandleFunc("/{id:[0-9]+}/comments", app.handler(getComments, authLevelCheck)).Methods("GET").Name("comments")
+	photos.HandleFunc("/{id:[0-9]+}/comments", app.handler(addComment, authLevelLogin)).Methods("POST").Name("addComment")
+	photos.HandleFunc("/{id:[0-9]+}/comments/lock", app.handler(lockComments, authLevelLogin)).Methods("PATCH").Name("lockComments")
+	photos.HandleFunc("/{id:[0-9]+}/report", app.handler(reportPhoto, authLevelLogin)).Methods("POST").Name("reportPhoto")
+	photos.HandleFunc("/{id:[0-9]+}/qr", app.handler(getPhotoQR, authLevelCheck)).Methods("GET").Name("photoQR")
+	photos.HandleFunc("/{id:[0-9]+}/shortlink", app.handler(getShortlink, authLevelCheck)).Methods("GET").Name("shortlink")
+	photos.HandleFunc("/{id:[0-9]+}/sale", app.handler(setPhotoSale, authLevelLogin)).Methods("PATCH").Name("setPhotoSale")
+	photos.HandleFunc("/{id:[0-9]+}/purchase", app.handler(idempotent(purchasePhoto), authLevelLogin)).Methods("POST").Name("purchasePhoto")
+	photos.HandleFunc("/{id:[0-9]+}/expiry", app.handler(setPhotoExpiry, authLevelLogin)).Methods("PATCH").Name("setPhotoExpiry")
+	photos.HandleFunc("/{id:[0-9]+}/suggestions", app.handler(getSuggestions, authLevelLogin)).Methods("GET").Name("suggestions")
+	photos.HandleFunc("/{id:[0-9]+}/suggestions", app.handler(dismissSuggestions, authLevelLogin)).Methods("DELETE").Name("dismissSuggestions")
+	photos.HandleFunc("/{id:[0-9]+}/suggestions/accept", app.handler(acceptSuggestions, authLevelLogin)).Methods("POST").Name("acceptSuggestions")
 	photos.HandleFunc("/{id:[0-9]+}/tags", app.handler(editPhotoTags, authLevelLogin)).Methods("PATCH").Name("editPhotoTags")
-	photos.HandleFunc("/{id:[0-9]+}/upvote", app.handler(voteUp, authLevelLogin)).Methods("PATCH").Name("upvote")
-	photos.HandleFunc("/{id:[0-9]+}/downvote", app.handler(voteDown, authLevelLogin)).Methods("PATCH").Name("downvote")
+	photos.HandleFunc("/{id:[0-9]+}/upvote", app.handler(idempotent(voteUp), authLevelLogin)).Methods("PATCH").Name("upvote")
+	photos.HandleFunc("/{id:[0-9]+}/downvote", app.handler(idempotent(voteDown), authLevelLogin)).Methods("PATCH").Name("downvote")
+	photos.HandleFunc("/{id:[0-9]+}/staffpick", app.handler(setStaffPick, authLevelAdmin)).Methods("PUT").Name("setStaffPick")
 
 	auth := api.PathPrefix("/auth/").Subrouter()
 
@@ -174,20 +346,186 @@ func (app *app) initRouter() {
 	auth.HandleFunc("/emailExists", app.handler(emailExists, authLevelIgnore)).Methods("GET").Name("emailExists")
 	auth.HandleFunc("/signup", app.handler(signup, authLevelIgnore)).Methods("POST").Name("signup")
 	auth.HandleFunc("/recoverpass", app.handler(recoverPassword, authLevelIgnore)).Methods("PUT").Name("recoverPassword")
-	auth.HandleFunc("/changepass", app.handler(changePassword, authLevelIgnore)).Methods("PUT").Name("changePassword")
+	auth.HandleFunc("/changepass", app.handler(changePassword, authLevelCheck)).Methods("PUT").Name("changePassword")
 
 	auth.HandleFunc("/oauth2/{provider}/url", app.handler(getAuthRedirectURL, authLevelIgnore)).Methods("GET")
 	auth.HandleFunc("/oauth2/{provider}/callback/", app.handler(authCallback, authLevelIgnore)).Methods("GET")
-
+	auth.HandleFunc("/oidc/url", app.handler(getOIDCRedirectURL, authLevelIgnore)).Methods("GET").Name("oidcURL")
+	auth.HandleFunc("/oidc/callback", app.handler(oidcCallback, authLevelIgnore)).Methods("GET").Name("oidcCallback")
+	auth.HandleFunc("/oidc/link", app.handler(confirmOIDCLink, authLevelIgnore)).Methods("PUT").Name("oidcLink")
+
+	account := api.PathPrefix("/user/").Subrouter()
+
+	account.HandleFunc("/mentions", app.handler(getMentions, authLevelLogin)).Methods("GET").Name("mentions")
+	account.HandleFunc("/notifications", app.handler(getNotifications, authLevelLogin)).Methods("GET").Name("notifications")
+	account.HandleFunc("/activity", app.handler(getActivity, authLevelLogin)).Methods("GET").Name("activity")
+	account.HandleFunc("/notifications/read", app.handler(markAllNotificationsRead, authLevelLogin)).Methods("PATCH").Name("markAllNotificationsRead")
+	account.HandleFunc("/notifications/{id:[0-9]+}/read", app.handler(markNotificationRead, authLevelLogin)).Methods("PATCH").Name("markNotificationRead")
+	account.HandleFunc("/photos/batch", app.handler(batchPhotos, authLevelLogin)).Methods("POST").Name("batchPhotos")
+	account.HandleFunc("/portfolio", app.handler(arrangePortfolio, authLevelLogin)).Methods("PUT").Name("arrangePortfolio")
+	account.HandleFunc("/purchases", app.handler(getPurchases, authLevelLogin)).Methods("GET").Name("purchases")
+	account.HandleFunc("/trash", app.handler(getTrash, authLevelLogin)).Methods("GET").Name("trash")
+	account.HandleFunc("/trash/{id:[0-9]+}/restore", app.handler(restorePhoto, authLevelLogin)).Methods("POST").Name("restorePhoto")
+	account.HandleFunc("/settings", app.handler(getSettings, authLevelLogin)).Methods("GET").Name("settings")
+	account.HandleFunc("/settings", app.handler(updateSettings, authLevelLogin)).Methods("PATCH").Name("updateSettings")
+	account.HandleFunc("/push", app.handler(getPushSubscriptions, authLevelLogin)).Methods("GET").Name("pushSubscriptions")
+	account.HandleFunc("/push", app.handler(subscribePush, authLevelLogin)).Methods("POST").Name("subscribePush")
+	account.HandleFunc("/push/{id:[0-9]+}", app.handler(unsubscribePush, authLevelLogin)).Methods("DELETE").Name("unsubscribePush")
+	account.HandleFunc("/name", app.handler(changeName, authLevelLogin)).Methods("PUT").Name("changeName")
+	account.HandleFunc("/slug", app.handler(changeSlug, authLevelLogin)).Methods("PUT").Name("changeSlug")
+	account.HandleFunc("/email", app.handler(changeEmail, authLevelLogin)).Methods("PUT").Name("changeEmail")
+	account.HandleFunc("/email/confirm", app.handler(confirmEmailChange, authLevelIgnore)).Methods("PUT").Name("confirmEmailChange")
+	account.HandleFunc("/impersonation", app.handler(stopImpersonation, authLevelLogin)).Methods("DELETE").Name("stopImpersonation")
+	account.HandleFunc("/sessions", app.handler(getSessions, authLevelLogin)).Methods("GET").Name("sessions")
+	account.HandleFunc("/sessions/{id:[0-9]+}", app.handler(revokeSession, authLevelLogin)).Methods("DELETE").Name("revokeSession")
+	account.HandleFunc("/blocks", app.handler(getBlockedUsers, authLevelLogin)).Methods("GET").Name("blockedUsers")
+	account.HandleFunc("/blocks/{userID:[0-9]+}", app.handler(blockUser, authLevelLogin)).Methods("POST").Name("blockUser")
+	account.HandleFunc("/blocks/{userID:[0-9]+}", app.handler(unblockUser, authLevelLogin)).Methods("DELETE").Name("unblockUser")
+	account.HandleFunc("/mutes/{userID:[0-9]+}", app.handler(muteUser, authLevelLogin)).Methods("POST").Name("muteUser")
+	account.HandleFunc("/mutes/{userID:[0-9]+}", app.handler(unblockUser, authLevelLogin)).Methods("DELETE").Name("unmuteUser")
+	account.HandleFunc("/follows", app.handler(getFollows, authLevelLogin)).Methods("GET").Name("follows")
+	account.HandleFunc("/follows/{userID:[0-9]+}", app.handler(followUser, authLevelLogin)).Methods("POST").Name("followUser")
+	account.HandleFunc("/follows/{userID:[0-9]+}", app.handler(unfollowUser, authLevelLogin)).Methods("DELETE").Name("unfollowUser")
+	account.HandleFunc("/feed", app.handler(getFeed, authLevelLogin)).Methods("GET").Name("feed")
+
+	groups := api.PathPrefix("/groups/").Subrouter()
+
+	groups.HandleFunc("/", app.handler(getGroups, authLevelIgnore)).Methods("GET").Name("groups")
+	groups.HandleFunc("/", app.handler(createGroup, authLevelLogin)).Methods("POST").Name("createGroup")
+	groups.HandleFunc("/{id:[0-9]+}", app.handler(getGroupDetail, authLevelCheck)).Methods("GET").Name("groupDetail")
+	groups.HandleFunc("/{id:[0-9]+}/join", app.handler(joinGroup, authLevelLogin)).Methods("POST").Name("joinGroup")
+	groups.HandleFunc("/{id:[0-9]+}/join", app.handler(leaveGroup, authLevelLogin)).Methods("DELETE").Name("leaveGroup")
+	groups.HandleFunc("/{id:[0-9]+}/members", app.handler(getGroupMembers, authLevelCheck)).Methods("GET").Name("groupMembers")
+	groups.HandleFunc("/{id:[0-9]+}/members/{userID:[0-9]+}/approve", app.handler(approveGroupMember, authLevelLogin)).Methods("PATCH").Name("approveGroupMember")
+	groups.HandleFunc("/{id:[0-9]+}/members/{userID:[0-9]+}/moderator", app.handler(setGroupModerator, authLevelLogin)).Methods("PUT").Name("setGroupModerator")
+	groups.HandleFunc("/{id:[0-9]+}/members/{userID:[0-9]+}", app.handler(removeGroupMember, authLevelLogin)).Methods("DELETE").Name("removeGroupMember")
+	groups.HandleFunc("/{id:[0-9]+}/photos", app.handler(getGroupPhotos, authLevelCheck)).Methods("GET").Name("groupPhotos")
+	groups.HandleFunc("/{id:[0-9]+}/download", app.handler(downloadGroup, authLevelCheck)).Methods("GET").Name("downloadGroup")
+	groups.HandleFunc("/{id:[0-9]+}/photos/{photoID:[0-9]+}", app.handler(addGroupPhoto, authLevelLogin)).Methods("POST").Name("addGroupPhoto")
+	groups.HandleFunc("/{id:[0-9]+}/photos/{photoID:[0-9]+}", app.handler(removeGroupPhoto, authLevelLogin)).Methods("DELETE").Name("removeGroupPhoto")
+
+	contests := api.PathPrefix("/contests/").Subrouter()
+
+	contests.HandleFunc("/", app.handler(getContests, authLevelIgnore)).Methods("GET").Name("contests")
+	contests.HandleFunc("/", app.handler(createContest, authLevelAdmin)).Methods("POST").Name("createContest")
+	contests.HandleFunc("/{id:[0-9]+}", app.handler(getContestDetail, authLevelIgnore)).Methods("GET").Name("contestDetail")
+	contests.HandleFunc("/{id:[0-9]+}/entries", app.handler(getContestEntries, authLevelCheck)).Methods("GET").Name("contestEntries")
+	contests.HandleFunc("/{id:[0-9]+}/vote/{photoID:[0-9]+}", app.handler(idempotent(voteInContest), authLevelLogin)).Methods("POST").Name("voteInContest")
+
+	challenges := api.PathPrefix("/challenges/").Subrouter()
+
+	challenges.HandleFunc("/", app.handler(getChallenges, authLevelIgnore)).Methods("GET").Name("challenges")
+	challenges.HandleFunc("/", app.handler(createChallenge, authLevelAdmin)).Methods("POST").Name("createChallenge")
+	challenges.HandleFunc("/current", app.handler(getCurrentChallenge, authLevelIgnore)).Methods("GET").Name("currentChallenge")
+	challenges.HandleFunc("/{id:[0-9]+}", app.handler(getChallengeDetail, authLevelIgnore)).Methods("GET").Name("challengeDetail")
+	challenges.HandleFunc("/{id:[0-9]+}/entries", app.handler(getChallengeEntries, authLevelCheck)).Methods("GET").Name("challengeEntries")
+
+	api.HandleFunc("/comments/{id:[0-9]+}", app.handler(editComment, authLevelLogin)).Methods("PATCH").Name("editComment")
+	api.HandleFunc("/comments/{id:[0-9]+}", app.handler(deleteComment, authLevelLogin)).Methods("DELETE").Name("deleteComment")
+	api.HandleFunc("/features", app.handler(getFeatures, authLevelCheck)).Methods("GET").Name("features")
+	api.HandleFunc("/captcha", app.handler(getCaptcha, authLevelIgnore)).Methods("GET").Name("captcha")
+	api.HandleFunc("/checkout/webhook", app.handler(checkoutWebhook, authLevelIgnore)).Methods("POST").Name("checkoutWebhook")
+	api.HandleFunc("/push/key", app.handler(getPushKey, authLevelIgnore)).Methods("GET").Name("pushKey")
+	api.HandleFunc("/site", app.handler(getSite, authLevelIgnore)).Methods("GET").Name("site")
+	api.HandleFunc("/users/{name}", app.handler(getProfile, authLevelIgnore)).Methods("GET").Name("profile")
+	api.HandleFunc("/users/{id:[0-9]+}/portfolio", app.handler(getPortfolio, authLevelCheck)).Methods("GET").Name("portfolio")
+	api.HandleFunc("/users/{id:[0-9]+}/albums/{album}", app.handler(getPortfolioAlbum, authLevelCheck)).Methods("GET").Name("portfolioAlbum")
+	api.HandleFunc("/u/{slug}", app.handler(getSlugProfile, authLevelIgnore)).Methods("GET").Name("slugProfile")
+	api.HandleFunc("/u/{slug}/portfolio", app.handler(getPortfolio, authLevelCheck)).Methods("GET").Name("slugPortfolio")
+	api.HandleFunc("/u/{slug}/albums/{album}", app.handler(getPortfolioAlbum, authLevelCheck)).Methods("GET").Name("slugPortfolioAlbum")
+
+	admin := api.PathPrefix("/admin/").Subrouter()
+
+	admin.HandleFunc("/users/{id:[0-9]+}/ban", app.handler(banUser, authLevelAdmin)).Methods("PATCH").Name("banUser")
+	admin.HandleFunc("/users/{id:[0-9]+}/impersonate", app.handler(startImpersonation, authLevelAdmin)).Methods("POST").Name("startImpersonation")
+	admin.HandleFunc("/users/{id:[0-9]+}/moderation", app.handler(getModeration, authLevelAdmin)).Methods("GET").Name("moderation")
+	admin.HandleFunc("/users/{id:[0-9]+}/moderation", app.handler(setModeration, authLevelAdmin)).Methods("PATCH").Name("setModeration")
+	admin.HandleFunc("/users/{id:[0-9]+}/notes", app.handler(addModerationNote, authLevelAdmin)).Methods("POST").Name("addModerationNote")
+	admin.HandleFunc("/users/{id:[0-9]+}/retention", app.handler(setUserRetention, authLevelAdmin)).Methods("PATCH").Name("setUserRetention")
+	admin.HandleFunc("/storage/corruptions", app.handler(getStorageCorruptions, authLevelAdmin)).Methods("GET").Name("storageCorruptions")
+	admin.HandleFunc("/features", app.handler(getFeatureFlags, authLevelAdmin)).Methods("GET").Name("featureFlags")
+	admin.HandleFunc("/features/{name}", app.handler(setFeatureFlag, authLevelAdmin)).Methods("PUT").Name("setFeatureFlag")
+	admin.HandleFunc("/maintenance", app.handler(getMaintenance, authLevelAdmin)).Methods("GET").Name("maintenance")
+	admin.HandleFunc("/maintenance", app.handler(setMaintenance, authLevelAdmin)).Methods("PUT").Name("setMaintenance")
+	admin.HandleFunc("/scores/recompute", app.handler(recomputeScores, authLevelAdmin)).Methods("POST").Name("recomputeScores")
+	admin.HandleFunc("/photos/held", app.handler(getHeldPhotos, authLevelAdmin)).Methods("GET").Name("heldPhotos")
+	admin.HandleFunc("/photos/{id:[0-9]+}/approve", app.handler(approvePhoto, authLevelAdmin)).Methods("PATCH").Name("approvePhoto")
+	admin.HandleFunc("/blocklist", app.handler(getBlockedWords, authLevelAdmin)).Methods("GET").Name("blockedWords")
+	admin.HandleFunc("/blocklist", app.handler(addBlockedWord, authLevelAdmin)).Methods("POST").Name("addBlockedWord")
+	admin.HandleFunc("/blocklist/{id:[0-9]+}", app.handler(removeBlockedWord, authLevelAdmin)).Methods("DELETE").Name("removeBlockedWord")
+	admin.HandleFunc("/reports", app.handler(getReports, authLevelAdmin)).Methods("GET").Name("reports")
+	admin.HandleFunc("/reports/{id:[0-9]+}", app.handler(resolveReport, authLevelAdmin)).Methods("PATCH").Name("resolveReport")
+	admin.HandleFunc("/strikes", app.handler(getStrikeThresholds, authLevelAdmin)).Methods("GET").Name("strikeThresholds")
+	admin.HandleFunc("/strikes", app.handler(setStrikeThresholds, authLevelAdmin)).Methods("PUT").Name("setStrikeThresholds")
+	admin.HandleFunc("/audit", app.handler(getAuditLog, authLevelAdmin)).Methods("GET").Name("auditLog")
+	admin.HandleFunc("/homepage", app.handler(getHomepagePins, authLevelAdmin)).Methods("GET").Name("homepagePins")
+	admin.HandleFunc("/homepage", app.handler(setHomepagePins, authLevelAdmin)).Methods("PUT").Name("setHomepagePins")
+
+	api.HandleFunc("/sync", app.handler(getSync, authLevelCheck)).Methods("GET").Name("sync")
+	api.HandleFunc("/uploads/", app.handler(idempotent(bulkUpload), authLevelLogin)).Methods("POST").Name("bulkUpload")
+	api.HandleFunc("/uploads/{id:[0-9A-Za-z]+}/status", app.handler(getUploadStatus, authLevelLogin)).Methods("GET").Name("uploadStatus")
+	api.HandleFunc("/gear/", app.handler(getGear, authLevelIgnore)).Methods("GET").Name("gear")
+	api.HandleFunc("/gear/{model:.+}/photos", app.handler(getGearPhotos, authLevelCheck)).Methods("GET").Name("gearPhotos")
 	api.HandleFunc("/tags/", app.handler(getTags, authLevelIgnore)).Methods("GET").Name("tags")
-	api.Handle("/messages/{path:.*}", messageHandler).Name("messages")
+	api.HandleFunc("/tags/{name}", app.handler(editTag, authLevelAdmin)).Methods("PATCH").Name("editTag")
+	api.HandleFunc("/tags/{name}/photos", app.handler(getTagPhotos, authLevelCheck)).Methods("GET").Name("tagPhotos")
+	api.HandleFunc("/tags/{name}/follow", app.handler(followTag, authLevelLogin)).Methods("POST").Name("followTag")
+	api.HandleFunc("/tags/{name}/follow", app.handler(unfollowTag, authLevelLogin)).Methods("DELETE").Name("unfollowTag")
+	api.Handle("/messages/{path:.*}", newMessageHandler(app.sites)).Name("messages")
 
 	feeds := app.router.PathPrefix("/feeds/").Subrouter()
 
 	feeds.HandleFunc("", app.handler(latestFeed, authLevelIgnore)).Methods("GET").Name("latestFeed")
 	feeds.HandleFunc("popular/", app.handler(popularFeed, authLevelIgnore)).Methods("GET").Name("popularFeed")
 	feeds.HandleFunc("owner/{ownerID:[0-9]+}", app.handler(ownerFeed, authLevelIgnore)).Methods("GET").Name("ownerFeed")
+	feeds.HandleFunc("group/{id:[0-9]+}", app.handler(groupFeed, authLevelIgnore)).Methods("GET").Name("groupFeed")
+
+	app.router.HandleFunc("/.well-known/webfinger", app.handler(webfinger, authLevelIgnore)).Methods("GET").Name("webfinger")
 
-	app.router.PathPrefix("/").Handler(http.FileServer(http.Dir(app.cfg.PublicDir)))
+	ap := app.router.PathPrefix("/ap/").Subrouter()
+
+	ap.HandleFunc("/users/{id:[0-9]+}", app.handler(getActor, authLevelIgnore)).Methods("GET").Name("actor")
+	ap.HandleFunc("/users/{id:[0-9]+}/outbox", app.handler(getOutbox, authLevelIgnore)).Methods("GET").Name("outbox")
+	ap.HandleFunc("/users/{id:[0-9]+}/followers", app.handler(getFollowersCollection, authLevelIgnore)).Methods("GET").Name("followers")
+	ap.HandleFunc("/users/{id:[0-9]+}/inbox", app.handler(postInbox, authLevelIgnore)).Methods("POST").Name("inbox")
+	ap.HandleFunc("/photos/{id:[0-9]+}", app.handler(getPhotoObject, authLevelIgnore)).Methods("GET").Name("photoObject")
+
+	scimUsers := app.router.PathPrefix("/scim/v2/Users").Subrouter()
+
+	scimUsers.HandleFunc("", app.handler(scim(getSCIMUsers), authLevelIgnore)).Methods("GET").Name("scimUsers")
+	scimUsers.HandleFunc("", app.handler(scim(createSCIMUser), authLevelIgnore)).Methods("POST").Name("createSCIMUser")
+	scimUsers.HandleFunc("/{id:[0-9]+}", app.handler(scim(getSCIMUser), authLevelIgnore)).Methods("GET").Name("scimUser")
+	scimUsers.HandleFunc("/{id:[0-9]+}", app.handler(scim(replaceSCIMUser), authLevelIgnore)).Methods("PUT").Name("replaceSCIMUser")
+	scimUsers.HandleFunc("/{id:[0-9]+}", app.handler(scim(patchSCIMUser), authLevelIgnore)).Methods("PATCH").Name("patchSCIMUser")
+	scimUsers.HandleFunc("/{id:[0-9]+}", app.handler(scim(deleteSCIMUser), authLevelIgnore)).Methods("DELETE").Name("deleteSCIMUser")
+
+	embed := app.router.PathPrefix("/embed/").Subrouter()
+
+	embed.HandleFunc("/photo/{id:[0-9]+}", app.handler(getPhotoEmbed, authLevelIgnore)).Methods("GET").Name("photoEmbed")
+	embed.HandleFunc("/photo/{id:[0-9]+}.js", app.handler(getPhotoEmbedScript, authLevelIgnore)).Methods("GET").Name("photoEmbedScript")
+
+	iiif := app.router.PathPrefix("/iiif/").Subrouter()
+
+	iiif.HandleFunc("/{id:[0-9]+}", app.handler(getIIIFBase, authLevelIgnore)).Methods("GET").Name("iiifBase")
+	iiif.HandleFunc("/{id:[0-9]+}/info.json", app.handler(getIIIFInfo, authLevelCheck)).Methods("GET").Name("iiifInfo")
+	iiif.HandleFunc("/{id:[0-9]+}/{region}/{size}/{rotation}/{quality:[a-z]+}.{format:[a-z]+}",
+		app.handler(getIIIFImage, authLevelCheck)).Methods("GET").Name("iiifImage")
+
+	if app.cfg.PublicMaxSize > 0 {
+		app.router.HandleFunc("/uploads/{filename:[^/]+}", app.handler(getPublicUpload, authLevelIgnore)).Methods("GET", "HEAD")
+	} else if app.cfg.ImageFormats != "" {
+		app.router.HandleFunc("/uploads/{filename:[^/]+}", app.handler(getUpload, authLevelIgnore)).Methods("GET", "HEAD")
+	} else if app.cfg.StorageMasterKey != "" {
+		app.router.HandleFunc("/uploads/{filename:[^/]+}", app.handler(getStoredUpload, authLevelIgnore)).Methods("GET", "HEAD")
+	}
+	app.router.HandleFunc("/p/{code:[0-9A-Za-z]+}", app.handler(followShortlink, authLevelIgnore)).Methods("GET").Name("followShortlink")
+	app.router.HandleFunc("/u/{slug}", app.handler(redirectSlug, authLevelIgnore)).Methods("GET").Name("slugRedirect")
+	if app.cfg.StorageMasterKey != "" {
+		// the files on disk are encrypted
+		app.router.HandleFunc("/uploads/thumbnails/{filename:[^/]+}", app.handler(getStoredThumbnail, authLevelIgnore)).Methods("GET", "HEAD")
+	} else {
+		app.router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir(app.cfg.UploadsDir))))
+	}
+	app.router.PathPrefix("/").Handler(app.assets)
 
 }
@@ -0,0 +1,223 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestEditPhotoTitleAuthorization(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := dm.login(&user{Name: "other", Email: "other@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("http://localhost/api/photos/%d/title", p.ID)
+
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{fmt.Sprintf("%d:revoked", owner.ID), http.StatusUnauthorized},
+		{otherToken, http.StatusForbidden},
+		{ownerToken, http.StatusOK},
+	} {
+		req, _ := http.NewRequest("PATCH", url, strings.NewReader(`{"title": "new title"}`))
+		req.Header.Set(tokenHeader, tc.token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("Token %q: expected %d, got %d", tc.token, tc.status, res.Code)
+		}
+	}
+
+	if p, _ := dm.getPhoto(p.ID); p.Title != "new title" {
+		t.Error("Title should be updated by the owner")
+	}
+}
+
+func TestEditPhotoAltText(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("http://localhost/api/photos/%d/alt", p.ID)
+
+	for _, tc := range []struct {
+		altText string
+		status  int
+	}{
+		{strings.Repeat("x", maxAltTextLength+1), http.StatusBadRequest},
+		{"A heron standing in shallow water", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("PATCH", url, strings.NewReader(fmt.Sprintf(`{"altText": %q}`, tc.altText)))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("Expected %d, got %d", tc.status, res.Code)
+		}
+	}
+
+	if p, _ := dm.getPhoto(p.ID); p.AltText != "A heron standing in shallow water" {
+		t.Errorf("Alt text should be updated, got %q", p.AltText)
+	}
+}
+
+func TestEditPhotoConflict(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/api/photos/%d", p.ID), nil)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Photo should have an ETag")
+	}
+
+	edit := func(path, body string) int {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/%s", p.ID, path), strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		req.Header.Set("If-Match", etag)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// both edits were made from the same version of the photo
+	if code := edit("title", `{"title": "first"}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if code := edit("tags", `{"tags": ["second"]}`); code != http.StatusConflict {
+		t.Errorf("Expected 409, got %d", code)
+	}
+
+	p, _ = dm.getPhoto(p.ID)
+	if p.Title != "first" || len(p.Tags) != 0 {
+		t.Errorf("Second edit should not be saved, got %+v", p)
+	}
+
+	// a stale version fails when saved, even without If-Match
+	p.Title = "stale"
+	p.Version--
+	if err := dm.updatePhoto(p); err != errPhotoConflict {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("title", "test")
+	form.WriteField("taglist", "one two")
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="photo"; filename="test.png"`)
+	h.Set("Content-Type", "image/png")
+	part, _ := form.CreatePart(h)
+	part.Write([]byte("not really a png"))
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/photos/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+
+	value := &photo{}
+	parseJSONBody(res, value)
+
+	store := app.filestore.(*memoryFileStorage)
+	if string(store.files[value.Filename]) != "not really a png" {
+		t.Error("Upload should be stored")
+	}
+	if _, ok := store.thumbnails[value.Filename]; !ok {
+		t.Error("Thumbnail should be stored")
+	}
+	if p, err := dm.getPhoto(value.ID); err != nil || p.Title != "test" {
+		t.Error("Photo should be created")
+	}
+}
+
+func TestImportPhotoBlocksInternalAddresses(t *testing.T) {
+
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Internal server should not be fetched")
+	}))
+	defer internal.Close()
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{internal.URL, "file:///etc/passwd", "http://[::1]/"} {
+		body := fmt.Sprintf(`{"url": %q, "title": "test"}`, url)
+		req, _ := http.NewRequest("POST", "http://localhost/api/photos/import", strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", url, res.Code)
+		}
+	}
+}
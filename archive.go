@@ -0,0 +1,196 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// An archive is a directory holding archive.json and a photos directory with
+// the original image files:
+//
+//	archive.json   {"version": 1, "exportedAt": ..., "users": [...], "photos": [...]}
+//	photos/<file>  image named by the "file" of each photo
+//
+// Users include their password hash, so an archive should be treated as a
+// secret. Votes are the IDs of the photos each user voted on; the up and down
+// vote counts are stored on the photos.
+
+const (
+	archiveVersion   = 1
+	archiveFile      = "archive.json"
+	archivePhotosDir = "photos"
+)
+
+type archive struct {
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exportedAt"`
+	Users      []archiveUser  `json:"users"`
+	Photos     []archivePhoto `json:"photos"`
+}
+
+type archiveUser struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Password  string    `json:"password"`
+	IsAdmin   bool      `json:"isAdmin"`
+	IsActive  bool      `json:"isActive"`
+	CreatedAt time.Time `json:"createdAt"`
+	Votes     []int64   `json:"votes"`
+
+	// see passwords.go; archives made before are of bcrypt hashes
+	PasswordAlgorithm string `json:"passwordAlgorithm,omitempty"`
+	PasswordPepper    string `json:"passwordPepper,omitempty"`
+}
+
+type archivePhoto struct {
+	ID        int64      `json:"id"`
+	OwnerID   int64      `json:"ownerId"`
+	Title     string     `json:"title"`
+	AltText   string     `json:"altText,omitempty"`
+	Private   bool       `json:"private,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Filename  string     `json:"file"`
+	Tags      []string   `json:"tags"`
+	UpVotes   int64      `json:"upVotes"`
+	DownVotes int64      `json:"downVotes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	TakenAt   *time.Time `json:"takenAt,omitempty"`
+	Latitude  *float64   `json:"latitude,omitempty"`
+	Longitude *float64   `json:"longitude,omitempty"`
+	Camera    string     `json:"camera,omitempty"`
+	Lens      string     `json:"lens,omitempty"`
+}
+
+// writes all users and photos to an archive in the directory
+func exportArchive(app *app, dirname string) error {
+
+	users, err := app.datamapper.getAllUsers()
+	if err != nil {
+		return err
+	}
+
+	photos, err := app.datamapper.getAllPhotos()
+	if err != nil {
+		return err
+	}
+
+	a := &archive{Version: archiveVersion, ExportedAt: utcNow()}
+
+	for _, u := range users {
+		a.Users = append(a.Users, archiveUser{
+			u.ID, u.Name, u.Email, u.Password, u.IsAdmin, u.IsActive, u.CreatedAt, u.getVotes(), u.PasswordAlgorithm, u.PasswordPepper,
+		})
+	}
+
+	if err := os.MkdirAll(filepath.Join(dirname, archivePhotosDir), 0755); err != nil {
+		return err
+	}
+
+	for _, p := range photos {
+		a.Photos = append(a.Photos, archivePhoto{
+			p.ID, p.OwnerID, p.Title, p.AltText, p.Private, p.ExpiresAt, p.Filename, p.Tags, p.UpVotes, p.DownVotes, p.CreatedAt,
+			p.TakenAt, p.Latitude, p.Longitude, p.Camera, p.Lens,
+		})
+		if err := copyFromStore(app.filestore, p.Filename, filepath.Join(dirname, archivePhotosDir, p.Filename)); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dirname, archiveFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+func copyFromStore(store fileStorage, name, dest string) error {
+	src, err := store.open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func readArchive(dirname string) (*archive, error) {
+	body, err := ioutil.ReadFile(filepath.Join(dirname, archiveFile))
+	if err != nil {
+		return nil, err
+	}
+	a := &archive{}
+	if err := json.Unmarshal(body, a); err != nil {
+		return nil, fmt.Errorf("invalid archive: %s", err)
+	}
+	if a.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+	return a, nil
+}
+
+// loads the archive in the directory. If preserveIDs is false, users and
+// photos get new IDs, so an archive can be merged into a site with content.
+func importArchive(app *app, dirname string, preserveIDs bool) error {
+
+	a, err := readArchive(dirname)
+	if err != nil {
+		return err
+	}
+
+	// store the files first, so no photo exists without its file
+	for _, p := range a.Photos {
+		if err := storeArchiveFile(app.filestore, filepath.Join(dirname, archivePhotosDir, p.Filename), p.Filename); err != nil {
+			return fmt.Errorf("%s: %s", p.Filename, err)
+		}
+	}
+
+	if err := app.datamapper.importArchive(a, preserveIDs); err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d users and %d photos", len(a.Users), len(a.Photos))
+	return app.cache.clear()
+}
+
+func storeArchiveFile(store fileStorage, filename, name string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := f.Read(head)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	contentType := http.DetectContentType(head[:n])
+	if !isAllowedContentType(contentType) {
+		return errors.New("unsupported image type " + contentType)
+	}
+	return store.store(f, name, contentType)
+}
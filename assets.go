@@ -0,0 +1,119 @@
+package photoshare
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Public files and templates are read from PUBLIC_DIR and TEMPLATES_DIR, or
+// from the binary when built with the "embed" tag (see assets_embed.go).
+
+type assets struct {
+	public    http.FileSystem
+	templates http.FileSystem
+	embedded  bool
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+const (
+	indexFile         = "/index.html"
+	assetCacheControl = "public, max-age=3600"
+)
+
+// reads a template file
+func (a *assets) readTemplate(name string) ([]byte, error) {
+	f, err := a.templates.Open("/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// embedded files have no modification time, so the ETag is a hash of the
+// content, computed once per file
+func (a *assets) etag(name string, f http.File) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if tag, ok := a.etags[name]; ok {
+		return tag, nil
+	}
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	tag := fmt.Sprintf(`"%x"`, h.Sum(nil))
+	a.etags[name] = tag
+	return tag, nil
+}
+
+// serves the public files. Paths without a file extension are client-side
+// routes, so get the index page.
+func (a *assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	name := path.Clean("/" + r.URL.Path)
+
+	if strings.HasPrefix(name, "/api/") || (r.Method != "GET" && r.Method != "HEAD") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := a.public.Open(name)
+	if err == nil {
+		if info, err := f.Stat(); err != nil || info.IsDir() {
+			f.Close()
+			f, name = nil, indexFile
+		}
+	} else if path.Ext(name) == "" {
+		name = indexFile
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	if f == nil {
+		if f, err = a.public.Open(name); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the index page links to the other assets, so it must always be checked
+	if name == indexFile {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", assetCacheControl)
+	}
+
+	if a.embedded {
+		tag, err := a.etag(name, f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", tag)
+	}
+
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,16 @@
+//go:build !embed
+// +build !embed
+
+package photoshare
+
+import (
+	"net/http"
+)
+
+func newAssets(cfg *config) (*assets, error) {
+	return &assets{
+		public:    http.Dir(cfg.PublicDir),
+		templates: http.Dir(cfg.TemplatesDir),
+		etags:     make(map[string]string),
+	}, nil
+}
@@ -0,0 +1,36 @@
+//go:build embed
+// +build embed
+
+package photoshare
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	// user timezones must load on hosts without a timezone database
+	_ "time/tzdata"
+)
+
+// public must be built with "make build-ui" first. Uploads are always served
+// from UPLOADS_DIR, which should be outside public in an embedded build.
+//
+//go:embed public templates
+var embeddedFiles embed.FS
+
+func newAssets(cfg *config) (*assets, error) {
+	public, err := fs.Sub(embeddedFiles, "public")
+	if err != nil {
+		return nil, err
+	}
+	templates, err := fs.Sub(embeddedFiles, "templates")
+	if err != nil {
+		return nil, err
+	}
+	return &assets{
+		public:    http.FS(public),
+		templates: http.FS(templates),
+		embedded:  true,
+		etags:     make(map[string]string),
+	}, nil
+}
@@ -0,0 +1,49 @@
+package photoshare
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssetsIndexFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "app.css"), []byte("css"), 0644)
+
+	a := &assets{public: http.Dir(dir), etags: make(map[string]string)}
+
+	for _, tc := range []struct {
+		path, body   string
+		status       int
+		cacheControl string
+	}{
+		{"/", "index", http.StatusOK, "no-cache"},
+		{"/photos/1", "index", http.StatusOK, "no-cache"},
+		{"/app.css", "css", http.StatusOK, assetCacheControl},
+		{"/missing.js", "", http.StatusNotFound, ""},
+		{"/api/missing", "", http.StatusNotFound, ""},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost"+tc.path, nil)
+		res := httptest.NewRecorder()
+		a.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, res.Code)
+			continue
+		}
+		if tc.status == http.StatusOK && res.Body.String() != tc.body {
+			t.Errorf("%s: expected body %q, got %q", tc.path, tc.body, res.Body.String())
+		}
+		if res.Header().Get("Cache-Control") != tc.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q", tc.path, tc.cacheControl)
+		}
+	}
+}
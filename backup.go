@@ -0,0 +1,293 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// A backup is a directory holding a dump of the database, of every site,
+// and a manifest of the uploads it refers to, with a copy of them unless
+// they are backed up otherwise, e.g. by STORAGE_REPLICA:
+//
+//	manifest.json  {"version": 1, "createdAt": ..., "files": [{"name": ..., "size": ..., "checksum": ...}]}
+//	database.dump  dump of pg_dump in its custom format
+//	files/<name>   the uploaded file
+//
+// The dump and the manifest are taken from the same snapshot of the
+// database, so every photo of the dump is in the manifest. Restoring loads
+// the dump with pg_restore, replacing the database, copies the files the
+// storage lacks from the backup, and checks every file of the manifest
+// against its checksum. pg_dump and pg_restore must be installed.
+
+const (
+	backupVersion      = 1
+	backupManifestFile = "manifest.json"
+	backupDumpFile     = "database.dump"
+	backupFilesDir     = "files"
+)
+
+type backupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Files     []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// returns the command running pg_dump or pg_restore on the database
+func pgCommand(cfg *config, name string, args ...string) *exec.Cmd {
+	args = append([]string{"--host", cfg.DBHost, "--username", cfg.DBUser, "--dbname", cfg.DBName, "--no-password"}, args...)
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+cfg.DBPassword)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// writes a backup to the directory, which must not exist
+func writeBackup(app *app, dirname string, withFiles bool) error {
+
+	if err := os.Mkdir(dirname, 0700); err != nil {
+		return err
+	}
+
+	// the snapshot lasts as long as the transaction exporting it
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY"); err != nil {
+		return err
+	}
+
+	var snapshot string
+	if err := tx.QueryRow("SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return err
+	}
+
+	var names []string
+	rows, err := tx.Query("SELECT photo FROM photos ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Dumping the database to %s", filepath.Join(dirname, backupDumpFile))
+	if err := pgCommand(app.cfg, "pg_dump", "--format=custom", "--snapshot="+snapshot,
+		"--file="+filepath.Join(dirname, backupDumpFile)).Run(); err != nil {
+		return fmt.Errorf("pg_dump: %s", err)
+	}
+	tx.Rollback()
+
+	m := &backupManifest{Version: backupVersion, CreatedAt: utcNow()}
+	failed := backupFiles(app.filestore, names, dirname, withFiles, m)
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirname, backupManifestFile), body, 0600); err != nil {
+		return err
+	}
+	log.Printf("Backed up the database and %d files to %s", len(m.Files), dirname)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be read and are not in the backup", failed)
+	}
+	return nil
+}
+
+// adds the files to the manifest, copying them to the backup if withFiles
+// is set, and returns the number that could not be read
+func backupFiles(store fileStorage, names []string, dirname string, withFiles bool, m *backupManifest) int {
+
+	if withFiles {
+		if err := os.MkdirAll(filepath.Join(dirname, backupFilesDir), 0700); err != nil {
+			logError(err)
+			return len(names)
+		}
+	}
+
+	var failed int
+	for _, name := range names {
+		f, err := backupFileOf(store, name, dirname, withFiles)
+		if err != nil {
+			log.Printf("Cannot back up %s: %s", name, err)
+			failed++
+			continue
+		}
+		m.Files = append(m.Files, *f)
+	}
+	return failed
+}
+
+func backupFileOf(store fileStorage, name, dirname string, withFiles bool) (*backupFile, error) {
+
+	src, err := store.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var r io.Reader = src
+	if withFiles {
+		dst, err := os.Create(filepath.Join(dirname, backupFilesDir, filepath.Base(name)))
+		if err != nil {
+			return nil, err
+		}
+		defer dst.Close()
+		r = io.TeeReader(src, dst)
+	}
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	sum, err := checksum(r)
+	if err != nil {
+		return nil, err
+	}
+	return &backupFile{name, size, sum}, nil
+}
+
+func readBackupManifest(dirname string) (*backupManifest, error) {
+	body, err := ioutil.ReadFile(filepath.Join(dirname, backupManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &backupManifest{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %s", err)
+	}
+	if m.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+	return m, nil
+}
+
+// checks the files copied to the backup, if any, against the manifest,
+// returning the names of those missing or changed
+func verifyBackupFiles(dirname string, m *backupManifest) []string {
+
+	dir := filepath.Join(dirname, backupFilesDir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	var damaged []string
+	for _, file := range m.Files {
+		f, err := os.Open(filepath.Join(dir, filepath.Base(file.Name)))
+		if err != nil {
+			damaged = append(damaged, file.Name)
+			continue
+		}
+		sum, err := checksum(f)
+		f.Close()
+		if err != nil || sum != file.Checksum {
+			damaged = append(damaged, file.Name)
+		}
+	}
+	return damaged
+}
+
+// copies the files of the manifest the storage lacks, or has changed, from
+// the backup, and returns the names of the files the storage still lacks
+func restoreBackupFiles(store fileStorage, dirname string, m *backupManifest) []string {
+
+	var missing []string
+	for _, file := range m.Files {
+		if sum, err := fileChecksum(store, file.Name); err == nil && sum == file.Checksum {
+			continue
+		}
+		if err := restoreBackupFile(store, dirname, file); err != nil {
+			log.Printf("Cannot restore %s: %s", file.Name, err)
+			missing = append(missing, file.Name)
+		}
+	}
+	return missing
+}
+
+func restoreBackupFile(store fileStorage, dirname string, file backupFile) error {
+	f, err := os.Open(filepath.Join(dirname, backupFilesDir, filepath.Base(file.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if sum, err := checksum(f); err != nil || sum != file.Checksum {
+		return errors.New("file in the backup does not match its checksum")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = storeChecked(store, f, file.Name, contentTypeOf(file.Name))
+	return err
+}
+
+// restores the backup in the directory, replacing the database, or only
+// checks it if verifyOnly is set
+func restoreBackup(app *app, dirname string, verifyOnly bool) error {
+
+	m, err := readBackupManifest(dirname)
+	if err != nil {
+		return err
+	}
+
+	damaged := verifyBackupFiles(dirname, m)
+	for _, name := range damaged {
+		log.Printf("Damaged file in the backup: %s", name)
+	}
+
+	dump := filepath.Join(dirname, backupDumpFile)
+	if verifyOnly {
+		if err := pgCommand(app.cfg, "pg_restore", "--list", dump).Run(); err != nil {
+			return fmt.Errorf("pg_restore: %s", err)
+		}
+		if len(damaged) > 0 {
+			return fmt.Errorf("%d files of the backup are missing or damaged", len(damaged))
+		}
+		log.Printf("Backup of %s with %d files is intact", m.CreatedAt.Format(time.RFC3339), len(m.Files))
+		return nil
+	}
+
+	log.Printf("Restoring the database from %s", dump)
+	if err := pgCommand(app.cfg, "pg_restore", "--clean", "--if-exists", "--no-owner", "--single-transaction", dump).Run(); err != nil {
+		return fmt.Errorf("pg_restore: %s", err)
+	}
+	if err := app.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	missing := restoreBackupFiles(app.filestore, dirname, m)
+	if len(missing) > 0 {
+		return fmt.Errorf("database restored, but %d files are missing or damaged", len(missing))
+	}
+	log.Printf("Restored the database and %d files", len(m.Files))
+	return nil
+}
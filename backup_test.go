@@ -0,0 +1,77 @@
+package photoshare
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newMemoryFileStorage(&fakeImageProcessor{})
+	for _, name := range []string{"a.jpg", "b.png"} {
+		store.store(strings.NewReader("image "+name), name, contentTypeOf(name))
+	}
+
+	m := &backupManifest{Version: backupVersion}
+	if failed := backupFiles(store, []string{"a.jpg", "b.png", "missing.jpg"}, dir, true, m); failed != 1 {
+		t.Errorf("Expected the missing file to fail, got %d", failed)
+	}
+	if len(m.Files) != 2 || m.Files[0].Name != "a.jpg" || m.Files[0].Size != int64(len("image a.jpg")) {
+		t.Fatalf("Expected the files in the manifest, got %+v", m.Files)
+	}
+	if sum, _ := checksum(strings.NewReader("image a.jpg")); m.Files[0].Checksum != sum {
+		t.Errorf("Expected the checksum of the file, got %s", m.Files[0].Checksum)
+	}
+	if body, _ := ioutil.ReadFile(filepath.Join(dir, backupFilesDir, "b.png")); string(body) != "image b.png" {
+		t.Errorf("Expected the file to be copied, got %q", body)
+	}
+
+	if damaged := verifyBackupFiles(dir, m); len(damaged) != 0 {
+		t.Errorf("Expected the backup to be intact, got %v", damaged)
+	}
+	ioutil.WriteFile(filepath.Join(dir, backupFilesDir, "b.png"), []byte("changed"), 0600)
+	if damaged := verifyBackupFiles(dir, m); len(damaged) != 1 || damaged[0] != "b.png" {
+		t.Errorf("Expected the changed file to be damaged, got %v", damaged)
+	}
+}
+
+func TestRestoreBackupFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newMemoryFileStorage(&fakeImageProcessor{})
+	for _, name := range []string{"a.jpg", "b.png", "c.gif"} {
+		store.store(strings.NewReader("image "+name), name, contentTypeOf(name))
+	}
+	m := &backupManifest{Version: backupVersion}
+	backupFiles(store, []string{"a.jpg", "b.png", "c.gif"}, dir, true, m)
+
+	// lost and changed since the backup, and lost from both
+	store.clean("a.jpg")
+	store.files["b.png"] = []byte("changed")
+	store.clean("c.gif")
+	os.Remove(filepath.Join(dir, backupFilesDir, "c.gif"))
+
+	missing := restoreBackupFiles(store, dir, m)
+	if len(missing) != 1 || missing[0] != "c.gif" {
+		t.Errorf("Expected only the file lost from both to be missing, got %v", missing)
+	}
+	for _, name := range []string{"a.jpg", "b.png"} {
+		if string(store.files[name]) != "image "+name {
+			t.Errorf("Expected %s to be restored, got %q", name, store.files[name])
+		}
+	}
+}
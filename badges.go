@@ -0,0 +1,120 @@
+package photoshare
+
+import (
+	"log"
+	"net/http"
+)
+
+// Users earn badges for their achievements, shown on their public profile.
+// Each achievement is judged on the stats of the user; new ones are added
+// to achievements below. The achievements of the owner of a photo are
+// checked when the photo is uploaded or updated, e.g. voted on, from the
+// messages published to the clients (see messages.go), and awarded badges
+// are never taken back. The award-badges command checks every user of the
+// site, e.g. for the photos uploaded before an achievement was added.
+
+type achievement struct {
+	name, description string
+	earned            func(*userStats) bool
+}
+
+var achievements = []achievement{
+	{"first_upload", "Uploaded a first photo", func(s *userStats) bool { return s.Photos >= 1 }},
+	{"100_votes", "Photos upvoted 100 times", func(s *userStats) bool { return s.UpVotes >= 100 }},
+	{"7_day_streak", "Uploaded photos 7 days in a row", func(s *userStats) bool { return s.Streak >= 7 }},
+}
+
+func getAchievement(name string) *achievement {
+	for i := range achievements {
+		if achievements[i].name == name {
+			return &achievements[i]
+		}
+	}
+	return nil
+}
+
+// awards the badges the user has earned and not been awarded yet,
+// returning them
+func awardBadges(dm dataMapper, userID int64) ([]badge, error) {
+
+	stats, err := dm.getUserStats(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var awarded []badge
+	for _, a := range achievements {
+		if !a.earned(stats) {
+			continue
+		}
+		b := badge{UserID: userID, Name: a.name, Description: a.description, AwardedAt: utcNow()}
+		isNew, err := dm.awardBadge(&b)
+		if err != nil {
+			return awarded, err
+		}
+		if isNew {
+			awarded = append(awarded, b)
+		}
+	}
+	return awarded, nil
+}
+
+// returns the badges of the user, with the descriptions of their achievements
+func getBadges(dm dataMapper, userID int64) ([]badge, error) {
+	badges, err := dm.getBadges(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range badges {
+		if a := getAchievement(badges[i].Name); a != nil {
+			badges[i].Description = a.description
+		}
+	}
+	return badges, nil
+}
+
+// checks the achievements of the owner of the photo, in the site of the photo
+func awardPhotoOwner(app *app, photoID int64) error {
+	photo, err := app.datamapper.getPhoto(photoID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil
+		}
+		return err
+	}
+	awarded, err := awardBadges(app.datamapper.forSite(photo.SiteID), photo.OwnerID)
+	for _, b := range awarded {
+		log.Printf("Awarded %s to user %d", b.Name, b.UserID)
+	}
+	return err
+}
+
+// checks achievements as photos are uploaded and updated, until the server
+// stops
+func runAchievements(app *app) {
+	messages, _ := pub.SubChannel(nil)
+	for msg := range messages {
+		sm, ok := msg.(*siteMessage)
+		if !ok {
+			continue
+		}
+		m, ok := sm.body.(*socketMessage)
+		if !ok || m.PhotoID == 0 || (m.Type != "photo_uploaded" && m.Type != "photo_updated") {
+			continue
+		}
+		if err := awardPhotoOwner(app, m.PhotoID); err != nil {
+			logError(err)
+		}
+	}
+}
+
+// renders the public profile of the user, with their badges
+func renderProfile(ctx *context, w http.ResponseWriter, user *user) error {
+	p := newProfile(user)
+	badges, err := getBadges(ctx.datamapper, user.ID)
+	if err != nil {
+		return err
+	}
+	p.Badges = badges
+	return renderJSON(w, p, http.StatusOK)
+}
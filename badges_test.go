@@ -0,0 +1,101 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type badgesDataMapper struct {
+	mockDataMapper
+	stats  userStats
+	badges map[string]bool
+}
+
+func newBadgesDataMapper(stats userStats) *badgesDataMapper {
+	return &badgesDataMapper{stats: stats, badges: make(map[string]bool)}
+}
+
+func (m *badgesDataMapper) forSite(siteID int64) dataMapper {
+	return m
+}
+
+func (m *badgesDataMapper) getPhoto(photoID int64) (*photo, error) {
+	return &photo{ID: photoID, OwnerID: 1, SiteID: 1}, nil
+}
+
+func (m *badgesDataMapper) getUserByName(name string) (*user, error) {
+	return &user{ID: 1, Name: name}, nil
+}
+
+func (m *badgesDataMapper) getUserStats(userID int64) (*userStats, error) {
+	return &m.stats, nil
+}
+
+func (m *badgesDataMapper) awardBadge(b *badge) (bool, error) {
+	if m.badges[b.Name] {
+		return false, nil
+	}
+	m.badges[b.Name] = true
+	return true, nil
+}
+
+func (m *badgesDataMapper) getBadges(userID int64) ([]badge, error) {
+	var badges []badge
+	for _, a := range achievements {
+		if m.badges[a.name] {
+			badges = append(badges, badge{UserID: userID, Name: a.name})
+		}
+	}
+	return badges, nil
+}
+
+func TestAwardBadges(t *testing.T) {
+
+	dm := newBadgesDataMapper(userStats{Photos: 12, UpVotes: 40, Streak: 7})
+	awarded, err := awardBadges(dm, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(awarded) != 2 || awarded[0].Name != "first_upload" || awarded[1].Name != "7_day_streak" {
+		t.Errorf("Expected the first upload and streak badges, got %+v", awarded)
+	}
+
+	// only new badges are awarded
+	dm.stats.UpVotes = 100
+	if err := awardPhotoOwner(&app{datamapper: dm}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !dm.badges["100_votes"] || len(dm.badges) != 3 {
+		t.Errorf("Expected the votes badge to be awarded, got %v", dm.badges)
+	}
+	if awarded, _ := awardBadges(dm, 1); len(awarded) != 0 {
+		t.Errorf("Expected no badge awarded twice, got %+v", awarded)
+	}
+}
+
+func TestProfileBadges(t *testing.T) {
+
+	dm := newBadgesDataMapper(userStats{Photos: 1})
+	dm.badges["first_upload"] = true
+	c := &context{
+		app:        &app{datamapper: dm},
+		params:     &params{map[string]string{"name": "tester"}},
+		user:       &user{},
+		datamapper: dm,
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/users/tester", nil)
+	res := httptest.NewRecorder()
+	if err := getProfile(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	p := &profile{}
+	if err := json.Unmarshal(res.Body.Bytes(), p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Badges) != 1 || p.Badges[0].Name != "first_upload" || p.Badges[0].Description != "Uploaded a first photo" {
+		t.Errorf("Expected the badge on the profile, got %s", res.Body)
+	}
+}
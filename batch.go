@@ -0,0 +1,170 @@
+package photoshare
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Users manage many of their own photos at once with one of the batch
+// actions. A batch is applied in one transaction: if any photo cannot be
+// changed, none are, and the results say which photos failed and why.
+
+const (
+	batchDelete     = "delete"
+	batchTag        = "tag"
+	batchVisibility = "visibility"
+
+	maxBatchSize = 100
+)
+
+type photoBatch struct {
+	IDs    []int64 `json:"ids"`
+	Action string  `json:"action"`
+
+	// tags added and removed by the tag action
+	AddTags    []string `json:"addTags"`
+	RemoveTags []string `json:"removeTags"`
+
+	// set by the visibility action
+	Private bool `json:"private"`
+}
+
+type batchResult struct {
+	ID    int64  `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// returns the tags with the added tags and without the removed tags
+func retag(tags []string, add []string, remove []string) []string {
+
+	removed := make(map[string]bool)
+	for _, name := range remove {
+		removed[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	var (
+		result []string
+		seen   = make(map[string]bool)
+	)
+	for _, name := range append(tags, add...) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || removed[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result
+}
+
+func batchPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	batch := &photoBatch{}
+
+	if err := decodeJSON(r, batch); err != nil {
+		return err
+	}
+
+	switch batch.Action {
+	case batchDelete, batchTag, batchVisibility:
+	default:
+		return httpError{http.StatusBadRequest, "Invalid action"}
+	}
+
+	if len(batch.IDs) == 0 {
+		return httpError{http.StatusBadRequest, "No photos given"}
+	}
+	if len(batch.IDs) > maxBatchSize {
+		return httpError{http.StatusBadRequest, "Too many photos"}
+	}
+
+	var (
+		photos  []*photo
+		results []batchResult
+		failed  bool
+		seen    = make(map[int64]bool)
+		lang    = ctx.translator.negotiate(r)
+	)
+
+	for _, id := range batch.IDs {
+
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		result := batchResult{ID: id, OK: true}
+
+		detail, err := ctx.datamapper.getPhotoDetail(id, ctx.user)
+		switch {
+		case isErrSqlNoRows(err):
+			result.Error = ctx.translator.translate(lang, "Not found")
+		case err != nil:
+			return err
+		case detail.OwnerID != ctx.user.ID:
+			result.Error = ctx.translator.translate(lang, "You're not allowed to edit this photo")
+		}
+
+		if result.Error == "" {
+			photo := &detail.photo
+			switch batch.Action {
+			case batchTag:
+				photo.Tags = retag(photo.Tags, batch.AddTags, batch.RemoveTags)
+			case batchVisibility:
+				photo.Private = batch.Private
+			}
+			if batch.Action != batchDelete {
+				if err := ctx.validate(photo, r); err != nil {
+					failure, ok := err.(validationFailure)
+					if !ok {
+						return err
+					}
+					var msgs []string
+					for _, msg := range failure.Errors {
+						msgs = append(msgs, ctx.translator.translate(lang, msg))
+					}
+					sort.Strings(msgs)
+					result.Error = strings.Join(msgs, "; ")
+				}
+			}
+			photos = append(photos, photo)
+		}
+
+		if result.Error != "" {
+			result.OK = false
+			failed = true
+		}
+		results = append(results, result)
+	}
+
+	if failed {
+		w.Header().Set("Content-Language", lang)
+		return renderJSON(w, map[string][]batchResult{"results": results}, http.StatusBadRequest)
+	}
+
+	if batch.Action == batchDelete {
+		if err := ctx.datamapper.trashPhotos(photos); err != nil {
+			return err
+		}
+	} else {
+		if err := ctx.datamapper.updatePhotos(photos); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	for _, photo := range photos {
+		if batch.Action == batchDelete {
+			sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_deleted"})
+		} else {
+			sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+		}
+	}
+
+	return renderJSON(w, map[string][]batchResult{"results": results}, http.StatusOK)
+}
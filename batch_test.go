@@ -0,0 +1,144 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRetag(t *testing.T) {
+	tags := retag([]string{"bird", "lake"}, []string{"Heron", "bird", " "}, []string{"lake"})
+	if !reflect.DeepEqual(tags, []string{"bird", "heron"}) {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+}
+
+func TestBatchPhotos(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &user{Name: "other", Email: "other@localhost"}
+	if err := dm.createUser(other); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, ownerID := range []int64{owner.ID, owner.ID, other.ID} {
+		p := &photo{Title: "test", Filename: "test.jpg", OwnerID: ownerID, Tags: []string{"bird"}}
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, p.ID)
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "http://localhost/api/user/photos/batch", strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	// a photo of another user fails the whole batch
+	res := post(fmt.Sprintf(`{"action": "delete", "ids": [%d, %d]}`, ids[0], ids[2]))
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), fmt.Sprintf(`{"id":%d,"ok":false`, ids[2])) {
+		t.Errorf("Failed photo should be reported, got %s", res.Body.String())
+	}
+	if _, err := dm.getPhoto(ids[0]); err != nil {
+		t.Error("Nothing should be deleted when the batch fails")
+	}
+
+	res = post(fmt.Sprintf(`{"action": "tag", "ids": [%d, %d], "addTags": ["heron"], "removeTags": ["bird"]}`, ids[0], ids[1]))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if p, _ := dm.getPhoto(ids[1]); !reflect.DeepEqual(p.Tags, []string{"heron"}) {
+		t.Errorf("Photo should be retagged, got %v", p.Tags)
+	}
+
+	res = post(fmt.Sprintf(`{"action": "visibility", "ids": [%d], "private": true}`, ids[0]))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if p, _ := dm.getPhoto(ids[0]); !p.Private {
+		t.Error("Photo should be private")
+	}
+
+	res = post(fmt.Sprintf(`{"action": "delete", "ids": [%d, %d]}`, ids[0], ids[1]))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if _, err := dm.getPhoto(ids[1]); err == nil {
+		t.Error("Photos should be deleted")
+	}
+
+	if res := post(`{"action": "rename", "ids": [1]}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid action, got %d", res.Code)
+	}
+}
+
+func TestLookupPhotos(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, private := range []bool{false, false, true} {
+		p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID, Private: private}
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, p.ID)
+	}
+
+	lookup := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "http://localhost/api/photos/lookup", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := lookup(fmt.Sprintf(`{"ids": [%d, %d, %d, %d, 999]}`, ids[1], ids[0], ids[1], ids[2]))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	result := &struct {
+		Photos  []photoDetail `json:"photos"`
+		Missing []int64       `json:"missing"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Photos) != 2 || result.Photos[0].ID != ids[0] || result.Photos[1].OwnerName != "owner" {
+		t.Errorf("Expected the visible photos, got %s", res.Body.String())
+	}
+	if fmt.Sprint(result.Missing) != fmt.Sprint([]int64{ids[2], 999}) {
+		t.Errorf("Expected the private and unknown photos missing, got %v", result.Missing)
+	}
+
+	tooMany := make([]string, maxBatchSize+1)
+	for i := range tooMany {
+		tooMany[i] = "1"
+	}
+	if res := lookup(`{"ids": [` + strings.Join(tooMany, ",") + `]}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too many photos, got %d", res.Code)
+	}
+}
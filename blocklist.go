@@ -0,0 +1,191 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Admins keep a list of words and phrases that may not be used in photo
+// titles, alt text and tags. Text is normalized before matching, so "h3ll0",
+// "HELLO", "h.e.l.l.o" and "hеllo" with a Cyrillic "е" all match "hello".
+// Only whole words are matched, so blocking "ass" does not block "class".
+
+const maxBlockedWordLength = 100
+
+// characters commonly used in place of letters
+var leetspeak = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'9': 'g',
+	'@': 'a',
+	'$': 's',
+}
+
+// letters of other scripts that look like latin letters, and accented
+// latin letters
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// accented latin
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c', 'è': 'e',
+	'é': 'e', 'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ñ': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ù': 'u', 'ú': 'u',
+	'û': 'u', 'ü': 'u', 'ý': 'y', 'ÿ': 'y',
+}
+
+// returns the words of the text in lowercase latin letters. Runs of single
+// letters are joined, so spelled out words such as "b a d" are matched too.
+func normalizeWords(s string) []string {
+
+	var (
+		words []string
+		word  []rune
+	)
+
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, string(word))
+			word = nil
+		}
+	}
+
+	for _, c := range s {
+		// fullwidth forms, e.g. "ｂ"
+		if c >= 0xff01 && c <= 0xff5e {
+			c -= 0xfee0
+		}
+		c = unicode.ToLower(c)
+		if l, ok := leetspeak[c]; ok {
+			c = l
+		}
+		if l, ok := confusables[c]; ok {
+			c = l
+		}
+		switch {
+		case unicode.IsLetter(c):
+			word = append(word, c)
+		case unicode.Is(unicode.Mn, c):
+			// combining accents
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	var joined []string
+	for i := 0; i < len(words); i++ {
+		if utf8.RuneCountInString(words[i]) > 1 {
+			joined = append(joined, words[i])
+			continue
+		}
+		j := i
+		for j < len(words) && utf8.RuneCountInString(words[j]) == 1 {
+			j++
+		}
+		joined = append(joined, strings.Join(words[i:j], ""))
+		i = j - 1
+	}
+	return joined
+}
+
+type blocklist struct {
+	phrases [][]string
+}
+
+func newBlocklist(words []blockedWord) *blocklist {
+	b := &blocklist{}
+	for _, w := range words {
+		if phrase := normalizeWords(w.Word); len(phrase) > 0 {
+			b.phrases = append(b.phrases, phrase)
+		}
+	}
+	return b
+}
+
+// checks if the text contains any of the blocked words or phrases
+func (b *blocklist) matches(text string) bool {
+	if len(b.phrases) == 0 || text == "" {
+		return false
+	}
+	words := normalizeWords(text)
+	for _, phrase := range b.phrases {
+	search:
+		for i := 0; i+len(phrase) <= len(words); i++ {
+			for j, w := range phrase {
+				if words[i+j] != w {
+					continue search
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// returns the blocklist of the site
+func (ctx *context) getBlocklist() (*blocklist, error) {
+	words, err := ctx.datamapper.getBlockedWords()
+	if err != nil {
+		return nil, err
+	}
+	return newBlocklist(words), nil
+}
+
+func getBlockedWords(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	words, err := ctx.datamapper.getBlockedWords()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, words, http.StatusOK)
+}
+
+func addBlockedWord(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	word := &blockedWord{}
+
+	if err := decodeJSON(r, word); err != nil {
+		return err
+	}
+
+	word.Word = strings.TrimSpace(word.Word)
+
+	if err := ctx.validate(word, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.addBlockedWord(word); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "block_word", word.ID, word.Word); err != nil {
+		return err
+	}
+
+	return renderJSON(w, word, http.StatusCreated)
+}
+
+func removeBlockedWord(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	id := ctx.params.getInt("id")
+
+	if err := ctx.datamapper.removeBlockedWord(id); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "unblock_word", id, ""); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "Word removed")
+}
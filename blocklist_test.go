@@ -0,0 +1,83 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeWords(t *testing.T) {
+	for _, tc := range []struct {
+		text  string
+		words []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"h3ll0 w0rld", []string{"hello", "world"}},
+		{"h.e.l.l.o there", []string{"hello", "there"}},
+		{"hеllо", []string{"hello"}}, // Cyrillic е and о
+		{"ｈｅｌｌｏ", []string{"hello"}},
+		{"Café crème", []string{"cafe", "creme"}},
+	} {
+		if words := normalizeWords(tc.text); !reflect.DeepEqual(words, tc.words) {
+			t.Errorf("%q: expected %v, got %v", tc.text, tc.words, words)
+		}
+	}
+}
+
+func TestBlocklistMatches(t *testing.T) {
+	b := newBlocklist([]blockedWord{{Word: "ass"}, {Word: "buy now"}})
+	for _, tc := range []struct {
+		text    string
+		matches bool
+	}{
+		{"Silly ass", true},
+		{"Silly @$$", true},
+		{"a s s", true},
+		{"First class", false},
+		{"BUY NOW!!", true},
+		{"Buy a cake now", false},
+		{"", false},
+	} {
+		if b.matches(tc.text) != tc.matches {
+			t.Errorf("%q: expected %t", tc.text, tc.matches)
+		}
+	}
+}
+
+func TestBlockedWordsInTitle(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken, err := dm.login(&user{Name: "admin", Email: "admin@localhost", IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/admin/blocklist", strings.NewReader(`{"word": "spam"}`))
+	req.Header.Set(tokenHeader, adminToken)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, newUploadRequest("Tinned 5P4M", token))
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, newUploadRequest("Spaghetti", token))
+	if res.Code != http.StatusCreated {
+		t.Errorf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+}
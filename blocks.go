@@ -0,0 +1,58 @@
+package photoshare
+
+import (
+	"net/http"
+)
+
+func getBlockedUsers(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	users, err := ctx.datamapper.getBlockedUsers(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, users, http.StatusOK)
+}
+
+func blockUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return block(ctx, w, r, false)
+}
+
+func muteUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return block(ctx, w, r, true)
+}
+
+// blocked users are hidden from the user and cannot vote on their photos;
+// muted users are only hidden
+func block(ctx *context, w http.ResponseWriter, r *http.Request, mute bool) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("userID"))
+	if err != nil {
+		return err
+	}
+
+	if target.ID == ctx.user.ID {
+		return httpError{http.StatusBadRequest, "You can't block yourself"}
+	}
+
+	if err := ctx.datamapper.blockUser(ctx.user.ID, target.ID, mute); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	if mute {
+		return renderString(w, http.StatusOK, "User muted")
+	}
+	return renderString(w, http.StatusOK, "User blocked")
+}
+
+func unblockUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.unblockUser(ctx.user.ID, ctx.params.getInt("userID")); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderString(w, http.StatusOK, "User unblocked")
+}
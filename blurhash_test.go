@@ -0,0 +1,40 @@
+package photoshare
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBlurhashSolidColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{0, 0, 0, 255})
+		}
+	}
+	// a flat image has no AC components, each encoded as the midpoint "fQ"
+	expected := "L00000" + strings.Repeat("fQ", blurhashXComponents*blurhashYComponents-1)
+	if hash := encodeBlurhash(img, blurhashXComponents, blurhashYComponents); hash != expected {
+		t.Errorf("Expected %s, got %s", expected, hash)
+	}
+}
+
+func TestEncodeBlurhashGradient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / 99), uint8(y * 255 / 49), 128, 255})
+		}
+	}
+	if hash := encodeBlurhash(img, blurhashXComponents, blurhashYComponents); hash != "L$HCAR2Y$5Sgl|azjtf7gcfjfQfj" {
+		t.Errorf("Unexpected hash %s", hash)
+	}
+}
+
+func TestEncodeBase83(t *testing.T) {
+	if s := encodeBase83(3429, 2); s != "fQ" {
+		t.Errorf("Expected fQ, got %s", s)
+	}
+}
@@ -26,7 +26,8 @@ type memcacheCache struct {
 	mc *memcache.Client
 }
 
-func (m *memcacheCache) set(key string, obj interface{}) ([]byte, error) {
+// stores obj as JSON under a key already encoded
+func (m *memcacheCache) put(key string, obj interface{}) ([]byte, error) {
 	value, err := json.Marshal(obj)
 	if err != nil {
 		return value, err
@@ -42,6 +43,10 @@ func (m *memcacheCache) set(key string, obj interface{}) ([]byte, error) {
 	return value, nil
 }
 
+func (m *memcacheCache) set(key string, obj interface{}) ([]byte, error) {
+	return m.put(makeCacheKey(key), obj)
+}
+
 func (m *memcacheCache) get(key string, fn func() (interface{}, error)) (interface{}, error) {
 
 	key = makeCacheKey(key)
@@ -49,7 +54,7 @@ func (m *memcacheCache) get(key string, fn func() (interface{}, error)) (interfa
 	it, err := m.mc.Get(key)
 	if err == nil {
 		var obj interface{}
-		if err := json.Unmarshal(it.Value, obj); err != nil {
+		if err := json.Unmarshal(it.Value, &obj); err != nil {
 			return obj, errgo.Mask(err)
 		}
 		return obj, nil
@@ -60,7 +65,7 @@ func (m *memcacheCache) get(key string, fn func() (interface{}, error)) (interfa
 	if err != nil {
 		return obj, err
 	}
-	if _, err := m.set(key, obj); err != nil {
+	if _, err := m.put(key, obj); err != nil {
 		return obj, errgo.Mask(err)
 	}
 	return obj, nil
@@ -85,7 +90,7 @@ func (m *memcacheCache) render(w http.ResponseWriter, status int, key string, fn
 	if err != nil {
 		return err
 	}
-	value, err := m.set(key, obj)
+	value, err := m.put(key, obj)
 	if err != nil {
 		return errgo.Mask(err)
 	}
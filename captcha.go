@@ -0,0 +1,99 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// With a captcha provider configured, signup and password recovery require
+// a captcha token from the browser, so accounts are not created or spammed
+// with recovery mail by bots. The browser gets the provider and site key
+// from /api/captcha.
+
+// reCAPTCHA, Turnstile and hCaptcha share the same verification API
+var captchaVerifyURLs = map[string]string{
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+}
+
+const captchaTimeout = 10 * time.Second
+
+type captchaVerifier interface {
+	verify(token, remoteIP string) (bool, error)
+}
+
+// returns the verifier of the configured provider, or nil if there is none
+func newCaptchaVerifier(cfg *config) captchaVerifier {
+	if cfg.CaptchaProvider == "" {
+		return nil
+	}
+	return &siteVerifyCaptcha{
+		url:    captchaVerifyURLs[cfg.CaptchaProvider],
+		secret: cfg.CaptchaSecret,
+		client: &http.Client{Timeout: captchaTimeout},
+	}
+}
+
+// posts the token to the siteverify endpoint of the provider
+type siteVerifyCaptcha struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (c *siteVerifyCaptcha) verify(token, remoteIP string) (bool, error) {
+
+	res, err := c.client.PostForm(c.url, url.Values{
+		"secret":   {c.secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verification returned %s", res.Status)
+	}
+
+	result := &struct {
+		Success bool `json:"success"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// returns an error unless captchas are disabled or the token is verified
+func checkCaptcha(ctx *context, token string) error {
+	if ctx.captcha == nil {
+		return nil
+	}
+	if token == "" {
+		return httpError{http.StatusBadRequest, "Captcha is missing"}
+	}
+	ok, err := ctx.captcha.verify(token, ctx.remoteIP)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusBadRequest, "Captcha verification failed"}
+	}
+	return nil
+}
+
+func getCaptcha(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if ctx.captcha == nil {
+		return httpError{http.StatusNotFound, "Captchas are not enabled"}
+	}
+	return renderJSON(w, map[string]string{
+		"provider": ctx.cfg.CaptchaProvider,
+		"siteKey":  ctx.cfg.CaptchaSiteKey,
+	}, http.StatusOK)
+}
@@ -0,0 +1,77 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSiteVerifyCaptcha(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != "secret" {
+			t.Errorf("Secret should be sent, got %q", r.PostFormValue("secret"))
+		}
+		fmt.Fprintf(w, `{"success": %t}`, r.PostFormValue("response") == "valid")
+	}))
+	defer srv.Close()
+
+	c := &siteVerifyCaptcha{url: srv.URL, secret: "secret", client: srv.Client()}
+
+	for token, expected := range map[string]bool{"valid": true, "invalid": false} {
+		ok, err := c.verify(token, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Errorf("%s: expected %t", token, expected)
+		}
+	}
+}
+
+type fakeCaptchaVerifier struct{}
+
+func (c *fakeCaptchaVerifier) verify(token, remoteIP string) (bool, error) {
+	return token == "valid", nil
+}
+
+func TestSignupRequiresCaptcha(t *testing.T) {
+
+	app := newTestApp(newMemoryDataMapper())
+	app.captcha = &fakeCaptchaVerifier{}
+
+	for _, tc := range []struct {
+		captcha string
+		status  int
+	}{
+		{"", http.StatusBadRequest},
+		{"invalid", http.StatusBadRequest},
+	} {
+		body := fmt.Sprintf(`{"name": "tester", "email": "tester@localhost", "password": "secret123", "captcha": %q}`, tc.captcha)
+		req, _ := http.NewRequest("POST", "http://localhost/api/auth/signup", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("%q: expected %d, got %d", tc.captcha, tc.status, res.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/auth/recoverpass", strings.NewReader(`{"email": "tester@localhost"}`))
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Recovery without captcha: expected 400, got %d", res.Code)
+	}
+}
+
+func TestNewCaptchaVerifier(t *testing.T) {
+	if newCaptchaVerifier(&config{}) != nil {
+		t.Error("Captchas should be disabled without a provider")
+	}
+	c := newCaptchaVerifier(&config{CaptchaProvider: "turnstile", CaptchaSecret: "secret"}).(*siteVerifyCaptcha)
+	if c.url != captchaVerifyURLs["turnstile"] || c.secret != "secret" {
+		t.Errorf("Unexpected verifier: %+v", c)
+	}
+}
@@ -0,0 +1,162 @@
+package photoshare
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Challenges are scheduled by admins, one after the other: a tag, e.g. of the
+// week, and the dates it runs. Photos are entered by tagging them with the
+// challenge tag while it runs. Clients are told when a challenge starts and
+// ends by challenge_started and challenge_ended messages.
+
+const challengeAnnouncementInterval = time.Minute
+
+type challengeMessage struct {
+	Sender      string `json:"sender"`
+	Receiver    string `json:"receiver"`
+	Type        string `json:"type"`
+	ChallengeID int64  `json:"challengeID"`
+	Tag         string `json:"tag"`
+}
+
+func getChallenges(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	challenges, err := ctx.datamapper.getChallenges(getPage(r), now)
+	if err != nil {
+		return err
+	}
+	for i := range challenges.Items {
+		challenges.Items[i].Status = challenges.Items[i].status(now)
+	}
+	return renderJSON(w, challenges, http.StatusOK)
+}
+
+func createChallenge(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Tag         string    `json:"tag"`
+		Description string    `json:"description"`
+		StartsAt    time.Time `json:"startsAt"`
+		EndsAt      time.Time `json:"endsAt"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	challenge := &challenge{
+		OwnerID:     ctx.user.ID,
+		Tag:         strings.TrimPrefix(strings.TrimSpace(s.Tag), "#"),
+		Description: s.Description,
+		StartsAt:    s.StartsAt,
+		EndsAt:      s.EndsAt,
+	}
+
+	if err := ctx.validate(challenge, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createChallenge(challenge); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "create_challenge", challenge.ID, challenge.Tag); err != nil {
+		return err
+	}
+	return renderJSON(w, challenge, http.StatusCreated)
+}
+
+func getChallengeDetail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	challenge, err := ctx.datamapper.getChallenge(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	challenge.Status = challenge.status(time.Now())
+	return renderJSON(w, challenge, http.StatusOK)
+}
+
+func getCurrentChallenge(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	challenge, err := ctx.datamapper.getCurrentChallenge(now)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return httpError{http.StatusNotFound, "There is no challenge running"}
+		}
+		return err
+	}
+	challenge.Status = challenge.status(now)
+	return renderJSON(w, challenge, http.StatusOK)
+}
+
+func getChallengeEntries(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	challenge, err := ctx.datamapper.getChallenge(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	page := getPage(r)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:challenge:%d:%s:page:%d:user:%d",
+		challenge.ID, challenge.status(time.Now()), page.index, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		return ctx.datamapper.getChallengeEntries(page, &challenge.challenge, userID)
+	})
+}
+
+// announces the challenges of each site started or ended since last time
+func announceChallenges(app *app) {
+	sites, err := app.datamapper.getSites()
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, s := range sites {
+		num, err := announceSiteChallenges(app.datamapper.forSite(s.ID), utcNow())
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if num > 0 {
+			log.Printf("Announced %d challenges of site %d", num, s.ID)
+		}
+	}
+}
+
+// returns the number of announcements. The start of a challenge already
+// ended is not announced, only its end.
+func announceSiteChallenges(datamapper dataMapper, now time.Time) (int, error) {
+
+	challenges, err := datamapper.getChallengesToAnnounce(now)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, c := range challenges {
+		kind := "challenge_started"
+		if c.StartAnnouncedAt == nil {
+			c.StartAnnouncedAt = &now
+		}
+		if !now.Before(c.EndsAt) {
+			kind = "challenge_ended"
+			c.EndAnnouncedAt = &now
+		}
+		if err := datamapper.setChallengeAnnounced(&c); err != nil {
+			return i, err
+		}
+		sendMessage(c.SiteID, &challengeMessage{Type: kind, ChallengeID: c.ID, Tag: c.Tag})
+	}
+	return len(challenges), nil
+}
+
+// announces challenges until the server stops
+func runChallengeAnnouncements(app *app) {
+	for range time.Tick(challengeAnnouncementInterval) {
+		announceChallenges(app)
+	}
+}
@@ -0,0 +1,98 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChallengeStatus(t *testing.T) {
+	start := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+	c := &challenge{StartsAt: start, EndsAt: start.AddDate(0, 0, 7)}
+	for _, tc := range []struct {
+		now    time.Time
+		status string
+	}{
+		{start.Add(-time.Hour), challengeUpcoming},
+		{start, challengeCurrent},
+		{start.AddDate(0, 0, 7), challengeFinished},
+	} {
+		if status := c.status(tc.now); status != tc.status {
+			t.Errorf("%s: expected %s, got %s", tc.now, tc.status, status)
+		}
+	}
+}
+
+type challengeDataMapper struct {
+	mockDataMapper
+	overlapping bool
+	created     *challenge
+	toAnnounce  []challenge
+	announced   []challenge
+}
+
+func (m *challengeDataMapper) isChallengeOverlapping(_ *challenge) (bool, error) {
+	return m.overlapping, nil
+}
+
+func (m *challengeDataMapper) createChallenge(c *challenge) error {
+	m.created = c
+	return nil
+}
+
+func (m *challengeDataMapper) getChallengesToAnnounce(now time.Time) ([]challenge, error) {
+	return m.toAnnounce, nil
+}
+
+func (m *challengeDataMapper) setChallengeAnnounced(c *challenge) error {
+	m.announced = append(m.announced, *c)
+	return nil
+}
+
+func TestCreateChallengeIfOverlapping(t *testing.T) {
+	dm := &challengeDataMapper{overlapping: true}
+	c := &context{
+		app:        &app{datamapper: dm},
+		params:     &params{make(map[string]string)},
+		user:       &user{ID: 1, IsAuthenticated: true, IsAdmin: true},
+		datamapper: dm,
+	}
+
+	body := `{"tag": "#birds", "startsAt": "2026-01-05T00:00:00Z", "endsAt": "2026-01-12T00:00:00Z"}`
+	req, _ := http.NewRequest("POST", "http://localhost/api/challenges/", strings.NewReader(body))
+
+	err := createChallenge(c, httptest.NewRecorder(), req)
+	if e, ok := err.(validationFailure); !ok || e.Errors["startsAt"] == "" {
+		t.Errorf("Expected challenges not to overlap, got %v", err)
+	}
+	if dm.created != nil {
+		t.Error("Expected the challenge not to be created")
+	}
+}
+
+func TestAnnounceChallenges(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-time.Hour)
+	dm := &challengeDataMapper{toAnnounce: []challenge{
+		{ID: 1, Tag: "birds", StartsAt: now.AddDate(0, 0, -7), EndsAt: now.Add(-time.Minute), StartAnnouncedAt: &started},
+		{ID: 2, Tag: "trees", StartsAt: now.Add(-time.Minute), EndsAt: now.AddDate(0, 0, 7)},
+	}}
+
+	num, err := announceSiteChallenges(dm, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 || len(dm.announced) != 2 {
+		t.Fatalf("Expected 2 announcements, got %d", num)
+	}
+
+	ended, current := dm.announced[0], dm.announced[1]
+	if ended.EndAnnouncedAt == nil || !ended.StartAnnouncedAt.Equal(started) {
+		t.Errorf("Expected the end of the first challenge to be announced, got %+v", ended)
+	}
+	if current.StartAnnouncedAt == nil || current.EndAnnouncedAt != nil {
+		t.Errorf("Expected the start of the second challenge to be announced, got %+v", current)
+	}
+}
@@ -0,0 +1,311 @@
+package photoshare
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Owners put a photo up for sale with a price and a license. With a
+// checkout provider configured, users buy it with a checkout of the
+// provider; the provider calls /api/checkout/webhook when it is paid, and
+// the buyer may then download the original (see getOriginal).
+
+const (
+	minPrice         = 50       // cents, the least most providers charge
+	maxPrice         = 10000000 // cents
+	maxLicenseLength = 2000
+
+	checkoutTimeout          = 10 * time.Second
+	maxWebhookSize           = 1 << 20
+	stripeCheckoutURL        = "https://api.stripe.com/v1/checkout/sessions"
+	stripeSignatureTolerance = 5 * time.Minute
+)
+
+var errSalesDisabled = httpError{http.StatusNotFound, "Photos are not sold on this site"}
+
+type checkoutRequest struct {
+	purchase   *purchase
+	title      string
+	successURL string
+	cancelURL  string
+}
+
+type checkoutProvider interface {
+	// starts a checkout of the purchase, returning its ID and the URL the
+	// buyer pays at
+	createCheckout(*checkoutRequest) (string, string, error)
+	// returns the ID of the checkout paid in a webhook call, or "" for
+	// other events
+	paidCheckout(*http.Request) (string, error)
+}
+
+// returns the configured provider, or nil if there is none
+func newCheckoutProvider(cfg *config) checkoutProvider {
+	if cfg.CheckoutProvider == "" {
+		return nil
+	}
+	return &stripeCheckout{
+		url:           stripeCheckoutURL,
+		secretKey:     cfg.CheckoutSecretKey,
+		webhookSecret: cfg.CheckoutWebhookSecret,
+		client:        &http.Client{Timeout: checkoutTimeout},
+	}
+}
+
+// Stripe Checkout sessions, https://stripe.com/docs/api/checkout/sessions
+type stripeCheckout struct {
+	url           string
+	secretKey     string
+	webhookSecret string
+	client        *http.Client
+}
+
+func (s *stripeCheckout) createCheckout(c *checkoutRequest) (string, string, error) {
+
+	form := url.Values{
+		"mode":                                   {"payment"},
+		"success_url":                            {c.successURL},
+		"cancel_url":                             {c.cancelURL},
+		"client_reference_id":                    {fmt.Sprintf("%d:%d", c.purchase.PhotoID, c.purchase.BuyerID)},
+		"line_items[0][quantity]":                {"1"},
+		"line_items[0][price_data][currency]":    {c.purchase.Currency},
+		"line_items[0][price_data][unit_amount]": {strconv.FormatInt(c.purchase.Amount, 10)},
+		"line_items[0][price_data][product_data][name]": {c.title},
+	}
+
+	req, err := http.NewRequest("POST", s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+s.secretKey)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("checkout returned %s", res.Status)
+	}
+
+	session := &struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(session); err != nil {
+		return "", "", err
+	}
+	return session.ID, session.URL, nil
+}
+
+// checks the Stripe-Signature header, "t=<timestamp>,v1=<signature>", an
+// HMAC-SHA256 of the timestamp and body with the webhook secret
+func (s *stripeCheckout) verifySignature(header string, body []byte, now time.Time) bool {
+
+	var (
+		timestamp  string
+		signatures []string
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(t, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		if sig, err := hex.DecodeString(signature); err == nil && hmac.Equal(sig, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stripeCheckout) paidCheckout(r *http.Request) (string, error) {
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		return "", err
+	}
+	if !s.verifySignature(r.Header.Get("Stripe-Signature"), body, time.Now()) {
+		return "", httpError{http.StatusBadRequest, "Invalid signature"}
+	}
+
+	event := &struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID            string `json:"id"`
+				PaymentStatus string `json:"payment_status"`
+			} `json:"object"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return "", httpError{http.StatusBadRequest, "Invalid event"}
+	}
+
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		if event.Data.Object.PaymentStatus == "paid" {
+			return event.Data.Object.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func setPhotoSale(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Price   *int64 `json:"price"`
+		License string `json:"license"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	photo.Price = s.Price
+	photo.License = strings.TrimSpace(s.License)
+	if photo.Price == nil {
+		photo.License = ""
+	}
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderJSON(w, photo, http.StatusOK)
+}
+
+// starts the checkout of a photo for sale, returning the URL to pay at
+func purchasePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.checkout == nil {
+		return errSalesDisabled
+	}
+
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	if photo.Price == nil {
+		return httpError{http.StatusBadRequest, "This photo is not for sale"}
+	}
+	if photo.OwnerID == ctx.user.ID {
+		return httpError{http.StatusBadRequest, "You cannot buy your own photo"}
+	}
+
+	purchased, err := ctx.datamapper.hasPurchased(photo.ID, ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	if purchased {
+		return httpError{http.StatusBadRequest, "You have already bought this photo"}
+	}
+
+	p := &purchase{
+		PhotoID:  photo.ID,
+		BuyerID:  ctx.user.ID,
+		Amount:   *photo.Price,
+		Currency: ctx.cfg.SalesCurrency,
+		License:  photo.License,
+	}
+
+	detailURL := fmt.Sprintf("%s/#/detail/%d", getBaseURL(r), photo.ID)
+
+	checkoutID, checkoutURL, err := ctx.checkout.createCheckout(&checkoutRequest{
+		purchase:   p,
+		title:      photo.Title,
+		successURL: detailURL + "?purchase=success",
+		cancelURL:  detailURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	p.CheckoutID = checkoutID
+	if err := ctx.datamapper.createPurchase(p); err != nil {
+		return err
+	}
+
+	return renderJSON(w, map[string]string{"url": checkoutURL}, http.StatusCreated)
+}
+
+// records the payment of a purchase, called by the provider
+func checkoutWebhook(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.checkout == nil {
+		return errSalesDisabled
+	}
+
+	checkoutID, err := ctx.checkout.paidCheckout(r)
+	if err != nil {
+		return err
+	}
+	if checkoutID == "" {
+		return renderString(w, http.StatusOK, "Ignored")
+	}
+
+	p, err := ctx.datamapper.getPurchaseByCheckout(checkoutID)
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.markPurchasePaid(p); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Paid")
+}
+
+func getPurchases(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	purchases, err := ctx.datamapper.getPurchases(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, purchases, http.StatusOK)
+}
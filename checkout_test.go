@@ -0,0 +1,180 @@
+package photoshare
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeCheckout struct {
+	created []*checkoutRequest
+	paid    string
+}
+
+func (c *fakeCheckout) createCheckout(req *checkoutRequest) (string, string, error) {
+	c.created = append(c.created, req)
+	id := fmt.Sprintf("cs_%d", len(c.created))
+	return id, "https://checkout.localhost/" + id, nil
+}
+
+func (c *fakeCheckout) paidCheckout(r *http.Request) (string, error) {
+	return c.paid, nil
+}
+
+func signStripe(secret, body string, t time.Time) string {
+	timestamp := fmt.Sprint(t.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestStripeSignature(t *testing.T) {
+
+	s := &stripeCheckout{webhookSecret: "whsec"}
+	body := `{"type": "checkout.session.completed"}`
+	now := time.Now()
+
+	if !s.verifySignature(signStripe("whsec", body, now), []byte(body), now) {
+		t.Error("Signature should be valid")
+	}
+	if s.verifySignature(signStripe("other", body, now), []byte(body), now) {
+		t.Error("Signature with another secret should be invalid")
+	}
+	if s.verifySignature(signStripe("whsec", body, now.Add(-time.Hour)), []byte(body), now) {
+		t.Error("Old signature should be invalid")
+	}
+	if s.verifySignature("", []byte(body), now) {
+		t.Error("Missing signature should be invalid")
+	}
+}
+
+func TestStripeCheckout(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		if r.Form.Get("line_items[0][price_data][unit_amount]") != "1500" || r.Form.Get("mode") != "payment" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"id": "cs_1", "url": "https://checkout.stripe.com/cs_1"}`))
+	}))
+	defer server.Close()
+
+	s := &stripeCheckout{url: server.URL, secretKey: "sk_test", client: server.Client()}
+	id, url, err := s.createCheckout(&checkoutRequest{
+		purchase: &purchase{PhotoID: 1, BuyerID: 2, Amount: 1500, Currency: "usd"},
+		title:    "Heron",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "cs_1" || url != "https://checkout.stripe.com/cs_1" {
+		t.Errorf("Unexpected checkout %s %s", id, url)
+	}
+
+	body := `{"type": "checkout.session.completed", "data": {"object": {"id": "cs_1", "payment_status": "paid"}}}`
+	s.webhookSecret = "whsec"
+	req, _ := http.NewRequest("POST", "http://localhost/api/checkout/webhook", strings.NewReader(body))
+	req.Header.Set("Stripe-Signature", signStripe("whsec", body, time.Now()))
+	if paid, err := s.paidCheckout(req); err != nil || paid != "cs_1" {
+		t.Errorf("Expected cs_1 to be paid, got %q %v", paid, err)
+	}
+}
+
+func TestPurchasePhoto(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.SalesCurrency = "usd"
+	checkout := &fakeCheckout{}
+	app.checkout = checkout
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buyer := &user{Name: "buyer", Email: "buyer@localhost"}
+	buyerToken, err := dm.login(buyer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "heron", Filename: "heron.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+	app.filestore.store(strings.NewReader("image"), p.Filename, "image/jpeg")
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	purchaseURL := fmt.Sprintf("/api/photos/%d/purchase", p.ID)
+	originalURL := fmt.Sprintf("/api/photos/%d/original", p.ID)
+
+	if res := send("POST", purchaseURL, buyerToken, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("Photo not for sale should not be bought, got %d", res.Code)
+	}
+
+	saleURL := fmt.Sprintf("/api/photos/%d/sale", p.ID)
+	if res := send("PATCH", saleURL, ownerToken, `{"price": 10}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a price out of range, got %d", res.Code)
+	}
+	if res := send("PATCH", saleURL, buyerToken, `{"price": 1500}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a photo of another user, got %d", res.Code)
+	}
+	if res := send("PATCH", saleURL, ownerToken, `{"price": 1500, "license": "Personal use"}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	if res := send("POST", purchaseURL, ownerToken, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("Owner should not buy their own photo, got %d", res.Code)
+	}
+
+	res := send("POST", purchaseURL, buyerToken, "")
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	if !strings.Contains(res.Body.String(), "https://checkout.localhost/cs_1") {
+		t.Errorf("Expected the checkout URL, got %s", res.Body.String())
+	}
+	if req := checkout.created[0]; req.purchase.Amount != 1500 || req.purchase.License != "Personal use" {
+		t.Errorf("Unexpected purchase %+v", req.purchase)
+	}
+
+	if res := send("GET", originalURL, buyerToken, ""); res.Code != http.StatusForbidden {
+		t.Errorf("Original should not be downloaded before payment, got %d", res.Code)
+	}
+
+	checkout.paid = "cs_1"
+	if res := send("POST", "/api/checkout/webhook", "", "{}"); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	if res := send("GET", originalURL, buyerToken, ""); res.Code != http.StatusOK || res.Body.String() != "image" {
+		t.Errorf("Buyer should download the original, got %d", res.Code)
+	}
+	if res := send("GET", "/api/user/purchases", buyerToken, ""); !strings.Contains(res.Body.String(), `"title":"heron"`) {
+		t.Errorf("Purchase should be listed, got %s", res.Body.String())
+	}
+	if res := send("POST", purchaseURL, buyerToken, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("Photo should not be bought twice, got %d", res.Code)
+	}
+}
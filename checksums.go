@@ -0,0 +1,191 @@
+package photoshare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The SHA-256 of each upload is recorded with its photo. Files are read back
+// and checked against it as soon as they are stored, and again by a scrub
+// that checks STORAGE_SCRUB_BATCH files of each site every hour, each at most
+// once a week. Files found missing or changed are reported to admins at
+// /api/admin/storage/corruptions; storages keeping another copy of each file
+// repair them from it. Photos uploaded before checksums were recorded have
+// theirs taken by their first check.
+
+const (
+	storageScrubInterval  = time.Hour
+	storageRecheckAge     = 7 * 24 * time.Hour
+	storageReportDuration = 30 * 24 * time.Hour
+)
+
+// a storage keeping another copy of each file, from which it restores a
+// missing or changed file
+type repairableStorage interface {
+	repair(string) error
+}
+
+// returns the SHA-256 of the contents, in hex
+func checksum(src io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// returns the checksum of the stored file
+func fileChecksum(store fileStorage, name string) (string, error) {
+	f, err := store.open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return checksum(f)
+}
+
+// stores the file, returning its checksum once the stored file is read back
+// and matches it. A file stored wrongly is removed.
+func storeChecked(store fileStorage, src readable, name, contentType string) (string, error) {
+	sum, err := checksum(src)
+	if err != nil {
+		return "", err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// files are named by their contents, so the file may be stored already
+	// for another photo
+	if stored, err := fileChecksum(store, name); err == nil && stored == sum {
+		return sum, nil
+	}
+	if err := store.store(src, name, contentType); err != nil {
+		return "", err
+	}
+	stored, err := fileChecksum(store, name)
+	if err == nil && stored != sum {
+		err = fmt.Errorf("stored file %s does not match its checksum", name)
+	}
+	if err != nil {
+		if err := store.clean(name); err != nil {
+			logError(err)
+		}
+		return "", err
+	}
+	return sum, nil
+}
+
+// checks the file of the photo, repairing it if the storage can, and
+// returns the corruption found, or nil if the file is intact
+func checkPhotoFile(store fileStorage, p *photo) *storageCorruption {
+	problem := fileProblem(store, p)
+	if problem == "" {
+		return nil
+	}
+	c := &storageCorruption{PhotoID: p.ID, Problem: problem}
+	if r, ok := store.(repairableStorage); ok {
+		if err := r.repair(p.Filename); err != nil {
+			logError(err)
+		} else if fileProblem(store, p) == "" {
+			c.Repaired = true
+		}
+	}
+	return c
+}
+
+// returns what is wrong with the file of the photo, if anything
+func fileProblem(store fileStorage, p *photo) string {
+	sum, err := fileChecksum(store, p.Filename)
+	if err != nil {
+		return "File cannot be read: " + err.Error()
+	}
+	if sum != p.Checksum {
+		return "File does not match its checksum"
+	}
+	return ""
+}
+
+// checks the files of the photos of the site checked longest ago, returning
+// the number checked and the number corrupted and not repaired
+func scrubSiteStorage(datamapper dataMapper, store fileStorage, now time.Time, batch int) (int, int, error) {
+
+	photos, err := datamapper.getPhotosToCheck(now.Add(-storageRecheckAge), batch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var corrupted int
+	for i := range photos {
+		p := &photos[i]
+
+		var c *storageCorruption
+		if p.Checksum == "" {
+			// uploaded before checksums were recorded: trusted as it is
+			if p.Checksum, err = fileChecksum(store, p.Filename); err == nil {
+				err = datamapper.setPhotoChecksum(p)
+			}
+			if err != nil {
+				logError(err)
+				continue
+			}
+		} else {
+			c = checkPhotoFile(store, p)
+		}
+
+		if c != nil {
+			if c.Repaired {
+				log.Printf("Repaired the file %s of photo %d: %s", p.Filename, p.ID, c.Problem)
+			} else {
+				log.Printf("Corrupted file %s of photo %d: %s", p.Filename, p.ID, c.Problem)
+				corrupted++
+			}
+		}
+		if err := datamapper.recordStorageCheck(p, now, c); err != nil {
+			return i, corrupted, err
+		}
+	}
+	return len(photos), corrupted, nil
+}
+
+// checks a batch of files of each site
+func scrubStorage(app *app) {
+	sites, err := app.datamapper.getSites()
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, s := range sites {
+		checked, corrupted, err := scrubSiteStorage(app.datamapper.forSite(s.ID), app.filestore, utcNow(), app.cfg.StorageScrubBatch)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if corrupted > 0 {
+			log.Printf("Checked %d files of site %d, %d corrupted", checked, s.ID, corrupted)
+		}
+	}
+}
+
+// checks the storage until the server stops
+func runStorageScrub(app *app) {
+	if app.cfg.StorageScrubBatch == 0 {
+		return
+	}
+	for range time.Tick(storageScrubInterval) {
+		scrubStorage(app)
+	}
+}
+
+// returns the files of the site found corrupted, open or resolved lately
+func getStorageCorruptions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	corruptions, err := ctx.datamapper.getStorageCorruptions(utcNow().Add(-storageReportDuration))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, corruptions, http.StatusOK)
+}
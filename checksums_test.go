@@ -0,0 +1,141 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stores files with a byte changed
+type corruptingStorage struct {
+	*memoryFileStorage
+}
+
+func (f *corruptingStorage) store(src readable, filename, contentType string) error {
+	if err := f.memoryFileStorage.store(src, filename, contentType); err != nil {
+		return err
+	}
+	f.files[filename][0]++
+	return nil
+}
+
+// keeps another copy of each file, to repair from
+type mirroredStorage struct {
+	*memoryFileStorage
+	copies map[string][]byte
+}
+
+func (f *mirroredStorage) repair(filename string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.files[filename] = append([]byte(nil), f.copies[filename]...)
+	return nil
+}
+
+func TestStoreChecked(t *testing.T) {
+
+	store := newMemoryFileStorage(&fakeImageProcessor{})
+	sum, err := storeChecked(store, strings.NewReader("image"), "test.jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "image"
+	if sum != "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Errorf("Expected the SHA-256 of the file, got %s", sum)
+	}
+
+	corrupting := &corruptingStorage{newMemoryFileStorage(&fakeImageProcessor{})}
+	if _, err := storeChecked(corrupting, strings.NewReader("image"), "test.jpg", "image/jpeg"); err == nil {
+		t.Error("Expected an error for a file stored wrongly")
+	}
+	if _, err := corrupting.open("test.jpg"); err == nil {
+		t.Error("The file stored wrongly should be removed")
+	}
+}
+
+func TestScrubStorage(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	store := app.filestore.(*memoryFileStorage)
+
+	adminToken, err := dm.login(&user{Name: "admin", Email: "admin@localhost", IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photos := make(map[string]*photo)
+	for _, filename := range []string{"intact.jpg", "changed.jpg", "missing.jpg", "legacy.jpg"} {
+		p := &photo{Title: filename, Filename: filename, OwnerID: 1}
+		if p.Checksum, err = storeChecked(store, strings.NewReader("image "+filename), filename, "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if filename == "legacy.jpg" {
+			p.Checksum = ""
+		}
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		photos[filename] = p
+	}
+	store.files["changed.jpg"][0]++
+	store.clean("missing.jpg")
+
+	now := time.Now()
+	checked, corrupted, err := scrubSiteStorage(dm, store, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 4 || corrupted != 2 {
+		t.Errorf("Expected 4 files checked and 2 corrupted, got %d and %d", checked, corrupted)
+	}
+	if p, _ := dm.getPhoto(photos["legacy.jpg"].ID); p.Checksum == "" {
+		t.Error("Expected the checksum of the photo uploaded before checksums to be recorded")
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/admin/storage/corruptions", nil)
+	req.Header.Set(tokenHeader, adminToken)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	var corruptions []storageCorruptionDetail
+	parseJSONBody(res, &corruptions)
+	reported := make(map[string]bool)
+	for _, c := range corruptions {
+		reported[c.Filename] = c.ResolvedAt == nil
+	}
+	if len(reported) != 2 || !reported["changed.jpg"] || !reported["missing.jpg"] {
+		t.Errorf("Expected the changed and missing files to be reported, got %+v", corruptions)
+	}
+
+	// checked again only after a week
+	if checked, _, _ := scrubSiteStorage(dm, store, now.Add(time.Hour), 10); checked != 0 {
+		t.Errorf("Expected no files checked again, got %d", checked)
+	}
+
+	// repaired from another copy
+	mirrored := &mirroredStorage{store, map[string][]byte{"changed.jpg": []byte("image changed.jpg")}}
+	checked, corrupted, err = scrubSiteStorage(dm, mirrored, now.Add(storageRecheckAge+time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 4 || corrupted != 1 {
+		t.Errorf("Expected 4 files checked and 1 corrupted, got %d and %d", checked, corrupted)
+	}
+	corruptions, _ = dm.getStorageCorruptions(now)
+	for _, c := range corruptions {
+		if c.Filename == "changed.jpg" && (c.ResolvedAt == nil || !c.Repaired) {
+			t.Errorf("Expected the changed file to be repaired, got %+v", c)
+		}
+		if c.Filename == "missing.jpg" && c.ResolvedAt != nil {
+			t.Errorf("Expected the missing file to stay reported, got %+v", c)
+		}
+	}
+	if len(corruptions) != 2 {
+		t.Errorf("Expected one report of each file, got %+v", corruptions)
+	}
+}
@@ -1,9 +1,12 @@
 package photoshare
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/SherClockHolmes/webpush-go"
 	"github.com/codegangsta/negroni"
+	"image"
 	"io/ioutil"
 	"log"
 	"os"
@@ -12,21 +15,473 @@ import (
 	"strings"
 )
 
-// Serve runs the HTTP server
-func Serve() {
+// a subcommand of the photoshare tool
+type command struct {
+	name  string
+	usage string
+	run   func(app *app, args []string) error
+}
+
+var commands = []*command{
+	{"serve", "run the HTTP server", serveCommand},
+	{"createsite", "add a site served on its own host name", createSiteCommand},
+	{"createadmin", "create an admin user", createAdminCommand},
+	{"migrate", "apply pending database migrations", migrateCommand},
+	{"reindex", "rebuild database indexes and statistics", reindexCommand},
+	{"cleanup-orphans", "remove uploaded files and tags no longer used by any photo", cleanupOrphansCommand},
+	{"replicate", "copy uploaded files missing from STORAGE_REPLICA", replicateCommand},
+	{"encrypt-uploads", "encrypt uploaded files stored before STORAGE_MASTER_KEY was set", encryptUploadsCommand},
+	{"extract-gear", "read the camera and lens of photos uploaded without them", extractGearCommand},
+	{"extract-colors", "compute the palette and blurhash of photos uploaded without them", extractColorsCommand},
+	{"extract-dimensions", "read the size and resolution of photos uploaded without them", extractDimensionsCommand},
+	{"export", "write all users and photos of the site to an archive", exportCommand},
+	{"backup", "write a snapshot of the database and uploads to a directory", backupCommand},
+	{"restore", "restore a backup, checking the uploads it refers to", restoreCommand},
+	{"import", "import an archive, or photos from a directory", importCommand},
+	{"import-takeout", "import a Flickr or Instagram data export", importTakeoutCommand},
+	{"award-badges", "award the badges users of the site have earned", awardBadgesCommand},
+	{"generate-vapid-keys", "print a new key pair for Web Push notifications", generateVAPIDKeysCommand},
+}
+
+// admin commands act on the default site unless another is given
+var siteFlag = flag.String("site", "", "host name of the site commands act on")
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [config flags] <command> [command flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nConfig flags:")
+	flag.PrintDefaults()
+}
+
+// Main runs the command given on the command line. Config flags come before
+// the command name, command flags after it:
+//
+//	photoshare -config=config.json createadmin -name=admin -email=admin@localhost
+func Main() {
+
+	registerConfigFlags(flag.CommandLine)
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		printUsage()
+		os.Exit(2)
+	}
 
+	cmd := getCommand(flag.Arg(0))
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", flag.Arg(0))
+		printUsage()
+		os.Exit(2)
+	}
+
+	runCommand(cmd, flag.Args()[1:])
+}
+
+func getCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func runCommand(cmd *command, args []string) {
 	app, err := newApp()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer app.close()
 
+	if *siteFlag != "" {
+		site, err := findSite(app, *siteFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.datamapper = app.datamapper.forSite(site.ID)
+	}
+
+	if err := cmd.run(app, args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Serve runs the HTTP server
+func Serve() {
+	registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+	runCommand(getCommand("serve"), flag.Args())
+}
+
+func serveCommand(app *app, args []string) error {
+
+	log.Printf("Configuration:\n%s", app.cfg)
+
 	runtime.GOMAXPROCS((runtime.NumCPU() * 2) + 1)
 
-	n := negroni.Classic()
+	// static files are served by the router
+	n := negroni.New(negroni.NewRecovery(), app.proxies, negroni.NewLogger(), newCompressor(app.cfg), newHotlinkGuard(app.cfg))
 	n.UseHandler(app.router)
+
+	go runScoreReconciliation(app)
+	go runIdempotencyKeyCleanup(app)
+	go runRetention(app)
+	go runPhotoExpiry(app)
+	go runStorageScrub(app)
+	go runAchievements(app)
+	go runChallengeAnnouncements(app)
+
+	if app.cfg.useTLS() {
+		return listenAndServeTLS(app.cfg, n)
+	}
+
 	n.Run(fmt.Sprintf(":%d", app.cfg.ServerPort))
 
+	return nil
+}
+
+func createSiteCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("createsite", flag.ExitOnError)
+	name := fs.String("name", "", "Site name")
+	hostname := fs.String("hostname", "", "Host name the site is served on")
+	fs.Parse(args)
+
+	if *name == "" || *hostname == "" {
+		return errors.New("name and hostname are required")
+	}
+
+	if _, err := findSite(app, *hostname); err == nil {
+		return errors.New("a site already uses this host name")
+	}
+
+	s := &site{Name: *name, Hostname: strings.ToLower(*hostname)}
+	if err := app.datamapper.createSite(s); err != nil {
+		return err
+	}
+
+	log.Printf("Created site %s (%d)", s.Hostname, s.ID)
+	return nil
+}
+
+func createAdminCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("createadmin", flag.ExitOnError)
+	name := fs.String("name", "", "User name")
+	email := fs.String("email", "", "Email address")
+	password := fs.String("password", "", "Password")
+	fs.Parse(args)
+
+	if *name == "" || *email == "" || *password == "" {
+		return errors.New("name, email and password are required")
+	}
+
+	if !validateEmail(*email) {
+		return errors.New("invalid email address")
+	}
+
+	admin := &user{
+		Name:     *name,
+		Email:    *email,
+		Password: *password,
+		IsAdmin:  true,
+	}
+
+	if ok, err := app.datamapper.isUserNameAvailable(admin); err != nil || !ok {
+		if err != nil {
+			return err
+		}
+		return errors.New("name already taken")
+	}
+
+	if ok, err := app.datamapper.isUserEmailAvailable(admin); err != nil || !ok {
+		if err != nil {
+			return err
+		}
+		return errors.New("email already taken")
+	}
+
+	if err := app.datamapper.createUser(admin); err != nil {
+		return err
+	}
+
+	log.Printf("Created admin %s (id %d)", admin.Name, admin.ID)
+	return nil
+}
+
+func migrateCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dirname := fs.String("dir", filepath.Join(app.cfg.BaseDir, "db", "migrations"), "Migrations directory")
+	dryRun := fs.Bool("dry-run", false, "List pending migrations without applying them")
+	fs.Parse(args)
+
+	migrations, err := migrate(app.db, *dirname, *dryRun)
+	for _, m := range migrations {
+		if *dryRun {
+			log.Printf("Pending %s", filepath.Base(m.filename))
+		} else {
+			log.Printf("Applied %s", filepath.Base(m.filename))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		log.Println("No pending migrations")
+	}
+	return nil
+}
+
+func reindexCommand(app *app, args []string) error {
+	for _, table := range []string{"photos", "photo_tags", "tags", "users"} {
+		log.Printf("Reindexing %s", table)
+		if _, err := app.db.Exec("REINDEX TABLE " + table); err != nil {
+			return err
+		}
+	}
+	_, err := app.db.Exec("ANALYZE")
+	return err
+}
+
+func cleanupOrphansCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("cleanup-orphans", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "List orphans without removing them")
+	fs.Parse(args)
+
+	filenames, err := app.datamapper.getPhotoFilenames()
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, name := range filenames {
+		used[name] = true
+	}
+
+	stored, err := app.filestore.list()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range stored {
+		if used[name] {
+			continue
+		}
+		log.Printf("Orphaned file %s", name)
+		if *dryRun {
+			continue
+		}
+		if err := app.filestore.clean(name); err != nil {
+			logError(err)
+		}
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	num, err := app.datamapper.removeOrphanTags()
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d unused tags", num)
+	return nil
+}
+
+// copies the uploads missing from the replica, e.g. after adding one
+func replicateCommand(app *app, args []string) error {
+	s, ok := app.filestore.(*replicatedStorage)
+	if !ok {
+		return errors.New("STORAGE_REPLICA is not set")
+	}
+	num, err := s.replicateMissing()
+	log.Printf("Copied %d files to the replica", num)
+	return err
+}
+
+// awards the badges earned before they were checked, e.g. for achievements
+// added since
+func awardBadgesCommand(app *app, args []string) error {
+	users, err := app.datamapper.getAllUsers()
+	if err != nil {
+		return err
+	}
+	var num int
+	for _, u := range users {
+		awarded, err := awardBadges(app.datamapper, u.ID)
+		if err != nil {
+			return err
+		}
+		num += len(awarded)
+	}
+	log.Printf("Awarded %d badges to %d users", num, len(users))
+	return nil
+}
+
+func encryptUploadsCommand(app *app, args []string) error {
+	if app.cfg.StorageMasterKey == "" {
+		return errors.New("STORAGE_MASTER_KEY is not set")
+	}
+	num, err := encryptStorage(app.filestore)
+	log.Printf("Encrypted %d files", num)
+	return err
+}
+
+// fills in the camera and lens of photos uploaded before they were read
+// from EXIF data
+func extractGearCommand(app *app, args []string) error {
+
+	photos, err := app.datamapper.getAllPhotos()
+	if err != nil {
+		return err
+	}
+
+	var num int
+	for i := range photos {
+		p := &photos[i].photo
+		if p.Camera != "" || p.Lens != "" {
+			continue
+		}
+		f, err := app.filestore.open(p.Filename)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		p.Camera, p.Lens = readGear(f)
+		f.Close()
+		if p.Camera == "" && p.Lens == "" {
+			continue
+		}
+		if err := app.datamapper.setPhotoGear(p); err != nil {
+			return err
+		}
+		num++
+	}
+	log.Printf("Read the camera and lens of %d photos", num)
+	return nil
+}
+
+// fills in the palette and blurhash of photos uploaded before they were
+// computed
+func extractColorsCommand(app *app, args []string) error {
+
+	photos, err := app.datamapper.getAllPhotos()
+	if err != nil {
+		return err
+	}
+
+	var num int
+	for i := range photos {
+		p := &photos[i].photo
+		if len(p.Colors) > 0 && p.Blurhash != "" {
+			continue
+		}
+		f, err := app.filestore.open(p.Filename)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			logError(err)
+			continue
+		}
+		p.setPalette(extractPalette(img, paletteSize))
+		p.Blurhash = encodeBlurhash(img, blurhashXComponents, blurhashYComponents)
+		if err := app.datamapper.setPhotoColors(p); err != nil {
+			return err
+		}
+		num++
+	}
+	log.Printf("Computed the colors of %d photos", num)
+	return nil
+}
+
+// fills in the size and resolution of photos uploaded before they were read
+func extractDimensionsCommand(app *app, args []string) error {
+
+	photos, err := app.datamapper.getAllPhotos()
+	if err != nil {
+		return err
+	}
+
+	var num int
+	for i := range photos {
+		p := &photos[i].photo
+		if p.Width > 0 && p.Height > 0 {
+			continue
+		}
+		f, err := app.filestore.open(p.Filename)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			logError(err)
+			continue
+		}
+		p.Width, p.Height = cfg.Width, cfg.Height
+		if f, err := app.filestore.open(p.Filename); err == nil {
+			p.DPI = readDPI(f)
+			f.Close()
+		}
+		if err := app.datamapper.setPhotoDimensions(p); err != nil {
+			return err
+		}
+		num++
+	}
+	log.Printf("Read the size of %d photos", num)
+	return nil
+}
+
+func exportCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dirname := fs.String("out", "", "Archive directory")
+	fs.Parse(args)
+
+	if *dirname == "" {
+		return errors.New("archive directory is required")
+	}
+
+	return exportArchive(app, *dirname)
+}
+
+// backups hold every site
+func backupCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dirname := fs.String("out", "", "Backup directory, created by the backup")
+	manifestOnly := fs.Bool("manifest-only", false, "List the uploads without copying them, if they are backed up otherwise")
+	fs.Parse(args)
+
+	if *dirname == "" {
+		return errors.New("backup directory is required")
+	}
+
+	return writeBackup(app, *dirname, !*manifestOnly)
+}
+
+func restoreCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dirname := fs.String("from", "", "Backup directory")
+	verifyOnly := fs.Bool("verify-only", false, "Check the backup without restoring it")
+	fs.Parse(args)
+
+	if *dirname == "" {
+		return errors.New("backup directory is required")
+	}
+
+	return restoreBackup(app, *dirname, *verifyOnly)
 }
 
 func storeFile(app *app,
@@ -36,15 +491,14 @@ func storeFile(app *app,
 	tags []string,
 	userID int64) error {
 	log.Println(title)
-	name := generateRandomFilename(contentType)
 	file, err := os.Open(filename)
 	if err != nil {
-		logError(err)
+		return err
 	}
 	defer file.Close()
-	err = app.filestore.store(file, name, contentType)
+	name, err := contentFilename(app.cfg, file, contentType)
 	if err != nil {
-		logError(err)
+		return err
 	}
 	photo := &photo{
 		Title:    title,
@@ -52,11 +506,9 @@ func storeFile(app *app,
 		Tags:     tags,
 		OwnerID:  userID,
 	}
-	if err := app.datamapper.createPhoto(photo); err != nil {
-		return err
-	}
-
-	return nil
+	return storePhotoFile(app.datamapper, app.filestore, file, photo, contentType, func() error {
+		return app.datamapper.createPhoto(photo)
+	})
 }
 
 func scanDir(app *app, userID int64, baseDir, dirname string) {
@@ -97,22 +549,58 @@ func Import() {
 	email := flag.String("user", "", "User email address")
 	dirname := flag.String("dir", "", "Directory")
 
+	registerConfigFlags(flag.CommandLine)
 	flag.Parse()
 
+	runCommand(getCommand("import"), []string{"-user", *email, "-dir", *dirname})
+}
+
+func importCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	archiveDir := fs.String("archive", "", "Archive directory")
+	preserveIDs := fs.Bool("preserve-ids", false, "Keep the IDs in the archive (for an empty site)")
+	email := fs.String("user", "", "User email address")
+	dirname := fs.String("dir", "", "Directory")
+	fs.Parse(args)
+
+	if *archiveDir != "" {
+		return importArchive(app, *archiveDir, *preserveIDs)
+	}
+
 	fmt.Println(*email)
 	fmt.Println(*dirname)
 
-	app, err := newApp()
+	user, err := app.datamapper.getUserByEmail(*email)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer app.close()
+
+	scanDir(app, user.ID, *dirname, *dirname)
+	return nil
+}
+
+func importTakeoutCommand(app *app, args []string) error {
+
+	fs := flag.NewFlagSet("import-takeout", flag.ExitOnError)
+	email := fs.String("user", "", "User email address")
+	filename := fs.String("file", "", "Data export ZIP file")
+	format := fs.String("format", "", "Export format: flickr or instagram")
+	fs.Parse(args)
 
 	user, err := app.datamapper.getUserByEmail(*email)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	scanDir(app, user.ID, *dirname, *dirname)
+	return importTakeout(app, user.ID, *filename, *format)
+}
 
+func generateVAPIDKeysCommand(app *app, args []string) error {
+	privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("VAPID_PUBLIC_KEY=%s\nVAPID_PRIVATE_KEY=%s\n", publicKey, privateKey)
+	return nil
 }
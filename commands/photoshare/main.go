@@ -0,0 +1,7 @@
+package main
+
+import "github.com/danjac/photoshare"
+
+func main() {
+	photoshare.Main()
+}
@@ -0,0 +1,238 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users comment on the photos they can see. Authors may edit a comment for
+// COMMENT_EDIT_WINDOW minutes after posting it, marking it as edited, and
+// delete it at any time; admins remove any comment, giving a reason kept in
+// the audit log. Owners and admins lock the comments of a photo, after
+// which no comments are added.
+
+const maxCommentLength = 2000
+
+func (ctx *context) commentEditWindow() time.Duration {
+	return time.Duration(ctx.cfg.CommentEditWindow) * time.Minute
+}
+
+func (ctx *context) commentPermissions(c *comment) *commentPermissions {
+	return &commentPermissions{
+		c.canEdit(ctx.user, ctx.commentEditWindow(), utcNow()),
+		c.canDelete(ctx.user),
+	}
+}
+
+func getComments(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.requireFeature(featureComments); err != nil {
+		return err
+	}
+
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	comments, err := ctx.datamapper.getComments(photo.ID, ctx.user)
+	if err != nil {
+		return err
+	}
+	if comments == nil {
+		comments = []commentDetail{}
+	}
+	for i := range comments {
+		comments[i].Permissions = ctx.commentPermissions(&comments[i].comment)
+	}
+	return renderJSON(w, comments, http.StatusOK)
+}
+
+func addComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.requireFeature(featureComments); err != nil {
+		return err
+	}
+
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	blocked, err := ctx.datamapper.isBlocked(photo.OwnerID, ctx.user.ID, false)
+	if err != nil {
+		return err
+	}
+	if err := ctx.permit(!blocked, "You're not allowed to comment on this photo"); err != nil {
+		return err
+	}
+	if photo.CommentsLocked {
+		return httpError{http.StatusForbidden, "Comments are locked on this photo"}
+	}
+
+	s := &struct {
+		Body string `json:"body"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	comment := &comment{PhotoID: photo.ID, AuthorID: ctx.user.ID, Body: strings.TrimSpace(s.Body)}
+	if err := ctx.validate(comment, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.createComment(comment); err != nil {
+		return err
+	}
+	notifyComment(ctx, r, &photo.photo, comment, "")
+	return renderJSON(w, &commentDetail{*comment, ctx.user.Name, ctx.commentPermissions(comment)}, http.StatusCreated)
+}
+
+func editComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.requireFeature(featureComments); err != nil {
+		return err
+	}
+
+	comment, err := ctx.datamapper.getComment(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.permit(comment.canEdit(ctx.user, ctx.commentEditWindow(), utcNow()),
+		"You're not allowed to edit this comment"); err != nil {
+		return err
+	}
+
+	s := &struct {
+		Body string `json:"body"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	body := strings.TrimSpace(s.Body)
+	if body == comment.Body {
+		return renderJSON(w, &commentDetail{*comment, ctx.user.Name, ctx.commentPermissions(comment)}, http.StatusOK)
+	}
+
+	previous := comment.Body
+	comment.Body = body
+	if err := ctx.validate(comment, r); err != nil {
+		return err
+	}
+
+	now := utcNow()
+	comment.Edited = true
+	comment.EditedAt = &now
+	if err := ctx.datamapper.updateComment(comment); err != nil {
+		return err
+	}
+	if photo, err := ctx.datamapper.getPhoto(comment.PhotoID); err == nil {
+		notifyComment(ctx, r, photo, comment, previous)
+	} else {
+		logError(err)
+	}
+	return renderJSON(w, &commentDetail{*comment, ctx.user.Name, ctx.commentPermissions(comment)}, http.StatusOK)
+}
+
+// notifies the users mentioned in the comment, but not in its previous body,
+// and the owner of the photo of a new comment. Errors are logged, as the
+// comment is saved.
+func notifyComment(ctx *context, r *http.Request, photo *photo, comment *comment, previous string) {
+	if err := notifyMentions(ctx, r, photo, comment.Body, previous); err != nil {
+		logError(err)
+	}
+	if previous != "" || photo.OwnerID == ctx.user.ID {
+		return
+	}
+	owner, err := ctx.datamapper.getActiveUser(photo.OwnerID)
+	if err == nil {
+		err = sendNotification(ctx, r, owner, notificationComment, photo)
+	}
+	if err != nil && !isErrSqlNoRows(err) {
+		logError(err)
+	}
+}
+
+// deletes the comment; admins removing the comment of another user give a
+// reason, e.g. {"reason": "spam"}
+func deleteComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	comment, err := ctx.datamapper.getComment(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.permit(comment.canDelete(ctx.user), "You're not allowed to delete this comment"); err != nil {
+		return err
+	}
+
+	moderated := comment.AuthorID != ctx.user.ID
+	var reason string
+	if moderated {
+		s := &struct {
+			Reason string `json:"reason"`
+		}{}
+
+		if err := decodeJSON(r, s); err != nil {
+			return err
+		}
+
+		if reason = strings.TrimSpace(s.Reason); reason == "" {
+			return validationFailure{map[string]string{"reason": "Reason is missing"}}
+		}
+	}
+
+	if err := ctx.datamapper.deleteComment(comment); err != nil {
+		return err
+	}
+
+	if moderated {
+		details := fmt.Sprintf("photo=%d reason=%s", comment.PhotoID, reason)
+		if err := writeAuditLog(ctx, "remove_comment", comment.AuthorID, details); err != nil {
+			return err
+		}
+	}
+	return renderString(w, http.StatusOK, "Comment deleted")
+}
+
+// locks or unlocks the comments of the photo, e.g. {"locked": true}
+func lockComments(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Locked bool `json:"locked"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	photo.CommentsLocked = s.Locked
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	if photo.OwnerID != ctx.user.ID {
+		if err := writeAuditLog(ctx, "lock_comments", photo.OwnerID,
+			fmt.Sprintf("photo=%d locked=%t", photo.ID, s.Locked)); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderJSON(w, photo, http.StatusOK)
+}
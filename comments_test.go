@@ -0,0 +1,231 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComments(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.CommentEditWindow = 15
+
+	admin := &user{Name: "admin", Email: "admin@localhost", IsAdmin: true, IsActive: true}
+	adminToken, err := dm.login(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := &user{Name: "author", Email: "author@localhost", IsActive: true}
+	authorToken, err := dm.login(author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &user{Name: "other", Email: "other@localhost", IsActive: true}
+	otherToken, err := dm.login(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photo := &photo{Title: "test", OwnerID: admin.ID}
+	if err := dm.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	commentsURL := fmt.Sprintf("/api/photos/%d/comments", photo.ID)
+	if res := send("POST", commentsURL, authorToken, `{"body": " "}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a body, got %d", res.Code)
+	}
+
+	add := func() string {
+		res := send("POST", commentsURL, authorToken, `{"body": "nice"}`)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+		}
+		c := &commentDetail{}
+		if err := json.NewDecoder(res.Body).Decode(c); err != nil {
+			t.Fatal(err)
+		}
+		if !c.Permissions.Edit || !c.Permissions.Delete {
+			t.Errorf("Expected the author to edit and delete, got %+v", c.Permissions)
+		}
+		return fmt.Sprintf("/api/comments/%d", c.ID)
+	}
+
+	url := add()
+	if res := send("PATCH", url, otherToken, `{"body": "mine"}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 editing the comment of another user, got %d", res.Code)
+	}
+	res := send("PATCH", url, authorToken, `{"body": "very nice"}`)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"edited":true`) {
+		t.Errorf("Expected the comment edited, got %d: %s", res.Code, res.Body.String())
+	}
+
+	// the edit window has passed
+	dm.comments[0].CreatedAt = time.Now().Add(-16 * time.Minute)
+	if res := send("PATCH", url, authorToken, `{"body": "nicer"}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 after the edit window, got %d", res.Code)
+	}
+	if res := send("DELETE", url, otherToken, ""); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting the comment of another user, got %d", res.Code)
+	}
+	if res := send("DELETE", url, authorToken, ""); res.Code != http.StatusOK {
+		t.Errorf("Expected 200 deleting your own comment, got %d", res.Code)
+	}
+
+	// admins remove comments with a reason
+	url = add()
+	if res := send("DELETE", url, adminToken, `{"reason": ""}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a reason, got %d", res.Code)
+	}
+	if res := send("DELETE", url, adminToken, `{"reason": "spam"}`); res.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", res.Code)
+	}
+	if len(dm.comments) != 0 {
+		t.Errorf("Expected the comments deleted, got %+v", dm.comments)
+	}
+	if len(dm.audit) != 1 || dm.audit[0].Action != "remove_comment" || !strings.Contains(dm.audit[0].Details, "reason=spam") {
+		t.Errorf("Expected the removal in the audit log, got %+v", dm.audit)
+	}
+}
+
+func TestLockComments(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost", IsActive: true}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &user{Name: "other", Email: "other@localhost", IsActive: true}
+	otherToken, err := dm.login(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photo := &photo{Title: "test", OwnerID: owner.ID}
+	if err := dm.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	lockURL := fmt.Sprintf("/api/photos/%d/comments/lock", photo.ID)
+	if res := send("PATCH", lockURL, otherToken, `{"locked": true}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 locking the photo of another user, got %d", res.Code)
+	}
+	if res := send("PATCH", lockURL, ownerToken, `{"locked": true}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	res := send("GET", fmt.Sprintf("/api/photos/%d", photo.ID), otherToken, "")
+	detail := &photoDetail{}
+	if err := json.NewDecoder(res.Body).Decode(detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.CommentsLocked || detail.Permissions.Comment {
+		t.Errorf("Expected the comments locked, got %+v", detail.Permissions)
+	}
+
+	commentsURL := fmt.Sprintf("/api/photos/%d/comments", photo.ID)
+	if res := send("POST", commentsURL, otherToken, `{"body": "nice"}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 while locked, got %d", res.Code)
+	}
+
+	if res := send("PATCH", lockURL, ownerToken, `{"locked": false}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if res := send("POST", commentsURL, otherToken, `{"body": "nice"}`); res.Code != http.StatusCreated {
+		t.Errorf("Expected 201 once unlocked, got %d", res.Code)
+	}
+}
+
+func TestCommentNotifications(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.CommentEditWindow = 15
+
+	owner := &user{Name: "owner", Email: "owner@example.com", IsActive: true}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	author := &user{Name: "author", Email: "author@example.com", IsActive: true}
+	token, err := dm.login(author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"friend", "other"} {
+		if err := dm.createUser(&user{Name: name, Email: name + "@example.com", IsActive: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	photo := &photo{Title: "test", OwnerID: owner.ID}
+	if err := dm.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	kinds := func() []string {
+		var kinds []string
+		for _, n := range dm.notifications {
+			kinds = append(kinds, n.Type)
+		}
+		return kinds
+	}
+
+	res := send("POST", fmt.Sprintf("/api/photos/%d/comments", photo.ID), `{"body": "nice @friend"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	c := &commentDetail{}
+	if err := json.NewDecoder(res.Body).Decode(c); err != nil {
+		t.Fatal(err)
+	}
+	if k := kinds(); len(k) != 2 || k[0] != notificationMention || k[1] != notificationComment {
+		t.Errorf("Expected the friend mentioned and the owner notified, got %v", k)
+	}
+
+	// only the new mention is notified
+	url := fmt.Sprintf("/api/comments/%d", c.ID)
+	if res := send("PATCH", url, `{"body": "nice @friend @other"}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if k := kinds(); len(k) != 3 || k[2] != notificationMention || dm.notifications[2].UserID == dm.notifications[0].UserID {
+		t.Errorf("Expected only the new mention notified, got %v", k)
+	}
+	if len(dm.mentions) != 2 {
+		t.Errorf("Expected 2 mentions, got %d", len(dm.mentions))
+	}
+}
@@ -0,0 +1,202 @@
+package photoshare
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// content types worth compressing; images are already compressed
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+	"text/",
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	for _, value := range compressibleTypes {
+		if strings.HasPrefix(contentType, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if the Accept-Encoding header accepts the encoding
+func acceptsEncoding(header, encoding string) bool {
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.TrimSpace(parts[0])
+		if name != encoding && name != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Compresses responses of compressible types and at least minSize bytes.
+// The decision is made when the headers are written, so the handler must
+// set Content-Type (and Content-Length, if known) before writing the body.
+type compressor struct {
+	minSize int
+}
+
+func newCompressor(cfg *config) *compressor {
+	return &compressor{cfg.CompressMinSize}
+}
+
+// negroni middleware
+func (c *compressor) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	if c.minSize < 0 || r.Header.Get("Upgrade") != "" {
+		next(w, r)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	accept := r.Header.Get("Accept-Encoding")
+
+	var encoding string
+	switch {
+	case acceptsEncoding(accept, "gzip"):
+		encoding = "gzip"
+	case acceptsEncoding(accept, "deflate"):
+		encoding = "deflate"
+	default:
+		next(w, r)
+		return
+	}
+
+	cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding, minSize: c.minSize}
+	defer cw.close()
+
+	next(cw, r)
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minSize     int
+	wroteHeader bool
+	writer      compressWriter
+}
+
+func (w *compressResponseWriter) shouldCompress() bool {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || !isCompressible(h.Get("Content-Type")) {
+		return false
+	}
+	if length := h.Get("Content-Length"); length != "" {
+		if n, err := strconv.Atoi(length); err == nil && n < w.minSize {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if status != http.StatusNoContent && status != http.StatusNotModified && w.shouldCompress() {
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+
+		if w.encoding == "gzip" {
+			w.writer = gzipWriters.Get().(*gzip.Writer)
+		} else {
+			w.writer = flateWriters.Get().(*flate.Writer)
+		}
+		w.writer.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response does not support hijacking")
+}
+
+func (w *compressResponseWriter) close() {
+	if w.writer == nil {
+		return
+	}
+	w.writer.Close()
+	switch writer := w.writer.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(writer)
+	case *flate.Writer:
+		flateWriters.Put(writer)
+	}
+	w.writer = nil
+}
@@ -0,0 +1,68 @@
+package photoshare
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressLargeJSON(t *testing.T) {
+	c := &compressor{minSize: 100}
+	body := strings.Repeat(`{"title":"photo"},`, 100)
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/photos/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	res := httptest.NewRecorder()
+
+	c.ServeHTTP(res, req, func(w http.ResponseWriter, r *http.Request) {
+		writeBody(w, []byte(body), http.StatusOK, "application/json")
+	})
+
+	if res.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("Response should be gzipped")
+	}
+	if res.Header().Get("Vary") != "Accept-Encoding" {
+		t.Error("Response should vary on Accept-Encoding")
+	}
+	if res.Header().Get("Content-Length") != "" {
+		t.Error("Content-Length of the uncompressed body should be removed")
+	}
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := ioutil.ReadAll(r)
+	if string(decoded) != body {
+		t.Error("Decompressed body should match original")
+	}
+}
+
+func TestCompressSkipsSmallOrBinary(t *testing.T) {
+	c := &compressor{minSize: 100}
+
+	for _, tc := range []struct {
+		body, contentType, accept string
+	}{
+		{"ok", "text/plain", "gzip"},
+		{strings.Repeat("x", 200), "image/jpeg", "gzip"},
+		{strings.Repeat("x", 200), "text/plain", "gzip;q=0"},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		res := httptest.NewRecorder()
+
+		c.ServeHTTP(res, req, func(w http.ResponseWriter, r *http.Request) {
+			writeBody(w, []byte(tc.body), http.StatusOK, tc.contentType)
+		})
+
+		if res.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s (%s, %s) should not be compressed", tc.contentType, tc.accept, tc.body[:2])
+		}
+		if res.Body.String() != tc.body {
+			t.Error("Body should be unchanged")
+		}
+	}
+}
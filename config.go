@@ -1,27 +1,49 @@
 package photoshare
 
 import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"encoding/json"
 	"errors"
-	"github.com/danryan/env"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
+// Settings are read from (in order of precedence) command line flags,
+// environment variables and a JSON config file, falling back to defaults.
+//
+// Each setting is described by its env tag:
+//
+//	key      name of the environment variable and config file key; the flag
+//	         name is the lower-cased key with dashes, e.g. -db-name
+//	default  value used if the setting is not given
+//	required startup fails if the setting is missing
+//	secret   value is redacted when the config is printed, and has no flag
 type config struct {
 	DBName     string `env:"key=DB_NAME required=true"`
 	DBUser     string `env:"key=DB_USER required=true"`
-	DBPassword string `env:"key=DB_PASS required=true"`
+	DBPassword string `env:"key=DB_PASS required=true secret=true"`
 	DBHost     string `env:"key=DB_HOST default=localhost"`
 
+	// host of a streaming replica of the database, with the same name and
+	// credentials, for the read-heavy queries (see newDataMapper)
+	DBReplicaHost string `env:"key=DB_REPLICA_HOST"`
+
 	TestDBName     string `env:"key=TEST_DB_NAME"`
 	TestDBUser     string `env:"key=TEST_DB_USER"`
-	TestDBPassword string `env:"key=TEST_DB_PASS"`
+	TestDBPassword string `env:"key=TEST_DB_PASS secret=true"`
 	TestDBHost     string `env:"key=TEST_DB_HOST"`
 
 	LogSql bool `env:"key=LOG_SQL default=false"`
 
 	SmtpName          string `env:"key=SMTP_NAME"`
-	SmtpPassword      string `env:"key=SMTP_PASS"`
+	SmtpPassword      string `env:"key=SMTP_PASS secret=true"`
 	SmtpUser          string `env:"key=SMTP_USER"`
 	SmtpHost          string `env:"key=SMTP_HOST default=localhost"`
 	SmtpPort          int    `env:"key=SMTP_PORT default=25"`
@@ -36,17 +58,580 @@ type config struct {
 	PrivateKey string `env:"key=PRIVATE_KEY required=true"`
 	PublicKey  string `env:"key=PUBLIC_KEY required=true"`
 
+	// client a session is bound to: lax for the browser and platform of the
+	// user agent, strict for the exact user agent and IP address, or off
+	// (see session.go)
+	SessionBinding string `env:"key=SESSION_BINDING default=lax"`
+
 	MemcacheHost string `env:"key=MEMCACHE_HOST default=0.0.0.0:11211"`
 
 	GoogleClientID string `env:"key=GOOGLE_CLIENT_ID"`
-	GoogleSecret   string `env:"key=GOOGLE_SECRET"`
+	GoogleSecret   string `env:"key=GOOGLE_SECRET secret=true"`
 
 	ServerPort int `env:"key=PORT default=5000"`
+
+	// HTTPS is enabled with either a certificate and key file, or a list of
+	// domains for which certificates are obtained from Let's Encrypt
+	HTTPSPort    int    `env:"key=HTTPS_PORT default=443"`
+	TLSCertFile  string `env:"key=TLS_CERT_FILE"`
+	TLSKeyFile   string `env:"key=TLS_KEY_FILE"`
+	ACMEDomains  string `env:"key=ACME_DOMAINS"`
+	ACMEEmail    string `env:"key=ACME_EMAIL"`
+	ACMECacheDir string `env:"key=ACME_CACHE_DIR"`
+
+	// comma-separated IP addresses or CIDR ranges of reverse proxies whose
+	// X-Forwarded-For and X-Forwarded-Proto headers are trusted
+	TrustedProxies string `env:"key=TRUSTED_PROXIES"`
+
+	// limits
+	MaxUploadSize int64 `env:"key=MAX_UPLOAD_SIZE default=10485760"` // bytes
+
+	// largest width or height of the photos served to users other than
+	// the owner, in pixels (see prints.go); 0 serves the originals
+	PublicMaxSize int `env:"key=PUBLIC_MAX_SIZE default=0"`
+
+	// processing of uploads (see processing.go): workers, 0 for one per
+	// CPU, uploads waiting for them, uploads of a user processed at once,
+	// and the size from which uploads are processed in the background, 0
+	// for never
+	ProcessingWorkers   int   `env:"key=PROCESSING_WORKERS default=0"`
+	ProcessingQueueSize int   `env:"key=PROCESSING_QUEUE_SIZE default=100"`
+	ProcessingUserLimit int   `env:"key=PROCESSING_USER_LIMIT default=2"`
+	AsyncUploadSize     int64 `env:"key=ASYNC_UPLOAD_SIZE default=5242880"` // bytes
+
+	// limits of image processing (see limits.go): pixels of an image, memory
+	// of the jobs processed at once, 0 for no limit, and seconds a job may
+	// take, 0 for no limit
+	MaxImagePixels    int64 `env:"key=MAX_IMAGE_PIXELS default=100000000"`
+	ProcessingMemory  int64 `env:"key=PROCESSING_MEMORY default=2147483648"` // bytes
+	ProcessingTimeout int   `env:"key=PROCESSING_TIMEOUT default=60"`
+
+	// comma-separated formats uploads are served in to browsers accepting
+	// them, best first, of "avif" and "webp" (see variants.go), and the
+	// directory the encoded files are kept in
+	ImageFormats string `env:"key=IMAGE_FORMATS"`
+	VariantsDir  string `env:"key=VARIANTS_DIR"`
+
+	// makes thumbnails: "go", or "vips" for libvips, with the Go processor
+	// as fallback if the binary was built without it (see vips.go)
+	ImageProcessor string `env:"key=IMAGE_PROCESSOR default=go"`
+
+	// a copy of the uploads, written in the background and read if the
+	// uploads directory fails (see replication.go): another directory, or
+	// s3://bucket/prefix for an S3 bucket at S3_ENDPOINT, path-style
+	StorageReplica string `env:"key=STORAGE_REPLICA"`
+	S3Endpoint     string `env:"key=S3_ENDPOINT default=https://s3.amazonaws.com"`
+	S3Region       string `env:"key=S3_REGION default=us-east-1"`
+	S3AccessKey    string `env:"key=S3_ACCESS_KEY"`
+	S3SecretKey    string `env:"key=S3_SECRET_KEY secret=true"`
+
+	// uploads and thumbnails encrypted in the storage, each with its own key
+	// wrapped by this one, 32 bytes in base64 (see encryption.go)
+	StorageMasterKey string `env:"key=STORAGE_MASTER_KEY secret=true"`
+
+	// key of the HMAC naming the stored files after their contents, so that
+	// names can't be told from the contents (see contentFilename); derived
+	// from the private key if not set
+	StorageNameKey string `env:"key=STORAGE_NAME_KEY secret=true"`
+
+	// uploads of each site checked against their checksums every hour, the
+	// longest unchecked first (see checksums.go); 0 disables the checks
+	StorageScrubBatch int `env:"key=STORAGE_SCRUB_BATCH default=100"`
+
+	// ZIP downloads of search results and groups (see download.go)
+	MaxDownloadPhotos int   `env:"key=MAX_DOWNLOAD_PHOTOS default=500"`
+	MaxDownloadSize   int64 `env:"key=MAX_DOWNLOAD_SIZE default=2147483648"` // bytes
+
+	// reads allowed in each window of seconds, by anonymous users, users
+	// logged in and clients with one of the comma-separated API keys (see
+	// ratelimit.go); 0 is unlimited
+	RateLimitWindow    int    `env:"key=RATE_LIMIT_WINDOW default=60"`
+	RateLimitAnonymous int    `env:"key=RATE_LIMIT_ANONYMOUS default=120"`
+	RateLimitUser      int    `env:"key=RATE_LIMIT_USER default=600"`
+	RateLimitAPIKey    int    `env:"key=RATE_LIMIT_API_KEY default=3000"`
+	APIKeys            string `env:"key=API_KEYS secret=true"`
+
+	// photos anonymous visitors may open in each window of seconds, by IP
+	// address, before they must log in (see preview.go); 0 is unlimited
+	AnonymousPhotoViews int `env:"key=ANONYMOUS_PHOTO_VIEWS default=0"`
+	AnonymousViewWindow int `env:"key=ANONYMOUS_VIEW_WINDOW default=86400"`
+
+	// minutes authors may edit their comments for; 0 disables editing
+	CommentEditWindow int `env:"key=COMMENT_EDIT_WINDOW default=15"`
+
+	// smallest response compressed, in bytes; -1 disables compression
+	CompressMinSize int `env:"key=COMPRESS_MIN_SIZE default=1024"`
+
+	// Web Push keys, created with the generate-vapid-keys command. The
+	// subject is a contact email or https URL given to push services.
+	VAPIDPublicKey  string `env:"key=VAPID_PUBLIC_KEY"`
+	VAPIDPrivateKey string `env:"key=VAPID_PRIVATE_KEY secret=true"`
+	VAPIDSubject    string `env:"key=VAPID_SUBJECT"`
+
+	// sites allowed to embed photos in frames, as CSP frame-ancestors
+	// sources, e.g. "https://blog.example.com"; "'none'" disables embedding
+	EmbedFrameAncestors string `env:"key=EMBED_FRAME_ANCESTORS default=*"`
+
+	// uploads shown only on pages of the site, of the comma-separated
+	// allowed hosts and their subdomains, or linked with a signature of
+	// HOTLINK_SECRET lasting HOTLINK_TOKEN_TTL seconds (see hotlink.go)
+	HotlinkProtection   bool   `env:"key=HOTLINK_PROTECTION default=false"`
+	HotlinkAllowedHosts string `env:"key=HOTLINK_ALLOWED_HOSTS"`
+	HotlinkSecret       string `env:"key=HOTLINK_SECRET secret=true"`
+	HotlinkTokenTTL     int    `env:"key=HOTLINK_TOKEN_TTL default=86400"`
+
+	// captcha required on signup and password recovery: recaptcha,
+	// turnstile or hcaptcha, with the keys given by the provider
+	CaptchaProvider string `env:"key=CAPTCHA_PROVIDER"`
+	CaptchaSiteKey  string `env:"key=CAPTCHA_SITE_KEY"`
+	CaptchaSecret   string `env:"key=CAPTCHA_SECRET secret=true"`
+
+	// password hashes (see passwords.go): argon2id, of passes, memory in
+	// KiB and threads, or bcrypt of its cost, with an optional pepper and
+	// the pepper before it; hashes of another algorithm, cost or pepper are
+	// replaced as their users log in
+	PasswordAlgorithm     string `env:"key=PASSWORD_ALGORITHM default=argon2id"`
+	PasswordArgon2Time    int    `env:"key=PASSWORD_ARGON2_TIME default=3"`
+	PasswordArgon2Memory  int    `env:"key=PASSWORD_ARGON2_MEMORY default=65536"`
+	PasswordArgon2Threads int    `env:"key=PASSWORD_ARGON2_THREADS default=2"`
+	PasswordBcryptCost    int    `env:"key=PASSWORD_BCRYPT_COST default=10"`
+	PasswordPepper        string `env:"key=PASSWORD_PEPPER secret=true"`
+	PasswordOldPepper     string `env:"key=PASSWORD_OLD_PEPPER secret=true"`
+
+	// LDAP directory or Active Directory checked on login (see ldap.go),
+	// e.g. ldaps://ldap.example.com, with the service account searching for
+	// the entry of the name or email given; %s in the filter is replaced by
+	// the name or email
+	LDAPURL            string `env:"key=LDAP_URL"`
+	LDAPStartTLS       bool   `env:"key=LDAP_START_TLS default=false"`
+	LDAPBindDN         string `env:"key=LDAP_BIND_DN"`
+	LDAPBindPassword   string `env:"key=LDAP_BIND_PASSWORD secret=true"`
+	LDAPBaseDN         string `env:"key=LDAP_BASE_DN"`
+	LDAPUserFilter     string `env:"key=LDAP_USER_FILTER default=(|(uid=%s)(mail=%s))"`
+	LDAPNameAttribute  string `env:"key=LDAP_NAME_ATTRIBUTE default=uid"`
+	LDAPEmailAttribute string `env:"key=LDAP_EMAIL_ATTRIBUTE default=mail"`
+
+	// OpenID Connect provider for single sign-on (see oidc.go), e.g.
+	// https://login.example.com, with the client registered there; the
+	// groups claim lists the groups of the user, and users of any of the
+	// comma-separated admin groups are made admins
+	OIDCIssuer       string `env:"key=OIDC_ISSUER"`
+	OIDCClientID     string `env:"key=OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"key=OIDC_CLIENT_SECRET secret=true"`
+	OIDCScopes       string `env:"key=OIDC_SCOPES default=openid,email,profile"`
+	OIDCGroupsClaim  string `env:"key=OIDC_GROUPS_CLAIM default=groups"`
+	OIDCAdminGroups  string `env:"key=OIDC_ADMIN_GROUPS"`
+
+	// bearer token of the identity provider provisioning users with SCIM
+	// (see scim.go); SCIM is disabled without it
+	SCIMToken string `env:"key=SCIM_TOKEN secret=true"`
+
+	// comma-separated domains of email addresses allowed to sign up, with
+	// their subdomains, and domains refused (see emaildomains.go)
+	EmailDomainsAllowed  string `env:"key=EMAIL_DOMAINS_ALLOWED"`
+	EmailDomainsDenied   string `env:"key=EMAIL_DOMAINS_DENIED"`
+	BlockDisposableEmail bool   `env:"key=BLOCK_DISPOSABLE_EMAIL default=false"`
+
+	// service suggesting tags and alt text for uploads (see labeler.go),
+	// with an optional bearer token
+	LabelerURL   string `env:"key=LABELER_URL"`
+	LabelerToken string `env:"key=LABELER_TOKEN secret=true"`
+
+	// accounts inactive for this many days are closed, after a warning
+	// mailed RETENTION_WARNING_DAYS before (see retention.go); 0 keeps
+	// accounts forever
+	RetentionInactiveDays int `env:"key=RETENTION_INACTIVE_DAYS default=0"`
+	RetentionWarningDays  int `env:"key=RETENTION_WARNING_DAYS default=30"`
+
+	// provider of the checkout of photos for sale (see checkout.go): stripe,
+	// with its secret key and the signing secret of its webhook
+	CheckoutProvider      string `env:"key=CHECKOUT_PROVIDER"`
+	CheckoutSecretKey     string `env:"key=CHECKOUT_SECRET_KEY secret=true"`
+	CheckoutWebhookSecret string `env:"key=CHECKOUT_WEBHOOK_SECRET secret=true"`
+	SalesCurrency         string `env:"key=SALES_CURRENCY default=usd"`
+
+	// service receiving panics with their stack traces as JSON (see
+	// recovery.go), with an optional bearer token
+	ErrorReportURL   string `env:"key=ERROR_REPORT_URL"`
+	ErrorReportToken string `env:"key=ERROR_REPORT_TOKEN secret=true"`
+
+	// feature flags, e.g. "uploads:25,-oauth" (see parseFeatures)
+	Features string `env:"key=FEATURES"`
+
+	// seconds clients are told to wait in maintenance (see maintenance.go)
+	MaintenanceRetryAfter int `env:"key=MAINTENANCE_RETRY_AFTER default=300"`
+}
+
+// name of the flag and environment variable giving the config file
+const configFileKey = "CONFIG_FILE"
+
+type configSetting struct {
+	field    reflect.StructField
+	key      string
+	defValue string
+	required bool
+	secret   bool
+}
+
+func (s *configSetting) flagName() string {
+	return strings.ToLower(strings.Replace(s.key, "_", "-", -1))
+}
+
+// parses the env tags of the config struct
+func getConfigSettings() []*configSetting {
+	var settings []*configSetting
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		setting := &configSetting{field: field}
+		for _, option := range strings.Fields(tag) {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "key":
+				setting.key = parts[1]
+			case "default":
+				setting.defValue = parts[1]
+			case "required":
+				setting.required = parts[1] == "true"
+			case "secret":
+				setting.secret = parts[1] == "true"
+			}
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// Registers the config flags on the flag set, for the entry points to parse
+// along with their own flags. Secrets have no flags, since the command line
+// of a process can be read by other users of the machine.
+func registerConfigFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "JSON config file")
+
+	for _, setting := range getConfigSettings() {
+		if !setting.secret {
+			fs.String(setting.flagName(), "", "sets "+setting.key)
+		}
+	}
+}
+
+// returns the config values given on the command line
+func getConfigFlagValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	if !fs.Parsed() {
+		return values
+	}
+	keys := map[string]string{"config": configFileKey}
+	for _, setting := range getConfigSettings() {
+		if !setting.secret {
+			keys[setting.flagName()] = setting.key
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := keys[f.Name]; ok {
+			values[key] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// reads a JSON object of config keys and values
+func readConfigFile(filename string) (map[string]string, error) {
+	values := make(map[string]string)
+	if filename == "" {
+		return values, nil
+	}
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return values, err
+	}
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return values, fmt.Errorf("invalid config file %s: %s", filename, err)
+	}
+	for key, value := range raw {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+// sets each config field from flags, environment, file and defaults, in
+// that order of precedence
+func (cfg *config) load(flags, file map[string]string, lookupEnv func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+
+	var missing []string
+
+	for _, setting := range getConfigSettings() {
+
+		value, ok := flags[setting.key]
+		if !ok {
+			value, ok = lookupEnv(setting.key)
+		}
+		if !ok {
+			value, ok = file[setting.key]
+		}
+		if !ok || value == "" {
+			value = setting.defValue
+		}
+		if value == "" {
+			if setting.required {
+				missing = append(missing, setting.key)
+			}
+			continue
+		}
+
+		field := v.FieldByIndex(setting.field.Index)
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", setting.key)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", setting.key)
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("%s has unsupported type %s", setting.key, field.Kind())
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checks the settings are consistent
+func (cfg *config) validate() error {
+	if cfg.TestDBName == cfg.DBName {
+		return errors.New("test DB name same as DB name")
+	}
+	if cfg.ServerPort <= 0 || cfg.ServerPort > 65535 {
+		return errors.New("PORT must be between 1 and 65535")
+	}
+	if cfg.SmtpPort <= 0 || cfg.SmtpPort > 65535 {
+		return errors.New("SMTP_PORT must be between 1 and 65535")
+	}
+	if cfg.HTTPSPort <= 0 || cfg.HTTPSPort > 65535 {
+		return errors.New("HTTPS_PORT must be between 1 and 65535")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSCertFile != "" && cfg.ACMEDomains != "" {
+		return errors.New("TLS_CERT_FILE and ACME_DOMAINS cannot both be set")
+	}
+	if (cfg.VAPIDPublicKey == "") != (cfg.VAPIDPrivateKey == "") {
+		return errors.New("VAPID_PUBLIC_KEY and VAPID_PRIVATE_KEY must be set together")
+	}
+	if cfg.HotlinkProtection && cfg.HotlinkTokenTTL <= 0 {
+		return errors.New("HOTLINK_TOKEN_TTL must be positive")
+	}
+	if strings.ContainsAny(cfg.EmbedFrameAncestors, ";,\r\n") {
+		return errors.New("EMBED_FRAME_ANCESTORS must be a space-separated list of sources")
+	}
+	if cfg.RetentionInactiveDays < 0 || cfg.RetentionWarningDays < 1 {
+		return errors.New("RETENTION_INACTIVE_DAYS must not be negative and RETENTION_WARNING_DAYS must be positive")
+	}
+	if cfg.RetentionInactiveDays > 0 && cfg.RetentionWarningDays >= cfg.RetentionInactiveDays {
+		return errors.New("RETENTION_WARNING_DAYS must be less than RETENTION_INACTIVE_DAYS")
+	}
+	if cfg.CaptchaProvider != "" {
+		if _, ok := captchaVerifyURLs[cfg.CaptchaProvider]; !ok {
+			return errors.New("CAPTCHA_PROVIDER must be recaptcha, turnstile or hcaptcha")
+		}
+		if cfg.CaptchaSiteKey == "" || cfg.CaptchaSecret == "" {
+			return errors.New("CAPTCHA_SITE_KEY and CAPTCHA_SECRET must be set with CAPTCHA_PROVIDER")
+		}
+	}
+	if cfg.CheckoutProvider != "" {
+		if cfg.CheckoutProvider != "stripe" {
+			return errors.New("CHECKOUT_PROVIDER must be stripe")
+		}
+		if cfg.CheckoutSecretKey == "" || cfg.CheckoutWebhookSecret == "" {
+			return errors.New("CHECKOUT_SECRET_KEY and CHECKOUT_WEBHOOK_SECRET must be set with CHECKOUT_PROVIDER")
+		}
+	}
+	if cfg.MaxUploadSize <= 0 {
+		return errors.New("MAX_UPLOAD_SIZE must be greater than 0")
+	}
+	if cfg.PublicMaxSize < 0 {
+		return errors.New("PUBLIC_MAX_SIZE must not be negative")
+	}
+	if cfg.ProcessingWorkers < 0 || cfg.ProcessingQueueSize <= 0 || cfg.ProcessingUserLimit <= 0 {
+		return errors.New("PROCESSING_QUEUE_SIZE and PROCESSING_USER_LIMIT must be greater than 0, and PROCESSING_WORKERS not negative")
+	}
+	if cfg.AsyncUploadSize < 0 {
+		return errors.New("ASYNC_UPLOAD_SIZE must not be negative")
+	}
+	if cfg.MaxImagePixels <= 0 {
+		return errors.New("MAX_IMAGE_PIXELS must be greater than 0")
+	}
+	if cfg.ProcessingMemory < 0 || cfg.ProcessingTimeout < 0 {
+		return errors.New("PROCESSING_MEMORY and PROCESSING_TIMEOUT must not be negative")
+	}
+	if cfg.ImageProcessor != "go" && cfg.ImageProcessor != "vips" {
+		return errors.New("IMAGE_PROCESSOR must be go or vips")
+	}
+	if err := cfg.validateStorageReplica(); err != nil {
+		return err
+	}
+	if cfg.StorageMasterKey != "" {
+		if _, err := decodeMasterKey(cfg.StorageMasterKey); err != nil {
+			return err
+		}
+		// the variants are kept unencrypted
+		if cfg.ImageFormats != "" {
+			return errors.New("IMAGE_FORMATS cannot be set with STORAGE_MASTER_KEY")
+		}
+	}
+	if cfg.StorageScrubBatch < 0 {
+		return errors.New("STORAGE_SCRUB_BATCH must not be negative")
+	}
+	for _, name := range cfg.imageFormats() {
+		if _, ok := imageFormats[name]; !ok {
+			return fmt.Errorf("IMAGE_FORMATS: unknown format %q", name)
+		}
+	}
+	if cfg.MaxDownloadPhotos <= 0 || cfg.MaxDownloadSize <= 0 {
+		return errors.New("MAX_DOWNLOAD_PHOTOS and MAX_DOWNLOAD_SIZE must be greater than 0")
+	}
+	if cfg.RateLimitWindow <= 0 {
+		return errors.New("RATE_LIMIT_WINDOW must be greater than 0")
+	}
+	if cfg.RateLimitAnonymous < 0 || cfg.RateLimitUser < 0 || cfg.RateLimitAPIKey < 0 {
+		return errors.New("RATE_LIMIT_ANONYMOUS, RATE_LIMIT_USER and RATE_LIMIT_API_KEY must not be negative")
+	}
+	if cfg.MaintenanceRetryAfter <= 0 {
+		return errors.New("MAINTENANCE_RETRY_AFTER must be greater than 0")
+	}
+	if cfg.AnonymousPhotoViews < 0 {
+		return errors.New("ANONYMOUS_PHOTO_VIEWS must not be negative")
+	}
+	if cfg.AnonymousPhotoViews > 0 && cfg.AnonymousViewWindow <= 0 {
+		return errors.New("ANONYMOUS_VIEW_WINDOW must be greater than 0")
+	}
+	if cfg.LDAPURL != "" {
+		if !strings.HasPrefix(cfg.LDAPURL, "ldap://") && !strings.HasPrefix(cfg.LDAPURL, "ldaps://") {
+			return errors.New("LDAP_URL must start with ldap:// or ldaps://")
+		}
+		if cfg.LDAPBaseDN == "" || !strings.Contains(cfg.LDAPUserFilter, "%s") {
+			return errors.New("LDAP_BASE_DN and LDAP_USER_FILTER with %s are required with LDAP_URL")
+		}
+	}
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID == "" {
+		return errors.New("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+	switch sessionBinding(cfg.SessionBinding) {
+	case sessionBindingOff, sessionBindingLax, sessionBindingStrict:
+	default:
+		return errors.New("SESSION_BINDING must be off, lax or strict")
+	}
+	if cfg.PasswordAlgorithm != passwordArgon2id && cfg.PasswordAlgorithm != passwordBcrypt {
+		return errors.New("PASSWORD_ALGORITHM must be argon2id or bcrypt")
+	}
+	if cfg.PasswordBcryptCost < bcrypt.MinCost || cfg.PasswordBcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("PASSWORD_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if (cfg.PasswordPepper != "" && len(cfg.PasswordPepper) < 16) || (cfg.PasswordOldPepper != "" && len(cfg.PasswordOldPepper) < 16) {
+		return errors.New("PASSWORD_PEPPER and PASSWORD_OLD_PEPPER must be at least 16 characters")
+	}
+	if cfg.PasswordOldPepper != "" && cfg.PasswordOldPepper == cfg.PasswordPepper {
+		return errors.New("PASSWORD_OLD_PEPPER must not be PASSWORD_PEPPER")
+	}
+	if cfg.PasswordArgon2Time < 1 || cfg.PasswordArgon2Threads < 1 || cfg.PasswordArgon2Threads > 255 {
+		return errors.New("PASSWORD_ARGON2_TIME must be greater than 0 and PASSWORD_ARGON2_THREADS between 1 and 255")
+	}
+	// Argon2id needs at least 8 KiB for each thread
+	if cfg.PasswordArgon2Memory < 8*cfg.PasswordArgon2Threads {
+		return errors.New("PASSWORD_ARGON2_MEMORY must be at least 8 KiB for each of PASSWORD_ARGON2_THREADS")
+	}
+	if cfg.CommentEditWindow < 0 {
+		return errors.New("COMMENT_EDIT_WINDOW must not be negative")
+	}
+	return nil
+}
+
+// checks the replica of the uploads is an S3 bucket with credentials, or a
+// directory other than the uploads directory
+func (cfg *config) validateStorageReplica() error {
+	if cfg.StorageReplica == "" {
+		return nil
+	}
+	if !strings.HasPrefix(cfg.StorageReplica, "s3://") {
+		if path.Clean(cfg.StorageReplica) == path.Clean(cfg.UploadsDir) {
+			return errors.New("STORAGE_REPLICA must not be the uploads directory")
+		}
+		return nil
+	}
+	replica, err := url.Parse(cfg.StorageReplica)
+	if err != nil || replica.Host == "" {
+		return errors.New("STORAGE_REPLICA must be s3://bucket/prefix or a directory")
+	}
+	if endpoint, err := url.Parse(cfg.S3Endpoint); err != nil || endpoint.Host == "" {
+		return errors.New("S3_ENDPOINT must be a URL")
+	}
+	if cfg.S3Region == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return errors.New("S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY are required for an S3 replica")
+	}
+	return nil
+}
+
+// returns true if the server should serve HTTPS
+func (cfg *config) useTLS() bool {
+	return cfg.TLSCertFile != "" || cfg.ACMEDomains != ""
+}
+
+// returns true if Web Push notifications can be sent
+func (cfg *config) pushEnabled() bool {
+	return cfg.VAPIDPublicKey != ""
+}
+
+// returns the settings with secret values redacted, safe for logging
+func (cfg *config) String() string {
+	v := reflect.ValueOf(cfg).Elem()
+	var lines []string
+	for _, setting := range getConfigSettings() {
+		value := fmt.Sprint(v.FieldByIndex(setting.field.Index).Interface())
+		if setting.secret && value != "" {
+			value = "********"
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", setting.key, value))
+	}
+	return strings.Join(lines, "\n")
 }
 
 func newConfig() (*config, error) {
 	cfg := &config{}
-	if err := env.Process(cfg); err != nil {
+
+	flags := getConfigFlagValues(flag.CommandLine)
+
+	filename, ok := flags[configFileKey]
+	if !ok {
+		filename = os.Getenv(configFileKey)
+	}
+
+	file, err := readConfigFile(filename)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.load(flags, file, os.LookupEnv); err != nil {
 		return cfg, err
 	}
 
@@ -66,10 +651,6 @@ func newConfig() (*config, error) {
 		cfg.TestDBHost = cfg.DBHost
 	}
 
-	if cfg.TestDBName == cfg.DBName {
-		return cfg, errors.New("test DB name same as DB name")
-	}
-
 	if cfg.BaseDir == "" {
 		cfg.BaseDir = getDefaultBaseDir()
 	}
@@ -86,11 +667,29 @@ func newConfig() (*config, error) {
 		cfg.ThumbnailsDir = path.Join(cfg.UploadsDir, "thumbnails")
 	}
 
+	if cfg.VariantsDir == "" {
+		cfg.VariantsDir = path.Join(cfg.UploadsDir, "variants")
+	}
+
 	if cfg.TemplatesDir == "" {
 		cfg.TemplatesDir = path.Join(cfg.BaseDir, "templates")
 	}
 
-	return cfg, nil
+	if cfg.VAPIDSubject == "" {
+		cfg.VAPIDSubject = cfg.SmtpDefaultSender
+	}
+
+	if cfg.ACMECacheDir == "" {
+		cfg.ACMECacheDir = path.Join(cfg.BaseDir, "certs")
+	}
+
+	if cfg.StorageNameKey == "" {
+		if cfg.StorageNameKey, err = deriveStorageNameKey(cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, cfg.validate()
 }
 
 func getDefaultBaseDir() string {
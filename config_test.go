@@ -0,0 +1,72 @@
+package photoshare
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	flags := map[string]string{"DB_NAME": "flagdb"}
+	file := map[string]string{
+		"DB_NAME":     "filedb",
+		"DB_USER":     "fileuser",
+		"DB_PASS":     "filepass",
+		"PRIVATE_KEY": "key",
+		"PUBLIC_KEY":  "key.pub",
+		"PORT":        "6000",
+	}
+	env := map[string]string{"DB_USER": "envuser"}
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	cfg := &config{}
+	if err := cfg.load(flags, file, lookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBName != "flagdb" {
+		t.Error("Flags should override file")
+	}
+	if cfg.DBUser != "envuser" {
+		t.Error("Environment should override file")
+	}
+	if cfg.ServerPort != 6000 {
+		t.Error("Port should be read from file")
+	}
+	if cfg.DBHost != "localhost" {
+		t.Error("DB host should have default value")
+	}
+}
+
+func TestConfigRequired(t *testing.T) {
+	cfg := &config{}
+	err := cfg.load(nil, nil, func(string) (string, bool) { return "", false })
+	if err == nil || !strings.Contains(err.Error(), "DB_NAME") {
+		t.Error("DB_NAME should be required")
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	cfg := &config{DBPassword: "topsecret"}
+	if strings.Contains(cfg.String(), "topsecret") {
+		t.Error("Password should be redacted")
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerConfigFlags(fs)
+
+	if err := fs.Parse([]string{"-db-name=flagdb", "-config=config.json"}); err != nil {
+		t.Fatal(err)
+	}
+	values := getConfigFlagValues(fs)
+	if values["DB_NAME"] != "flagdb" || values[configFileKey] != "config.json" {
+		t.Errorf("Flags should be read, got %v", values)
+	}
+	if fs.Lookup("db-pass") != nil {
+		t.Error("Secrets should have no flags")
+	}
+}
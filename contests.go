@@ -0,0 +1,160 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Contests are run by admins. Photos are entered by tagging them with the
+// contest tag while entries are open, and are taken as they are once entries
+// close; members then vote for one entry each until voting closes, when the
+// entry with the most votes wins.
+
+// returns the contest, taking its entries if they have closed and setting
+// its winner if voting has closed
+func getContestWithPhase(ctx *context, contestID int64) (*contestDetail, error) {
+	contest, err := ctx.datamapper.getContest(contestID)
+	if err != nil {
+		return nil, err
+	}
+	if err := takeContestEntries(ctx, contest); err != nil {
+		return nil, err
+	}
+	if contest.Phase == contestFinished && contest.WinnerID == nil {
+		if err := ctx.datamapper.setContestWinner(&contest.contest); err != nil {
+			return nil, err
+		}
+	}
+	return contest, nil
+}
+
+// sets the phase of the contest, taking its entries once they have closed
+func takeContestEntries(ctx *context, contest *contestDetail) error {
+	contest.Phase = contest.phase(time.Now())
+	if contest.Phase == contestUpcoming || contest.Phase == contestEntries || contest.EntriesTakenAt != nil {
+		return nil
+	}
+	return ctx.datamapper.takeContestEntries(&contest.contest)
+}
+
+func getContests(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	contests, err := ctx.datamapper.getContests(getPage(r))
+	if err != nil {
+		return err
+	}
+	for i := range contests.Items {
+		if err := takeContestEntries(ctx, &contests.Items[i]); err != nil {
+			return err
+		}
+	}
+	return renderJSON(w, contests, http.StatusOK)
+}
+
+func createContest(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Title          string    `json:"title"`
+		Description    string    `json:"description"`
+		Tag            string    `json:"tag"`
+		StartsAt       time.Time `json:"startsAt"`
+		EntriesCloseAt time.Time `json:"entriesCloseAt"`
+		VotingCloseAt  time.Time `json:"votingCloseAt"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	contest := &contest{
+		OwnerID:        ctx.user.ID,
+		Title:          s.Title,
+		Description:    s.Description,
+		Tag:            strings.TrimPrefix(strings.TrimSpace(s.Tag), "#"),
+		StartsAt:       s.StartsAt,
+		EntriesCloseAt: s.EntriesCloseAt,
+		VotingCloseAt:  s.VotingCloseAt,
+	}
+
+	if err := ctx.validate(contest, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createContest(contest); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "create_contest", contest.ID, contest.Title); err != nil {
+		return err
+	}
+	return renderJSON(w, contest, http.StatusCreated)
+}
+
+func getContestDetail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	contest, err := getContestWithPhase(ctx, ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, contest, http.StatusOK)
+}
+
+func getContestEntries(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	contest, err := getContestWithPhase(ctx, ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	page := getPage(r)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:contest:%d:%s:page:%d:user:%d", contest.ID, contest.Phase, page.index, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		return ctx.datamapper.getContestEntries(page, &contest.contest, userID)
+	})
+}
+
+// casts the one vote of the user in the contest
+func voteInContest(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	contest, err := getContestWithPhase(ctx, ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if contest.Phase != contestVoting {
+		return httpError{http.StatusBadRequest, "Voting is not open"}
+	}
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("photoID"))
+	if err != nil {
+		return err
+	}
+
+	ok, err := ctx.datamapper.isContestEntry(&contest.contest, photo.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusNotFound, "Photo is not entered in this contest"}
+	}
+
+	blocked, err := ctx.datamapper.isBlocked(photo.OwnerID, ctx.user.ID, false)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.permit(photo.OwnerID != ctx.user.ID && !blocked,
+		"You're not allowed to vote for this photo"); err != nil {
+		return err
+	}
+
+	if ok, err = ctx.datamapper.voteInContest(contest.ID, ctx.user.ID, photo.ID); err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusBadRequest, "You have already voted in this contest"}
+	}
+	return renderString(w, http.StatusOK, "Voting successful")
+}
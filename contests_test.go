@@ -0,0 +1,108 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContestPhase(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &contest{
+		StartsAt:       start,
+		EntriesCloseAt: start.AddDate(0, 0, 7),
+		VotingCloseAt:  start.AddDate(0, 0, 14),
+	}
+	for _, tc := range []struct {
+		now   time.Time
+		phase string
+	}{
+		{start.Add(-time.Hour), contestUpcoming},
+		{start, contestEntries},
+		{start.AddDate(0, 0, 7), contestVoting},
+		{start.AddDate(0, 0, 14), contestFinished},
+	} {
+		if phase := c.phase(tc.now); phase != tc.phase {
+			t.Errorf("%s: expected %s, got %s", tc.now, tc.phase, phase)
+		}
+	}
+}
+
+type contestDataMapper struct {
+	mockDataMapper
+	contest *contestDetail
+	taken   int
+}
+
+func (m *contestDataMapper) getContest(contestID int64) (*contestDetail, error) {
+	return m.contest, nil
+}
+
+func (m *contestDataMapper) takeContestEntries(contest *contest) error {
+	m.taken++
+	now := time.Now()
+	contest.EntriesTakenAt = &now
+	return nil
+}
+
+func TestTakeContestEntriesOnceClosed(t *testing.T) {
+	now := time.Now()
+	dm := &contestDataMapper{contest: &contestDetail{contest: contest{
+		ID:             1,
+		StartsAt:       now.Add(-time.Hour),
+		EntriesCloseAt: now.Add(time.Hour),
+		VotingCloseAt:  now.Add(2 * time.Hour),
+	}}}
+	c := &context{app: &app{datamapper: dm}, datamapper: dm}
+
+	if _, err := getContestWithPhase(c, 1); err != nil {
+		t.Fatal(err)
+	}
+	if dm.taken != 0 {
+		t.Errorf("Entries should not be taken while open")
+	}
+
+	dm.contest.EntriesCloseAt = now.Add(-time.Minute)
+	for i := 0; i < 2; i++ {
+		contest, err := getContestWithPhase(c, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contest.Phase != contestVoting {
+			t.Errorf("Expected %s, got %s", contestVoting, contest.Phase)
+		}
+	}
+	if dm.taken != 1 {
+		t.Errorf("Entries should be taken once, were taken %d times", dm.taken)
+	}
+}
+
+func TestVoteInContestIfEntriesOpen(t *testing.T) {
+	now := time.Now()
+	dm := &contestDataMapper{contest: &contestDetail{contest: contest{
+		ID:             1,
+		StartsAt:       now.Add(-time.Hour),
+		EntriesCloseAt: now.Add(time.Hour),
+		VotingCloseAt:  now.Add(2 * time.Hour),
+	}}}
+
+	p := &params{make(map[string]string)}
+	p.vars["id"] = "1"
+	p.vars["photoID"] = "1"
+
+	c := &context{
+		app:        &app{datamapper: dm},
+		params:     p,
+		user:       &user{ID: 2, IsAuthenticated: true},
+		datamapper: dm,
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/contests/1/vote/1", nil)
+	res := httptest.NewRecorder()
+
+	err := voteInContest(c, res, req)
+	if e, ok := err.(httpError); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("Expected voting to be closed, got %v", err)
+	}
+}
@@ -24,8 +24,13 @@ func (p *params) getInt(name string) int64 {
 // contains the app config so we have access to all the objects we nee
 type context struct {
 	*app
-	params *params
-	user   *user
+	params     *params
+	user       *user
+	remoteIP   string
+	site       *site
+	datamapper dataMapper   // scoped to the site
+	cache      cache        // keys scoped to the site
+	features   featureFlags // scoped to the site
 }
 
 func (ctx *context) validate(v validator, r *http.Request) error {
@@ -39,9 +44,34 @@ func (ctx *context) validate(v validator, r *http.Request) error {
 	return nil
 }
 
-func newContext(app *app, r *http.Request, user *user) *context {
+// returns an error if the current user is not allowed an action: 401 if
+// logging in might help, otherwise 403
+func (ctx *context) permit(allowed bool, msg string) error {
+	if allowed {
+		return nil
+	}
+	if ctx.user == nil || !ctx.user.IsAuthenticated {
+		return errLoginRequired
+	}
+	return httpError{http.StatusForbidden, msg}
+}
+
+// returns the ID of the current user, or 0 if not logged in
+func (ctx *context) userID() int64 {
+	if ctx.user == nil {
+		return 0
+	}
+	return ctx.user.ID
+}
+
+func newContext(app *app, r *http.Request, site *site, user *user) *context {
 	ctx := &context{app: app}
+	ctx.site = site
+	ctx.datamapper = app.datamapper.forSite(site.ID)
+	ctx.cache = &siteCache{app.cache, site.ID}
+	ctx.features = app.features.forSite(site.ID)
 	ctx.params = &params{mux.Vars(r)}
 	ctx.user = user
+	ctx.remoteIP = getRemoteIP(r)
 	return ctx
 }
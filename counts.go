@@ -0,0 +1,58 @@
+package photoshare
+
+import (
+	"sync"
+	"time"
+)
+
+// Photo lists of all photos, tags and gear count their photos for the
+// number of pages, which scans every visible photo on each request. Unless
+// the exact total is asked for with ?exact=true, the total is taken from the
+// count of the list made in the last approximateCountTTL, as counted for
+// anonymous users, and the list is marked approximate.
+
+const (
+	approximateCountTTL = 5 * time.Minute
+	maxApproximateCount = 10000 // lists counted before the cache is cleared
+)
+
+type cachedCount struct {
+	total   int64
+	expires time.Time
+}
+
+// totals of photo lists by their query, shared by the data mappers of the
+// database
+type countCache struct {
+	sync.Mutex
+	totals map[string]cachedCount
+}
+
+func newCountCache() *countCache {
+	return &countCache{totals: make(map[string]cachedCount)}
+}
+
+// returns the cached total of the key, or counts it if there is none or it
+// has expired
+func (c *countCache) get(key string, now time.Time, count func() (int64, error)) (int64, error) {
+	c.Lock()
+	cached, ok := c.totals[key]
+	c.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.total, nil
+	}
+
+	total, err := count()
+	if err != nil {
+		return 0, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.totals) >= maxApproximateCount {
+		c.totals = make(map[string]cachedCount)
+	}
+	c.totals[key] = cachedCount{total, now.Add(approximateCountTTL)}
+	return total, nil
+}
@@ -0,0 +1,41 @@
+package photoshare
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCountCache(t *testing.T) {
+
+	c := newCountCache()
+	counted := 0
+	count := func() (int64, error) {
+		counted++
+		return int64(counted * 10), nil
+	}
+
+	now := time.Now()
+	if total, _ := c.get("photos", now, count); total != 10 {
+		t.Errorf("Expected 10, got %d", total)
+	}
+	if total, _ := c.get("photos", now.Add(time.Minute), count); total != 10 || counted != 1 {
+		t.Errorf("Expected the cached total, got %d", total)
+	}
+	if total, _ := c.get("photos", now.Add(approximateCountTTL), count); total != 20 {
+		t.Errorf("Expected the total counted again once expired, got %d", total)
+	}
+}
+
+func TestGetPageExact(t *testing.T) {
+	for url, exact := range map[string]bool{
+		"/api/photos/?page=2":            false,
+		"/api/photos/?page=2&exact=true": true,
+		"/api/photos/?exact=nope":        false,
+	} {
+		r, _ := http.NewRequest("GET", url, nil)
+		if page := getPage(r); page.exact != exact {
+			t.Errorf("Expected exact %t for %s", exact, url)
+		}
+	}
+}
@@ -8,11 +8,13 @@ import (
 	_ "github.com/lib/pq" // PostgreSQL library
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func dbConnect(user, pwd, name, host string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", fmt.Sprintf("user=%s dbname=%s password=%s host=%s sslmode=disable",
+	db, err := sql.Open("postgres", fmt.Sprintf("user=%s dbname=%s password=%s host=%s sslmode=disable timezone=UTC",
 		user,
 		name,
 		pwd,
@@ -38,44 +40,303 @@ func initDB(db *sql.DB, logSql bool) (*gorp.DbMap, error) {
 	dbMap.AddTableWithName(user{}, "users").SetKeys(true, "ID")
 	dbMap.AddTableWithName(photo{}, "photos").SetKeys(true, "ID")
 	dbMap.AddTableWithName(tag{}, "tags").SetKeys(true, "ID")
+	dbMap.AddTableWithName(mention{}, "mentions").SetKeys(true, "ID")
+	dbMap.AddTableWithName(notification{}, "notifications").SetKeys(true, "ID")
+	dbMap.AddTableWithName(auditEntry{}, "audit_log").SetKeys(true, "ID")
+	dbMap.AddTableWithName(session{}, "sessions").SetKeys(true, "ID")
+	dbMap.AddTableWithName(site{}, "sites").SetKeys(true, "ID")
+	dbMap.AddTableWithName(group{}, "groups").SetKeys(true, "ID")
+	dbMap.AddTableWithName(contest{}, "contests").SetKeys(true, "ID")
+	dbMap.AddTableWithName(challenge{}, "challenges").SetKeys(true, "ID")
+	dbMap.AddTableWithName(purchase{}, "purchases").SetKeys(true, "ID")
+	dbMap.AddTableWithName(portfolioAlbum{}, "portfolio_albums").SetKeys(true, "ID")
+	dbMap.AddTableWithName(homepagePin{}, "homepage_pins").SetKeys(true, "ID")
+	dbMap.AddTableWithName(shortlink{}, "shortlinks").SetKeys(false, "Code")
+	dbMap.AddTableWithName(report{}, "reports").SetKeys(true, "ID")
+	dbMap.AddTableWithName(comment{}, "comments").SetKeys(true, "ID")
+	dbMap.AddTableWithName(moderationNote{}, "moderation_notes").SetKeys(true, "ID")
 
 	return dbMap, nil
 }
 
 type dataMapper interface {
+	forSite(int64) dataMapper
+
+	getSites() ([]site, error)
+	createSite(*site) error
+
 	createPhoto(*photo) error
 	removePhoto(*photo) error
 	updatePhoto(*photo) error
 	updateTags(*photo) error
+	updatePhotos([]*photo) error
+	removePhotos([]*photo) error
 
 	createUser(*user) error
+	createMention(*mention) error
+	createNotification(*notification) error
+	markNotificationRead(int64, int64) error
+	markAllNotificationsRead(int64) error
+	getNotificationSettings(int64) (notificationSettings, error)
+	saveNotificationSettings(notificationSettings) error
+	getPortfolio(int64, int64) ([]portfolioAlbum, error)
+	setPortfolio(int64, []portfolioAlbum) error
+	getAlbumIDByPreviousSlug(int64, string) (int64, error)
+	getAlbum(int64) (*portfolioAlbum, error)
+
+	getHomepagePins() ([]homepagePin, error)
+	getActiveHomepagePins(time.Time, int64) ([]homepagePin, error)
+	setHomepagePins([]homepagePin) error
+	getShortlink(int64) (*shortlink, error)
+	createShortlink(*shortlink) error
+	followShortlink(string) (*shortlink, error)
+	getComments(int64, *user) ([]commentDetail, error)
+	getComment(int64) (*comment, error)
+	createComment(*comment) error
+	updateComment(*comment) error
+	deleteComment(*comment) error
+	createReport(*report) error
+	hasReported(int64, int64) (bool, error)
+	getReport(int64) (*report, error)
+	getOpenReports() ([]reportDetail, error)
+	resolveReport(*report) (*user, error)
+	getModerationNotes(int64) ([]moderationNoteDetail, error)
+	createModerationNote(*moderationNote) error
+	getStrikeThresholds() ([]strikeThreshold, error)
+	setStrikeThresholds([]strikeThreshold) error
+	createPurchase(*purchase) error
+	getPurchaseByCheckout(string) (*purchase, error)
+	markPurchasePaid(*purchase) error
+	hasPurchased(int64, int64) (bool, error)
+	getPurchases(int64) ([]purchaseDetail, error)
+
+	savePushSubscription(*pushSubscription) error
+	getPushSubscriptions(int64) ([]pushSubscription, error)
+	removePushSubscription(int64, int64) error
+	removePushEndpoint(string) error
 	updateUser(*user) error
 
 	updateMany(...interface{}) error
+	recordVote(*photo, *user, int) error
+	recomputeScores() (int64, error)
 
 	getPhoto(int64) (*photo, error)
 	getPhotoDetail(int64, *user) (*photoDetail, error)
+	getPhotoDetails([]int64, *user) ([]photoDetail, error)
+	getChangedPhotos(time.Time, int64) ([]photoChange, error)
+	getDeletedPhotoIDs(time.Time) ([]int64, error)
 	getTagCounts() ([]tagCount, error)
-	getPhotos(*page, string) (*photoList, error)
-	getPhotosByOwnerID(*page, int64) (*photoList, error)
-	searchPhotos(*page, string) (*photoList, error)
+	getTagDetail(string) (*tagDetail, error)
+	saveTagDetail(*tagDetail) error
+	isTaggedPhoto(int64, int64) (bool, error)
+	getAllPhotos() ([]photoDetail, error)
+	getAllUsers() ([]user, error)
+
+	getUserStats(int64) (*userStats, error)
+	awardBadge(*badge) (bool, error)
+	getBadges(int64) ([]badge, error)
+	importArchive(*archive, bool) error
+	getPhotoFilenames() ([]string, error)
+	isFileUsed(string) (bool, error)
+	withFileLock(string, func() error) error
+	removeOrphanTags() (int64, error)
+	getPhotos(*page, *ordering, int64) (*photoList, error)
+	getPhotosByOwnerID(*page, int64, int64) (*photoList, error)
+	getPhotosByTag(*page, int64, *ordering, int64) (*photoList, error)
+	getPhotosByGear(*page, string, *ordering, int64) (*photoList, error)
+	getGear() ([]gearCount, error)
+	setPhotoGear(*photo) error
+	setPhotoColors(*photo) error
+	setPhotoDimensions(*photo) error
+	setPhotoChecksum(*photo) error
+	getPhotosToCheck(time.Time, int) ([]photo, error)
+	recordStorageCheck(*photo, time.Time, *storageCorruption) error
+	getStorageCorruptions(time.Time) ([]storageCorruptionDetail, error)
+	searchPhotos(*page, string, int64) (*photoList, error)
+	getRandomPhotos(int64, int64) ([]photo, error)
+	getStaffPicks(*page, int64) (*photoList, error)
+	setStaffPick(*photo, bool) error
+	getBlockedWords() ([]blockedWord, error)
+	addBlockedWord(*blockedWord) error
+	removeBlockedWord(int64) error
+	getSpamSignals(int64, string) (*spamSignals, error)
+	getHeldPhotos(*page) (*photoList, error)
+	getExpiredPhotos(time.Time) ([]photo, error)
+	trashPhotos([]*photo) error
+	restorePhoto(*photo) error
+	getTrash(*page, int64) (*photoList, error)
+	getTrashedPhoto(int64, int64) (*photo, error)
+	getTrashedBefore(time.Time) ([]photo, error)
+	saveSuggestions(*photoSuggestions) error
+	getSuggestions(int64) (*photoSuggestions, error)
+	removeSuggestions(int64) error
+	reserveIdempotencyKey(*idempotencyKey, time.Time, time.Time) (*idempotencyKey, error)
+	saveIdempotencyKey(*idempotencyKey) error
+	removeIdempotencyKey(*idempotencyKey) error
+	removeExpiredIdempotencyKeys(time.Time) (int64, error)
+	getMentions(*page, int64) (*mentionList, error)
+	getNotifications(*page, int64) (*notificationList, error)
+	getActivity(*page, int64, time.Time) (*activityList, error)
+
+	getFeatureFlags() ([]featureFlag, error)
+	setFeatureFlag(*featureFlag) error
+
+	createAuditEntry(*auditEntry) error
+	getAuditLog(*page) (*auditList, error)
+
+	blockUser(int64, int64, bool) error
+	unblockUser(int64, int64) error
+	isBlocked(int64, int64, bool) (bool, error)
+	getBlockedUsers(int64) ([]blockedUser, error)
+
+	followUser(int64, int64) (bool, error)
+	unfollowUser(int64, int64) error
+	followTag(int64, int64) error
+	unfollowTag(int64, string) error
+	isFollowingTag(int64, int64) (bool, error)
+	getFollows(int64) (*follows, error)
+	getFeedPhotos(*page, *ordering, int64) (*photoList, error)
+
+	createSession(*session) error
+	getSession(string) (*session, error)
+	getSessions(int64) ([]session, error)
+	touchSession(*session) error
+	deleteSession(int64, int64) error
+	rotateSessionKey(int64, int64, string) error
+	deleteUserSessions(int64) error
+	deleteOtherSessions(int64, int64) error
 
 	isUserNameAvailable(*user) (bool, error)
 	isUserEmailAvailable(*user) (bool, error)
 	getActiveUser(userID int64) (*user, error)
+	getUser(userID int64) (*user, error)
+	removeUser(*user) error
+	getInactiveUsers(time.Time) ([]inactiveUser, error)
+	getWarnedUsers(time.Time, time.Time) ([]inactiveUser, error)
 	getUserByRecoveryCode(string) (*user, error)
+	clearRecoveryCode(int64, string) (bool, error)
+	updatePasswordHash(*user, string) error
+	getUserByEmailChangeCode(string) (*user, error)
 	getUserByEmail(string) (*user, error)
+	getUserByOIDCSubject(string) (*user, error)
+	getUserByOIDCLinkCode(string) (*user, error)
 	getUserByNameOrEmail(identifier string) (*user, error)
+	getUsersByNames([]string) ([]user, error)
+	getUserByName(string) (*user, error)
+	getUserByPreviousName(string) (*user, error)
+	changeUserName(*user, string) error
+	getUserBySlug(string) (*user, error)
+	getUserByPreviousSlug(string) (*user, error)
+	isUserSlugAvailable(*user) (bool, error)
+	changeUserSlug(*user, *string) error
+
+	createGroup(*group) error
+	getGroup(int64) (*group, error)
+	getGroupDetail(int64) (*groupDetail, error)
+	getGroups(*page) (*groupList, error)
+	isGroupNameAvailable(*group) (bool, error)
+	getGroupMember(int64, int64) (*groupMember, error)
+	saveGroupMember(*groupMember) error
+	removeGroupMember(int64, int64) error
+	getGroupMembers(int64, string) ([]groupMemberDetail, error)
+	addGroupPhoto(int64, int64) error
+	removeGroupPhoto(int64, int64) error
+	getGroupPhotos(*page, int64, int64) (*photoList, error)
+
+	createContest(*contest) error
+	getContest(int64) (*contestDetail, error)
+	getContests(*page) (*contestList, error)
+	getContestEntries(*page, *contest, int64) (*photoList, error)
+	isContestEntry(*contest, int64) (bool, error)
+	takeContestEntries(*contest) error
+	voteInContest(int64, int64, int64) (bool, error)
+	setContestWinner(*contest) error
+
+	createChallenge(*challenge) error
+	getChallenge(int64) (*challengeDetail, error)
+	getCurrentChallenge(time.Time) (*challengeDetail, error)
+	getChallenges(*page, time.Time) (*challengeList, error)
+	getChallengeEntries(*page, *challenge, int64) (*photoList, error)
+	isChallengeOverlapping(*challenge) (bool, error)
+	getChallengesToAnnounce(time.Time) ([]challenge, error)
+	setChallengeAnnounced(*challenge) error
+
+	getActorKey(int64) (*actorKey, error)
+	createActorKey(*actorKey) error
+	addFollower(*follower) error
+	removeFollower(int64, string) error
+	getFollowers(int64) ([]follower, error)
+	countFollowers(int64) (int64, error)
+}
+
+// excludes photos in the trash, photos by owners the viewing user has
+// blocked or muted, and private, expired or held photos unless the viewing
+// user is the owner, or photos by shadow-banned owners unless the viewing
+// user is the owner or an admin
+const visibleSql = "deleted_at IS NULL AND owner_id NOT IN (SELECT target_id FROM blocks WHERE user_id=$%[1]d) AND " +
+	"(owner_id=$%[1]d OR (NOT private AND held_at IS NULL AND (expires_at IS NULL OR expires_at > now()) AND " +
+	"(owner_id NOT IN (SELECT id FROM users WHERE shadow_banned=true) OR " +
+	"$%[1]d IN (SELECT id FROM users WHERE admin=true))))"
+
+// how many ids getRandomPhotos draws for each photo it returns
+const randomOversample = 3
+
+// ORDER BY clauses of the photo orderings. Hot ranks the log of the score
+// plus the age, so a photo needs ten times the votes to stay level with one
+// posted 12.5 hours later. Controversial ranks photos with many votes split
+// evenly up and down; photos without both up and down votes come last.
+var orderingSql = map[string]string{
+	orderNew: "created_at DESC",
+	orderHot: "SIGN(up_votes - down_votes) * LOG(GREATEST(ABS(up_votes - down_votes), 1)) + " +
+		"EXTRACT(EPOCH FROM created_at) / 45000 DESC, created_at DESC",
+	orderTop: "(up_votes - down_votes) DESC, created_at DESC",
+	orderControversial: "CASE WHEN up_votes <= 0 OR down_votes <= 0 THEN 0 " +
+		"ELSE POWER(up_votes + down_votes, LEAST(up_votes, down_votes)::float / GREATEST(up_votes, down_votes)) END DESC, " +
+		"created_at DESC",
 }
 
+// queries are scoped to the users and photos of one site (see forSite)
 type defaultDataMapper struct {
 	*gorp.DbMap
+	siteID int64
+
+	// read replica for the read-heavy queries, if any, see read
+	replica *gorp.DbMap
+
+	// prepared statements of the hot queries, see statements.go
+	stmts        *statementCache
+	replicaStmts *statementCache
+
+	// approximate totals of photo lists, see counts.go
+	counts *countCache
 }
 
 type transaction struct {
 	*gorp.Transaction
 }
 
+// saves the edited photo and bumps its version, failing with
+// errPhotoConflict if the photo was edited since it was read
+func (t *transaction) updatePhoto(photo *photo) error {
+	result, err := t.Exec("UPDATE photos SET version = version + 1 WHERE id=$1 AND version=$2",
+		photo.ID, photo.Version)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num == 0 {
+		return errPhotoConflict
+	}
+	photo.Version++
+	if _, err := t.Update(photo); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
 func (t *transaction) updateTags(photo *photo) error {
 
 	var (
@@ -105,12 +366,71 @@ func (t *transaction) updateTags(photo *photo) error {
 
 }
 
-func newDataMapper(db *sql.DB, logSql bool) (dataMapper, error) {
+// returns the data mapper of the database, with reads of photo lists,
+// searches, tags and photos sent to the replica if not nil
+func newDataMapper(db *sql.DB, replica *sql.DB, logSql bool) (dataMapper, error) {
 	dbMap, err := initDB(db, logSql)
 	if err != nil {
 		return nil, err
 	}
-	return &defaultDataMapper{dbMap}, nil
+	d := &defaultDataMapper{
+		DbMap:  dbMap,
+		siteID: defaultSiteID,
+		stmts:  newStatementCache(db),
+		counts: newCountCache(),
+	}
+	if replica != nil {
+		if d.replica, err = initDB(replica, logSql); err != nil {
+			return nil, err
+		}
+		d.replicaStmts = newStatementCache(replica)
+	}
+	return d, nil
+}
+
+// returns a dataMapper scoped to the site
+func (d *defaultDataMapper) forSite(siteID int64) dataMapper {
+	return &defaultDataMapper{
+		DbMap:        d.DbMap,
+		siteID:       siteID,
+		replica:      d.replica,
+		stmts:        d.stmts,
+		replicaStmts: d.replicaStmts,
+		counts:       d.counts,
+	}
+}
+
+// runs the read-only queries on the replica, if any. As the replica may be
+// down or lag behind, queries failing there, including rows not found, run
+// again on the primary.
+func (d *defaultDataMapper) read(queries func(d *defaultDataMapper) error) error {
+	if d.replica != nil {
+		err := queries(&defaultDataMapper{DbMap: d.replica, siteID: d.siteID, stmts: d.replicaStmts, counts: d.counts})
+		if err == nil {
+			return nil
+		}
+		if !isErrSqlNoRows(err) {
+			logError(err)
+		}
+	}
+	return queries(d)
+}
+
+// returns a condition matching rows of the current site
+func (d *defaultDataMapper) inSite(column string) string {
+	return fmt.Sprintf("%s=%d", column, d.siteID)
+}
+
+func (d *defaultDataMapper) getSites() ([]site, error) {
+	var sites []site
+	if _, err := d.Select(&sites, "SELECT * FROM sites ORDER BY id"); err != nil {
+		return sites, errgo.Mask(err)
+	}
+	return sites, nil
+}
+
+func (d *defaultDataMapper) createSite(site *site) error {
+	return errgo.Mask(d.Insert(site))
 }
 
 func (d *defaultDataMapper) begin() (*transaction, error) {
@@ -126,6 +446,7 @@ func (d *defaultDataMapper) createPhoto(photo *photo) error {
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	photo.SiteID = d.siteID
 	if err := t.Insert(photo); err != nil {
 		return errgo.Mask(err)
 	}
@@ -137,263 +458,2086 @@ func (d *defaultDataMapper) createPhoto(photo *photo) error {
 }
 
 func (d *defaultDataMapper) createUser(user *user) error {
+	user.SiteID = d.siteID
 	return errgo.Mask(d.Insert(user))
 }
 
-func (d *defaultDataMapper) updatePhoto(photo *photo) error {
-	if _, err := d.Update(photo); err != nil {
-		return errgo.Mask(err)
-	}
-	return nil
+func (d *defaultDataMapper) createMention(mention *mention) error {
+	return errgo.Mask(d.Insert(mention))
 }
 
-func (d *defaultDataMapper) updateUser(user *user) error {
-	if _, err := d.Update(user); err != nil {
-		return errgo.Mask(err)
-	}
-	return nil
+func (d *defaultDataMapper) createNotification(n *notification) error {
+	return errgo.Mask(d.Insert(n))
 }
 
-func (d *defaultDataMapper) removePhoto(photo *photo) error {
-	if _, err := d.Delete(photo); err != nil {
+func (d *defaultDataMapper) markNotificationRead(userID int64, notificationID int64) error {
+	result, err := d.Exec("UPDATE notifications SET is_read=true WHERE id=$1 AND user_id=$2", notificationID, userID)
+	if err != nil {
 		return errgo.Mask(err)
 	}
-	return nil
-}
-
-func (d *defaultDataMapper) updateTags(photo *photo) error {
-	tx, err := d.begin()
+	num, err := result.RowsAffected()
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if err := tx.updateTags(photo); err != nil {
-		tx.Rollback()
-		return err
+	if num == 0 {
+		return sql.ErrNoRows
 	}
-	return errgo.Mask(tx.Commit())
+	return nil
 }
 
-func (d *defaultDataMapper) updateMany(items ...interface{}) error {
-	tx, err := d.begin()
+func (d *defaultDataMapper) markAllNotificationsRead(userID int64) error {
+	_, err := d.Exec("UPDATE notifications SET is_read=true WHERE user_id=$1 AND is_read=false", userID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getNotificationSettings(userID int64) (notificationSettings, error) {
+	var prefs []notificationPreference
+	if _, err := d.Select(&prefs, "SELECT * FROM notification_preferences WHERE user_id=$1", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newNotificationSettings(userID, prefs), nil
+}
+
+func (d *defaultDataMapper) saveNotificationSettings(settings notificationSettings) error {
+	t, err := d.Begin()
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	for _, item := range items {
-		if _, err := tx.Update(item); err != nil {
-			tx.Rollback()
+	for _, pref := range settings {
+		if _, err := t.Exec("INSERT INTO notification_preferences (user_id, type, in_app, email, push) "+
+			"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id, type) "+
+			"DO UPDATE SET in_app=EXCLUDED.in_app, email=EXCLUDED.email, push=EXCLUDED.push",
+			pref.UserID, pref.Type, pref.InApp, pref.Email, pref.Push); err != nil {
+			t.Rollback()
 			return errgo.Mask(err)
 		}
 	}
-	return errgo.Mask(tx.Commit())
+	return errgo.Mask(t.Commit())
 }
 
-func (d *defaultDataMapper) getPhoto(photoID int64) (*photo, error) {
+// returns the albums of the portfolio of the owner with the photos the user
+// may see, both in the order the owner arranged them
+func (d *defaultDataMapper) getPortfolio(ownerID int64, userID int64) ([]portfolioAlbum, error) {
 
-	p := &photo{}
+	var albums []portfolioAlbum
+	if _, err := d.Select(&albums, "SELECT * FROM portfolio_albums WHERE owner_id=$1 AND "+d.inSite("site_id")+
+		" ORDER BY position", ownerID); err != nil {
+		return albums, errgo.Mask(err)
+	}
 
-	if photoID == 0 {
-		return p, sql.ErrNoRows
+	var photos []portfolioPhoto
+	if _, err := d.Select(&photos, "SELECT photos.*, ap.album_id FROM photos "+
+		"JOIN portfolio_album_photos ap ON ap.photo_id = photos.id "+
+		"JOIN portfolio_albums pa ON pa.id = ap.album_id "+
+		"WHERE pa.owner_id=$1 AND "+d.inSite("pa.site_id")+" AND "+fmt.Sprintf(visibleSql, 2)+
+		" ORDER BY ap.position", ownerID, userID); err != nil {
+		return albums, errgo.Mask(err)
 	}
 
-	obj, err := d.Get(p, photoID)
-	if err != nil {
-		return p, errgo.Mask(err)
+	index := make(map[int64]int)
+	for i := range albums {
+		albums[i].Photos = []photo{}
+		index[albums[i].ID] = i
 	}
-	if obj == nil {
-		return p, sql.ErrNoRows
+	for _, p := range photos {
+		i := index[p.AlbumID]
+		albums[i].Photos = append(albums[i].Photos, p.photo)
 	}
-	return obj.(*photo), nil
+	return albums, nil
 }
 
-func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+// replaces the portfolio of the owner with the albums, in their order. Albums
+// with the ID of an album of the owner are updated, keeping its previous
+// slug in the history; the others are created, and those left out deleted.
+func (d *defaultDataMapper) setPortfolio(ownerID int64, albums []portfolioAlbum) error {
 
-	photo := &photoDetail{}
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
 
-	if photoID == 0 {
-		return photo, sql.ErrNoRows
+	var existing []portfolioAlbum
+	if _, err := tx.Select(&existing, "SELECT * FROM portfolio_albums WHERE owner_id=$1 AND site_id=$2", ownerID, d.siteID); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	previous := make(map[int64]portfolioAlbum)
+	for _, album := range existing {
+		previous[album.ID] = album
 	}
 
-	q := "SELECT p.*, u.name AS owner_name " +
-		"FROM photos p JOIN users u ON u.id = p.owner_id " +
-		"WHERE p.id=$1"
+	now := utcNow()
+	for i := range albums {
+		album := &albums[i]
+		album.SiteID = d.siteID
+		album.OwnerID = ownerID
+		album.Position = i
+
+		if old, ok := previous[album.ID]; ok {
+			delete(previous, album.ID)
+			album.CreatedAt = old.CreatedAt
+			if old.Slug != nil && (album.Slug == nil || *album.Slug != *old.Slug) {
+				if _, err := tx.Exec("INSERT INTO slug_history (user_id, album_id, slug, changed_at) VALUES ($1, $2, $3, $4)",
+					ownerID, album.ID, *old.Slug, now); err != nil {
+					tx.Rollback()
+					return errgo.Mask(err)
+				}
+			}
+			if _, err := tx.Update(album); err != nil {
+				tx.Rollback()
+				return errgo.Mask(err)
+			}
+			if _, err := tx.Exec("DELETE FROM portfolio_album_photos WHERE album_id=$1", album.ID); err != nil {
+				tx.Rollback()
+				return errgo.Mask(err)
+			}
+		} else {
+			album.ID = 0
+			album.CreatedAt = now
+			if err := tx.Insert(album); err != nil {
+				tx.Rollback()
+				return errgo.Mask(err)
+			}
+		}
 
-	if err := d.SelectOne(photo, q, photoID); err != nil {
-		return photo, errgo.Mask(err)
+		for position, photoID := range album.PhotoIDs {
+			if _, err := tx.Exec("INSERT INTO portfolio_album_photos (album_id, photo_id, position) VALUES ($1, $2, $3)",
+				album.ID, photoID, position); err != nil {
+				tx.Rollback()
+				return errgo.Mask(err)
+			}
+		}
 	}
 
-	var tags []tag
+	for id := range previous {
+		if _, err := tx.Exec("DELETE FROM portfolio_albums WHERE id=$1", id); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
 
-	if _, err := d.Select(&tags,
-		"SELECT t.* FROM tags t JOIN photo_tags pt ON pt.tag_id=t.id "+
-			"WHERE pt.photo_id=$1", photo.ID); err != nil {
-		return photo, errgo.Mask(err)
+// returns the ID of the album of the owner which last had the slug
+func (d *defaultDataMapper) getAlbumIDByPreviousSlug(ownerID int64, slug string) (int64, error) {
+	id, err := d.SelectInt("SELECT h.album_id FROM slug_history h "+
+		"JOIN portfolio_albums pa ON pa.id = h.album_id "+
+		"WHERE h.user_id=$1 AND h.slug=$2 AND "+d.inSite("pa.site_id")+" "+
+		"ORDER BY h.changed_at DESC LIMIT 1", ownerID, slug)
+	if err != nil {
+		return 0, errgo.Mask(err)
 	}
-	for _, tag := range tags {
-		photo.Tags = append(photo.Tags, tag.Name)
+	if id == 0 {
+		return 0, sql.ErrNoRows
 	}
+	return id, nil
+}
 
-	photo.Permissions = &permissions{
-		photo.canEdit(user),
-		photo.canDelete(user),
-		photo.canVote(user),
+func (d *defaultDataMapper) getAlbum(albumID int64) (*portfolioAlbum, error) {
+	album := &portfolioAlbum{}
+	if err := d.SelectOne(album, "SELECT * FROM portfolio_albums WHERE id=$1 AND "+d.inSite("site_id"), albumID); err != nil {
+		return album, errgo.Mask(err)
 	}
-	return photo, nil
+	return album, nil
+}
 
+// returns the pins of the homepage in order, shown or not
+func (d *defaultDataMapper) getHomepagePins() ([]homepagePin, error) {
+	var pins []homepagePin
+	if _, err := d.Select(&pins, "SELECT * FROM homepage_pins WHERE "+d.inSite("site_id")+
+		" ORDER BY position"); err != nil {
+		return pins, errgo.Mask(err)
+	}
+	return pins, nil
 }
 
-func (d *defaultDataMapper) getPhotosByOwnerID(page *page, ownerID int64) (*photoList, error) {
-	var (
-		photos []photo
-		err    error
-		total  int64
-	)
+// returns the pins shown at the time in order, with their photo or album
+// and its photos visible to the user. Pins with nothing visible are left out.
+func (d *defaultDataMapper) getActiveHomepagePins(now time.Time, userID int64) ([]homepagePin, error) {
 
-	if ownerID == 0 {
-		return nil, sql.ErrNoRows
-	}
-	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos WHERE owner_id=$1", ownerID); err != nil {
+	var pins []homepagePin
+	if _, err := d.Select(&pins, "SELECT * FROM homepage_pins WHERE (starts_at IS NULL OR starts_at <= $1) AND "+
+		"(ends_at IS NULL OR ends_at > $1) AND "+d.inSite("site_id")+" ORDER BY position", now); err != nil {
 		return nil, errgo.Mask(err)
 	}
 
-	if _, err = d.Select(&photos,
-		"SELECT * FROM photos WHERE owner_id = $1"+
-			"ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $2 OFFSET $3",
-		ownerID, page.size, page.offset); err != nil {
-		return nil, errgo.Mask(err)
+	var photoIDs, albumIDs []int64
+	for _, pin := range pins {
+		if pin.PhotoID != nil {
+			photoIDs = append(photoIDs, *pin.PhotoID)
+		} else if pin.AlbumID != nil {
+			albumIDs = append(albumIDs, *pin.AlbumID)
+		}
 	}
-	return newPhotoList(photos, total, page.index), nil
-
-}
 
-func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, error) {
+	var photos []photo
+	if len(photoIDs) > 0 {
+		if _, err := d.Select(&photos, "SELECT * FROM photos WHERE id = ANY($2::integer[]) AND "+
+			d.inSite("site_id")+" AND "+fmt.Sprintf(visibleSql, 1), userID, intSliceToPgArr(photoIDs)); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
 
 	var (
-		clauses []string
-		params  []interface{}
-		err     error
-		photos  []photo
-		total   int64
+		albums      []portfolioAlbum
+		albumPhotos []portfolioPhoto
 	)
-
-	if q == "" {
-		return nil, nil
+	if len(albumIDs) > 0 {
+		if _, err := d.Select(&albums, "SELECT * FROM portfolio_albums WHERE id = ANY($1::integer[]) AND "+
+			d.inSite("site_id"), intSliceToPgArr(albumIDs)); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if _, err := d.Select(&albumPhotos, "SELECT photos.*, ap.album_id FROM photos "+
+			"JOIN portfolio_album_photos ap ON ap.photo_id = photos.id "+
+			"WHERE ap.album_id = ANY($2::integer[]) AND "+fmt.Sprintf(visibleSql, 1)+
+			" ORDER BY ap.position", userID, intSliceToPgArr(albumIDs)); err != nil {
+			return nil, errgo.Mask(err)
+		}
 	}
 
-	for num, word := range strings.Split(q, " ") {
-		word = strings.TrimSpace(word)
-		if word == "" || num > 6 {
-			break
+	photosByID := make(map[int64]*photo)
+	for i := range photos {
+		photosByID[photos[i].ID] = &photos[i]
+	}
+	albumsByID := make(map[int64]*portfolioAlbum)
+	for i := range albums {
+		albums[i].Photos = []photo{}
+		albumsByID[albums[i].ID] = &albums[i]
+	}
+	for _, p := range albumPhotos {
+		if album, ok := albumsByID[p.AlbumID]; ok {
+			album.Photos = append(album.Photos, p.photo)
 		}
+	}
 
-		num++
+	var active []homepagePin
+	for _, pin := range pins {
+		switch {
+		case pin.PhotoID != nil && photosByID[*pin.PhotoID] != nil:
+			pin.Photo = photosByID[*pin.PhotoID]
+		case pin.AlbumID != nil && albumsByID[*pin.AlbumID] != nil && len(albumsByID[*pin.AlbumID].Photos) > 0:
+			pin.Album = albumsByID[*pin.AlbumID]
+		default:
+			continue
+		}
+		pin.Active = true
+		active = append(active, pin)
+	}
+	return active, nil
+}
 
-		if strings.HasPrefix(word, "@") {
-			word = word[1:]
-			clauses = append(clauses, fmt.Sprintf(
-				"SELECT p.* FROM photos p "+
-					"INNER JOIN users u ON u.id = p.owner_id  "+
-					"WHERE UPPER(u.name::text) = UPPER($%d)", num))
-		} else if strings.HasPrefix(word, "#") {
-			word = word[1:]
-			clauses = append(clauses, fmt.Sprintf(
-				"SELECT p.* FROM photos p "+
-					"INNER JOIN photo_tags pt ON pt.photo_id = p.id "+
-					"INNER JOIN tags t ON pt.tag_id=t.id "+
-					"WHERE UPPER(t.name::text) = UPPER($%d)", num))
-		} else {
-			word = "%" + word + "%"
-			clauses = append(clauses, fmt.Sprintf(
-				"SELECT DISTINCT p.* FROM photos p "+
-					"INNER JOIN users u ON u.id = p.owner_id  "+
-					"LEFT JOIN photo_tags pt ON pt.photo_id = p.id "+
-					"LEFT JOIN tags t ON pt.tag_id=t.id "+
-					"WHERE UPPER(p.title::text) LIKE UPPER($%d) OR "+
-					"UPPER(u.name::text) LIKE UPPER($%d) OR t.name LIKE $%d",
-				num, num, num))
+// replaces the pins of the homepage with the pins, in their order
+func (d *defaultDataMapper) setHomepagePins(pins []homepagePin) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Exec("DELETE FROM homepage_pins WHERE site_id=$1", d.siteID); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	now := utcNow()
+	for i := range pins {
+		pin := &pins[i]
+		pin.ID = 0
+		pin.SiteID = d.siteID
+		pin.Position = i
+		pin.CreatedAt = now
+		if err := tx.Insert(pin); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
 		}
+	}
+	return errgo.Mask(tx.Commit())
+}
 
-		params = append(params, interface{}(word))
+func (d *defaultDataMapper) getShortlink(photoID int64) (*shortlink, error) {
+	link := &shortlink{}
+	if err := d.SelectOne(link, "SELECT * FROM shortlinks WHERE photo_id=$1 AND "+d.inSite("site_id"), photoID); err != nil {
+		return link, errgo.Mask(err)
 	}
+	return link, nil
+}
 
-	clausesSql := strings.Join(clauses, " INTERSECT ")
+func (d *defaultDataMapper) createShortlink(link *shortlink) error {
+	link.SiteID = d.siteID
+	link.CreatedAt = utcNow()
+	return errgo.Mask(d.Insert(link))
+}
 
-	countSql := fmt.Sprintf("SELECT COUNT(id) FROM (%s) q", clausesSql)
+// counts a click of the shortlink, unless its photo has been deleted
+func (d *defaultDataMapper) followShortlink(code string) (*shortlink, error) {
+	link := &shortlink{}
+	if err := d.SelectOne(link, "UPDATE shortlinks s SET clicks = s.clicks + 1 FROM photos p "+
+		"WHERE s.code=$1 AND p.id = s.photo_id AND p.deleted_at IS NULL AND "+d.inSite("s.site_id")+" "+
+		"RETURNING s.*", code); err != nil {
+		return link, errgo.Mask(err)
+	}
+	return link, nil
+}
 
-	if total, err = d.SelectInt(countSql, params...); err != nil {
-		return nil, errgo.Mask(err)
+// returns the comments on the photo, oldest first; comments of shadow
+// banned users are only shown to them
+func (d *defaultDataMapper) getComments(photoID int64, user *user) ([]commentDetail, error) {
+	var comments []commentDetail
+	if _, err := d.Select(&comments, "SELECT c.*, a.name AS author_name FROM comments c "+
+		"JOIN users a ON a.id = c.author_id "+
+		"WHERE c.photo_id=$1 AND (a.shadow_banned=false OR a.id=$2) AND "+d.inSite("c.site_id")+
+		" ORDER BY c.created_at, c.id", photoID, user.ID); err != nil {
+		return comments, errgo.Mask(err)
 	}
+	return comments, nil
+}
 
-	numParams := len(params)
+func (d *defaultDataMapper) getComment(commentID int64) (*comment, error) {
+	c := &comment{}
+	if err := d.SelectOne(c, "SELECT * FROM comments WHERE id=$1 AND "+d.inSite("site_id"), commentID); err != nil {
+		return c, errgo.Mask(err)
+	}
+	return c, nil
+}
 
-	sql := fmt.Sprintf("SELECT * FROM (%s) q ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $%d OFFSET $%d",
-		clausesSql, numParams+1, numParams+2)
+func (d *defaultDataMapper) createComment(c *comment) error {
+	c.SiteID = d.siteID
+	c.CreatedAt = utcNow()
+	return errgo.Mask(d.Insert(c))
+}
 
-	params = append(params, interface{}(page.size))
-	params = append(params, interface{}(page.offset))
+func (d *defaultDataMapper) updateComment(c *comment) error {
+	_, err := d.Update(c)
+	return errgo.Mask(err)
+}
 
-	if _, err = d.Select(&photos, sql, params...); err != nil {
-		return nil, errgo.Mask(err)
+func (d *defaultDataMapper) deleteComment(c *comment) error {
+	_, err := d.Delete(c)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) createReport(r *report) error {
+	r.SiteID = d.siteID
+	r.Status = reportOpen
+	r.CreatedAt = utcNow()
+	return errgo.Mask(d.Insert(r))
+}
+
+func (d *defaultDataMapper) hasReported(photoID int64, userID int64) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(id) FROM reports WHERE photo_id=$1 AND reporter_id=$2", photoID, userID)
+	if err != nil {
+		return false, errgo.Mask(err)
 	}
-	return newPhotoList(photos, total, page.index), nil
+	return num > 0, nil
 }
 
-func (d *defaultDataMapper) getPhotos(page *page, orderBy string) (*photoList, error) {
+func (d *defaultDataMapper) getReport(reportID int64) (*report, error) {
+	r := &report{}
+	if err := d.SelectOne(r, "SELECT * FROM reports WHERE id=$1 AND "+d.inSite("site_id"), reportID); err != nil {
+		return r, errgo.Mask(err)
+	}
+	return r, nil
+}
 
-	var (
-		total  int64
-		photos []photo
-		err    error
-	)
-	if orderBy == "votes" {
-		orderBy = "(up_votes - down_votes)"
-	} else {
-		orderBy = "created_at"
+// returns the reports waiting for an admin, oldest first
+func (d *defaultDataMapper) getOpenReports() ([]reportDetail, error) {
+	var reports []reportDetail
+	if _, err := d.Select(&reports, "SELECT r.*, p.title, o.name AS owner_name, u.name AS reporter_name "+
+		"FROM reports r JOIN photos p ON p.id = r.photo_id "+
+		"JOIN users o ON o.id = r.owner_id JOIN users u ON u.id = r.reporter_id "+
+		"WHERE r.status=$1 AND "+d.inSite("r.site_id")+" ORDER BY r.created_at", reportOpen); err != nil {
+		return reports, errgo.Mask(err)
 	}
+	return reports, nil
+}
+
+// saves the status of the report; an upheld report adds a strike to the
+// owner of the photo, returned with the new count, otherwise nil
+func (d *defaultDataMapper) resolveReport(r *report) (*user, error) {
 
-	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos"); err != nil {
+	tx, err := d.begin()
+	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 
-	if _, err = d.Select(&photos,
-		"SELECT * FROM photos "+
-			"ORDER BY "+orderBy+" DESC LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+	now := utcNow()
+	r.ResolvedAt = &now
+	if _, err := tx.Update(r); err != nil {
+		tx.Rollback()
 		return nil, errgo.Mask(err)
 	}
-	return newPhotoList(photos, total, page.index), nil
-}
 
-func (d *defaultDataMapper) getTagCounts() ([]tagCount, error) {
-	var tags []tagCount
-	if _, err := d.Select(&tags, "SELECT name, photo, num_photos FROM tag_counts"); err != nil {
-		return tags, errgo.Mask(err)
+	var owner *user
+	if r.Status == reportUpheld {
+		owner = &user{}
+		if err := tx.SelectOne(owner, "UPDATE users SET strikes = strikes + 1 WHERE id=$1 RETURNING *", r.OwnerID); err != nil {
+			tx.Rollback()
+			return nil, errgo.Mask(err)
+		}
 	}
-	return tags, nil
+	return owner, errgo.Mask(tx.Commit())
 }
 
-func (d *defaultDataMapper) isUserNameAvailable(user *user) (bool, error) {
-	var (
-		num int64
-		err error
-	)
-	q := "SELECT COUNT(id) FROM users WHERE name=$1"
-	if user.ID == 0 {
-		num, err = d.SelectInt(q, user.Name)
-	} else {
-		q += " AND id != $2"
-		num, err = d.SelectInt(q, user.Name, user.ID)
+func (d *defaultDataMapper) getModerationNotes(userID int64) ([]moderationNoteDetail, error) {
+	var notes []moderationNoteDetail
+	if _, err := d.Select(&notes, "SELECT n.*, a.name AS author_name FROM moderation_notes n "+
+		"JOIN users a ON a.id = n.author_id WHERE n.user_id=$1 ORDER BY n.created_at", userID); err != nil {
+		return notes, errgo.Mask(err)
 	}
-	if err != nil {
-		return false, errgo.Mask(err)
+	return notes, nil
+}
+
+func (d *defaultDataMapper) createModerationNote(note *moderationNote) error {
+	note.CreatedAt = utcNow()
+	return errgo.Mask(d.Insert(note))
+}
+
+func (d *defaultDataMapper) getStrikeThresholds() ([]strikeThreshold, error) {
+	var thresholds []strikeThreshold
+	if _, err := d.Select(&thresholds, "SELECT strikes, suspension_days FROM strike_thresholds WHERE "+
+		d.inSite("site_id")+" ORDER BY strikes"); err != nil {
+		return thresholds, errgo.Mask(err)
 	}
-	return num == 0, nil
+	return thresholds, nil
 }
 
-func (d *defaultDataMapper) isUserEmailAvailable(user *user) (bool, error) {
-	var (
-		num int64
+func (d *defaultDataMapper) setStrikeThresholds(thresholds []strikeThreshold) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Exec("DELETE FROM strike_thresholds WHERE site_id=$1", d.siteID); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	for _, t := range thresholds {
+		if _, err := tx.Exec("INSERT INTO strike_thresholds (site_id, strikes, suspension_days) VALUES ($1, $2, $3)",
+			d.siteID, t.Strikes, t.SuspensionDays); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) createPurchase(p *purchase) error {
+	p.SiteID = d.siteID
+	p.CreatedAt = utcNow()
+	return errgo.Mask(d.Insert(p))
+}
+
+func (d *defaultDataMapper) getPurchaseByCheckout(checkoutID string) (*purchase, error) {
+	p := &purchase{}
+	if err := d.SelectOne(p, "SELECT * FROM purchases WHERE checkout_id=$1 AND "+d.inSite("site_id"), checkoutID); err != nil {
+		return p, errgo.Mask(err)
+	}
+	return p, nil
+}
+
+// records the payment of the purchase, once
+func (d *defaultDataMapper) markPurchasePaid(p *purchase) error {
+	now := utcNow()
+	if _, err := d.Exec("UPDATE purchases SET paid_at=$1 WHERE id=$2 AND paid_at IS NULL", now, p.ID); err != nil {
+		return errgo.Mask(err)
+	}
+	if p.PaidAt == nil {
+		p.PaidAt = &now
+	}
+	return nil
+}
+
+// returns true if the user paid for the photo
+func (d *defaultDataMapper) hasPurchased(photoID int64, userID int64) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(id) FROM purchases WHERE photo_id=$1 AND buyer_id=$2 AND paid_at IS NOT NULL",
+		photoID, userID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// returns the paid purchases of the user, last first
+func (d *defaultDataMapper) getPurchases(userID int64) ([]purchaseDetail, error) {
+	var purchases []purchaseDetail
+	if _, err := d.Select(&purchases, "SELECT pu.*, p.title, p.photo FROM purchases pu "+
+		"JOIN photos p ON p.id = pu.photo_id "+
+		"WHERE pu.buyer_id=$1 AND pu.paid_at IS NOT NULL AND "+d.inSite("pu.site_id")+
+		" ORDER BY pu.paid_at DESC", userID); err != nil {
+		return purchases, errgo.Mask(err)
+	}
+	return purchases, nil
+}
+
+// stores the subscription; a browser subscribing again, even as another
+// user, replaces its previous subscription
+func (d *defaultDataMapper) savePushSubscription(s *pushSubscription) error {
+	s.CreatedAt = utcNow()
+	return errgo.Mask(d.SelectOne(s, "INSERT INTO push_subscriptions (user_id, endpoint, auth, p256dh, created_at) "+
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (endpoint) "+
+		"DO UPDATE SET user_id=EXCLUDED.user_id, auth=EXCLUDED.auth, p256dh=EXCLUDED.p256dh, created_at=EXCLUDED.created_at "+
+		"RETURNING *", s.UserID, s.Endpoint, s.Auth, s.P256dh, s.CreatedAt))
+}
+
+func (d *defaultDataMapper) getPushSubscriptions(userID int64) ([]pushSubscription, error) {
+	var subs []pushSubscription
+	if _, err := d.Select(&subs, "SELECT * FROM push_subscriptions WHERE user_id=$1 ORDER BY created_at DESC", userID); err != nil {
+		return subs, errgo.Mask(err)
+	}
+	return subs, nil
+}
+
+func (d *defaultDataMapper) removePushSubscription(userID int64, subscriptionID int64) error {
+	result, err := d.Exec("DELETE FROM push_subscriptions WHERE id=$1 AND user_id=$2", subscriptionID, userID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num == 0 {
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// removes a subscription the push service reports has expired
+func (d *defaultDataMapper) removePushEndpoint(endpoint string) error {
+	_, err := d.Exec("DELETE FROM push_subscriptions WHERE endpoint=$1", endpoint)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) updatePhoto(photo *photo) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := tx.updatePhoto(photo); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) updateUser(user *user) error {
+	if _, err := d.Update(user); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) removePhoto(photo *photo) error {
+	if _, err := d.Delete(photo); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) updateTags(photo *photo) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := tx.updatePhoto(photo); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.updateTags(photo); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+// returns the photos of the site expired by the time
+func (d *defaultDataMapper) getExpiredPhotos(now time.Time) ([]photo, error) {
+	var photos []photo
+	if _, err := d.Select(&photos, "SELECT * FROM photos WHERE expires_at <= $1 AND "+d.inSite("site_id")+
+		" ORDER BY id", now); err != nil {
+		return photos, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+// moves the photos to the trash of their owners
+func (d *defaultDataMapper) trashPhotos(photos []*photo) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	now := utcNow()
+	for _, photo := range photos {
+		if _, err := tx.Exec("UPDATE photos SET deleted_at=$1, version = version + 1 WHERE id=$2",
+			now, photo.ID); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+		photo.DeletedAt = &now
+		photo.Version++
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+// takes the photo out of the trash
+func (d *defaultDataMapper) restorePhoto(photo *photo) error {
+	if _, err := d.Exec("UPDATE photos SET deleted_at=NULL, version = version + 1 WHERE id=$1",
+		photo.ID); err != nil {
+		return errgo.Mask(err)
+	}
+	photo.DeletedAt = nil
+	photo.Version++
+	return nil
+}
+
+// returns the photos in the trash of the owner, last deleted first
+func (d *defaultDataMapper) getTrash(page *page, ownerID int64) (*photoList, error) {
+
+	var (
+		total  int64
+		photos []photo
+		err    error
+	)
+
+	where := "WHERE owner_id=$1 AND deleted_at IS NOT NULL AND " + d.inSite("site_id")
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos "+where, ownerID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT * FROM photos "+where+
+			" ORDER BY deleted_at DESC LIMIT $2 OFFSET $3", ownerID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+func (d *defaultDataMapper) getTrashedPhoto(photoID int64, ownerID int64) (*photo, error) {
+	p := &photo{}
+	if err := d.SelectOne(p, "SELECT * FROM photos WHERE id=$1 AND owner_id=$2 AND deleted_at IS NOT NULL AND "+
+		d.inSite("site_id"), photoID, ownerID); err != nil {
+		return p, errgo.Mask(err)
+	}
+	return p, nil
+}
+
+// returns the photos of the site put in the trash before the time
+func (d *defaultDataMapper) getTrashedBefore(before time.Time) ([]photo, error) {
+	var photos []photo
+	if _, err := d.Select(&photos, "SELECT * FROM photos WHERE deleted_at < $1 AND "+d.inSite("site_id")+
+		" ORDER BY id", before); err != nil {
+		return photos, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+// updates the photos and their tags in one transaction
+func (d *defaultDataMapper) updatePhotos(photos []*photo) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, photo := range photos {
+		if err := tx.updatePhoto(photo); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.updateTags(photo); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) removePhotos(photos []*photo) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, photo := range photos {
+		if _, err := tx.Delete(photo); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) updateMany(items ...interface{}) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, item := range items {
+		if _, err := tx.Update(item); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+// stores the vote, counting it on the photo and the user in SQL so that
+// concurrent votes are not lost, and reads back the updated photo and user.
+// A second vote of the user on the photo fails with errAlreadyVoted.
+func (d *defaultDataMapper) recordVote(photo *photo, user *user, value int) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	result, err := tx.Exec("INSERT INTO photo_votes (photo_id, user_id, value, created_at) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (photo_id, user_id) DO NOTHING", photo.ID, user.ID, value, utcNow())
+	if err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num == 0 {
+		tx.Rollback()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errAlreadyVoted
+	}
+	column := "up_votes"
+	if value < 0 {
+		column = "down_votes"
+	}
+	if err := tx.SelectOne(photo, fmt.Sprintf("UPDATE photos SET %[1]s = %[1]s + 1 WHERE id=$1 RETURNING *", column),
+		photo.ID); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := tx.SelectOne(user, "UPDATE users SET votes = array_append(votes, $1) WHERE id=$2 RETURNING *",
+		photo.ID, user.ID); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+// recounts the votes of photos of the site whose up and down votes no
+// longer match their recorded votes, returning the number of photos fixed
+func (d *defaultDataMapper) recomputeScores() (int64, error) {
+	result, err := d.Exec("UPDATE photos p SET " +
+		"up_votes = p.legacy_up_votes + v.up, down_votes = p.legacy_down_votes + v.down FROM (" +
+		"SELECT vp.id, " +
+		"COUNT(pv.photo_id) FILTER (WHERE pv.value > 0) AS up, " +
+		"COUNT(pv.photo_id) FILTER (WHERE pv.value < 0) AS down " +
+		"FROM photos vp LEFT JOIN photo_votes pv ON pv.photo_id = vp.id " +
+		"WHERE " + d.inSite("vp.site_id") + " GROUP BY vp.id) v " +
+		"WHERE v.id = p.id AND " +
+		"(p.up_votes != p.legacy_up_votes + v.up OR p.down_votes != p.legacy_down_votes + v.down)")
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	return num, errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getPhoto(photoID int64) (*photo, error) {
+
+	p := &photo{}
+
+	if photoID == 0 {
+		return p, sql.ErrNoRows
+	}
+
+	obj, err := d.Get(p, photoID)
+	if err != nil {
+		return p, errgo.Mask(err)
+	}
+	if obj == nil || obj.(*photo).SiteID != d.siteID || obj.(*photo).DeletedAt != nil {
+		return p, sql.ErrNoRows
+	}
+	return obj.(*photo), nil
+}
+
+func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+	var photo *photoDetail
+	err := d.read(func(d *defaultDataMapper) (err error) {
+		photo, err = d.selectPhotoDetail(photoID, user)
+		return err
+	})
+	return photo, err
+}
+
+func (d *defaultDataMapper) selectPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+
+	photo := &photoDetail{}
+
+	if photoID == 0 {
+		return photo, sql.ErrNoRows
+	}
+
+	q := "SELECT p.*, u.name AS owner_name, u.shadow_banned AS owner_shadow_banned " +
+		"FROM photos p JOIN users u ON u.id = p.owner_id " +
+		"WHERE p.id=$1 AND p.deleted_at IS NULL AND " + d.inSite("p.site_id")
+
+	if err := d.selectOnePrepared(photo, q, photoID); err != nil {
+		return photo, errgo.Mask(err)
+	}
+
+	if !photo.isVisibleTo(user, utcNow()) {
+		return photo, sql.ErrNoRows
+	}
+
+	var tags []tag
+
+	if err := d.selectPrepared(&tags,
+		"SELECT t.* FROM tags t JOIN photo_tags pt ON pt.tag_id=t.id "+
+			"WHERE pt.photo_id=$1", photo.ID); err != nil {
+		return photo, errgo.Mask(err)
+	}
+	for _, tag := range tags {
+		photo.Tags = append(photo.Tags, tag.Name)
+	}
+
+	if err := d.setPermissions(photo, user, nil); err != nil {
+		return photo, err
+	}
+	return photo, nil
+
+}
+
+// sets what the user may do with the photo. Users blocked by the owner may
+// not vote or comment; blocked caches the lookups by owner, if not nil.
+func (d *defaultDataMapper) setPermissions(photo *photoDetail, user *user, blocked map[int64]bool) error {
+
+	photo.Permissions = &permissions{
+		photo.canEdit(user),
+		photo.canDelete(user),
+		photo.canVote(user),
+		photo.canComment(user),
+	}
+
+	if photo.Permissions.Vote || photo.Permissions.Comment {
+		isBlocked, ok := blocked[photo.OwnerID]
+		if !ok {
+			var err error
+			if isBlocked, err = d.isBlocked(photo.OwnerID, user.ID, false); err != nil {
+				return err
+			}
+			if blocked != nil {
+				blocked[photo.OwnerID] = isBlocked
+			}
+		}
+		photo.Permissions.Vote = photo.Permissions.Vote && !isBlocked
+		photo.Permissions.Comment = photo.Permissions.Comment && !isBlocked
+	}
+	return nil
+}
+
+// returns the photos of the ids the user may see, as getPhotoDetail does,
+// in the order of their ids
+func (d *defaultDataMapper) getPhotoDetails(photoIDs []int64, user *user) ([]photoDetail, error) {
+
+	if len(photoIDs) == 0 {
+		return nil, nil
+	}
+
+	var found []photoDetail
+
+	if _, err := d.Select(&found,
+		"SELECT p.*, u.name AS owner_name, u.shadow_banned AS owner_shadow_banned "+
+			"FROM photos p JOIN users u ON u.id = p.owner_id "+
+			"WHERE p.id = ANY($1::integer[]) AND p.deleted_at IS NULL AND "+d.inSite("p.site_id")+" ORDER BY p.id",
+		intSliceToPgArr(photoIDs)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	var (
+		photos  []photoDetail
+		blocked = make(map[int64]bool)
+		now     = utcNow()
+	)
+	for _, photo := range found {
+		if !photo.isVisibleTo(user, now) {
+			continue
+		}
+		if err := d.setPermissions(&photo, user, blocked); err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+
+	var photoTags []struct {
+		PhotoID int64  `db:"photo_id"`
+		Name    string `db:"name"`
+	}
+
+	if _, err := d.Select(&photoTags,
+		"SELECT pt.photo_id, t.name FROM tags t JOIN photo_tags pt ON pt.tag_id=t.id "+
+			"WHERE pt.photo_id = ANY($1::integer[])", intSliceToPgArr(photoIDs)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	tags := make(map[int64][]string)
+	for _, pt := range photoTags {
+		tags[pt.PhotoID] = append(tags[pt.PhotoID], pt.Name)
+	}
+	for i := range photos {
+		photos[i].Tags = tags[photos[i].ID]
+	}
+	return photos, nil
+}
+
+func (d *defaultDataMapper) getPhotosByOwnerID(page *page, ownerID int64, userID int64) (*photoList, error) {
+	var (
+		photos []photo
+		err    error
+		total  int64
+	)
+
+	if ownerID == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	where := "WHERE owner_id=$1 AND " + d.inSite("site_id") + " AND " + fmt.Sprintf(visibleSql, 2)
+
+	if total, err = d.selectIntPrepared("SELECT COUNT(id) FROM photos "+where, ownerID, userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if err = d.selectPrepared(&photos,
+		"SELECT * FROM photos "+where+
+			" ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $3 OFFSET $4",
+		ownerID, userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+
+}
+
+func (d *defaultDataMapper) searchPhotos(page *page, q string, userID int64) (*photoList, error) {
+	var photos *photoList
+	err := d.read(func(d *defaultDataMapper) (err error) {
+		photos, err = d.selectSearchPhotos(page, q, userID)
+		return err
+	})
+	return photos, err
+}
+
+func (d *defaultDataMapper) selectSearchPhotos(page *page, q string, userID int64) (*photoList, error) {
+
+	var (
+		clauses []string
+		params  []interface{}
+		err     error
+		photos  []photo
+		total   int64
+	)
+
+	if q == "" {
+		return nil, nil
+	}
+
+	for num, word := range strings.Split(q, " ") {
+		word = strings.TrimSpace(word)
+		if word == "" || num > 6 {
+			break
+		}
+
+		num++
+
+		if strings.HasPrefix(word, "@") {
+			word = word[1:]
+			clauses = append(clauses, fmt.Sprintf(
+				"SELECT p.* FROM photos p "+
+					"INNER JOIN users u ON u.id = p.owner_id  "+
+					"WHERE UPPER(u.name::text) = UPPER($%d)", num))
+		} else if c, ok := parseColor(strings.TrimPrefix(word, "color:")); strings.HasPrefix(word, "color:") && ok {
+			word = strconv.FormatInt(c, 10)
+			clauses = append(clauses, fmt.Sprintf(
+				"SELECT p.* FROM photos p WHERE EXISTS (SELECT 1 FROM UNNEST(p.palette) c WHERE "+
+					"POWER(((c >> 16) & 255) - (($%[1]d::integer >> 16) & 255), 2) + "+
+					"POWER(((c >> 8) & 255) - (($%[1]d::integer >> 8) & 255), 2) + "+
+					"POWER((c & 255) - ($%[1]d::integer & 255), 2) <= %[2]d)",
+				num, colorSearchDistance*colorSearchDistance))
+		} else if strings.HasPrefix(word, "#") {
+			word = word[1:]
+			clauses = append(clauses, fmt.Sprintf(
+				"SELECT p.* FROM photos p "+
+					"INNER JOIN photo_tags pt ON pt.photo_id = p.id "+
+					"INNER JOIN tags t ON pt.tag_id=t.id "+
+					"WHERE UPPER(t.name::text) = UPPER($%d)", num))
+		} else {
+			word = "%" + word + "%"
+			clauses = append(clauses, fmt.Sprintf(
+				"SELECT DISTINCT p.* FROM photos p "+
+					"INNER JOIN users u ON u.id = p.owner_id  "+
+					"LEFT JOIN photo_tags pt ON pt.photo_id = p.id "+
+					"LEFT JOIN tags t ON pt.tag_id=t.id "+
+					"WHERE UPPER(p.title::text) LIKE UPPER($%d) OR "+
+					"UPPER(u.name::text) LIKE UPPER($%d) OR t.name LIKE $%d",
+				num, num, num))
+		}
+
+		params = append(params, interface{}(word))
+	}
+
+	params = append(params, interface{}(userID))
+
+	numParams := len(params)
+
+	clausesSql := fmt.Sprintf("SELECT * FROM (%s) q WHERE %s AND %s",
+		strings.Join(clauses, " INTERSECT "),
+		d.inSite("site_id"),
+		fmt.Sprintf(visibleSql, numParams))
+
+	countSql := fmt.Sprintf("SELECT COUNT(id) FROM (%s) q", clausesSql)
+
+	if total, err = d.selectIntPrepared(countSql, params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	sql := fmt.Sprintf("SELECT * FROM (%s) q ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $%d OFFSET $%d",
+		clausesSql, numParams+1, numParams+2)
+
+	params = append(params, interface{}(page.size))
+	params = append(params, interface{}(page.offset))
+
+	if err = d.selectPrepared(&photos, sql, params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+func (d *defaultDataMapper) getPhotos(page *page, order *ordering, userID int64) (*photoList, error) {
+	var photos *photoList
+	err := d.read(func(d *defaultDataMapper) (err error) {
+		photos, err = d.selectPhotos(page, order, "", userID)
+		return err
+	})
+	return photos, err
+}
+
+// returns the photos of the tag
+func (d *defaultDataMapper) getPhotosByTag(page *page, tagID int64, order *ordering, userID int64) (*photoList, error) {
+	return d.selectPhotos(page, order, "id IN (SELECT photo_id FROM photo_tags WHERE tag_id=$2)", userID, tagID)
+}
+
+// returns the photos of the site visible to the user ($1) in the ordering,
+// optionally filtered with a further condition and its params ($2...)
+func (d *defaultDataMapper) selectPhotos(page *page, order *ordering, cond string, userID int64, condParams ...interface{}) (*photoList, error) {
+
+	var (
+		total  int64
+		photos []photo
+		err    error
+	)
+
+	where := "WHERE " + d.inSite("site_id") + " AND " + fmt.Sprintf(visibleSql, 1)
+	params := append([]interface{}{userID}, condParams...)
+
+	if cond != "" {
+		where += " AND " + cond
+	}
+
+	if since := order.since(utcNow()); !since.IsZero() {
+		params = append(params, since)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(params))
+	}
+
+	countSql := "SELECT COUNT(id) FROM photos " + where
+	approximate := !page.exact && d.counts != nil
+
+	if approximate {
+		key := fmt.Sprint(where, order.window, condParams)
+		total, err = d.counts.get(key, utcNow(), func() (int64, error) {
+			return d.selectIntPrepared(countSql, append([]interface{}{int64(0)}, params[1:]...)...)
+		})
+	} else {
+		total, err = d.selectIntPrepared(countSql, params...)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	sql := fmt.Sprintf("SELECT * FROM photos %s ORDER BY %s LIMIT $%d OFFSET $%d",
+		where, orderingSql[order.sort], len(params)+1, len(params)+2)
+
+	if err = d.selectPrepared(&photos, sql, append(params, page.size, page.offset)...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := newPhotoList(photos, total, page.index)
+	result.Approximate = approximate
+	return result, nil
+}
+
+// returns up to n photos picked at random. Instead of sorting the whole
+// table with ORDER BY random(), ids are drawn from the range of photo ids and
+// looked up by primary key; ids are oversampled to make up for gaps left by
+// deleted photos, other sites and hidden owners, so fewer than n photos may
+// be returned when most ids in the range are missing.
+func (d *defaultDataMapper) getRandomPhotos(n int64, userID int64) ([]photo, error) {
+
+	var photos []photo
+
+	// the few photos found are shuffled, as they come back in id order
+	sql := fmt.Sprintf("SELECT * FROM photos WHERE id IN ("+
+		"SELECT FLOOR(r.min_id + RANDOM() * (r.max_id - r.min_id + 1))::integer "+
+		"FROM (SELECT MIN(id) AS min_id, MAX(id) AS max_id FROM photos WHERE %[1]s) r, "+
+		"GENERATE_SERIES(1, $2 * %[2]d)) AND %[1]s AND %[3]s ORDER BY RANDOM() LIMIT $2",
+		d.inSite("site_id"), randomOversample, fmt.Sprintf(visibleSql, 1))
+
+	if _, err := d.Select(&photos, sql, userID, n); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+// returns the staff picks, most recently picked first
+func (d *defaultDataMapper) getStaffPicks(page *page, userID int64) (*photoList, error) {
+
+	var (
+		total  int64
+		photos []photo
+		err    error
+	)
+
+	where := "WHERE staff_picked_at IS NOT NULL AND " + d.inSite("site_id") + " AND " + fmt.Sprintf(visibleSql, 1)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos "+where, userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT * FROM photos "+where+
+			" ORDER BY staff_picked_at DESC LIMIT $2 OFFSET $3", userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+// picks the photo, keeping the time of an earlier pick, or unpicks it
+func (d *defaultDataMapper) setStaffPick(photo *photo, picked bool) error {
+	switch {
+	case !picked:
+		photo.StaffPickedAt = nil
+	case photo.StaffPickedAt == nil:
+		now := utcNow()
+		photo.StaffPickedAt = &now
+	}
+	_, err := d.Exec("UPDATE photos SET staff_picked_at=$1 WHERE id=$2", photo.StaffPickedAt, photo.ID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getBlockedWords() ([]blockedWord, error) {
+	var words []blockedWord
+	if _, err := d.Select(&words,
+		"SELECT * FROM blocked_words WHERE "+d.inSite("site_id")+" ORDER BY word"); err != nil {
+		return words, errgo.Mask(err)
+	}
+	return words, nil
+}
+
+// adds the word, or returns it if already blocked
+func (d *defaultDataMapper) addBlockedWord(word *blockedWord) error {
+	word.SiteID = d.siteID
+	word.CreatedAt = utcNow()
+	return errgo.Mask(d.SelectOne(word, "INSERT INTO blocked_words (site_id, word, created_at) "+
+		"VALUES ($1, $2, $3) ON CONFLICT (site_id, word) DO UPDATE SET word=EXCLUDED.word "+
+		"RETURNING *", word.SiteID, word.Word, word.CreatedAt))
+}
+
+func (d *defaultDataMapper) removeBlockedWord(wordID int64) error {
+	result, err := d.Exec("DELETE FROM blocked_words WHERE id=$1 AND "+d.inSite("site_id"), wordID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num == 0 {
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// counts the recent uploads of the owner, and those with the title
+func (d *defaultDataMapper) getSpamSignals(ownerID int64, title string) (*spamSignals, error) {
+	s := &spamSignals{}
+	now := utcNow()
+	if err := d.SelectOne(s,
+		"SELECT COUNT(*) FILTER (WHERE LOWER(title) = LOWER($2) AND created_at > $3) AS duplicate_titles, "+
+			"COUNT(*) FILTER (WHERE created_at > $4) AS recent_uploads "+
+			"FROM photos WHERE owner_id=$1 AND created_at > $3",
+		ownerID, title, now.Add(-spamDuplicateWindow), now.Add(-spamBurstWindow)); err != nil {
+		return s, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+// returns the photos held for review, most suspicious first
+func (d *defaultDataMapper) getHeldPhotos(page *page) (*photoList, error) {
+
+	var (
+		total  int64
+		photos []photo
+		err    error
+	)
+
+	where := "WHERE held_at IS NOT NULL AND deleted_at IS NULL AND " + d.inSite("site_id")
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos " + where); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT * FROM photos "+where+
+			" ORDER BY spam_score DESC, held_at LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+// replaces any earlier suggestions for the photo
+func (d *defaultDataMapper) saveSuggestions(s *photoSuggestions) error {
+	s.TagList = strings.Join(s.Tags, " ")
+	s.CreatedAt = utcNow()
+	_, err := d.Exec("INSERT INTO photo_suggestions (photo_id, tags, alt_text, created_at) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (photo_id) "+
+		"DO UPDATE SET tags=EXCLUDED.tags, alt_text=EXCLUDED.alt_text, created_at=EXCLUDED.created_at",
+		s.PhotoID, s.TagList, s.AltText, s.CreatedAt)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getSuggestions(photoID int64) (*photoSuggestions, error) {
+	s := &photoSuggestions{}
+	if err := d.SelectOne(s,
+		"SELECT s.* FROM photo_suggestions s JOIN photos p ON p.id = s.photo_id "+
+			"WHERE s.photo_id=$1 AND "+d.inSite("p.site_id"), photoID); err != nil {
+		return s, errgo.Mask(err)
+	}
+	s.Tags = strings.Fields(s.TagList)
+	return s, nil
+}
+
+func (d *defaultDataMapper) removeSuggestions(photoID int64) error {
+	_, err := d.Exec("DELETE FROM photo_suggestions WHERE photo_id=$1", photoID)
+	return errgo.Mask(err)
+}
+
+// reserves the key for a request, returning nil, or returns the key stored by
+// an earlier request. Keys created before expiry are reserved again.
+func (d *defaultDataMapper) reserveIdempotencyKey(key *idempotencyKey, expiry time.Time, reservationExpiry time.Time) (*idempotencyKey, error) {
+	err := d.SelectOne(key, "INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, key) "+
+		"DO UPDATE SET fingerprint=EXCLUDED.fingerprint, status=0, content_type='', body=NULL, created_at=EXCLUDED.created_at "+
+		"WHERE idempotency_keys.created_at < $5 OR (idempotency_keys.status=0 AND idempotency_keys.created_at < $6) RETURNING *",
+		key.UserID, key.Key, key.Fingerprint, key.CreatedAt, expiry, reservationExpiry)
+	if err == nil {
+		return nil, nil
+	}
+	if !isErrSqlNoRows(err) {
+		return nil, errgo.Mask(err)
+	}
+	stored := &idempotencyKey{}
+	if err := d.SelectOne(stored, "SELECT * FROM idempotency_keys WHERE user_id=$1 AND key=$2",
+		key.UserID, key.Key); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return stored, nil
+}
+
+// stores the response of the request of the key
+func (d *defaultDataMapper) saveIdempotencyKey(key *idempotencyKey) error {
+	_, err := d.Exec("UPDATE idempotency_keys SET status=$1, content_type=$2, body=$3 WHERE user_id=$4 AND key=$5",
+		key.Status, key.ContentType, key.Body, key.UserID, key.Key)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) removeIdempotencyKey(key *idempotencyKey) error {
+	_, err := d.Exec("DELETE FROM idempotency_keys WHERE user_id=$1 AND key=$2", key.UserID, key.Key)
+	return errgo.Mask(err)
+}
+
+// removes keys of all sites created before expiry
+func (d *defaultDataMapper) removeExpiredIdempotencyKeys(expiry time.Time) (int64, error) {
+	result, err := d.Exec("DELETE FROM idempotency_keys WHERE created_at < $1", expiry)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	return num, errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getMentions(page *page, userID int64) (*mentionList, error) {
+
+	var (
+		mentions []mentionDetail
+		total    int64
+		err      error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM mentions WHERE user_id=$1", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&mentions,
+		"SELECT m.*, u.name AS sender_name, p.title, p.photo "+
+			"FROM mentions m "+
+			"JOIN users u ON u.id = m.sender_id "+
+			"JOIN photos p ON p.id = m.photo_id "+
+			"WHERE m.user_id=$1 ORDER BY m.created_at DESC LIMIT $2 OFFSET $3",
+		userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newMentionList(mentions, total, page.index), nil
+}
+
+func (d *defaultDataMapper) getNotifications(page *page, userID int64) (*notificationList, error) {
+
+	var (
+		notifications []notificationDetail
+		total, unread int64
+		err           error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM notifications WHERE user_id=$1", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if unread, err = d.SelectInt("SELECT COUNT(id) FROM notifications WHERE user_id=$1 AND is_read=false", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&notifications,
+		"SELECT n.*, COALESCE(u.name, n.actor) AS sender_name, "+
+			"COALESCE(p.title, '') AS title, COALESCE(p.photo, '') AS photo "+
+			"FROM notifications n "+
+			"LEFT JOIN users u ON u.id = n.sender_id "+
+			"LEFT JOIN photos p ON p.id = n.photo_id "+
+			"WHERE n.user_id=$1 ORDER BY n.created_at DESC LIMIT $2 OFFSET $3",
+		userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newNotificationList(notifications, total, unread, page.index), nil
+}
+
+// votes and comments on photos, see getActivity
+const activitySql = "FROM (" +
+	"SELECT CASE WHEN value > 0 THEN 'upvote' ELSE 'downvote' END AS type, photo_id, user_id, " +
+	"NULL::integer AS comment_id, '' AS body, created_at FROM photo_votes " +
+	"UNION ALL " +
+	"SELECT 'comment' AS type, photo_id, author_id AS user_id, id AS comment_id, body, created_at FROM comments" +
+	") a JOIN photos p ON p.id = a.photo_id JOIN users u ON u.id = a.user_id " +
+	"WHERE p.owner_id=$1 AND p.deleted_at IS NULL AND a.user_id <> $1 AND a.created_at >= $2 " +
+	"AND u.shadow_banned=false AND a.user_id NOT IN (SELECT target_id FROM blocks WHERE user_id=$1)"
+
+// returns the votes and comments of other users on photos of the user since
+// the time, newest first, leaving out users the user blocked or muted
+func (d *defaultDataMapper) getActivity(page *page, userID int64, since time.Time) (*activityList, error) {
+
+	var items []activity
+
+	total, err := d.SelectInt("SELECT COUNT(*) "+activitySql, userID, since)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err := d.Select(&items,
+		"SELECT a.*, p.title, p.photo, u.name AS user_name "+activitySql+
+			" ORDER BY a.created_at DESC LIMIT $3 OFFSET $4",
+		userID, since, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newActivityList(items, total, page.index), nil
+}
+
+// returns the cameras and lenses used in the site, most used first
+func (d *defaultDataMapper) getGear() ([]gearCount, error) {
+	var gear []gearCount
+	if _, err := d.Select(&gear,
+		"SELECT camera AS name, 'camera' AS kind, COUNT(*) AS num_photos FROM photos "+
+			"WHERE camera <> '' AND deleted_at IS NULL AND "+d.inSite("site_id")+" GROUP BY camera "+
+			"UNION ALL "+
+			"SELECT lens AS name, 'lens' AS kind, COUNT(*) AS num_photos FROM photos "+
+			"WHERE lens <> '' AND deleted_at IS NULL AND "+d.inSite("site_id")+" GROUP BY lens "+
+			"ORDER BY num_photos DESC, name"); err != nil {
+		return gear, errgo.Mask(err)
+	}
+	return gear, nil
+}
+
+// returns the photos taken with the camera or lens
+func (d *defaultDataMapper) getPhotosByGear(page *page, name string, order *ordering, userID int64) (*photoList, error) {
+	return d.selectPhotos(page, order, "(camera=$2 OR lens=$2)", userID, name)
+}
+
+// saves the camera and lens read from the photo file
+func (d *defaultDataMapper) setPhotoGear(photo *photo) error {
+	_, err := d.Exec("UPDATE photos SET camera=$1, lens=$2 WHERE id=$3", photo.Camera, photo.Lens, photo.ID)
+	return errgo.Mask(err)
+}
+
+// saves the size and resolution read from the photo file
+func (d *defaultDataMapper) setPhotoDimensions(photo *photo) error {
+	_, err := d.Exec("UPDATE photos SET width=$1, height=$2, dpi=$3 WHERE id=$4", photo.Width, photo.Height, photo.DPI, photo.ID)
+	return errgo.Mask(err)
+}
+
+// saves the checksum of a photo uploaded before checksums were recorded
+func (d *defaultDataMapper) setPhotoChecksum(photo *photo) error {
+	_, err := d.Exec("UPDATE photos SET checksum=$1 WHERE id=$2", photo.Checksum, photo.ID)
+	return errgo.Mask(err)
+}
+
+// returns photos of the site whose files were never checked or not checked
+// since the time, the longest unchecked first
+func (d *defaultDataMapper) getPhotosToCheck(checkedBefore time.Time, limit int) ([]photo, error) {
+	var photos []photo
+	if _, err := d.Select(&photos, "SELECT p.* FROM photos p "+
+		"LEFT JOIN storage_checks c ON c.photo_id = p.id "+
+		"WHERE (c.checked_at IS NULL OR c.checked_at < $1) AND "+d.inSite("p.site_id")+
+		" ORDER BY c.checked_at NULLS FIRST, p.id LIMIT $2", checkedBefore, limit); err != nil {
+		return photos, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+// records a check of the file of the photo, with the corruption it found,
+// or nil if it passed, which resolves any open corruption of the file
+func (d *defaultDataMapper) recordStorageCheck(photo *photo, now time.Time, c *storageCorruption) error {
+
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	if _, err := tx.Exec("INSERT INTO storage_checks (photo_id, site_id, checked_at) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (photo_id) DO UPDATE SET checked_at=EXCLUDED.checked_at", photo.ID, d.siteID, now); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+
+	switch {
+	case c == nil:
+		_, err = tx.Exec("UPDATE storage_corruptions SET resolved_at=$1 "+
+			"WHERE photo_id=$2 AND resolved_at IS NULL", now, photo.ID)
+	case c.Repaired:
+		var result sql.Result
+		result, err = tx.Exec("UPDATE storage_corruptions SET resolved_at=$1, repaired=true "+
+			"WHERE photo_id=$2 AND resolved_at IS NULL", now, photo.ID)
+		var num int64
+		if err == nil {
+			num, err = result.RowsAffected()
+		}
+		if err == nil && num == 0 {
+			_, err = tx.Exec("INSERT INTO storage_corruptions (site_id, photo_id, problem, detected_at, resolved_at, repaired) "+
+				"VALUES ($1, $2, $3, $4, $4, true)", d.siteID, photo.ID, c.Problem, now)
+		}
+	default:
+		_, err = tx.Exec("INSERT INTO storage_corruptions (site_id, photo_id, problem, detected_at) "+
+			"VALUES ($1, $2, $3, $4) ON CONFLICT (photo_id) WHERE resolved_at IS NULL DO NOTHING",
+			d.siteID, photo.ID, c.Problem, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+// returns the open corruptions of the site, and those resolved since the
+// time, latest first
+func (d *defaultDataMapper) getStorageCorruptions(resolvedSince time.Time) ([]storageCorruptionDetail, error) {
+	var corruptions []storageCorruptionDetail
+	if _, err := d.Select(&corruptions, "SELECT c.*, p.photo, p.title FROM storage_corruptions c "+
+		"JOIN photos p ON p.id = c.photo_id "+
+		"WHERE (c.resolved_at IS NULL OR c.resolved_at >= $1) AND "+d.inSite("c.site_id")+
+		" ORDER BY c.detected_at DESC", resolvedSince); err != nil {
+		return corruptions, errgo.Mask(err)
+	}
+	return corruptions, nil
+}
+
+// saves the palette and blurhash computed from the photo file
+func (d *defaultDataMapper) setPhotoColors(photo *photo) error {
+	_, err := d.Exec("UPDATE photos SET palette=$1, blurhash=$2 WHERE id=$3", photo.Palette, photo.Blurhash, photo.ID)
+	return errgo.Mask(err)
+}
+
+// returns the tag if used in the site, with its description and number of
+// photos in the site
+func (d *defaultDataMapper) getTagDetail(name string) (*tagDetail, error) {
+	tag := &tagDetail{}
+	if err := d.SelectOne(tag,
+		"SELECT t.id, t.name, COALESCE(td.description, '') AS description, "+
+			"td.cover_photo_id, cp.photo AS cover_photo, "+
+			"(SELECT COUNT(*) FROM photo_tags pt JOIN photos p ON p.id = pt.photo_id "+
+			"WHERE pt.tag_id = t.id AND p.deleted_at IS NULL AND "+d.inSite("p.site_id")+") AS num_photos "+
+			"FROM tags t LEFT JOIN tag_details td ON td.tag_id = t.id AND "+d.inSite("td.site_id")+" "+
+			"LEFT JOIN photos cp ON cp.id = td.cover_photo_id AND cp.deleted_at IS NULL "+
+			"WHERE t.name = $1", strings.ToLower(name)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if tag.NumPhotos == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return tag, nil
+}
+
+// saves the description and cover photo of the tag in the site
+func (d *defaultDataMapper) saveTagDetail(tag *tagDetail) error {
+	_, err := d.Exec("INSERT INTO tag_details (tag_id, site_id, description, cover_photo_id) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (tag_id, site_id) "+
+		"DO UPDATE SET description=EXCLUDED.description, cover_photo_id=EXCLUDED.cover_photo_id",
+		tag.ID, d.siteID, tag.Description, tag.CoverPhotoID)
+	return errgo.Mask(err)
+}
+
+// checks the photo of the site has the tag
+func (d *defaultDataMapper) isTaggedPhoto(tagID int64, photoID int64) (bool, error) {
+	n, err := d.SelectInt("SELECT COUNT(*) FROM photo_tags pt JOIN photos p ON p.id = pt.photo_id "+
+		"WHERE pt.tag_id=$1 AND pt.photo_id=$2 AND p.deleted_at IS NULL AND "+d.inSite("p.site_id"), tagID, photoID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return n > 0, nil
+}
+
+// returns the tags used in the site, most used first, with the cover or
+// top photo of each
+func (d *defaultDataMapper) getTagCounts() ([]tagCount, error) {
+	var tags []tagCount
+	err := d.read(func(d *defaultDataMapper) error {
+		tags = nil
+		_, err := d.Select(&tags,
+			"SELECT t.name, COALESCE(td.description, '') AS description, COUNT(p.id) AS num_photos, "+
+				"COALESCE((SELECT cp.photo FROM photos cp WHERE cp.id = td.cover_photo_id AND cp.deleted_at IS NULL), "+
+				"(SELECT tp.photo FROM photos tp JOIN photo_tags tpt ON tpt.photo_id = tp.id "+
+				"WHERE tpt.tag_id = t.id AND tp.deleted_at IS NULL AND "+d.inSite("tp.site_id")+" "+
+				"ORDER BY (tp.up_votes - tp.down_votes) DESC, tp.created_at DESC LIMIT 1)) AS photo "+
+				"FROM tags t JOIN photo_tags pt ON pt.tag_id = t.id JOIN photos p ON p.id = pt.photo_id "+
+				"LEFT JOIN tag_details td ON td.tag_id = t.id AND "+d.inSite("td.site_id")+" "+
+				"WHERE p.deleted_at IS NULL AND "+d.inSite("p.site_id")+" GROUP BY t.id, t.name, td.description, td.cover_photo_id "+
+				"ORDER BY num_photos DESC")
+		return errgo.Mask(err)
+	})
+	return tags, err
+}
+
+// returns the photos of the site changed after the time, including those
+// in the trash, in the order they were changed
+func (d *defaultDataMapper) getChangedPhotos(since time.Time, limit int64) ([]photoChange, error) {
+	var changes []photoChange
+	if _, err := d.Select(&changes,
+		"SELECT id, updated_at FROM photos WHERE updated_at > $1 AND "+d.inSite("site_id")+
+			" ORDER BY updated_at, id LIMIT $2", since, limit); err != nil {
+		return changes, errgo.Mask(err)
+	}
+	return changes, nil
+}
+
+// returns the ids of the photos of the site deleted after the time
+func (d *defaultDataMapper) getDeletedPhotoIDs(since time.Time) ([]int64, error) {
+	var ids []int64
+	if _, err := d.Select(&ids,
+		"SELECT photo_id FROM photo_deletions WHERE deleted_at > $1 AND "+d.inSite("site_id")+
+			" ORDER BY deleted_at", since); err != nil {
+		return ids, errgo.Mask(err)
+	}
+	return ids, nil
+}
+
+// returns every photo of the site with owner name and tags, for export
+func (d *defaultDataMapper) getAllPhotos() ([]photoDetail, error) {
+
+	var photos []photoDetail
+
+	if _, err := d.Select(&photos,
+		"SELECT p.*, u.name AS owner_name, u.shadow_banned AS owner_shadow_banned "+
+			"FROM photos p JOIN users u ON u.id = p.owner_id WHERE p.deleted_at IS NULL AND "+d.inSite("p.site_id")+" ORDER BY p.id"); err != nil {
+		return photos, errgo.Mask(err)
+	}
+
+	var photoTags []struct {
+		PhotoID int64  `db:"photo_id"`
+		Name    string `db:"name"`
+	}
+
+	if _, err := d.Select(&photoTags,
+		"SELECT pt.photo_id, t.name FROM tags t JOIN photo_tags pt ON pt.tag_id=t.id"); err != nil {
+		return photos, errgo.Mask(err)
+	}
+
+	tags := make(map[int64][]string)
+	for _, pt := range photoTags {
+		tags[pt.PhotoID] = append(tags[pt.PhotoID], pt.Name)
+	}
+	for i := range photos {
+		photos[i].Tags = tags[photos[i].ID]
+	}
+	return photos, nil
+}
+
+func (d *defaultDataMapper) getAllUsers() ([]user, error) {
+	var users []user
+	if _, err := d.Select(&users, "SELECT * FROM users WHERE "+d.inSite("site_id")+" ORDER BY id"); err != nil {
+		return users, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+// returns the photos of the user, the upvotes they received and the longest
+// run of days, in UTC, the user uploaded photos on
+func (d *defaultDataMapper) getUserStats(userID int64) (*userStats, error) {
+	stats := &userStats{}
+	if err := d.SelectOne(stats,
+		"SELECT COUNT(*) AS photos, COALESCE(SUM(up_votes), 0) AS up_votes, "+
+			"(SELECT COALESCE(MAX(days), 0) FROM ("+
+			"SELECT COUNT(*) AS days FROM ("+
+			"SELECT day - (ROW_NUMBER() OVER (ORDER BY day))::integer AS run FROM ("+
+			"SELECT DISTINCT (created_at AT TIME ZONE 'UTC')::date AS day FROM photos "+
+			"WHERE owner_id=$1 AND deleted_at IS NULL) d) r GROUP BY run) s) AS streak "+
+			"FROM photos WHERE owner_id=$1 AND deleted_at IS NULL", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return stats, nil
+}
+
+// stores the badge, returning false if the user has it already
+func (d *defaultDataMapper) awardBadge(b *badge) (bool, error) {
+	result, err := d.Exec("INSERT INTO badges (user_id, name, awarded_at) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (user_id, name) DO NOTHING", b.UserID, b.Name, b.AwardedAt)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+func (d *defaultDataMapper) getBadges(userID int64) ([]badge, error) {
+	var badges []badge
+	if _, err := d.Select(&badges, "SELECT * FROM badges WHERE user_id=$1 ORDER BY awarded_at, name", userID); err != nil {
+		return badges, errgo.Mask(err)
+	}
+	return badges, nil
+}
+
+// inserts the users and photos of an archive, keeping their IDs or mapping
+// them to new IDs
+func (d *defaultDataMapper) importArchive(a *archive, preserveIDs bool) error {
+
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	var (
+		userIDs  = make(map[int64]int64)
+		photoIDs = make(map[int64]int64)
+	)
+
+	insert := func(table, columns, values string, id int64, params ...interface{}) (int64, error) {
+		if preserveIDs {
+			columns = "id, " + columns
+			values = fmt.Sprintf("%d, %s", id, values)
+		}
+		return t.SelectInt(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING id", table, columns, values), params...)
+	}
+
+	for _, u := range a.Users {
+		algorithm := u.PasswordAlgorithm
+		if algorithm == "" {
+			algorithm = passwordBcrypt
+		}
+		id, err := insert("users", "name, email, password, password_algorithm, password_pepper, admin, active, created_at, votes, site_id",
+			"$1, $2, $3, $4, $5, $6, $7, $8, '{}', $9", u.ID,
+			u.Name, u.Email, u.Password, algorithm, u.PasswordPepper, u.IsAdmin, u.IsActive, u.CreatedAt, d.siteID)
+		if err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+		userIDs[u.ID] = id
+	}
+
+	for _, p := range a.Photos {
+		ownerID, ok := userIDs[p.OwnerID]
+		if !ok {
+			t.Rollback()
+			return fmt.Errorf("photo %d has unknown owner %d", p.ID, p.OwnerID)
+		}
+		id, err := insert("photos",
+			"owner_id, title, photo, up_votes, down_votes, legacy_up_votes, legacy_down_votes, created_at, taken_at, latitude, longitude, camera, lens, alt_text, private, expires_at, site_id",
+			"$1, $2, $3, $4, $5, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15", p.ID,
+			ownerID, p.Title, p.Filename, p.UpVotes, p.DownVotes, p.CreatedAt, p.TakenAt, p.Latitude, p.Longitude, p.Camera, p.Lens, p.AltText, p.Private, p.ExpiresAt, d.siteID)
+		if err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+		photoIDs[p.ID] = id
+		if err := t.updateTags(&photo{ID: id, Tags: p.Tags}); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+
+	for _, u := range a.Users {
+		var votes []int64
+		for _, photoID := range u.Votes {
+			if id, ok := photoIDs[photoID]; ok {
+				votes = append(votes, id)
+			}
+		}
+		if _, err := t.Exec("UPDATE users SET votes=$1 WHERE id=$2", intSliceToPgArr(votes), userIDs[u.ID]); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+
+	if preserveIDs {
+		for _, table := range []string{"users", "photos"} {
+			if _, err := t.Exec(fmt.Sprintf(
+				"SELECT setval('%[1]s_id_seq', COALESCE((SELECT MAX(id) FROM %[1]s), 1))", table)); err != nil {
+				t.Rollback()
+				return errgo.Mask(err)
+			}
+		}
+	}
+
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) getPhotoFilenames() ([]string, error) {
+	var names []string
+	if _, err := d.Select(&names, "SELECT photo FROM photos"); err != nil {
+		return names, errgo.Mask(err)
+	}
+	return names, nil
+}
+
+// returns true if a photo of any site uses the file, in the trash or not
+func (d *defaultDataMapper) isFileUsed(name string) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(*) FROM photos WHERE photo=$1", name)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// runs fn holding a lock on the stored file, on every server, until fn
+// returns
+func (d *defaultDataMapper) withFileLock(name string, fn func() error) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", name); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := fn(); err != nil {
+		t.Rollback()
+		return err
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) removeOrphanTags() (int64, error) {
+	result, err := d.Exec("DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM photo_tags)")
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return result.RowsAffected()
+}
+
+func (d *defaultDataMapper) getFeatureFlags() ([]featureFlag, error) {
+	var flags []featureFlag
+	if _, err := d.Select(&flags, "SELECT * FROM feature_flags WHERE "+d.inSite("site_id")); err != nil {
+		return flags, errgo.Mask(err)
+	}
+	return flags, nil
+}
+
+func (d *defaultDataMapper) setFeatureFlag(flag *featureFlag) error {
+	result, err := d.Exec("UPDATE feature_flags SET percentage=$1 WHERE name=$2 AND "+d.inSite("site_id"),
+		flag.Percentage, flag.Name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num > 0 {
+		return errgo.Mask(err)
+	}
+	_, err = d.Exec("INSERT INTO feature_flags (site_id, name, percentage) VALUES ($1, $2, $3)",
+		d.siteID, flag.Name, flag.Percentage)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) createAuditEntry(entry *auditEntry) error {
+	return errgo.Mask(d.Insert(entry))
+}
+
+func (d *defaultDataMapper) getAuditLog(page *page) (*auditList, error) {
+	var (
+		entries []auditEntryDetail
+		total   int64
+		err     error
+	)
+
+	where := "WHERE a.user_id IN (SELECT id FROM users WHERE " + d.inSite("site_id") + ") "
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM audit_log a " + where); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&entries,
+		"SELECT a.*, COALESCE(u.name, '') AS user_name FROM audit_log a "+
+			"LEFT JOIN users u ON u.id = a.user_id "+where+
+			"ORDER BY a.created_at DESC LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newAuditList(entries, total, page.index), nil
+}
+
+// blocks (or if mute is set, only mutes) the target user. Any existing
+// block or mute is replaced.
+func (d *defaultDataMapper) blockUser(userID int64, targetID int64, mute bool) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Exec("DELETE FROM blocks WHERE user_id=$1 AND target_id=$2", userID, targetID); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Exec("INSERT INTO blocks (user_id, target_id, mute, created_at) VALUES ($1, $2, $3, $4)",
+		userID, targetID, mute, utcNow()); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) unblockUser(userID int64, targetID int64) error {
+	_, err := d.Exec("DELETE FROM blocks WHERE user_id=$1 AND target_id=$2", userID, targetID)
+	return errgo.Mask(err)
+}
+
+// checks if the user has blocked the target user. Mutes are only included if
+// includeMuted is set.
+func (d *defaultDataMapper) isBlocked(userID int64, targetID int64, includeMuted bool) (bool, error) {
+	if userID == 0 || targetID == 0 {
+		return false, nil
+	}
+	q := "SELECT COUNT(*) FROM blocks WHERE user_id=$1 AND target_id=$2"
+	if !includeMuted {
+		q += " AND mute=false"
+	}
+	num, err := d.SelectInt(q, userID, targetID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+func (d *defaultDataMapper) getBlockedUsers(userID int64) ([]blockedUser, error) {
+	var users []blockedUser
+	if _, err := d.Select(&users,
+		"SELECT u.id, u.name, b.mute, b.created_at FROM blocks b "+
+			"JOIN users u ON u.id = b.target_id "+
+			"WHERE b.user_id=$1 ORDER BY u.name", userID); err != nil {
+		return users, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+// follows the target, returning false if the user already followed them
+func (d *defaultDataMapper) followUser(userID int64, targetID int64) (bool, error) {
+	result, err := d.Exec("INSERT INTO user_follows (user_id, target_id, created_at) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (user_id, target_id) DO NOTHING", userID, targetID, utcNow())
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+func (d *defaultDataMapper) unfollowUser(userID int64, targetID int64) error {
+	_, err := d.Exec("DELETE FROM user_follows WHERE user_id=$1 AND target_id=$2", userID, targetID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) followTag(userID int64, tagID int64) error {
+	_, err := d.Exec("INSERT INTO tag_follows (user_id, tag_id, created_at) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (user_id, tag_id) DO NOTHING", userID, tagID, utcNow())
+	return errgo.Mask(err)
+}
+
+// unfollows the tag by name, so that tags left without photos can be unfollowed
+func (d *defaultDataMapper) unfollowTag(userID int64, name string) error {
+	_, err := d.Exec("DELETE FROM tag_follows WHERE user_id=$1 AND tag_id IN (SELECT id FROM tags WHERE name=$2)",
+		userID, strings.ToLower(name))
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) isFollowingTag(userID int64, tagID int64) (bool, error) {
+	if userID == 0 {
+		return false, nil
+	}
+	num, err := d.SelectInt("SELECT COUNT(*) FROM tag_follows WHERE user_id=$1 AND tag_id=$2", userID, tagID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// returns the users and tags the user follows, by name
+func (d *defaultDataMapper) getFollows(userID int64) (*follows, error) {
+	f := &follows{Users: []followedUser{}, Tags: []string{}}
+	if _, err := d.Select(&f.Users,
+		"SELECT u.id, u.name, f.created_at FROM user_follows f "+
+			"JOIN users u ON u.id = f.target_id "+
+			"WHERE f.user_id=$1 AND u.active=true ORDER BY u.name", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := d.Select(&f.Tags,
+		"SELECT t.name FROM tag_follows f JOIN tags t ON t.id = f.tag_id "+
+			"WHERE f.user_id=$1 ORDER BY t.name", userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return f, nil
+}
+
+// returns the photos of the users and tags the user ($2) follows, each once
+// however many of its tags are followed
+func (d *defaultDataMapper) getFeedPhotos(page *page, order *ordering, userID int64) (*photoList, error) {
+	return d.selectPhotos(page, order,
+		"(owner_id IN (SELECT target_id FROM user_follows WHERE user_id=$2) OR "+
+			"id IN (SELECT pt.photo_id FROM photo_tags pt JOIN tag_follows f ON f.tag_id = pt.tag_id WHERE f.user_id=$2))",
+		userID, userID)
+}
+
+// creates a new session record, removing any expired sessions for the user
+func (d *defaultDataMapper) createSession(session *session) error {
+	if _, err := d.Exec("DELETE FROM sessions WHERE user_id=$1 AND created_at < $2",
+		session.UserID, time.Now().Add(-time.Minute*expiry)); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := d.Insert(session); err != nil {
+		return errgo.Mask(err)
+	}
+	// admins acting as the user do not keep the account active
+	if session.ImpersonatorID != nil {
+		return nil
+	}
+	return d.markActive(session.UserID, session.CreatedAt)
+}
+
+// records the activity of the user, cancelling any inactivity warning
+func (d *defaultDataMapper) markActive(userID int64, at time.Time) error {
+	_, err := d.Exec("UPDATE users SET last_active_at=$1, inactivity_warned_at=NULL WHERE id=$2", at, userID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getSession(key string) (*session, error) {
+	session := &session{}
+	if key == "" {
+		return session, sql.ErrNoRows
+	}
+	if err := d.SelectOne(session, "SELECT * FROM sessions WHERE session_key=$1", key); err != nil {
+		return session, errgo.Mask(err)
+	}
+	return session, nil
+}
+
+// returns the unexpired sessions of the user, most recently used first
+func (d *defaultDataMapper) getSessions(userID int64) ([]session, error) {
+	var sessions []session
+	if _, err := d.Select(&sessions,
+		"SELECT * FROM sessions WHERE user_id=$1 AND created_at >= $2 ORDER BY last_seen_at DESC",
+		userID, time.Now().Add(-time.Minute*expiry)); err != nil {
+		return sessions, errgo.Mask(err)
+	}
+	return sessions, nil
+}
+
+func (d *defaultDataMapper) touchSession(session *session) error {
+	session.LastSeenAt = utcNow()
+	if _, err := d.Exec("UPDATE sessions SET last_seen_at=$1 WHERE id=$2", session.LastSeenAt, session.ID); err != nil {
+		return errgo.Mask(err)
+	}
+	if session.ImpersonatorID != nil {
+		return nil
+	}
+	return d.markActive(session.UserID, session.LastSeenAt)
+}
+
+func (d *defaultDataMapper) deleteSession(userID int64, sessionID int64) error {
+	result, err := d.Exec("DELETE FROM sessions WHERE id=$1 AND user_id=$2", sessionID, userID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// gives the session a new key, the old one no longer working
+func (d *defaultDataMapper) rotateSessionKey(userID int64, sessionID int64, key string) error {
+	result, err := d.Exec("UPDATE sessions SET session_key=$1 WHERE id=$2 AND user_id=$3", key, sessionID, userID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ends all the sessions of the user
+func (d *defaultDataMapper) deleteUserSessions(userID int64) error {
+	_, err := d.Exec("DELETE FROM sessions WHERE user_id=$1", userID)
+	return errgo.Mask(err)
+}
+
+// deletes the sessions of the user but for the one given
+func (d *defaultDataMapper) deleteOtherSessions(userID int64, sessionID int64) error {
+	_, err := d.Exec("DELETE FROM sessions WHERE user_id=$1 AND id<>$2", userID, sessionID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) isUserNameAvailable(user *user) (bool, error) {
+	var (
+		num int64
+		err error
+	)
+	// previous names are reserved for their owners, so old links resolve
+	q := "SELECT COUNT(*) FROM (" +
+		"SELECT id AS user_id FROM users WHERE UPPER(name)=UPPER($1) AND " + d.inSite("site_id") + " " +
+		"UNION ALL SELECT h.user_id FROM username_history h JOIN users u ON u.id = h.user_id " +
+		"WHERE UPPER(h.name)=UPPER($1) AND " + d.inSite("u.site_id") + ") n"
+	if user.ID == 0 {
+		num, err = d.SelectInt(q, user.Name)
+	} else {
+		q += " WHERE user_id != $2"
+		num, err = d.SelectInt(q, user.Name, user.ID)
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num == 0, nil
+}
+
+func (d *defaultDataMapper) isUserEmailAvailable(user *user) (bool, error) {
+	var (
+		num int64
 		err error
 	)
-	q := "SELECT COUNT(id) FROM users WHERE email=$1"
+	q := "SELECT COUNT(id) FROM users WHERE email=$1 AND " + d.inSite("site_id")
 	if user.ID == 0 {
 		num, err = d.SelectInt(q, user.Email)
 	} else {
@@ -403,45 +2547,727 @@ func (d *defaultDataMapper) isUserEmailAvailable(user *user) (bool, error) {
 	if err != nil {
 		return false, errgo.Mask(err)
 	}
-	return num == 0, nil
+	return num == 0, nil
+}
+
+func (d *defaultDataMapper) getActiveUser(userID int64) (*user, error) {
+
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND id=$2 AND "+d.inSite("site_id"), true, userID); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+
+}
+
+// returns the user, active or not
+func (d *defaultDataMapper) getUser(userID int64) (*user, error) {
+
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE id=$1 AND "+d.inSite("site_id"), userID); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+}
+
+func (d *defaultDataMapper) removeUser(user *user) error {
+	if _, err := d.Delete(user); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// active users other than admins and exempt users, with their number of photos
+const retainedUsersSql = "SELECT u.*, (SELECT COUNT(*) FROM photos p WHERE p.owner_id = u.id) AS num_photos " +
+	"FROM users u WHERE u.active=true AND u.admin=false AND u.retention_exempt=false AND "
+
+// returns the users not yet warned who were last active before the time
+func (d *defaultDataMapper) getInactiveUsers(activeBefore time.Time) ([]inactiveUser, error) {
+	var users []inactiveUser
+	if _, err := d.Select(&users, retainedUsersSql+"u.last_active_at < $1 AND u.inactivity_warned_at IS NULL AND "+
+		d.inSite("u.site_id")+" ORDER BY u.id", activeBefore); err != nil {
+		return users, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+// returns the users warned before warnedBefore who were last active before
+// activeBefore
+func (d *defaultDataMapper) getWarnedUsers(activeBefore time.Time, warnedBefore time.Time) ([]inactiveUser, error) {
+	var users []inactiveUser
+	if _, err := d.Select(&users, retainedUsersSql+"u.last_active_at < $1 AND u.inactivity_warned_at < $2 AND "+
+		d.inSite("u.site_id")+" ORDER BY u.id", activeBefore, warnedBefore); err != nil {
+		return users, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+// returns the user by the hash of their recovery code
+func (d *defaultDataMapper) getUserByRecoveryCode(code string) (*user, error) {
+
+	user := &user{}
+	if code == "" {
+		return user, sql.ErrNoRows
+	}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND recovery_code=$2 AND "+d.inSite("site_id"), true, code); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+
+}
+
+// clears the recovery code of the user, given by its hash, returning false
+// if it was no longer the code, e.g. used by another request
+func (d *defaultDataMapper) clearRecoveryCode(userID int64, code string) (bool, error) {
+	result, err := d.Exec("UPDATE users SET recovery_code=NULL WHERE id=$1 AND recovery_code=$2", userID, code)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// saves the password hash of the user with its algorithm and pepper, unless
+// the password was changed since the old hash was read
+func (d *defaultDataMapper) updatePasswordHash(u *user, oldHash string) error {
+	_, err := d.Exec("UPDATE users SET password=$1, password_algorithm=$2, password_pepper=$3 WHERE id=$4 AND password=$5",
+		u.Password, u.PasswordAlgorithm, u.PasswordPepper, u.ID, oldHash)
+	return errgo.Mask(err)
+}
+
+// returns the user by the hash of their email change code
+func (d *defaultDataMapper) getUserByEmailChangeCode(code string) (*user, error) {
+
+	user := &user{}
+	if code == "" {
+		return user, sql.ErrNoRows
+	}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email_change_code=$2 AND "+d.inSite("site_id"), true, code); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+
+}
+
+func (d *defaultDataMapper) getUserByEmail(email string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email=$2 AND "+d.inSite("site_id"), true, email); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+}
+
+func (d *defaultDataMapper) getUserByOIDCSubject(subject string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND oidc_subject=$2 AND "+d.inSite("site_id"), true, subject); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+}
+
+// returns the user by the hash of the code linking their OpenID Connect
+// account
+func (d *defaultDataMapper) getUserByOIDCLinkCode(code string) (*user, error) {
+	user := &user{}
+	if code == "" {
+		return user, sql.ErrNoRows
+	}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND oidc_link_code=$2 AND "+d.inSite("site_id"), true, code); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+}
+
+func (d *defaultDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
+	user := &user{}
+
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND (email=$2 OR name=$2) AND "+d.inSite("site_id"), true, identifier); err != nil {
+		return user, errgo.Mask(err)
+	}
+
+	return user, nil
+}
+
+func (d *defaultDataMapper) getUsersByNames(names []string) ([]user, error) {
+	var (
+		users  []user
+		args   []string
+		params = []interface{}{interface{}(true)}
+	)
+
+	if len(names) == 0 {
+		return users, nil
+	}
+
+	for num, name := range names {
+		args = append(args, fmt.Sprintf("UPPER($%d)", num+2))
+		params = append(params, interface{}(name))
+	}
+
+	// includes users mentioned by a previous name
+	q := fmt.Sprintf("SELECT * FROM users WHERE active=$1 AND %[2]s AND (UPPER(name) IN (%[1]s) OR "+
+		"id IN (SELECT user_id FROM username_history WHERE UPPER(name) IN (%[1]s)))",
+		strings.Join(args, ","), d.inSite("site_id"))
+
+	if _, err := d.Select(&users, q, params...); err != nil {
+		return users, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+func (d *defaultDataMapper) getUserByName(name string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND UPPER(name)=UPPER($2) AND "+d.inSite("site_id"), true, name); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
 }
 
-func (d *defaultDataMapper) getActiveUser(userID int64) (*user, error) {
-
+// finds the user who has previously used this name
+func (d *defaultDataMapper) getUserByPreviousName(name string) (*user, error) {
 	user := &user{}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND id=$2", true, userID); err != nil {
+	if err := d.SelectOne(user, "SELECT u.* FROM users u "+
+		"JOIN username_history h ON h.user_id = u.id "+
+		"WHERE u.active=$1 AND UPPER(h.name)=UPPER($2) AND "+d.inSite("u.site_id")+" "+
+		"ORDER BY h.changed_at DESC LIMIT 1", true, name); err != nil {
 		return user, errgo.Mask(err)
 	}
 	return user, nil
-
 }
 
-func (d *defaultDataMapper) getUserByRecoveryCode(code string) (*user, error) {
+// saves the user with the new name, and keeps the old name in the history
+func (d *defaultDataMapper) changeUserName(user *user, oldName string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Exec("INSERT INTO username_history (user_id, name, changed_at) VALUES ($1, $2, $3)",
+		user.ID, oldName, utcNow()); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Update(user); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tx.Commit())
+}
 
+func (d *defaultDataMapper) getUserBySlug(slug string) (*user, error) {
 	user := &user{}
-	if code == "" {
-		return user, sql.ErrNoRows
-	}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND recovery_code=$2", true, code); err != nil {
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND slug=$2 AND "+d.inSite("site_id"), true, slug); err != nil {
 		return user, errgo.Mask(err)
 	}
 	return user, nil
-
 }
-func (d *defaultDataMapper) getUserByEmail(email string) (*user, error) {
+
+// finds the user who has previously used this slug
+func (d *defaultDataMapper) getUserByPreviousSlug(slug string) (*user, error) {
 	user := &user{}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email=$2", true, email); err != nil {
+	if err := d.SelectOne(user, "SELECT u.* FROM users u "+
+		"JOIN slug_history h ON h.user_id = u.id "+
+		"WHERE u.active=$1 AND h.album_id IS NULL AND h.slug=$2 AND "+d.inSite("u.site_id")+" "+
+		"ORDER BY h.changed_at DESC LIMIT 1", true, slug); err != nil {
 		return user, errgo.Mask(err)
 	}
 	return user, nil
 }
 
-func (d *defaultDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
-	user := &user{}
+func (d *defaultDataMapper) isUserSlugAvailable(user *user) (bool, error) {
+	// previous slugs are reserved for their owners, so old links resolve
+	num, err := d.SelectInt("SELECT COUNT(*) FROM ("+
+		"SELECT id AS user_id FROM users WHERE slug=$1 AND "+d.inSite("site_id")+" "+
+		"UNION ALL SELECT h.user_id FROM slug_history h JOIN users u ON u.id = h.user_id "+
+		"WHERE h.album_id IS NULL AND h.slug=$1 AND "+d.inSite("u.site_id")+") n "+
+		"WHERE user_id != $2", *user.Slug, user.ID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num == 0, nil
+}
 
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND (email=$2 OR name=$2)", true, identifier); err != nil {
-		return user, errgo.Mask(err)
+// saves the user with the new slug, and keeps the old slug in the history
+func (d *defaultDataMapper) changeUserSlug(user *user, oldSlug *string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if oldSlug != nil {
+		if _, err := tx.Exec("INSERT INTO slug_history (user_id, slug, changed_at) VALUES ($1, $2, $3)",
+			user.ID, *oldSlug, utcNow()); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	if _, err := tx.Update(user); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) getActorKey(userID int64) (*actorKey, error) {
+	key := &actorKey{}
+	if err := d.SelectOne(key, "SELECT * FROM actor_keys WHERE user_id=$1", userID); err != nil {
+		return key, errgo.Mask(err)
 	}
+	return key, nil
+}
 
-	return user, nil
+// stores the key unless the user already has one
+func (d *defaultDataMapper) createActorKey(key *actorKey) error {
+	_, err := d.Exec("INSERT INTO actor_keys (user_id, private_key, public_key, created_at) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO NOTHING",
+		key.UserID, key.PrivateKey, key.PublicKey, utcNow())
+	return errgo.Mask(err)
+}
+
+// adds the follower, updating the inbox if the actor already follows the user
+func (d *defaultDataMapper) addFollower(f *follower) error {
+	f.CreatedAt = utcNow()
+	_, err := d.Exec("INSERT INTO followers (user_id, actor, inbox, created_at) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (user_id, actor) DO UPDATE SET inbox=EXCLUDED.inbox",
+		f.UserID, f.Actor, f.Inbox, f.CreatedAt)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) removeFollower(userID int64, actor string) error {
+	_, err := d.Exec("DELETE FROM followers WHERE user_id=$1 AND actor=$2", userID, actor)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getFollowers(userID int64) ([]follower, error) {
+	var followers []follower
+	if _, err := d.Select(&followers, "SELECT * FROM followers WHERE user_id=$1 ORDER BY id", userID); err != nil {
+		return followers, errgo.Mask(err)
+	}
+	return followers, nil
+}
+
+func (d *defaultDataMapper) countFollowers(userID int64) (int64, error) {
+	num, err := d.SelectInt("SELECT COUNT(*) FROM followers WHERE user_id=$1", userID)
+	return num, errgo.Mask(err)
+}
+
+// creates the group with its owner as the first moderator
+func (d *defaultDataMapper) createGroup(group *group) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	group.SiteID = d.siteID
+	if err := tx.Insert(group); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := tx.Exec("INSERT INTO group_members (group_id, user_id, role, status, created_at) "+
+		"VALUES ($1, $2, $3, $4, $5)",
+		group.ID, group.OwnerID, groupRoleModerator, groupStatusActive, utcNow()); err != nil {
+		tx.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+func (d *defaultDataMapper) getGroup(groupID int64) (*group, error) {
+	group := &group{}
+	if err := d.SelectOne(group, "SELECT * FROM groups WHERE id=$1 AND "+d.inSite("site_id"), groupID); err != nil {
+		return group, errgo.Mask(err)
+	}
+	return group, nil
+}
+
+// counts active members and photos of groups
+const groupDetailSql = "SELECT g.*, " +
+	"(SELECT COUNT(*) FROM group_members m WHERE m.group_id = g.id AND m.status='active') AS num_members, " +
+	"(SELECT COUNT(*) FROM group_photos gp WHERE gp.group_id = g.id) AS num_photos " +
+	"FROM groups g "
+
+func (d *defaultDataMapper) getGroupDetail(groupID int64) (*groupDetail, error) {
+	group := &groupDetail{}
+	if err := d.SelectOne(group, groupDetailSql+"WHERE g.id=$1 AND "+d.inSite("g.site_id"), groupID); err != nil {
+		return group, errgo.Mask(err)
+	}
+	return group, nil
+}
+
+// returns the groups of the site, largest first
+func (d *defaultDataMapper) getGroups(page *page) (*groupList, error) {
+	var (
+		groups []groupDetail
+		total  int64
+		err    error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM groups WHERE " + d.inSite("site_id")); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&groups, groupDetailSql+"WHERE "+d.inSite("g.site_id")+
+		" ORDER BY num_members DESC, g.created_at DESC LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newGroupList(groups, total, page.index), nil
+}
+
+func (d *defaultDataMapper) isGroupNameAvailable(group *group) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(id) FROM groups WHERE UPPER(name)=UPPER($1) AND id != $2 AND "+
+		d.inSite("site_id"), group.Name, group.ID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num == 0, nil
+}
+
+func (d *defaultDataMapper) getGroupMember(groupID int64, userID int64) (*groupMember, error) {
+	member := &groupMember{}
+	if err := d.SelectOne(member, "SELECT * FROM group_members WHERE group_id=$1 AND user_id=$2",
+		groupID, userID); err != nil {
+		return member, errgo.Mask(err)
+	}
+	return member, nil
+}
+
+// adds the member, or updates the role and status of an existing member
+func (d *defaultDataMapper) saveGroupMember(member *groupMember) error {
+	if member.CreatedAt.IsZero() {
+		member.CreatedAt = utcNow()
+	}
+	_, err := d.Exec("INSERT INTO group_members (group_id, user_id, role, status, created_at) "+
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (group_id, user_id) "+
+		"DO UPDATE SET role=EXCLUDED.role, status=EXCLUDED.status",
+		member.GroupID, member.UserID, member.Role, member.Status, member.CreatedAt)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) removeGroupMember(groupID int64, userID int64) error {
+	result, err := d.Exec("DELETE FROM group_members WHERE group_id=$1 AND user_id=$2", groupID, userID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num == 0 {
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// returns the members of the group with the status, moderators first
+func (d *defaultDataMapper) getGroupMembers(groupID int64, status string) ([]groupMemberDetail, error) {
+	var members []groupMemberDetail
+	if _, err := d.Select(&members,
+		"SELECT m.*, u.name FROM group_members m JOIN users u ON u.id = m.user_id "+
+			"WHERE m.group_id=$1 AND m.status=$2 ORDER BY m.role='moderator' DESC, m.created_at",
+		groupID, status); err != nil {
+		return members, errgo.Mask(err)
+	}
+	return members, nil
+}
+
+func (d *defaultDataMapper) addGroupPhoto(groupID int64, photoID int64) error {
+	_, err := d.Exec("INSERT INTO group_photos (group_id, photo_id, created_at) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (group_id, photo_id) DO NOTHING", groupID, photoID, utcNow())
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) removeGroupPhoto(groupID int64, photoID int64) error {
+	result, err := d.Exec("DELETE FROM group_photos WHERE group_id=$1 AND photo_id=$2", groupID, photoID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num == 0 {
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// returns the photos cross-posted to the group, most recently posted first
+func (d *defaultDataMapper) getGroupPhotos(page *page, groupID int64, userID int64) (*photoList, error) {
+	var (
+		photos []photo
+		total  int64
+		err    error
+	)
+
+	where := "WHERE gp.group_id=$1 AND " + fmt.Sprintf(visibleSql, 2)
+
+	if total, err = d.SelectInt("SELECT COUNT(photos.id) FROM photos JOIN group_photos gp ON gp.photo_id = photos.id "+
+		where, groupID, userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT photos.* FROM photos JOIN group_photos gp ON gp.photo_id = photos.id "+where+
+			" ORDER BY gp.created_at DESC LIMIT $3 OFFSET $4",
+		groupID, userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+func (d *defaultDataMapper) createContest(contest *contest) error {
+	contest.SiteID = d.siteID
+	return errgo.Mask(d.Insert(contest))
+}
+
+// counts the photos entered in contests
+const contestDetailSql = "SELECT c.*, " +
+	"(SELECT COUNT(*) FROM photos p WHERE " + contestEntrySql + ") AS num_entries " +
+	"FROM contests c "
+
+// matches photos of the site tagged with the contest tag while entries are
+// open
+const contestOpenEntrySql = "p.site_id = c.site_id AND p.deleted_at IS NULL AND " +
+	"p.created_at >= c.starts_at AND p.created_at < c.entries_close_at AND " +
+	"EXISTS (SELECT 1 FROM photo_tags pt JOIN tags t ON t.id = pt.tag_id " +
+	"WHERE pt.photo_id = p.id AND UPPER(t.name) = UPPER(c.tag))"
+
+// matches the entries of the contest, as taken once entries closed
+const contestEntrySql = "p.deleted_at IS NULL AND CASE WHEN c.entries_taken_at IS NULL " +
+	"THEN " + contestOpenEntrySql + " ELSE EXISTS (SELECT 1 FROM contest_entries ce " +
+	"WHERE ce.contest_id = c.id AND ce.photo_id = p.id) END"
+
+func (d *defaultDataMapper) getContest(contestID int64) (*contestDetail, error) {
+	contest := &contestDetail{}
+	if err := d.SelectOne(contest, contestDetailSql+"WHERE c.id=$1 AND "+d.inSite("c.site_id"), contestID); err != nil {
+		return contest, errgo.Mask(err)
+	}
+	return contest, nil
+}
+
+// returns the contests of the site, latest first
+func (d *defaultDataMapper) getContests(page *page) (*contestList, error) {
+	var (
+		contests []contestDetail
+		total    int64
+		err      error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM contests WHERE " + d.inSite("site_id")); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&contests, contestDetailSql+"WHERE "+d.inSite("c.site_id")+
+		" ORDER BY c.starts_at DESC LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newContestList(contests, total, page.index), nil
+}
+
+// returns the entries of the contest, newest first. Once voting has closed
+// entries are ordered by their contest votes.
+func (d *defaultDataMapper) getContestEntries(page *page, contest *contest, userID int64) (*photoList, error) {
+	var (
+		photos []photo
+		total  int64
+		err    error
+	)
+
+	from := "FROM photos p JOIN contests c ON c.id=$1 WHERE " + contestEntrySql +
+		" AND " + fmt.Sprintf(visibleSql, 2)
+
+	if total, err = d.SelectInt("SELECT COUNT(p.id) "+from, contest.ID, userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	orderBy := "p.created_at DESC"
+	if contest.phase(time.Now()) == contestFinished {
+		orderBy = "(SELECT COUNT(*) FROM contest_votes cv WHERE cv.contest_id = c.id AND cv.photo_id = p.id) DESC, " + orderBy
+	}
+
+	if _, err = d.Select(&photos, "SELECT p.* "+from+" ORDER BY "+orderBy+" LIMIT $3 OFFSET $4",
+		contest.ID, userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+func (d *defaultDataMapper) isContestEntry(contest *contest, photoID int64) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(p.id) FROM photos p JOIN contests c ON c.id=$1 "+
+		"WHERE p.id=$2 AND "+contestEntrySql, contest.ID, photoID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// takes the entries of the contest once its entries have closed, so that
+// photos tagged or untagged later don't change the contest. Entries are
+// only taken once.
+func (d *defaultDataMapper) takeContestEntries(contest *contest) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	now := utcNow()
+	result, err := t.Exec("UPDATE contests SET entries_taken_at=$1 "+
+		"WHERE id=$2 AND entries_taken_at IS NULL AND entries_close_at <= $1", now, contest.ID)
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if num, err := result.RowsAffected(); err != nil || num == 0 {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("INSERT INTO contest_entries (contest_id, photo_id, entered_at) "+
+		"SELECT c.id, p.id, p.created_at FROM photos p JOIN contests c ON c.id=$1 "+
+		"WHERE "+contestOpenEntrySql, contest.ID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := t.Commit(); err != nil {
+		return errgo.Mask(err)
+	}
+	contest.EntriesTakenAt = &now
+	return nil
+}
+
+// records the vote of the user, returning false if the user has already
+// voted in the contest
+func (d *defaultDataMapper) voteInContest(contestID int64, userID int64, photoID int64) (bool, error) {
+	result, err := d.Exec("INSERT INTO contest_votes (contest_id, user_id, photo_id, created_at) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (contest_id, user_id) DO NOTHING",
+		contestID, userID, photoID, utcNow())
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// sets the winner to the entry with the most votes; ties go to the entry
+// which first received a vote
+func (d *defaultDataMapper) setContestWinner(contest *contest) error {
+	winnerID, err := d.SelectNullInt("SELECT cv.photo_id FROM contest_votes cv "+
+		"JOIN contest_entries ce ON ce.contest_id = cv.contest_id AND ce.photo_id = cv.photo_id "+
+		"WHERE cv.contest_id=$1 GROUP BY cv.photo_id ORDER BY COUNT(*) DESC, MIN(cv.created_at) LIMIT 1",
+		contest.ID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !winnerID.Valid {
+		return nil
+	}
+	if _, err := d.Exec("UPDATE contests SET winner_id=$1 WHERE id=$2 AND winner_id IS NULL",
+		winnerID.Int64, contest.ID); err != nil {
+		return errgo.Mask(err)
+	}
+	contest.WinnerID = &winnerID.Int64
+	return nil
+}
+
+func (d *defaultDataMapper) createChallenge(challenge *challenge) error {
+	challenge.SiteID = d.siteID
+	return errgo.Mask(d.Insert(challenge))
+}
+
+// counts the photos entered in challenges
+const challengeDetailSql = "SELECT c.*, " +
+	"(SELECT COUNT(*) FROM photos p WHERE " + challengeEntrySql + ") AS num_entries " +
+	"FROM challenges c "
+
+// matches photos of the site tagged with the challenge tag while it ran
+const challengeEntrySql = "p.site_id = c.site_id AND p.deleted_at IS NULL AND " +
+	"p.created_at >= c.starts_at AND p.created_at < c.ends_at AND " +
+	"EXISTS (SELECT 1 FROM photo_tags pt JOIN tags t ON t.id = pt.tag_id " +
+	"WHERE pt.photo_id = p.id AND UPPER(t.name) = UPPER(c.tag))"
+
+func (d *defaultDataMapper) getChallenge(challengeID int64) (*challengeDetail, error) {
+	challenge := &challengeDetail{}
+	if err := d.SelectOne(challenge, challengeDetailSql+"WHERE c.id=$1 AND "+d.inSite("c.site_id"), challengeID); err != nil {
+		return challenge, errgo.Mask(err)
+	}
+	return challenge, nil
+}
+
+// returns the challenge running at the time
+func (d *defaultDataMapper) getCurrentChallenge(now time.Time) (*challengeDetail, error) {
+	challenge := &challengeDetail{}
+	if err := d.SelectOne(challenge, challengeDetailSql+"WHERE c.starts_at <= $1 AND c.ends_at > $1 AND "+
+		d.inSite("c.site_id")+" ORDER BY c.starts_at DESC LIMIT 1", now); err != nil {
+		return challenge, errgo.Mask(err)
+	}
+	return challenge, nil
+}
+
+// returns the challenges of the site started at the time, the current one
+// first
+func (d *defaultDataMapper) getChallenges(page *page, now time.Time) (*challengeList, error) {
+	var (
+		challenges []challengeDetail
+		total      int64
+		err        error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM challenges WHERE starts_at <= $1 AND "+
+		d.inSite("site_id"), now); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&challenges, challengeDetailSql+"WHERE c.starts_at <= $1 AND "+d.inSite("c.site_id")+
+		" ORDER BY c.starts_at DESC LIMIT $2 OFFSET $3", now, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newChallengeList(challenges, total, page.index), nil
+}
+
+// returns the entries of the challenge, newest first
+func (d *defaultDataMapper) getChallengeEntries(page *page, challenge *challenge, userID int64) (*photoList, error) {
+	var (
+		photos []photo
+		total  int64
+		err    error
+	)
+
+	from := "FROM photos p JOIN challenges c ON c.id=$1 WHERE " + challengeEntrySql +
+		" AND " + fmt.Sprintf(visibleSql, 2)
+
+	if total, err = d.SelectInt("SELECT COUNT(p.id) "+from, challenge.ID, userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos, "SELECT p.* "+from+" ORDER BY p.created_at DESC LIMIT $3 OFFSET $4",
+		challenge.ID, userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+// checks if another challenge of the site runs at any time the challenge runs
+func (d *defaultDataMapper) isChallengeOverlapping(challenge *challenge) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(id) FROM challenges WHERE id <> $1 AND starts_at < $3 AND ends_at > $2 AND "+
+		d.inSite("site_id"), challenge.ID, challenge.StartsAt, challenge.EndsAt)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// returns the challenges started or ended at the time and not announced yet
+func (d *defaultDataMapper) getChallengesToAnnounce(now time.Time) ([]challenge, error) {
+	var challenges []challenge
+	if _, err := d.Select(&challenges, "SELECT * FROM challenges WHERE "+
+		"((start_announced_at IS NULL AND starts_at <= $1) OR (end_announced_at IS NULL AND ends_at <= $1)) AND "+
+		d.inSite("site_id")+" ORDER BY starts_at", now); err != nil {
+		return challenges, errgo.Mask(err)
+	}
+	return challenges, nil
+}
+
+func (d *defaultDataMapper) setChallengeAnnounced(challenge *challenge) error {
+	_, err := d.Exec("UPDATE challenges SET start_announced_at=$1, end_announced_at=$2 WHERE id=$3",
+		challenge.StartAnnouncedAt, challenge.EndAnnouncedAt, challenge.ID)
+	return errgo.Mask(err)
 }
@@ -2,7 +2,9 @@ package photoshare
 
 import (
 	"database/sql"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetIfNotNone(t *testing.T) {
@@ -11,7 +13,7 @@ func TestGetIfNotNone(t *testing.T) {
 	tdb := makeTestDB(cfg)
 	defer tdb.clean()
 
-	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
 
 	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
 
@@ -38,7 +40,7 @@ func TestGetIfNone(t *testing.T) {
 	tdb := makeTestDB(cfg)
 	defer tdb.clean()
 
-	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
 
 	_, err := datamapper.getPhoto(1)
 	if err != sql.ErrNoRows {
@@ -53,7 +55,7 @@ func TestSearchPhotos(t *testing.T) {
 	tdb := makeTestDB(cfg)
 	defer tdb.clean()
 
-	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
 
 	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
 	if err := datamapper.createUser(user); err != nil {
@@ -66,7 +68,7 @@ func TestSearchPhotos(t *testing.T) {
 		return
 	}
 
-	result, err := datamapper.searchPhotos(newPage(1), "test")
+	result, err := datamapper.searchPhotos(newPage(1), "test", 0)
 	if err != nil {
 		t.Error(err)
 		return
@@ -81,7 +83,7 @@ func TestAllPhotos(t *testing.T) {
 	tdb := makeTestDB(cfg)
 	defer tdb.clean()
 
-	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
 
 	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
 	if err := datamapper.createUser(user); err != nil {
@@ -94,7 +96,7 @@ func TestAllPhotos(t *testing.T) {
 		return
 	}
 
-	result, err := datamapper.getPhotos(newPage(1), "")
+	result, err := datamapper.getPhotos(newPage(1), newOrdering(orderNew, ""), 0)
 	if err != nil {
 		t.Error(err)
 		return
@@ -105,6 +107,246 @@ func TestAllPhotos(t *testing.T) {
 	}
 }
 
+func TestFeedPhotos(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
+
+	follower := &user{Name: "follower", Email: "follower@gmail.com", Password: "test"}
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	other := &user{Name: "other", Email: "other@gmail.com", Password: "test"}
+	for _, u := range []*user{follower, owner, other} {
+		if err := datamapper.createUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// followed by owner and tag, by tag only, and neither
+	for _, p := range []*photo{
+		{Title: "mine", OwnerID: owner.ID, Filename: "a.jpg", Tags: []string{"birds", "sea"}},
+		{Title: "tagged", OwnerID: other.ID, Filename: "b.jpg", Tags: []string{"sea"}},
+		{Title: "other", OwnerID: other.ID, Filename: "c.jpg", Tags: []string{"cats"}},
+	} {
+		if err := datamapper.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := datamapper.followUser(follower.ID, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"birds", "sea"} {
+		tag, err := datamapper.getTagDetail(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := datamapper.followTag(follower.ID, tag.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := datamapper.getFeedPhotos(newPage(1), newOrdering(orderNew, ""), follower.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 2 || result.Total != 2 {
+		t.Errorf("Expected each followed photo once, got %d of %d", len(result.Items), result.Total)
+	}
+
+	if err := datamapper.unfollowTag(follower.ID, "Sea"); err != nil {
+		t.Fatal(err)
+	}
+	follows, err := datamapper.getFollows(follower.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(follows.Users) != 1 || len(follows.Tags) != 1 || follows.Tags[0] != "birds" {
+		t.Errorf("Expected the owner and birds followed, got %+v", follows)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	voter := &user{Name: "voter", Email: "voter@gmail.com", Password: "test"}
+	for _, u := range []*user{owner, voter} {
+		if err := datamapper.createUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	photo := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := datamapper.recordVote(photo, voter, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*comment{
+		{PhotoID: photo.ID, AuthorID: voter.ID, Body: "Nice"},
+		{PhotoID: photo.ID, AuthorID: owner.ID, Body: "Thanks"},
+	} {
+		if err := datamapper.createComment(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := datamapper.getActivity(newPage(1), owner.ID, utcNow().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 2 || len(result.Items) != 2 {
+		t.Fatalf("Expected the vote and comment of the voter, got %+v", result.Items)
+	}
+	if result.Items[0].Type != "comment" || result.Items[0].Body != "Nice" || result.Items[1].Type != "upvote" {
+		t.Errorf("Expected the comment then the vote, got %+v", result.Items)
+	}
+
+	if err := datamapper.blockUser(owner.ID, voter.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := datamapper.getActivity(newPage(1), owner.ID, utcNow().Add(-time.Hour)); result.Total != 0 {
+		t.Errorf("Expected muted users to be left out, got %d", result.Total)
+	}
+}
+
+func TestBadges(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.createPhoto(&photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := datamapper.getUserStats(owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Photos != 1 || stats.Streak != 1 {
+		t.Errorf("Expected one photo uploaded today, got %+v", stats)
+	}
+
+	b := &badge{UserID: owner.ID, Name: "first_upload", AwardedAt: utcNow()}
+	if isNew, err := datamapper.awardBadge(b); err != nil || !isNew {
+		t.Fatalf("Expected the badge to be awarded, got %v %v", isNew, err)
+	}
+	if isNew, err := datamapper.awardBadge(b); err != nil || isNew {
+		t.Errorf("Expected the badge to be awarded once, got %v %v", isNew, err)
+	}
+	if badges, _ := datamapper.getBadges(owner.ID); len(badges) != 1 || badges[0].Name != "first_upload" {
+		t.Errorf("Expected the badge, got %+v", badges)
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	now := utcNow()
+	current := &challenge{OwnerID: owner.ID, Tag: "Birds", StartsAt: now.Add(-time.Hour), EndsAt: now.AddDate(0, 0, 7)}
+	if err := datamapper.createChallenge(current); err != nil {
+		t.Fatal(err)
+	}
+	next := &challenge{OwnerID: owner.ID, Tag: "trees", StartsAt: now.AddDate(0, 0, 6), EndsAt: now.AddDate(0, 0, 13)}
+	if overlaps, err := datamapper.isChallengeOverlapping(next); err != nil || !overlaps {
+		t.Errorf("Expected the challenges to overlap, got %v %v", overlaps, err)
+	}
+
+	for _, p := range []*photo{
+		{Title: "entry", OwnerID: owner.ID, Filename: "a.jpg", Tags: []string{"birds"}},
+		{Title: "other", OwnerID: owner.ID, Filename: "b.jpg", Tags: []string{"cats"}},
+	} {
+		if err := datamapper.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	detail, err := datamapper.getCurrentChallenge(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.ID != current.ID || detail.NumEntries != 1 {
+		t.Errorf("Expected the current challenge with one entry, got %+v", detail)
+	}
+	if result, _ := datamapper.getChallengeEntries(newPage(1), current, owner.ID); result.Total != 1 || result.Items[0].Title != "entry" {
+		t.Errorf("Expected the photo tagged with the challenge tag, got %+v", result)
+	}
+
+	toAnnounce, err := datamapper.getChallengesToAnnounce(now)
+	if err != nil || len(toAnnounce) != 1 {
+		t.Fatalf("Expected the start of the challenge to be announced, got %v %v", toAnnounce, err)
+	}
+	toAnnounce[0].StartAnnouncedAt = &now
+	if err := datamapper.setChallengeAnnounced(&toAnnounce[0]); err != nil {
+		t.Fatal(err)
+	}
+	if toAnnounce, _ := datamapper.getChallengesToAnnounce(now); len(toAnnounce) != 0 {
+		t.Errorf("Expected the challenge to be announced once, got %v", toAnnounce)
+	}
+}
+
+func TestHomepagePins(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	shown := &photo{Title: "shown", OwnerID: owner.ID, Filename: "a.jpg"}
+	later := &photo{Title: "later", OwnerID: owner.ID, Filename: "b.jpg"}
+	for _, p := range []*photo{shown, later} {
+		if err := datamapper.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := utcNow()
+	tomorrow := now.AddDate(0, 0, 1)
+	if err := datamapper.setHomepagePins([]homepagePin{
+		{PhotoID: &later.ID, StartsAt: &tomorrow},
+		{PhotoID: &shown.ID},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if pins, _ := datamapper.getHomepagePins(); len(pins) != 2 || *pins[0].PhotoID != later.ID {
+		t.Errorf("Expected the pins in order, got %+v", pins)
+	}
+	pins, err := datamapper.getActiveHomepagePins(now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || pins[0].Photo == nil || pins[0].Photo.Title != "shown" {
+		t.Errorf("Expected the pin shown now with its photo, got %+v", pins)
+	}
+}
+
 func TestCanEdit(t *testing.T) {
 	user := &user{ID: 1}
 	photo := &photo{ID: 1, OwnerID: 1}
@@ -143,3 +385,112 @@ func TestHasVoted(t *testing.T) {
 		t.Error("The user should have voted")
 	}
 }
+
+func TestEmailChange(t *testing.T) {
+	u := &user{Email: "tester@gmail.com"}
+	if !u.isEmailChangeExpired() {
+		t.Error("No email change has been requested")
+	}
+
+	if _, err := u.requestEmailChange("other@gmail.com"); err != nil {
+		t.Fatal(err)
+	}
+	if u.isEmailChangeExpired() {
+		t.Error("Email change should not have expired")
+	}
+
+	u.confirmEmailChange()
+	if u.Email != "other@gmail.com" {
+		t.Error("Email should have changed")
+	}
+	if u.EmailChangeCode.Valid {
+		t.Error("Email change code should be reset")
+	}
+}
+
+func TestReplicaFallback(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	// a replica that is down
+	replica, _ := sql.Open("postgres", "host=/nonexistent dbname=replica sslmode=disable")
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, replica, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := datamapper.getPhotos(newPage(1), newOrdering(orderNew, ""), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 {
+		t.Error("There should be 1 photo read from the primary")
+	}
+	if _, err := datamapper.getPhotoDetail(photo.ID, user); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFieldIndexes(t *testing.T) {
+	indexes := fieldIndexes(reflect.TypeOf(photoDetail{}))
+
+	for column, index := range map[string][]int{
+		"id":         {0, 0},
+		"photo":      {0, 5},
+		"owner_name": {1},
+	} {
+		if !reflect.DeepEqual(indexes[column], index) {
+			t.Errorf("Expected %s at %v, got %v", column, index, indexes[column])
+		}
+	}
+	if _, ok := indexes["tags"]; ok {
+		t.Error("Fields without a column should not be scanned")
+	}
+}
+
+// compares the photo queries run as prepared statements and as SQL text
+func BenchmarkPhotoQueries(b *testing.B) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, nil, false)
+	unprepared := &defaultDataMapper{DbMap: tdb.dbMap, siteID: defaultSiteID}
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := datamapper.createPhoto(&photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bm := range []struct {
+		name       string
+		datamapper dataMapper
+	}{{"unprepared", unprepared}, {"prepared", datamapper}} {
+		b.Run(bm.name+"/photos", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.datamapper.getPhotos(newPage(1), newOrdering(orderNew, ""), user.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bm.name+"/search", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.datamapper.searchPhotos(newPage(1), "test @tester", user.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
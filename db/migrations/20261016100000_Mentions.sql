@@ -0,0 +1,18 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE mentions (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    sender_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    created_at timestamp with time zone
+);
+
+CREATE INDEX idx_mentions_user_id ON mentions (user_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE mentions;
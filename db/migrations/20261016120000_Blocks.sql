@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE blocks (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    target_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    mute boolean NOT NULL DEFAULT false,
+    created_at timestamp with time zone,
+    PRIMARY KEY (user_id, target_id)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE blocks;
@@ -0,0 +1,27 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users
+	ADD COLUMN banned boolean NOT NULL DEFAULT false,
+	ADD COLUMN shadow_banned boolean NOT NULL DEFAULT false;
+
+CREATE TABLE audit_log (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL DEFAULT 0,
+    action text NOT NULL,
+    target_id integer NOT NULL DEFAULT 0,
+    details text,
+    created_at timestamp with time zone
+);
+
+CREATE INDEX idx_audit_log_created_at ON audit_log (created_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE audit_log;
+
+ALTER TABLE users
+	DROP COLUMN banned,
+	DROP COLUMN shadow_banned;
@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE sessions (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_key varchar(32) NOT NULL,
+    ip text,
+    user_agent text,
+    created_at timestamp with time zone,
+    last_seen_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX idx_sessions_session_key ON sessions (session_key);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE sessions;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users
+	ADD COLUMN new_email text NULL,
+	ADD COLUMN email_change_code VARCHAR(30) NULL,
+	ADD COLUMN email_change_expires timestamp with time zone NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users
+	DROP COLUMN new_email,
+	DROP COLUMN email_change_code,
+	DROP COLUMN email_change_expires;
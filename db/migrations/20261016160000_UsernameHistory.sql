@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users ADD COLUMN name_changed_at timestamp with time zone NULL;
+
+CREATE TABLE username_history (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    changed_at timestamp with time zone
+);
+
+CREATE INDEX idx_username_history_upper_name ON username_history (UPPER(name));
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE username_history;
+
+ALTER TABLE users DROP COLUMN name_changed_at;
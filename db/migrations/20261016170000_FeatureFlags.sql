@@ -0,0 +1,13 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE feature_flags (
+    name text PRIMARY KEY,
+    percentage integer NOT NULL DEFAULT 100 CHECK (percentage BETWEEN 0 AND 100)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE feature_flags;
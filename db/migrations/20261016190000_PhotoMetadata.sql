@@ -0,0 +1,14 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN taken_at timestamp with time zone;
+ALTER TABLE photos ADD COLUMN latitude double precision;
+ALTER TABLE photos ADD COLUMN longitude double precision;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN taken_at;
+ALTER TABLE photos DROP COLUMN latitude;
+ALTER TABLE photos DROP COLUMN longitude;
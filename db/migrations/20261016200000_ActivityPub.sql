@@ -0,0 +1,25 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE actor_keys (
+    user_id integer PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    private_key text NOT NULL,
+    public_key text NOT NULL,
+    created_at timestamp with time zone
+);
+
+CREATE TABLE followers (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    actor text NOT NULL,
+    inbox text NOT NULL,
+    created_at timestamp with time zone,
+    UNIQUE (user_id, actor)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE followers;
+DROP TABLE actor_keys;
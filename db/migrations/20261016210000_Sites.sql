@@ -0,0 +1,36 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE sites (
+    id serial PRIMARY KEY,
+    name text NOT NULL,
+    hostname text NOT NULL,
+    created_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX idx_sites_hostname ON sites (LOWER(hostname));
+
+-- existing users and photos belong to the default site, which serves any
+-- host name not matched by another site
+INSERT INTO sites (id, name, hostname, created_at) VALUES (1, 'Photoshare', '', now());
+SELECT setval('sites_id_seq', 1);
+
+ALTER TABLE users ADD COLUMN site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id);
+ALTER TABLE photos ADD COLUMN site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id);
+
+CREATE INDEX idx_photos_site_id ON photos (site_id);
+
+DROP INDEX idx_users_upper_name;
+CREATE UNIQUE INDEX idx_users_upper_name ON users (site_id, UPPER(name));
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_users_upper_name;
+CREATE UNIQUE INDEX idx_users_upper_name ON users (UPPER(name));
+
+ALTER TABLE photos DROP COLUMN site_id;
+ALTER TABLE users DROP COLUMN site_id;
+
+DROP TABLE sites;
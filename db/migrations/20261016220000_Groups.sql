@@ -0,0 +1,38 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE groups (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id),
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    requires_approval boolean NOT NULL DEFAULT false,
+    created_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX idx_groups_upper_name ON groups (site_id, UPPER(name));
+
+CREATE TABLE group_members (
+    group_id integer NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role text NOT NULL DEFAULT 'member',
+    status text NOT NULL DEFAULT 'active',
+    created_at timestamp with time zone,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE TABLE group_photos (
+    group_id integer NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    created_at timestamp with time zone,
+    PRIMARY KEY (group_id, photo_id)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE group_photos;
+DROP TABLE group_members;
+DROP TABLE groups;
@@ -0,0 +1,33 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE contests (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id),
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    tag text NOT NULL,
+    starts_at timestamp with time zone NOT NULL,
+    entries_close_at timestamp with time zone NOT NULL,
+    voting_close_at timestamp with time zone NOT NULL,
+    winner_id integer REFERENCES photos(id) ON DELETE SET NULL,
+    created_at timestamp with time zone
+);
+
+CREATE TABLE contest_votes (
+    contest_id integer NOT NULL REFERENCES contests(id) ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    created_at timestamp with time zone,
+    PRIMARY KEY (contest_id, user_id)
+);
+
+CREATE INDEX idx_contest_votes_photo ON contest_votes (contest_id, photo_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE contest_votes;
+DROP TABLE contests;
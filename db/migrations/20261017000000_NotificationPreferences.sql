@@ -0,0 +1,17 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE notification_preferences (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type text NOT NULL,
+    in_app boolean NOT NULL DEFAULT true,
+    email boolean NOT NULL DEFAULT false,
+    push boolean NOT NULL DEFAULT true,
+    PRIMARY KEY (user_id, type)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE notification_preferences;
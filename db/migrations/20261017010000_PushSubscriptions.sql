@@ -0,0 +1,19 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE push_subscriptions (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    endpoint text NOT NULL UNIQUE,
+    auth text NOT NULL,
+    p256dh text NOT NULL,
+    created_at timestamp with time zone
+);
+
+CREATE INDEX idx_push_subscriptions_user ON push_subscriptions (user_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE push_subscriptions;
@@ -0,0 +1,25 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE photo_votes (
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    value smallint NOT NULL CHECK (value IN (-1, 1)),
+    created_at timestamp with time zone,
+    PRIMARY KEY (photo_id, user_id)
+);
+
+-- votes cast before photo_votes existed were not recorded per user, so they
+-- are kept as a baseline the recorded votes are added to
+ALTER TABLE photos ADD COLUMN legacy_up_votes integer NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN legacy_down_votes integer NOT NULL DEFAULT 0;
+
+UPDATE photos SET legacy_up_votes = up_votes, legacy_down_votes = down_votes;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN legacy_down_votes;
+ALTER TABLE photos DROP COLUMN legacy_up_votes;
+DROP TABLE photo_votes;
@@ -0,0 +1,13 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN staff_picked_at timestamp with time zone;
+
+CREATE INDEX photos_staff_picked_at_idx ON photos (staff_picked_at) WHERE staff_picked_at IS NOT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX photos_staff_picked_at_idx;
+ALTER TABLE photos DROP COLUMN staff_picked_at;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- tags are shared by all sites, so each site describes them separately
+CREATE TABLE tag_details (
+    tag_id integer NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    description text NOT NULL DEFAULT '',
+    PRIMARY KEY (tag_id, site_id)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE tag_details;
@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE tag_details ADD COLUMN cover_photo_id integer REFERENCES photos(id) ON DELETE SET NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE tag_details DROP COLUMN cover_photo_id;
@@ -0,0 +1,17 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN camera text NOT NULL DEFAULT '';
+ALTER TABLE photos ADD COLUMN lens text NOT NULL DEFAULT '';
+
+CREATE INDEX photos_camera_idx ON photos (site_id, camera) WHERE camera <> '';
+CREATE INDEX photos_lens_idx ON photos (site_id, lens) WHERE lens <> '';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX photos_lens_idx;
+DROP INDEX photos_camera_idx;
+ALTER TABLE photos DROP COLUMN lens;
+ALTER TABLE photos DROP COLUMN camera;
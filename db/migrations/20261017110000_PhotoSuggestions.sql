@@ -0,0 +1,17 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- tags (space separated) and alt text suggested by the labeler, until the
+-- owner accepts or dismisses them
+CREATE TABLE photo_suggestions (
+    photo_id integer PRIMARY KEY REFERENCES photos(id) ON DELETE CASCADE,
+    tags text NOT NULL DEFAULT '',
+    alt_text text NOT NULL DEFAULT '',
+    created_at timestamp with time zone NOT NULL
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE photo_suggestions;
@@ -0,0 +1,15 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN spam_score integer NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN held_at timestamp with time zone;
+
+CREATE INDEX photos_held_at_idx ON photos (held_at) WHERE held_at IS NOT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX photos_held_at_idx;
+ALTER TABLE photos DROP COLUMN held_at;
+ALTER TABLE photos DROP COLUMN spam_score;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE blocked_words (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    word text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    UNIQUE (site_id, word)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE blocked_words;
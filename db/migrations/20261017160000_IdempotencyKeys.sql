@@ -0,0 +1,22 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- responses stored for the Idempotency-Key of a request, replayed to retries;
+-- status is 0 while the first request is in progress
+CREATE TABLE idempotency_keys (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key text NOT NULL,
+    fingerprint text NOT NULL,
+    status integer NOT NULL DEFAULT 0,
+    content_type text NOT NULL DEFAULT '',
+    body bytea,
+    created_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys (created_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE idempotency_keys;
@@ -0,0 +1,19 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users ADD COLUMN last_active_at timestamp with time zone NOT NULL DEFAULT now();
+ALTER TABLE users ADD COLUMN inactivity_warned_at timestamp with time zone;
+ALTER TABLE users ADD COLUMN retention_exempt boolean NOT NULL DEFAULT false;
+
+-- users last seen before sessions were recorded count as active now
+UPDATE users u SET last_active_at = COALESCE(GREATEST(u.created_at,
+    (SELECT MAX(s.last_seen_at) FROM sessions s WHERE s.user_id = u.id)), now());
+
+CREATE INDEX idx_users_last_active_at ON users (last_active_at) WHERE active;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users DROP COLUMN retention_exempt;
+ALTER TABLE users DROP COLUMN inactivity_warned_at;
+ALTER TABLE users DROP COLUMN last_active_at;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- photos deleted by their owner stay in the trash for a while, restorable
+ALTER TABLE photos ADD COLUMN deleted_at timestamp with time zone;
+
+CREATE INDEX idx_photos_deleted_at ON photos (owner_id, deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN deleted_at;
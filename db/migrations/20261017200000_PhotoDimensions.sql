@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- size of the original in pixels, and its resolution in dots per inch if
+-- the file gives one; 0 until read, see extract-dimensions
+ALTER TABLE photos ADD COLUMN width integer NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN height integer NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN dpi integer NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN dpi;
+ALTER TABLE photos DROP COLUMN height;
+ALTER TABLE photos DROP COLUMN width;
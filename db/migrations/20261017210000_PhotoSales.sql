@@ -0,0 +1,31 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- price in cents of photos for sale, and the license granted to buyers
+ALTER TABLE photos ADD COLUMN price bigint;
+ALTER TABLE photos ADD COLUMN license text NOT NULL DEFAULT '';
+
+-- purchases are made with a checkout of the provider, and entitle the buyer
+-- to the original once paid
+CREATE TABLE purchases (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    buyer_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount bigint NOT NULL,
+    currency text NOT NULL,
+    license text NOT NULL DEFAULT '',
+    checkout_id text NOT NULL UNIQUE,
+    created_at timestamp with time zone NOT NULL,
+    paid_at timestamp with time zone
+);
+
+CREATE INDEX idx_purchases_buyer_id ON purchases (buyer_id, photo_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE purchases;
+
+ALTER TABLE photos DROP COLUMN license;
+ALTER TABLE photos DROP COLUMN price;
@@ -0,0 +1,28 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- albums of the portfolio of a user, in the order the owner arranged them
+CREATE TABLE portfolio_albums (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title text NOT NULL,
+    cover_photo_id integer REFERENCES photos(id) ON DELETE SET NULL,
+    position integer NOT NULL,
+    created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX idx_portfolio_albums_owner_id ON portfolio_albums (owner_id, position);
+
+CREATE TABLE portfolio_album_photos (
+    album_id integer NOT NULL REFERENCES portfolio_albums(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    position integer NOT NULL,
+    PRIMARY KEY (album_id, photo_id)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE portfolio_album_photos;
+DROP TABLE portfolio_albums;
@@ -0,0 +1,32 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users ADD COLUMN slug text NULL;
+
+CREATE UNIQUE INDEX idx_users_slug ON users (site_id, slug);
+
+-- deferred, so albums may swap slugs when the portfolio is arranged
+ALTER TABLE portfolio_albums ADD COLUMN slug text NULL;
+ALTER TABLE portfolio_albums ADD CONSTRAINT portfolio_albums_owner_slug UNIQUE (owner_id, slug) DEFERRABLE INITIALLY DEFERRED;
+
+-- previous slugs of users, and of their albums, so old links redirect
+CREATE TABLE slug_history (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    album_id integer NULL REFERENCES portfolio_albums(id) ON DELETE CASCADE,
+    slug text NOT NULL,
+    changed_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX idx_slug_history_slug ON slug_history (slug);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE slug_history;
+
+ALTER TABLE portfolio_albums DROP CONSTRAINT portfolio_albums_owner_slug;
+ALTER TABLE portfolio_albums DROP COLUMN slug;
+
+DROP INDEX idx_users_slug;
+ALTER TABLE users DROP COLUMN slug;
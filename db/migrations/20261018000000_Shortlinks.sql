@@ -0,0 +1,16 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- short codes of photos for /p/{code}, with the number of times followed
+CREATE TABLE shortlinks (
+    code text PRIMARY KEY,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL UNIQUE REFERENCES photos(id) ON DELETE CASCADE,
+    clicks bigint NOT NULL DEFAULT 0,
+    created_at timestamp with time zone NOT NULL
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE shortlinks;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- sessions of admins acting as the user, which end at expires_at
+ALTER TABLE sessions ADD COLUMN impersonator_id integer NULL REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE sessions ADD COLUMN expires_at timestamp with time zone NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE sessions DROP COLUMN expires_at;
+ALTER TABLE sessions DROP COLUMN impersonator_id;
@@ -0,0 +1,52 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- photos reported by users, open until an admin upholds or dismisses them
+CREATE TABLE reports (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reporter_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reason text NOT NULL,
+    status text NOT NULL DEFAULT 'open',
+    created_at timestamp with time zone NOT NULL,
+    resolved_at timestamp with time zone NULL,
+    UNIQUE (photo_id, reporter_id)
+);
+
+CREATE INDEX idx_reports_status ON reports (site_id, status, created_at);
+
+-- strikes from upheld reports, and the end of any suspension they brought
+ALTER TABLE users ADD COLUMN strikes integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN suspended_until timestamp with time zone NULL;
+
+-- notes of admins about users
+CREATE TABLE moderation_notes (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    author_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    note text NOT NULL,
+    created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX idx_moderation_notes_user_id ON moderation_notes (user_id, created_at);
+
+-- days a user is suspended for on reaching a number of strikes
+CREATE TABLE strike_thresholds (
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    strikes integer NOT NULL,
+    suspension_days integer NOT NULL,
+    PRIMARY KEY (site_id, strikes)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE strike_thresholds;
+DROP TABLE moderation_notes;
+
+ALTER TABLE users DROP COLUMN suspended_until;
+ALTER TABLE users DROP COLUMN strikes;
+
+DROP TABLE reports;
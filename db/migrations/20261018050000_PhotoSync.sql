@@ -0,0 +1,46 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN updated_at timestamp with time zone NOT NULL DEFAULT now();
+CREATE INDEX photos_updated_at_idx ON photos (site_id, updated_at);
+
+CREATE TABLE photo_deletions (
+    photo_id integer NOT NULL,
+    site_id integer NOT NULL,
+    deleted_at timestamp with time zone NOT NULL
+);
+CREATE INDEX photo_deletions_deleted_at_idx ON photo_deletions (site_id, deleted_at);
+
+-- every change of a photo, whichever query makes it, is seen by the sync;
+-- clock_timestamp() rather than now() orders the changes of one transaction
+
+-- +goose StatementBegin
+CREATE FUNCTION photos_touch() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+NEW.updated_at := clock_timestamp();
+RETURN NEW;
+END$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION photos_record_deletion() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+INSERT INTO photo_deletions (photo_id, site_id, deleted_at) VALUES (OLD.id, OLD.site_id, clock_timestamp());
+RETURN OLD;
+END$$;
+-- +goose StatementEnd
+
+CREATE TRIGGER photos_touch BEFORE UPDATE ON photos FOR EACH ROW EXECUTE PROCEDURE photos_touch();
+CREATE TRIGGER photos_record_deletion AFTER DELETE ON photos FOR EACH ROW EXECUTE PROCEDURE photos_record_deletion();
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TRIGGER photos_record_deletion ON photos;
+DROP TRIGGER photos_touch ON photos;
+DROP FUNCTION photos_record_deletion();
+DROP FUNCTION photos_touch();
+DROP TABLE photo_deletions;
+ALTER TABLE photos DROP COLUMN updated_at;
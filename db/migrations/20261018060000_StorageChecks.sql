@@ -0,0 +1,38 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- SHA-256 of the uploaded file; photos uploaded before have theirs recorded
+-- by their first check
+ALTER TABLE photos ADD COLUMN checksum text NOT NULL DEFAULT '';
+
+-- the last check of the file of each photo, kept apart from photos so that
+-- checks are not seen by the sync
+CREATE TABLE storage_checks (
+    photo_id integer PRIMARY KEY REFERENCES photos(id) ON DELETE CASCADE,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    checked_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX idx_storage_checks_checked_at ON storage_checks (site_id, checked_at);
+
+-- files found missing or changed, open until a later check passes
+CREATE TABLE storage_corruptions (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    problem text NOT NULL,
+    detected_at timestamp with time zone NOT NULL,
+    resolved_at timestamp with time zone NULL,
+    repaired boolean NOT NULL DEFAULT false
+);
+
+CREATE UNIQUE INDEX idx_storage_corruptions_open ON storage_corruptions (photo_id) WHERE resolved_at IS NULL;
+CREATE INDEX idx_storage_corruptions_detected_at ON storage_corruptions (site_id, detected_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE storage_corruptions;
+DROP TABLE storage_checks;
+
+ALTER TABLE photos DROP COLUMN checksum;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE user_follows (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    target_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp with time zone,
+    PRIMARY KEY (user_id, target_id)
+);
+
+CREATE TABLE tag_follows (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    tag_id integer NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    created_at timestamp with time zone,
+    PRIMARY KEY (user_id, tag_id)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE tag_follows;
+DROP TABLE user_follows;
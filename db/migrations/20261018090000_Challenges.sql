@@ -0,0 +1,23 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE challenges (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id),
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    tag text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    starts_at timestamp with time zone NOT NULL,
+    ends_at timestamp with time zone NOT NULL,
+    start_announced_at timestamp with time zone,
+    end_announced_at timestamp with time zone,
+    created_at timestamp with time zone
+);
+
+CREATE INDEX idx_challenges_site_starts_at ON challenges (site_id, starts_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE challenges;
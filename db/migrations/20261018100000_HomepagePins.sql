@@ -0,0 +1,22 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE homepage_pins (
+    id serial PRIMARY KEY,
+    site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id),
+    photo_id integer REFERENCES photos(id) ON DELETE CASCADE,
+    album_id integer REFERENCES portfolio_albums(id) ON DELETE CASCADE,
+    position integer NOT NULL DEFAULT 0,
+    starts_at timestamp with time zone,
+    ends_at timestamp with time zone,
+    created_at timestamp with time zone,
+    CHECK ((photo_id IS NULL) <> (album_id IS NULL))
+);
+
+CREATE INDEX idx_homepage_pins_site ON homepage_pins (site_id, position);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE homepage_pins;
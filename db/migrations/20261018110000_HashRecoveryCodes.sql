@@ -0,0 +1,17 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- recovery codes are stored as the hex SHA-256 of the code emailed
+ALTER TABLE users ALTER COLUMN recovery_code TYPE text;
+
+UPDATE users SET recovery_code = encode(sha256(convert_to(recovery_code, 'UTF8')), 'hex')
+WHERE recovery_code IS NOT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+-- the codes can't be recovered from their hashes, so users ask for new ones
+UPDATE users SET recovery_code = NULL;
+
+ALTER TABLE users ALTER COLUMN recovery_code TYPE VARCHAR(30);
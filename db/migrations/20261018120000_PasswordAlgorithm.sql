@@ -0,0 +1,11 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- algorithm of the password hash: the hashes so far are bcrypt, replaced by
+-- argon2id as their users log in
+ALTER TABLE users ADD COLUMN password_algorithm text NOT NULL DEFAULT 'bcrypt';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users DROP COLUMN password_algorithm;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- id of the pepper of the password hash, see passwords.go; hashes so far
+-- are without a pepper
+ALTER TABLE users ADD COLUMN password_pepper text NOT NULL DEFAULT '';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users DROP COLUMN password_pepper;
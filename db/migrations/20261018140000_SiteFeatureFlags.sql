@@ -0,0 +1,18 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- flags are set for each site; those set so far applied to every site
+ALTER TABLE feature_flags ADD COLUMN site_id integer NOT NULL DEFAULT 1 REFERENCES sites(id);
+ALTER TABLE feature_flags DROP CONSTRAINT feature_flags_pkey;
+ALTER TABLE feature_flags ADD PRIMARY KEY (site_id, name);
+
+INSERT INTO feature_flags (site_id, name, percentage)
+    SELECT s.id, f.name, f.percentage FROM sites s, feature_flags f WHERE s.id <> f.site_id;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DELETE FROM feature_flags WHERE site_id <> 1;
+ALTER TABLE feature_flags DROP CONSTRAINT feature_flags_pkey;
+ALTER TABLE feature_flags DROP COLUMN site_id;
+ALTER TABLE feature_flags ADD PRIMARY KEY (name);
@@ -0,0 +1,28 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- the entries of a contest, taken when its entries close
+CREATE TABLE contest_entries (
+    contest_id integer NOT NULL REFERENCES contests(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    entered_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (contest_id, photo_id)
+);
+
+ALTER TABLE contests ADD COLUMN entries_taken_at timestamp with time zone;
+
+-- entries of contests closed so far are taken as they are now
+INSERT INTO contest_entries (contest_id, photo_id, entered_at)
+    SELECT c.id, p.id, p.created_at FROM contests c JOIN photos p ON p.site_id = c.site_id
+    WHERE c.entries_close_at <= now() AND p.deleted_at IS NULL AND
+    p.created_at >= c.starts_at AND p.created_at < c.entries_close_at AND
+    EXISTS (SELECT 1 FROM photo_tags pt JOIN tags t ON t.id = pt.tag_id
+    WHERE pt.photo_id = p.id AND UPPER(t.name) = UPPER(c.tag));
+
+UPDATE contests SET entries_taken_at = now() WHERE entries_close_at <= now();
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE contests DROP COLUMN entries_taken_at;
+DROP TABLE contest_entries;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- the OpenID Connect account of a user, by issuer and subject, and the one
+-- waiting for the owner of an existing account with its email to link it
+ALTER TABLE users ADD COLUMN oidc_subject text;
+ALTER TABLE users ADD COLUMN oidc_link_subject text;
+ALTER TABLE users ADD COLUMN oidc_link_code text;
+ALTER TABLE users ADD COLUMN oidc_link_expires timestamp with time zone;
+
+CREATE UNIQUE INDEX idx_users_oidc_subject ON users (site_id, oidc_subject);
+CREATE INDEX idx_users_oidc_link_code ON users (oidc_link_code);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_users_oidc_link_code;
+DROP INDEX idx_users_oidc_subject;
+ALTER TABLE users DROP COLUMN oidc_link_expires;
+ALTER TABLE users DROP COLUMN oidc_link_code;
+ALTER TABLE users DROP COLUMN oidc_link_subject;
+ALTER TABLE users DROP COLUMN oidc_subject;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- follows have no photo, and federated followers are actors rather than users
+ALTER TABLE notifications ALTER COLUMN photo_id DROP NOT NULL;
+ALTER TABLE notifications ALTER COLUMN sender_id DROP NOT NULL;
+ALTER TABLE notifications ADD COLUMN actor text NOT NULL DEFAULT '';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DELETE FROM notifications WHERE photo_id IS NULL OR sender_id IS NULL;
+ALTER TABLE notifications DROP COLUMN actor;
+ALTER TABLE notifications ALTER COLUMN sender_id SET NOT NULL;
+ALTER TABLE notifications ALTER COLUMN photo_id SET NOT NULL;
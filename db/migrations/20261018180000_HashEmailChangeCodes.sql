@@ -0,0 +1,19 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- email change codes are stored as the hex SHA-256 of the code emailed
+ALTER TABLE users ALTER COLUMN email_change_code TYPE text;
+UPDATE users SET email_change_code = encode(sha256(convert_to(email_change_code, 'UTF8')), 'hex')
+WHERE email_change_code IS NOT NULL;
+
+-- users of a directory or single sign-on provider, whose password is random
+ALTER TABLE users ADD COLUMN random_password boolean NOT NULL DEFAULT false;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users DROP COLUMN random_password;
+
+-- the codes can't be recovered from their hashes, so users ask again
+UPDATE users SET new_email = NULL, email_change_code = NULL, email_change_expires = NULL;
+ALTER TABLE users ALTER COLUMN email_change_code TYPE VARCHAR(30);
@@ -0,0 +1,165 @@
+package photoshare
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Search results and group photos are downloaded as a ZIP of the originals,
+// written to the response as each file is read so that neither the archive
+// nor a photo is held in memory; a slow client slows the reads. Only photos
+// the user may see are included, scaled down to PUBLIC_MAX_SIZE if set. Downloads of more than MAX_DOWNLOAD_PHOTOS
+// photos are refused, and photos after the first MAX_DOWNLOAD_SIZE bytes
+// are left out with a note in the archive.
+
+const downloadNoteName = "MISSING.txt"
+
+var (
+	errTooManyDownloadPhotos = httpError{http.StatusRequestEntityTooLarge, "Too many photos to download"}
+	unsafeFilenameRegex      = regexp.MustCompile(`[^\w\-]+`)
+)
+
+// returns the name of the photo in the ZIP, e.g. "12-heron-at-dawn.jpg"
+func downloadFilename(p *photo) string {
+	title := strings.Trim(unsafeFilenameRegex.ReplaceAllString(strings.ToLower(p.Title), "-"), "-")
+	if len(title) > 50 {
+		title = strings.TrimRight(title[:50], "-")
+	}
+	if title == "" {
+		return fmt.Sprintf("%d%s", p.ID, path.Ext(p.Filename))
+	}
+	return fmt.Sprintf("%d-%s%s", p.ID, title, path.Ext(p.Filename))
+}
+
+// counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// streams the photos as a ZIP named name.zip. Errors after the response is
+// started can only be logged, and end the archive early.
+func writePhotoZip(ctx *context, w http.ResponseWriter, name string, photos []photo) error {
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+	w.WriteHeader(http.StatusOK)
+
+	cw := &countingWriter{w: w}
+	zw := zip.NewWriter(cw)
+
+	var missing []string
+
+	for i := range photos {
+		p := &photos[i]
+
+		if cw.n >= ctx.cfg.MaxDownloadSize {
+			missing = append(missing, downloadFilename(p))
+			continue
+		}
+
+		src, err := ctx.filestore.open(p.Filename)
+		if err != nil {
+			logError(err)
+			missing = append(missing, downloadFilename(p))
+			continue
+		}
+
+		// images are already compressed
+		dst, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     downloadFilename(p),
+			Method:   zip.Store,
+			Modified: p.CreatedAt,
+		})
+		if err == nil {
+			err = copyPublicImage(ctx, dst, p, src)
+		}
+		if err == nil {
+			err = zw.Flush()
+		}
+		src.Close()
+		if err != nil {
+			log.Printf("Download %s stopped: %s", name, err)
+			return nil
+		}
+	}
+
+	if len(missing) > 0 {
+		note, err := zw.Create(downloadNoteName)
+		if err == nil {
+			_, err = fmt.Fprintf(note, "These photos were left out, download them separately:\r\n\r\n%s\r\n",
+				strings.Join(missing, "\r\n"))
+		}
+		if err != nil {
+			logError(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Printf("Download %s stopped: %s", name, err)
+	}
+	return nil
+}
+
+// returns every photo of the list, or an error if there are too many to
+// download
+func getDownloadPhotos(ctx *context, getPhotos func(*page) (*photoList, error)) ([]photo, error) {
+	max := int64(ctx.cfg.MaxDownloadPhotos)
+	photos, err := getPhotos(&page{index: 1, offset: 0, size: max})
+	if err != nil {
+		return nil, err
+	}
+	if photos.Total > max {
+		return nil, errTooManyDownloadPhotos
+	}
+	return photos.Items, nil
+}
+
+func downloadSearch(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	q := r.FormValue("q")
+	userID := ctx.userID()
+
+	photos, err := getDownloadPhotos(ctx, func(page *page) (*photoList, error) {
+		return ctx.datamapper.searchPhotos(page, q, userID)
+	})
+	if err != nil {
+		return err
+	}
+
+	name := strings.Trim(unsafeFilenameRegex.ReplaceAllString(strings.ToLower(q), "-"), "-")
+	if name == "" {
+		name = "photos"
+	}
+	return writePhotoZip(ctx, w, name, photos)
+}
+
+func downloadGroup(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	userID := ctx.userID()
+
+	photos, err := getDownloadPhotos(ctx, func(page *page) (*photoList, error) {
+		return ctx.datamapper.getGroupPhotos(page, group.ID, userID)
+	})
+	if err != nil {
+		return err
+	}
+	return writePhotoZip(ctx, w, fmt.Sprintf("group-%d", group.ID), photos)
+}
@@ -0,0 +1,104 @@
+package photoshare
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDownloadFilename(t *testing.T) {
+	for title, expected := range map[string]string{
+		"Heron at dawn!": "12-heron-at-dawn.jpg",
+		"   ":            "12.jpg",
+		"Café":           "12-caf.jpg",
+	} {
+		if name := downloadFilename(&photo{ID: 12, Title: title, Filename: "abc.jpg"}); name != expected {
+			t.Errorf("%q: expected %s, got %s", title, expected, name)
+		}
+	}
+}
+
+func TestDownloadSearch(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.MaxDownloadPhotos = 10
+	app.cfg.MaxDownloadSize = 1 << 20
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*photo{
+		{Title: "heron", Filename: "a.jpg", OwnerID: owner.ID},
+		{Title: "heron at dusk", Filename: "b.jpg", OwnerID: owner.ID},
+		{Title: "private heron", Filename: "c.jpg", OwnerID: owner.ID, Private: true},
+		{Title: "swan", Filename: "d.jpg", OwnerID: owner.ID},
+	} {
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		app.filestore.store(strings.NewReader("image "+p.Filename), p.Filename, "image/jpeg")
+	}
+
+	download := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/api/photos/search/download?q=heron", nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	readZip := func(res *httptest.ResponseRecorder) map[string]string {
+		zr, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]string)
+		for _, f := range zr.File {
+			r, _ := f.Open()
+			body, _ := ioutil.ReadAll(r)
+			r.Close()
+			files[f.Name] = string(body)
+		}
+		return files
+	}
+
+	res := download()
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Content-Disposition") != `attachment; filename="heron.zip"` {
+		t.Errorf("Unexpected Content-Disposition %s", res.Header().Get("Content-Disposition"))
+	}
+	files := readZip(res)
+	expected := map[string]string{
+		"2-heron.jpg":         "image a.jpg",
+		"3-heron-at-dusk.jpg": "image b.jpg",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected only the visible results, got %v", files)
+	}
+
+	// photos past the size cap are listed in a note
+	app.cfg.MaxDownloadSize = 1
+	files = readZip(download())
+	if _, ok := files["2-heron.jpg"]; !ok {
+		t.Error("First photo should be included")
+	}
+	if _, ok := files["3-heron-at-dusk.jpg"]; ok {
+		t.Error("Photo past the size cap should be left out")
+	}
+	if !strings.Contains(files[downloadNoteName], "3-heron-at-dusk.jpg") {
+		t.Errorf("Left out photo should be noted, got %q", files[downloadNoteName])
+	}
+
+	app.cfg.MaxDownloadPhotos = 1
+	if res := download(); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", res.Code)
+	}
+}
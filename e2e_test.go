@@ -0,0 +1,210 @@
+//go:build e2e
+// +build e2e
+
+package photoshare
+
+// End-to-end tests run the API against a real PostgreSQL database, migrated
+// from db/migrations. Run with "make test-e2e", which starts the database
+// in docker.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+)
+
+type testServer struct {
+	*httptest.Server
+	app *app
+	t   *testing.T
+}
+
+// migrates and empties the test database, and starts a server with the real
+// data mapper and session manager. Uploads are stored in memory.
+func newTestServer(t *testing.T) *testServer {
+
+	cfg, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := dbConnect(cfg.TestDBUser, cfg.TestDBPassword, cfg.TestDBName, cfg.TestDBHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrate(db, "db/migrations", false); err != nil {
+		t.Fatal(err)
+	}
+
+	datamapper, err := newDataMapper(db, nil, cfg.LogSql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range testTables {
+		if _, err := db.Exec("DELETE FROM " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := newTestApp(datamapper)
+	app.cfg = cfg
+	app.db = db
+
+	if app.session, err = newSessionManager(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if app.features, err = newFeatureFlags(cfg, datamapper); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testServer{httptest.NewServer(app.router), app, t}
+}
+
+func (s *testServer) close() {
+	s.Close()
+	s.app.close()
+}
+
+// sends a request, with the auth token if given
+func (s *testServer) request(method, path, token, contentType string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return res
+}
+
+func (s *testServer) requestJSON(method, path, token string, value interface{}) *http.Response {
+	var body io.Reader
+	if value != nil {
+		b, err := json.Marshal(value)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	return s.request(method, path, token, "application/json", body)
+}
+
+func (s *testServer) expect(res *http.Response, status int, value interface{}) {
+	defer res.Body.Close()
+	if res.StatusCode != status {
+		b, _ := ioutil.ReadAll(res.Body)
+		s.t.Fatalf("%s %s: expected %d, got %d: %s", res.Request.Method, res.Request.URL.Path, status, res.StatusCode, b)
+	}
+	if value != nil {
+		if err := json.NewDecoder(res.Body).Decode(value); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+// signs up a new user, returning the auth token
+func (s *testServer) signup(name string) string {
+	res := s.requestJSON("POST", "/api/auth/signup", "", map[string]string{
+		"name":     name,
+		"email":    name + "@localhost",
+		"password": "password",
+	})
+	s.expect(res, http.StatusCreated, nil)
+	return res.Header.Get(tokenHeader)
+}
+
+// uploads a photo, returning the new photo
+func (s *testServer) upload(token, title, tags string) *photo {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("title", title)
+	form.WriteField("taglist", tags)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="photo"; filename="photo.png"`)
+	h.Set("Content-Type", "image/png")
+	part, _ := form.CreatePart(h)
+	part.Write([]byte("png"))
+	form.Close()
+
+	p := &photo{}
+	s.expect(s.request("POST", "/api/photos/", token, form.FormDataContentType(), body), http.StatusCreated, p)
+	return p
+}
+
+func TestE2ESearch(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	token := s.signup("owner")
+	s.upload(token, "sunset over the sea", "beach summer")
+	s.upload(token, "mountains", "winter")
+
+	for _, tc := range []struct {
+		q     string
+		total int64
+	}{
+		{"sunset", 1},
+		{"%23winter", 1},
+		{"%40owner", 2},
+		{"sunset%20%23winter", 0},
+		{"nothing", 0},
+	} {
+		result := &photoList{}
+		s.expect(s.request("GET", "/api/photos/search?q="+tc.q, "", "", nil), http.StatusOK, result)
+		if result.Total != tc.total {
+			t.Errorf("Search %s: expected %d, got %d", tc.q, tc.total, result.Total)
+		}
+	}
+}
+
+func TestE2EVoting(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	owner := s.signup("owner")
+	voter := s.signup("voter")
+
+	p := s.upload(owner, "test", "")
+	path := fmt.Sprintf("/api/photos/%d/upvote", p.ID)
+
+	s.expect(s.request("PATCH", path, "", "", nil), http.StatusUnauthorized, nil)
+	s.expect(s.request("PATCH", path, owner, "", nil), http.StatusForbidden, nil)
+	s.expect(s.request("PATCH", path, voter, "", nil), http.StatusOK, nil)
+	s.expect(s.request("PATCH", path, voter, "", nil), http.StatusForbidden, nil)
+
+	detail := &photoDetail{}
+	s.expect(s.request("GET", fmt.Sprintf("/api/photos/%d", p.ID), voter, "", nil), http.StatusOK, detail)
+	if detail.UpVotes != 1 || detail.Score != 1 {
+		t.Errorf("Expected 1 up vote and score 1, got %d and %d", detail.UpVotes, detail.Score)
+	}
+	if detail.Permissions.Vote {
+		t.Error("Voter should not be able to vote again")
+	}
+
+	// drifted counts are recomputed from the recorded votes
+	if _, err := s.app.db.Exec("UPDATE photos SET up_votes=5, down_votes=2 WHERE id=$1", p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if num, err := s.app.datamapper.recomputeScores(); err != nil || num != 1 {
+		t.Fatalf("Expected 1 photo recomputed, got %d (%v)", num, err)
+	}
+	if p, _ := s.app.datamapper.getPhoto(p.ID); p.UpVotes != 1 || p.DownVotes != 0 {
+		t.Errorf("Expected 1 up vote and no down votes, got %d and %d", p.UpVotes, p.DownVotes)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"net/http"
 	"net/smtp"
-	"path"
 	"strings"
 	"text/template"
 )
@@ -31,6 +30,7 @@ func (msg *message) String() string {
 type mailer struct {
 	sender             mailSender
 	cfg                *config
+	assets             *assets
 	defaultFromAddress string
 	templates          map[string]*template.Template
 }
@@ -47,7 +47,12 @@ func (m *mailer) parseTemplate(name string) (*template.Template, error) {
 	)
 	t, ok = m.templates[name]
 	if !ok {
-		t, err = template.ParseFiles(path.Join(m.cfg.TemplatesDir, name+".tmpl"))
+		var body []byte
+		body, err = m.assets.readTemplate(name + ".tmpl")
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		t, err = template.New(name).Parse(string(body))
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
@@ -118,8 +123,8 @@ func newSmtpSender(cfg *config) *smtpSender {
 	return s
 }
 
-func newMailer(cfg *config) *mailer {
-	mailer := &mailer{cfg: cfg}
+func newMailer(cfg *config, assets *assets) *mailer {
+	mailer := &mailer{cfg: cfg, assets: assets}
 	if cfg.SmtpName == "" {
 		log.Println("WARNING: using fake mailer, messages will not be sent by SMTP. " +
 			"Set SMTP_NAME and SMTP_PASSWORD in environment to enable.")
@@ -167,3 +172,198 @@ func (m *mailer) sendWelcomeMail(user *user) error {
 	}
 	return m.send(msg)
 }
+
+// warns the user that their inactive account will be closed in days, by
+// deactivating it if they have photos or deleting it otherwise
+func (m *mailer) sendInactivityMail(user *user, hostname string, days int, hasPhotos bool) error {
+	msg, err := m.messageFromTemplate(
+		"Your photoshare account will be closed",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"inactive_account",
+		&struct {
+			Name      string
+			Hostname  string
+			Days      int
+			HasPhotos bool
+		}{
+			user.Name,
+			hostname,
+			days,
+			hasPhotos,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+// sends the email for a notification type, with the template of the type
+func (m *mailer) sendNotificationMail(recipient *user, sender string, kind string, photo *photo, r *http.Request) error {
+	switch kind {
+	case notificationUpvote, notificationDownvote:
+		return m.sendVoteMail(recipient, sender, kind, photo, r)
+	case notificationMention:
+		return m.sendMentionMail(recipient, sender, photo, r)
+	case notificationComment:
+		return m.sendCommentMail(recipient, sender, photo, r)
+	case notificationFollow:
+		return m.sendFollowMail(recipient, sender, r)
+	}
+	return fmt.Errorf("no email for notification type %q", kind)
+}
+
+func (m *mailer) sendVoteMail(recipient *user, sender string, kind string, photo *photo, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		sender+" voted on your photo on photoshare",
+		[]string{recipient.Email},
+		m.defaultFromAddress,
+		"vote",
+		&struct {
+			Name    string
+			Sender  string
+			Vote    string
+			Title   string
+			PhotoID int64
+			URL     string
+		}{
+			recipient.Name,
+			sender,
+			map[string]string{notificationUpvote: "up", notificationDownvote: "down"}[kind],
+			photo.Title,
+			photo.ID,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendMentionMail(recipient *user, sender string, photo *photo, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		sender+" mentioned you on photoshare",
+		[]string{recipient.Email},
+		m.defaultFromAddress,
+		"mention",
+		&struct {
+			Name    string
+			Sender  string
+			Title   string
+			PhotoID int64
+			URL     string
+		}{
+			recipient.Name,
+			sender,
+			photo.Title,
+			photo.ID,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendCommentMail(recipient *user, sender string, photo *photo, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		sender+" commented on your photo on photoshare",
+		[]string{recipient.Email},
+		m.defaultFromAddress,
+		"comment",
+		&struct {
+			Name    string
+			Sender  string
+			Title   string
+			PhotoID int64
+			URL     string
+		}{
+			recipient.Name,
+			sender,
+			photo.Title,
+			photo.ID,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+// tells the user of a new follower, local or federated
+func (m *mailer) sendFollowMail(recipient *user, follower string, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		follower+" followed you on photoshare",
+		[]string{recipient.Email},
+		m.defaultFromAddress,
+		"follow",
+		&struct {
+			Name     string
+			Follower string
+			UserID   int64
+			UserName string
+			URL      string
+		}{
+			recipient.Name,
+			follower,
+			recipient.ID,
+			recipient.Name,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+// asks the user to link the OpenID Connect account with their email
+func (m *mailer) sendOIDCLinkMail(user *user, code string, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Link your photoshare account to single sign-on",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"oidc_link",
+		&struct {
+			Name string
+			Code string
+			URL  string
+		}{
+			user.Name,
+			code,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendChangeEmailMail(user *user, code string, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Confirm your new email address",
+		[]string{user.NewEmail.String},
+		m.defaultFromAddress,
+		"change_email",
+		&struct {
+			Name  string
+			Email string
+			Code  string
+			URL   string
+		}{
+			user.Name,
+			user.NewEmail.String,
+			code,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
@@ -0,0 +1,50 @@
+package photoshare
+
+import (
+	"strings"
+)
+
+// Private or corporate deployments limit who signs up by the domain of
+// their email address: with EMAIL_DOMAINS_ALLOWED only those domains and
+// their subdomains are accepted, EMAIL_DOMAINS_DENIED are refused, and
+// with BLOCK_DISPOSABLE_EMAIL so are the throwaway inbox services below.
+// Addresses are checked on signup and on changing email.
+
+// well known disposable email services
+var disposableDomains = map[string]bool{
+	"10minutemail.com": true, "burnermail.io": true, "dispostable.com": true,
+	"emailondeck.com": true, "fakeinbox.com": true, "getnada.com": true,
+	"grr.la": true, "guerrillamail.com": true, "guerrillamailblock.com": true,
+	"mailinator.com": true, "maildrop.cc": true, "mailnesia.com": true,
+	"mintemail.com": true, "mohmal.com": true, "sharklasers.com": true,
+	"spamgourmet.com": true, "tempail.com": true, "temp-mail.org": true,
+	"tempmail.com": true, "throwawaymail.com": true, "trashmail.com": true,
+	"yopmail.com": true,
+}
+
+// returns true if the domain is one of the comma-separated domains, or a
+// subdomain of one
+func matchesDomain(domain string, domains string) bool {
+	for _, d := range strings.Split(domains, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the reason the domain of the email address is refused, or "" if
+// it is accepted
+func checkEmailDomain(cfg *config, email string) string {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	switch {
+	case cfg.EmailDomainsAllowed != "" && !matchesDomain(domain, cfg.EmailDomainsAllowed):
+		return "Email domain not allowed"
+	case matchesDomain(domain, cfg.EmailDomainsDenied):
+		return "Email domain not allowed"
+	case cfg.BlockDisposableEmail && disposableDomains[domain]:
+		return "Disposable email addresses are not allowed"
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package photoshare
+
+import (
+	"testing"
+)
+
+func TestCheckEmailDomain(t *testing.T) {
+
+	cfg := &config{}
+	if msg := checkEmailDomain(cfg, "tester@mailinator.com"); msg != "" {
+		t.Errorf("Expected any domain allowed by default, got %q", msg)
+	}
+
+	cfg.BlockDisposableEmail = true
+	if msg := checkEmailDomain(cfg, "tester@Mailinator.com"); msg == "" {
+		t.Error("Expected a disposable address refused")
+	}
+
+	cfg.EmailDomainsAllowed = "example.com, example.org"
+	cfg.EmailDomainsDenied = "sales.example.com"
+	for email, allowed := range map[string]bool{
+		"tester@example.com":         true,
+		"tester@eu.example.org":      true,
+		"tester@sales.example.com":   false,
+		"tester@notexample.com":      false,
+		"tester@example.com.evil.io": false,
+	} {
+		if msg := checkEmailDomain(cfg, email); (msg == "") != allowed {
+			t.Errorf("Expected %s allowed: %t, got %q", email, allowed, msg)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// Blogs embed a photo with its title and owner in an iframe of
+// /embed/photo/{id}, or with a script tag of /embed/photo/{id}.js which
+// inserts the iframe in its place. EMBED_FRAME_ANCESTORS limits the sites
+// allowed to frame the page.
+
+const (
+	embedWidth        = 640
+	embedHeight       = 520
+	embedCacheControl = "public, max-age=300"
+)
+
+// returns the photo of the route if it is visible to anyone
+func getEmbeddedPhoto(ctx *context) (*photoDetail, error) {
+	return ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), nil)
+}
+
+func embedURL(baseURL string, photoID int64) string {
+	return fmt.Sprintf("%s/embed/photo/%d", baseURL, photoID)
+}
+
+func getPhotoEmbed(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getEmbeddedPhoto(ctx)
+	if err != nil {
+		return err
+	}
+
+	body, err := ctx.assets.readTemplate("embed_photo.tmpl")
+	if err != nil {
+		return err
+	}
+	t, err := template.New("embed_photo").Parse(string(body))
+	if err != nil {
+		return err
+	}
+
+	baseURL := getBaseURL(r)
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, map[string]interface{}{
+		"Photo":    photo,
+		"AltText":  photo.altText(),
+		"PhotoURL": fmt.Sprintf("%s/#/detail/%d", baseURL, photo.ID),
+		"ImageURL": uploadURL(ctx.cfg, baseURL, photo.Filename),
+		"BaseURL":  baseURL,
+		"Host":     r.Host,
+	}); err != nil {
+		return err
+	}
+
+	csp := "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'"
+	if ctx.cfg.EmbedFrameAncestors != "" {
+		csp += "; frame-ancestors " + ctx.cfg.EmbedFrameAncestors
+	}
+	w.Header().Set("Content-Security-Policy", csp)
+	w.Header().Set("Cache-Control", embedCacheControl)
+
+	return writeBody(w, buf.Bytes(), http.StatusOK, "text/html")
+}
+
+// returns a script inserting the embed iframe in place of its script tag
+func getPhotoEmbedScript(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getEmbeddedPhoto(ctx)
+	if err != nil {
+		return err
+	}
+
+	// JSON strings are valid JavaScript, with "<" escaped
+	src, err := json.Marshal(embedURL(getBaseURL(r), photo.ID))
+	if err != nil {
+		return err
+	}
+	title, err := json.Marshal(photo.Title)
+	if err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`(function() {
+  var s = document.currentScript, f = document.createElement("iframe");
+  f.src = %s;
+  f.title = %s;
+  f.width = "%d";
+  f.height = "%d";
+  f.style.border = "0";
+  f.style.maxWidth = "100%%";
+  f.setAttribute("loading", "lazy");
+  s.parentNode.insertBefore(f, s);
+})();
+`, src, title, embedWidth, embedHeight)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", embedCacheControl)
+
+	return writeBody(w, []byte(script), http.StatusOK, "text/javascript")
+}
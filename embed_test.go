@@ -0,0 +1,61 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPhotoEmbed(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.EmbedFrameAncestors = "https://blog.example.com"
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "Heron <at> dawn", AltText: "A heron", Filename: "heron.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/embed/photo/%d", p.ID), nil)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if csp := res.Header().Get("Content-Security-Policy"); !strings.HasSuffix(csp, "frame-ancestors https://blog.example.com") {
+		t.Errorf("Frame ancestors should be limited, got %q", csp)
+	}
+	body := res.Body.String()
+	for _, s := range []string{`src="http://localhost/uploads/heron.jpg"`, `alt="A heron"`, "Heron &lt;at&gt; dawn", "by owner"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Embed should contain %s, got %s", s, body)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("http://localhost/embed/photo/%d.js", p.ID), nil)
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), fmt.Sprintf(`f.src = "http://localhost/embed/photo/%d"`, p.ID)) ||
+		strings.Contains(res.Body.String(), "<at>") {
+		t.Errorf("Unexpected script: %s", res.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost/embed/photo/999", nil)
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", res.Code)
+	}
+}
@@ -0,0 +1,268 @@
+package photoshare
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// With STORAGE_MASTER_KEY set, uploads and thumbnails are encrypted in the
+// storage, the uploads directory as well as the replica. Each file has its
+// own data key, random, encrypting it with AES-256-GCM; the data key is
+// kept in the header of the file, wrapped by the master key:
+//
+//	"PSE1" | key id (8) | length of the wrapped key (2) | wrapped key | nonce (12) | ciphertext
+//
+// The key id tells the master key the data key is wrapped by, the first
+// bytes of its SHA-256. Wrapping is behind the keyWrapper interface, so
+// that the master key can be kept in a key management service instead.
+// Files are decrypted when opened, so handlers read them as before, and
+// the uploads are served by handlers in place of the uploads directory.
+// Files stored before the key was set are read as they are; the
+// encrypt-uploads command encrypts them.
+
+var sealedMagic = []byte("PSE1")
+
+const (
+	sealedKeyIDSize = 8
+	dataKeySize     = 32
+)
+
+var errWrongMasterKey = errors.New("file encrypted with another master key")
+
+// wraps the data keys of files with a master key
+type keyWrapper interface {
+	keyID() []byte
+	wrap(dataKey []byte) ([]byte, error)
+	unwrap(wrapped []byte) ([]byte, error)
+}
+
+// wraps data keys with AES-256-GCM under a master key of the config
+type localKeyWrapper struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newLocalKeyWrapper(masterKey []byte) (*localKeyWrapper, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(masterKey)
+	return &localKeyWrapper{sum[:sealedKeyIDSize], aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (w *localKeyWrapper) keyID() []byte {
+	return w.id
+}
+
+func (w *localKeyWrapper) wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, dataKey, w.id), nil
+}
+
+func (w *localKeyWrapper) unwrap(wrapped []byte) ([]byte, error) {
+	size := w.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return w.aead.Open(nil, wrapped[:size], wrapped[size:], w.id)
+}
+
+// decodes STORAGE_MASTER_KEY, base64 of 32 bytes
+func decodeMasterKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != dataKeySize {
+		return nil, errors.New("STORAGE_MASTER_KEY must be 32 bytes encoded in base64")
+	}
+	return key, nil
+}
+
+// encrypts and decrypts the files of the storage
+type sealer struct {
+	keys keyWrapper
+}
+
+// returns the sealer of STORAGE_MASTER_KEY, or nil if not set
+func newSealer(cfg *config) (*sealer, error) {
+	if cfg.StorageMasterKey == "" {
+		return nil, nil
+	}
+	masterKey, err := decodeMasterKey(cfg.StorageMasterKey)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newLocalKeyWrapper(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{keys}, nil
+}
+
+// returns the file encrypted with a new data key
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(sealedMagic)
+	header.Write(s.keys.keyID())
+	binary.Write(header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header.Write(nonce)
+
+	// the header is authenticated with the content
+	return aead.Seal(header.Bytes(), nonce, plaintext, header.Bytes()), nil
+}
+
+func isSealed(body []byte) bool {
+	return bytes.HasPrefix(body, sealedMagic)
+}
+
+// returns the content of the file, decrypted if it is encrypted
+func (s *sealer) open(body []byte) ([]byte, error) {
+
+	if !isSealed(body) {
+		return body, nil
+	}
+
+	invalid := errors.New("invalid encrypted file")
+	rest := body[len(sealedMagic):]
+	if len(rest) < sealedKeyIDSize+2 {
+		return nil, invalid
+	}
+	if !bytes.Equal(rest[:sealedKeyIDSize], s.keys.keyID()) {
+		return nil, errWrongMasterKey
+	}
+	rest = rest[sealedKeyIDSize:]
+	size := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < size {
+		return nil, invalid
+	}
+	dataKey, err := s.keys.unwrap(rest[:size])
+	if err != nil {
+		return nil, invalid
+	}
+	rest = rest[size:]
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, invalid
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, invalid
+	}
+	headerSize := len(body) - len(rest) + aead.NonceSize()
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], body[:headerSize])
+	if err != nil {
+		return nil, invalid
+	}
+	return plaintext, nil
+}
+
+// reads and encrypts the file
+func (s *sealer) sealFrom(src io.Reader) ([]byte, error) {
+	plaintext, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(plaintext)
+}
+
+// a file decrypted in memory
+type decryptedFile struct {
+	*bytes.Reader
+}
+
+func (f decryptedFile) Close() error { return nil }
+
+// reads and decrypts the file
+func (s *sealer) openFrom(src io.Reader) (readableFile, error) {
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.open(body)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedFile{bytes.NewReader(plaintext)}, nil
+}
+
+// a storage whose files stored before STORAGE_MASTER_KEY was set can be
+// encrypted
+type encryptableStorage interface {
+	encryptFiles() (int, error)
+}
+
+// encrypts the files of the storage stored before STORAGE_MASTER_KEY was set,
+// returning the number of uploads encrypted
+func encryptStorage(store fileStorage) (int, error) {
+	s, ok := store.(encryptableStorage)
+	if !ok {
+		return 0, errors.New("storage cannot be encrypted")
+	}
+	return s.encryptFiles()
+}
+
+// serves the uploaded files, decrypted, in place of the uploads directory;
+// registered when STORAGE_MASTER_KEY is set without PUBLIC_MAX_SIZE
+func getStoredUpload(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	file, err := ctx.filestore.open(ctx.params.get("filename"))
+	if err != nil {
+		return httpError{http.StatusNotFound, "Not found"}
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", contentTypeOf(ctx.params.get("filename")))
+	http.ServeContent(w, r, "", time.Time{}, file)
+	return nil
+}
+
+// serves the thumbnails, decrypted; registered when STORAGE_MASTER_KEY is set
+func getStoredThumbnail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	file, err := ctx.filestore.openThumbnail(ctx.params.get("filename"))
+	if err != nil {
+		return httpError{http.StatusNotFound, "Not found"}
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", contentTypeOf(ctx.params.get("filename")))
+	http.ServeContent(w, r, "", time.Time{}, file)
+	return nil
+}
@@ -0,0 +1,148 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestSealer(t *testing.T, key byte) *sealer {
+	s, err := newSealer(&config{StorageMasterKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{key}, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSealer(t *testing.T) {
+
+	s := newTestSealer(t, 1)
+	sealed, err := s.seal([]byte("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || bytes.Contains(sealed, []byte("image")) {
+		t.Errorf("Expected the file to be encrypted, got %q", sealed)
+	}
+	if body, err := s.open(sealed); err != nil || string(body) != "image" {
+		t.Errorf("Expected the file decrypted, got %q, %v", body, err)
+	}
+	if again, _ := s.seal([]byte("image")); bytes.Equal(again, sealed) {
+		t.Error("Expected each file to have its own key and nonce")
+	}
+
+	// files stored before encryption are read as they are
+	if body, err := s.open([]byte("plain")); err != nil || string(body) != "plain" {
+		t.Errorf("Expected the unencrypted file, got %q, %v", body, err)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := s.open(tampered); err == nil {
+		t.Error("Expected an error for a changed file")
+	}
+	if _, err := s.open(sealed[:20]); err == nil {
+		t.Error("Expected an error for a truncated file")
+	}
+	if _, err := newTestSealer(t, 2).open(sealed); err != errWrongMasterKey {
+		t.Errorf("Expected an error for another master key, got %v", err)
+	}
+}
+
+func TestMasterKeyConfig(t *testing.T) {
+	for _, key := range []string{"short", base64.StdEncoding.EncodeToString(make([]byte, 16)), "not base64!"} {
+		if _, err := newSealer(&config{StorageMasterKey: key}); err == nil {
+			t.Errorf("Expected an error for %q", key)
+		}
+	}
+	if s, err := newSealer(&config{}); s != nil || err != nil {
+		t.Errorf("Expected no encryption without a key, got %v, %v", s, err)
+	}
+}
+
+func TestEncryptedFileStorage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &defaultFileStorage{dir, path.Join(dir, "thumbnails"), path.Join(dir, "variants"), &fakeImageProcessor{}, newTestSealer(t, 1)}
+	if err := store.store(strings.NewReader("image a.jpg"), "a.jpg", "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "thumbnails/a.jpg"} {
+		if body, _ := ioutil.ReadFile(path.Join(dir, name)); !isSealed(body) {
+			t.Errorf("Expected %s to be encrypted on disk, got %q", name, body)
+		}
+	}
+
+	f, err := store.open("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(f); string(body) != "image a.jpg" {
+		t.Errorf("Expected the file decrypted, got %q", body)
+	}
+	f, err = store.openThumbnail("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(f); string(body) != "image a.jpg" {
+		t.Errorf("Expected the thumbnail decrypted, got %q", body)
+	}
+
+	// stored before the key was set
+	ioutil.WriteFile(path.Join(dir, "b.png"), []byte("image b.png"), 0666)
+	ioutil.WriteFile(path.Join(dir, "thumbnails", "b.png"), []byte("image b.png"), 0666)
+	num, err := store.encryptFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Errorf("Expected only the unencrypted file to be encrypted, got %d", num)
+	}
+	for _, name := range []string{"b.png", "thumbnails/b.png"} {
+		if body, _ := ioutil.ReadFile(path.Join(dir, name)); !isSealed(body) {
+			t.Errorf("Expected %s to be encrypted, got %q", name, body)
+		}
+	}
+	if sum, _ := fileChecksum(store, "b.png"); sum == "" {
+		t.Error("Expected the encrypted file to be read")
+	}
+	if names, _ := store.list(); len(names) != 2 {
+		t.Errorf("Expected no file left aside, got %v", names)
+	}
+}
+
+func TestGetStoredThumbnail(t *testing.T) {
+
+	app := newTestApp(&mockDataMapper{})
+	app.cfg.StorageMasterKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	app.initRouter()
+	app.filestore.store(strings.NewReader("image a.jpg"), "a.jpg", "image/jpeg")
+
+	for url, status := range map[string]int{
+		"/uploads/a.jpg":            http.StatusOK,
+		"/uploads/thumbnails/a.jpg": http.StatusOK,
+		"/uploads/thumbnails/b.jpg": http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != status {
+			t.Errorf("Expected %d for %s, got %d", status, url, res.Code)
+			continue
+		}
+		if status == http.StatusOK && (res.Body.String() != "image a.jpg" || res.Header().Get("Content-Type") != "image/jpeg") {
+			t.Errorf("Expected the file for %s, got %q (%s)", url, res.Body.String(), res.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -20,6 +20,12 @@ func (h httpError) Error() string {
 	return h.Description
 }
 
+// an httpError with a code for the client to act on, rendered as JSON
+type codedError struct {
+	httpError
+	Code string
+}
+
 func isErrSqlNoRows(err error) bool {
 	if err == sql.ErrNoRows {
 		return true
@@ -38,27 +44,43 @@ func logError(err error) {
 	log.Println(s)
 }
 
-func handleError(w http.ResponseWriter, r *http.Request, err error) {
+// writes the error response, with messages in the language of the client
+func handleError(w http.ResponseWriter, r *http.Request, err error, t *translator) {
 	if err == nil {
 		return
 	}
 
+	lang := t.negotiate(r)
+	w.Header().Set("Content-Language", lang)
+
+	if err, ok := err.(codedError); ok {
+		renderJSON(w, map[string]string{
+			"error": t.translate(lang, err.Error()),
+			"code":  err.Code,
+		}, err.Status)
+		return
+	}
+
 	if err, ok := err.(httpError); ok {
-		http.Error(w, err.Error(), err.Status)
+		http.Error(w, t.translate(lang, err.Error()), err.Status)
 		return
 	}
 
 	if err, ok := err.(validationFailure); ok {
-		renderJSON(w, err, http.StatusBadRequest)
+		errors := make(map[string]string)
+		for field, msg := range err.Errors {
+			errors[field] = t.translate(lang, msg)
+		}
+		renderJSON(w, validationFailure{errors}, http.StatusBadRequest)
 		return
 	}
 
 	if isErrSqlNoRows(err) {
-		http.NotFound(w, r)
+		http.Error(w, t.translate(lang, "Not found"), http.StatusNotFound)
 		return
 	}
 
 	logError(err)
 
-	http.Error(w, "Sorry, an error occurred", http.StatusInternalServerError)
+	http.Error(w, t.translate(lang, "Sorry, an error occurred"), http.StatusInternalServerError)
 }
@@ -0,0 +1,117 @@
+package photoshare
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Owners set an expiry on a photo for a temporary share, when uploading it
+// or later. Once expired the photo is only shown to its owner, and it is
+// deleted, with its file, by the next run of removeExpiredPhotos.
+
+const photoExpiryInterval = time.Minute
+
+// parses the RFC 3339 time of an expiry, returning nil if there is none
+func parseExpiry(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, httpError{http.StatusBadRequest, "Invalid expiry"}
+	}
+	if !t.After(utcNow()) {
+		return nil, httpError{http.StatusBadRequest, "Expiry must be in the future"}
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// sets the expiry of the photo, or removes it if none is given
+func setPhotoExpiry(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		ExpiresAt string `json:"expiresAt"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if photo.ExpiresAt, err = parseExpiry(s.ExpiresAt); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderJSON(w, photo, http.StatusOK)
+}
+
+// deletes the expired photos of each site and their files
+func removeExpiredPhotos(app *app) {
+	sites, err := app.datamapper.getSites()
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, s := range sites {
+		num, err := removeSiteExpiredPhotos(app.datamapper.forSite(s.ID), app.filestore, utcNow())
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if num > 0 {
+			log.Printf("Removed %d expired photos of site %d", num, s.ID)
+			if err := app.cache.clear(); err != nil {
+				logError(err)
+			}
+		}
+	}
+}
+
+// returns the number of photos removed
+func removeSiteExpiredPhotos(datamapper dataMapper, filestore fileStorage, now time.Time) (int, error) {
+
+	expired, err := datamapper.getExpiredPhotos(now)
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+
+	photos := make([]*photo, len(expired))
+	for i := range expired {
+		photos[i] = &expired[i]
+	}
+	if err := datamapper.removePhotos(photos); err != nil {
+		return 0, err
+	}
+
+	for _, photo := range photos {
+		if err := cleanUnusedFile(datamapper, filestore, photo.Filename); err != nil {
+			logError(err)
+		}
+		sendMessage(photo.SiteID, &socketMessage{"", "", photo.ID, "photo_deleted"})
+	}
+	return len(photos), nil
+}
+
+// removes expired photos until the server stops
+func runPhotoExpiry(app *app) {
+	for range time.Tick(photoExpiryInterval) {
+		removeExpiredPhotos(app)
+	}
+}
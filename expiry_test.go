@@ -0,0 +1,97 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	if expiresAt, err := parseExpiry(""); err != nil || expiresAt != nil {
+		t.Errorf("No expiry should be nil, got %v %v", expiresAt, err)
+	}
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if expiresAt, err := parseExpiry(future); err != nil || expiresAt == nil {
+		t.Errorf("Expected an expiry, got %v", err)
+	}
+	for _, value := range []string{"tomorrow", "2001-01-01T00:00:00Z"} {
+		if _, err := parseExpiry(value); err == nil {
+			t.Errorf("%s should be invalid", value)
+		}
+	}
+}
+
+func TestPhotoExpiry(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var photos []*photo
+	for _, filename := range []string{"expiring.jpg", "kept.jpg"} {
+		p := &photo{Title: "test", Filename: filename, OwnerID: owner.ID}
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		app.filestore.store(strings.NewReader("image"), filename, "image/jpeg")
+		photos = append(photos, p)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/expiry", photos[0].ID),
+		strings.NewReader(fmt.Sprintf(`{"expiresAt": %q}`, expiresAt.Format(time.RFC3339))))
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	p, _ := dm.getPhoto(photos[0].ID)
+	if p.ExpiresAt == nil || !p.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Expiry should be set, got %v", p.ExpiresAt)
+	}
+
+	if _, err := dm.getPhotoDetail(p.ID, nil); err != nil {
+		t.Error("Photo should be visible until it expires")
+	}
+
+	// once expired, only the owner sees the photo until it is removed
+	past := time.Now().Add(-time.Minute)
+	p.ExpiresAt = &past
+	if err := dm.updatePhoto(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.getPhotoDetail(p.ID, nil); err == nil {
+		t.Error("Expired photo should be hidden")
+	}
+	owner.IsAuthenticated = true
+	if _, err := dm.getPhotoDetail(p.ID, owner); err != nil {
+		t.Error("Expired photo should be visible to its owner")
+	}
+
+	num, err := removeSiteExpiredPhotos(dm, app.filestore, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Errorf("Expected 1 photo removed, got %d", num)
+	}
+	if _, err := dm.getPhoto(photos[0].ID); err == nil {
+		t.Error("Expired photo should be removed")
+	}
+	if _, err := dm.getPhoto(photos[1].ID); err != nil {
+		t.Error("Photo without expiry should be kept")
+	}
+	if _, err := app.filestore.open("expiring.jpg"); err == nil {
+		t.Error("File of the expired photo should be removed")
+	}
+}
@@ -0,0 +1,62 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The explore page shows photos picked at random, and staff picks chosen by
+// moderators.
+
+func getRandomPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	photos, err := ctx.datamapper.getRandomPhotos(pageSize, ctx.userID())
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, newPhotoList(photos, int64(len(photos)), 1), http.StatusOK)
+}
+
+func getStaffPicks(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	page := getPage(r)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:staffpicks:page:%d:user:%d", page.index, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		return ctx.datamapper.getStaffPicks(page, userID)
+	})
+}
+
+// adds the photo to the staff picks, or removes it
+func setStaffPick(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		StaffPick bool `json:"staffPick"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.setStaffPick(photo, s.StaffPick); err != nil {
+		return err
+	}
+
+	action := "staff_pick"
+	if !s.StaffPick {
+		action = "remove_staff_pick"
+	}
+	if err := writeAuditLog(ctx, action, photo.ID, photo.Title); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderJSON(w, photo, http.StatusOK)
+}
@@ -0,0 +1,77 @@
+package photoshare
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type staffPickDataMapper struct {
+	mockDataMapper
+	picked *bool
+	audit  []string
+}
+
+func (m *staffPickDataMapper) getPhoto(photoID int64) (*photo, error) {
+	return &photo{ID: photoID, OwnerID: 1, Title: "test"}, nil
+}
+
+func (m *staffPickDataMapper) setStaffPick(photo *photo, picked bool) error {
+	m.picked = &picked
+	return nil
+}
+
+func (m *staffPickDataMapper) createAuditEntry(entry *auditEntry) error {
+	m.audit = append(m.audit, entry.Action)
+	return nil
+}
+
+func TestSetStaffPick(t *testing.T) {
+	for _, tc := range []struct {
+		body   string
+		action string
+	}{
+		{`{"staffPick": true}`, "staff_pick"},
+		{`{"staffPick": false}`, "remove_staff_pick"},
+	} {
+		dm := &staffPickDataMapper{}
+		p := &params{make(map[string]string)}
+		p.vars["id"] = "1"
+
+		c := &context{
+			app:        &app{datamapper: dm},
+			params:     p,
+			user:       &user{ID: 2, IsAuthenticated: true, IsAdmin: true},
+			datamapper: dm,
+			cache:      &fakeCache{},
+		}
+
+		req, _ := http.NewRequest("PUT", "http://localhost/api/photos/1/staffpick", bytes.NewBufferString(tc.body))
+		res := httptest.NewRecorder()
+
+		if err := setStaffPick(c, res, req); err != nil {
+			t.Fatal(err)
+		}
+		if dm.picked == nil {
+			t.Fatalf("%s: staff pick was not saved", tc.body)
+		}
+		if len(dm.audit) != 1 || dm.audit[0] != tc.action {
+			t.Errorf("%s: expected audit action %s, got %v", tc.body, tc.action, dm.audit)
+		}
+	}
+}
+
+func TestSetStaffPickRequiresAdmin(t *testing.T) {
+	app := newTestApp(&mockDataMapper{})
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/photos/1/staffpick", bytes.NewBufferString(`{"staffPick": true}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+}
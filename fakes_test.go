@@ -0,0 +1,1502 @@
+package photoshare
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// In-memory fakes of the app services, so handlers can be tested through
+// the router without a database, memcache or keys.
+
+// builds an app with the given data mapper and fakes for everything else
+func newTestApp(datamapper dataMapper) *app {
+	cfg := &config{
+		TemplatesDir:    "templates",
+		MaxUploadSize:   1 << 20,
+		CompressMinSize: -1,
+		StorageNameKey:  "test",
+	}
+	assets, _ := newAssets(cfg)
+	app := &app{
+		cfg:        cfg,
+		assets:     assets,
+		datamapper: datamapper,
+		session:    &fakeSessionManager{},
+		cache:      &fakeCache{},
+		features:   &fakeFeatureFlags{},
+		mailer: &mailer{
+			sender:    &fakeSender{},
+			assets:    assets,
+			templates: make(map[string]*template.Template),
+		},
+		filestore: newMemoryFileStorage(&fakeImageProcessor{}),
+		proxies:   &trustedProxies{},
+		fetcher:   newFetchClient(),
+		sites:     &fakeSiteResolver{},
+
+		recoveryLimiter: newRateLimiter(recoveryCodeWindow),
+	}
+	app.translator, _ = newTranslator(assets)
+	app.initRouter()
+	return app
+}
+
+// tokens are "userID:sessionKey", unsigned
+type fakeSessionManager struct {
+	sessionBinding
+}
+
+func (m *fakeSessionManager) readToken(r *http.Request) (int64, string, error) {
+	parts := strings.SplitN(r.Header.Get(tokenHeader), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", nil
+	}
+	userID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", nil
+	}
+	return userID, parts[1], nil
+}
+
+func (m *fakeSessionManager) createToken(userID int64, sessionKey string) (string, error) {
+	return fmt.Sprintf("%d:%s", userID, sessionKey), nil
+}
+
+func (m *fakeSessionManager) writeToken(w http.ResponseWriter, userID int64, sessionKey string) error {
+	token, _ := m.createToken(userID, sessionKey)
+	w.Header().Set(tokenHeader, token)
+	return nil
+}
+
+// never caches anything
+type fakeCache struct{}
+
+func (c *fakeCache) set(key string, obj interface{}) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (c *fakeCache) clear() error {
+	return nil
+}
+
+func (c *fakeCache) get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return fn()
+}
+
+func (c *fakeCache) render(w http.ResponseWriter, status int, key string, fn func() (interface{}, error)) error {
+	obj, err := fn()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, obj, status)
+}
+
+// every host is the default site
+type fakeSiteResolver struct{}
+
+func (r *fakeSiteResolver) resolve(host string) (*site, error) {
+	return &site{ID: defaultSiteID, Name: "Photoshare"}, nil
+}
+
+// every feature is enabled, and maintenance once set
+type fakeFeatureFlags struct {
+	maintenance bool
+}
+
+func (f *fakeFeatureFlags) isEnabled(name string, user *user) bool {
+	return name != featureMaintenance || f.maintenance
+}
+
+func (f *fakeFeatureFlags) getAll() (map[string]int, error) {
+	return defaultFeatures, nil
+}
+
+func (f *fakeFeatureFlags) forSite(siteID int64) featureFlags {
+	return f
+}
+
+func (f *fakeFeatureFlags) set(name string, percentage int) error {
+	if name == featureMaintenance {
+		f.maintenance = percentage > 0
+	}
+	return nil
+}
+
+// Stores users, photos, sessions and followers in memory. Other dataMapper
+// methods fall back to the canned answers of mockDataMapper.
+type memoryDataMapper struct {
+	mockDataMapper
+	sync.Mutex
+	lastID    int64
+	users     map[int64]user
+	photos    map[int64]photo
+	sessions  map[string]session
+	keys      map[int64]actorKey
+	followers map[int64][]follower
+
+	suggestions   map[int64]photoSuggestions
+	audit         []auditEntry
+	blocked       []blockedWord
+	notifications []notification
+	preferences   []notificationPreference
+	mentions      []mention
+	idempotency   map[string]idempotencyKey
+	purchases     []purchase
+	portfolios    map[int64][]portfolioAlbum
+	slugHistory   []slugChange
+	shortlinks    map[string]shortlink
+	comments      []comment
+	reports       []report
+	notes         []moderationNote
+	thresholds    []strikeThreshold
+	deletions     []photoDeletion
+	checks        map[int64]time.Time
+	corruptions   []storageCorruption
+	badges        []badge
+
+	// held by withFileLock, apart from the lock of the maps
+	fileLock sync.Mutex
+}
+
+// a photo deleted, for the sync
+type photoDeletion struct {
+	photoID   int64
+	deletedAt time.Time
+}
+
+// a previous slug of a user, or of their album
+type slugChange struct {
+	userID  int64
+	albumID int64
+	slug    string
+}
+
+func newMemoryDataMapper() *memoryDataMapper {
+	return &memoryDataMapper{
+		users:     make(map[int64]user),
+		photos:    make(map[int64]photo),
+		sessions:  make(map[string]session),
+		keys:      make(map[int64]actorKey),
+		followers: make(map[int64][]follower),
+
+		suggestions: make(map[int64]photoSuggestions),
+		portfolios:  make(map[int64][]portfolioAlbum),
+		shortlinks:  make(map[string]shortlink),
+		checks:      make(map[int64]time.Time),
+	}
+}
+
+// sites are not separated in memory
+func (m *memoryDataMapper) forSite(siteID int64) dataMapper {
+	return m
+}
+
+func (m *memoryDataMapper) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *memoryDataMapper) createUser(u *user) error {
+	m.Lock()
+	defer m.Unlock()
+	u.ID = m.nextID()
+	u.IsActive = true
+	u.CreatedAt = time.Now()
+	u.LastActiveAt = u.CreatedAt
+	u.Votes = "{}"
+	m.users[u.ID] = *u
+	return nil
+}
+
+func (m *memoryDataMapper) updateUser(u *user) error {
+	m.Lock()
+	defer m.Unlock()
+	m.users[u.ID] = *u
+	return nil
+}
+
+func (m *memoryDataMapper) getActiveUser(userID int64) (*user, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userID]
+	if !ok || !u.IsActive {
+		return &user{}, sql.ErrNoRows
+	}
+	return &u, nil
+}
+
+func (m *memoryDataMapper) getUser(userID int64) (*user, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &u, nil
+}
+
+func (m *memoryDataMapper) getAllUsers() ([]user, error) {
+	m.Lock()
+	defer m.Unlock()
+	var users []user
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *memoryDataMapper) removeUser(u *user) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.users, u.ID)
+	return nil
+}
+
+// returns the active users other than admins and exempt users for which the
+// filter is true, by ID
+func (m *memoryDataMapper) retainedUsers(filter func(u *user) bool) ([]inactiveUser, error) {
+	m.Lock()
+	defer m.Unlock()
+	var users []inactiveUser
+	for _, u := range m.users {
+		if !u.IsActive || u.IsAdmin || u.RetentionExempt || !filter(&u) {
+			continue
+		}
+		item := inactiveUser{user: u}
+		for _, p := range m.photos {
+			if p.OwnerID == u.ID {
+				item.NumPhotos++
+			}
+		}
+		users = append(users, item)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *memoryDataMapper) getInactiveUsers(activeBefore time.Time) ([]inactiveUser, error) {
+	return m.retainedUsers(func(u *user) bool {
+		return u.LastActiveAt.Before(activeBefore) && u.InactivityWarnedAt == nil
+	})
+}
+
+func (m *memoryDataMapper) getWarnedUsers(activeBefore time.Time, warnedBefore time.Time) ([]inactiveUser, error) {
+	return m.retainedUsers(func(u *user) bool {
+		return u.LastActiveAt.Before(activeBefore) && u.InactivityWarnedAt != nil && u.InactivityWarnedAt.Before(warnedBefore)
+	})
+}
+
+func (m *memoryDataMapper) createPhoto(p *photo) error {
+	m.Lock()
+	defer m.Unlock()
+	p.ID = m.nextID()
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+	m.photos[p.ID] = *p
+	return nil
+}
+
+func (m *memoryDataMapper) updatePhoto(p *photo) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.photos[p.ID].Version != p.Version {
+		return errPhotoConflict
+	}
+	p.Version++
+	p.UpdatedAt = time.Now()
+	m.photos[p.ID] = *p
+	return nil
+}
+
+func (m *memoryDataMapper) updateTags(p *photo) error {
+	return m.updatePhoto(p)
+}
+
+func (m *memoryDataMapper) getExpiredPhotos(now time.Time) ([]photo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var photos []photo
+	for _, p := range m.photos {
+		if p.isExpired(now) {
+			photos = append(photos, p)
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].ID < photos[j].ID })
+	return photos, nil
+}
+
+func (m *memoryDataMapper) setPhotoChecksum(p *photo) error {
+	m.Lock()
+	defer m.Unlock()
+	stored := m.photos[p.ID]
+	stored.Checksum = p.Checksum
+	m.photos[p.ID] = stored
+	return nil
+}
+
+func (m *memoryDataMapper) getPhotosToCheck(checkedBefore time.Time, limit int) ([]photo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var photos []photo
+	for _, p := range m.photos {
+		if checkedAt, ok := m.checks[p.ID]; !ok || checkedAt.Before(checkedBefore) {
+			photos = append(photos, p)
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool {
+		a, b := m.checks[photos[i].ID], m.checks[photos[j].ID]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return photos[i].ID < photos[j].ID
+	})
+	if len(photos) > limit {
+		photos = photos[:limit]
+	}
+	return photos, nil
+}
+
+func (m *memoryDataMapper) recordStorageCheck(p *photo, now time.Time, c *storageCorruption) error {
+	m.Lock()
+	defer m.Unlock()
+	m.checks[p.ID] = now
+	open := -1
+	for i := range m.corruptions {
+		if m.corruptions[i].PhotoID == p.ID && m.corruptions[i].ResolvedAt == nil {
+			open = i
+		}
+	}
+	switch {
+	case c == nil || c.Repaired:
+		if open >= 0 {
+			m.corruptions[open].ResolvedAt = &now
+			m.corruptions[open].Repaired = c != nil
+		} else if c != nil {
+			m.corruptions = append(m.corruptions, storageCorruption{ID: m.nextID(), PhotoID: p.ID,
+				Problem: c.Problem, DetectedAt: now, ResolvedAt: &now, Repaired: true})
+		}
+	case open < 0:
+		m.corruptions = append(m.corruptions, storageCorruption{ID: m.nextID(), PhotoID: p.ID,
+			Problem: c.Problem, DetectedAt: now})
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) getStorageCorruptions(resolvedSince time.Time) ([]storageCorruptionDetail, error) {
+	m.Lock()
+	defer m.Unlock()
+	var corruptions []storageCorruptionDetail
+	for i := len(m.corruptions) - 1; i >= 0; i-- {
+		c := m.corruptions[i]
+		if c.ResolvedAt == nil || !c.ResolvedAt.Before(resolvedSince) {
+			p := m.photos[c.PhotoID]
+			corruptions = append(corruptions, storageCorruptionDetail{c, p.Filename, p.Title})
+		}
+	}
+	return corruptions, nil
+}
+
+func (m *memoryDataMapper) withFileLock(name string, fn func() error) error {
+	m.fileLock.Lock()
+	defer m.fileLock.Unlock()
+	return fn()
+}
+
+func (m *memoryDataMapper) isFileUsed(name string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, p := range m.photos {
+		if p.Filename == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDataMapper) removePhoto(p *photo) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.photos, p.ID)
+	m.deletions = append(m.deletions, photoDeletion{p.ID, time.Now()})
+	return nil
+}
+
+func (m *memoryDataMapper) updatePhotos(photos []*photo) error {
+	for _, p := range photos {
+		if err := m.updatePhoto(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) removePhotos(photos []*photo) error {
+	for _, p := range photos {
+		if err := m.removePhoto(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) trashPhotos(photos []*photo) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	for _, p := range photos {
+		p.DeletedAt = &now
+		p.Version++
+		p.UpdatedAt = now
+		m.photos[p.ID] = *p
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) restorePhoto(p *photo) error {
+	m.Lock()
+	defer m.Unlock()
+	p.DeletedAt = nil
+	p.Version++
+	p.UpdatedAt = time.Now()
+	m.photos[p.ID] = *p
+	return nil
+}
+
+func (m *memoryDataMapper) getChangedPhotos(since time.Time, limit int64) ([]photoChange, error) {
+	m.Lock()
+	defer m.Unlock()
+	var changes []photoChange
+	for _, p := range m.photos {
+		if p.UpdatedAt.After(since) {
+			changes = append(changes, photoChange{p.ID, p.UpdatedAt})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].UpdatedAt.Equal(changes[j].UpdatedAt) {
+			return changes[i].ID < changes[j].ID
+		}
+		return changes[i].UpdatedAt.Before(changes[j].UpdatedAt)
+	})
+	if int64(len(changes)) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
+
+func (m *memoryDataMapper) getDeletedPhotoIDs(since time.Time) ([]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var ids []int64
+	for _, d := range m.deletions {
+		if d.deletedAt.After(since) {
+			ids = append(ids, d.photoID)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memoryDataMapper) trashedPhotos(filter func(p *photo) bool) []photo {
+	m.Lock()
+	defer m.Unlock()
+	var photos []photo
+	for _, p := range m.photos {
+		if p.DeletedAt != nil && filter(&p) {
+			photos = append(photos, p)
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].ID < photos[j].ID })
+	return photos
+}
+
+func (m *memoryDataMapper) getTrash(page *page, ownerID int64) (*photoList, error) {
+	photos := m.trashedPhotos(func(p *photo) bool { return p.OwnerID == ownerID })
+	return newPhotoList(photos, int64(len(photos)), page.index), nil
+}
+
+func (m *memoryDataMapper) getTrashedPhoto(photoID int64, ownerID int64) (*photo, error) {
+	photos := m.trashedPhotos(func(p *photo) bool { return p.ID == photoID && p.OwnerID == ownerID })
+	if len(photos) == 0 {
+		return &photo{}, sql.ErrNoRows
+	}
+	return &photos[0], nil
+}
+
+func (m *memoryDataMapper) getTrashedBefore(before time.Time) ([]photo, error) {
+	return m.trashedPhotos(func(p *photo) bool { return p.DeletedAt.Before(before) }), nil
+}
+
+func (m *memoryDataMapper) updateMany(items ...interface{}) error {
+	for _, item := range items {
+		var err error
+		switch item := item.(type) {
+		case *photo:
+			// saved as is, without checking the version
+			m.Lock()
+			m.photos[item.ID] = *item
+			m.Unlock()
+		case *user:
+			err = m.updateUser(item)
+		default:
+			err = fmt.Errorf("cannot update %T", item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) recordVote(p *photo, u *user, value int) error {
+	m.Lock()
+	defer m.Unlock()
+	stored, ok := m.photos[p.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	voter, ok := m.users[u.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if voter.hasVoted(p.ID) {
+		return errAlreadyVoted
+	}
+	if value > 0 {
+		stored.UpVotes++
+	} else {
+		stored.DownVotes++
+	}
+	stored.Score = stored.UpVotes - stored.DownVotes
+	voter.registerVote(p.ID)
+	m.photos[p.ID] = stored
+	m.users[u.ID] = voter
+	*p = stored
+	u.Votes = voter.Votes
+	return nil
+}
+
+func (m *memoryDataMapper) getPhoto(photoID int64) (*photo, error) {
+	m.Lock()
+	defer m.Unlock()
+	p, ok := m.photos[photoID]
+	if !ok || p.DeletedAt != nil {
+		return &photo{}, sql.ErrNoRows
+	}
+	return &p, nil
+}
+
+// matches titles and tags containing the query, in upload order
+func (m *memoryDataMapper) searchPhotos(page *page, q string, userID int64) (*photoList, error) {
+	m.Lock()
+	defer m.Unlock()
+	q = strings.ToLower(q)
+	now := time.Now()
+	var photos []photo
+	for _, p := range m.photos {
+		if p.DeletedAt != nil || ((p.Private || p.HeldAt != nil || p.isExpired(now)) && p.OwnerID != userID) {
+			continue
+		}
+		if strings.Contains(strings.ToLower(p.Title+" "+strings.Join(p.Tags, " ")), q) {
+			photos = append(photos, p)
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].ID < photos[j].ID })
+	total := int64(len(photos))
+	if total > page.offset+page.size {
+		photos = photos[:page.offset+page.size]
+	}
+	if total < page.offset {
+		photos = nil
+	} else {
+		photos = photos[page.offset:]
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+func (m *memoryDataMapper) getPhotoDetail(photoID int64, u *user) (*photoDetail, error) {
+	p, err := m.getPhoto(photoID)
+	if err != nil {
+		return nil, err
+	}
+	m.Lock()
+	owner := m.users[p.OwnerID]
+	m.Unlock()
+	detail := &photoDetail{
+		photo:             *p,
+		OwnerName:         owner.Name,
+		OwnerShadowBanned: owner.IsShadowBanned,
+		Permissions: &permissions{
+			p.canEdit(u),
+			p.canDelete(u),
+			p.canVote(u),
+			p.canComment(u),
+		},
+	}
+	if !detail.isVisibleTo(u, time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	return detail, nil
+}
+
+func (m *memoryDataMapper) getPhotoDetails(photoIDs []int64, u *user) ([]photoDetail, error) {
+	var photos []photoDetail
+	for _, id := range photoIDs {
+		photo, err := m.getPhotoDetail(id, u)
+		if isErrSqlNoRows(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, *photo)
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].ID < photos[j].ID })
+	return photos, nil
+}
+
+func (m *memoryDataMapper) getPortfolio(ownerID int64, userID int64) ([]portfolioAlbum, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	var albums []portfolioAlbum
+	for _, album := range m.portfolios[ownerID] {
+		album.Photos = []photo{}
+		for _, id := range album.PhotoIDs {
+			p, ok := m.photos[id]
+			if !ok || p.DeletedAt != nil || ((p.Private || p.HeldAt != nil || p.isExpired(now)) && p.OwnerID != userID) {
+				continue
+			}
+			album.Photos = append(album.Photos, p)
+		}
+		album.PhotoIDs = nil
+		albums = append(albums, album)
+	}
+	return albums, nil
+}
+
+func (m *memoryDataMapper) setPortfolio(ownerID int64, albums []portfolioAlbum) error {
+	m.Lock()
+	defer m.Unlock()
+	previous := make(map[int64]portfolioAlbum)
+	for _, album := range m.portfolios[ownerID] {
+		previous[album.ID] = album
+	}
+	saved := make([]portfolioAlbum, len(albums))
+	for i := range albums {
+		album := &albums[i]
+		if old, ok := previous[album.ID]; ok {
+			if old.Slug != nil && (album.Slug == nil || *album.Slug != *old.Slug) {
+				m.slugHistory = append(m.slugHistory, slugChange{ownerID, album.ID, *old.Slug})
+			}
+		} else {
+			album.ID = m.nextID()
+		}
+		album.OwnerID = ownerID
+		album.Position = i
+		saved[i] = *album
+	}
+	m.portfolios[ownerID] = saved
+	return nil
+}
+
+func (m *memoryDataMapper) getAlbumIDByPreviousSlug(ownerID int64, slug string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.slugHistory) - 1; i >= 0; i-- {
+		if c := m.slugHistory[i]; c.userID == ownerID && c.albumID != 0 && c.slug == slug {
+			return c.albumID, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) getShortlink(photoID int64) (*shortlink, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, link := range m.shortlinks {
+		if link.PhotoID == photoID {
+			return &link, nil
+		}
+	}
+	return &shortlink{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) createShortlink(link *shortlink) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.shortlinks[link.Code]; ok {
+		return errors.New("duplicate shortlink")
+	}
+	link.CreatedAt = time.Now()
+	m.shortlinks[link.Code] = *link
+	return nil
+}
+
+func (m *memoryDataMapper) followShortlink(code string) (*shortlink, error) {
+	m.Lock()
+	defer m.Unlock()
+	link, ok := m.shortlinks[code]
+	if p, found := m.photos[link.PhotoID]; !ok || !found || p.DeletedAt != nil {
+		return &shortlink{}, sql.ErrNoRows
+	}
+	link.Clicks++
+	m.shortlinks[code] = link
+	return &link, nil
+}
+
+func (m *memoryDataMapper) getComments(photoID int64, u *user) ([]commentDetail, error) {
+	m.Lock()
+	defer m.Unlock()
+	var comments []commentDetail
+	for _, c := range m.comments {
+		author := m.users[c.AuthorID]
+		if c.PhotoID == photoID && (!author.IsShadowBanned || author.ID == u.ID) {
+			comments = append(comments, commentDetail{comment: c, AuthorName: author.Name})
+		}
+	}
+	return comments, nil
+}
+
+func (m *memoryDataMapper) getComment(commentID int64) (*comment, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, c := range m.comments {
+		if c.ID == commentID {
+			return &c, nil
+		}
+	}
+	return &comment{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) createComment(c *comment) error {
+	m.Lock()
+	defer m.Unlock()
+	c.ID = m.nextID()
+	c.CreatedAt = time.Now()
+	m.comments = append(m.comments, *c)
+	return nil
+}
+
+func (m *memoryDataMapper) updateComment(c *comment) error {
+	m.Lock()
+	defer m.Unlock()
+	for i := range m.comments {
+		if m.comments[i].ID == c.ID {
+			m.comments[i] = *c
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) deleteComment(c *comment) error {
+	m.Lock()
+	defer m.Unlock()
+	for i := range m.comments {
+		if m.comments[i].ID == c.ID {
+			m.comments = append(m.comments[:i], m.comments[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) createReport(r *report) error {
+	m.Lock()
+	defer m.Unlock()
+	r.ID = m.nextID()
+	r.Status = reportOpen
+	r.CreatedAt = time.Now()
+	m.reports = append(m.reports, *r)
+	return nil
+}
+
+func (m *memoryDataMapper) hasReported(photoID int64, userID int64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, r := range m.reports {
+		if r.PhotoID == photoID && r.ReporterID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDataMapper) getReport(reportID int64) (*report, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, r := range m.reports {
+		if r.ID == reportID {
+			return &r, nil
+		}
+	}
+	return &report{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) getOpenReports() ([]reportDetail, error) {
+	m.Lock()
+	defer m.Unlock()
+	var reports []reportDetail
+	for _, r := range m.reports {
+		if r.Status == reportOpen {
+			reports = append(reports, reportDetail{
+				report:       r,
+				Title:        m.photos[r.PhotoID].Title,
+				OwnerName:    m.users[r.OwnerID].Name,
+				ReporterName: m.users[r.ReporterID].Name,
+			})
+		}
+	}
+	return reports, nil
+}
+
+func (m *memoryDataMapper) resolveReport(r *report) (*user, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	r.ResolvedAt = &now
+	for i := range m.reports {
+		if m.reports[i].ID == r.ID {
+			m.reports[i] = *r
+		}
+	}
+	if r.Status != reportUpheld {
+		return nil, nil
+	}
+	owner, ok := m.users[r.OwnerID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	owner.Strikes++
+	m.users[owner.ID] = owner
+	return &owner, nil
+}
+
+func (m *memoryDataMapper) getModerationNotes(userID int64) ([]moderationNoteDetail, error) {
+	m.Lock()
+	defer m.Unlock()
+	var notes []moderationNoteDetail
+	for _, n := range m.notes {
+		if n.UserID == userID {
+			notes = append(notes, moderationNoteDetail{n, m.users[n.AuthorID].Name})
+		}
+	}
+	return notes, nil
+}
+
+func (m *memoryDataMapper) createModerationNote(note *moderationNote) error {
+	m.Lock()
+	defer m.Unlock()
+	note.ID = m.nextID()
+	note.CreatedAt = time.Now()
+	m.notes = append(m.notes, *note)
+	return nil
+}
+
+func (m *memoryDataMapper) getStrikeThresholds() ([]strikeThreshold, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]strikeThreshold(nil), m.thresholds...), nil
+}
+
+func (m *memoryDataMapper) setStrikeThresholds(thresholds []strikeThreshold) error {
+	m.Lock()
+	defer m.Unlock()
+	m.thresholds = append([]strikeThreshold(nil), thresholds...)
+	sort.Slice(m.thresholds, func(i, j int) bool { return m.thresholds[i].Strikes < m.thresholds[j].Strikes })
+	return nil
+}
+
+func (m *memoryDataMapper) createPurchase(p *purchase) error {
+	m.Lock()
+	defer m.Unlock()
+	p.ID = m.nextID()
+	p.CreatedAt = time.Now()
+	m.purchases = append(m.purchases, *p)
+	return nil
+}
+
+func (m *memoryDataMapper) getPurchaseByCheckout(checkoutID string) (*purchase, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, p := range m.purchases {
+		if p.CheckoutID == checkoutID {
+			return &p, nil
+		}
+	}
+	return &purchase{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) markPurchasePaid(p *purchase) error {
+	m.Lock()
+	defer m.Unlock()
+	for i := range m.purchases {
+		if m.purchases[i].ID == p.ID && m.purchases[i].PaidAt == nil {
+			now := time.Now()
+			m.purchases[i].PaidAt = &now
+			p.PaidAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) hasPurchased(photoID int64, userID int64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, p := range m.purchases {
+		if p.PhotoID == photoID && p.BuyerID == userID && p.PaidAt != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDataMapper) getPurchases(userID int64) ([]purchaseDetail, error) {
+	m.Lock()
+	defer m.Unlock()
+	var purchases []purchaseDetail
+	for _, p := range m.purchases {
+		if p.BuyerID == userID && p.PaidAt != nil {
+			photo := m.photos[p.PhotoID]
+			purchases = append(purchases, purchaseDetail{p, photo.Title, photo.Filename})
+		}
+	}
+	return purchases, nil
+}
+
+func (m *memoryDataMapper) createAuditEntry(e *auditEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	e.ID = m.nextID()
+	m.audit = append(m.audit, *e)
+	return nil
+}
+
+func (m *memoryDataMapper) reserveIdempotencyKey(key *idempotencyKey, expiry time.Time, reservationExpiry time.Time) (*idempotencyKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.idempotency == nil {
+		m.idempotency = make(map[string]idempotencyKey)
+	}
+	id := fmt.Sprintf("%d:%s", key.UserID, key.Key)
+	if stored, ok := m.idempotency[id]; ok && !stored.CreatedAt.Before(expiry) &&
+		(stored.Status != 0 || !stored.CreatedAt.Before(reservationExpiry)) {
+		return &stored, nil
+	}
+	m.idempotency[id] = *key
+	return nil, nil
+}
+
+func (m *memoryDataMapper) saveIdempotencyKey(key *idempotencyKey) error {
+	m.Lock()
+	defer m.Unlock()
+	m.idempotency[fmt.Sprintf("%d:%s", key.UserID, key.Key)] = *key
+	return nil
+}
+
+func (m *memoryDataMapper) removeIdempotencyKey(key *idempotencyKey) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.idempotency, fmt.Sprintf("%d:%s", key.UserID, key.Key))
+	return nil
+}
+
+func (m *memoryDataMapper) getNotificationSettings(userID int64) (notificationSettings, error) {
+	m.Lock()
+	defer m.Unlock()
+	var prefs []notificationPreference
+	for _, pref := range m.preferences {
+		if pref.UserID == userID {
+			prefs = append(prefs, pref)
+		}
+	}
+	return newNotificationSettings(userID, prefs), nil
+}
+
+func (m *memoryDataMapper) saveNotificationSettings(settings notificationSettings) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, pref := range settings {
+		saved := false
+		for i := range m.preferences {
+			if m.preferences[i].UserID == pref.UserID && m.preferences[i].Type == pref.Type {
+				m.preferences[i], saved = *pref, true
+			}
+		}
+		if !saved {
+			m.preferences = append(m.preferences, *pref)
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) createNotification(n *notification) error {
+	m.Lock()
+	defer m.Unlock()
+	n.ID = m.nextID()
+	m.notifications = append(m.notifications, *n)
+	return nil
+}
+
+func (m *memoryDataMapper) createMention(mention *mention) error {
+	m.Lock()
+	defer m.Unlock()
+	m.mentions = append(m.mentions, *mention)
+	return nil
+}
+
+func (m *memoryDataMapper) getBlockedWords() ([]blockedWord, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]blockedWord{}, m.blocked...), nil
+}
+
+func (m *memoryDataMapper) addBlockedWord(word *blockedWord) error {
+	m.Lock()
+	defer m.Unlock()
+	word.ID = m.nextID()
+	word.CreatedAt = time.Now()
+	m.blocked = append(m.blocked, *word)
+	return nil
+}
+
+func (m *memoryDataMapper) getSpamSignals(ownerID int64, title string) (*spamSignals, error) {
+	m.Lock()
+	defer m.Unlock()
+	s := &spamSignals{}
+	now := time.Now()
+	for _, p := range m.photos {
+		if p.OwnerID != ownerID {
+			continue
+		}
+		if strings.EqualFold(p.Title, title) && p.CreatedAt.After(now.Add(-spamDuplicateWindow)) {
+			s.DuplicateTitles++
+		}
+		if p.CreatedAt.After(now.Add(-spamBurstWindow)) {
+			s.RecentUploads++
+		}
+	}
+	return s, nil
+}
+
+func (m *memoryDataMapper) saveSuggestions(s *photoSuggestions) error {
+	m.Lock()
+	defer m.Unlock()
+	s.CreatedAt = time.Now()
+	m.suggestions[s.PhotoID] = *s
+	return nil
+}
+
+func (m *memoryDataMapper) getSuggestions(photoID int64) (*photoSuggestions, error) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.suggestions[photoID]
+	if !ok {
+		return &photoSuggestions{}, sql.ErrNoRows
+	}
+	return &s, nil
+}
+
+func (m *memoryDataMapper) removeSuggestions(photoID int64) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.suggestions, photoID)
+	return nil
+}
+
+func (m *memoryDataMapper) getUsersByNames(names []string) ([]user, error) {
+	m.Lock()
+	defer m.Unlock()
+	var users []user
+	for _, u := range m.users {
+		for _, name := range names {
+			if strings.EqualFold(u.Name, name) {
+				users = append(users, u)
+			}
+		}
+	}
+	return users, nil
+}
+
+func (m *memoryDataMapper) getUserByName(name string) (*user, error) {
+	users, _ := m.getUsersByNames([]string{name})
+	if len(users) == 0 || !users[0].IsActive {
+		return &user{}, sql.ErrNoRows
+	}
+	return &users[0], nil
+}
+
+// returns the first active user for which the filter is true
+func (m *memoryDataMapper) findUser(filter func(u *user) bool) (*user, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, u := range m.users {
+		if u.IsActive && filter(&u) {
+			return &u, nil
+		}
+	}
+	return &user{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) getUserByEmail(email string) (*user, error) {
+	return m.findUser(func(u *user) bool { return u.Email == email })
+}
+
+func (m *memoryDataMapper) getUserByEmailChangeCode(code string) (*user, error) {
+	return m.findUser(func(u *user) bool { return code != "" && u.EmailChangeCode.String == code })
+}
+
+func (m *memoryDataMapper) getUserByOIDCSubject(subject string) (*user, error) {
+	return m.findUser(func(u *user) bool { return u.OIDCSubject.Valid && u.OIDCSubject.String == subject })
+}
+
+func (m *memoryDataMapper) getUserByOIDCLinkCode(code string) (*user, error) {
+	return m.findUser(func(u *user) bool { return code != "" && u.OIDCLinkCode.String == code })
+}
+
+func (m *memoryDataMapper) getUserByRecoveryCode(code string) (*user, error) {
+	return m.findUser(func(u *user) bool { return code != "" && u.RecoveryCode.String == code })
+}
+
+func (m *memoryDataMapper) clearRecoveryCode(userID int64, code string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userID]
+	if !ok || !u.RecoveryCode.Valid || u.RecoveryCode.String != code {
+		return false, nil
+	}
+	u.resetRecoveryCode()
+	m.users[userID] = u
+	return true, nil
+}
+
+func (m *memoryDataMapper) updatePasswordHash(u *user, oldHash string) error {
+	m.Lock()
+	defer m.Unlock()
+	if saved, ok := m.users[u.ID]; ok && saved.Password == oldHash {
+		saved.Password, saved.PasswordAlgorithm, saved.PasswordPepper = u.Password, u.PasswordAlgorithm, u.PasswordPepper
+		m.users[u.ID] = saved
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
+	return m.findUser(func(u *user) bool { return u.Email == identifier || u.Name == identifier })
+}
+
+func (m *memoryDataMapper) isUserNameAvailable(candidate *user) (bool, error) {
+	_, err := m.findUser(func(u *user) bool { return u.ID != candidate.ID && strings.EqualFold(u.Name, candidate.Name) })
+	return err != nil, nil
+}
+
+func (m *memoryDataMapper) isUserEmailAvailable(candidate *user) (bool, error) {
+	_, err := m.findUser(func(u *user) bool { return u.ID != candidate.ID && u.Email == candidate.Email })
+	return err != nil, nil
+}
+
+func (m *memoryDataMapper) changeUserName(u *user, oldName string) error {
+	return m.updateUser(u)
+}
+
+func (m *memoryDataMapper) getUserBySlug(slug string) (*user, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, u := range m.users {
+		if u.IsActive && u.Slug != nil && *u.Slug == slug {
+			return &u, nil
+		}
+	}
+	return &user{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) getUserByPreviousSlug(slug string) (*user, error) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.slugHistory) - 1; i >= 0; i-- {
+		if c := m.slugHistory[i]; c.albumID == 0 && c.slug == slug {
+			if u, ok := m.users[c.userID]; ok && u.IsActive {
+				return &u, nil
+			}
+		}
+	}
+	return &user{}, sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) isUserSlugAvailable(user *user) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, u := range m.users {
+		if u.ID != user.ID && u.Slug != nil && *u.Slug == *user.Slug {
+			return false, nil
+		}
+	}
+	for _, c := range m.slugHistory {
+		if c.albumID == 0 && c.userID != user.ID && c.slug == *user.Slug {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *memoryDataMapper) changeUserSlug(user *user, oldSlug *string) error {
+	m.Lock()
+	defer m.Unlock()
+	if oldSlug != nil {
+		m.slugHistory = append(m.slugHistory, slugChange{user.ID, 0, *oldSlug})
+	}
+	m.users[user.ID] = *user
+	return nil
+}
+
+func (m *memoryDataMapper) getActorKey(userID int64) (*actorKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	key, ok := m.keys[userID]
+	if !ok {
+		return &actorKey{}, sql.ErrNoRows
+	}
+	return &key, nil
+}
+
+func (m *memoryDataMapper) createActorKey(key *actorKey) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.keys[key.UserID]; !ok {
+		m.keys[key.UserID] = *key
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) addFollower(f *follower) error {
+	m.Lock()
+	defer m.Unlock()
+	f.ID = m.nextID()
+	m.followers[f.UserID] = append(m.followers[f.UserID], *f)
+	return nil
+}
+
+func (m *memoryDataMapper) getFollowers(userID int64) ([]follower, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.followers[userID], nil
+}
+
+func (m *memoryDataMapper) countFollowers(userID int64) (int64, error) {
+	followers, err := m.getFollowers(userID)
+	return int64(len(followers)), err
+}
+
+func (m *memoryDataMapper) isBlocked(userID int64, targetID int64, includeMuted bool) (bool, error) {
+	return false, nil
+}
+
+func (m *memoryDataMapper) createSession(s *session) error {
+	m.Lock()
+	defer m.Unlock()
+	s.ID = m.nextID()
+	s.CreatedAt = time.Now()
+	s.LastSeenAt = s.CreatedAt
+	m.sessions[s.Key] = *s
+	return nil
+}
+
+func (m *memoryDataMapper) getSession(key string) (*session, error) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.sessions[key]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &s, nil
+}
+
+func (m *memoryDataMapper) touchSession(s *session) error {
+	m.Lock()
+	defer m.Unlock()
+	s.LastSeenAt = time.Now()
+	m.sessions[s.Key] = *s
+	return nil
+}
+
+func (m *memoryDataMapper) deleteSession(userID int64, sessionID int64) error {
+	m.Lock()
+	defer m.Unlock()
+	for key, s := range m.sessions {
+		if s.ID == sessionID && s.UserID == userID {
+			delete(m.sessions, key)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) rotateSessionKey(userID int64, sessionID int64, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	for oldKey, s := range m.sessions {
+		if s.ID == sessionID && s.UserID == userID {
+			delete(m.sessions, oldKey)
+			s.Key = key
+			m.sessions[key] = s
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDataMapper) deleteUserSessions(userID int64) error {
+	m.Lock()
+	defer m.Unlock()
+	for key, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataMapper) deleteOtherSessions(userID int64, sessionID int64) error {
+	m.Lock()
+	defer m.Unlock()
+	for key, s := range m.sessions {
+		if s.UserID == userID && s.ID != sessionID {
+			delete(m.sessions, key)
+		}
+	}
+	return nil
+}
+
+// creates a user with a session, returning the auth token
+func (m *memoryDataMapper) login(u *user) (string, error) {
+	if err := m.createUser(u); err != nil {
+		return "", err
+	}
+	s := &session{UserID: u.ID, Key: fmt.Sprintf("session-%d", u.ID)}
+	if err := m.createSession(s); err != nil {
+		return "", err
+	}
+	return (&fakeSessionManager{}).createToken(u.ID, s.Key)
+}
+
+// Stores uploads and thumbnails in memory
+type memoryFileStorage struct {
+	sync.Mutex
+	processor  imageProcessor
+	files      map[string][]byte
+	thumbnails map[string][]byte
+}
+
+func newMemoryFileStorage(processor imageProcessor) *memoryFileStorage {
+	return &memoryFileStorage{
+		processor:  processor,
+		files:      make(map[string][]byte),
+		thumbnails: make(map[string][]byte),
+	}
+}
+
+func (f *memoryFileStorage) store(src readable, filename, contentType string) error {
+	thumb := &bytes.Buffer{}
+	if err := f.processor.thumbnail(src, thumb, contentType); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.files[filename] = body
+	f.thumbnails[filename] = thumb.Bytes()
+	return nil
+}
+
+func (f *memoryFileStorage) clean(filename string) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.files[filename]; !ok {
+		return os.ErrNotExist
+	}
+	delete(f.files, filename)
+	delete(f.thumbnails, filename)
+	return nil
+}
+
+func (f *memoryFileStorage) list() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	var names []string
+	for name := range f.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (f memoryFile) Close() error { return nil }
+
+func (f *memoryFileStorage) open(filename string) (readableFile, error) {
+	f.Lock()
+	defer f.Unlock()
+	body, ok := f.files[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memoryFile{bytes.NewReader(body)}, nil
+}
+
+func (f *memoryFileStorage) openThumbnail(filename string) (readableFile, error) {
+	f.Lock()
+	defer f.Unlock()
+	body, ok := f.thumbnails[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memoryFile{bytes.NewReader(body)}, nil
+}
+
+// "thumbnails" are a copy of the image, so no decoding is needed
+type fakeImageProcessor struct{}
+
+func (p *fakeImageProcessor) thumbnail(src io.Reader, dst io.Writer, contentType string) error {
+	if !isAllowedContentType(contentType) {
+		return errors.New("invalid content type:" + contentType)
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+func (m *memoryDataMapper) getBadges(userID int64) ([]badge, error) {
+	m.Lock()
+	defer m.Unlock()
+	var badges []badge
+	for _, b := range m.badges {
+		if b.UserID == userID {
+			badges = append(badges, b)
+		}
+	}
+	return badges, nil
+}
+
+// nothing is pinned to the homepage in memory
+func (m *memoryDataMapper) getActiveHomepagePins(now time.Time, userID int64) ([]homepagePin, error) {
+	return nil, nil
+}
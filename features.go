@@ -0,0 +1,279 @@
+package photoshare
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// features that can be switched off or rolled out gradually
+const (
+	featureRegistration = "registration"
+	featureUploads      = "uploads"
+	featureComments     = "comments"
+	featureOAuth        = "oauth"
+	featureFederation   = "federation"
+	featureMaintenance  = "maintenance"
+)
+
+// features are enabled for all users unless configured otherwise, except
+// federation which publishes photos to other servers, and maintenance (see
+// maintenance.go)
+var defaultFeatures = map[string]int{
+	featureRegistration: 100,
+	featureUploads:      100,
+	featureComments:     100,
+	featureOAuth:        100,
+	featureFederation:   0,
+	featureMaintenance:  0,
+}
+
+// features checked before users log in, or for no user, so that they can
+// only be switched on or off: a rollout would leave them off for everyone
+var wholeFeatures = map[string]bool{
+	featureRegistration: true,
+	featureOAuth:        true,
+	featureMaintenance:  true,
+}
+
+// returns false if the feature can't be rolled out to the percentage
+func isValidRollout(name string, percentage int) bool {
+	if percentage < 0 || percentage > 100 {
+		return false
+	}
+	return !wholeFeatures[name] || percentage == 0 || percentage == 100
+}
+
+// how long flags stored in the database are cached
+const featureFlagsRefresh = 30 * time.Second
+
+type featureFlags interface {
+	isEnabled(string, *user) bool
+	getAll() (map[string]int, error)
+	set(string, int) error
+	forSite(int64) featureFlags
+}
+
+// Parses the FEATURES setting, a comma-separated list of features with an
+// optional rollout percentage, e.g. "uploads:25,-oauth". A "-" prefix
+// disables the feature. Registration and OAuth can't be rolled out, only
+// enabled or disabled.
+func parseFeatures(s string) (map[string]int, error) {
+	features := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "-") {
+			features[item[1:]] = 0
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		percentage := 100
+		if len(parts) == 2 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || !isValidRollout(parts[0], n) {
+				return features, fmt.Errorf("invalid percentage for feature %s", parts[0])
+			}
+			percentage = n
+		}
+		features[parts[0]] = percentage
+	}
+	return features, nil
+}
+
+// decides if the user is within the rollout percentage of a feature. Users
+// are bucketed by ID, so the same user always gets the same result;
+// anonymous users are never in a partial rollout.
+func inRollout(name string, percentage int, user *user) bool {
+	if percentage >= 100 {
+		return true
+	}
+	if percentage <= 0 || user == nil || user.ID == 0 {
+		return false
+	}
+	bucket := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s:%d", name, user.ID))) % 100
+	return int(bucket) < percentage
+}
+
+// flags stored in the database for the site override the configured flags,
+// which override the defaults
+type defaultFeatureFlags struct {
+	datamapper dataMapper // scoped to the site
+	siteID     int64
+	configured map[string]int
+	stored     *storedFeatureFlags
+}
+
+// the flags stored for each site, shared by the featureFlags of the sites
+type storedFeatureFlags struct {
+	sync.RWMutex
+	sites    map[int64]map[string]int
+	loadedAt map[int64]time.Time
+}
+
+func newFeatureFlags(cfg *config, datamapper dataMapper) (featureFlags, error) {
+	configured, err := parseFeatures(cfg.Features)
+	if err != nil {
+		return nil, err
+	}
+	return &defaultFeatureFlags{
+		datamapper: datamapper,
+		siteID:     defaultSiteID,
+		configured: configured,
+		stored: &storedFeatureFlags{
+			sites:    make(map[int64]map[string]int),
+			loadedAt: make(map[int64]time.Time),
+		},
+	}, nil
+}
+
+// returns the flags of the site
+func (f *defaultFeatureFlags) forSite(siteID int64) featureFlags {
+	return &defaultFeatureFlags{
+		datamapper: f.datamapper.forSite(siteID),
+		siteID:     siteID,
+		configured: f.configured,
+		stored:     f.stored,
+	}
+}
+
+func (f *defaultFeatureFlags) getStored() (map[string]int, error) {
+	f.stored.RLock()
+	stored, loadedAt := f.stored.sites[f.siteID], f.stored.loadedAt[f.siteID]
+	f.stored.RUnlock()
+
+	if stored != nil && time.Since(loadedAt) < featureFlagsRefresh {
+		return stored, nil
+	}
+
+	flags, err := f.datamapper.getFeatureFlags()
+	if err != nil {
+		return stored, err
+	}
+
+	stored = make(map[string]int)
+	for _, flag := range flags {
+		stored[flag.Name] = flag.Percentage
+	}
+
+	f.stored.Lock()
+	f.stored.sites[f.siteID], f.stored.loadedAt[f.siteID] = stored, time.Now()
+	f.stored.Unlock()
+
+	return stored, nil
+}
+
+func (f *defaultFeatureFlags) getAll() (map[string]int, error) {
+	stored, err := f.getStored()
+	if err != nil {
+		return nil, err
+	}
+	features := make(map[string]int)
+	for _, values := range []map[string]int{defaultFeatures, f.configured, stored} {
+		for name, percentage := range values {
+			features[name] = percentage
+		}
+	}
+	return features, nil
+}
+
+func (f *defaultFeatureFlags) isEnabled(name string, user *user) bool {
+	features, err := f.getAll()
+	if err != nil {
+		// fall back to the configured flags if the database is unavailable
+		logError(err)
+		features = make(map[string]int)
+		for _, values := range []map[string]int{defaultFeatures, f.configured} {
+			for name, percentage := range values {
+				features[name] = percentage
+			}
+		}
+	}
+	percentage, ok := features[name]
+	if !ok {
+		return false
+	}
+	return inRollout(name, percentage, user)
+}
+
+func (f *defaultFeatureFlags) set(name string, percentage int) error {
+	if err := f.datamapper.setFeatureFlag(&featureFlag{Name: name, Percentage: percentage}); err != nil {
+		return err
+	}
+	f.stored.Lock()
+	delete(f.stored.sites, f.siteID)
+	f.stored.Unlock()
+	return nil
+}
+
+// returns the names of the features enabled for the current user
+func getFeatures(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	features, err := ctx.features.getAll()
+	if err != nil {
+		return err
+	}
+	enabled := []string{}
+	for name, percentage := range features {
+		if inRollout(name, percentage, ctx.user) {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return renderJSON(w, enabled, http.StatusOK)
+}
+
+func getFeatureFlags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	features, err := ctx.features.getAll()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, features, http.StatusOK)
+}
+
+func setFeatureFlag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Percentage int `json:"percentage"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	name := ctx.params.get("name")
+
+	if _, ok := defaultFeatures[name]; !ok {
+		return httpError{http.StatusNotFound, "No such feature"}
+	}
+	if s.Percentage < 0 || s.Percentage > 100 {
+		return httpError{http.StatusBadRequest, "Percentage must be between 0 and 100"}
+	}
+	if !isValidRollout(name, s.Percentage) {
+		return httpError{http.StatusBadRequest, "This feature can only be enabled or disabled"}
+	}
+
+	if err := ctx.features.set(name, s.Percentage); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "feature", 0, fmt.Sprintf("%s=%d", name, s.Percentage)); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "Feature updated")
+}
+
+// returns an error if the feature is disabled for the current user
+func (ctx *context) requireFeature(name string) error {
+	if !ctx.features.isEnabled(name, ctx.user) {
+		return httpError{http.StatusForbidden, "This feature is not available"}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseFeatures(t *testing.T) {
+	features, err := parseFeatures("registration, uploads:25,-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features["registration"] != 100 {
+		t.Error("Registration should be fully enabled")
+	}
+	if features["uploads"] != 25 {
+		t.Error("Uploads should be rolled out to 25%")
+	}
+	if features["oauth"] != 0 {
+		t.Error("OAuth should be disabled")
+	}
+
+	if _, err := parseFeatures("uploads:200"); err == nil {
+		t.Error("Percentage over 100 should be invalid")
+	}
+	if _, err := parseFeatures("registration:25"); err == nil {
+		t.Error("Features checked before login should not be rolled out")
+	}
+}
+
+func TestInRollout(t *testing.T) {
+	u := &user{ID: 1}
+	if !inRollout("uploads", 100, nil) {
+		t.Error("Fully enabled features should be enabled for anonymous users")
+	}
+	if inRollout("uploads", 0, u) {
+		t.Error("Disabled features should not be enabled")
+	}
+	if inRollout("uploads", 50, u) != inRollout("uploads", 50, u) {
+		t.Error("Rollout should be consistent for the same user")
+	}
+
+	var enabled int
+	for i := 1; i <= 1000; i++ {
+		if inRollout("uploads", 50, &user{ID: int64(i)}) {
+			enabled++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Errorf("About half of users should be in rollout, got %d", enabled)
+	}
+}
+
+// stores the flags of each site
+type siteFlagsDataMapper struct {
+	mockDataMapper
+	siteID int64
+	flags  map[int64][]featureFlag
+}
+
+func (m *siteFlagsDataMapper) forSite(siteID int64) dataMapper {
+	return &siteFlagsDataMapper{siteID: siteID, flags: m.flags}
+}
+
+func (m *siteFlagsDataMapper) getFeatureFlags() ([]featureFlag, error) {
+	return m.flags[m.siteID], nil
+}
+
+func (m *siteFlagsDataMapper) setFeatureFlag(flag *featureFlag) error {
+	m.flags[m.siteID] = append(m.flags[m.siteID], *flag)
+	return nil
+}
+
+func TestFeatureFlagsForSite(t *testing.T) {
+	dm := &siteFlagsDataMapper{siteID: defaultSiteID, flags: make(map[int64][]featureFlag)}
+	features, err := newFeatureFlags(&config{}, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := features.forSite(2)
+
+	if !other.isEnabled(featureUploads, nil) {
+		t.Fatal("Uploads should be enabled by default")
+	}
+	if err := features.forSite(defaultSiteID).set(featureUploads, 0); err != nil {
+		t.Fatal(err)
+	}
+	if features.isEnabled(featureUploads, nil) {
+		t.Error("Uploads should be disabled for the site")
+	}
+	if !other.isEnabled(featureUploads, nil) {
+		t.Error("Uploads should still be enabled for other sites")
+	}
+}
+
+func TestSetUnknownFeatureFlag(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "admin", Email: "admin@example.com", IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, code := range map[string]int{"comments": http.StatusOK, "coments": http.StatusNotFound} {
+		req, _ := http.NewRequest("PUT", "http://localhost/api/admin/features/"+name, strings.NewReader(`{"percentage": 0}`))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+
+		if res.Code != code {
+			t.Errorf("Expected %d for %s, got %d", code, name, res.Code)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package photoshare
 import (
 	"fmt"
 	"github.com/gorilla/feeds"
+	"html"
 	"net/http"
 	"strconv"
 	"time"
 )
 
-func photoFeed(w http.ResponseWriter,
+func photoFeed(cfg *config,
+	w http.ResponseWriter,
 	r *http.Request,
 	title string,
 	description string,
@@ -30,7 +32,7 @@ func photoFeed(w http.ResponseWriter,
 			Id:          strconv.FormatInt(photo.ID, 10),
 			Title:       photo.Title,
 			Link:        &feeds.Link{Href: fmt.Sprintf("%s/#/detail/%d", baseURL, photo.ID)},
-			Description: fmt.Sprintf("<img src=\"%s/uploads/thumbnails/%s\">", baseURL, photo.Filename),
+			Description: fmt.Sprintf("<img src=\"%s\">", html.EscapeString(uploadURL(cfg, baseURL, "thumbnails/"+photo.Filename))),
 			Created:     photo.CreatedAt,
 		}
 		feed.Add(item)
@@ -45,24 +47,24 @@ func photoFeed(w http.ResponseWriter,
 
 func latestFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	photos, err := ctx.datamapper.getPhotos(newPage(1), "")
+	photos, err := ctx.datamapper.getPhotos(newPage(1), newOrdering(orderNew, ""), 0)
 
 	if err != nil {
 		return err
 	}
 
-	return photoFeed(w, r, "Latest photos", "Most recent photos", "/latest", photos)
+	return photoFeed(ctx.cfg, w, r, "Latest photos", "Most recent photos", "/latest", photos)
 }
 
 func popularFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	photos, err := ctx.datamapper.getPhotos(newPage(1), "votes")
+	photos, err := ctx.datamapper.getPhotos(newPage(1), newOrdering(orderTop, ""), 0)
 
 	if err != nil {
 		return err
 	}
 
-	return photoFeed(w, r, "Popular photos", "Most upvoted photos", "/popular", photos)
+	return photoFeed(ctx.cfg, w, r, "Popular photos", "Most upvoted photos", "/popular", photos)
 }
 
 func ownerFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
@@ -76,10 +78,29 @@ func ownerFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	description := "List of feeds for " + owner.Name
 	link := fmt.Sprintf("/owner/%d/%s", ownerID, owner.Name)
 
-	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), ownerID)
+	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), ownerID, 0)
 
 	if err != nil {
 		return err
 	}
-	return photoFeed(w, r, title, description, link, photos)
+	return photoFeed(ctx.cfg, w, r, title, description, link, photos)
+}
+
+func groupFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	groupID := ctx.params.getInt("id")
+	group, err := ctx.datamapper.getGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	title := "Feeds for " + group.Name
+	description := "Photos posted to " + group.Name
+	link := fmt.Sprintf("/groups/%d", groupID)
+
+	photos, err := ctx.datamapper.getGroupPhotos(newPage(1), groupID, 0)
+
+	if err != nil {
+		return err
+	}
+	return photoFeed(ctx.cfg, w, r, title, description, link, photos)
 }
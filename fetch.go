@@ -0,0 +1,205 @@
+package photoshare
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Fetching images from user-supplied URLs must not give access to the
+// server's network, so only public addresses are dialled, checked after DNS
+// resolution so a hostname cannot point at an internal address.
+
+const (
+	fetchTimeout      = 30 * time.Second
+	fetchMaxRedirects = 3
+)
+
+var errBlockedAddress = errors.New("address not allowed")
+
+var blockedNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		blockedNetworks = append(blockedNetworks, network)
+	}
+}
+
+// returns true if the IP is not a public address
+func isBlockedIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+}
+
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return httpError{http.StatusBadRequest, "Only http and https URLs are allowed"}
+	}
+	if u.Host == "" {
+		return httpError{http.StatusBadRequest, "Invalid URL"}
+	}
+	return nil
+}
+
+// fetches an image of at most maxSize bytes, returning the body and the
+// content type detected from the body
+func fetchImage(client *http.Client, rawURL string, maxSize int64) ([]byte, string, error) {
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", httpError{http.StatusBadRequest, "Invalid URL"}
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, "", err
+	}
+
+	errFetch := httpError{http.StatusBadRequest, "Unable to fetch image"}
+
+	res, err := client.Get(u.String())
+	if err != nil {
+		if err, ok := err.(*url.Error); ok {
+			if err, ok := err.Err.(httpError); ok {
+				return nil, "", err
+			}
+		}
+		logError(err)
+		return nil, "", errFetch
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", errFetch
+	}
+	if res.ContentLength > maxSize {
+		return nil, "", httpError{http.StatusRequestEntityTooLarge, "Image is too large"}
+	}
+
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: maxSize + 1})
+	if err != nil {
+		return nil, "", errFetch
+	}
+	if int64(len(body)) > maxSize {
+		return nil, "", httpError{http.StatusRequestEntityTooLarge, "Image is too large"}
+	}
+
+	contentType := http.DetectContentType(body)
+	if !isAllowedContentType(contentType) {
+		return nil, "", httpError{http.StatusBadRequest, fmt.Sprintf("Unsupported image type %s", contentType)}
+	}
+	return body, contentType, nil
+}
+
+func importPhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.requireFeature(featureUploads); err != nil {
+		return err
+	}
+
+	s := &struct {
+		URL       string   `json:"url"`
+		Title     string   `json:"title"`
+		Tags      []string `json:"tags"`
+		ExpiresAt string   `json:"expiresAt"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	expiresAt, err := parseExpiry(s.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	progress, err := newUploadProgress(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	body, contentType, err := fetchImage(ctx.fetcher, s.URL, ctx.cfg.MaxUploadSize)
+	if err != nil {
+		progress.finish(nil, err)
+		return err
+	}
+
+	cost, err := checkImageSize(ctx.cfg, bytes.NewReader(body))
+	if err != nil {
+		progress.finish(nil, err)
+		return err
+	}
+
+	photo, err := ctx.processing.run(&processingJob{ownerID: ctx.user.ID, cost: cost, progress: progress,
+		run: func(job *processingJob) ([]*photo, error) {
+			p, err := savePhoto(ctx, r, bytes.NewReader(body), contentType, s.Title, s.Tags, expiresAt, job)
+			if err != nil {
+				return nil, err
+			}
+			return []*photo{p}, nil
+		}})
+	progress.finish(photo, err)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photo, http.StatusCreated)
+}
@@ -0,0 +1,114 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Users follow other users and tags; their feed has the photos of both,
+// newest first unless ordered otherwise, each photo once.
+
+// Feed pages are cached under a version of the user's feed, changed when
+// they follow or unfollow, so that only their own pages are dropped.
+func feedVersionKey(userID int64) string {
+	return fmt.Sprintf("feed:version:user:%d", userID)
+}
+
+func getFeedVersion(ctx *context, userID int64) (string, error) {
+	version, err := ctx.cache.get(feedVersionKey(userID), func() (interface{}, error) {
+		return "", nil
+	})
+	if err != nil {
+		return "", err
+	}
+	s, _ := version.(string)
+	return s, nil
+}
+
+func clearFeedCache(ctx *context, userID int64) {
+	version := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := ctx.cache.set(feedVersionKey(userID), version); err != nil {
+		logError(err)
+	}
+}
+
+func getFollows(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	follows, err := ctx.datamapper.getFollows(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, follows, http.StatusOK)
+}
+
+func followUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("userID"))
+	if err != nil {
+		return err
+	}
+
+	if target.ID == ctx.user.ID {
+		return httpError{http.StatusBadRequest, "You can't follow yourself"}
+	}
+
+	followed, err := ctx.datamapper.followUser(ctx.user.ID, target.ID)
+	if err != nil {
+		return err
+	}
+	clearFeedCache(ctx, ctx.user.ID)
+	if followed {
+		if err := notifyFollow(ctx, r, target, ""); err != nil {
+			return err
+		}
+	}
+	return renderString(w, http.StatusOK, "User followed")
+}
+
+func unfollowUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.unfollowUser(ctx.user.ID, ctx.params.getInt("userID")); err != nil {
+		return err
+	}
+	clearFeedCache(ctx, ctx.user.ID)
+	return renderString(w, http.StatusOK, "User unfollowed")
+}
+
+func followTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tag, err := ctx.datamapper.getTagDetail(ctx.params.get("name"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.followTag(ctx.user.ID, tag.ID); err != nil {
+		return err
+	}
+	clearFeedCache(ctx, ctx.user.ID)
+	return renderString(w, http.StatusOK, "Tag followed")
+}
+
+func unfollowTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.unfollowTag(ctx.user.ID, ctx.params.get("name")); err != nil {
+		return err
+	}
+	clearFeedCache(ctx, ctx.user.ID)
+	return renderString(w, http.StatusOK, "Tag unfollowed")
+}
+
+// returns the photos of the users and tags the user follows
+func getFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	page := getPage(r)
+	order := getOrdering(r)
+	userID := ctx.user.ID
+	version, err := getFeedVersion(ctx, userID)
+	if err != nil {
+		return err
+	}
+	cacheKey := fmt.Sprintf("photos:feed:%s:%s:page:%d:exact:%t:user:%d:version:%s", order.sort, order.window, page.index, page.exact, userID, version)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		return ctx.datamapper.getFeedPhotos(page, order, userID)
+	})
+}
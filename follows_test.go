@@ -0,0 +1,161 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type followsDataMapper struct {
+	mockDataMapper
+	followedUser, followedTag int64
+	notifications             []notification
+}
+
+func (m *followsDataMapper) getActiveUser(userID int64) (*user, error) {
+	return &user{ID: userID, Name: "owner"}, nil
+}
+
+func (m *followsDataMapper) getTagDetail(name string) (*tagDetail, error) {
+	return &tagDetail{ID: 3, Name: name, NumPhotos: 1}, nil
+}
+
+func (m *followsDataMapper) followUser(userID int64, targetID int64) (bool, error) {
+	followed := m.followedUser != targetID
+	m.followedUser = targetID
+	return followed, nil
+}
+
+func (m *followsDataMapper) createNotification(n *notification) error {
+	m.notifications = append(m.notifications, *n)
+	return nil
+}
+
+func (m *followsDataMapper) followTag(userID int64, tagID int64) error {
+	m.followedTag = tagID
+	return nil
+}
+
+func (m *followsDataMapper) isFollowingTag(userID int64, tagID int64) (bool, error) {
+	return tagID == m.followedTag, nil
+}
+
+func newFollowsContext(dm dataMapper, u *user) *context {
+	p := &params{make(map[string]string)}
+	p.vars["userID"] = "2"
+	p.vars["name"] = "birds"
+	return &context{
+		app:        &app{cfg: &config{}, datamapper: dm},
+		params:     p,
+		cache:      &fakeCache{},
+		site:       &site{ID: 1},
+		user:       u,
+		datamapper: dm,
+	}
+}
+
+func TestFollowUser(t *testing.T) {
+
+	dm := &followsDataMapper{}
+	req, _ := http.NewRequest("POST", "http://localhost/api/user/follows/2", nil)
+
+	err := followUser(newFollowsContext(dm, &user{ID: 2, IsAuthenticated: true}), httptest.NewRecorder(), req)
+	if e, ok := err.(httpError); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("Expected users not to follow themselves, got %v", err)
+	}
+
+	if err := followUser(newFollowsContext(dm, &user{ID: 1, IsAuthenticated: true}), httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if dm.followedUser != 2 {
+		t.Errorf("Expected the user to be followed, got %d", dm.followedUser)
+	}
+	if len(dm.notifications) != 1 {
+		t.Fatalf("Expected the followed user to be notified, got %+v", dm.notifications)
+	}
+	if n := dm.notifications[0]; n.UserID != 2 || n.Type != notificationFollow ||
+		n.SenderID == nil || *n.SenderID != 1 || n.PhotoID != nil {
+		t.Errorf("Expected a follow notification from the user, got %+v", n)
+	}
+
+	// following again notifies no one
+	if err := followUser(newFollowsContext(dm, &user{ID: 1, IsAuthenticated: true}), httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.notifications) != 1 {
+		t.Errorf("Expected no notification when already following, got %+v", dm.notifications)
+	}
+}
+
+func TestFollowTag(t *testing.T) {
+
+	dm := &followsDataMapper{}
+	c := newFollowsContext(dm, &user{ID: 1, IsAuthenticated: true})
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/tags/birds/follow", nil)
+	if err := followTag(c, httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if dm.followedTag != 3 {
+		t.Errorf("Expected the tag to be followed, got %d", dm.followedTag)
+	}
+
+	// the tag page shows the tag as followed
+	req, _ = http.NewRequest("GET", "http://localhost/api/tags/birds/photos", nil)
+	res := httptest.NewRecorder()
+	if err := getTagPhotos(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	result := &struct{ Following bool }{}
+	if err := json.Unmarshal(res.Body.Bytes(), result); err != nil || !result.Following {
+		t.Errorf("Expected the tag to be followed, got %s", res.Body)
+	}
+}
+
+// keeps what is set in a map, and records clears
+type mapCache struct {
+	fakeCache
+	values  map[string]interface{}
+	cleared bool
+}
+
+func (c *mapCache) set(key string, obj interface{}) ([]byte, error) {
+	c.values[key] = obj
+	return json.Marshal(obj)
+}
+
+func (c *mapCache) get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	if obj, ok := c.values[key]; ok {
+		return obj, nil
+	}
+	return fn()
+}
+
+func (c *mapCache) clear() error {
+	c.cleared = true
+	return nil
+}
+
+func TestFollowDropsOnlyOwnFeed(t *testing.T) {
+
+	dm := &followsDataMapper{}
+	cache := &mapCache{values: map[string]interface{}{"photos:latest": "cached"}}
+	ctx := newFollowsContext(dm, &user{ID: 1, IsAuthenticated: true})
+	ctx.cache = cache
+
+	before, _ := getFeedVersion(ctx, 1)
+	req, _ := http.NewRequest("POST", "http://localhost/api/user/follows/tags/birds", nil)
+	if err := followTag(ctx, httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := getFeedVersion(ctx, 1); after == before {
+		t.Error("Expected the feed of the user to get a new version")
+	}
+	if other, _ := getFeedVersion(ctx, 2); other != "" {
+		t.Errorf("Expected the feeds of other users kept, got version %q", other)
+	}
+	if cache.cleared || cache.values["photos:latest"] != "cached" {
+		t.Error("Expected the rest of the cache kept")
+	}
+}
@@ -0,0 +1,68 @@
+package photoshare
+
+import (
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The camera and lens of a photo are read from the EXIF data of the upload,
+// so users can browse the photos taken with a camera or lens.
+
+// returns the camera and lens in the EXIF data of the image, or empty
+// strings if the image has none
+func readGear(r io.Reader) (camera string, lens string) {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return "", ""
+	}
+	return gearName(exifString(x, exif.Make), exifString(x, exif.Model)), exifString(x, exif.LensModel)
+}
+
+func exifString(x *exif.Exif, field exif.FieldName) string {
+	tag, err := x.Get(field)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(strings.Trim(s, "\x00")), " ")
+}
+
+// names the camera by its model, prefixed with the make unless the model
+// already starts with it, e.g. "FUJIFILM X-T3" but "Canon EOS 5D" rather
+// than "Canon Canon EOS 5D"
+func gearName(maker, model string) string {
+	if model == "" {
+		return ""
+	}
+	brand := strings.Fields(maker)
+	if len(brand) == 0 || strings.HasPrefix(strings.ToUpper(model), strings.ToUpper(brand[0])) {
+		return model
+	}
+	return brand[0] + " " + model
+}
+
+func getGear(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return ctx.cache.render(w, http.StatusOK, "gear", func() (interface{}, error) {
+		return ctx.datamapper.getGear()
+	})
+}
+
+func getGearPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	name := ctx.params.get("model")
+	page := getPage(r)
+	order := getOrdering(r)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:gear:%s:%s:%s:page:%d:exact:%t:user:%d", url.QueryEscape(name), order.sort, order.window, page.index, page.exact, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		return ctx.datamapper.getPhotosByGear(page, name, order, userID)
+	})
+}
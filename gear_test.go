@@ -0,0 +1,80 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// builds a JPEG with only an EXIF segment holding the make, model and lens,
+// each longer than 4 bytes so they are stored after the IFDs
+func exifJPEG(maker, model, lens string) []byte {
+
+	le := binary.LittleEndian
+	tiff := &bytes.Buffer{}
+
+	const ifd0, exifIFD, data = 8, 8 + 2 + 3*12 + 4, 8 + 2 + 3*12 + 4 + 2 + 12 + 4
+
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(tiff, le, tag)
+		binary.Write(tiff, le, typ)
+		binary.Write(tiff, le, count)
+		binary.Write(tiff, le, value)
+	}
+
+	tiff.WriteString("II")
+	binary.Write(tiff, le, uint16(42))
+	binary.Write(tiff, le, uint32(ifd0))
+
+	binary.Write(tiff, le, uint16(3))
+	entry(0x010F, 2, uint32(len(maker)+1), data)
+	entry(0x0110, 2, uint32(len(model)+1), uint32(data+len(maker)+1))
+	entry(0x8769, 4, 1, exifIFD)
+	binary.Write(tiff, le, uint32(0))
+
+	binary.Write(tiff, le, uint16(1))
+	entry(0xA434, 2, uint32(len(lens)+1), uint32(data+len(maker)+len(model)+2))
+	binary.Write(tiff, le, uint32(0))
+
+	tiff.WriteString(maker + "\x00" + model + "\x00" + lens + "\x00")
+
+	jpeg := &bytes.Buffer{}
+	jpeg.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(jpeg, binary.BigEndian, uint16(2+6+tiff.Len()))
+	jpeg.WriteString("Exif\x00\x00")
+	jpeg.Write(tiff.Bytes())
+	jpeg.Write([]byte{0xFF, 0xD9})
+	return jpeg.Bytes()
+}
+
+func TestReadGear(t *testing.T) {
+	camera, lens := readGear(bytes.NewReader(exifJPEG("FUJIFILM", "X-T3", "XF23mmF2 R WR")))
+	if camera != "FUJIFILM X-T3" {
+		t.Errorf("Expected camera FUJIFILM X-T3, got %q", camera)
+	}
+	if lens != "XF23mmF2 R WR" {
+		t.Errorf("Expected lens XF23mmF2 R WR, got %q", lens)
+	}
+}
+
+func TestReadGearWithoutExif(t *testing.T) {
+	if camera, lens := readGear(bytes.NewReader([]byte{0xFF, 0xD8, 0xFF, 0xD9})); camera != "" || lens != "" {
+		t.Errorf("Expected no gear, got %q, %q", camera, lens)
+	}
+}
+
+func TestGearName(t *testing.T) {
+	for _, tc := range []struct {
+		maker, model, name string
+	}{
+		{"Canon", "Canon EOS 5D Mark IV", "Canon EOS 5D Mark IV"},
+		{"NIKON CORPORATION", "NIKON D750", "NIKON D750"},
+		{"Apple", "iPhone 12", "Apple iPhone 12"},
+		{"", "X100V", "X100V"},
+		{"Sony", "", ""},
+	} {
+		if name := gearName(tc.maker, tc.model); name != tc.name {
+			t.Errorf("%q %q: expected %q, got %q", tc.maker, tc.model, tc.name, name)
+		}
+	}
+}
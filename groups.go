@@ -0,0 +1,337 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Groups are community boards created by users. Members cross-post photos
+// from their own stream to the group stream. Groups may require moderators
+// to approve new members; moderators can also remove members and photos.
+
+// returns the membership of the current user, or nil if not a member
+func getMembership(ctx *context, groupID int64) (*groupMember, error) {
+	if !ctx.user.IsAuthenticated {
+		return nil, nil
+	}
+	member, err := ctx.datamapper.getGroupMember(groupID, ctx.user.ID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return member, nil
+}
+
+// returns the group of the route if the current user can moderate it
+func getModeratedGroup(ctx *context) (*group, error) {
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return nil, err
+	}
+	member, err := getMembership(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.permit(member.isModerator() || ctx.user.IsAdmin, "You must be a moderator of this group"); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func getGroups(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	groups, err := ctx.datamapper.getGroups(getPage(r))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, groups, http.StatusOK)
+}
+
+func createGroup(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Name             string `json:"name"`
+		Description      string `json:"description"`
+		RequiresApproval bool   `json:"requiresApproval"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	group := &group{
+		OwnerID:          ctx.user.ID,
+		Name:             s.Name,
+		Description:      s.Description,
+		RequiresApproval: s.RequiresApproval,
+	}
+
+	if err := ctx.validate(group, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createGroup(group); err != nil {
+		return err
+	}
+	return renderJSON(w, group, http.StatusCreated)
+}
+
+// returns the group with the membership of the current user
+func getGroupDetail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroupDetail(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if group.Membership, err = getMembership(ctx, group.ID); err != nil {
+		return err
+	}
+	return renderJSON(w, group, http.StatusOK)
+}
+
+// joins the group, or asks to join if moderators approve new members
+func joinGroup(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	member, err := getMembership(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	if member != nil {
+		return renderJSON(w, member, http.StatusOK)
+	}
+
+	member = &groupMember{
+		GroupID: group.ID,
+		UserID:  ctx.user.ID,
+		Role:    groupRoleMember,
+		Status:  groupStatusActive,
+	}
+	if group.RequiresApproval {
+		member.Status = groupStatusPending
+	}
+
+	if err := ctx.datamapper.saveGroupMember(member); err != nil {
+		return err
+	}
+	return renderJSON(w, member, http.StatusCreated)
+}
+
+func leaveGroup(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if group.OwnerID == ctx.user.ID {
+		return httpError{http.StatusBadRequest, "The owner cannot leave the group"}
+	}
+
+	if err := ctx.datamapper.removeGroupMember(group.ID, ctx.user.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Left group")
+}
+
+// returns the active members; moderators can also list pending members
+// with ?status=pending
+func getGroupMembers(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	status := groupStatusActive
+
+	if r.FormValue("status") == groupStatusPending {
+		if _, err := getModeratedGroup(ctx); err != nil {
+			return err
+		}
+		status = groupStatusPending
+	}
+
+	members, err := ctx.datamapper.getGroupMembers(ctx.params.getInt("id"), status)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, members, http.StatusOK)
+}
+
+func approveGroupMember(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := getModeratedGroup(ctx)
+	if err != nil {
+		return err
+	}
+
+	member, err := ctx.datamapper.getGroupMember(group.ID, ctx.params.getInt("userID"))
+	if err != nil {
+		return err
+	}
+
+	member.Status = groupStatusActive
+
+	if err := ctx.datamapper.saveGroupMember(member); err != nil {
+		return err
+	}
+	return renderJSON(w, member, http.StatusOK)
+}
+
+// removes a member, or rejects a pending member
+func removeGroupMember(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := getModeratedGroup(ctx)
+	if err != nil {
+		return err
+	}
+
+	userID := ctx.params.getInt("userID")
+	if userID == group.OwnerID {
+		return httpError{http.StatusBadRequest, "The owner cannot be removed"}
+	}
+
+	if err := ctx.datamapper.removeGroupMember(group.ID, userID); err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("group=%d", group.ID)
+	if err := writeAuditLog(ctx, "remove_group_member", userID, details); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Member removed")
+}
+
+// makes a member a moderator, or a moderator a member. Only the owner can
+// change moderators.
+func setGroupModerator(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.permit(group.OwnerID == ctx.user.ID || ctx.user.IsAdmin,
+		"Only the owner can change moderators"); err != nil {
+		return err
+	}
+
+	s := &struct {
+		Moderator bool `json:"moderator"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	member, err := ctx.datamapper.getGroupMember(group.ID, ctx.params.getInt("userID"))
+	if err != nil {
+		return err
+	}
+
+	if !member.isActive() {
+		return httpError{http.StatusBadRequest, "Member has not been approved"}
+	}
+	if member.UserID == group.OwnerID {
+		return httpError{http.StatusBadRequest, "The owner is always a moderator"}
+	}
+
+	member.Role = groupRoleMember
+	if s.Moderator {
+		member.Role = groupRoleModerator
+	}
+
+	if err := ctx.datamapper.saveGroupMember(member); err != nil {
+		return err
+	}
+	return renderJSON(w, member, http.StatusOK)
+}
+
+func getGroupPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	page := getPage(r)
+	groupID := ctx.params.getInt("id")
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:group:%d:page:%d:user:%d", groupID, page.index, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		return ctx.datamapper.getGroupPhotos(page, groupID, userID)
+	})
+}
+
+// cross-posts one of the user's own photos to the group
+func addGroupPhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	member, err := getMembership(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	if err := ctx.permit(member.isActive(), "You must be a member of this group"); err != nil {
+		return err
+	}
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("photoID"))
+	if err != nil {
+		return err
+	}
+	if err := ctx.permit(photo.OwnerID == ctx.user.ID, "You can only post your own photos"); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.addGroupPhoto(group.ID, photo.ID); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderString(w, http.StatusOK, "Photo posted")
+}
+
+// removes a photo from the group stream; the photo itself is kept
+func removeGroupPhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group, err := ctx.datamapper.getGroup(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("photoID"))
+	if err != nil {
+		return err
+	}
+
+	member, err := getMembership(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+
+	isOwner := photo.OwnerID == ctx.user.ID
+	if err := ctx.permit(isOwner || member.isModerator() || ctx.user.IsAdmin,
+		"You cannot remove this photo"); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.removeGroupPhoto(group.ID, photo.ID); err != nil {
+		return err
+	}
+
+	if !isOwner {
+		details := fmt.Sprintf("group=%d", group.ID)
+		if err := writeAuditLog(ctx, "remove_group_photo", photo.ID, details); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderString(w, http.StatusOK, "Photo removed")
+}
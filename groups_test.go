@@ -0,0 +1,75 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type groupsDataMapper struct {
+	mockDataMapper
+	member *groupMember
+}
+
+func (m *groupsDataMapper) getGroup(groupID int64) (*group, error) {
+	return &group{ID: groupID, OwnerID: 1, Name: "Birds", RequiresApproval: true}, nil
+}
+
+func (m *groupsDataMapper) saveGroupMember(member *groupMember) error {
+	m.member = member
+	return nil
+}
+
+func newGroupContext(dm dataMapper, u *user) *context {
+	p := &params{make(map[string]string)}
+	p.vars["id"] = "1"
+	p.vars["photoID"] = "1"
+	return &context{
+		app:        &app{datamapper: dm},
+		params:     p,
+		user:       u,
+		datamapper: dm,
+	}
+}
+
+func TestGroupMemberPermissions(t *testing.T) {
+	var none *groupMember
+	if none.isActive() || none.isModerator() {
+		t.Error("Non-members should not be active or moderators")
+	}
+	pending := &groupMember{Role: groupRoleModerator, Status: groupStatusPending}
+	if pending.isActive() || pending.isModerator() {
+		t.Error("Pending members should not be active or moderators")
+	}
+	mod := &groupMember{Role: groupRoleModerator, Status: groupStatusActive}
+	if !mod.isActive() || !mod.isModerator() {
+		t.Error("Active moderator should be a moderator")
+	}
+}
+
+func TestJoinGroupRequiresApproval(t *testing.T) {
+	dm := &groupsDataMapper{}
+	c := newGroupContext(dm, &user{ID: 2, IsAuthenticated: true})
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/groups/1/join", nil)
+	res := httptest.NewRecorder()
+
+	if err := joinGroup(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if dm.member == nil || dm.member.Status != groupStatusPending {
+		t.Errorf("Member should be pending, got %v", dm.member)
+	}
+}
+
+func TestAddGroupPhotoIfNotMember(t *testing.T) {
+	c := newGroupContext(&groupsDataMapper{}, &user{ID: 2, IsAuthenticated: true})
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/groups/1/photos/1", nil)
+	res := httptest.NewRecorder()
+
+	err := addGroupPhoto(c, res, req)
+	if e, ok := err.(httpError); !ok || e.Status != http.StatusForbidden {
+		t.Errorf("Expected forbidden, got %v", err)
+	}
+}
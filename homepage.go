@@ -0,0 +1,124 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Admins pin photos and albums to the homepage, each shown from an optional
+// start until an optional end. The pins shown are listed in order ahead of
+// the photos on the first page of /api/photos/, which leaves out the pinned
+// photos. The whole list of pins is saved at once; pins past their end stay
+// listed for admins until they are left out.
+
+const maxHomepagePins = 20
+
+func getHomepagePins(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	pins, err := ctx.datamapper.getHomepagePins()
+	if err != nil {
+		return err
+	}
+	if pins == nil {
+		pins = []homepagePin{}
+	}
+	now := time.Now()
+	for i := range pins {
+		pins[i].Active = pins[i].isActive(now)
+	}
+	return renderJSON(w, pins, http.StatusOK)
+}
+
+// replaces the pins, e.g. {"pins": [{"photoId": 3}, {"albumId": 2,
+// "startsAt": "...", "endsAt": "..."}]}
+func setHomepagePins(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Pins []homepagePin `json:"pins"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if len(s.Pins) > maxHomepagePins {
+		return httpError{http.StatusBadRequest, "Too many pins"}
+	}
+
+	errors := make(map[string]string)
+
+	for i := range s.Pins {
+		pin := &s.Pins[i]
+		pin.Active, pin.Photo, pin.Album = false, nil, nil
+
+		if (pin.PhotoID == nil) == (pin.AlbumID == nil) {
+			errors["pins"] = "Each pin must have a photo or an album"
+			continue
+		}
+		if pin.StartsAt != nil && pin.EndsAt != nil && !pin.StartsAt.Before(*pin.EndsAt) {
+			errors["endsAt"] = "A pin must end after it starts"
+		}
+
+		var err error
+		if pin.PhotoID != nil {
+			_, err = ctx.datamapper.getPhoto(*pin.PhotoID)
+		} else {
+			_, err = ctx.datamapper.getAlbum(*pin.AlbumID)
+		}
+		if err != nil {
+			if !isErrSqlNoRows(err) {
+				return err
+			}
+			errors["pins"] = "Pinned photo or album not found"
+		}
+	}
+
+	if len(errors) > 0 {
+		return validationFailure{errors}
+	}
+
+	if err := ctx.datamapper.setHomepagePins(s.Pins); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "set_homepage_pins", 0, fmt.Sprintf("%d pins", len(s.Pins))); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return getHomepagePins(ctx, w, r)
+}
+
+// puts the pins shown ahead of the first page of photos, leaving the pinned
+// photos out of the page
+func addHomepagePins(ctx *context, photos *photoList, userID int64) error {
+
+	pins, err := ctx.datamapper.getActiveHomepagePins(time.Now(), userID)
+	if err != nil || len(pins) == 0 {
+		return err
+	}
+
+	pinned := make(map[int64]bool)
+	for i := range pins {
+		if pins[i].Photo != nil {
+			pinned[pins[i].Photo.ID] = true
+		}
+		if pins[i].Album != nil {
+			albums := []portfolioAlbum{*pins[i].Album}
+			setPortfolioCovers(albums)
+			pins[i].Album = &albums[0]
+		}
+	}
+
+	items := []photo{}
+	for _, photo := range photos.Items {
+		if !pinned[photo.ID] {
+			items = append(items, photo)
+		}
+	}
+	photos.Items = items
+	photos.Pinned = pins
+	return nil
+}
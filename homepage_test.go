@@ -0,0 +1,90 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type homepageDataMapper struct {
+	mockDataMapper
+	pins []homepagePin
+	set  []homepagePin
+}
+
+func (m *homepageDataMapper) getActiveHomepagePins(now time.Time, userID int64) ([]homepagePin, error) {
+	return m.pins, nil
+}
+
+func (m *homepageDataMapper) getPhoto(photoID int64) (*photo, error) {
+	return &photo{ID: photoID}, nil
+}
+
+func (m *homepageDataMapper) setHomepagePins(pins []homepagePin) error {
+	m.set = pins
+	return nil
+}
+
+func newHomepageContext(dm dataMapper) *context {
+	return &context{
+		app:        &app{datamapper: dm},
+		params:     &params{make(map[string]string)},
+		cache:      &fakeCache{},
+		user:       &user{ID: 1, IsAuthenticated: true, IsAdmin: true},
+		datamapper: dm,
+	}
+}
+
+func TestAddHomepagePins(t *testing.T) {
+	photoID, albumID := int64(2), int64(5)
+	dm := &homepageDataMapper{pins: []homepagePin{
+		{ID: 1, AlbumID: &albumID, Album: &portfolioAlbum{ID: albumID, Photos: []photo{{ID: 7}, {ID: 8}}}},
+		{ID: 2, PhotoID: &photoID, Photo: &photo{ID: photoID}},
+	}}
+
+	photos := newPhotoList([]photo{{ID: 1}, {ID: 2}, {ID: 3}}, 3, 1)
+	if err := addHomepagePins(newHomepageContext(dm), photos, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(photos.Pinned) != 2 || photos.Pinned[0].Album == nil || photos.Pinned[1].Photo == nil {
+		t.Fatalf("Expected the pins in order, got %+v", photos.Pinned)
+	}
+	if cover := photos.Pinned[0].Album.Cover; cover == nil || cover.ID != 7 {
+		t.Errorf("Expected the first photo of the album as its cover, got %+v", cover)
+	}
+	if len(photos.Items) != 2 || photos.Items[0].ID != 1 || photos.Items[1].ID != 3 {
+		t.Errorf("Expected the pinned photo to be left out, got %+v", photos.Items)
+	}
+}
+
+func TestSetHomepagePins(t *testing.T) {
+	dm := &homepageDataMapper{}
+
+	body := `{"pins": [{"photoId": 3, "albumId": 2}]}`
+	req, _ := http.NewRequest("PUT", "http://localhost/api/admin/homepage", strings.NewReader(body))
+	err := setHomepagePins(newHomepageContext(dm), httptest.NewRecorder(), req)
+	if _, ok := err.(validationFailure); !ok {
+		t.Errorf("Expected a pin of both a photo and an album to be refused, got %v", err)
+	}
+
+	body = `{"pins": [{"photoId": 3, "startsAt": "2026-01-05T00:00:00Z", "endsAt": "2026-01-12T00:00:00Z"}]}`
+	req, _ = http.NewRequest("PUT", "http://localhost/api/admin/homepage", strings.NewReader(body))
+	if err := setHomepagePins(newHomepageContext(dm), httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.set) != 1 || *dm.set[0].PhotoID != 3 || dm.set[0].EndsAt == nil {
+		t.Errorf("Expected the pin to be saved, got %+v", dm.set)
+	}
+}
+
+func TestHomepagePinActive(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	pin := &homepagePin{StartsAt: &now, EndsAt: &later}
+	if !pin.isActive(now) || pin.isActive(later) || pin.isActive(now.Add(-time.Minute)) {
+		t.Error("Expected the pin to be shown from its start until its end")
+	}
+}
@@ -0,0 +1,105 @@
+package photoshare
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With HOTLINK_PROTECTION set, uploads and thumbnails under /uploads/ are
+// only served to pages of the site itself, of HOTLINK_ALLOWED_HOSTS and
+// their subdomains, and to requests without a Referer, such as direct
+// visits, apps and other servers. Other pages embedding them get a
+// placeholder image instead. Links signed with HOTLINK_SECRET are served
+// to any page until they expire: embeds and feeds, shown on other sites,
+// link to the images with a signature.
+
+// shown in place of hotlinked images
+const hotlinkPlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="300" height="200" viewBox="0 0 300 200">` +
+	`<rect width="300" height="200" fill="#eee"/>` +
+	`<text x="150" y="105" font-family="sans-serif" font-size="14" fill="#777" text-anchor="middle">%s</text></svg>`
+
+type hotlinkGuard struct {
+	enabled bool
+	allowed string
+	secret  []byte
+}
+
+func newHotlinkGuard(cfg *config) *hotlinkGuard {
+	return &hotlinkGuard{cfg.HotlinkProtection, cfg.HotlinkAllowedHosts, []byte(cfg.HotlinkSecret)}
+}
+
+// returns the signature of the path until the time, in seconds
+func signUploadPath(secret []byte, p string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(p + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// returns the URL of the file under /uploads/, signed if hotlinks are
+// refused and HOTLINK_SECRET is set. Links expire between one and two
+// HOTLINK_TOKEN_TTL from now, so that they stay the same, and cached, for a
+// while.
+func uploadURL(cfg *config, baseURL, name string) string {
+	p := "/uploads/" + name
+	if !cfg.HotlinkProtection || cfg.HotlinkSecret == "" {
+		return baseURL + p
+	}
+	ttl := time.Duration(cfg.HotlinkTokenTTL) * time.Second
+	expires := utcNow().Truncate(ttl).Add(2 * ttl).Unix()
+	return fmt.Sprintf("%s%s?expires=%d&token=%s", baseURL, p, expires, signUploadPath([]byte(cfg.HotlinkSecret), p, expires))
+}
+
+// returns true if the request has an unexpired signature of its path
+func (g *hotlinkGuard) isSigned(r *http.Request) bool {
+	if len(g.secret) == 0 {
+		return false
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || expires < utcNow().Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("token")), []byte(signUploadPath(g.secret, r.URL.Path, expires)))
+}
+
+// returns true if the page of the Referer may show the images of the site
+func (g *hotlinkGuard) isAllowedReferer(r *http.Request) bool {
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		return true
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return matchesDomain(strings.ToLower(u.Hostname()), g.allowed)
+}
+
+// negroni middleware
+func (g *hotlinkGuard) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !g.enabled || !strings.HasPrefix(r.URL.Path, "/uploads/") {
+		next(w, r)
+		return
+	}
+	// the response depends on the page, so caches must not share it
+	w.Header().Add("Vary", "Referer")
+	if g.isSigned(r) || g.isAllowedReferer(r) {
+		next(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, hotlinkPlaceholder, "Image hosted on "+html.EscapeString(r.Host))
+}
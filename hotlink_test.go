@@ -0,0 +1,77 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHotlinkGuard(t *testing.T) {
+
+	cfg := &config{
+		HotlinkProtection:   true,
+		HotlinkAllowedHosts: "blog.example.com, partner.org",
+		HotlinkSecret:       "secret",
+		HotlinkTokenTTL:     3600,
+	}
+	g := newHotlinkGuard(cfg)
+	next := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("image")) }
+
+	signed, _ := url.Parse(uploadURL(cfg, "http://photos.test", "a.jpg"))
+	expired := "/uploads/a.jpg?expires=1&token=" + signUploadPath(g.secret, "/uploads/a.jpg", 1)
+
+	for _, tc := range []struct {
+		url, referer string
+		allowed      bool
+	}{
+		{"/uploads/a.jpg", "", true},
+		{"/uploads/a.jpg", "http://photos.test/#/detail/1", true},
+		{"/uploads/thumbnails/a.jpg", "https://blog.example.com/post", true},
+		{"/uploads/a.jpg", "https://www.partner.org/", true},
+		{"/uploads/a.jpg", "https://evil.test/", false},
+		{"/uploads/a.jpg", "https://partner.org.evil.test/", false},
+		{"/uploads/a.jpg", "not a url", false},
+		{signed.RequestURI(), "https://evil.test/", true},
+		{strings.Replace(signed.RequestURI(), "a.jpg", "b.jpg", 1), "https://evil.test/", false},
+		{expired, "https://evil.test/", false},
+		{"/api/photos/", "https://evil.test/", true},
+	} {
+		req, _ := http.NewRequest("GET", "http://photos.test"+tc.url, nil)
+		req.Header.Set("Referer", tc.referer)
+		res := httptest.NewRecorder()
+		g.ServeHTTP(res, req, next)
+
+		if allowed := res.Body.String() == "image"; allowed != tc.allowed {
+			t.Errorf("Expected %s from %q allowed: %v, got %d", tc.url, tc.referer, tc.allowed, res.Code)
+			continue
+		}
+		if !tc.allowed && (res.Code != http.StatusForbidden || res.Header().Get("Content-Type") != "image/svg+xml") {
+			t.Errorf("Expected the placeholder for %s, got %d %s", tc.url, res.Code, res.Header().Get("Content-Type"))
+		}
+	}
+
+	// off by default
+	req, _ := http.NewRequest("GET", "http://photos.test/uploads/a.jpg", nil)
+	req.Header.Set("Referer", "https://evil.test/")
+	res := httptest.NewRecorder()
+	newHotlinkGuard(&config{}).ServeHTTP(res, req, next)
+	if res.Body.String() != "image" {
+		t.Errorf("Expected hotlinks to be served without HOTLINK_PROTECTION, got %d", res.Code)
+	}
+}
+
+func TestUploadURL(t *testing.T) {
+	if u := uploadURL(&config{}, "http://photos.test", "a.jpg"); u != "http://photos.test/uploads/a.jpg" {
+		t.Errorf("Expected an unsigned URL, got %s", u)
+	}
+	cfg := &config{HotlinkProtection: true, HotlinkSecret: "secret", HotlinkTokenTTL: 3600}
+	u := uploadURL(cfg, "http://photos.test", "thumbnails/a.jpg")
+	if !strings.HasPrefix(u, "http://photos.test/uploads/thumbnails/a.jpg?expires=") || !strings.Contains(u, "&token=") {
+		t.Errorf("Expected a signed URL, got %s", u)
+	}
+	if again := uploadURL(cfg, "http://photos.test", "thumbnails/a.jpg"); again != u {
+		t.Errorf("Expected the same URL for a while, got %s and %s", u, again)
+	}
+}
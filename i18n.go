@@ -0,0 +1,137 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error and validation messages are translated into the language the client
+// asks for in its Accept-Language header. Catalogs are JSON files in the
+// locales directory of the templates, e.g. locales/fr.json, mapping each
+// English message to its translation. Messages missing from a catalog are
+// returned in English.
+
+const (
+	defaultLanguage = "en"
+	localesDir      = "/locales"
+)
+
+type catalog map[string]string
+
+type translator struct {
+	catalogs map[string]catalog
+}
+
+// reads the catalog of each language in the locales directory
+func newTranslator(a *assets) (*translator, error) {
+
+	t := &translator{catalogs: make(map[string]catalog)}
+
+	dir, err := a.templates.Open(localesDir)
+	if err != nil {
+		// no catalogs, so every message is in English
+		return t, nil
+	}
+	defer dir.Close()
+
+	files, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range files {
+		name := info.Name()
+		if path.Ext(name) != ".json" {
+			continue
+		}
+		body, err := a.readTemplate(path.Join(localesDir, name))
+		if err != nil {
+			return nil, err
+		}
+		c := make(catalog)
+		if err := json.Unmarshal(body, &c); err != nil {
+			return nil, fmt.Errorf("invalid catalog %s: %s", name, err)
+		}
+		t.catalogs[strings.ToLower(strings.TrimSuffix(name, ".json"))] = c
+	}
+	return t, nil
+}
+
+// returns the language tags of an Accept-Language header, most preferred
+// first, e.g. "fr-CH, fr;q=0.9, en;q=0.8" returns fr-ch, fr, en
+func parseAcceptLanguage(header string) []string {
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+	for i, w := range tags {
+		result[i] = w.tag
+	}
+	return result
+}
+
+// returns the best language with a catalog for the request, falling back
+// from a regional tag to its base language, or English if none match
+func (t *translator) negotiate(r *http.Request) string {
+	if t == nil {
+		return defaultLanguage
+	}
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if tag == defaultLanguage || strings.HasPrefix(tag, defaultLanguage+"-") {
+			return defaultLanguage
+		}
+		if _, ok := t.catalogs[tag]; ok {
+			return tag
+		}
+		if i := strings.Index(tag, "-"); i > 0 {
+			if _, ok := t.catalogs[tag[:i]]; ok {
+				return tag[:i]
+			}
+		}
+	}
+	return defaultLanguage
+}
+
+// returns the message in the language, or unchanged if there is no
+// translation
+func (t *translator) translate(lang, msg string) string {
+	if t == nil {
+		return msg
+	}
+	if s, ok := t.catalogs[lang][msg]; ok && s != "" {
+		return s
+	}
+	return msg
+}
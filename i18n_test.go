@@ -0,0 +1,54 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tags := parseAcceptLanguage("en;q=0.5, fr-CH, de;q=0, fr;q=0.9")
+	expected := []string{"fr-ch", "fr", "en"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected %v, got %v", expected, tags)
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tr := &translator{catalogs: map[string]catalog{"fr": {}, "pt-br": {}}}
+	for header, lang := range map[string]string{
+		"":                  "en",
+		"fr-CH, en;q=0.8":   "fr",
+		"pt-BR":             "pt-br",
+		"en-GB, fr;q=0.9":   "en",
+		"ja, de;q=0.9":      "en",
+		"ja, fr;q=0.1, *;q": "fr",
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Accept-Language", header)
+		if result := tr.negotiate(req); result != lang {
+			t.Errorf("%q: expected %s, got %s", header, lang, result)
+		}
+	}
+}
+
+func TestTranslatedError(t *testing.T) {
+	app := newTestApp(newMemoryDataMapper())
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/groups/", strings.NewReader(`{}`))
+	req.Header.Set("Accept-Language", "fr")
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d", res.Code)
+	}
+	if body := strings.TrimSpace(res.Body.String()); body != "Vous devez être connecté" {
+		t.Errorf("Expected French message, got %q", body)
+	}
+	if lang := res.Header().Get("Content-Language"); lang != "fr" {
+		t.Errorf("Expected Content-Language fr, got %q", lang)
+	}
+}
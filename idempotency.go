@@ -0,0 +1,151 @@
+package photoshare
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clients retrying an upload or a vote, e.g. on a flaky mobile network, send
+// the same Idempotency-Key header with each attempt. The response to the first
+// successful attempt is stored with the key and replayed to the retries, so
+// that the photo is uploaded or the vote cast only once. Failed attempts are
+// not stored and may be retried with the same key. Keys are kept for a day,
+// or for a few minutes while their request runs, so that the key of a request
+// whose server stopped is released.
+
+const (
+	idempotencyHeader          = "Idempotency-Key"
+	idempotencyKeyTTL          = 24 * time.Hour
+	idempotencyReservationTTL  = 10 * time.Minute
+	idempotencyCleanupInterval = time.Hour
+	maxIdempotencyKeyLength    = 255
+)
+
+var (
+	errIdempotencyKeyInUse  = httpError{http.StatusConflict, "A request with this idempotency key is in progress"}
+	errIdempotencyKeyReused = httpError{http.StatusUnprocessableEntity, "This idempotency key was used for another request"}
+)
+
+// records the status, headers and body written by a handler
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// identifies the request a key was sent with, so that a key is not reused
+// for a request to another photo or endpoint
+func requestFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path))
+	return hex.EncodeToString(sum[:])
+}
+
+// handles requests of logged in users sent with an Idempotency-Key once,
+// replaying the stored response to retries
+func idempotent(h handlerFunc) handlerFunc {
+	return func(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+		value := strings.TrimSpace(r.Header.Get(idempotencyHeader))
+		if value == "" || !ctx.user.IsAuthenticated {
+			return h(ctx, w, r)
+		}
+		if len(value) > maxIdempotencyKeyLength {
+			return httpError{http.StatusBadRequest, "Invalid idempotency key"}
+		}
+
+		now := utcNow()
+		key := &idempotencyKey{
+			UserID:      ctx.user.ID,
+			Key:         value,
+			Fingerprint: requestFingerprint(r),
+			CreatedAt:   now,
+		}
+
+		stored, err := ctx.datamapper.reserveIdempotencyKey(key,
+			now.Add(-idempotencyKeyTTL), now.Add(-idempotencyReservationTTL))
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			switch {
+			case stored.Fingerprint != key.Fingerprint:
+				return errIdempotencyKeyReused
+			case stored.Status == 0:
+				return errIdempotencyKeyInUse
+			}
+			w.Header().Set("Content-Type", stored.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			_, err := w.Write(stored.Body)
+			return err
+		}
+
+		// failed requests, including panics, and responses which could not
+		// be stored release the key for retries
+		saved := false
+		defer func() {
+			if !saved {
+				if err := ctx.datamapper.removeIdempotencyKey(key); err != nil {
+					logError(err)
+				}
+			}
+		}()
+
+		rec := &recordingResponseWriter{ResponseWriter: w}
+		if err := h(ctx, rec, r); err != nil {
+			return err
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusBadRequest {
+			return nil
+		}
+
+		response := *key
+		response.Status = rec.status
+		response.ContentType = rec.Header().Get("Content-Type")
+		response.Body = rec.body.Bytes()
+
+		if err := ctx.datamapper.saveIdempotencyKey(&response); err != nil {
+			logError(err)
+			return nil
+		}
+		saved = true
+		return nil
+	}
+}
+
+// removes expired keys until the server stops
+func runIdempotencyKeyCleanup(app *app) {
+	for range time.Tick(idempotencyCleanupInterval) {
+		num, err := app.datamapper.removeExpiredIdempotencyKeys(utcNow().Add(-idempotencyKeyTTL))
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if num > 0 {
+			log.Printf("Removed %d expired idempotency keys", num)
+		}
+	}
+}
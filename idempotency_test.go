@@ -0,0 +1,170 @@
+package photoshare
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotentVote(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	token, err := dm.login(&user{Name: "voter", Email: "voter@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, p.ID)
+	}
+
+	vote := func(photoID int64) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/upvote", photoID), nil)
+		req.Header.Set(tokenHeader, token)
+		req.Header.Set(idempotencyHeader, "retry-1")
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := vote(ids[0]); res.Code != http.StatusOK || res.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("First vote should succeed, got %d", res.Code)
+	}
+
+	// the retry gets the response of the first vote, rather than a 403
+	res := vote(ids[0])
+	if res.Code != http.StatusOK || res.Header().Get("Idempotent-Replayed") != "true" || res.Body.String() != "Voting successful" {
+		t.Errorf("Retry should be replayed, got %d: %s", res.Code, res.Body.String())
+	}
+	if p, _ := dm.getPhoto(ids[0]); p.UpVotes != 1 {
+		t.Errorf("Vote should be counted once, got %d", p.UpVotes)
+	}
+
+	if res := vote(ids[1]); res.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Key should not be reused for another photo, got %d", res.Code)
+	}
+}
+
+func TestIdempotentFailureReleasesKey(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	voter := &user{Name: "voter", Email: "voter@localhost"}
+	token, err := dm.login(voter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: voter.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// owners cannot vote on their own photos
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/upvote", p.ID), nil)
+	req.Header.Set(tokenHeader, token)
+	req.Header.Set(idempotencyHeader, "retry-1")
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %d", res.Code)
+	}
+	if len(dm.idempotency) != 0 {
+		t.Error("Key of a failed request should be released")
+	}
+}
+
+// fails to store responses
+type unsavedIdempotencyDataMapper struct {
+	*memoryDataMapper
+}
+
+func (m *unsavedIdempotencyDataMapper) forSite(siteID int64) dataMapper {
+	return m
+}
+
+func (m *unsavedIdempotencyDataMapper) saveIdempotencyKey(key *idempotencyKey) error {
+	return errors.New("database is down")
+}
+
+func TestIdempotentUnsavedResponseReleasesKey(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(&unsavedIdempotencyDataMapper{dm})
+
+	token, err := dm.login(&user{Name: "voter", Email: "voter@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/upvote", p.ID), nil)
+	req.Header.Set(tokenHeader, token)
+	req.Header.Set(idempotencyHeader, "retry-1")
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if len(dm.idempotency) != 0 {
+		t.Error("Key whose response could not be stored should be released")
+	}
+}
+
+func TestReserveStaleIdempotencyKey(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	now := time.Now()
+	expiry, reservationExpiry := now.Add(-idempotencyKeyTTL), now.Add(-idempotencyReservationTTL)
+
+	running := &idempotencyKey{UserID: 1, Key: "running", CreatedAt: now.Add(-time.Minute)}
+	stale := &idempotencyKey{UserID: 1, Key: "stale", CreatedAt: now.Add(-time.Hour)}
+	done := &idempotencyKey{UserID: 1, Key: "done", CreatedAt: now.Add(-time.Hour)}
+	for _, key := range []*idempotencyKey{running, stale, done} {
+		if _, err := dm.reserveIdempotencyKey(key, expiry, reservationExpiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done.Status = http.StatusOK
+	if err := dm.saveIdempotencyKey(done); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key      string
+		reserved bool
+	}{
+		{"running", false},
+		{"stale", true},
+		{"done", false},
+	} {
+		stored, err := dm.reserveIdempotencyKey(&idempotencyKey{UserID: 1, Key: tc.key, CreatedAt: now}, expiry, reservationExpiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reserved := stored == nil; reserved != tc.reserved {
+			t.Errorf("%s: expected reserved %t, got %t", tc.key, tc.reserved, reserved)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/disintegration/gift"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IIIF Image API 3.0 (https://iiif.io/api/image/3.0/) for hosted photos, so
+// deep-zoom viewers and archive tooling can request any part of a photo:
+//
+//	/iiif/{id}/info.json
+//	/iiif/{id}/{region}/{size}/{rotation}/{quality}.{format}
+
+const (
+	iiifContext     = "http://iiif.io/api/image/3/context.json"
+	iiifMaxSize     = 4096 // largest width or height returned, in pixels
+	iiifJPEGQuality = 90
+)
+
+var iiifContentTypes = map[string]string{
+	"jpg": "image/jpeg",
+	"png": "image/png",
+	"gif": "image/gif",
+}
+
+func errIIIF(msg string) error {
+	return httpError{http.StatusBadRequest, msg}
+}
+
+type iiifRequest struct {
+	region        image.Rectangle
+	width, height int
+	mirror        bool
+	rotation      float64
+	quality       string
+	format        string
+}
+
+// parses a region, e.g. "full", "square", "10,10,200,100" or
+// "pct:10,10,50,50", within the bounds of the image
+func parseIIIFRegion(s string, bounds image.Rectangle) (image.Rectangle, error) {
+
+	w, h := bounds.Dx(), bounds.Dy()
+
+	switch s {
+	case "full":
+		return bounds, nil
+	case "square":
+		side := w
+		if h < side {
+			side = h
+		}
+		x, y := (w-side)/2, (h-side)/2
+		return image.Rect(x, y, x+side, y+side).Add(bounds.Min), nil
+	}
+
+	pct := strings.HasPrefix(s, "pct:")
+	parts := strings.Split(strings.TrimPrefix(s, "pct:"), ",")
+	if len(parts) != 4 {
+		return bounds, errIIIF("Invalid region")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || (!pct && v != math.Trunc(v)) {
+			return bounds, errIIIF("Invalid region")
+		}
+		values[i] = v
+	}
+
+	if pct {
+		values[0] = values[0] * float64(w) / 100
+		values[1] = values[1] * float64(h) / 100
+		values[2] = values[2] * float64(w) / 100
+		values[3] = values[3] * float64(h) / 100
+	}
+
+	x, y := int(math.Round(values[0])), int(math.Round(values[1]))
+	region := image.Rect(x, y, x+int(math.Round(values[2])), y+int(math.Round(values[3])))
+	region = region.Add(bounds.Min).Intersect(bounds)
+	if region.Empty() {
+		return bounds, errIIIF("Region is outside the image")
+	}
+	return region, nil
+}
+
+// parses a size, e.g. "max", "200,", ",100", "pct:50", "200,100" or
+// "!200,200", returning the size of the scaled region. A "^" prefix allows
+// sizes larger than the region.
+func parseIIIFSize(s string, regionWidth, regionHeight int) (int, int, error) {
+
+	upscale := strings.HasPrefix(s, "^")
+	s = strings.TrimPrefix(s, "^")
+
+	rw, rh := float64(regionWidth), float64(regionHeight)
+	var w, h float64
+
+	switch {
+
+	case s == "max":
+		w, h = rw, rh
+		// scale to fit the largest size allowed
+		scale := math.Min(iiifMaxSize/rw, iiifMaxSize/rh)
+		if scale < 1 || upscale {
+			w, h = rw*scale, rh*scale
+		}
+
+	case strings.HasPrefix(s, "pct:"):
+		n, err := strconv.ParseFloat(s[4:], 64)
+		if err != nil || n <= 0 {
+			return 0, 0, errIIIF("Invalid size")
+		}
+		w, h = rw*n/100, rh*n/100
+
+	default:
+		confined := strings.HasPrefix(s, "!")
+		parts := strings.Split(strings.TrimPrefix(s, "!"), ",")
+		if len(parts) != 2 {
+			return 0, 0, errIIIF("Invalid size")
+		}
+
+		var err error
+		if parts[0] != "" {
+			if w, err = strconv.ParseFloat(parts[0], 64); err != nil || w <= 0 {
+				return 0, 0, errIIIF("Invalid size")
+			}
+		}
+		if parts[1] != "" {
+			if h, err = strconv.ParseFloat(parts[1], 64); err != nil || h <= 0 {
+				return 0, 0, errIIIF("Invalid size")
+			}
+		}
+
+		switch {
+		case w == 0 && h == 0:
+			return 0, 0, errIIIF("Invalid size")
+		case confined:
+			if w == 0 || h == 0 {
+				return 0, 0, errIIIF("Invalid size")
+			}
+			scale := math.Min(w/rw, h/rh)
+			w, h = rw*scale, rh*scale
+		case h == 0:
+			h = rh * w / rw
+		case w == 0:
+			w = rw * h / rh
+		}
+	}
+
+	width, height := int(math.Round(w)), int(math.Round(h))
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	if !upscale && (width > regionWidth || height > regionHeight) {
+		return 0, 0, errIIIF("Size is larger than the region")
+	}
+	if width > iiifMaxSize || height > iiifMaxSize {
+		return 0, 0, errIIIF("Size is too large")
+	}
+	return width, height, nil
+}
+
+// parses a rotation in degrees clockwise, e.g. "90" or "!22.5". A "!"
+// prefix mirrors the image before rotating.
+func parseIIIFRotation(s string) (bool, float64, error) {
+	mirror := strings.HasPrefix(s, "!")
+	degrees, err := strconv.ParseFloat(strings.TrimPrefix(s, "!"), 64)
+	if err != nil || degrees < 0 || degrees > 360 {
+		return false, 0, errIIIF("Invalid rotation")
+	}
+	return mirror, math.Mod(degrees, 360), nil
+}
+
+func parseIIIFRequest(ctx *context, bounds image.Rectangle) (*iiifRequest, error) {
+
+	req := &iiifRequest{
+		quality: ctx.params.get("quality"),
+		format:  ctx.params.get("format"),
+	}
+
+	var err error
+
+	if req.region, err = parseIIIFRegion(ctx.params.get("region"), bounds); err != nil {
+		return nil, err
+	}
+	if req.width, req.height, err = parseIIIFSize(ctx.params.get("size"), req.region.Dx(), req.region.Dy()); err != nil {
+		return nil, err
+	}
+	if req.mirror, req.rotation, err = parseIIIFRotation(ctx.params.get("rotation")); err != nil {
+		return nil, err
+	}
+
+	switch req.quality {
+	case "default", "color", "gray", "bitonal":
+	default:
+		return nil, errIIIF("Invalid quality")
+	}
+	if _, ok := iiifContentTypes[req.format]; !ok {
+		return nil, errIIIF("Invalid format")
+	}
+	return req, nil
+}
+
+// applies the region, size, rotation and quality of the request
+func (req *iiifRequest) apply(src image.Image) image.Image {
+
+	g := gift.New()
+
+	if req.region != src.Bounds() {
+		g.Add(gift.Crop(req.region))
+	}
+	if req.width != req.region.Dx() || req.height != req.region.Dy() {
+		g.Add(gift.Resize(req.width, req.height, gift.LanczosResampling))
+	}
+	if req.mirror {
+		g.Add(gift.FlipHorizontal())
+	}
+
+	// gift rotates counter-clockwise
+	switch req.rotation {
+	case 0:
+	case 90:
+		g.Add(gift.Rotate270())
+	case 180:
+		g.Add(gift.Rotate180())
+	case 270:
+		g.Add(gift.Rotate90())
+	default:
+		g.Add(gift.Rotate(float32(360-req.rotation), color.Transparent, gift.CubicInterpolation))
+	}
+
+	switch req.quality {
+	case "gray":
+		g.Add(gift.Grayscale())
+	case "bitonal":
+		g.Add(gift.Grayscale(), gift.Threshold(50))
+	}
+
+	dst := image.NewRGBA(g.Bounds(src.Bounds()))
+	g.Draw(dst, src)
+	return dst
+}
+
+func (req *iiifRequest) encode(img image.Image) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	switch req.format {
+	case "jpg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: iiifJPEGQuality})
+	case "png":
+		err = png.Encode(buf, img)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	}
+	return buf.Bytes(), err
+}
+
+// returns the photo of the request if visible to the user
+func getIIIFPhoto(ctx *context) (*photo, error) {
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return nil, err
+	}
+	return &photo.photo, nil
+}
+
+func iiifBaseURL(r *http.Request, photoID int64) string {
+	return fmt.Sprintf("%s/iiif/%d", getBaseURL(r), photoID)
+}
+
+// the base URI of an image redirects to its info
+func getIIIFBase(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	photo, err := getIIIFPhoto(ctx)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, iiifBaseURL(r, photo.ID)+"/info.json", http.StatusSeeOther)
+	return nil
+}
+
+func getIIIFInfo(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getIIIFPhoto(ctx)
+	if err != nil {
+		return err
+	}
+
+	file, err := ctx.filestore.open(photo.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+
+	// users other than the owner see the image at the public size
+	bounds := image.Rect(0, 0, cfg.Width, cfg.Height)
+	if max := publicMaxSize(ctx, photo); max > 0 {
+		bounds = fitBounds(bounds, max)
+	}
+
+	info := map[string]interface{}{
+		"@context":       iiifContext,
+		"id":             iiifBaseURL(r, photo.ID),
+		"type":           "ImageService3",
+		"protocol":       "http://iiif.io/api/image",
+		"profile":        "level2",
+		"width":          bounds.Dx(),
+		"height":         bounds.Dy(),
+		"maxWidth":       iiifMaxSize,
+		"maxHeight":      iiifMaxSize,
+		"extraQualities": []string{"color", "gray", "bitonal"},
+		"extraFormats":   []string{"gif"},
+		"extraFeatures":  []string{"mirroring", "rotationArbitrary", "sizeUpscaling"},
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	return renderJSON(w, info, http.StatusOK)
+}
+
+func getIIIFImage(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getIIIFPhoto(ctx)
+	if err != nil {
+		return err
+	}
+
+	file, err := ctx.filestore.open(photo.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	src, _, err := decodeImage(ctx.cfg, file)
+	if err != nil {
+		return err
+	}
+
+	max := publicMaxSize(ctx, photo)
+	if max > 0 {
+		src = fitImage(src, max)
+	}
+
+	req, err := parseIIIFRequest(ctx, src.Bounds())
+	if err != nil {
+		return err
+	}
+
+	body, err := req.encode(req.apply(src))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// full size renditions are only for the owner when the size is limited
+	if max == 0 && ctx.cfg.PublicMaxSize > 0 {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	w.Header().Set("Content-Type", iiifContentTypes[req.format])
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	return err
+}
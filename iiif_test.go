@@ -0,0 +1,116 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseIIIFRegion(t *testing.T) {
+	bounds := image.Rect(0, 0, 400, 200)
+	for _, tc := range []struct {
+		region   string
+		expected image.Rectangle
+	}{
+		{"full", bounds},
+		{"square", image.Rect(100, 0, 300, 200)},
+		{"10,20,100,50", image.Rect(10, 20, 110, 70)},
+		{"pct:50,50,50,50", image.Rect(200, 100, 400, 200)},
+		{"300,100,500,500", image.Rect(300, 100, 400, 200)},
+	} {
+		region, err := parseIIIFRegion(tc.region, bounds)
+		if err != nil || region != tc.expected {
+			t.Errorf("%s: expected %v, got %v (%v)", tc.region, tc.expected, region, err)
+		}
+	}
+	for _, region := range []string{"", "1,2,3", "500,0,10,10", "a,b,c,d", "1.5,0,10,10"} {
+		if _, err := parseIIIFRegion(region, bounds); err == nil {
+			t.Errorf("%s: expected an error", region)
+		}
+	}
+}
+
+func TestParseIIIFSize(t *testing.T) {
+	for _, tc := range []struct {
+		size          string
+		width, height int
+	}{
+		{"max", 400, 200},
+		{"200,", 200, 100},
+		{",50", 100, 50},
+		{"pct:25", 100, 50},
+		{"100,100", 100, 100},
+		{"!100,100", 100, 50},
+		{"^800,", 800, 400},
+	} {
+		w, h, err := parseIIIFSize(tc.size, 400, 200)
+		if err != nil || w != tc.width || h != tc.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d (%v)", tc.size, tc.width, tc.height, w, h, err)
+		}
+	}
+	for _, size := range []string{"", ",", "800,", "pct:200", "!100,", "^10000,"} {
+		if _, _, err := parseIIIFSize(size, 400, 200); err == nil {
+			t.Errorf("%s: expected an error", size)
+		}
+	}
+}
+
+func TestGetIIIFImage(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "test", Filename: "test.png"}
+	if err := app.filestore.store(bytes.NewReader(buf.Bytes()), p.Filename, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path          string
+		status        int
+		width, height int
+	}{
+		{"full/max/0/default.png", http.StatusOK, 400, 200},
+		{"square/100,/90/gray.jpg", http.StatusOK, 100, 100},
+		{"0,0,200,100/!50,50/!270/default.png", http.StatusOK, 25, 50},
+		{"full/max/0/default.tiff", http.StatusBadRequest, 0, 0},
+		{"full/1000,/0/default.png", http.StatusBadRequest, 0, 0},
+	} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/iiif/%d/%s", p.ID, tc.path), nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.status, res.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(res.Body)
+		if err != nil || cfg.Width != tc.width || cfg.Height != tc.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d (%v)", tc.path, tc.width, tc.height, cfg.Width, cfg.Height, err)
+		}
+	}
+
+	private := &photo{Title: "private", Filename: p.Filename, OwnerID: 1, Private: true}
+	if err := dm.createPhoto(private); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/iiif/%d/info.json", private.ID), nil)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Private photos should return 404, got %d", res.Code)
+	}
+}
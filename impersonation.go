@@ -0,0 +1,139 @@
+package photoshare
+
+import (
+	"fmt"
+	"github.com/dchest/uniuri"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admins debugging a problem a user reported may act as the user for a
+// while, with a session of the user marked with the admin. Every request
+// made in it is written to the audit log, and responses carry the
+// X-Impersonated-By header and the admin in the session info, so the
+// frontend can show a banner.
+
+const (
+	impersonationDuration = 30 * time.Minute
+	impersonatedByHeader  = "X-Impersonated-By"
+)
+
+// the admin acting as the user
+type impersonator struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// returns the admin of an impersonation session, or nil if the session has
+// expired or the admin is no longer one
+func loadImpersonator(datamapper dataMapper, session *session) (*impersonator, error) {
+	if session.ExpiresAt == nil || !time.Now().Before(*session.ExpiresAt) {
+		return nil, nil
+	}
+	admin, err := datamapper.getActiveUser(*session.ImpersonatorID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !admin.IsAdmin || admin.IsBanned {
+		return nil, nil
+	}
+	return &impersonator{admin.ID, admin.Name, *session.ExpiresAt}, nil
+}
+
+// marks the response, and records the request of the admin in the audit log
+func noteImpersonation(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set(impersonatedByHeader, ctx.user.Impersonator.Name)
+	return ctx.datamapper.createAuditEntry(&auditEntry{
+		UserID:   ctx.user.Impersonator.ID,
+		Action:   "impersonated_request",
+		TargetID: ctx.user.ID,
+		Details:  r.Method + " " + r.URL.RequestURI(),
+		IP:       ctx.remoteIP,
+	})
+}
+
+// starts a session of the user for the admin, writing its token to the
+// response. The admin keeps their own session to return to.
+func startImpersonation(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Reason string `json:"reason"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	s.Reason = strings.TrimSpace(s.Reason)
+	if s.Reason == "" {
+		return validationFailure{map[string]string{"reason": "Reason is missing"}}
+	}
+
+	if target.IsAdmin {
+		return httpError{http.StatusForbidden, "Admins cannot be impersonated"}
+	}
+
+	adminID := ctx.user.ID
+	expiresAt := utcNow().Add(impersonationDuration)
+	session := &session{
+		UserID:         target.ID,
+		Key:            uniuri.NewLen(32),
+		IP:             ctx.remoteIP,
+		UserAgent:      r.UserAgent(),
+		ImpersonatorID: &adminID,
+		ExpiresAt:      &expiresAt,
+	}
+	if err := ctx.datamapper.createSession(session); err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("until=%s reason=%s", expiresAt.Format(time.RFC3339), s.Reason)
+	if err := writeAuditLog(ctx, "impersonate", target.ID, details); err != nil {
+		return err
+	}
+
+	if err := ctx.session.writeToken(w, target.ID, session.Key); err != nil {
+		return err
+	}
+
+	target.IsAuthenticated = true
+	target.SessionID = session.ID
+	target.Impersonator = &impersonator{ctx.user.ID, ctx.user.Name, expiresAt}
+	return renderJSON(w, newSessionInfo(target), http.StatusCreated)
+}
+
+// ends the session of the admin acting as the user
+func stopImpersonation(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.user.Impersonator == nil {
+		return httpError{http.StatusBadRequest, "You are not acting as another user"}
+	}
+
+	if err := ctx.datamapper.deleteSession(ctx.user.ID, ctx.user.SessionID); err != nil && !isErrSqlNoRows(err) {
+		return err
+	}
+
+	if err := ctx.datamapper.createAuditEntry(&auditEntry{
+		UserID:   ctx.user.Impersonator.ID,
+		Action:   "stop_impersonation",
+		TargetID: ctx.user.ID,
+		IP:       ctx.remoteIP,
+	}); err != nil {
+		return err
+	}
+
+	if err := ctx.session.writeToken(w, 0, ""); err != nil {
+		return err
+	}
+	return renderJSON(w, newSessionInfo(&user{}), http.StatusOK)
+}
@@ -0,0 +1,95 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImpersonation(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	admin := &user{Name: "admin", Email: "admin@localhost", IsAdmin: true, IsActive: true}
+	adminToken, err := dm.login(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &user{Name: "target", Email: "target@localhost", IsActive: true}
+	if _, err := dm.login(target); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	impersonateURL := fmt.Sprintf("/api/admin/users/%d/impersonate", target.ID)
+
+	if res := send("POST", impersonateURL, adminToken, `{"reason": ""}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a reason, got %d", res.Code)
+	}
+	if res := send("POST", fmt.Sprintf("/api/admin/users/%d/impersonate", admin.ID), adminToken, `{"reason": "test"}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an admin, got %d", res.Code)
+	}
+
+	res := send("POST", impersonateURL, adminToken, `{"reason": "photo upload fails"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	token := res.Header().Get(tokenHeader)
+
+	res = send("GET", "/api/auth/", token, "")
+	info := &sessionInfo{}
+	if err := json.NewDecoder(res.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != target.ID || info.Impersonator == nil || info.Impersonator.ID != admin.ID {
+		t.Errorf("Expected the target with the admin, got %+v", info)
+	}
+	if res.Header().Get(impersonatedByHeader) != "admin" {
+		t.Errorf("Expected the %s header, got %v", impersonatedByHeader, res.Header())
+	}
+
+	var requests int
+	for _, e := range dm.audit {
+		if e.UserID == admin.ID && e.TargetID == target.ID && e.Action == "impersonated_request" {
+			requests++
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the request in the audit log, got %+v", dm.audit)
+	}
+
+	// the session ends on time
+	s := dm.sessions[strings.SplitN(token, ":", 2)[1]]
+	expired := time.Now().Add(-time.Minute)
+	s.ExpiresAt = &expired
+	dm.sessions[s.Key] = s
+	if res := send("DELETE", "/api/user/impersonation", token, ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after the session expires, got %d", res.Code)
+	}
+
+	res = send("POST", impersonateURL, adminToken, `{"reason": "again"}`)
+	token = res.Header().Get(tokenHeader)
+	if res := send("DELETE", "/api/user/impersonation", token, ""); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := send("DELETE", "/api/user/impersonation", token, ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("Session should be ended, got %d", res.Code)
+	}
+	if res := send("GET", "/api/auth/", adminToken, ""); !strings.Contains(res.Body.String(), `"name":"admin"`) {
+		t.Errorf("Admin should keep their session, got %s", res.Body.String())
+	}
+}
@@ -0,0 +1,228 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A labeler suggests tags and alt text for new uploads, e.g. with an external
+// vision API or a local model. Suggestions are kept until the owner accepts
+// or dismisses them.
+
+const (
+	maxSuggestedTags = 10
+	labelerTimeout   = 30 * time.Second
+)
+
+type labeler interface {
+	label(src io.Reader, contentType string) (*photoSuggestions, error)
+}
+
+// returns the labeler set in the config, or nil if there is none
+func newLabeler(cfg *config) labeler {
+	if cfg.LabelerURL == "" {
+		return nil
+	}
+	return &httpLabeler{
+		url:    cfg.LabelerURL,
+		token:  cfg.LabelerToken,
+		client: &http.Client{Timeout: labelerTimeout},
+	}
+}
+
+// posts the image to a service, which returns JSON such as
+// {"tags": ["heron", "lake"], "altText": "A heron standing in shallow water"}.
+// The service is set by admins, so it may run on a private network.
+type httpLabeler struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (l *httpLabeler) label(src io.Reader, contentType string) (*photoSuggestions, error) {
+	req, err := http.NewRequest("POST", l.url, src)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if l.token != "" {
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	}
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("labeler returned %s", res.Status)
+	}
+
+	s := &photoSuggestions{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// asks the labeler for suggestions for the stored photo and saves them
+func labelPhoto(lb labeler, filestore fileStorage, datamapper dataMapper, photo *photo, contentType string) {
+
+	src, err := filestore.open(photo.Filename)
+	if err != nil {
+		logError(err)
+		return
+	}
+	defer src.Close()
+
+	s, err := lb.label(src, contentType)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	s.PhotoID = photo.ID
+	s.Tags = cleanSuggestedTags(s.Tags, photo.Tags)
+	s.AltText = strings.TrimSpace(s.AltText)
+	if len(s.AltText) > maxAltTextLength {
+		s.AltText = ""
+	}
+	if len(s.Tags) == 0 && s.AltText == "" {
+		return
+	}
+
+	if err := datamapper.saveSuggestions(s); err != nil {
+		logError(err)
+	}
+}
+
+// makes single-word lowercase tags of the suggestions, e.g. "Golden
+// Retriever" becomes "golden-retriever", leaving out those the photo
+// already has
+func cleanSuggestedTags(suggested []string, existing []string) []string {
+
+	seen := make(map[string]bool)
+	for _, name := range existing {
+		seen[strings.ToLower(name)] = true
+	}
+
+	var tags []string
+	for _, name := range suggested {
+		name = strings.ToLower(strings.Join(strings.Fields(strings.TrimPrefix(strings.TrimSpace(name), "#")), "-"))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		tags = append(tags, name)
+		if len(tags) == maxSuggestedTags {
+			break
+		}
+	}
+	return tags
+}
+
+func getSuggestions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s, err := ctx.datamapper.getSuggestions(photo.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, s, http.StatusOK)
+}
+
+// adds the accepted tags to the photo, and replaces its alt text with the
+// suggested one if accepted, then removes the suggestions
+func acceptSuggestions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s, err := ctx.datamapper.getSuggestions(photo.ID)
+	if err != nil {
+		return err
+	}
+
+	accepted := &struct {
+		Tags    []string `json:"tags"`
+		AltText bool     `json:"altText"`
+	}{}
+
+	if err := decodeJSON(r, accepted); err != nil {
+		return err
+	}
+
+	detail, err := ctx.datamapper.getPhotoDetail(photo.ID, ctx.user)
+	if err != nil {
+		return err
+	}
+	photo.Tags = detail.Tags
+
+	suggested := make(map[string]bool)
+	for _, name := range s.Tags {
+		suggested[name] = true
+	}
+	for _, name := range accepted.Tags {
+		if !suggested[name] {
+			return httpError{http.StatusBadRequest, "Only suggested tags can be accepted"}
+		}
+		photo.Tags = append(photo.Tags, name)
+	}
+
+	acceptAltText := accepted.AltText && s.AltText != ""
+	if acceptAltText {
+		photo.AltText = s.AltText
+	}
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
+	if acceptAltText {
+		if err := ctx.datamapper.updatePhoto(photo); err != nil {
+			return err
+		}
+	}
+
+	if len(accepted.Tags) > 0 {
+		if err := ctx.datamapper.updateTags(photo); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.datamapper.removeSuggestions(photo.ID); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderString(w, http.StatusOK, "Photo updated")
+}
+
+func dismissSuggestions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.removeSuggestions(photo.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Suggestions dismissed")
+}
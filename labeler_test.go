@@ -0,0 +1,119 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPLabeler(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "image" || r.Header.Get("Content-Type") != "image/jpeg" {
+			t.Errorf("Unexpected request: %q %s", body, r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Token should be sent, got %q", r.Header.Get("Authorization"))
+		}
+		fmt.Fprint(w, `{"tags": ["heron", "lake"], "altText": "A heron"}`)
+	}))
+	defer srv.Close()
+
+	lb := newLabeler(&config{LabelerURL: srv.URL, LabelerToken: "secret"})
+	s, err := lb.label(strings.NewReader("image"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Tags, []string{"heron", "lake"}) || s.AltText != "A heron" {
+		t.Errorf("Unexpected suggestions: %+v", s)
+	}
+
+	if newLabeler(&config{}) != nil {
+		t.Error("Labeler should be disabled without a URL")
+	}
+}
+
+func TestCleanSuggestedTags(t *testing.T) {
+	tags := cleanSuggestedTags([]string{"Golden Retriever", "#dog", "Dog", "park", " "}, []string{"park"})
+	if !reflect.DeepEqual(tags, []string{"golden-retriever", "dog"}) {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+}
+
+type fakeLabeler struct {
+	suggestions *photoSuggestions
+}
+
+func (l *fakeLabeler) label(src io.Reader, contentType string) (*photoSuggestions, error) {
+	return l.suggestions, nil
+}
+
+func TestAcceptSuggestions(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID, Tags: []string{"bird"}}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.filestore.store(bytes.NewReader([]byte("image")), p.Filename, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	labelPhoto(&fakeLabeler{&photoSuggestions{
+		Tags:    []string{"Bird", "heron", "lake"},
+		AltText: "A heron standing in shallow water",
+	}}, app.filestore, dm, p, "image/jpeg")
+
+	url := fmt.Sprintf("http://localhost/api/photos/%d/suggestions", p.ID)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), `"tags":["heron","lake"]`) {
+		t.Errorf("Suggestions should leave out existing tags, got %s", res.Body.String())
+	}
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"tags": ["sunset"]}`, http.StatusBadRequest},
+		{`{"tags": ["heron"], "altText": true}`, http.StatusOK},
+		{`{"tags": ["lake"]}`, http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("POST", url+"/accept", strings.NewReader(tc.body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.body, tc.status, res.Code)
+		}
+	}
+
+	p, _ = dm.getPhoto(p.ID)
+	if !reflect.DeepEqual(p.Tags, []string{"bird", "heron"}) {
+		t.Errorf("Accepted tags should be added, got %v", p.Tags)
+	}
+	if p.AltText != "A heron standing in shallow water" {
+		t.Errorf("Accepted alt text should be set, got %q", p.AltText)
+	}
+}
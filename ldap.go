@@ -0,0 +1,150 @@
+package photoshare
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/juju/errgo"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Intranet deployments check logins against an LDAP directory or Active
+// Directory. With LDAP_URL set, the service account LDAP_BIND_DN searches
+// LDAP_BASE_DN for the entry of the name or email given, with
+// LDAP_USER_FILTER, and the password is checked by binding as the entry.
+// Users are created on their first login from the name and email of their
+// entry. Local accounts, such as admins made with createadmin, still log in
+// with their own password.
+
+const ldapTimeout = 10 * time.Second
+
+// characters of directory names not allowed in user names, e.g. "jane.doe"
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// checks the credentials given on login
+type directory interface {
+	// returns the name and email of the account, or nil if the credentials
+	// are refused
+	authenticate(identifier, password string) (*authInfo, error)
+}
+
+// returns the configured directory, or nil if there is none
+func newDirectory(cfg *config) directory {
+	if cfg.LDAPURL == "" {
+		return nil
+	}
+	return &ldapDirectory{cfg}
+}
+
+type ldapDirectory struct {
+	cfg *config
+}
+
+func (d *ldapDirectory) authenticate(identifier, password string) (*authInfo, error) {
+
+	// binding without a password succeeds as an anonymous bind
+	if password == "" {
+		return nil, nil
+	}
+
+	conn, err := ldap.DialURL(d.cfg.LDAPURL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if d.cfg.LDAPStartTLS {
+		u, err := url.Parse(d.cfg.LDAPURL)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	if err := conn.Bind(d.cfg.LDAPBindDN, d.cfg.LDAPBindPassword); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	filter := strings.Replace(d.cfg.LDAPUserFilter, "%s", ldap.EscapeFilter(identifier), -1)
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.cfg.LDAPBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		filter, []string{d.cfg.LDAPNameAttribute, d.cfg.LDAPEmailAttribute}, nil,
+	))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// an identifier matching several entries is refused
+	if len(result.Entries) != 1 {
+		return nil, nil
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+
+	info := &authInfo{
+		name:  entry.GetAttributeValue(d.cfg.LDAPNameAttribute),
+		email: strings.ToLower(entry.GetAttributeValue(d.cfg.LDAPEmailAttribute)),
+	}
+	if info.name == "" || info.email == "" {
+		return nil, fmt.Errorf("LDAP entry %s has no %s or %s", entry.DN, d.cfg.LDAPNameAttribute, d.cfg.LDAPEmailAttribute)
+	}
+	return info, nil
+}
+
+// returns the user of the directory account, creating them on their first
+// login, or nil if there is no directory or it refuses the credentials
+func loginDirectory(ctx *context, r *http.Request, identifier, password string) (*user, error) {
+
+	if ctx.directory == nil {
+		return nil, nil
+	}
+
+	info, err := ctx.directory.authenticate(identifier, password)
+	if err != nil || info == nil {
+		return nil, err
+	}
+
+	return provisionUser(ctx, r, info)
+}
+
+// returns the user with the email of an account of the directory, creating
+// them if there is none
+func provisionUser(ctx *context, r *http.Request, info *authInfo) (*user, error) {
+
+	existing, err := ctx.datamapper.getUserByEmail(info.email)
+	if err == nil {
+		return existing, nil
+	}
+	if !isErrSqlNoRows(err) {
+		return nil, err
+	}
+
+	user := &user{
+		Name:  invalidNameChars.ReplaceAllString(info.name, "_"),
+		Email: info.email,
+	}
+	// never used, as the user logs in elsewhere
+	if err := user.setRandomPassword(); err != nil {
+		return nil, err
+	}
+	if err := ctx.validate(user, r); err != nil {
+		return nil, err
+	}
+	if err := ctx.datamapper.createUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,73 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// accepts "secret" as the password of each account
+type fakeDirectory struct {
+	accounts map[string]*authInfo
+}
+
+func (d *fakeDirectory) authenticate(identifier, password string) (*authInfo, error) {
+	if info, ok := d.accounts[identifier]; ok && password == "secret" {
+		return info, nil
+	}
+	return nil, nil
+}
+
+func TestLoginDirectory(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.directory = &fakeDirectory{map[string]*authInfo{
+		"jane.doe": {"jane.doe", "jane@example.com"},
+		"local":    {"local", "local@example.com"},
+	}}
+
+	local := &user{Name: "local", Email: "local@example.com", IsActive: true}
+	if err := local.changePassword("password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.createUser(local); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(identifier, password string) int {
+		body := `{"identifier": "` + identifier + `", "password": "` + password + `"}`
+		req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	if code := login("jane.doe", "wrong"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a wrong password, got %d", code)
+	}
+	if code := login("jane.doe", "secret"); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	jane, err := dm.getUserByEmail("jane@example.com")
+	if err != nil {
+		t.Fatal("Expected the user created on their first login")
+	}
+	if jane.Name != "jane_doe" {
+		t.Errorf("Expected the name made valid, got %s", jane.Name)
+	}
+	if code := login("jane.doe", "secret"); code != http.StatusCreated {
+		t.Errorf("Expected 201 on the next login, got %d", code)
+	}
+	if len(dm.users) != 2 {
+		t.Errorf("Expected the user created once, got %d users", len(dm.users))
+	}
+
+	// local accounts log in with either password
+	for _, password := range []string{"password", "secret"} {
+		if code := login("local", password); code != http.StatusCreated {
+			t.Errorf("Expected 201 for the local account, got %d", code)
+		}
+	}
+}
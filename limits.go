@@ -0,0 +1,44 @@
+package photoshare
+
+import (
+	"image"
+	"io"
+	"net/http"
+)
+
+// A small PNG or GIF can declare billions of pixels, which decoding would
+// allocate at once. Images are checked against MAX_IMAGE_PIXELS from their
+// header before they are decoded, and uploads are admitted to the
+// processing pool by the memory decoding them takes (see processing.go).
+
+// bytes taken by each pixel of an upload being processed: it is decoded
+// once for its size, colors and blurhash, and again for the thumbnail
+const decodedBytesPerPixel = 8
+
+var errTooManyPixels = httpError{http.StatusRequestEntityTooLarge, "Image has too many pixels"}
+
+// checks the size of the image from its header, returning the memory taken
+// to process it. Images whose header cannot be read are left to fail when
+// they are decoded.
+func checkImageSize(cfg *config, src readable) (int64, error) {
+	imgCfg, _, err := image.DecodeConfig(src)
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err != nil {
+		return 0, nil
+	}
+	pixels := int64(imgCfg.Width) * int64(imgCfg.Height)
+	if cfg.MaxImagePixels > 0 && pixels > cfg.MaxImagePixels {
+		return 0, errTooManyPixels
+	}
+	return pixels * decodedBytesPerPixel, nil
+}
+
+// decodes the image once its header is checked
+func decodeImage(cfg *config, src readable) (image.Image, string, error) {
+	if _, err := checkImageSize(cfg, src); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(src)
+}
@@ -0,0 +1,170 @@
+package photoshare
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// returns a small GIF whose header claims 65535x65535 pixels
+func gifBomb(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	if err := gif.Encode(buf, image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	copy(b[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+	return b
+}
+
+func TestCheckImageSize(t *testing.T) {
+
+	cfg := &config{MaxImagePixels: 100000000}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(buf.Bytes())
+	if cost, err := checkImageSize(cfg, src); err != nil || cost != 400*200*decodedBytesPerPixel {
+		t.Errorf("Expected the cost of 400x200 pixels, got %d (%v)", cost, err)
+	}
+	if _, _, err := image.Decode(src); err != nil {
+		t.Errorf("Expected the image to be read from the start after the check, got %v", err)
+	}
+
+	if _, err := checkImageSize(cfg, bytes.NewReader(gifBomb(t))); err != errTooManyPixels {
+		t.Errorf("Expected too many pixels, got %v", err)
+	}
+	if _, _, err := decodeImage(cfg, bytes.NewReader(gifBomb(t))); err != errTooManyPixels {
+		t.Errorf("Expected the image not to be decoded, got %v", err)
+	}
+
+	// left to fail when decoded
+	if cost, err := checkImageSize(cfg, bytes.NewReader([]byte("not an image"))); err != nil || cost != 0 {
+		t.Errorf("Expected no cost for an unreadable image, got %d (%v)", cost, err)
+	}
+}
+
+func TestUploadTooManyPixels(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.MaxImagePixels = 100000000
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("title", "bomb")
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="photo"; filename="bomb.gif"`)
+	h.Set("Content-Type", "image/gif")
+	part, _ := form.CreatePart(h)
+	part.Write(gifBomb(t))
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/photos/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d: %s", res.Code, res.Body.String())
+	}
+	if len(app.filestore.(*memoryFileStorage).files) != 0 {
+		t.Error("The image should not be stored")
+	}
+}
+
+func TestProcessingMemory(t *testing.T) {
+
+	p := newProcessingPool(&config{ProcessingWorkers: 2, ProcessingQueueSize: 10, ProcessingUserLimit: 2, ProcessingMemory: 100})
+
+	if _, err := p.submit(&processingJob{ownerID: 1, cost: 150, run: func(*processingJob) ([]*photo, error) {
+		return []*photo{{}}, nil
+	}}); err == nil || err.(httpError).Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a job larger than the memory, got %v", err)
+	}
+
+	started := make(chan int, 2)
+	release := make(chan struct{})
+	var jobs []*processingJob
+	for i := 0; i < 2; i++ {
+		i := i
+		job, err := p.submit(&processingJob{ownerID: 1, cost: 60, run: func(*processingJob) ([]*photo, error) {
+			started <- i
+			<-release
+			return []*photo{{}}, nil
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	<-started
+	select {
+	case <-started:
+		t.Error("Expected the second job to wait for memory")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if status, _ := p.status(jobs[1].ID, 1); status.Status != jobQueued {
+		t.Errorf("Expected the second job to be queued, got %s", status.Status)
+	}
+
+	close(release)
+	for _, job := range jobs {
+		select {
+		case <-job.done:
+		case <-time.After(time.Second):
+			t.Fatal("Expected both jobs to finish")
+		}
+	}
+}
+
+func TestProcessingTimeout(t *testing.T) {
+
+	p := newProcessingPool(&config{ProcessingWorkers: 1, ProcessingQueueSize: 10, ProcessingUserLimit: 1})
+	p.Lock()
+	p.timeout = 20 * time.Millisecond
+	p.Unlock()
+
+	release := make(chan struct{})
+	stopped := make(chan error, 1)
+	job, err := p.submit(&processingJob{ownerID: 1, run: func(job *processingJob) ([]*photo, error) {
+		<-release
+		err := job.stage(uploadStoring)
+		stopped <- err
+		return nil, err
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-job.done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the job to time out")
+	}
+	if status, _ := p.status(job.ID, 1); status.Status != jobFailed || status.err != errProcessingTimeout {
+		t.Errorf("Expected the job to fail with a timeout, got %s %v", status.Status, status.err)
+	}
+
+	close(release)
+	if err := <-stopped; err != errProcessingTimeout {
+		t.Errorf("Expected the job to stop at its next stage, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package photoshare
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// In maintenance the site is read-only: requests other than GET, HEAD and
+// OPTIONS get a 503 with Retry-After, while pages, photos and images are
+// still served. Admins switch it on and off at /api/admin/maintenance; it is
+// stored as the maintenance feature flag, so other servers follow within
+// featureFlagsRefresh. Background jobs keep running.
+
+var errMaintenance = httpError{http.StatusServiceUnavailable, "The site is in maintenance, please try again later"}
+
+// routes still accepting writes in maintenance, for admins to log in and
+// switch it off
+var maintenanceRoutes = map[string]bool{
+	"login":          true,
+	"setMaintenance": true,
+}
+
+// refuses writes while the site is in maintenance
+func (app *app) checkMaintenance(w http.ResponseWriter, r *http.Request, site *site) error {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" || app.features == nil {
+		return nil
+	}
+	if route := mux.CurrentRoute(r); route != nil && maintenanceRoutes[route.GetName()] {
+		return nil
+	}
+	if !app.features.forSite(site.ID).isEnabled(featureMaintenance, nil) {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(app.cfg.MaintenanceRetryAfter))
+	return errMaintenance
+}
+
+func getMaintenance(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return renderJSON(w, map[string]interface{}{
+		"enabled":    ctx.features.isEnabled(featureMaintenance, nil),
+		"retryAfter": ctx.cfg.MaintenanceRetryAfter,
+	}, http.StatusOK)
+}
+
+func setMaintenance(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Enabled bool `json:"enabled"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	percentage := 0
+	if s.Enabled {
+		percentage = 100
+	}
+	if err := ctx.features.set(featureMaintenance, percentage); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "maintenance", 0, fmt.Sprintf("enabled=%t", s.Enabled)); err != nil {
+		return err
+	}
+	return getMaintenance(ctx, w, r)
+}
@@ -0,0 +1,57 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.MaintenanceRetryAfter = 60
+
+	admin := &user{Name: "admin", Email: "admin@localhost", IsAdmin: true}
+	adminToken, err := dm.login(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := send("PUT", "/api/admin/maintenance", ownerToken, `{"enabled": true}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected only admins to switch maintenance, got %d", res.Code)
+	}
+	if res := send("PUT", "/api/admin/maintenance", adminToken, `{"enabled": true}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	res := send("PUT", "/api/user/slug", ownerToken, `{"slug": "owner-slug"}`)
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected writes to be refused, got %d %q", res.Code, res.Header().Get("Retry-After"))
+	}
+	if res := send("GET", "/api/admin/maintenance", adminToken, ""); res.Code != http.StatusOK ||
+		!strings.Contains(res.Body.String(), `"enabled":true`) {
+		t.Errorf("Expected reads to be served, got %d: %s", res.Code, res.Body.String())
+	}
+
+	if res := send("PUT", "/api/admin/maintenance", adminToken, `{"enabled": false}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := send("PUT", "/api/user/slug", ownerToken, `{"slug": "owner-slug"}`); res.Code != http.StatusOK {
+		t.Errorf("Expected writes once maintenance is off, got %d: %s", res.Code, res.Body.String())
+	}
+}
@@ -0,0 +1,95 @@
+package photoshare
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var mentionRegex = regexp.MustCompile(`\B@(\w+)`)
+
+// returns the unique user names mentioned in a piece of text, e.g. "@tester"
+func parseMentions(s string) []string {
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+	for _, match := range mentionRegex.FindAllStringSubmatch(s, -1) {
+		name := match[1]
+		key := strings.ToLower(name)
+		if !seen[key] {
+			seen[key] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// records mentions in the text, a title or comment of the photo, and
+// notifies the mentioned users. Names already mentioned in the previous text
+// are ignored, so editing a title or comment does not notify the same users
+// twice.
+func notifyMentions(ctx *context, r *http.Request, photo *photo, text, previous string) error {
+
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+
+	for _, name := range parseMentions(previous) {
+		seen[strings.ToLower(name)] = true
+	}
+
+	for _, name := range parseMentions(text) {
+		if !seen[strings.ToLower(name)] {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 || ctx.user.IsShadowBanned {
+		return nil
+	}
+
+	users, err := ctx.datamapper.getUsersByNames(names)
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range users {
+		if recipient.ID == ctx.user.ID {
+			continue
+		}
+		blocked, err := ctx.datamapper.isBlocked(recipient.ID, ctx.user.ID, true)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			continue
+		}
+		m := &mention{
+			UserID:   recipient.ID,
+			SenderID: ctx.user.ID,
+			PhotoID:  photo.ID,
+		}
+		if err := ctx.datamapper.createMention(m); err != nil {
+			return err
+		}
+
+		if err := sendNotification(ctx, r, &recipient, notificationMention, photo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getMentions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	mentions, err := ctx.datamapper.getMentions(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	loc := ctx.user.location()
+	for i := range mentions.Items {
+		mentions.Items[i].Created = newDisplayTime(mentions.Items[i].CreatedAt, loc)
+	}
+	return renderJSON(w, mentions, http.StatusOK)
+}
@@ -0,0 +1,21 @@
+package photoshare
+
+import (
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	names := parseMentions("sunset with @tester and @Other, also @tester again")
+	if len(names) != 2 {
+		t.Fatal("There should be 2 mentions")
+	}
+	if names[0] != "tester" || names[1] != "Other" {
+		t.Error("Mentions should be returned in order")
+	}
+}
+
+func TestParseMentionsIgnoresEmails(t *testing.T) {
+	if len(parseMentions("contact tester@gmail.com")) != 0 {
+		t.Error("Email addresses should not be mentions")
+	}
+}
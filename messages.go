@@ -5,6 +5,7 @@ import (
 	"github.com/igm/pubsub"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
 	"log"
+	"net/http"
 )
 
 var pub pubsub.Publisher
@@ -16,11 +17,20 @@ type socketMessage struct {
 	Type     string `json:"type"`
 }
 
-func sendMessage(msg *socketMessage) {
-	pub.Publish(msg)
+// a message for the sessions of one site
+type siteMessage struct {
+	siteID int64
+	body   interface{}
 }
 
-func receiveMessage(session sockjs.Session) {
+// publishes the message, a socketMessage or another type with sender,
+// receiver and type fields, to every session of the site. Receivers are
+// user names, which are only unique within a site.
+func sendMessage(siteID int64, msg interface{}) {
+	pub.Publish(&siteMessage{siteID, msg})
+}
+
+func receiveMessage(session sockjs.Session, siteID int64) {
 	reader, _ := pub.SubChannel(nil)
 	for {
 		select {
@@ -29,8 +39,11 @@ func receiveMessage(session sockjs.Session) {
 				log.Println("channel closed")
 				return
 			}
-			msg = msg.(*socketMessage)
-			if body, err := json.Marshal(msg); err == nil {
+			m, ok := msg.(*siteMessage)
+			if !ok || m.siteID != siteID {
+				continue
+			}
+			if body, err := json.Marshal(m.body); err == nil {
 				log.Println("message:", string(body))
 				if err = session.Send(string(body)); err != nil {
 					log.Println(err)
@@ -41,10 +54,18 @@ func receiveMessage(session sockjs.Session) {
 	}
 }
 
-var messageHandler = sockjs.NewHandler(
-	"/api/messages",
-	sockjs.DefaultOptions, func(session sockjs.Session) {
-		go func() {
-			receiveMessage(session)
-		}()
-	})
+// sends each session the messages of the site of its host
+func newMessageHandler(sites siteResolver) http.Handler {
+	return sockjs.NewHandler(
+		"/api/messages",
+		sockjs.DefaultOptions, func(session sockjs.Session) {
+			site, err := sites.resolve(session.Request().Host)
+			if err != nil {
+				session.Close(http.StatusNotFound, err.Error())
+				return
+			}
+			go func() {
+				receiveMessage(session, site.ID)
+			}()
+		})
+}
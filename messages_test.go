@@ -0,0 +1,39 @@
+package photoshare
+
+import (
+	"errors"
+	"gopkg.in/igm/sockjs-go.v2/sockjs"
+	"strings"
+	"testing"
+	"time"
+)
+
+// records the first message sent, then closes
+type recordingSession struct {
+	sockjs.Session
+	sent chan string
+}
+
+func (s *recordingSession) Send(msg string) error {
+	s.sent <- msg
+	return errors.New("closed")
+}
+
+func TestReceiveMessageOfSite(t *testing.T) {
+
+	session := &recordingSession{sent: make(chan string, 1)}
+	go receiveMessage(session, 2)
+
+	for {
+		sendMessage(1, &socketMessage{"other", "", 1, "photo_updated"})
+		sendMessage(2, &socketMessage{"tester", "", 2, "photo_updated"})
+		select {
+		case msg := <-session.sent:
+			if !strings.Contains(msg, `"sender":"tester"`) {
+				t.Errorf("Only messages of the site should be sent, got %s", msg)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package photoshare
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are applied with the same version table as goose, so databases
+// migrated with either tool stay in sync.
+
+const createMigrationsTableSql = `CREATE TABLE IF NOT EXISTS goose_db_version (
+    id serial NOT NULL PRIMARY KEY,
+    version_id bigint NOT NULL,
+    is_applied boolean NOT NULL,
+    tstamp timestamp NULL DEFAULT now()
+)`
+
+type migration struct {
+	version  int64
+	filename string
+}
+
+// returns the migrations in the directory in order of version
+func getMigrations(dirname string) ([]migration, error) {
+	var migrations []migration
+
+	filenames, err := filepath.Glob(filepath.Join(dirname, "*.sql"))
+	if err != nil {
+		return migrations, err
+	}
+
+	for _, filename := range filenames {
+		name := filepath.Base(filename)
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			return migrations, fmt.Errorf("invalid migration name %s", name)
+		}
+		migrations = append(migrations, migration{version, filename})
+	}
+
+	sort.Sort(migrationsByVersion(migrations))
+	return migrations, nil
+}
+
+type migrationsByVersion []migration
+
+func (m migrationsByVersion) Len() int           { return len(m) }
+func (m migrationsByVersion) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m migrationsByVersion) Less(i, j int) bool { return m[i].version < m[j].version }
+
+// returns the "Up" section of a goose migration
+func parseMigrationUp(body string) string {
+	var lines []string
+	up := false
+	for _, line := range strings.Split(body, "\n") {
+		switch strings.TrimSpace(line) {
+		case "-- +goose Up":
+			up = true
+			continue
+		case "-- +goose Down":
+			up = false
+			continue
+		}
+		if up {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// returns the versions recorded as applied. Goose records a row for each
+// migration and rollback, so the latest row for a version wins.
+func getAppliedMigrations(db *sql.DB) (map[int64]bool, error) {
+	applied := make(map[int64]bool)
+
+	if _, err := db.Exec(createMigrationsTableSql); err != nil {
+		return applied, err
+	}
+
+	rows, err := db.Query("SELECT version_id, is_applied FROM goose_db_version ORDER BY id DESC")
+	if err != nil {
+		return applied, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			version   int64
+			isApplied bool
+		)
+		if err := rows.Scan(&version, &isApplied); err != nil {
+			return applied, err
+		}
+		if _, ok := applied[version]; !ok {
+			applied[version] = isApplied
+		}
+	}
+	return applied, rows.Err()
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	body, err := ioutil.ReadFile(m.filename)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(parseMigrationUp(string(body))); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %s", filepath.Base(m.filename), err)
+	}
+
+	if _, err := tx.Exec("INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, true)", m.version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applies any migrations in the directory not yet applied, returning the
+// migrations in the order applied
+func migrate(db *sql.DB, dirname string, dryRun bool) ([]migration, error) {
+	var pending []migration
+
+	migrations, err := getMigrations(dirname)
+	if err != nil {
+		return pending, err
+	}
+
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return pending, err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if !dryRun {
+			if err := applyMigration(db, m); err != nil {
+				return pending, err
+			}
+		}
+		pending = append(pending, m)
+	}
+	return pending, nil
+}
@@ -2,12 +2,14 @@ package photoshare
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/bcrypt"
 	"crypto/rand"
 	"database/sql"
 	"github.com/coopernurse/gorp"
+	"github.com/dchest/uniuri"
+	"github.com/lib/pq"
 	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -15,6 +17,10 @@ const (
 	pageSize               = 20
 	recoveryCodeLength     = 30
 	recoveryCodeCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	emailChangeExpiry      = 24 // hours
+	oidcLinkExpiry         = 24 // hours
+	nameChangeCooldown     = 30 // days
+	maxAltTextLength       = 1000
 )
 
 type photoList struct {
@@ -22,6 +28,12 @@ type photoList struct {
 	Total       int64   `json:"total"`
 	CurrentPage int64   `json:"currentPage"`
 	NumPages    int64   `json:"numPages"`
+
+	// the total is a recent count, see counts.go
+	Approximate bool `json:"approximate,omitempty"`
+
+	// shown ahead of the first page of the homepage, see homepage.go
+	Pinned []homepagePin `json:"pinned,omitempty"`
 }
 
 func newPhotoList(photos []photo, total int64, page int64) *photoList {
@@ -35,33 +47,160 @@ func newPhotoList(photos []photo, total int64, page int64) *photoList {
 	}
 }
 
+// one of the independent photo communities hosted by the deployment
+type site struct {
+	ID        int64     `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Hostname  string    `db:"hostname" json:"hostname"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+}
+
+func (site *site) PreInsert(s gorp.SqlExecutor) error {
+	site.CreatedAt = utcNow()
+	return nil
+}
+
 type tag struct {
 	ID   int64  `db:"id" json:"id"`
 	Name string `db:"name" json:"name"`
 }
 
+// a tag with the cover photo chosen by moderators, or else its top photo
 type tagCount struct {
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+	Photo       string `db:"photo" json:"photo"`
+	NumPhotos   int64  `db:"num_photos" json:"numPhotos"`
+}
+
+// a camera or lens with the number of photos taken with it
+type gearCount struct {
 	Name      string `db:"name" json:"name"`
-	Photo     string `db:"photo" json:"photo"`
+	Kind      string `db:"kind" json:"kind"`
 	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
 }
 
+// a tag with the details shown on its page
+type tagDetail struct {
+	ID           int64   `db:"id" json:"-"`
+	Name         string  `db:"name" json:"name"`
+	Description  string  `db:"description" json:"description"`
+	CoverPhotoID *int64  `db:"cover_photo_id" json:"coverPhotoId,omitempty"`
+	CoverPhoto   *string `db:"cover_photo" json:"coverPhoto,omitempty"`
+	NumPhotos    int64   `db:"num_photos" json:"numPhotos"`
+}
+
+func (tag *tagDetail) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if len(tag.Description) > 1000 {
+		errors["description"] = "Description is too long"
+	}
+	return nil
+}
+
+// a page of the photos of a tag
+type tagPhotoList struct {
+	Tag       *tagDetail `json:"tag"`
+	Following bool       `json:"following"`
+	*photoList
+}
+
 type photo struct {
-	ID        int64     `db:"id" json:"id"`
-	OwnerID   int64     `db:"owner_id" json:"ownerId"`
-	CreatedAt time.Time `db:"created_at" json:"createdAt"`
-	Title     string    `db:"title" json:"title"`
-	Filename  string    `db:"photo" json:"photo"`
-	Tags      []string  `db:"-" json:"tags,omitempty"`
-	UpVotes   int64     `db:"up_votes" json:"upVotes"`
-	DownVotes int64     `db:"down_votes" json:"downVotes"`
+	ID        int64      `db:"id" json:"id"`
+	OwnerID   int64      `db:"owner_id" json:"ownerId"`
+	CreatedAt time.Time  `db:"created_at" json:"createdAt"`
+	Title     string     `db:"title" json:"title"`
+	AltText   string     `db:"alt_text" json:"altText"`
+	Filename  string     `db:"photo" json:"photo"`
+	Tags      []string   `db:"-" json:"tags,omitempty"`
+	UpVotes   int64      `db:"up_votes" json:"upVotes"`
+	DownVotes int64      `db:"down_votes" json:"downVotes"`
+	Score     int64      `db:"-" json:"score"`
+	TakenAt   *time.Time `db:"taken_at" json:"takenAt,omitempty"`
+	Latitude  *float64   `db:"latitude" json:"latitude,omitempty"`
+	Longitude *float64   `db:"longitude" json:"longitude,omitempty"`
+	SiteID    int64      `db:"site_id" json:"-"`
+
+	// from the EXIF data of the upload, see readGear
+	Camera string `db:"camera" json:"camera,omitempty"`
+	Lens   string `db:"lens" json:"lens,omitempty"`
+
+	// size of the upload in pixels, and its resolution if the file gives
+	// one, for the print sizes of the photo, see printSizes
+	Width  int `db:"width" json:"width,omitempty"`
+	Height int `db:"height" json:"height,omitempty"`
+	DPI    int `db:"dpi" json:"dpi,omitempty"`
+
+	// dominant colors as a pg array of 0xRRGGBB values, and as hex swatches
+	Palette string   `db:"palette" json:"-"`
+	Colors  []string `db:"-" json:"colors,omitempty"`
+
+	// SHA-256 of the uploaded file, checked after it is stored and
+	// periodically after, see checksums.go
+	Checksum string `db:"checksum" json:"checksum,omitempty"`
+
+	// placeholder drawn while the photo loads, see encodeBlurhash
+	Blurhash string `db:"blurhash" json:"blurhash,omitempty"`
+
+	// set when moderators pick the photo for the explore page
+	StaffPickedAt *time.Time `db:"staff_picked_at" json:"staffPickedAt,omitempty"`
+
+	// private photos are only shown to their owner
+	Private bool `db:"private" json:"private"`
+
+	// no comments are added while locked by the owner or an admin, see
+	// lockComments
+	CommentsLocked bool `db:"comments_locked" json:"commentsLocked"`
+
+	// price in cents of the original, nil unless the photo is for sale, and
+	// the license granted to buyers, see checkout.go
+	Price   *int64 `db:"price" json:"price,omitempty"`
+	License string `db:"license" json:"license,omitempty"`
+
+	// expiring photos are unpublished and deleted when they expire, see
+	// removeExpiredPhotos
+	ExpiresAt *time.Time `db:"expires_at" json:"expiresAt,omitempty"`
+
+	// set while the photo is in the trash of its owner, see trashPhotos
+	DeletedAt *time.Time `db:"deleted_at" json:"deletedAt,omitempty"`
+
+	// scored on upload, and set while the photo is held for review, see checkSpam
+	SpamScore int        `db:"spam_score" json:"spamScore,omitempty"`
+	HeldAt    *time.Time `db:"held_at" json:"heldAt,omitempty"`
+
+	// bumped by each edit, and sent as the ETag of the photo, see photoETag
+	Version int64 `db:"version" json:"version"`
+
+	// set by the database on every change of the photo, see getSync
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+
+	// votes not recorded in photo_votes, see recomputeScores
+	LegacyUpVotes   int64 `db:"legacy_up_votes" json:"-"`
+	LegacyDownVotes int64 `db:"legacy_down_votes" json:"-"`
 }
 
 func (photo *photo) PreInsert(s gorp.SqlExecutor) error {
-	photo.CreatedAt = time.Now()
+	photo.CreatedAt = utcNow()
+	photo.UpdatedAt = photo.CreatedAt
+	if photo.Palette == "" {
+		photo.Palette = "{}"
+	}
+	return nil
+}
+
+func (photo *photo) PostGet(s gorp.SqlExecutor) error {
+	photo.Score = photo.UpVotes - photo.DownVotes
+	photo.setPalette(pgArrToIntSlice(photo.Palette))
 	return nil
 }
 
+func (photo *photo) setPalette(palette []int64) {
+	photo.Palette = intSliceToPgArr(palette)
+	photo.Colors = nil
+	for _, c := range palette {
+		photo.Colors = append(photo.Colors, colorHex(c))
+	}
+}
+
 func (photo *photo) validate(ctx *context, r *http.Request, errors map[string]string) error {
 	if photo.OwnerID == 0 {
 		errors["ownerID"] = "Owner ID is missing"
@@ -72,12 +211,50 @@ func (photo *photo) validate(ctx *context, r *http.Request, errors map[string]st
 	if len(photo.Title) > 200 {
 		errors["title"] = "Title is too long"
 	}
+	if len(photo.AltText) > maxAltTextLength {
+		errors["altText"] = "Alt text is too long"
+	}
 	if photo.Filename == "" {
 		errors["photo"] = "Photo filename not set"
 	}
+	if photo.Price != nil && (*photo.Price < minPrice || *photo.Price > maxPrice) {
+		errors["price"] = "Price is out of range"
+	}
+	if len(photo.License) > maxLicenseLength {
+		errors["license"] = "License is too long"
+	}
+
+	blocked, err := ctx.getBlocklist()
+	if err != nil {
+		return err
+	}
+	if blocked.matches(photo.Title) {
+		errors["title"] = "Title contains a blocked word"
+	}
+	if blocked.matches(photo.AltText) {
+		errors["altText"] = "Alt text contains a blocked word"
+	}
+	for _, tag := range photo.Tags {
+		if blocked.matches(tag) {
+			errors["tags"] = "Tags contain a blocked word"
+			break
+		}
+	}
 	return nil
 }
 
+func (photo *photo) isExpired(now time.Time) bool {
+	return photo.ExpiresAt != nil && !photo.ExpiresAt.After(now)
+}
+
+// returns the alt text, or the title if there is none
+func (photo *photo) altText() string {
+	if photo.AltText != "" {
+		return photo.AltText
+	}
+	return photo.Title
+}
+
 func (photo *photo) canEdit(user *user) bool {
 	if user == nil || !user.IsAuthenticated {
 		return false
@@ -100,16 +277,42 @@ func (photo *photo) canVote(user *user) bool {
 	return !user.hasVoted(photo.ID)
 }
 
+func (photo *photo) canComment(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return !photo.CommentsLocked
+}
+
 type permissions struct {
-	Edit   bool `json:"edit"`
-	Delete bool `json:"delete"`
-	Vote   bool `json:"vote"`
+	Edit    bool `json:"edit"`
+	Delete  bool `json:"delete"`
+	Vote    bool `json:"vote"`
+	Comment bool `json:"comment"`
 }
 
 type photoDetail struct {
-	photo       `db:"-"`
-	OwnerName   string       `db:"owner_name" json:"ownerName"`
-	Permissions *permissions `db:"-" json:"perms"`
+	photo             `db:"-"`
+	OwnerName         string       `db:"owner_name" json:"ownerName"`
+	OwnerShadowBanned bool         `db:"owner_shadow_banned" json:"-"`
+	Permissions       *permissions `db:"-" json:"perms"`
+	Created           *displayTime `db:"-" json:"created,omitempty"`
+	PrintSizes        []printSize  `db:"-" json:"printSizes,omitempty"`
+	Currency          string       `db:"-" json:"currency,omitempty"`
+	Purchased         bool         `db:"-" json:"purchased,omitempty"`
+}
+
+// a photo changed since a sync checkpoint, see getSync
+type photoChange struct {
+	ID        int64     `db:"id"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// returns true unless the photo is hidden from all but its owner and admins,
+// being private, held, expired or of a shadow banned owner
+func (photo *photoDetail) isVisibleTo(user *user, now time.Time) bool {
+	return !(photo.OwnerShadowBanned || photo.Private || photo.HeldAt != nil || photo.isExpired(now)) ||
+		photo.canEdit(user)
 }
 
 // User represents users in database
@@ -117,20 +320,64 @@ type user struct {
 	ID              int64          `db:"id" json:"id"`
 	CreatedAt       time.Time      `db:"created_at" json:"createdAt"`
 	Name            string         `db:"name" json:"name"`
-	Password        string         `db:"password" json:""`
+	Password        string         `db:"password" json:"-"`
 	Email           string         `db:"email" json:"email"`
-	Votes           string         `db:"votes" json:""`
+	Votes           string         `db:"votes" json:"-"`
 	IsAdmin         bool           `db:"admin" json:"isAdmin"`
 	IsActive        bool           `db:"active" json:"isActive"`
-	RecoveryCode    sql.NullString `db:"recovery_code" json:""`
+	RecoveryCode    sql.NullString `db:"recovery_code" json:"-"`
+	NewEmail        sql.NullString `db:"new_email" json:"-"`
+	EmailChangeCode sql.NullString `db:"email_change_code" json:"-"`
+	EmailChangeExp  pq.NullTime    `db:"email_change_expires" json:"-"`
+	NameChangedAt   pq.NullTime    `db:"name_changed_at" json:"-"`
+	IsBanned        bool           `db:"banned" json:"isBanned"`
+	IsShadowBanned  bool           `db:"shadow_banned" json:"isShadowBanned"`
+	SiteID          int64          `db:"site_id" json:"-"`
+	Timezone        string         `db:"timezone" json:"timezone"`
+	Slug            *string        `db:"slug" json:"slug,omitempty"`
 	IsAuthenticated bool           `db:"-" json:"isAuthenticated"`
+	SessionID       int64          `db:"-" json:"-"`
+	Impersonator    *impersonator  `db:"-" json:"-"`
+
+	// see applyRetention
+	LastActiveAt       time.Time  `db:"last_active_at" json:"-"`
+	InactivityWarnedAt *time.Time `db:"inactivity_warned_at" json:"-"`
+	RetentionExempt    bool       `db:"retention_exempt" json:"retentionExempt"`
+
+	// see moderation.go
+	Strikes        int        `db:"strikes" json:"-"`
+	SuspendedUntil *time.Time `db:"suspended_until" json:"-"`
+
+	// see passwords.go
+	PasswordAlgorithm string `db:"password_algorithm" json:"-"`
+	PasswordPepper    string `db:"password_pepper" json:"-"`
+
+	// the password was never given to the user, who logs in with a
+	// directory or single sign-on, see setRandomPassword
+	RandomPassword bool `db:"random_password" json:"-"`
+
+	// see oidc.go
+	OIDCSubject     sql.NullString `db:"oidc_subject" json:"-"`
+	OIDCLinkSubject sql.NullString `db:"oidc_link_subject" json:"-"`
+	OIDCLinkCode    sql.NullString `db:"oidc_link_code" json:"-"`
+	OIDCLinkExp     pq.NullTime    `db:"oidc_link_expires" json:"-"`
+}
+
+// a user with the number of their photos, see applyRetention
+type inactiveUser struct {
+	user
+	NumPhotos int64 `db:"num_photos"`
 }
 
 // PreInsert hook
 func (user *user) PreInsert(s gorp.SqlExecutor) error {
 	user.IsActive = true
-	user.CreatedAt = time.Now()
+	user.CreatedAt = utcNow()
+	user.LastActiveAt = user.CreatedAt
 	user.Votes = "{}"
+	if user.Timezone == "" {
+		user.Timezone = defaultTimezone
+	}
 	user.encryptPassword()
 	return nil
 }
@@ -140,6 +387,13 @@ func (user *user) validate(ctx *context, r *http.Request, errors map[string]stri
 	if user.Name == "" {
 		errors["name"] = "Name is missing"
 	} else {
+		// names of existing users are checked when changed, see changeName,
+		// so rules added since do not lock their owners out
+		if user.ID == 0 {
+			if err := validateNewName(ctx, user.Name, errors); err != nil {
+				return err
+			}
+		}
 		ok, err := ctx.datamapper.isUserNameAvailable(user)
 		if err != nil {
 			return err
@@ -164,6 +418,13 @@ func (user *user) validate(ctx *context, r *http.Request, errors map[string]stri
 
 	}
 
+	// addresses of existing users are checked when changed, see changeEmail
+	if _, invalid := errors["email"]; !invalid && user.ID == 0 {
+		if msg := checkEmailDomain(ctx.cfg, user.Email); msg != "" {
+			errors["email"] = msg
+		}
+	}
+
 	// tbd: we need flag user is third-party
 	if user.Password == "" {
 		errors["password"] = "Password is missing"
@@ -172,7 +433,9 @@ func (user *user) validate(ctx *context, r *http.Request, errors map[string]stri
 	return nil
 
 }
-func (user *user) generateRecoveryCode() (string, error) {
+
+// generates a random code for use in emailed links
+func generateRandomCode() (string, error) {
 
 	buf := bytes.Buffer{}
 	randbytes := make([]byte, recoveryCodeLength)
@@ -189,8 +452,17 @@ func (user *user) generateRecoveryCode() (string, error) {
 		buf.WriteString(string(char))
 	}
 
-	code := buf.String()
-	user.RecoveryCode = sql.NullString{String: code, Valid: true}
+	return buf.String(), nil
+}
+
+// sets a new recovery code, returning it to be emailed; only its hash is
+// stored (see hashRecoveryCode)
+func (user *user) generateRecoveryCode() (string, error) {
+	code, err := generateRandomCode()
+	if err != nil {
+		return "", err
+	}
+	user.RecoveryCode = sql.NullString{String: hashRecoveryCode(code), Valid: true}
 	return code, nil
 }
 
@@ -198,20 +470,97 @@ func (user *user) resetRecoveryCode() {
 	user.RecoveryCode = sql.NullString{String: "", Valid: false}
 }
 
+// stores the new email address until the change is confirmed, returning
+// the code to email; only its hash is stored (see hashRecoveryCode)
+func (user *user) requestEmailChange(email string) (string, error) {
+	code, err := generateRandomCode()
+	if err != nil {
+		return "", err
+	}
+	user.NewEmail = sql.NullString{String: email, Valid: true}
+	user.EmailChangeCode = sql.NullString{String: hashRecoveryCode(code), Valid: true}
+	user.EmailChangeExp = pq.NullTime{Time: utcNow().Add(time.Hour * emailChangeExpiry), Valid: true}
+	return code, nil
+}
+
+func (user *user) isEmailChangeExpired() bool {
+	return !user.NewEmail.Valid || !user.EmailChangeExp.Valid || time.Now().After(user.EmailChangeExp.Time)
+}
+
+// switches to the new email address
+func (user *user) confirmEmailChange() {
+	user.Email = user.NewEmail.String
+	user.cancelEmailChange()
+}
+
+func (user *user) cancelEmailChange() {
+	user.NewEmail = sql.NullString{}
+	user.EmailChangeCode = sql.NullString{}
+	user.EmailChangeExp = pq.NullTime{}
+}
+
+// keeps the OpenID Connect account until the owner of the user confirms it
+// is theirs, returning the code to email them; only its hash is stored
+func (user *user) requestOIDCLink(subject string) (string, error) {
+	code, err := generateRandomCode()
+	if err != nil {
+		return "", err
+	}
+	user.OIDCLinkSubject = sql.NullString{String: subject, Valid: true}
+	user.OIDCLinkCode = sql.NullString{String: hashRecoveryCode(code), Valid: true}
+	user.OIDCLinkExp = pq.NullTime{Time: utcNow().Add(time.Hour * oidcLinkExpiry), Valid: true}
+	return code, nil
+}
+
+func (user *user) isOIDCLinkExpired() bool {
+	return !user.OIDCLinkSubject.Valid || !user.OIDCLinkExp.Valid || time.Now().After(user.OIDCLinkExp.Time)
+}
+
+// links the OpenID Connect account waiting for confirmation
+func (user *user) confirmOIDCLink() {
+	user.OIDCSubject = user.OIDCLinkSubject
+	user.cancelOIDCLink()
+}
+
+func (user *user) cancelOIDCLink() {
+	user.OIDCLinkSubject = sql.NullString{}
+	user.OIDCLinkCode = sql.NullString{}
+	user.OIDCLinkExp = pq.NullTime{}
+}
+
+// users may only change their name once per cooldown period
+func (user *user) canChangeName() bool {
+	if !user.NameChangedAt.Valid {
+		return true
+	}
+	return time.Now().After(user.NameChangedAt.Time.AddDate(0, 0, nameChangeCooldown))
+}
+
 func (user *user) changePassword(password string) error {
 	user.Password = password
+	user.RandomPassword = false
 	return user.encryptPassword()
 }
 
+// sets a password the user never sees, for users logging in with a
+// directory or single sign-on
+func (user *user) setRandomPassword() error {
+	if err := user.changePassword(uniuri.NewLen(32)); err != nil {
+		return err
+	}
+	user.RandomPassword = true
+	return nil
+}
+
 func (user *user) encryptPassword() error {
 	if user.Password == "" {
 		return nil
 	}
-	hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashed, algorithm, pepper, err := passwordHashing.hash(user.Password)
 	if err != nil {
 		return err
 	}
-	user.Password = string(hashed)
+	user.Password, user.PasswordAlgorithm, user.PasswordPepper = hashed, algorithm, pepper
 	return nil
 }
 
@@ -219,8 +568,7 @@ func (user *user) checkPassword(password string) bool {
 	if user.Password == "" {
 		return false
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	return err == nil
+	return passwordHashing.compare(user.PasswordAlgorithm, user.PasswordPepper, user.Password, password)
 }
 
 func (user *user) registerVote(photoID int64) {
@@ -244,10 +592,545 @@ func (user *user) setVotes(votes []int64) {
 	user.Votes = intSliceToPgArr(votes)
 }
 
+type mention struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	SenderID  int64     `db:"sender_id" json:"senderId"`
+	PhotoID   int64     `db:"photo_id" json:"photoId"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (mention *mention) PreInsert(s gorp.SqlExecutor) error {
+	mention.CreatedAt = utcNow()
+	return nil
+}
+
+type mentionDetail struct {
+	mention    `db:"-"`
+	SenderName string       `db:"sender_name" json:"senderName"`
+	Title      string       `db:"title" json:"title"`
+	Filename   string       `db:"photo" json:"photo"`
+	Created    *displayTime `db:"-" json:"created,omitempty"`
+}
+
+type mentionList struct {
+	Items       []mentionDetail `json:"mentions"`
+	Total       int64           `json:"total"`
+	CurrentPage int64           `json:"currentPage"`
+	NumPages    int64           `json:"numPages"`
+}
+
+func newMentionList(mentions []mentionDetail, total int64, page int64) *mentionList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &mentionList{
+		Items:       mentions,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+// sent by a user, or by the federated actor of a follow; follows have no
+// photo
+type notification struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	SenderID  *int64    `db:"sender_id" json:"senderId"`
+	Actor     string    `db:"actor" json:"actor,omitempty"`
+	PhotoID   *int64    `db:"photo_id" json:"photoId"`
+	Type      string    `db:"type" json:"type"`
+	IsRead    bool      `db:"is_read" json:"isRead"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (n *notification) PreInsert(s gorp.SqlExecutor) error {
+	n.CreatedAt = utcNow()
+	return nil
+}
+
+// the channels through which a user receives one type of notification
+type notificationPreference struct {
+	UserID int64  `db:"user_id" json:"-"`
+	Type   string `db:"type" json:"-"`
+	InApp  bool   `db:"in_app" json:"inApp"`
+	Email  bool   `db:"email" json:"email"`
+	Push   bool   `db:"push" json:"push"`
+}
+
+// notification preferences keyed by notification type
+type notificationSettings map[string]*notificationPreference
+
+// returns the settings of the user, using the defaults for types the user
+// has not changed
+func newNotificationSettings(userID int64, prefs []notificationPreference) notificationSettings {
+	settings := make(notificationSettings)
+	for _, kind := range notificationTypes {
+		settings[kind] = &notificationPreference{
+			UserID: userID,
+			Type:   kind,
+			InApp:  true,
+			Email:  kind == notificationMention,
+			Push:   true,
+		}
+	}
+	for i := range prefs {
+		if _, ok := settings[prefs[i].Type]; ok {
+			settings[prefs[i].Type] = &prefs[i]
+		}
+	}
+	return settings
+}
+
+// tags and alt text suggested for a photo by the labeler
+type photoSuggestions struct {
+	PhotoID   int64     `db:"photo_id" json:"-"`
+	TagList   string    `db:"tags" json:"-"` // space separated
+	Tags      []string  `db:"-" json:"tags"`
+	AltText   string    `db:"alt_text" json:"altText"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// a word or phrase not allowed in the site, see blocklist
+type blockedWord struct {
+	ID        int64     `db:"id" json:"id"`
+	SiteID    int64     `db:"site_id" json:"-"`
+	Word      string    `db:"word" json:"word"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (word *blockedWord) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if len(normalizeWords(word.Word)) == 0 {
+		errors["word"] = "Word is missing"
+	} else if len(word.Word) > maxBlockedWordLength {
+		errors["word"] = "Word is too long"
+	}
+	return nil
+}
+
+// the response to a request sent with an Idempotency-Key, see idempotent
+type idempotencyKey struct {
+	UserID      int64     `db:"user_id"`
+	Key         string    `db:"key"`
+	Fingerprint string    `db:"fingerprint"`
+	Status      int       `db:"status"`
+	ContentType string    `db:"content_type"`
+	Body        []byte    `db:"body"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// an album of the portfolio of a user, see portfolio.go
+type portfolioAlbum struct {
+	ID           int64     `db:"id" json:"id"`
+	SiteID       int64     `db:"site_id" json:"-"`
+	OwnerID      int64     `db:"owner_id" json:"-"`
+	Title        string    `db:"title" json:"title"`
+	Slug         *string   `db:"slug" json:"slug,omitempty"`
+	CoverPhotoID *int64    `db:"cover_photo_id" json:"coverPhotoId,omitempty"`
+	Position     int       `db:"position" json:"-"`
+	CreatedAt    time.Time `db:"created_at" json:"-"`
+	Cover        *photo    `db:"-" json:"cover,omitempty"`
+	Photos       []photo   `db:"-" json:"photos"`
+	PhotoIDs     []int64   `db:"-" json:"photoIds,omitempty"`
+}
+
+type portfolioPhoto struct {
+	photo   `db:"-"`
+	AlbumID int64 `db:"album_id"`
+}
+
+// A photo or an album pinned to the homepage by admins, from StartsAt until
+// EndsAt when they are set
+type homepagePin struct {
+	ID        int64           `db:"id" json:"id"`
+	SiteID    int64           `db:"site_id" json:"-"`
+	PhotoID   *int64          `db:"photo_id" json:"photoId,omitempty"`
+	AlbumID   *int64          `db:"album_id" json:"albumId,omitempty"`
+	Position  int             `db:"position" json:"-"`
+	StartsAt  *time.Time      `db:"starts_at" json:"startsAt"`
+	EndsAt    *time.Time      `db:"ends_at" json:"endsAt"`
+	CreatedAt time.Time       `db:"created_at" json:"-"`
+	Active    bool            `db:"-" json:"active"`
+	Photo     *photo          `db:"-" json:"photo,omitempty"`
+	Album     *portfolioAlbum `db:"-" json:"album,omitempty"`
+}
+
+// returns true if the pin is shown at the time
+func (pin *homepagePin) isActive(now time.Time) bool {
+	return (pin.StartsAt == nil || !now.Before(*pin.StartsAt)) && (pin.EndsAt == nil || now.Before(*pin.EndsAt))
+}
+
+type portfolio struct {
+	UserID int64            `json:"userId"`
+	Name   string           `json:"name"`
+	Slug   *string          `json:"slug,omitempty"`
+	Albums []portfolioAlbum `json:"albums"`
+}
+
+// a comment on a photo, see comments.go
+type comment struct {
+	ID        int64      `db:"id" json:"id"`
+	SiteID    int64      `db:"site_id" json:"-"`
+	PhotoID   int64      `db:"photo_id" json:"photoId"`
+	AuthorID  int64      `db:"author_id" json:"authorId"`
+	Body      string     `db:"body" json:"body"`
+	CreatedAt time.Time  `db:"created_at" json:"createdAt"`
+	Edited    bool       `db:"edited" json:"edited"`
+	EditedAt  *time.Time `db:"edited_at" json:"editedAt,omitempty"`
+}
+
+type commentPermissions struct {
+	Edit   bool `json:"edit"`
+	Delete bool `json:"delete"`
+}
+
+type commentDetail struct {
+	comment     `db:"-"`
+	AuthorName  string              `db:"author_name" json:"authorName"`
+	Permissions *commentPermissions `db:"-" json:"perms"`
+}
+
+func (comment *comment) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if comment.Body == "" {
+		errors["body"] = "Comment is missing"
+	}
+	if len(comment.Body) > maxCommentLength {
+		errors["body"] = "Comment is too long"
+	}
+	blocked, err := ctx.getBlocklist()
+	if err != nil {
+		return err
+	}
+	if blocked.matches(comment.Body) {
+		errors["body"] = "Comment contains a blocked word"
+	}
+	return nil
+}
+
+// authors may edit their comments for the edit window
+func (comment *comment) canEdit(user *user, window time.Duration, now time.Time) bool {
+	if user == nil || !user.IsAuthenticated || comment.AuthorID != user.ID {
+		return false
+	}
+	return now.Before(comment.CreatedAt.Add(window))
+}
+
+// authors may delete their comments, and admins remove any comment
+func (comment *comment) canDelete(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return user.IsAdmin || comment.AuthorID == user.ID
+}
+
+// a photo reported by a user, see moderation.go
+type report struct {
+	ID         int64      `db:"id" json:"id"`
+	SiteID     int64      `db:"site_id" json:"-"`
+	PhotoID    int64      `db:"photo_id" json:"photoId"`
+	OwnerID    int64      `db:"owner_id" json:"ownerId"`
+	ReporterID int64      `db:"reporter_id" json:"reporterId"`
+	Reason     string     `db:"reason" json:"reason"`
+	Status     string     `db:"status" json:"status"`
+	CreatedAt  time.Time  `db:"created_at" json:"createdAt"`
+	ResolvedAt *time.Time `db:"resolved_at" json:"resolvedAt,omitempty"`
+}
+
+type reportDetail struct {
+	report       `db:"-"`
+	Title        string `db:"title" json:"title"`
+	OwnerName    string `db:"owner_name" json:"ownerName"`
+	ReporterName string `db:"reporter_name" json:"reporterName"`
+}
+
+// a file found missing or changed by a check of the storage, see checksums.go.
+// Resolved when a later check of the file passes, after it was repaired from
+// another copy or restored by an admin.
+type storageCorruption struct {
+	ID         int64      `db:"id" json:"id"`
+	SiteID     int64      `db:"site_id" json:"-"`
+	PhotoID    int64      `db:"photo_id" json:"photoId"`
+	Problem    string     `db:"problem" json:"problem"`
+	DetectedAt time.Time  `db:"detected_at" json:"detectedAt"`
+	ResolvedAt *time.Time `db:"resolved_at" json:"resolvedAt,omitempty"`
+	Repaired   bool       `db:"repaired" json:"repaired"`
+}
+
+type storageCorruptionDetail struct {
+	storageCorruption `db:"-"`
+	Filename          string `db:"photo" json:"photo"`
+	Title             string `db:"title" json:"title"`
+}
+
+type moderationNote struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"-"`
+	AuthorID  int64     `db:"author_id" json:"authorId"`
+	Note      string    `db:"note" json:"note"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type moderationNoteDetail struct {
+	moderationNote `db:"-"`
+	AuthorName     string `db:"author_name" json:"authorName"`
+}
+
+// days of suspension on reaching a number of strikes
+type strikeThreshold struct {
+	Strikes        int `db:"strikes" json:"strikes"`
+	SuspensionDays int `db:"suspension_days" json:"suspensionDays"`
+}
+
+// a short code redirecting to a photo, see shortlinks.go
+type shortlink struct {
+	Code      string    `db:"code" json:"code"`
+	SiteID    int64     `db:"site_id" json:"-"`
+	PhotoID   int64     `db:"photo_id" json:"photoId"`
+	Clicks    int64     `db:"clicks" json:"clicks"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+}
+
+// a photo bought by a user, paid once the checkout is completed
+type purchase struct {
+	ID         int64      `db:"id" json:"id"`
+	SiteID     int64      `db:"site_id" json:"-"`
+	PhotoID    int64      `db:"photo_id" json:"photoId"`
+	BuyerID    int64      `db:"buyer_id" json:"-"`
+	Amount     int64      `db:"amount" json:"amount"`
+	Currency   string     `db:"currency" json:"currency"`
+	License    string     `db:"license" json:"license"`
+	CheckoutID string     `db:"checkout_id" json:"-"`
+	CreatedAt  time.Time  `db:"created_at" json:"createdAt"`
+	PaidAt     *time.Time `db:"paid_at" json:"paidAt,omitempty"`
+}
+
+type purchaseDetail struct {
+	purchase `db:"-"`
+	Title    string `db:"title" json:"title"`
+	Filename string `db:"photo" json:"photo"`
+}
+
+// a browser registered to receive Web Push notifications
+type pushSubscription struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"-"`
+	Endpoint  string    `db:"endpoint" json:"endpoint"`
+	Auth      string    `db:"auth" json:"-"`
+	P256dh    string    `db:"p256dh" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type notificationDetail struct {
+	notification `db:"-"`
+	SenderName   string       `db:"sender_name" json:"senderName"`
+	Title        string       `db:"title" json:"title"`
+	Filename     string       `db:"photo" json:"photo"`
+	Created      *displayTime `db:"-" json:"created,omitempty"`
+}
+
+type notificationList struct {
+	Items       []notificationDetail `json:"notifications"`
+	Total       int64                `json:"total"`
+	Unread      int64                `json:"unread"`
+	CurrentPage int64                `json:"currentPage"`
+	NumPages    int64                `json:"numPages"`
+}
+
+func newNotificationList(notifications []notificationDetail, total int64, unread int64, page int64) *notificationList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &notificationList{
+		Items:       notifications,
+		Total:       total,
+		Unread:      unread,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+// a vote or comment by another user on a photo of the user
+type activity struct {
+	Type      string       `db:"type" json:"type"`
+	PhotoID   int64        `db:"photo_id" json:"photoId"`
+	Title     string       `db:"title" json:"title"`
+	Filename  string       `db:"photo" json:"photo"`
+	UserID    int64        `db:"user_id" json:"userId"`
+	UserName  string       `db:"user_name" json:"userName"`
+	CommentID *int64       `db:"comment_id" json:"commentId,omitempty"`
+	Body      string       `db:"body" json:"body,omitempty"`
+	CreatedAt time.Time    `db:"created_at" json:"createdAt"`
+	Created   *displayTime `db:"-" json:"created,omitempty"`
+}
+
+type activityList struct {
+	Items       []activity `json:"activity"`
+	Total       int64      `json:"total"`
+	CurrentPage int64      `json:"currentPage"`
+	NumPages    int64      `json:"numPages"`
+}
+
+func newActivityList(items []activity, total int64, page int64) *activityList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &activityList{
+		Items:       items,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+type blockedUser struct {
+	ID        int64     `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Mute      bool      `db:"mute" json:"mute"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// the users and tags whose photos make up the feed of a user
+type follows struct {
+	Users []followedUser `json:"users"`
+	Tags  []string       `json:"tags"`
+}
+
+type followedUser struct {
+	ID        int64     `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type auditEntry struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	Action    string    `db:"action" json:"action"`
+	TargetID  int64     `db:"target_id" json:"targetId"`
+	Details   string    `db:"details" json:"details"`
+	IP        string    `db:"ip" json:"ip"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (entry *auditEntry) PreInsert(s gorp.SqlExecutor) error {
+	entry.CreatedAt = utcNow()
+	return nil
+}
+
+type auditEntryDetail struct {
+	auditEntry `db:"-"`
+	UserName   string `db:"user_name" json:"userName"`
+}
+
+type auditList struct {
+	Items       []auditEntryDetail `json:"entries"`
+	Total       int64              `json:"total"`
+	CurrentPage int64              `json:"currentPage"`
+	NumPages    int64              `json:"numPages"`
+}
+
+func newAuditList(entries []auditEntryDetail, total int64, page int64) *auditList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &auditList{
+		Items:       entries,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+type session struct {
+	ID         int64     `db:"id" json:"id"`
+	UserID     int64     `db:"user_id" json:"-"`
+	Key        string    `db:"session_key" json:"-"`
+	IP         string    `db:"ip" json:"ip"`
+	UserAgent  string    `db:"user_agent" json:"userAgent"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"lastSeenAt"`
+	IsCurrent  bool      `db:"-" json:"isCurrent"`
+
+	// set for an admin acting as the user, see impersonation.go
+	ImpersonatorID *int64     `db:"impersonator_id" json:"impersonatorId,omitempty"`
+	ExpiresAt      *time.Time `db:"expires_at" json:"expiresAt,omitempty"`
+}
+
+func (session *session) PreInsert(s gorp.SqlExecutor) error {
+	session.CreatedAt = utcNow()
+	session.LastSeenAt = session.CreatedAt
+	return nil
+}
+
+// public user profile
+type profile struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Slug      *string   `json:"slug,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Badges    []badge   `json:"badges,omitempty"`
+}
+
+func newProfile(user *user) *profile {
+	return &profile{ID: user.ID, Name: user.Name, Slug: user.Slug, CreatedAt: user.CreatedAt}
+}
+
+// a user as shown to admins, without secrets such as the password hash
+type adminUser struct {
+	ID             int64     `json:"id"`
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	CreatedAt      time.Time `json:"createdAt"`
+	IsAdmin        bool      `json:"isAdmin"`
+	IsActive       bool      `json:"isActive"`
+	IsBanned       bool      `json:"isBanned"`
+	IsShadowBanned bool      `json:"isShadowBanned"`
+
+	// see applyRetention
+	LastActiveAt    time.Time `json:"lastActiveAt"`
+	RetentionExempt bool      `json:"retentionExempt"`
+}
+
+func newAdminUser(user *user) *adminUser {
+	return &adminUser{
+		ID:             user.ID,
+		Name:           user.Name,
+		Email:          user.Email,
+		CreatedAt:      user.CreatedAt,
+		IsAdmin:        user.IsAdmin,
+		IsActive:       user.IsActive,
+		IsBanned:       user.IsBanned,
+		IsShadowBanned: user.IsShadowBanned,
+
+		LastActiveAt:    user.LastActiveAt,
+		RetentionExempt: user.RetentionExempt,
+	}
+}
+
+// an achievement awarded to a user, see badges.go
+type badge struct {
+	UserID      int64     `db:"user_id" json:"-"`
+	Name        string    `db:"name" json:"name"`
+	Description string    `db:"-" json:"description"`
+	AwardedAt   time.Time `db:"awarded_at" json:"awardedAt"`
+}
+
+// what achievements are judged on
+type userStats struct {
+	Photos  int64 `db:"photos"`
+	UpVotes int64 `db:"up_votes"`
+	Streak  int64 `db:"streak"` // most days in a row with an upload
+}
+
+type featureFlag struct {
+	SiteID     int64  `db:"site_id" json:"-"`
+	Name       string `db:"name" json:"name"`
+	Percentage int    `db:"percentage" json:"percentage"`
+}
+
 type page struct {
 	index  int64
 	offset int64
 	size   int64
+
+	// the total of the list must be exact, see counts.go
+	exact bool
 }
 
 func newPage(index int64) *page {
@@ -255,5 +1138,335 @@ func newPage(index int64) *page {
 	if offset < 0 {
 		offset = 0
 	}
-	return &page{index, offset, pageSize}
+	return &page{index: index, offset: offset, size: pageSize}
+}
+
+// photo list orderings
+const (
+	orderNew           = "new"
+	orderHot           = "hot"
+	orderTop           = "top"
+	orderControversial = "controversial"
+)
+
+// time windows of the top and controversial orderings
+var orderWindows = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
+}
+
+type ordering struct {
+	sort   string
+	window string
+}
+
+// returns the ordering, defaulting to new for an unknown sort and to all
+// for an unknown window. "votes" is kept as an alias of top.
+func newOrdering(sort, window string) *ordering {
+	switch sort {
+	case orderHot, orderTop, orderControversial:
+	case "votes":
+		sort = orderTop
+	default:
+		sort = orderNew
+	}
+	if _, ok := orderWindows[window]; !ok || (sort != orderTop && sort != orderControversial) {
+		window = "all"
+	}
+	return &ordering{sort, window}
+}
+
+// returns the earliest creation time of photos in the window, or the zero
+// time for all photos
+func (o *ordering) since(now time.Time) time.Time {
+	if d := orderWindows[o.window]; d > 0 {
+		return now.Add(-d)
+	}
+	return time.Time{}
+}
+
+// RSA key pair used to sign the ActivityPub requests of a user
+type actorKey struct {
+	UserID     int64     `db:"user_id" json:"-"`
+	PrivateKey string    `db:"private_key" json:"-"`
+	PublicKey  string    `db:"public_key" json:"-"`
+	CreatedAt  time.Time `db:"created_at" json:"-"`
+}
+
+// remote ActivityPub actor following a user
+type follower struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	Actor     string    `db:"actor" json:"actor"`
+	Inbox     string    `db:"inbox" json:"inbox"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// group member roles and statuses
+const (
+	groupRoleMember    = "member"
+	groupRoleModerator = "moderator"
+	groupStatusPending = "pending"
+	groupStatusActive  = "active"
+)
+
+// a community board, with a photo stream of photos cross-posted by members
+type group struct {
+	ID               int64     `db:"id" json:"id"`
+	SiteID           int64     `db:"site_id" json:"-"`
+	OwnerID          int64     `db:"owner_id" json:"ownerId"`
+	Name             string    `db:"name" json:"name"`
+	Description      string    `db:"description" json:"description"`
+	RequiresApproval bool      `db:"requires_approval" json:"requiresApproval"`
+	CreatedAt        time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (group *group) PreInsert(s gorp.SqlExecutor) error {
+	group.CreatedAt = utcNow()
+	return nil
+}
+
+func (group *group) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if group.Name == "" {
+		errors["name"] = "Name is missing"
+	} else if len(group.Name) > 60 {
+		errors["name"] = "Name is too long"
+	} else {
+		ok, err := ctx.datamapper.isGroupNameAvailable(group)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			errors["name"] = "Name is already taken"
+		}
+	}
+	if len(group.Description) > 1000 {
+		errors["description"] = "Description is too long"
+	}
+	return nil
+}
+
+type groupDetail struct {
+	group      `db:"-"`
+	NumMembers int64        `db:"num_members" json:"numMembers"`
+	NumPhotos  int64        `db:"num_photos" json:"numPhotos"`
+	Membership *groupMember `db:"-" json:"membership"`
+}
+
+type groupList struct {
+	Items       []groupDetail `json:"groups"`
+	Total       int64         `json:"total"`
+	CurrentPage int64         `json:"currentPage"`
+	NumPages    int64         `json:"numPages"`
+}
+
+func newGroupList(groups []groupDetail, total int64, page int64) *groupList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &groupList{
+		Items:       groups,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+type groupMember struct {
+	GroupID   int64     `db:"group_id" json:"groupId"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	Role      string    `db:"role" json:"role"`
+	Status    string    `db:"status" json:"status"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (m *groupMember) isActive() bool {
+	return m != nil && m.Status == groupStatusActive
+}
+
+func (m *groupMember) isModerator() bool {
+	return m.isActive() && m.Role == groupRoleModerator
+}
+
+type groupMemberDetail struct {
+	groupMember `db:"-"`
+	Name        string `db:"name" json:"name"`
+}
+
+// contest phases
+const (
+	contestUpcoming = "upcoming"
+	contestEntries  = "entries"
+	contestVoting   = "voting"
+	contestFinished = "finished"
+)
+
+// Photos are entered in a contest by tagging them with its tag while
+// entries are open. Votes are cast after entries close, until voting closes,
+// for the entries as they were taken when entries closed.
+type contest struct {
+	ID             int64      `db:"id" json:"id"`
+	SiteID         int64      `db:"site_id" json:"-"`
+	OwnerID        int64      `db:"owner_id" json:"ownerId"`
+	Title          string     `db:"title" json:"title"`
+	Description    string     `db:"description" json:"description"`
+	Tag            string     `db:"tag" json:"tag"`
+	StartsAt       time.Time  `db:"starts_at" json:"startsAt"`
+	EntriesCloseAt time.Time  `db:"entries_close_at" json:"entriesCloseAt"`
+	VotingCloseAt  time.Time  `db:"voting_close_at" json:"votingCloseAt"`
+	WinnerID       *int64     `db:"winner_id" json:"winnerId"`
+	EntriesTakenAt *time.Time `db:"entries_taken_at" json:"-"`
+	CreatedAt      time.Time  `db:"created_at" json:"createdAt"`
+}
+
+func (contest *contest) PreInsert(s gorp.SqlExecutor) error {
+	contest.CreatedAt = utcNow()
+	return nil
+}
+
+func (contest *contest) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if contest.Title == "" {
+		errors["title"] = "Title is missing"
+	} else if len(contest.Title) > 100 {
+		errors["title"] = "Title is too long"
+	}
+	if len(contest.Description) > 1000 {
+		errors["description"] = "Description is too long"
+	}
+	if contest.Tag == "" {
+		errors["tag"] = "Tag is missing"
+	} else if strings.ContainsAny(contest.Tag, " #") {
+		errors["tag"] = "Tag must be a single word"
+	}
+	if !contest.StartsAt.Before(contest.EntriesCloseAt) {
+		errors["entriesCloseAt"] = "Entries must close after the contest starts"
+	}
+	if !contest.EntriesCloseAt.Before(contest.VotingCloseAt) {
+		errors["votingCloseAt"] = "Voting must close after entries close"
+	}
+	return nil
+}
+
+// returns the phase of the contest at the time
+func (contest *contest) phase(now time.Time) string {
+	switch {
+	case now.Before(contest.StartsAt):
+		return contestUpcoming
+	case now.Before(contest.EntriesCloseAt):
+		return contestEntries
+	case now.Before(contest.VotingCloseAt):
+		return contestVoting
+	}
+	return contestFinished
+}
+
+type contestDetail struct {
+	contest    `db:"-"`
+	NumEntries int64  `db:"num_entries" json:"numEntries"`
+	Phase      string `db:"-" json:"phase"`
+}
+
+type contestList struct {
+	Items       []contestDetail `json:"contests"`
+	Total       int64           `json:"total"`
+	CurrentPage int64           `json:"currentPage"`
+	NumPages    int64           `json:"numPages"`
+}
+
+func newContestList(contests []contestDetail, total int64, page int64) *contestList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &contestList{
+		Items:       contests,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+// challenge states
+const (
+	challengeUpcoming = "upcoming"
+	challengeCurrent  = "current"
+	challengeFinished = "finished"
+)
+
+// A challenge is the tag of the week, or of any other run of dates. Photos
+// are entered by tagging them with its tag while it runs. Challenges of a
+// site don't overlap, so they follow each other.
+type challenge struct {
+	ID               int64      `db:"id" json:"id"`
+	SiteID           int64      `db:"site_id" json:"-"`
+	OwnerID          int64      `db:"owner_id" json:"ownerId"`
+	Tag              string     `db:"tag" json:"tag"`
+	Description      string     `db:"description" json:"description"`
+	StartsAt         time.Time  `db:"starts_at" json:"startsAt"`
+	EndsAt           time.Time  `db:"ends_at" json:"endsAt"`
+	StartAnnouncedAt *time.Time `db:"start_announced_at" json:"-"`
+	EndAnnouncedAt   *time.Time `db:"end_announced_at" json:"-"`
+	CreatedAt        time.Time  `db:"created_at" json:"createdAt"`
+}
+
+func (challenge *challenge) PreInsert(s gorp.SqlExecutor) error {
+	challenge.CreatedAt = utcNow()
+	return nil
+}
+
+func (challenge *challenge) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if challenge.Tag == "" {
+		errors["tag"] = "Tag is missing"
+	} else if strings.ContainsAny(challenge.Tag, " #") {
+		errors["tag"] = "Tag must be a single word"
+	}
+	if len(challenge.Description) > 1000 {
+		errors["description"] = "Description is too long"
+	}
+	if !challenge.StartsAt.Before(challenge.EndsAt) {
+		errors["endsAt"] = "Challenge must end after it starts"
+		return nil
+	}
+	overlaps, err := ctx.datamapper.isChallengeOverlapping(challenge)
+	if err != nil {
+		return err
+	}
+	if overlaps {
+		errors["startsAt"] = "Another challenge runs at the same time"
+	}
+	return nil
+}
+
+// returns the state of the challenge at the time
+func (challenge *challenge) status(now time.Time) string {
+	switch {
+	case now.Before(challenge.StartsAt):
+		return challengeUpcoming
+	case now.Before(challenge.EndsAt):
+		return challengeCurrent
+	}
+	return challengeFinished
+}
+
+type challengeDetail struct {
+	challenge  `db:"-"`
+	NumEntries int64  `db:"num_entries" json:"numEntries"`
+	Status     string `db:"-" json:"status"`
+}
+
+type challengeList struct {
+	Items       []challengeDetail `json:"challenges"`
+	Total       int64             `json:"total"`
+	CurrentPage int64             `json:"currentPage"`
+	NumPages    int64             `json:"numPages"`
+}
+
+func newChallengeList(challenges []challengeDetail, total int64, page int64) *challengeList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &challengeList{
+		Items:       challenges,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
 }
@@ -0,0 +1,306 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users report photos breaking the rules, and admins uphold or dismiss the
+// reports. Each upheld report is a strike against the owner of the photo;
+// on reaching the number of strikes of a threshold set by the admins, the
+// owner is suspended for its number of days, and is treated as banned
+// until then. Admins also keep notes about users.
+
+const (
+	reportOpen      = "open"
+	reportUpheld    = "upheld"
+	reportDismissed = "dismissed"
+
+	maxReportReasonLength   = 1000
+	maxModerationNoteLength = 2000
+	maxStrikeThresholds     = 20
+	maxSuspensionDays       = 3650
+)
+
+var errSuspended = httpError{http.StatusForbidden, "Your account is suspended"}
+
+// returns true if the user is suspended for their strikes
+func (user *user) isSuspended() bool {
+	return user.SuspendedUntil != nil && utcNow().Before(*user.SuspendedUntil)
+}
+
+// suspends the user if their strikes reach a threshold, returning true if
+// they were suspended
+func applyStrikeThresholds(ctx *context, owner *user) (bool, error) {
+
+	if owner.IsAdmin {
+		return false, nil
+	}
+
+	thresholds, err := ctx.datamapper.getStrikeThresholds()
+	if err != nil {
+		return false, err
+	}
+
+	for _, t := range thresholds {
+		if t.Strikes != owner.Strikes {
+			continue
+		}
+		until := utcNow().AddDate(0, 0, t.SuspensionDays)
+		if owner.SuspendedUntil != nil && owner.SuspendedUntil.After(until) {
+			return false, nil
+		}
+		owner.SuspendedUntil = &until
+		if err := ctx.datamapper.updateUser(owner); err != nil {
+			return false, err
+		}
+		details := fmt.Sprintf("strikes=%d until=%s", owner.Strikes, until.Format(time.RFC3339))
+		return true, writeAuditLog(ctx, "suspend", owner.ID, details)
+	}
+	return false, nil
+}
+
+func reportPhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Reason string `json:"reason"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	s.Reason = strings.TrimSpace(s.Reason)
+	switch {
+	case s.Reason == "":
+		return validationFailure{map[string]string{"reason": "Reason is missing"}}
+	case len(s.Reason) > maxReportReasonLength:
+		return validationFailure{map[string]string{"reason": "Reason is too long"}}
+	}
+
+	if photo.OwnerID == ctx.user.ID {
+		return httpError{http.StatusBadRequest, "You cannot report your own photo"}
+	}
+
+	reported, err := ctx.datamapper.hasReported(photo.ID, ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	if reported {
+		return httpError{http.StatusBadRequest, "You have already reported this photo"}
+	}
+
+	report := &report{
+		PhotoID:    photo.ID,
+		OwnerID:    photo.OwnerID,
+		ReporterID: ctx.user.ID,
+		Reason:     s.Reason,
+	}
+	if err := ctx.datamapper.createReport(report); err != nil {
+		return err
+	}
+	return renderJSON(w, report, http.StatusCreated)
+}
+
+func getReports(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	reports, err := ctx.datamapper.getOpenReports()
+	if err != nil {
+		return err
+	}
+	if reports == nil {
+		reports = []reportDetail{}
+	}
+	return renderJSON(w, reports, http.StatusOK)
+}
+
+// upholds or dismisses a report; upholding adds a strike to the owner of the
+// photo, which may suspend them
+func resolveReport(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	report, err := ctx.datamapper.getReport(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Upheld bool `json:"upheld"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if report.Status != reportOpen {
+		return httpError{http.StatusBadRequest, "This report has already been resolved"}
+	}
+
+	report.Status = reportDismissed
+	if s.Upheld {
+		report.Status = reportUpheld
+	}
+
+	owner, err := ctx.datamapper.resolveReport(report)
+	if err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("status=%s photo=%d", report.Status, report.PhotoID)
+	if err := writeAuditLog(ctx, "resolve_report", report.OwnerID, details); err != nil {
+		return err
+	}
+
+	if owner != nil {
+		if _, err := applyStrikeThresholds(ctx, owner); err != nil {
+			return err
+		}
+	}
+
+	return renderJSON(w, report, http.StatusOK)
+}
+
+// returns the strikes, suspension and notes of a user
+func getModeration(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	notes, err := ctx.datamapper.getModerationNotes(target.ID)
+	if err != nil {
+		return err
+	}
+	if notes == nil {
+		notes = []moderationNoteDetail{}
+	}
+
+	return renderJSON(w, &struct {
+		UserID         int64                  `json:"userId"`
+		Name           string                 `json:"name"`
+		Strikes        int                    `json:"strikes"`
+		SuspendedUntil *time.Time             `json:"suspendedUntil,omitempty"`
+		Notes          []moderationNoteDetail `json:"notes"`
+	}{target.ID, target.Name, target.Strikes, target.SuspendedUntil, notes}, http.StatusOK)
+}
+
+// sets the strikes and suspension of a user, e.g. to lift a suspension
+func setModeration(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Strikes        int        `json:"strikes"`
+		SuspendedUntil *time.Time `json:"suspendedUntil"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if s.Strikes < 0 {
+		return validationFailure{map[string]string{"strikes": "Strikes must not be negative"}}
+	}
+	if target.IsAdmin && s.SuspendedUntil != nil {
+		return httpError{http.StatusForbidden, "Admins cannot be suspended"}
+	}
+
+	target.Strikes = s.Strikes
+	target.SuspendedUntil = s.SuspendedUntil
+
+	if err := ctx.datamapper.updateUser(target); err != nil {
+		return err
+	}
+
+	until := "none"
+	if s.SuspendedUntil != nil {
+		until = s.SuspendedUntil.Format(time.RFC3339)
+	}
+	if err := writeAuditLog(ctx, "moderate", target.ID, fmt.Sprintf("strikes=%d until=%s", s.Strikes, until)); err != nil {
+		return err
+	}
+
+	return getModeration(ctx, w, r)
+}
+
+func addModerationNote(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Note string `json:"note"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	s.Note = strings.TrimSpace(s.Note)
+	switch {
+	case s.Note == "":
+		return validationFailure{map[string]string{"note": "Note is missing"}}
+	case len(s.Note) > maxModerationNoteLength:
+		return validationFailure{map[string]string{"note": "Note is too long"}}
+	}
+
+	note := &moderationNote{UserID: target.ID, AuthorID: ctx.user.ID, Note: s.Note}
+	if err := ctx.datamapper.createModerationNote(note); err != nil {
+		return err
+	}
+	return renderJSON(w, &moderationNoteDetail{*note, ctx.user.Name}, http.StatusCreated)
+}
+
+func getStrikeThresholds(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	thresholds, err := ctx.datamapper.getStrikeThresholds()
+	if err != nil {
+		return err
+	}
+	if thresholds == nil {
+		thresholds = []strikeThreshold{}
+	}
+	return renderJSON(w, thresholds, http.StatusOK)
+}
+
+// replaces the thresholds, e.g. [{"strikes": 3, "suspensionDays": 7}]
+func setStrikeThresholds(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	var thresholds []strikeThreshold
+
+	if err := decodeJSON(r, &thresholds); err != nil {
+		return err
+	}
+
+	if len(thresholds) > maxStrikeThresholds {
+		return httpError{http.StatusBadRequest, "Too many thresholds"}
+	}
+
+	seen := make(map[int]bool)
+	for _, t := range thresholds {
+		if t.Strikes < 1 || t.SuspensionDays < 1 || t.SuspensionDays > maxSuspensionDays || seen[t.Strikes] {
+			return httpError{http.StatusBadRequest, "Invalid threshold"}
+		}
+		seen[t.Strikes] = true
+	}
+
+	if err := ctx.datamapper.setStrikeThresholds(thresholds); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "set_strike_thresholds", 0, fmt.Sprintf("%v", thresholds)); err != nil {
+		return err
+	}
+
+	return getStrikeThresholds(ctx, w, r)
+}
@@ -0,0 +1,112 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportsAndStrikes(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	admin := &user{Name: "admin", Email: "admin@localhost", IsAdmin: true, IsActive: true}
+	adminToken, err := dm.login(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &user{Name: "owner", Email: "owner@localhost", IsActive: true}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := send("PUT", "/api/admin/strikes", adminToken, `[{"strikes": 2, "suspensionDays": 0}]`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid threshold, got %d", res.Code)
+	}
+	if res := send("PUT", "/api/admin/strikes", adminToken, `[{"strikes": 2, "suspensionDays": 7}]`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	// each upheld report from another reporter is a strike
+	for i := 1; i <= 2; i++ {
+		photo := &photo{Title: fmt.Sprintf("photo %d", i), OwnerID: owner.ID}
+		if err := dm.createPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+		reporter := &user{Name: fmt.Sprintf("reporter%d", i), Email: fmt.Sprintf("reporter%d@localhost", i), IsActive: true}
+		token, err := dm.login(reporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reportURL := fmt.Sprintf("/api/photos/%d/report", photo.ID)
+		if res := send("POST", reportURL, ownerToken, `{"reason": "spam"}`); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 reporting your own photo, got %d", res.Code)
+		}
+		if res := send("POST", reportURL, token, `{"reason": ""}`); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 without a reason, got %d", res.Code)
+		}
+		if res := send("POST", reportURL, token, `{"reason": "spam"}`); res.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+		}
+		if res := send("POST", reportURL, token, `{"reason": "spam"}`); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a second report, got %d", res.Code)
+		}
+
+		resolveURL := fmt.Sprintf("/api/admin/reports/%d", dm.reports[len(dm.reports)-1].ID)
+		if res := send("PATCH", resolveURL, token, `{"upheld": true}`); res.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for a user, got %d", res.Code)
+		}
+		if res := send("PATCH", resolveURL, adminToken, `{"upheld": true}`); res.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+		}
+		if res := send("PATCH", resolveURL, adminToken, `{"upheld": false}`); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a resolved report, got %d", res.Code)
+		}
+	}
+
+	stored := dm.users[owner.ID]
+	if stored.Strikes != 2 || !stored.isSuspended() {
+		t.Fatalf("Expected the owner suspended with 2 strikes, got %d until %v", stored.Strikes, stored.SuspendedUntil)
+	}
+	if days := stored.SuspendedUntil.Sub(time.Now()).Hours() / 24; days < 6.9 || days > 7 {
+		t.Errorf("Expected a 7 day suspension, got %.2f days", days)
+	}
+
+	// suspended users are refused as banned users are
+	if res := send("PUT", "/api/user/portfolio", ownerToken, `{"albums": []}`); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 while suspended, got %d", res.Code)
+	}
+
+	moderationURL := fmt.Sprintf("/api/admin/users/%d/moderation", owner.ID)
+	if res := send("POST", fmt.Sprintf("/api/admin/users/%d/notes", owner.ID), adminToken, `{"note": "warned by email"}`); res.Code != http.StatusCreated {
+		t.Errorf("Expected 201, got %d", res.Code)
+	}
+	res := send("GET", moderationURL, adminToken, "")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "warned by email") {
+		t.Errorf("Expected the note, got %d: %s", res.Code, res.Body.String())
+	}
+
+	// lifting the suspension
+	if res := send("PATCH", moderationURL, adminToken, `{"strikes": 0, "suspendedUntil": null}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if stored := dm.users[owner.ID]; stored.Strikes != 0 || stored.isSuspended() {
+		t.Errorf("Expected the suspension lifted, got %+v", stored)
+	}
+}
@@ -0,0 +1,80 @@
+package photoshare
+
+import (
+	"regexp"
+	"strings"
+)
+
+// User names are checked when they are chosen, on signup and on changing
+// name: letters, digits and underscores only, so names can be mentioned
+// (see parseMentions), and never a reserved name, a name passing as staff
+// or one containing a blocked word. Names are compared as normalized by the
+// blocklist, so "Adm1n" is refused as "admin" is.
+
+const (
+	minNameLength = 3
+	maxNameLength = 30
+)
+
+var nameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// names taken by routes, or likely to be mistaken for the site
+var reservedNames = map[string]bool{
+	"api": true, "static": true, "uploads": true, "thumbnails": true,
+	"auth": true, "login": true, "logout": true, "signup": true,
+	"register": true, "account": true, "settings": true, "user": true,
+	"users": true, "photos": true, "search": true, "feeds": true,
+	"embed": true, "iiif": true, "groups": true, "contests": true,
+	"root": true, "system": true, "help": true, "webmaster": true,
+	"postmaster": true, "hostmaster": true,
+	"www": true, "mail": true, "null": true, "undefined": true,
+	"anonymous": true, "everyone": true, "photoshare": true,
+}
+
+// words of names passing as staff, e.g. "admin_bob"
+var staffWords = map[string]bool{
+	"admin": true, "administrator": true, "moderator": true, "mod": true,
+	"staff": true, "support": true, "official": true,
+}
+
+// returns true if the name is reserved or passes as staff
+func isReservedName(name string) bool {
+	words := normalizeWords(name)
+	if reservedNames[strings.Join(words, "")] {
+		return true
+	}
+	for _, w := range words {
+		if staffWords[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// checks a name being chosen, adding any error to errors
+func validateNewName(ctx *context, name string, errors map[string]string) error {
+
+	switch {
+	case len(name) < minNameLength:
+		errors["name"] = "Name is too short"
+		return nil
+	case len(name) > maxNameLength:
+		errors["name"] = "Name is too long"
+		return nil
+	case !nameRegex.MatchString(name) || digitsRegex.MatchString(name):
+		errors["name"] = "Name may only contain letters, digits and underscores"
+		return nil
+	case isReservedName(name):
+		errors["name"] = "Name is reserved"
+		return nil
+	}
+
+	blocked, err := ctx.getBlocklist()
+	if err != nil {
+		return err
+	}
+	if blocked.matches(name) {
+		errors["name"] = "Name contains a blocked word"
+	}
+	return nil
+}
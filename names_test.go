@@ -0,0 +1,36 @@
+package photoshare
+
+import (
+	"testing"
+)
+
+func TestValidateNewName(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	dm.blocked = []blockedWord{{Word: "darn"}}
+	ctx := &context{app: &app{datamapper: dm}, datamapper: dm}
+
+	for name, valid := range map[string]bool{
+		"tester":        true,
+		"jane_doe":      true,
+		"Photographer9": true,
+		"modern_art":    true,
+		"ab":            false,
+		"12345":         false,
+		"jane doe":      false,
+		"jané":          false,
+		"api":           false,
+		"Adm1n":         false,
+		"admin_bob":     false,
+		"the_moderator": false,
+		"d4rn_it":       false,
+	} {
+		errors := make(map[string]string)
+		if err := validateNewName(ctx, name, errors); err != nil {
+			t.Fatal(err)
+		}
+		if _, invalid := errors["name"]; invalid == valid {
+			t.Errorf("Expected %q valid: %t, got %v", name, valid, errors)
+		}
+	}
+}
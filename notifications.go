@@ -0,0 +1,181 @@
+package photoshare
+
+import (
+	"net/http"
+)
+
+// notification types
+const (
+	notificationUpvote   = "upvote"
+	notificationDownvote = "downvote"
+	notificationMention  = "mention"
+	notificationComment  = "comment"
+	notificationFollow   = "follow"
+)
+
+// notification types users can set preferences for
+var notificationTypes = []string{
+	notificationUpvote, notificationDownvote, notificationMention, notificationComment, notificationFollow,
+}
+
+// notifies the recipient of the action of the user through each channel
+// enabled in their settings: in-app notifications are stored and published
+// to the websocket, emails and push messages are sent in the background.
+// The photo is nil for follows.
+func sendNotification(ctx *context, r *http.Request, recipient *user, kind string, photo *photo) error {
+	return notify(ctx, r, recipient, kind, photo, "")
+}
+
+// notifies the recipient of a new follower: the user, or the federated
+// actor if given
+func notifyFollow(ctx *context, r *http.Request, recipient *user, actor string) error {
+	return notify(ctx, r, recipient, notificationFollow, nil, actor)
+}
+
+// see sendNotification; with an actor, the notification is of a federated
+// account rather than of the user
+func notify(ctx *context, r *http.Request, recipient *user, kind string, photo *photo, actor string) error {
+
+	n := &notification{UserID: recipient.ID, Type: kind}
+	sender := ctx.user.Name
+
+	if actor != "" {
+		n.Actor, sender = actor, actor
+	} else {
+		if ctx.user.IsShadowBanned {
+			return nil
+		}
+		blocked, err := ctx.datamapper.isBlocked(recipient.ID, ctx.user.ID, true)
+		if err != nil || blocked {
+			return err
+		}
+		n.SenderID = &ctx.user.ID
+	}
+
+	var photoID int64
+	if photo != nil {
+		photoID = photo.ID
+		n.PhotoID = &photo.ID
+	}
+
+	settings, err := ctx.datamapper.getNotificationSettings(recipient.ID)
+	if err != nil {
+		return err
+	}
+	pref := settings[kind]
+
+	if pref.InApp {
+		if err := ctx.datamapper.createNotification(n); err != nil {
+			return err
+		}
+		sendMessage(ctx.site.ID, &socketMessage{sender, recipient.Name, photoID, kind})
+	}
+
+	if pref.Email {
+		go func() {
+			if err := ctx.mailer.sendNotificationMail(recipient, sender, kind, photo, r); err != nil {
+				logError(err)
+			}
+		}()
+	}
+
+	if pref.Push {
+		go sendPush(ctx.app, recipient.ID, newPushMessage(kind, sender, recipient, photo))
+	}
+	return nil
+}
+
+func getSettings(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	settings, err := ctx.datamapper.getNotificationSettings(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderSettings(ctx, w, settings)
+}
+
+func renderSettings(ctx *context, w http.ResponseWriter, settings notificationSettings) error {
+	return renderJSON(w, map[string]interface{}{
+		"notifications": settings,
+		"timezone":      ctx.user.location().String(),
+	}, http.StatusOK)
+}
+
+// updates the settings given, e.g.
+// {"timezone": "Europe/Paris", "notifications": {"upvote": {"email": true, "push": false}}}
+func updateSettings(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Timezone      *string `json:"timezone"`
+		Notifications map[string]struct {
+			InApp *bool `json:"inApp"`
+			Email *bool `json:"email"`
+			Push  *bool `json:"push"`
+		} `json:"notifications"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	settings, err := ctx.datamapper.getNotificationSettings(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	for kind, values := range s.Notifications {
+		pref, ok := settings[kind]
+		if !ok {
+			return httpError{http.StatusBadRequest, "Unknown notification type: " + kind}
+		}
+		if values.InApp != nil {
+			pref.InApp = *values.InApp
+		}
+		if values.Email != nil {
+			pref.Email = *values.Email
+		}
+		if values.Push != nil {
+			pref.Push = *values.Push
+		}
+	}
+
+	if s.Timezone != nil && *s.Timezone != ctx.user.Timezone {
+		if !isValidTimezone(*s.Timezone) {
+			return validationFailure{map[string]string{"timezone": "Unknown timezone"}}
+		}
+		ctx.user.Timezone = *s.Timezone
+		if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.datamapper.saveNotificationSettings(settings); err != nil {
+		return err
+	}
+	return renderSettings(ctx, w, settings)
+}
+
+func getNotifications(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	notifications, err := ctx.datamapper.getNotifications(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	loc := ctx.user.location()
+	for i := range notifications.Items {
+		notifications.Items[i].Created = newDisplayTime(notifications.Items[i].CreatedAt, loc)
+	}
+	return renderJSON(w, notifications, http.StatusOK)
+}
+
+func markNotificationRead(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.markNotificationRead(ctx.user.ID, ctx.params.getInt("id")); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Notification read")
+}
+
+func markAllNotificationsRead(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.markAllNotificationsRead(ctx.user.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Notifications read")
+}
@@ -0,0 +1,95 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotificationSettingsDefaults(t *testing.T) {
+	settings := newNotificationSettings(1, []notificationPreference{
+		{UserID: 1, Type: notificationUpvote, InApp: false},
+		{UserID: 1, Type: "unknown", InApp: true},
+	})
+	if len(settings) != len(notificationTypes) {
+		t.Errorf("Expected %d types, got %d", len(notificationTypes), len(settings))
+	}
+	if settings[notificationUpvote].InApp {
+		t.Error("Saved preference should override the default")
+	}
+	if !settings[notificationMention].Email || settings[notificationDownvote].Email {
+		t.Error("Only mentions should be emailed by default")
+	}
+}
+
+// sends a settings update as a new user, returning the user and response
+func updateTestSettings(t *testing.T, app *app, dm *memoryDataMapper, body string) (*user, *httptest.ResponseRecorder) {
+	u := &user{Name: "owner", Email: "owner@example.com"}
+	token, err := dm.login(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PATCH", "http://localhost/api/user/settings", strings.NewReader(body))
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	return u, res
+}
+
+func TestUpdateSettings(t *testing.T) {
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	u, res := updateTestSettings(t, app, dm, `{"notifications": {"upvote": {"email": true}}}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	settings, err := dm.getNotificationSettings(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pref := settings[notificationUpvote]; !pref.Email || !pref.InApp {
+		t.Errorf("Expected email and in-app upvote notifications, got %+v", pref)
+	}
+}
+
+func TestUpdateSettingsUnknownType(t *testing.T) {
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	_, res := updateTestSettings(t, app, dm, `{"notifications": {"favorite": {"email": true}}}`)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Unknown notification type should be rejected, got %d", res.Code)
+	}
+}
+
+func TestSendNotificationMail(t *testing.T) {
+	app := newTestApp(newMemoryDataMapper())
+	sender := &recordingSender{}
+	app.mailer.sender = sender
+
+	recipient := &user{ID: 1, Name: "owner", Email: "owner@example.com"}
+	photo := &photo{ID: 3, Title: "Sunset"}
+	req, _ := http.NewRequest("POST", "http://localhost/api/photos/3/upvote", nil)
+
+	for kind, expected := range map[string]string{
+		notificationUpvote:   "voted up your photo",
+		notificationDownvote: "voted down your photo",
+		notificationMention:  "mentioned you",
+		notificationComment:  "commented on your photo",
+		notificationFollow:   "followed you",
+	} {
+		sender.messages = nil
+		if err := app.mailer.sendNotificationMail(recipient, "tester", kind, photo, req); err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+		if len(sender.messages) != 1 || !strings.Contains(string(sender.messages[0].body), expected) {
+			t.Errorf("%s: expected a mail saying %q, got %v", kind, expected, sender.messages)
+		}
+	}
+
+	if err := app.mailer.sendNotificationMail(recipient, "tester", "favorite", photo, req); err == nil {
+		t.Error("Unknown notification types should not be emailed")
+	}
+}
@@ -0,0 +1,432 @@
+package photoshare
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"github.com/juju/errgo"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enterprise deployments sign users in with an OpenID Connect provider,
+// next to local accounts. With OIDC_ISSUER set, the endpoints of the
+// provider are discovered from the issuer, the browser is sent to log in
+// with PKCE, and the ID token returned for the code gives the subject,
+// verified email, name and groups of the user. Users are created on their
+// first login and matched by issuer and subject afterwards. An account made
+// otherwise with the same email is only linked once its owner follows the
+// link emailed to them, so that the provider can't log in as any account;
+// with OIDC_ADMIN_GROUPS, users are made admins or not on each login by
+// their groups.
+
+const (
+	oidcTimeout     = 10 * time.Second
+	oidcStateCookie = "oidcState"
+	oidcStateMaxAge = 600 // seconds to log in with the provider
+)
+
+var errInvalidOIDCLogin = httpError{http.StatusBadRequest, "Invalid login, please try again"}
+
+// endpoints of the provider, see
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// the claims of the ID token used to find or create the user
+type oidcIdentity struct {
+	subject string // the issuer and sub claim
+	name    string
+	email   string
+	groups  []string
+}
+
+type oidcProvider struct {
+	sync.Mutex
+	cfg       *config
+	client    *http.Client
+	discovery *oidcDiscovery
+}
+
+// returns the configured provider, or nil if there is none
+func newOIDCProvider(cfg *config) *oidcProvider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: oidcTimeout}}
+}
+
+// fetches the endpoints of the provider, once
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	res, err := p.client.Get(strings.TrimSuffix(p.cfg.OIDCIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery returned %s", res.Status)
+	}
+
+	d := &oidcDiscovery{}
+	if err := json.NewDecoder(res.Body).Decode(d); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if d.Issuer != p.cfg.OIDCIssuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery of %s returned issuer %q", p.cfg.OIDCIssuer, d.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// returns the PKCE challenge of the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// returns the URL of the provider's login page
+func (p *oidcProvider) authURL(redirectURI, state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.OIDCClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Replace(p.cfg.OIDCScopes, ",", " ", -1)},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchanges the code for an ID token, returning the identity it gives. The
+// token comes straight from the provider over TLS, so its claims are checked
+// rather than its signature, see
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *oidcProvider) exchange(code, redirectURI, nonce, verifier string) (*oidcIdentity, error) {
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.PostForm(d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.cfg.OIDCClientID},
+		"client_secret": {p.cfg.OIDCClientSecret},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errInvalidOIDCLogin
+	}
+
+	token := &struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(token); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidOIDCLogin
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidOIDCLogin
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidOIDCLogin
+	}
+
+	exp, _ := claims["exp"].(float64)
+	sub, _ := claims["sub"].(string)
+	if claims["iss"] != d.Issuer || !containsClaim(claims["aud"], p.cfg.OIDCClientID) ||
+		time.Now().Unix() >= int64(exp) || claims["nonce"] != nonce || sub == "" {
+		return nil, errInvalidOIDCLogin
+	}
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return nil, httpError{http.StatusForbidden, "Your email address is not verified"}
+	}
+
+	identity := &oidcIdentity{subject: d.Issuer + " " + sub}
+	identity.email, _ = claims["email"].(string)
+	identity.email = strings.ToLower(identity.email)
+	if identity.name, _ = claims["preferred_username"].(string); identity.name == "" {
+		identity.name, _ = claims["name"].(string)
+	}
+	if identity.email == "" || identity.name == "" {
+		return nil, httpError{http.StatusBadRequest, "Your account has no email address or name"}
+	}
+	if groups, ok := claims[p.cfg.OIDCGroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				identity.groups = append(identity.groups, g)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// returns true if the claim is the value, or a list containing it
+func containsClaim(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, c := range claim {
+			if c == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns true if any of the groups is one of the comma-separated groups
+func inGroups(groups []string, names string) bool {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		for _, g := range groups {
+			if name != "" && g == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func oidcRedirectURI(r *http.Request) string {
+	return getBaseURL(r) + "/api/auth/oidc/callback"
+}
+
+// returns the URL of the provider's login page, keeping the state of the
+// login in a cookie for the callback
+func getOIDCRedirectURL(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.oidc == nil {
+		return httpError{http.StatusNotFound, "Single sign-on is not enabled"}
+	}
+
+	state, nonce, verifier := uniuri.NewLen(32), uniuri.NewLen(32), uniuri.NewLen(64)
+
+	loginURL, err := ctx.oidc.authURL(oidcRedirectURI(r), state, nonce, verifier)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		Path:     "/api/auth/oidc/",
+		MaxAge:   oidcStateMaxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(getBaseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return renderString(w, http.StatusOK, loginURL)
+}
+
+// logs in the user returning from the provider, creating them on their
+// first login
+func oidcCallback(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.oidc == nil {
+		return httpError{http.StatusNotFound, "Single sign-on is not enabled"}
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return errInvalidOIDCLogin
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc/", MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || r.FormValue("state") != parts[0] || r.FormValue("code") == "" {
+		return errInvalidOIDCLogin
+	}
+
+	identity, err := ctx.oidc.exchange(r.FormValue("code"), oidcRedirectURI(r), parts[1], parts[2])
+	if err != nil {
+		return err
+	}
+
+	user, err := getOIDCUser(ctx, r, identity)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return renderString(w, http.StatusAccepted, "An account already has your email address: "+
+			"follow the link sent to it to link it to single sign-on")
+	}
+
+	if ctx.cfg.OIDCAdminGroups != "" {
+		if isAdmin := inGroups(identity.groups, ctx.cfg.OIDCAdminGroups); isAdmin != user.IsAdmin {
+			user.IsAdmin = isAdmin
+			if err := ctx.datamapper.updateUser(user); err != nil {
+				return err
+			}
+			// see sessionBinding
+			if err := ctx.datamapper.deleteUserSessions(user.ID); err != nil {
+				return err
+			}
+			if err := writeAuditLog(ctx, "oidc_role", user.ID, fmt.Sprintf("admin=%t", isAdmin)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if user.IsBanned {
+		return errBanned
+	}
+	if user.isSuspended() {
+		return errSuspended
+	}
+
+	session, err := newSession(ctx, r, user)
+	if err != nil {
+		return err
+	}
+
+	authToken, err := ctx.session.createToken(user.ID, session.Key)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "authToken",
+		Value:   authToken,
+		Path:    "/",
+		Expires: time.Now().AddDate(0, 0, 1),
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// returns the user of the OpenID Connect account, creating them on their
+// first login. If an account made otherwise has the email, a link to link
+// them is sent to it and nil is returned.
+func getOIDCUser(ctx *context, r *http.Request, identity *oidcIdentity) (*user, error) {
+
+	linked, err := ctx.datamapper.getUserByOIDCSubject(identity.subject)
+	if err == nil || !isErrSqlNoRows(err) {
+		return linked, err
+	}
+
+	existing, err := ctx.datamapper.getUserByEmail(identity.email)
+	if err == nil {
+		code, err := existing.requestOIDCLink(identity.subject)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.datamapper.updateUser(existing); err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := ctx.mailer.sendOIDCLinkMail(existing, code, r); err != nil {
+				logError(err)
+			}
+		}()
+		return nil, nil
+	}
+	if !isErrSqlNoRows(err) {
+		return nil, err
+	}
+
+	user := &user{
+		Name:        invalidNameChars.ReplaceAllString(identity.name, "_"),
+		Email:       identity.email,
+		OIDCSubject: sql.NullString{String: identity.subject, Valid: true},
+	}
+	// never used, as the user logs in with the provider
+	if err := user.setRandomPassword(); err != nil {
+		return nil, err
+	}
+	if err := ctx.validate(user, r); err != nil {
+		return nil, err
+	}
+	if err := ctx.datamapper.createUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// links the OpenID Connect account to the user of the code emailed to them
+func confirmOIDCLink(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	user, err := ctx.datamapper.getUserByOIDCLinkCode(hashRecoveryCode(s.Code))
+	if err != nil {
+		return err
+	}
+
+	if user.isOIDCLinkExpired() {
+		user.cancelOIDCLink()
+		if err := ctx.datamapper.updateUser(user); err != nil {
+			return err
+		}
+		return httpError{http.StatusBadRequest, "This link has expired"}
+	}
+
+	// the account may have been linked to another user since
+	if _, err := ctx.datamapper.getUserByOIDCSubject(user.OIDCLinkSubject.String); !isErrSqlNoRows(err) {
+		if err != nil {
+			return err
+		}
+		user.cancelOIDCLink()
+		if err := ctx.datamapper.updateUser(user); err != nil {
+			return err
+		}
+		return httpError{http.StatusBadRequest, "This account is already linked"}
+	}
+
+	user.confirmOIDCLink()
+
+	if err := ctx.datamapper.updateUser(user); err != nil {
+		return err
+	}
+	if err := writeAuditLog(ctx, "oidc_link", user.ID, user.OIDCSubject.String); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Account linked, you can now log in with single sign-on")
+}
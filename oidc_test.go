@@ -0,0 +1,166 @@
+package photoshare
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOIDCLogin(t *testing.T) {
+
+	var (
+		provider  *httptest.Server
+		challenge string
+		claims    map[string]interface{}
+		subject   = "jane"
+		email     = "Jane@example.com"
+		verified  = true
+	)
+
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(&oidcDiscovery{provider.URL, provider.URL + "/authorize", provider.URL + "/token"})
+		case "/token":
+			if r.FormValue("code") != "code" || pkceChallenge(r.FormValue("code_verifier")) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			payload, _ := json.Marshal(claims)
+			json.NewEncoder(w).Encode(map[string]string{
+				"id_token": "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig",
+			})
+		}
+	}))
+	defer provider.Close()
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.OIDCIssuer = provider.URL
+	app.cfg.OIDCClientID = "photoshare"
+	app.cfg.OIDCScopes = "openid,email"
+	app.cfg.OIDCGroupsClaim = "groups"
+	app.cfg.OIDCAdminGroups = "photo-admins"
+	app.oidc = newOIDCProvider(app.cfg)
+
+	// logs in with the provider, returning the response of the callback
+	login := func(groups ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/api/auth/oidc/url", nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+		}
+
+		loginURL := res.Body.String()
+		u, err := url.Parse(loginURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := u.Query()
+		if params.Get("code_challenge_method") != "S256" || params.Get("scope") != "openid email" {
+			t.Errorf("Expected PKCE and the scopes, got %s", loginURL)
+		}
+		challenge = params.Get("code_challenge")
+		claims = map[string]interface{}{
+			"iss":                provider.URL,
+			"aud":                []string{"photoshare"},
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"nonce":              params.Get("nonce"),
+			"sub":                subject,
+			"email":              email,
+			"email_verified":     verified,
+			"preferred_username": "jane.doe",
+			"groups":             groups,
+		}
+
+		req, _ = http.NewRequest("GET", fmt.Sprintf("http://localhost/api/auth/oidc/callback?code=code&state=%s", params.Get("state")), nil)
+		for _, c := range res.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		res = httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := login("photo-admins")
+	if res.Code != http.StatusSeeOther || !strings.Contains(strings.Join(res.Header()["Set-Cookie"], ";"), "authToken=") {
+		t.Fatalf("Expected a redirect with the token, got %d: %s", res.Code, res.Body.String())
+	}
+	jane, err := dm.getUserByEmail("jane@example.com")
+	if err != nil {
+		t.Fatal("Expected the user created on their first login")
+	}
+	if jane.Name != "jane_doe" || !jane.IsAdmin {
+		t.Errorf("Expected jane_doe made an admin, got %+v", jane)
+	}
+
+	// leaving the admin group
+	if res := login("photographers"); res.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect, got %d", res.Code)
+	}
+	if jane, _ := dm.getUserByEmail("jane@example.com"); jane.IsAdmin || len(dm.users) != 1 {
+		t.Errorf("Expected the user no longer an admin, got %+v", jane)
+	}
+
+	// unverified emails are refused
+	verified = false
+	if res := login(); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an unverified email, got %d", res.Code)
+	}
+	verified = true
+
+	// the account of another provider user with the email of a local
+	// account is only linked once its owner confirms it
+	sender := &recordingSender{}
+	app.mailer.sender = sender
+	local := &user{Name: "admin", Email: "admin@example.com", IsAdmin: true}
+	if err := dm.createUser(local); err != nil {
+		t.Fatal(err)
+	}
+	subject, email = "mallory", "admin@example.com"
+	res = login()
+	if res.Code != http.StatusAccepted || strings.Contains(strings.Join(res.Header()["Set-Cookie"], ";"), "authToken=") {
+		t.Fatalf("Expected no login to the local account, got %d: %s", res.Code, res.Body.String())
+	}
+	if admin, _ := dm.getUser(local.ID); !admin.IsAdmin || admin.OIDCSubject.Valid {
+		t.Errorf("Expected the local account left as it is, got %+v", admin)
+	}
+	var code string
+	for i := 0; i < 100 && code == ""; i++ {
+		time.Sleep(time.Millisecond)
+		if len(sender.messages) > 0 {
+			body := string(sender.messages[0].body)
+			code = body[strings.Index(body, "code=")+5:]
+			code = code[:strings.Index(code, "\n")]
+		}
+	}
+	if code == "" {
+		t.Fatal("Expected the owner of the local account to be sent a link")
+	}
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/auth/oidc/link", strings.NewReader(`{"code": "`+code+`"}`))
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := login(); res.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a login once linked, got %d: %s", res.Code, res.Body.String())
+	}
+
+	// the state must match the cookie
+	req, _ = http.NewRequest("GET", "http://localhost/api/auth/oidc/callback?code=code&state=forged", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "state.nonce.verifier"})
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a forged state, got %d", res.Code)
+	}
+}
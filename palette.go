@@ -0,0 +1,144 @@
+package photoshare
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The dominant colors of a photo are extracted on upload and stored as RGB
+// values packed into integers (0xRRGGBB). They are returned as hex swatches
+// for placeholders while the photo loads, and searched with color:NAME or
+// color:#RRGGBB in the search query.
+
+const (
+	paletteSize = 5
+
+	// pixels sampled from each image at most
+	paletteSamples = 10000
+
+	// colors closer than this are not both kept in a palette
+	paletteMinDistance = 48
+
+	// search matches palette colors within this distance of the color
+	colorSearchDistance = 80
+)
+
+var namedColors = map[string]int64{
+	"red":    0xd32f2f,
+	"orange": 0xf57c00,
+	"yellow": 0xfbc02d,
+	"green":  0x388e3c,
+	"teal":   0x00897b,
+	"blue":   0x1976d2,
+	"purple": 0x7b1fa2,
+	"pink":   0xe91e63,
+	"brown":  0x6d4c41,
+	"black":  0x000000,
+	"gray":   0x808080,
+	"grey":   0x808080,
+	"white":  0xffffff,
+}
+
+// returns up to n dominant colors of the image, most common first. Sampled
+// pixels are grouped into buckets of similar colors; the average colors of
+// the largest buckets are kept unless close to a color already kept.
+func extractPalette(img image.Image, n int) []int64 {
+
+	type bucket struct {
+		r, g, b, count int64
+	}
+
+	bounds := img.Bounds()
+	step := 1
+	for (bounds.Dx()/step)*(bounds.Dy()/step) > paletteSamples {
+		step++
+	}
+
+	buckets := make(map[int]*bucket)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r, g, b = r>>8, g>>8, b>>8
+			key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += int64(r)
+			bk.g += int64(g)
+			bk.b += int64(b)
+			bk.count++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].count > sorted[j].count })
+
+	var palette []int64
+
+	for _, bk := range sorted {
+		if len(palette) == n {
+			break
+		}
+		c := (bk.r/bk.count)<<16 | (bk.g/bk.count)<<8 | bk.b/bk.count
+		distinct := true
+		for _, kept := range palette {
+			if colorDistance(c, kept) < paletteMinDistance {
+				distinct = false
+				break
+			}
+		}
+		if distinct {
+			palette = append(palette, c)
+		}
+	}
+	return palette
+}
+
+// returns the euclidean distance of two colors in RGB space
+func colorDistance(a, b int64) int64 {
+	dr := (a>>16)&0xff - (b>>16)&0xff
+	dg := (a>>8)&0xff - (b>>8)&0xff
+	db := a&0xff - b&0xff
+	return isqrt(dr*dr + dg*dg + db*db)
+}
+
+func isqrt(n int64) int64 {
+	x := int64(0)
+	for (x+1)*(x+1) <= n {
+		x++
+	}
+	return x
+}
+
+func colorHex(c int64) string {
+	return fmt.Sprintf("#%06x", c)
+}
+
+// parses a color name or hex value, with or without #
+func parseColor(s string) (int64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := namedColors[s]; ok {
+		return c, true
+	}
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return 0, false
+	}
+	c, err := strconv.ParseInt(s, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return c, true
+}
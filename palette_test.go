@@ -0,0 +1,63 @@
+package photoshare
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestExtractPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			switch {
+			case x < 70:
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			case x < 72:
+				// too close to blue to be kept
+				img.Set(x, y, color.RGBA{0, 40, 230, 255})
+			default:
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			}
+		}
+	}
+	palette := extractPalette(img, paletteSize)
+	if len(palette) != 2 {
+		t.Fatalf("Expected 2 colors, got %v", palette)
+	}
+	if palette[0] != 0x0000ff || palette[1] != 0xff0000 {
+		t.Errorf("Expected blue then red, got %s, %s", colorHex(palette[0]), colorHex(palette[1]))
+	}
+}
+
+func TestSetPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, color.RGBA{0x33, 0x66, 0x99, 255})
+		}
+	}
+	p := &photo{}
+	p.setPalette(extractPalette(img, paletteSize))
+	if len(p.Colors) != 1 || p.Colors[0] != "#336699" || p.Palette != "{3368601}" {
+		t.Errorf("Unexpected palette %s, colors %v", p.Palette, p.Colors)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for _, tc := range []struct {
+		s  string
+		c  int64
+		ok bool
+	}{
+		{"Blue", 0x1976d2, true},
+		{"#FF8800", 0xff8800, true},
+		{"ff8800", 0xff8800, true},
+		{"f80", 0, false},
+		{"sky", 0, false},
+	} {
+		if c, ok := parseColor(tc.s); c != tc.c || ok != tc.ok {
+			t.Errorf("%s: expected %x %t, got %x %t", tc.s, tc.c, tc.ok, c, ok)
+		}
+	}
+}
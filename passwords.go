@@ -0,0 +1,262 @@
+package photoshare
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+// Passwords are hashed with Argon2id, or bcrypt with PASSWORD_ALGORITHM,
+// Argon2id encoding its parameters with the salt and hash as
+// $argon2id$v=19$m=65536,t=3,p=2$salt$hash. With PASSWORD_PEPPER set, the
+// password hashed is first its HMAC-SHA256 under the pepper, kept out of
+// the database, so that hashes in a copy of it can't be cracked alone.
+//
+// The algorithm of each hash is kept in password_algorithm, and the pepper
+// in password_pepper by its id. Hashes of another algorithm, cost or pepper
+// than those of the config are replaced when their users log in, the
+// password being then known; this is done in the background by the
+// passwordRehasher, so that logins are not slowed down. Hashes made without
+// a pepper, or with the one before, PASSWORD_OLD_PEPPER, work until then.
+
+const (
+	passwordBcrypt   = "bcrypt"
+	passwordArgon2id = "argon2id"
+)
+
+const (
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+
+	// logins waiting for their passwords to be hashed again
+	passwordRehashQueueSize = 100
+)
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32 // KiB
+	threads uint8
+}
+
+// how new passwords are hashed, see setPasswordPolicy
+type passwordPolicy struct {
+	algorithm  string
+	argon2     argon2Params
+	bcryptCost int
+	pepper     []byte
+	oldPepper  []byte
+}
+
+var passwordHashing = &passwordPolicy{
+	algorithm:  passwordArgon2id,
+	argon2:     argon2Params{time: 3, memory: 64 * 1024, threads: 2},
+	bcryptCost: bcrypt.DefaultCost,
+}
+
+// sets how new passwords are hashed from the config
+func setPasswordPolicy(cfg *config) {
+	passwordHashing = &passwordPolicy{
+		algorithm: cfg.PasswordAlgorithm,
+		argon2: argon2Params{
+			time:    uint32(cfg.PasswordArgon2Time),
+			memory:  uint32(cfg.PasswordArgon2Memory),
+			threads: uint8(cfg.PasswordArgon2Threads),
+		},
+		bcryptCost: cfg.PasswordBcryptCost,
+		pepper:     []byte(cfg.PasswordPepper),
+		oldPepper:  []byte(cfg.PasswordOldPepper),
+	}
+}
+
+// returns the id of the pepper kept with the hashes, the start of its
+// SHA-256, or "" without a pepper
+func getPepperID(pepper []byte) string {
+	if len(pepper) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(pepper)
+	return hex.EncodeToString(sum[:4])
+}
+
+// returns the pepper of the id, of the pepper or the old pepper, or false
+// if neither; "" is the id of hashes made without a pepper
+func (p *passwordPolicy) getPepper(id string) ([]byte, bool) {
+	for _, pepper := range [][]byte{p.pepper, p.oldPepper, nil} {
+		if getPepperID(pepper) == id {
+			return pepper, true
+		}
+	}
+	return nil, false
+}
+
+// returns the password to hash with the pepper
+func applyPepper(pepper []byte, password string) []byte {
+	if len(pepper) == 0 {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// returns the hash of the password, with the algorithm and pepper id to
+// keep with it
+func (p *passwordPolicy) hash(password string) (hashed, algorithm, pepper string, err error) {
+	peppered := applyPepper(p.pepper, password)
+	switch p.algorithm {
+	case passwordBcrypt:
+		var b []byte
+		if b, err = bcrypt.GenerateFromPassword(peppered, p.bcryptCost); err == nil {
+			hashed = string(b)
+		}
+	default:
+		hashed, err = hashArgon2(peppered, p.argon2)
+	}
+	return hashed, p.algorithm, getPepperID(p.pepper), err
+}
+
+// returns true if the password is the one hashed with the algorithm and
+// pepper
+func (p *passwordPolicy) compare(algorithm, pepperID, hashed, password string) bool {
+	pepper, ok := p.getPepper(pepperID)
+	if !ok {
+		return false
+	}
+	peppered := applyPepper(pepper, password)
+	switch algorithm {
+	case passwordBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hashed), peppered) == nil
+	case passwordArgon2id:
+		params, salt, key, err := parseArgon2Hash(hashed)
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey(peppered, salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+	return false
+}
+
+// returns true if the hash is of the algorithm, cost and pepper of the
+// policy
+func (p *passwordPolicy) isCurrent(algorithm, pepperID, hashed string) bool {
+	if algorithm != p.algorithm || pepperID != getPepperID(p.pepper) {
+		return false
+	}
+	if algorithm == passwordBcrypt {
+		cost, err := bcrypt.Cost([]byte(hashed))
+		return err == nil && cost == p.bcryptCost
+	}
+	params, _, _, err := parseArgon2Hash(hashed)
+	return err == nil && params == p.argon2
+}
+
+// returns the encoded Argon2id hash of the password with a random salt
+func hashArgon2(password []byte, params argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, params.time, params.memory, params.threads, argon2KeySize)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		passwordArgon2id, argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// returns the parameters, salt and key of a hash encoded by hashArgon2
+func parseArgon2Hash(hashed string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != passwordArgon2id {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
+
+// returns true if the password of the user is to be hashed again, as set
+// by the config
+func (user *user) needsRehash() bool {
+	return user.Password != "" &&
+		!passwordHashing.isCurrent(user.PasswordAlgorithm, user.PasswordPepper, user.Password)
+}
+
+// hashes the password of the user again once checked on login, if needed.
+// The hash is only replaced if unchanged since, and errors are logged, as
+// the old hash still works.
+func rehashPassword(dm dataMapper, user user, password string) {
+	if !user.needsRehash() {
+		return
+	}
+	oldHash := user.Password
+	if err := user.changePassword(password); err != nil {
+		logError(err)
+		return
+	}
+	if err := dm.updatePasswordHash(&user, oldHash); err != nil {
+		logError(err)
+	}
+}
+
+type rehashJob struct {
+	dm       dataMapper
+	user     user
+	password string
+}
+
+// hashes passwords again in the background, one at a time, so that many
+// logins at once don't use the memory of as many hashes
+type passwordRehasher struct {
+	jobs chan *rehashJob
+}
+
+func newPasswordRehasher() *passwordRehasher {
+	r := &passwordRehasher{make(chan *rehashJob, passwordRehashQueueSize)}
+	go r.work()
+	return r
+}
+
+// queues the password of the user, just checked, to be hashed again if
+// needed. Logins are left out while the queue is full, to be hashed on
+// their next login. A nil rehasher hashes it at once.
+func (r *passwordRehasher) submit(dm dataMapper, user *user, password string) {
+	if !user.needsRehash() {
+		return
+	}
+	if r == nil {
+		rehashPassword(dm, *user, password)
+		return
+	}
+	select {
+	case r.jobs <- &rehashJob{dm, *user, password}:
+	default:
+	}
+}
+
+func (r *passwordRehasher) work() {
+	for job := range r.jobs {
+		rehashPassword(job.dm, job.user, job.password)
+	}
+}
@@ -0,0 +1,116 @@
+package photoshare
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPasswordPolicy() *passwordPolicy {
+	return &passwordPolicy{
+		algorithm:  passwordArgon2id,
+		argon2:     argon2Params{time: 1, memory: 64, threads: 1},
+		bcryptCost: bcrypt.MinCost,
+		pepper:     []byte("pepper-0123456789"),
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := newTestPasswordPolicy()
+
+	hashed, algorithm, pepper, err := p.hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$argon2id$v=19$m=64,t=1,p=1$") || algorithm != passwordArgon2id || pepper == "" {
+		t.Errorf("Expected the parameters encoded with the hash, got %q %s %q", hashed, algorithm, pepper)
+	}
+	if !p.compare(algorithm, pepper, hashed, "secret") || p.compare(algorithm, pepper, hashed, "wrong") {
+		t.Error("Expected only the password hashed to match")
+	}
+	if p.compare(passwordBcrypt, pepper, hashed, "secret") || p.compare(algorithm, "", hashed, "secret") {
+		t.Error("Expected hashes of another algorithm or pepper not to match")
+	}
+	if !p.isCurrent(algorithm, pepper, hashed) {
+		t.Error("Expected the hash to be current")
+	}
+
+	// the pepper is changed, the one before kept to check older hashes
+	p.oldPepper, p.pepper = p.pepper, []byte("pepper-abcdefghij")
+	if !p.compare(algorithm, pepper, hashed, "secret") || p.isCurrent(algorithm, pepper, hashed) {
+		t.Error("Expected hashes of the old pepper to match, and to be replaced")
+	}
+
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if !p.compare(passwordBcrypt, "", string(legacy), "secret") || p.isCurrent(passwordBcrypt, "", string(legacy)) {
+		t.Error("Expected hashes without a pepper to match, and to be replaced")
+	}
+
+	p.algorithm = passwordBcrypt
+	hashed, algorithm, pepper, err = p.hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.compare(algorithm, pepper, hashed, "secret") || !p.isCurrent(algorithm, pepper, hashed) {
+		t.Error("Expected the bcrypt hash to match")
+	}
+	p.bcryptCost++
+	if p.isCurrent(algorithm, pepper, hashed) {
+		t.Error("Expected hashes of another cost to be replaced")
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+
+	defer func(p *passwordPolicy) { passwordHashing = p }(passwordHashing)
+	passwordHashing = newTestPasswordPolicy()
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	owner := &user{Name: "owner", Email: "owner@example.com", Password: string(legacy), PasswordAlgorithm: passwordBcrypt}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) int {
+		body := `{"identifier": "owner", "password": "` + password + `"}`
+		req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	if code := login("wrong"); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a wrong password, got %d", code)
+	}
+	if u, _ := dm.getUser(owner.ID); u.PasswordAlgorithm != passwordBcrypt {
+		t.Fatal("Expected the hash kept after a wrong password")
+	}
+
+	if code := login("password"); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	u, _ := dm.getUser(owner.ID)
+	if u.PasswordAlgorithm != passwordArgon2id || u.PasswordPepper == "" || u.needsRehash() || !u.checkPassword("password") {
+		t.Fatalf("Expected the bcrypt hash replaced on login, got %s %q", u.PasswordAlgorithm, u.Password)
+	}
+
+	// hashed in the background
+	app.rehasher = newPasswordRehasher()
+	passwordHashing.argon2.time++
+	if code := login("password"); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	for i := 0; i < 100; i++ {
+		if u, _ := dm.getUser(owner.ID); !u.needsRehash() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the hash replaced with the new parameters")
+}
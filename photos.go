@@ -2,36 +2,61 @@ package photoshare
 
 import (
 	"fmt"
+	"github.com/juju/errgo"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path"
 	"strings"
+	"time"
 )
 
+const (
+	// files of a bulk upload, each up to MAX_UPLOAD_SIZE
+	maxBulkUploadFiles = 20
+
+	// bytes of multipart forms kept in memory, the rest in temporary files
+	maxUploadMemory = 32 << 20
+)
+
+var errPhotoConflict = httpError{http.StatusConflict, "The photo was changed by someone else, reload it and try again"}
+
 func deletePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	p, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
 	if err != nil {
 		return err
 	}
 
-	if !photo.canDelete(ctx.user) {
-		return httpError{http.StatusForbidden, "You're not allowed to delete this photo"}
-	}
-	if err := ctx.datamapper.removePhoto(photo); err != nil {
+	if err := ctx.permit(p.canDelete(ctx.user), "You're not allowed to delete this photo"); err != nil {
 		return err
 	}
 
-	go func() {
-		if err := ctx.filestore.clean(photo.Filename); err != nil {
-			log.Println(err)
+	// owners can restore their photos from the trash; photos deleted by
+	// admins are removed at once
+	if p.OwnerID == ctx.user.ID {
+		if err := ctx.datamapper.trashPhotos([]*photo{p}); err != nil {
+			return err
 		}
-	}()
+	} else {
+		if err := ctx.datamapper.removePhoto(p); err != nil {
+			return err
+		}
+
+		go func() {
+			if err := cleanUnusedFile(ctx.datamapper, ctx.filestore, p.Filename); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 
 	if err := ctx.cache.clear(); err != nil {
 		return err
 	}
 
-	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_deleted"})
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", p.ID, "photo_deleted"})
 	return renderString(w, http.StatusOK, "Photo deleted")
 }
 
@@ -41,6 +66,20 @@ func getPhotoDetail(ctx *context, w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
+	if err := checkPreviewLimit(ctx, photo.ID); err != nil {
+		return err
+	}
+	photo.Created = newDisplayTime(photo.CreatedAt, ctx.user.location())
+	photo.PrintSizes = photo.printSizes()
+	if photo.Price != nil {
+		photo.Currency = ctx.cfg.SalesCurrency
+		if ctx.user.IsAuthenticated {
+			if photo.Purchased, err = ctx.datamapper.hasPurchased(photo.ID, ctx.user.ID); err != nil {
+				return err
+			}
+		}
+	}
+	w.Header().Set("ETag", photoETag(&photo.photo))
 	return renderJSON(w, photo, http.StatusOK)
 
 }
@@ -52,12 +91,24 @@ func getPhotoToEdit(ctx *context, w http.ResponseWriter, r *http.Request) (*phot
 		return photo, err
 	}
 
-	if !photo.canEdit(ctx.user) {
-		return photo, httpError{http.StatusForbidden, "You're not allowed to edit this photo"}
+	if err := ctx.permit(photo.canEdit(ctx.user), "You're not allowed to edit this photo"); err != nil {
+		return photo, err
+	}
+
+	// clients send the ETag of the photo they edited, so that edits made
+	// since are not overwritten
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" &&
+		strings.TrimPrefix(match, "W/") != photoETag(photo) {
+		return photo, errPhotoConflict
 	}
 	return photo, nil
 }
 
+// returns the ETag of the current version of the photo
+func photoETag(photo *photo) string {
+	return fmt.Sprintf(`"%d"`, photo.Version)
+}
+
 func editPhotoTitle(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	photo, err := getPhotoToEdit(ctx, w, r)
@@ -74,6 +125,7 @@ func editPhotoTitle(ctx *context, w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
+	previous := photo.Title
 	photo.Title = s.Title
 
 	if err := ctx.validate(photo, r); err != nil {
@@ -85,7 +137,45 @@ func editPhotoTitle(ctx *context, w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	if err := notifyMentions(ctx, r, photo, photo.Title, previous); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderString(w, http.StatusOK, "Photo updated")
+}
+
+// sets the description of the photo read by screen readers
+func editPhotoAltText(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		AltText string `json:"altText"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	photo.AltText = strings.TrimSpace(s.AltText)
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
 	return renderString(w, http.StatusOK, "Photo updated")
 }
 
@@ -105,17 +195,58 @@ func editPhotoTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	}
 
 	photo.Tags = s.Tags
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
 	if err := ctx.datamapper.updateTags(photo); err != nil {
 		return err
 	}
 
-	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
 	return renderString(w, http.StatusOK, "Photo updated")
 
 }
 
 func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
+	if err := ctx.requireFeature(featureUploads); err != nil {
+		return err
+	}
+
+	progress, err := newUploadProgress(ctx, r)
+	if err != nil {
+		return err
+	}
+	r.Body = progress.reader(http.MaxBytesReader(w, r.Body, ctx.cfg.MaxUploadSize), r.ContentLength)
+
+	job, async, err := receivePhoto(ctx, r, progress)
+	if err != nil {
+		progress.finish(nil, err)
+		return err
+	}
+	if async {
+		return renderUploadJob(ctx, w, r, job)
+	}
+	if job.err != nil {
+		return job.err
+	}
+	return renderJSON(w, job.photo(), http.StatusCreated)
+}
+
+// answers an upload processed in the background with its job
+func renderUploadJob(ctx *context, w http.ResponseWriter, r *http.Request, job *processingJob) error {
+	status, _ := ctx.processing.status(job.ID, ctx.user.ID)
+	w.Header().Set("Location", fmt.Sprintf("/api/uploads/%s/status", job.ID))
+	return renderJSON(w, status.status(ctx.translator, ctx.translator.negotiate(r)), http.StatusAccepted)
+}
+
+// queues the photo of the multipart form of an upload to be saved by the
+// processing pool, waiting for it unless the upload is large enough to be
+// processed in the background
+func receivePhoto(ctx *context, r *http.Request, progress *uploadProgress) (*processingJob, bool, error) {
+
 	title := r.FormValue("title")
 	taglist := r.FormValue("taglist")
 	tags := strings.Split(taglist, " ")
@@ -123,52 +254,307 @@ func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	src, hdr, err := r.FormFile("photo")
 	if err != nil {
 		if err == http.ErrMissingFile || err == http.ErrNotMultipart {
-			return httpError{http.StatusBadRequest, "Invalid photo"}
+			return nil, false, httpError{http.StatusBadRequest, "Invalid photo"}
 		}
-		return err
+		return nil, false, err
 	}
 	defer src.Close()
 
 	contentType := hdr.Header["Content-Type"][0]
 
 	if !isAllowedContentType(contentType) {
-		return httpError{http.StatusBadRequest, "Only JPEG or PNG files allowed"}
+		return nil, false, httpError{http.StatusBadRequest, "Only JPEG or PNG files allowed"}
 	}
 
-	filename := generateRandomFilename(contentType)
+	expiresAt, err := parseExpiry(r.FormValue("expiresAt"))
+	if err != nil {
+		return nil, false, err
+	}
 
-	photo := &photo{Title: title,
-		OwnerID:  ctx.user.ID,
-		Filename: filename,
-		Tags:     tags,
+	cost, err := checkImageSize(ctx.cfg, src)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if err := ctx.filestore.store(src, photo.Filename, contentType); err != nil {
+	var file readable = src
+	async := ctx.processing != nil && ctx.cfg.AsyncUploadSize > 0 && hdr.Size >= ctx.cfg.AsyncUploadSize
+
+	// the files of the form are removed when the request ends
+	var tmp *os.File
+	if async {
+		if tmp, err = copyToTempFile(src); err != nil {
+			return nil, false, err
+		}
+		file = tmp
+	}
+
+	job, err := ctx.processing.submit(&processingJob{ownerID: ctx.user.ID, cost: cost, progress: progress,
+		run: func(job *processingJob) ([]*photo, error) {
+			if tmp != nil {
+				defer removeTempFile(tmp)
+			}
+			p, err := savePhoto(ctx, r, file, contentType, title, tags, expiresAt, job)
+			progress.finish(p, err)
+			if err != nil {
+				return nil, err
+			}
+			return []*photo{p}, nil
+		}})
+	if err != nil {
+		if tmp != nil {
+			removeTempFile(tmp)
+		}
+		return nil, false, err
+	}
+	if !async {
+		<-job.done
+	}
+	return job, async, nil
+}
+
+// uploads many photos at once, with the same title, or their filenames
+// without one, and tags. They are always processed in the background.
+func bulkUpload(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.requireFeature(featureUploads); err != nil {
 		return err
 	}
 
-	if err := ctx.validate(photo, r); err != nil {
+	progress, err := newUploadProgress(ctx, r)
+	if err != nil {
 		return err
 	}
-	if err := ctx.datamapper.createPhoto(photo); err != nil {
+	r.Body = progress.reader(http.MaxBytesReader(w, r.Body, ctx.cfg.MaxUploadSize*maxBulkUploadFiles), r.ContentLength)
+
+	job, err := receiveBulkUpload(ctx, r, progress)
+	if err != nil {
+		progress.finish(nil, err)
 		return err
 	}
+	return renderUploadJob(ctx, w, r, job)
+}
+
+func receiveBulkUpload(ctx *context, r *http.Request, progress *uploadProgress) (*processingJob, error) {
+
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return nil, httpError{http.StatusBadRequest, "Invalid photo"}
+	}
+	hdrs := r.MultipartForm.File["photo"]
+	if len(hdrs) == 0 {
+		return nil, httpError{http.StatusBadRequest, "Invalid photo"}
+	}
+	if len(hdrs) > maxBulkUploadFiles {
+		return nil, httpError{http.StatusBadRequest, fmt.Sprintf("No more than %d photos can be uploaded at once", maxBulkUploadFiles)}
+	}
+
+	title := r.FormValue("title")
+	tags := strings.Split(r.FormValue("taglist"), " ")
+	expiresAt, err := parseExpiry(r.FormValue("expiresAt"))
+	if err != nil {
+		return nil, err
+	}
+
+	// files failing before processing are reported with the others
+	type bulkFile struct {
+		name, contentType string
+		tmp               *os.File
+	}
+	var files []bulkFile
+	var cost int64 // of the largest file, as they are processed in turn
+	failures := make(uploadFailures)
+	removeFiles := func() {
+		for _, f := range files {
+			removeTempFile(f.tmp)
+		}
+	}
+
+	for _, hdr := range hdrs {
+		contentType := hdr.Header.Get("Content-Type")
+		switch {
+		case !isAllowedContentType(contentType):
+			failures[hdr.Filename] = httpError{http.StatusBadRequest, "Only JPEG or PNG files allowed"}
+			continue
+		case hdr.Size > ctx.cfg.MaxUploadSize:
+			failures[hdr.Filename] = httpError{http.StatusRequestEntityTooLarge, "Photo is too large"}
+			continue
+		}
+		src, err := hdr.Open()
+		if err != nil {
+			removeFiles()
+			return nil, errgo.Mask(err)
+		}
+		fileCost, err := checkImageSize(ctx.cfg, src)
+		if err != nil {
+			src.Close()
+			failures[hdr.Filename] = err
+			continue
+		}
+		if fileCost > cost {
+			cost = fileCost
+		}
+		tmp, err := copyToTempFile(src)
+		src.Close()
+		if err != nil {
+			removeFiles()
+			return nil, err
+		}
+		files = append(files, bulkFile{hdr.Filename, contentType, tmp})
+	}
+
+	job, err := ctx.processing.submit(&processingJob{ownerID: ctx.user.ID, cost: cost, progress: progress,
+		run: func(job *processingJob) ([]*photo, error) {
+			defer removeFiles()
+
+			var photos []*photo
+			for _, f := range files {
+				fileTitle := title
+				if fileTitle == "" {
+					fileTitle = strings.TrimSuffix(path.Base(f.name), path.Ext(f.name))
+				}
+				photo, err := savePhoto(ctx, r, f.tmp, f.contentType, fileTitle, tags, expiresAt, job)
+				if err != nil {
+					failures[f.name] = err
+					continue
+				}
+				photos = append(photos, photo)
+			}
+
+			if len(photos) == 0 {
+				progress.finish(nil, failures)
+				return nil, failures
+			}
+			progress.finish(photos[0], nil)
+			if len(failures) > 0 {
+				return photos, failures
+			}
+			return photos, nil
+		}})
+	if err != nil {
+		removeFiles()
+		return nil, err
+	}
+	return job, nil
+}
+
+// copies the file of a form to a temporary file, as the files of a form are
+// removed when the request ends
+func copyToTempFile(src io.Reader) (*os.File, error) {
+	tmp, err := ioutil.TempFile("", "upload-")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		removeTempFile(tmp)
+		return nil, errgo.Mask(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		removeTempFile(tmp)
+		return nil, errgo.Mask(err)
+	}
+	return tmp, nil
+}
+
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// stores the image and creates a photo owned by the current user, as a job
+// of the processing pool
+func savePhoto(ctx *context, r *http.Request, src readable, contentType, title string, tags []string,
+	expiresAt *time.Time, job *processingJob) (*photo, error) {
+
+	if err := job.stage(uploadProcessing); err != nil {
+		return nil, err
+	}
+
+	filename, err := contentFilename(ctx.cfg, src, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	photo := &photo{Title: title,
+		OwnerID:   ctx.user.ID,
+		Filename:  filename,
+		Tags:      tags,
+		ExpiresAt: expiresAt,
+	}
+
+	if err := checkSpam(ctx, photo); err != nil {
+		return nil, err
+	}
+
+	photo.Camera, photo.Lens = readGear(src)
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	photo.DPI = readDPI(src)
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := decodeImage(ctx.cfg, src)
+	if err == errTooManyPixels {
+		return nil, err
+	}
+	if err == nil {
+		photo.Width, photo.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		photo.setPalette(extractPalette(img, paletteSize))
+		photo.Blurhash = encodeBlurhash(img, blurhashXComponents, blurhashYComponents)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if err := job.stage(uploadStoring); err != nil {
+		return nil, err
+	}
+	if err := storePhotoFile(ctx.datamapper, ctx.filestore, src, photo, contentType, func() error {
+		if err := ctx.validate(photo, r); err != nil {
+			return err
+		}
+		if err := job.expired(); err != nil {
+			return err
+		}
+		return ctx.datamapper.createPhoto(photo)
+	}); err != nil {
+		return nil, err
+	}
 	if err := ctx.cache.clear(); err != nil {
 		logError(err)
 	}
 
-	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_uploaded"})
-	return renderJSON(w, photo, http.StatusCreated)
+	if ctx.labeler != nil {
+		go labelPhoto(ctx.labeler, ctx.filestore, ctx.datamapper, photo, contentType)
+	}
+
+	// held photos are published when approved
+	if photo.HeldAt != nil {
+		return photo, nil
+	}
+
+	if err := notifyMentions(ctx, r, photo, photo.Title, ""); err != nil {
+		logError(err)
+	}
+
+	if isFederated(ctx.app, ctx.user) {
+		owner := *ctx.user
+		go deliverPhoto(ctx.app, &owner, photo, getBaseURL(r))
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_uploaded"})
+	return photo, nil
 }
 
 func searchPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	page := getPage(r)
 	q := r.FormValue("q")
-	cacheKey := fmt.Sprintf("photos:search:%s:page:%d", q, page.index)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:search:%s:page:%d:user:%d", q, page.index, userID)
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
-		photos, err := ctx.datamapper.searchPhotos(page, q)
+		photos, err := ctx.datamapper.searchPhotos(page, q, userID)
 		if err != nil {
 			return photos, err
 		}
@@ -181,10 +567,11 @@ func photosByOwnerID(ctx *context, w http.ResponseWriter, r *http.Request) error
 
 	page := getPage(r)
 	ownerID := ctx.params.getInt("ownerID")
-	cacheKey := fmt.Sprintf("photos:ownerID:%d:page:%d", ownerID, page.index)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:ownerID:%d:page:%d:user:%d", ownerID, page.index, userID)
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
-		photos, err := ctx.datamapper.getPhotosByOwnerID(page, ownerID)
+		photos, err := ctx.datamapper.getPhotosByOwnerID(page, ownerID, userID)
 		if err != nil {
 			return photos, err
 		}
@@ -195,14 +582,20 @@ func photosByOwnerID(ctx *context, w http.ResponseWriter, r *http.Request) error
 func getPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	page := getPage(r)
-	orderBy := r.FormValue("orderBy")
-	cacheKey := fmt.Sprintf("photos:%s:page:%d", orderBy, page.index)
+	order := getOrdering(r)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:%s:%s:page:%d:exact:%t:user:%d", order.sort, order.window, page.index, page.exact, userID)
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
-		photos, err := ctx.datamapper.getPhotos(page, orderBy)
+		photos, err := ctx.datamapper.getPhotos(page, order, userID)
 		if err != nil {
 			return photos, err
 		}
+		if page.index == 1 {
+			if err := addHomepagePins(ctx, photos, userID); err != nil {
+				return photos, err
+			}
+		}
 		return photos, nil
 	})
 }
@@ -218,32 +611,196 @@ func getTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 }
 
+// returns the tag with a page of its photos
+func getTagPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tag, err := ctx.datamapper.getTagDetail(ctx.params.get("name"))
+	if err != nil {
+		return err
+	}
+
+	page := getPage(r)
+	order := getOrdering(r)
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("photos:tag:%d:%s:%s:page:%d:exact:%t:user:%d", tag.ID, order.sort, order.window, page.index, page.exact, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		photos, err := ctx.datamapper.getPhotosByTag(page, tag.ID, order, userID)
+		if err != nil {
+			return nil, err
+		}
+		following, err := ctx.datamapper.isFollowingTag(userID, tag.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &tagPhotoList{tag, following, photos}, nil
+	})
+}
+
+// sets the description of the tag, and its cover photo from the photos of
+// the tag; a cover photo ID of 0 removes the cover photo
+func editTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tag, err := ctx.datamapper.getTagDetail(ctx.params.get("name"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Description  *string `json:"description"`
+		CoverPhotoID *int64  `json:"coverPhotoId"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if s.Description != nil {
+		tag.Description = strings.TrimSpace(*s.Description)
+	}
+
+	if s.CoverPhotoID != nil {
+		if *s.CoverPhotoID == 0 {
+			tag.CoverPhotoID = nil
+		} else {
+			ok, err := ctx.datamapper.isTaggedPhoto(tag.ID, *s.CoverPhotoID)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return httpError{http.StatusBadRequest, "The cover photo must have the tag"}
+			}
+			tag.CoverPhotoID = s.CoverPhotoID
+		}
+	}
+
+	if err := ctx.validate(tag, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.saveTagDetail(tag); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "edit_tag", tag.ID, tag.Name); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	if tag, err = ctx.datamapper.getTagDetail(tag.Name); err != nil {
+		return err
+	}
+	return renderJSON(w, tag, http.StatusOK)
+}
+
 func voteDown(ctx *context, w http.ResponseWriter, r *http.Request) error {
-	return vote(ctx, w, r, func(photo *photo) { photo.DownVotes++ })
+	return vote(ctx, w, r, notificationDownvote, -1)
 }
 
 func voteUp(ctx *context, w http.ResponseWriter, r *http.Request) error {
-	return vote(ctx, w, r, func(photo *photo) { photo.UpVotes++ })
+	return vote(ctx, w, r, notificationUpvote, 1)
 }
 
-func vote(ctx *context, w http.ResponseWriter, r *http.Request, fn func(photo *photo)) error {
+func vote(ctx *context, w http.ResponseWriter, r *http.Request, kind string, value int) error {
 
-	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	detail, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
 	if err != nil {
 		return err
 	}
+	photo := &detail.photo
 
-	if !photo.canVote(ctx.user) {
-		return httpError{http.StatusForbidden, "You're not allowed to vote on this photo"}
+	blocked, err := ctx.datamapper.isBlocked(photo.OwnerID, ctx.user.ID, false)
+	if err != nil {
+		return err
 	}
 
-	fn(photo)
-
-	ctx.user.registerVote(photo.ID)
+	if err := ctx.permit(photo.canVote(ctx.user) && !blocked, "You're not allowed to vote on this photo"); err != nil {
+		return err
+	}
 
-	if err := ctx.datamapper.updateMany(photo, ctx.user); err != nil {
+	if err := ctx.datamapper.recordVote(photo, ctx.user, value); err != nil {
 		return err
 	}
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+
+	owner, err := ctx.datamapper.getActiveUser(photo.OwnerID)
+	if err == nil {
+		err = sendNotification(ctx, r, owner, kind, photo)
+	}
+	if err != nil && !isErrSqlNoRows(err) {
+		logError(err)
+	}
 
 	return renderString(w, http.StatusOK, "Voting successful")
 }
+
+// returns the photos of up to maxBatchSize ids in one response, for clients
+// filling their offline caches. The ids of photos not found, or hidden from
+// the user, are returned as missing.
+func lookupPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		IDs []int64 `json:"ids"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if len(s.IDs) == 0 {
+		return httpError{http.StatusBadRequest, "No photos given"}
+	}
+	if len(s.IDs) > maxBatchSize {
+		return httpError{http.StatusBadRequest, "Too many photos"}
+	}
+
+	var (
+		photoIDs []int64
+		found    = make(map[int64]bool)
+	)
+	for _, id := range s.IDs {
+		if _, ok := found[id]; !ok {
+			found[id] = false
+			photoIDs = append(photoIDs, id)
+		}
+	}
+
+	photos, err := ctx.datamapper.getPhotoDetails(photoIDs, ctx.user)
+	if err != nil {
+		return err
+	}
+
+	for i := range photos {
+		photo := &photos[i]
+		found[photo.ID] = true
+		photo.Created = newDisplayTime(photo.CreatedAt, ctx.user.location())
+		photo.PrintSizes = photo.printSizes()
+		if photo.Price != nil {
+			photo.Currency = ctx.cfg.SalesCurrency
+			if ctx.user.IsAuthenticated {
+				if photo.Purchased, err = ctx.datamapper.hasPurchased(photo.ID, ctx.user.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	missing := []int64{}
+	for _, id := range photoIDs {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	if photos == nil {
+		photos = []photoDetail{}
+	}
+
+	return renderJSON(w, &struct {
+		Photos  []photoDetail `json:"photos"`
+		Missing []int64       `json:"missing"`
+	}{photos, missing}, http.StatusOK)
+}
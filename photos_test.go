@@ -1,52 +1,28 @@
 package photoshare
 
 import (
+	"bytes"
 	"database/sql"
-	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
-type mockCache struct{}
-
-func (m *mockCache) set(key string, obj interface{}) ([]byte, error) {
-	return json.Marshal(obj)
-}
-
-func (m *mockCache) clear() error {
-	return nil
-}
-
-func (m *mockCache) get(key string, fn func() (interface{}, error)) (interface{}, error) {
-	return fn()
-}
-
-func (m *mockCache) render(w http.ResponseWriter, status int, key string, fn func() (interface{}, error)) error {
-	obj, err := fn()
-	if err != nil {
-		return err
-	}
-	value, err := json.Marshal(obj)
-	if err != nil {
-		return err
-	}
-	return writeBody(w, value, status, "application/json")
-}
-
 type mockSessionManager struct {
+	sessionBinding
 }
 
-func (m *mockSessionManager) readToken(r *http.Request) (int64, error) {
-	return 0, nil
+func (m *mockSessionManager) readToken(r *http.Request) (int64, string, error) {
+	return 0, "", nil
 }
 
-func (m *mockSessionManager) createToken(userID int64) (string, error) {
+func (m *mockSessionManager) createToken(userID int64, sessionKey string) (string, error) {
 	return strconv.FormatInt(userID, 10), nil
 }
 
-func (m *mockSessionManager) writeToken(w http.ResponseWriter, userID int64) error {
+func (m *mockSessionManager) writeToken(w http.ResponseWriter, userID int64, sessionKey string) error {
 	return nil
 }
 
@@ -57,6 +33,18 @@ func (m *mockDataMapper) getPhoto(photoID int64) (*photo, error) {
 	return nil, sql.ErrNoRows
 }
 
+func (m *mockDataMapper) getChangedPhotos(since time.Time, limit int64) ([]photoChange, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) getDeletedPhotoIDs(since time.Time) ([]int64, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) getPhotoDetails(photoIDs []int64, user *user) ([]photoDetail, error) {
+	return nil, nil
+}
+
 func (m *mockDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
 	canEdit := user.ID == 1
 	photo := &photoDetail{
@@ -73,7 +61,7 @@ func (m *mockDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail
 	return photo, nil
 }
 
-func (m *mockDataMapper) getPhotos(page *page, orderBy string) (*photoList, error) {
+func (m *mockDataMapper) getPhotos(page *page, order *ordering, userID int64) (*photoList, error) {
 	item := &photo{
 		ID:      1,
 		Title:   "test",
@@ -83,22 +71,581 @@ func (m *mockDataMapper) getPhotos(page *page, orderBy string) (*photoList, erro
 	return newPhotoList(photos, 1, 1), nil
 }
 
-func (m *mockDataMapper) getPhotosByOwnerID(page *page, ownerID int64) (*photoList, error) {
+func (m *mockDataMapper) getPhotosByOwnerID(page *page, ownerID int64, userID int64) (*photoList, error) {
 	return &photoList{}, nil
 }
 
-func (m *mockDataMapper) searchPhotos(page *page, q string) (*photoList, error) {
+func (m *mockDataMapper) searchPhotos(page *page, q string, userID int64) (*photoList, error) {
 	return &photoList{}, nil
 }
 
+func (m *mockDataMapper) getPhotosByTag(page *page, tagID int64, order *ordering, userID int64) (*photoList, error) {
+	return newPhotoList([]photo{{ID: 1, Title: "test", OwnerID: 1}}, 1, 1), nil
+}
+
+func (m *mockDataMapper) getTagDetail(name string) (*tagDetail, error) {
+	if name != "nature" {
+		return nil, sql.ErrNoRows
+	}
+	return &tagDetail{ID: 1, Name: name, Description: "Trees and flowers", NumPhotos: 1}, nil
+}
+
+func (m *mockDataMapper) saveTagDetail(tag *tagDetail) error {
+	return nil
+}
+
+func (m *mockDataMapper) isTaggedPhoto(tagID int64, photoID int64) (bool, error) {
+	return photoID == 1, nil
+}
+
+func (m *mockDataMapper) getPhotosByGear(page *page, name string, order *ordering, userID int64) (*photoList, error) {
+	return &photoList{}, nil
+}
+
+func (m *mockDataMapper) getGear() ([]gearCount, error) {
+	return []gearCount{}, nil
+}
+
+func (m *mockDataMapper) setPhotoGear(photo *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) setPhotoColors(photo *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) getRandomPhotos(n int64, userID int64) ([]photo, error) {
+	return []photo{}, nil
+}
+
+func (m *mockDataMapper) getStaffPicks(page *page, userID int64) (*photoList, error) {
+	return &photoList{}, nil
+}
+
+func (m *mockDataMapper) setStaffPick(photo *photo, picked bool) error {
+	return nil
+}
+
+func (m *mockDataMapper) updatePhotos(photos []*photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) removePhotos(photos []*photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) getBlockedWords() ([]blockedWord, error) {
+	return []blockedWord{}, nil
+}
+
+func (m *mockDataMapper) addBlockedWord(word *blockedWord) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeBlockedWord(wordID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getSpamSignals(ownerID int64, title string) (*spamSignals, error) {
+	return &spamSignals{}, nil
+}
+
+func (m *mockDataMapper) getHeldPhotos(page *page) (*photoList, error) {
+	return &photoList{}, nil
+}
+
+func (m *mockDataMapper) saveSuggestions(s *photoSuggestions) error {
+	return nil
+}
+
+func (m *mockDataMapper) getSuggestions(photoID int64) (*photoSuggestions, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) removeSuggestions(photoID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getMentions(page *page, userID int64) (*mentionList, error) {
+	return &mentionList{}, nil
+}
+
+func (m *mockDataMapper) getActivity(page *page, userID int64, since time.Time) (*activityList, error) {
+	return newActivityList([]activity{}, 0, page.index), nil
+}
+
+func (m *mockDataMapper) getNotifications(page *page, userID int64) (*notificationList, error) {
+	return &notificationList{}, nil
+}
+
 func (m *mockDataMapper) getTagCounts() ([]tagCount, error) {
 	return []tagCount{}, nil
 }
 
+func (m *mockDataMapper) getAllPhotos() ([]photoDetail, error) {
+	return []photoDetail{}, nil
+}
+
+func (m *mockDataMapper) getAllUsers() ([]user, error) {
+	return []user{}, nil
+}
+
+func (m *mockDataMapper) importArchive(_ *archive, _ bool) error {
+	return nil
+}
+
+func (m *mockDataMapper) forSite(siteID int64) dataMapper {
+	return m
+}
+
+func (m *mockDataMapper) getSites() ([]site, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) createSite(_ *site) error {
+	return nil
+}
+
+func (m *mockDataMapper) createGroup(_ *group) error {
+	return nil
+}
+
+func (m *mockDataMapper) getGroup(groupID int64) (*group, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getGroupDetail(groupID int64) (*groupDetail, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getGroups(page *page) (*groupList, error) {
+	return newGroupList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) isGroupNameAvailable(_ *group) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) getGroupMember(groupID int64, userID int64) (*groupMember, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) saveGroupMember(_ *groupMember) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeGroupMember(groupID int64, userID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getGroupMembers(groupID int64, status string) ([]groupMemberDetail, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) addGroupPhoto(groupID int64, photoID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeGroupPhoto(groupID int64, photoID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getGroupPhotos(page *page, groupID int64, userID int64) (*photoList, error) {
+	return newPhotoList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) createContest(_ *contest) error {
+	return nil
+}
+
+func (m *mockDataMapper) getContest(contestID int64) (*contestDetail, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getContests(page *page) (*contestList, error) {
+	return newContestList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) getContestEntries(page *page, _ *contest, userID int64) (*photoList, error) {
+	return newPhotoList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) isContestEntry(_ *contest, photoID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) takeContestEntries(_ *contest) error {
+	return nil
+}
+
+func (m *mockDataMapper) voteInContest(contestID int64, userID int64, photoID int64) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) setContestWinner(_ *contest) error {
+	return nil
+}
+
+func (m *mockDataMapper) getAlbum(albumID int64) (*portfolioAlbum, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getHomepagePins() ([]homepagePin, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) getActiveHomepagePins(now time.Time, userID int64) ([]homepagePin, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) setHomepagePins(pins []homepagePin) error {
+	return nil
+}
+
+func (m *mockDataMapper) createChallenge(_ *challenge) error {
+	return nil
+}
+
+func (m *mockDataMapper) getChallenge(challengeID int64) (*challengeDetail, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getCurrentChallenge(now time.Time) (*challengeDetail, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getChallenges(page *page, now time.Time) (*challengeList, error) {
+	return newChallengeList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) getChallengeEntries(page *page, _ *challenge, userID int64) (*photoList, error) {
+	return newPhotoList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) isChallengeOverlapping(_ *challenge) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getChallengesToAnnounce(now time.Time) ([]challenge, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) setChallengeAnnounced(_ *challenge) error {
+	return nil
+}
+
+func (m *mockDataMapper) getActorKey(userID int64) (*actorKey, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) createActorKey(_ *actorKey) error {
+	return nil
+}
+
+func (m *mockDataMapper) addFollower(_ *follower) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeFollower(userID int64, actor string) error {
+	return nil
+}
+
+func (m *mockDataMapper) getFollowers(userID int64) ([]follower, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) countFollowers(userID int64) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) getPhotoFilenames() ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *mockDataMapper) withFileLock(name string, fn func() error) error {
+	return fn()
+}
+
+func (m *mockDataMapper) isFileUsed(name string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) removeOrphanTags() (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) getFeatureFlags() ([]featureFlag, error) {
+	return []featureFlag{}, nil
+}
+
+func (m *mockDataMapper) setFeatureFlag(_ *featureFlag) error {
+	return nil
+}
+
+func (m *mockDataMapper) createAuditEntry(_ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) getAuditLog(page *page) (*auditList, error) {
+	return &auditList{}, nil
+}
+
+func (m *mockDataMapper) blockUser(userID int64, targetID int64, mute bool) error {
+	return nil
+}
+
+func (m *mockDataMapper) unblockUser(userID int64, targetID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) isBlocked(userID int64, targetID int64, includeMuted bool) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getBlockedUsers(userID int64) ([]blockedUser, error) {
+	return []blockedUser{}, nil
+}
+
+func (m *mockDataMapper) followUser(userID int64, targetID int64) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) unfollowUser(userID int64, targetID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) followTag(userID int64, tagID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) unfollowTag(userID int64, name string) error {
+	return nil
+}
+
+func (m *mockDataMapper) isFollowingTag(userID int64, tagID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getFollows(userID int64) (*follows, error) {
+	return &follows{Users: []followedUser{}, Tags: []string{}}, nil
+}
+
+func (m *mockDataMapper) getFeedPhotos(page *page, order *ordering, userID int64) (*photoList, error) {
+	return newPhotoList(nil, 0, page.index), nil
+}
+
+func (m *mockDataMapper) createSession(_ *session) error {
+	return nil
+}
+
+func (m *mockDataMapper) getSession(key string) (*session, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getSessions(userID int64) ([]session, error) {
+	return []session{}, nil
+}
+
+func (m *mockDataMapper) touchSession(_ *session) error {
+	return nil
+}
+
+func (m *mockDataMapper) rotateSessionKey(userID int64, sessionID int64, key string) error {
+	return nil
+}
+
+func (m *mockDataMapper) deleteUserSessions(userID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) deleteOtherSessions(userID int64, sessionID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) deleteSession(userID int64, sessionID int64) error {
+	return nil
+}
+
 func (m *mockDataMapper) getActiveUser(userID int64) (*user, error) {
 	return &user{}, nil
 }
 
+func (m *mockDataMapper) getExpiredPhotos(_ time.Time) ([]photo, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) setPhotoDimensions(_ *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) setPhotoChecksum(_ *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) getPhotosToCheck(_ time.Time, _ int) ([]photo, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) recordStorageCheck(_ *photo, _ time.Time, _ *storageCorruption) error {
+	return nil
+}
+
+func (m *mockDataMapper) getStorageCorruptions(_ time.Time) ([]storageCorruptionDetail, error) {
+	return []storageCorruptionDetail{}, nil
+}
+
+func (m *mockDataMapper) getPortfolio(_ int64, _ int64) ([]portfolioAlbum, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) setPortfolio(_ int64, _ []portfolioAlbum) error {
+	return nil
+}
+
+func (m *mockDataMapper) getAlbumIDByPreviousSlug(_ int64, _ string) (int64, error) {
+	return 0, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getUserBySlug(_ string) (*user, error) {
+	return &user{}, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getUserByPreviousSlug(_ string) (*user, error) {
+	return &user{}, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) isUserSlugAvailable(_ *user) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) changeUserSlug(_ *user, _ *string) error {
+	return nil
+}
+
+func (m *mockDataMapper) getShortlink(_ int64) (*shortlink, error) {
+	return &shortlink{}, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) createShortlink(_ *shortlink) error {
+	return nil
+}
+
+func (m *mockDataMapper) followShortlink(_ string) (*shortlink, error) {
+	return &shortlink{}, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getComments(_ int64, _ *user) ([]commentDetail, error) {
+	return []commentDetail{}, nil
+}
+
+func (m *mockDataMapper) getComment(_ int64) (*comment, error) {
+	return &comment{}, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) createComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) updateComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) deleteComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) createReport(_ *report) error {
+	return nil
+}
+
+func (m *mockDataMapper) hasReported(_ int64, _ int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getReport(_ int64) (*report, error) {
+	return &report{}, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getOpenReports() ([]reportDetail, error) {
+	return []reportDetail{}, nil
+}
+
+func (m *mockDataMapper) resolveReport(_ *report) (*user, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) getModerationNotes(_ int64) ([]moderationNoteDetail, error) {
+	return []moderationNoteDetail{}, nil
+}
+
+func (m *mockDataMapper) createModerationNote(_ *moderationNote) error {
+	return nil
+}
+
+func (m *mockDataMapper) getStrikeThresholds() ([]strikeThreshold, error) {
+	return []strikeThreshold{}, nil
+}
+
+func (m *mockDataMapper) setStrikeThresholds(_ []strikeThreshold) error {
+	return nil
+}
+
+func (m *mockDataMapper) createPurchase(_ *purchase) error {
+	return nil
+}
+
+func (m *mockDataMapper) getPurchaseByCheckout(_ string) (*purchase, error) {
+	return &purchase{}, nil
+}
+
+func (m *mockDataMapper) markPurchasePaid(_ *purchase) error {
+	return nil
+}
+
+func (m *mockDataMapper) hasPurchased(_ int64, _ int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getPurchases(_ int64) ([]purchaseDetail, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) trashPhotos(_ []*photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) restorePhoto(_ *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) getTrash(_ *page, _ int64) (*photoList, error) {
+	return &photoList{}, nil
+}
+
+func (m *mockDataMapper) getTrashedPhoto(_ int64, _ int64) (*photo, error) {
+	return &photo{}, nil
+}
+
+func (m *mockDataMapper) getTrashedBefore(_ time.Time) ([]photo, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) getUser(userID int64) (*user, error) {
+	return &user{}, nil
+}
+
+func (m *mockDataMapper) removeUser(_ *user) error {
+	return nil
+}
+
+func (m *mockDataMapper) getInactiveUsers(_ time.Time) ([]inactiveUser, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) getWarnedUsers(_ time.Time, _ time.Time) ([]inactiveUser, error) {
+	return nil, nil
+}
+
 func (m *mockDataMapper) getUserByEmail(email string) (*user, error) {
 	return &user{}, nil
 }
@@ -115,10 +662,58 @@ func (m *mockDataMapper) getUserByNameOrEmail(identifier string) (*user, error)
 	return &user{}, nil
 }
 
+func (m *mockDataMapper) getUserByOIDCSubject(subject string) (*user, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getUserByOIDCLinkCode(code string) (*user, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getUserByEmailChangeCode(code string) (*user, error) {
+	return &user{}, nil
+}
+
+func (m *mockDataMapper) getUsersByNames(names []string) ([]user, error) {
+	return []user{}, nil
+}
+
+func (m *mockDataMapper) getUserByName(name string) (*user, error) {
+	return &user{}, nil
+}
+
+func (m *mockDataMapper) getUserStats(userID int64) (*userStats, error) {
+	return &userStats{}, nil
+}
+
+func (m *mockDataMapper) awardBadge(b *badge) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) getBadges(userID int64) ([]badge, error) {
+	return []badge{}, nil
+}
+
+func (m *mockDataMapper) getUserByPreviousName(name string) (*user, error) {
+	return &user{}, nil
+}
+
+func (m *mockDataMapper) changeUserName(_ *user, oldName string) error {
+	return nil
+}
+
 func (m *mockDataMapper) getUserByRecoveryCode(code string) (*user, error) {
 	return &user{}, nil
 }
 
+func (m *mockDataMapper) clearRecoveryCode(userID int64, code string) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) updatePasswordHash(u *user, oldHash string) error {
+	return nil
+}
+
 func (m *mockDataMapper) createPhoto(_ *photo) error {
 	return nil
 }
@@ -139,6 +734,70 @@ func (m *mockDataMapper) createUser(_ *user) error {
 	return nil
 }
 
+func (m *mockDataMapper) createMention(_ *mention) error {
+	return nil
+}
+
+func (m *mockDataMapper) recordVote(_ *photo, _ *user, value int) error {
+	return nil
+}
+
+func (m *mockDataMapper) reserveIdempotencyKey(_ *idempotencyKey, _ time.Time, _ time.Time) (*idempotencyKey, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) saveIdempotencyKey(_ *idempotencyKey) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeIdempotencyKey(_ *idempotencyKey) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeExpiredIdempotencyKeys(_ time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) recomputeScores() (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) createNotification(_ *notification) error {
+	return nil
+}
+
+func (m *mockDataMapper) markNotificationRead(userID int64, notificationID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getNotificationSettings(userID int64) (notificationSettings, error) {
+	return newNotificationSettings(userID, nil), nil
+}
+
+func (m *mockDataMapper) saveNotificationSettings(_ notificationSettings) error {
+	return nil
+}
+
+func (m *mockDataMapper) savePushSubscription(_ *pushSubscription) error {
+	return nil
+}
+
+func (m *mockDataMapper) getPushSubscriptions(userID int64) ([]pushSubscription, error) {
+	return nil, nil
+}
+
+func (m *mockDataMapper) removePushSubscription(userID int64, subscriptionID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) removePushEndpoint(endpoint string) error {
+	return nil
+}
+
+func (m *mockDataMapper) markAllNotificationsRead(userID int64) error {
+	return nil
+}
+
 func (m *mockDataMapper) updateUser(_ *user) error {
 	return nil
 }
@@ -151,9 +810,9 @@ type emptyDataStore struct {
 	mockDataMapper
 }
 
-func (m *emptyDataStore) getPhotos(page *page, orderBy string) (*photoList, error) {
+func (m *emptyDataStore) getPhotos(page *page, order *ordering, userID int64) (*photoList, error) {
 	var photos []photo
-	return &photoList{photos, 0, 1, 0}, nil
+	return &photoList{Items: photos, CurrentPage: 1}, nil
 }
 
 func (m *emptyDataStore) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
@@ -171,8 +830,9 @@ func TestGetPhotoDetailIfNone(t *testing.T) {
 	}
 
 	c := &context{
-		app:    app,
-		params: &params{make(map[string]string)},
+		app:        app,
+		params:     &params{make(map[string]string)},
+		datamapper: app.datamapper,
 	}
 
 	err := getPhotoDetail(c, res, req)
@@ -194,9 +854,10 @@ func TestGetPhotoDetail(t *testing.T) {
 	}
 
 	c := &context{
-		app:    app,
-		params: p,
-		user:   &user{},
+		app:        app,
+		params:     p,
+		user:       &user{},
+		datamapper: app.datamapper,
 	}
 
 	getPhotoDetail(c, res, req)
@@ -220,12 +881,14 @@ func TestGetPhotos(t *testing.T) {
 
 	app := &app{
 		datamapper: &mockDataMapper{},
-		cache:      &mockCache{},
+		cache:      &fakeCache{},
 	}
 
 	c := &context{
-		app:    app,
-		params: &params{},
+		app:        app,
+		params:     &params{},
+		datamapper: app.datamapper,
+		cache:      app.cache,
 	}
 
 	getPhotos(c, res, req)
@@ -236,3 +899,88 @@ func TestGetPhotos(t *testing.T) {
 	}
 
 }
+
+func TestGetTagPhotos(t *testing.T) {
+
+	app := newTestApp(&mockDataMapper{})
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/tags/nature/photos?orderBy=top", nil)
+	res := httptest.NewRecorder()
+
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	value := &tagPhotoList{photoList: &photoList{}}
+	parseJSONBody(res, value)
+	if value.Tag == nil || value.Tag.Description != "Trees and flowers" || value.Tag.NumPhotos != 1 {
+		t.Errorf("Tag details missing: %+v", value.Tag)
+	}
+	if value.Total != 1 || len(value.Items) != 1 {
+		t.Error("Photos missing")
+	}
+}
+
+func TestGetTagPhotosUnknownTag(t *testing.T) {
+
+	app := newTestApp(&mockDataMapper{})
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/tags/unknown/photos", nil)
+	res := httptest.NewRecorder()
+
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", res.Code)
+	}
+}
+
+type tagDataMapper struct {
+	mockDataMapper
+	saved *tagDetail
+}
+
+func (m *tagDataMapper) saveTagDetail(tag *tagDetail) error {
+	m.saved = tag
+	return nil
+}
+
+func TestEditTag(t *testing.T) {
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"description": "Outdoors", "coverPhotoId": 1}`, http.StatusOK},
+		{`{"coverPhotoId": 2}`, http.StatusBadRequest},
+	} {
+		dm := &tagDataMapper{}
+		p := &params{make(map[string]string)}
+		p.vars["name"] = "nature"
+
+		c := &context{
+			app:        &app{datamapper: dm},
+			params:     p,
+			user:       &user{ID: 1, IsAuthenticated: true, IsAdmin: true},
+			datamapper: dm,
+			cache:      &fakeCache{},
+		}
+
+		req, _ := http.NewRequest("PATCH", "http://localhost/api/tags/nature", bytes.NewBufferString(tc.body))
+		res := httptest.NewRecorder()
+
+		err := editTag(c, res, req)
+		if tc.status != http.StatusOK {
+			if e, ok := err.(httpError); !ok || e.Status != tc.status {
+				t.Errorf("%s: expected %d, got %v", tc.body, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dm.saved == nil || dm.saved.Description != "Outdoors" || dm.saved.CoverPhotoID == nil || *dm.saved.CoverPhotoID != 1 {
+			t.Errorf("Tag details not saved: %+v", dm.saved)
+		}
+	}
+}
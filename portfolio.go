@@ -0,0 +1,217 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Photographers arrange some of their photos in the albums of a portfolio,
+// for a public portfolio page. The owner saves the whole portfolio at once,
+// giving the albums and their photos in order; the cover of an album is
+// the photo chosen, or else its first photo. Portfolios and albums are
+// found by ID or by slug (see slugs.go).
+
+const (
+	maxPortfolioAlbums      = 50
+	maxPortfolioAlbumPhotos = 200
+	maxPortfolioTitleLength = 100
+)
+
+// sets the cover of each album from its photos
+func setPortfolioCovers(albums []portfolioAlbum) {
+	for i := range albums {
+		album := &albums[i]
+		album.Cover = nil
+		for j := range album.Photos {
+			if album.CoverPhotoID != nil && album.Photos[j].ID == *album.CoverPhotoID {
+				album.Cover = &album.Photos[j]
+				break
+			}
+		}
+		if album.Cover == nil && len(album.Photos) > 0 {
+			album.Cover = &album.Photos[0]
+		}
+	}
+}
+
+// returns the owner of the portfolio in the URL, by ID or by slug; nil
+// after redirecting a previous slug to the named route
+func getPortfolioOwner(ctx *context, w http.ResponseWriter, r *http.Request, route string, pairs ...string) (*user, error) {
+	if ctx.params.get("slug") != "" {
+		return getSlugUser(ctx, w, r, route, pairs...)
+	}
+	return ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+}
+
+func getPortfolio(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	owner, err := getPortfolioOwner(ctx, w, r, "slugPortfolio")
+	if err != nil || owner == nil {
+		return err
+	}
+
+	userID := ctx.userID()
+	cacheKey := fmt.Sprintf("portfolio:%d:user:%d", owner.ID, userID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		albums, err := ctx.datamapper.getPortfolio(owner.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		setPortfolioCovers(albums)
+		if albums == nil {
+			albums = []portfolioAlbum{}
+		}
+		return &portfolio{UserID: owner.ID, Name: owner.Name, Slug: owner.Slug, Albums: albums}, nil
+	})
+}
+
+// returns an album of a portfolio by its ID or slug. A previous slug of the
+// album redirects to its current URL.
+func getPortfolioAlbum(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	route := "portfolioAlbum"
+	if ctx.params.get("slug") != "" {
+		route = "slugPortfolioAlbum"
+	}
+
+	ref := ctx.params.get("album")
+
+	owner, err := getPortfolioOwner(ctx, w, r, route, "album", ref)
+	if err != nil || owner == nil {
+		return err
+	}
+
+	albums, err := ctx.datamapper.getPortfolio(owner.ID, ctx.userID())
+	if err != nil {
+		return err
+	}
+	setPortfolioCovers(albums)
+
+	find := func(match func(*portfolioAlbum) bool) *portfolioAlbum {
+		for i := range albums {
+			if match(&albums[i]) {
+				return &albums[i]
+			}
+		}
+		return nil
+	}
+
+	if digitsRegex.MatchString(ref) {
+		if album := find(func(a *portfolioAlbum) bool { return fmt.Sprint(a.ID) == ref }); album != nil {
+			return renderJSON(w, album, http.StatusOK)
+		}
+		return httpError{http.StatusNotFound, "Not found"}
+	}
+
+	if album := find(func(a *portfolioAlbum) bool { return a.Slug != nil && *a.Slug == ref }); album != nil {
+		return renderJSON(w, album, http.StatusOK)
+	}
+
+	albumID, err := ctx.datamapper.getAlbumIDByPreviousSlug(owner.ID, ref)
+	if err != nil {
+		return err
+	}
+	album := find(func(a *portfolioAlbum) bool { return a.ID == albumID })
+	if album == nil {
+		return httpError{http.StatusNotFound, "Not found"}
+	}
+	current := fmt.Sprint(album.ID)
+	if album.Slug != nil {
+		current = *album.Slug
+	}
+	if route == "slugPortfolioAlbum" {
+		return redirectRoute(ctx, w, r, route, "slug", ctx.params.get("slug"), "album", current)
+	}
+	return redirectRoute(ctx, w, r, route, "id", fmt.Sprint(owner.ID), "album", current)
+}
+
+// replaces the portfolio of the user with the albums given, in order
+func arrangePortfolio(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Albums []portfolioAlbum `json:"albums"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if len(s.Albums) > maxPortfolioAlbums {
+		return httpError{http.StatusBadRequest, "Too many albums"}
+	}
+
+	errors := make(map[string]string)
+	slugs := make(map[string]bool)
+
+	for i := range s.Albums {
+		album := &s.Albums[i]
+		album.Title = strings.TrimSpace(album.Title)
+
+		if album.Slug = normalizeSlug(album.Slug); album.Slug != nil {
+			switch {
+			case !validateSlug(*album.Slug):
+				errors["slug"] = "Slug must be 3 to 40 lower case letters, digits or dashes"
+			case slugs[*album.Slug]:
+				errors["slug"] = "Slug already taken"
+			}
+			slugs[*album.Slug] = true
+		}
+
+		switch {
+		case album.Title == "":
+			errors["title"] = "Title is missing"
+		case len(album.Title) > maxPortfolioTitleLength:
+			errors["title"] = "Title is too long"
+		}
+
+		if len(album.PhotoIDs) > maxPortfolioAlbumPhotos {
+			errors["photoIds"] = "Too many photos"
+			continue
+		}
+
+		seen := make(map[int64]bool)
+		var photoIDs []int64
+		for _, id := range album.PhotoIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			photo, err := ctx.datamapper.getPhoto(id)
+			if err != nil && !isErrSqlNoRows(err) {
+				return err
+			}
+			if err != nil || photo.OwnerID != ctx.user.ID {
+				errors["photoIds"] = "Only your own photos can be in your portfolio"
+				continue
+			}
+			photoIDs = append(photoIDs, id)
+		}
+		album.PhotoIDs = photoIDs
+
+		if album.CoverPhotoID != nil && !seen[*album.CoverPhotoID] {
+			errors["coverPhotoId"] = "The cover must be one of the photos of the album"
+		}
+	}
+
+	if len(errors) > 0 {
+		return validationFailure{errors}
+	}
+
+	if err := ctx.datamapper.setPortfolio(ctx.user.ID, s.Albums); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	albums, err := ctx.datamapper.getPortfolio(ctx.user.ID, ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	setPortfolioCovers(albums)
+	return renderJSON(w, &portfolio{UserID: ctx.user.ID, Name: ctx.user.Name, Slug: ctx.user.Slug, Albums: albums}, http.StatusOK)
+}
@@ -0,0 +1,104 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPortfolio(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &user{Name: "other", Email: "other@localhost"}
+	otherToken, err := dm.login(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var photos []*photo
+	for _, p := range []*photo{
+		{Title: "heron", OwnerID: owner.ID},
+		{Title: "egret", OwnerID: owner.ID},
+		{Title: "private", OwnerID: owner.ID, Private: true},
+		{Title: "other", OwnerID: other.ID},
+	} {
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		photos = append(photos, p)
+	}
+	heron, egret, private, otherPhoto := photos[0], photos[1], photos[2], photos[3]
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	portfolioURL := fmt.Sprintf("/api/users/%d/portfolio", owner.ID)
+
+	for _, body := range []string{
+		`{"albums": [{"title": "", "photoIds": [1]}]}`,
+		fmt.Sprintf(`{"albums": [{"title": "Birds", "photoIds": [%d]}]}`, otherPhoto.ID),
+		fmt.Sprintf(`{"albums": [{"title": "Birds", "photoIds": [%d], "coverPhotoId": %d}]}`, heron.ID, egret.ID),
+	} {
+		if res := send("PUT", "/api/user/portfolio", ownerToken, body); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, res.Code)
+		}
+	}
+
+	body := fmt.Sprintf(`{"albums": [{"title": "Birds", "photoIds": [%d, %d, %d], "coverPhotoId": %d}, {"title": "Empty"}]}`,
+		private.ID, heron.ID, egret.ID, egret.ID)
+	if res := send("PUT", "/api/user/portfolio", ownerToken, body); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	get := func(token string) *portfolio {
+		res := send("GET", portfolioURL, token, "")
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+		}
+		result := &portfolio{}
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := get(otherToken)
+	if result.Name != "owner" || len(result.Albums) != 2 {
+		t.Fatalf("Unexpected portfolio %+v", result)
+	}
+	birds := result.Albums[0]
+	if birds.Title != "Birds" || len(birds.Photos) != 2 || birds.Photos[0].ID != heron.ID || birds.Photos[1].ID != egret.ID {
+		t.Errorf("Expected the public photos in order, got %+v", birds.Photos)
+	}
+	if birds.Cover == nil || birds.Cover.ID != egret.ID {
+		t.Errorf("Expected the chosen cover, got %+v", birds.Cover)
+	}
+	if empty := result.Albums[1]; empty.Title != "Empty" || empty.Cover != nil {
+		t.Errorf("Unexpected empty album %+v", empty)
+	}
+
+	if birds := get(ownerToken).Albums[0]; len(birds.Photos) != 3 || birds.Photos[0].ID != private.ID {
+		t.Errorf("Owner should see their private photo, got %+v", birds.Photos)
+	}
+
+	if res := send("GET", "/api/users/9999/portfolio", "", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing user, got %d", res.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Anonymous visitors may open ANONYMOUS_PHOTO_VIEWS photos in each window of
+// ANONYMOUS_VIEW_WINDOW seconds, counted by IP address on the server, before
+// they must log in. Opening a photo again doesn't count. Over the limit the
+// photo is refused with a 401 and the preview_limit code, for the client to
+// ask the visitor to sign up; lists and thumbnails are still shown.
+
+var errPreviewLimit = codedError{
+	httpError{http.StatusUnauthorized, "Log in or sign up to see more photos"},
+	"preview_limit",
+}
+
+// counts the photos opened by each anonymous visitor in the fixed windows of
+// a rateLimiter, each photo once
+type previewTracker struct {
+	*rateLimiter
+}
+
+func newPreviewTracker(cfg *config) *previewTracker {
+	if cfg.AnonymousPhotoViews == 0 {
+		return nil
+	}
+	return &previewTracker{newRateLimiter(time.Duration(cfg.AnonymousViewWindow) * time.Second)}
+}
+
+// counts the photo as opened by the visitor, returning false if the visitor
+// has opened as many other photos as allowed in the window
+func (t *previewTracker) view(key string, photoID int64, limit int, now time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	w := t.current(key, now)
+	if w.ids[photoID] {
+		return true
+	}
+	if w.count >= limit {
+		return false
+	}
+	if w.ids == nil {
+		w.ids = make(map[int64]bool)
+	}
+	w.ids[photoID] = true
+	w.count++
+	return true
+}
+
+// refuses the photo to anonymous visitors over their preview limit
+func checkPreviewLimit(ctx *context, photoID int64) error {
+	if ctx.previews == nil || ctx.user.IsAuthenticated {
+		return nil
+	}
+	key := fmt.Sprintf("%d:%s", ctx.site.ID, ctx.remoteIP)
+	if !ctx.previews.view(key, photoID, ctx.cfg.AnonymousPhotoViews, time.Now()) {
+		return errPreviewLimit
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreviewTracker(t *testing.T) {
+	tracker := newPreviewTracker(&config{AnonymousPhotoViews: 2, AnonymousViewWindow: 60})
+	now := time.Now()
+
+	for _, photoID := range []int64{1, 2, 1} {
+		if !tracker.view("1:10.0.0.1", photoID, 2, now) {
+			t.Errorf("Expected photo %d to be shown", photoID)
+		}
+	}
+	if tracker.view("1:10.0.0.1", 3, 2, now) {
+		t.Error("Expected a third photo to be refused")
+	}
+	if !tracker.view("1:10.0.0.2", 3, 2, now) {
+		t.Error("Expected other visitors to be counted apart")
+	}
+	if !tracker.view("1:10.0.0.1", 3, 2, now.Add(time.Minute)) {
+		t.Error("Expected the count to reset with the window")
+	}
+}
+
+type previewDataMapper struct {
+	mockDataMapper
+}
+
+func (m *previewDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+	return &photoDetail{photo: photo{ID: photoID, Title: "test"}}, nil
+}
+
+func TestPreviewLimit(t *testing.T) {
+	cfg := &config{AnonymousPhotoViews: 1, AnonymousViewWindow: 60}
+	dm := &previewDataMapper{}
+	a := &app{cfg: cfg, datamapper: dm, previews: newPreviewTracker(cfg)}
+
+	view := func(photoID string, u *user) error {
+		p := &params{map[string]string{"id": photoID}}
+		c := &context{app: a, params: p, user: u, remoteIP: "10.0.0.1", site: &site{ID: 1}, datamapper: dm}
+		req, _ := http.NewRequest("GET", "http://localhost/api/photos/"+photoID, nil)
+		return getPhotoDetail(c, httptest.NewRecorder(), req)
+	}
+
+	if err := view("1", &user{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := view("2", &user{ID: 1, IsAuthenticated: true}); err != nil {
+		t.Errorf("Expected users logged in not to be limited, got %v", err)
+	}
+
+	err := view("2", &user{})
+	if err != errPreviewLimit {
+		t.Fatalf("Expected the preview limit, got %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/photos/2", nil)
+	res := httptest.NewRecorder()
+	handleError(res, req, err, &translator{catalogs: make(map[string]catalog)})
+	result := make(map[string]string)
+	if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusUnauthorized || result["code"] != "preview_limit" {
+		t.Errorf("Expected a 401 with the preview_limit code, got %d %s", res.Code, res.Body)
+	}
+}
@@ -0,0 +1,260 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/disintegration/gift"
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// For photographers selling prints, the detail of a photo suggests the
+// print sizes its resolution is good for. With PUBLIC_MAX_SIZE set, users
+// other than the owner only get renditions up to that size, from /uploads/
+// and IIIF, and the owner, or a buyer (see checkout.go), downloads the
+// original from /api/photos/{id}/original.
+
+const publicJPEGQuality = 90
+
+// print quality by the least dots per inch, best first
+var printQualities = []struct {
+	name string
+	dpi  int
+}{
+	{"excellent", 300},
+	{"good", 200},
+	{"fair", 150},
+}
+
+// common print sizes in inches, short side first
+var commonPrintSizes = [][2]float64{
+	{4, 6}, {5, 7}, {8, 10}, {8.5, 11}, {11, 14}, {12, 18}, {16, 20}, {20, 30}, {24, 36}, {30, 40},
+}
+
+type printSize struct {
+	Name    string  `json:"name"`
+	Width   float64 `json:"width"`  // inches
+	Height  float64 `json:"height"` // inches
+	DPI     int     `json:"dpi"`
+	Quality string  `json:"quality"`
+}
+
+func printQuality(dpi int) string {
+	for _, q := range printQualities {
+		if dpi >= q.dpi {
+			return q.name
+		}
+	}
+	return ""
+}
+
+// returns the resolution of the image in dots per inch from its EXIF data,
+// or 0 if it has none
+func readDPI(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 0
+	}
+	tag, err := x.Get(exif.XResolution)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || num <= 0 || den <= 0 {
+		return 0
+	}
+	dpi := float64(num) / float64(den)
+	// 3 is centimeters, otherwise inches
+	if tag, err := x.Get(exif.ResolutionUnit); err == nil {
+		if unit, err := tag.Int(0); err == nil && unit == 3 {
+			dpi *= 2.54
+		}
+	}
+	return int(math.Round(dpi))
+}
+
+// returns the sizes the photo prints well at, largest first, in the
+// orientation of the photo: its own size at the DPI of the file, if any,
+// then the common sizes it fills at no less than fair quality, cropped to
+// the aspect ratio of the print
+func (p *photo) printSizes() []printSize {
+
+	if p.Width <= 0 || p.Height <= 0 {
+		return nil
+	}
+
+	long, short := float64(p.Width), float64(p.Height)
+	landscape := p.Width > p.Height
+	if !landscape {
+		long, short = short, long
+	}
+
+	newSize := func(name string, longSide, shortSide float64, dpi int) printSize {
+		s := printSize{Name: name, Width: shortSide, Height: longSide, DPI: dpi, Quality: printQuality(dpi)}
+		if landscape {
+			s.Width, s.Height = s.Height, s.Width
+		}
+		return s
+	}
+
+	var sizes []printSize
+
+	if p.DPI > 0 && printQuality(p.DPI) != "" {
+		round := func(inches float64) float64 { return math.Round(inches*10) / 10 }
+		sizes = append(sizes, newSize("original", round(long/float64(p.DPI)), round(short/float64(p.DPI)), p.DPI))
+	}
+
+	for i := len(commonPrintSizes) - 1; i >= 0; i-- {
+		shortSide, longSide := commonPrintSizes[i][0], commonPrintSizes[i][1]
+		dpi := int(math.Min(long/longSide, short/shortSide))
+		if printQuality(dpi) == "" {
+			continue
+		}
+		name := fmt.Sprintf("%gx%g", shortSide, longSide)
+		if landscape {
+			name = fmt.Sprintf("%gx%g", longSide, shortSide)
+		}
+		sizes = append(sizes, newSize(name, longSide, shortSide, dpi))
+	}
+	return sizes
+}
+
+// returns the largest width or height of the photo served to the user, or
+// 0 if there is no limit
+func publicMaxSize(ctx *context, p *photo) int {
+	if p.OwnerID == ctx.user.ID {
+		return 0
+	}
+	return ctx.cfg.PublicMaxSize
+}
+
+// returns the bounds scaled down to fit max pixels wide and high
+func fitBounds(bounds image.Rectangle, max int) image.Rectangle {
+	if bounds.Dx() <= max && bounds.Dy() <= max {
+		return bounds
+	}
+	return gift.New(gift.ResizeToFit(max, max, gift.LanczosResampling)).Bounds(bounds)
+}
+
+// returns the image scaled down to fit max pixels wide and high
+func fitImage(src image.Image, max int) image.Image {
+	bounds := fitBounds(src.Bounds(), max)
+	if bounds == src.Bounds() {
+		return src
+	}
+	g := gift.New(gift.ResizeToFit(max, max, gift.LanczosResampling))
+	dst := image.NewRGBA(bounds)
+	g.Draw(dst, src)
+	return dst
+}
+
+// encodes a public rendition in the format of the original, as decoded by
+// image.Decode, returning its content type
+func encodePublicImage(w io.Writer, img image.Image, format string) (string, error) {
+	switch format {
+	case "png":
+		return "image/png", png.Encode(w, img)
+	case "gif":
+		return "image/gif", gif.Encode(w, img, nil)
+	}
+	return "image/jpeg", jpeg.Encode(w, img, &jpeg.Options{Quality: publicJPEGQuality})
+}
+
+// copies the photo to the writer, scaled down unless the user may have the
+// original
+func copyPublicImage(ctx *context, w io.Writer, p *photo, src readable) error {
+	max := publicMaxSize(ctx, p)
+	if max == 0 {
+		_, err := io.Copy(w, src)
+		return err
+	}
+	img, format, err := decodeImage(ctx.cfg, src)
+	if err != nil {
+		return err
+	}
+	_, err = encodePublicImage(w, fitImage(img, max), format)
+	return err
+}
+
+// sends the uploaded file of the photo to its owner, or to a user who
+// bought it
+func getOriginal(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	allowed := photo.OwnerID == ctx.user.ID
+	if !allowed {
+		if allowed, err = ctx.datamapper.hasPurchased(photo.ID, ctx.user.ID); err != nil {
+			return err
+		}
+	}
+	if err := ctx.permit(allowed, "Only the owner or a buyer can download the original"); err != nil {
+		return err
+	}
+
+	file, err := ctx.filestore.open(photo.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// served in ranges, so that downloads can be resumed; uploads are never
+	// changed, so their filename is their ETag for If-Range
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(photo.Filename)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, downloadFilename(photo)))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("ETag", `"`+photo.Filename+`"`)
+	http.ServeContent(w, r, photo.Filename, photo.CreatedAt, file)
+	return nil
+}
+
+// serves uploaded files, scaled down to PUBLIC_MAX_SIZE, in place of the
+// originals; registered when it is set. Renditions in the formats of
+// IMAGE_FORMATS are kept, as they are slower to encode (see variants.go).
+func getPublicUpload(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.cfg.ImageFormats != "" {
+		w.Header().Add("Vary", "Accept")
+	}
+	if name := uploadFormat(ctx.cfg, r, ctx.params.get("filename")); name != "" {
+		variantPath, err := uploadVariant(ctx, ctx.params.get("filename"), ctx.cfg.PublicMaxSize, name)
+		if err != nil {
+			return err
+		}
+		serveVariant(w, r, variantPath, name)
+		return nil
+	}
+
+	file, err := ctx.filestore.open(ctx.params.get("filename"))
+	if err != nil {
+		return httpError{http.StatusNotFound, "Not found"}
+	}
+	defer file.Close()
+
+	src, format, err := decodeImage(ctx.cfg, file)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	contentType, err := encodePublicImage(buf, fitImage(src, ctx.cfg.PublicMaxSize), format)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	return nil
+}
@@ -0,0 +1,175 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrintSizes(t *testing.T) {
+
+	if sizes := (&photo{}).printSizes(); sizes != nil {
+		t.Errorf("Photo without dimensions should have no print sizes, got %v", sizes)
+	}
+
+	sizes := (&photo{Width: 6000, Height: 4000, DPI: 300}).printSizes()
+	if len(sizes) == 0 {
+		t.Fatal("Expected print sizes")
+	}
+	if s := sizes[0]; s.Name != "original" || s.Width != 20 || s.Height != 13.3 || s.Quality != "excellent" {
+		t.Errorf("Unexpected original size %+v", s)
+	}
+
+	found := make(map[string]printSize)
+	for _, s := range sizes {
+		found[s.Name] = s
+	}
+	if s := found["30x20"]; s.Width != 30 || s.Height != 20 || s.DPI != 200 || s.Quality != "good" {
+		t.Errorf("Unexpected 30x20 size %+v", s)
+	}
+	if s, ok := found["40x30"]; ok {
+		t.Errorf("Size below fair quality should be left out, got %+v", s)
+	}
+
+	// largest first, in the orientation of the photo
+	sizes = (&photo{Width: 4000, Height: 6000}).printSizes()
+	if s := sizes[0]; s.Name != "24x36" || s.Width != 24 || s.Height != 36 || s.Quality != "fair" {
+		t.Errorf("Portrait photo should have portrait sizes, got %+v", s)
+	}
+}
+
+func TestPublicMaxSize(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.PublicMaxSize = 100
+	app.initRouter()
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &user{Name: "other", Email: "other@localhost"}
+	otherToken, err := dm.login(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "test", Filename: "test.png", OwnerID: owner.ID}
+	if err := app.filestore.store(bytes.NewReader(buf.Bytes()), p.Filename, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, tc := range []struct {
+		path, token   string
+		width, height int
+	}{
+		{"/uploads/test.png", "", 100, 50},
+		{fmt.Sprintf("/iiif/%d/full/max/0/default.png", p.ID), otherToken, 100, 50},
+		{fmt.Sprintf("/iiif/%d/full/max/0/default.png", p.ID), ownerToken, 400, 200},
+		{fmt.Sprintf("/api/photos/%d/original", p.ID), ownerToken, 400, 200},
+	} {
+		res := get(tc.path, tc.token)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", tc.path, res.Code)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(res.Body)
+		if err != nil || cfg.Width != tc.width || cfg.Height != tc.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d (%v)", tc.path, tc.width, tc.height, cfg.Width, cfg.Height, err)
+		}
+	}
+
+	if res := get(fmt.Sprintf("/api/photos/%d/original", p.ID), otherToken); res.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for the original of another user's photo, got %d", res.Code)
+	}
+}
+
+func TestOriginalRanges(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.initRouter()
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "test", Filename: "test.png", OwnerID: owner.ID}
+	if err := app.filestore.store(bytes.NewReader(buf.Bytes()), p.Filename, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, header map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost/api/photos/%d/original", p.ID), nil)
+		req.Header.Set(tokenHeader, token)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := request("GET", map[string]string{"Range": "bytes=10-19"})
+	if res.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206, got %d", res.Code)
+	}
+	if contentRange := res.Header().Get("Content-Range"); contentRange != fmt.Sprintf("bytes 10-19/%d", buf.Len()) {
+		t.Errorf("Unexpected Content-Range %q", contentRange)
+	}
+	if !bytes.Equal(res.Body.Bytes(), buf.Bytes()[10:20]) {
+		t.Errorf("Expected bytes 10 to 19 of the original, got %v", res.Body.Bytes())
+	}
+
+	// resumed against a changed file
+	res = request("GET", map[string]string{"Range": "bytes=10-19", "If-Range": `"other.png"`})
+	if res.Code != http.StatusOK || res.Body.Len() != buf.Len() {
+		t.Errorf("Expected the whole original for a stale If-Range, got %d with %d bytes", res.Code, res.Body.Len())
+	}
+
+	res = request("GET", map[string]string{"Range": "bytes=10-19", "If-Range": `"test.png"`})
+	if res.Code != http.StatusPartialContent {
+		t.Errorf("Expected 206 for a matching If-Range, got %d", res.Code)
+	}
+
+	res = request("HEAD", nil)
+	if res.Code != http.StatusOK || res.Header().Get("Accept-Ranges") != "bytes" || res.Header().Get("Content-Length") != fmt.Sprint(buf.Len()) {
+		t.Errorf("Expected the length and Accept-Ranges for HEAD, got %d %v", res.Code, res.Header())
+	}
+
+	if res := request("GET", map[string]string{"Range": fmt.Sprintf("bytes=%d-", buf.Len()+10)}); res.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 for a range past the end, got %d", res.Code)
+	}
+}
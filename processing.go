@@ -0,0 +1,343 @@
+package photoshare
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Decoding and thumbnailing uploads takes a lot of CPU and memory, so they
+// are processed by a bounded pool of PROCESSING_WORKERS rather than in each
+// request. Jobs wait in a queue of at most PROCESSING_QUEUE_SIZE, beyond
+// which uploads get a 503, and each user has at most PROCESSING_USER_LIMIT
+// jobs running at once, so that a burst from one user doesn't hold up
+// everyone else. Uploads of ASYNC_UPLOAD_SIZE bytes or more, and bulk
+// uploads, are answered with 202 Accepted and the job, and the client polls
+// its status at /api/uploads/ID/status; smaller uploads wait for their job.
+//
+// Jobs also wait until the memory taken to decode their images fits in
+// PROCESSING_MEMORY alongside the running jobs, and fail if they take more
+// than PROCESSING_TIMEOUT seconds. Go cannot stop a decode once started, so
+// a job out of time stops at its next stage, before anything is saved, and
+// keeps its worker and memory until then.
+
+const (
+	jobQueued     = "queued"
+	jobProcessing = "processing"
+	jobDone       = "done"
+	jobFailed     = "failed"
+
+	// how long the status of finished jobs is kept
+	jobRetention = time.Hour
+)
+
+var errProcessingTimeout = httpError{http.StatusUnprocessableEntity, "Processing the photo took too long"}
+
+type processingJob struct {
+	ID         string
+	Status     string
+	ownerID    int64
+	cost       int64 // bytes of memory
+	progress   *uploadProgress
+	run        func(*processingJob) ([]*photo, error)
+	photos     []*photo
+	err        error
+	finishedAt time.Time
+	timedOut   int32 // set atomically
+	done       chan struct{}
+}
+
+// the errors of the files of a bulk upload that failed, by filename
+type uploadFailures map[string]error
+
+func (f uploadFailures) Error() string {
+	return "Some files could not be uploaded"
+}
+
+// the status of a job for its owner
+type uploadStatus struct {
+	ID       string            `json:"id"`
+	Status   string            `json:"status"`
+	PhotoIDs []int64           `json:"photoIDs"`
+	Error    string            `json:"error,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"` // by field, or by file of bulk uploads
+}
+
+// returns the message of an error failing an upload, for its owner, and the
+// messages of the fields or files at fault, if any. Errors other than those
+// of the request are not disclosed.
+func uploadErrorMessages(err error) (string, map[string]string) {
+	switch err := err.(type) {
+	case httpError:
+		return err.Description, nil
+	case validationFailure:
+		return "Invalid photo", err.Errors
+	case uploadFailures:
+		errors := make(map[string]string)
+		for filename, err := range err {
+			errors[filename], _ = uploadErrorMessages(err)
+		}
+		return err.Error(), errors
+	}
+	return "Upload failed", nil
+}
+
+type processingPool struct {
+	sync.Mutex
+	cond       *sync.Cond
+	queue      []*processingJob
+	jobs       map[string]*processingJob
+	running    map[int64]int // jobs running by owner
+	maxQueue   int
+	userLimit  int
+	memory     int64 // bytes, 0 for no limit
+	memoryUsed int64
+	timeout    time.Duration
+}
+
+func newProcessingPool(cfg *config) *processingPool {
+	p := &processingPool{
+		jobs:      make(map[string]*processingJob),
+		running:   make(map[int64]int),
+		maxQueue:  cfg.ProcessingQueueSize,
+		userLimit: cfg.ProcessingUserLimit,
+		memory:    cfg.ProcessingMemory,
+		timeout:   time.Duration(cfg.ProcessingTimeout) * time.Second,
+	}
+	p.cond = sync.NewCond(p)
+
+	workers := cfg.ProcessingWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// queues the job, of its owner, memory cost, progress and run, returning
+// it to wait for or to poll. A nil pool runs the job at once.
+func (p *processingPool) submit(job *processingJob) (*processingJob, error) {
+	job.ID = uniuri.New()
+	job.Status = jobQueued
+	job.done = make(chan struct{})
+	if p == nil {
+		job.finish(job.run(job))
+		return job, nil
+	}
+
+	if p.memory > 0 && job.cost > p.memory {
+		return nil, httpError{http.StatusRequestEntityTooLarge, "Image is too large to process"}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	now := utcNow()
+	for id, j := range p.jobs {
+		if !j.finishedAt.IsZero() && now.Sub(j.finishedAt) > jobRetention {
+			delete(p.jobs, id)
+		}
+	}
+
+	if len(p.queue) >= p.maxQueue {
+		return nil, httpError{http.StatusServiceUnavailable, "Too many uploads are being processed, please try again later"}
+	}
+	p.queue = append(p.queue, job)
+	p.jobs[job.ID] = job
+	p.cond.Signal()
+	return job, nil
+}
+
+// runs the job in the pool, returning its first photo
+func (p *processingPool) run(job *processingJob) (*photo, error) {
+	job, err := p.submit(job)
+	if err != nil {
+		return nil, err
+	}
+	<-job.done
+	return job.photo(), job.err
+}
+
+// returns a copy of the job of the owner, false if there is none
+func (p *processingPool) status(id string, ownerID int64) (processingJob, bool) {
+	if p == nil {
+		return processingJob{}, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	job, ok := p.jobs[id]
+	if !ok || job.ownerID != ownerID {
+		return processingJob{}, false
+	}
+	return *job, true
+}
+
+// returns the first queued job whose owner is below their limit, taking it
+// off the queue. Jobs behind one waiting for memory wait too, so that large
+// images are not held up forever by smaller ones.
+func (p *processingPool) next() *processingJob {
+	for i, job := range p.queue {
+		if p.running[job.ownerID] >= p.userLimit {
+			continue
+		}
+		if p.memory > 0 && p.memoryUsed > 0 && p.memoryUsed+job.cost > p.memory {
+			return nil
+		}
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		return job
+	}
+	return nil
+}
+
+func (p *processingPool) work() {
+	type result struct {
+		photos []*photo
+		err    error
+	}
+
+	for {
+		p.Lock()
+		job := p.next()
+		for job == nil {
+			p.cond.Wait()
+			job = p.next()
+		}
+		p.running[job.ownerID]++
+		p.memoryUsed += job.cost
+		job.Status = jobProcessing
+		jobTimeout := p.timeout
+		p.Unlock()
+
+		results := make(chan result, 1)
+		go func() {
+			photos, err := job.runSafely()
+			results <- result{photos, err}
+		}()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if jobTimeout > 0 {
+			timer = time.NewTimer(jobTimeout)
+			timeout = timer.C
+		}
+
+		var r result
+		select {
+		case r = <-results:
+		case <-timeout:
+			atomic.StoreInt32(&job.timedOut, 1)
+			p.Lock()
+			job.finish(nil, errProcessingTimeout)
+			p.Unlock()
+			r = <-results
+			if len(r.photos) > 0 {
+				logError(fmt.Errorf("processing job %s finished after its timeout", job.ID))
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		p.Lock()
+		if p.running[job.ownerID]--; p.running[job.ownerID] == 0 {
+			delete(p.running, job.ownerID)
+		}
+		p.memoryUsed -= job.cost
+		if atomic.LoadInt32(&job.timedOut) == 0 {
+			job.finish(r.photos, r.err)
+		} else if len(r.photos) > 0 {
+			// saved after all, past its last stage
+			job.photos, job.err, job.Status = r.photos, nil, jobDone
+		}
+		// other jobs may be able to run now
+		p.cond.Broadcast()
+		p.Unlock()
+	}
+}
+
+// runs the job, failing it if it panics so that the worker carries on
+func (job *processingJob) runSafely() (photos []*photo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("processing job %s: %v", job.ID, r)
+			logError(err)
+		}
+	}()
+	return job.run(job)
+}
+
+// reports the start of a stage of the job, returning an error if it has run
+// out of time, so that it stops before saving anything
+func (job *processingJob) stage(stage string) error {
+	if err := job.expired(); err != nil {
+		return err
+	}
+	job.progress.stage(stage)
+	return nil
+}
+
+// returns an error if the job has run out of time
+func (job *processingJob) expired() error {
+	if atomic.LoadInt32(&job.timedOut) == 1 {
+		return errProcessingTimeout
+	}
+	return nil
+}
+
+// jobs saving some photos are done, even if other files of a bulk upload
+// failed
+func (job *processingJob) finish(photos []*photo, err error) {
+	if len(photos) == 0 && err == nil {
+		err = errors.New("no photos saved")
+	}
+	job.photos, job.err = photos, err
+	job.finishedAt = utcNow()
+	if len(photos) == 0 {
+		job.Status = jobFailed
+	} else {
+		job.Status = jobDone
+	}
+	close(job.done)
+}
+
+// returns the first photo saved by the job, nil if it failed
+func (job *processingJob) photo() *photo {
+	if len(job.photos) == 0 {
+		return nil
+	}
+	return job.photos[0]
+}
+
+// returns the status of the job, with its errors in the language
+func (job *processingJob) status(t *translator, lang string) *uploadStatus {
+	status := &uploadStatus{ID: job.ID, Status: job.Status, PhotoIDs: []int64{}}
+	for _, photo := range job.photos {
+		status.PhotoIDs = append(status.PhotoIDs, photo.ID)
+	}
+	if job.err != nil {
+		msg, errors := uploadErrorMessages(job.err)
+		status.Error = t.translate(lang, msg)
+		for key, msg := range errors {
+			if status.Errors == nil {
+				status.Errors = make(map[string]string)
+			}
+			status.Errors[key] = t.translate(lang, msg)
+		}
+	}
+	return status
+}
+
+func getUploadStatus(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	job, ok := ctx.processing.status(ctx.params.get("id"), ctx.user.ID)
+	if !ok {
+		return httpError{http.StatusNotFound, "Not found"}
+	}
+	return renderJSON(w, job.status(ctx.translator, ctx.translator.negotiate(r)), http.StatusOK)
+}
@@ -0,0 +1,265 @@
+package photoshare
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessingPoolUserLimit(t *testing.T) {
+
+	p := newProcessingPool(&config{ProcessingWorkers: 4, ProcessingQueueSize: 10, ProcessingUserLimit: 1})
+
+	var (
+		mu                  sync.Mutex
+		running, mostAtOnce int
+	)
+	release := make(chan struct{})
+	started := make(chan int64, 10)
+
+	job := func(ownerID int64) func(*processingJob) ([]*photo, error) {
+		return func(*processingJob) ([]*photo, error) {
+			mu.Lock()
+			if ownerID == 1 {
+				if running++; running > mostAtOnce {
+					mostAtOnce = running
+				}
+			}
+			mu.Unlock()
+			started <- ownerID
+
+			if ownerID == 1 {
+				<-release
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}
+			return []*photo{{ID: ownerID}}, nil
+		}
+	}
+
+	var jobs []*processingJob
+	for _, ownerID := range []int64{1, 1, 1, 2} {
+		j, err := p.submit(&processingJob{ownerID: ownerID, run: job(ownerID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+
+	// the other user's job runs while the first user's wait
+	startedBy := make(map[int64]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case ownerID := <-started:
+			startedBy[ownerID] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Expected two jobs to start, got %v", startedBy)
+		}
+	}
+	if !startedBy[1] || !startedBy[2] {
+		t.Errorf("Expected a job of each user to start, got %v", startedBy)
+	}
+	if status, _ := p.status(jobs[1].ID, 1); status.Status != jobQueued {
+		t.Errorf("Expected the second job of the user to be queued, got %s", status.Status)
+	}
+	if _, ok := p.status(jobs[1].ID, 2); ok {
+		t.Error("Jobs should only be shown to their owner")
+	}
+
+	close(release)
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+		case <-time.After(time.Second):
+			t.Fatal("Expected every job to finish")
+		}
+	}
+	if mostAtOnce != 1 {
+		t.Errorf("Expected one job of the user at once, got %d", mostAtOnce)
+	}
+	if status, _ := p.status(jobs[2].ID, 1); status.Status != jobDone || status.photo().ID != 1 {
+		t.Errorf("Expected the job to be done with its photo, got %+v", status)
+	}
+}
+
+func TestProcessingPoolQueueFull(t *testing.T) {
+
+	p := newProcessingPool(&config{ProcessingWorkers: 1, ProcessingQueueSize: 1, ProcessingUserLimit: 1})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if _, err := p.submit(&processingJob{ownerID: 1, run: func(*processingJob) ([]*photo, error) {
+		close(started)
+		<-release
+		return []*photo{{}}, nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	defer close(release)
+
+	done := func(*processingJob) ([]*photo, error) { return []*photo{{}}, nil }
+	if _, err := p.submit(&processingJob{ownerID: 2, run: done}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := p.submit(&processingJob{ownerID: 3, run: done})
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with a full queue, got %v", err)
+	}
+}
+
+func TestAsyncUpload(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.AsyncUploadSize = 100
+	app.processing = newProcessingPool(&config{ProcessingWorkers: 1, ProcessingQueueSize: 10, ProcessingUserLimit: 1})
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := dm.login(&user{Name: "other", Email: "other@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(size int) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("title", "test")
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="photo"; filename="test.png"`)
+		h.Set("Content-Type", "image/png")
+		part, _ := form.CreatePart(h)
+		part.Write(bytes.Repeat([]byte("x"), size))
+		form.Close()
+
+		req, _ := http.NewRequest("POST", "http://localhost/api/photos/", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := upload(10); res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for a small upload, got %d: %s", res.Code, res.Body.String())
+	}
+
+	res := upload(1000)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 for a large upload, got %d: %s", res.Code, res.Body.String())
+	}
+	job := &uploadStatus{}
+	parseJSONBody(res, job)
+	location := res.Header().Get("Location")
+	if job.ID == "" || location != "/api/uploads/"+job.ID+"/status" {
+		t.Fatalf("Expected the job and its status URL, got %+v at %q", job, location)
+	}
+
+	for i := 0; job.Status != jobDone; i++ {
+		if i == 100 || job.Status == jobFailed {
+			t.Fatalf("Expected the upload to be processed, got %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		res := get(location, token)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", res.Code)
+		}
+		parseJSONBody(res, job)
+	}
+	if len(job.PhotoIDs) != 1 {
+		t.Fatalf("Expected the photo of the upload, got %v", job.PhotoIDs)
+	}
+	if p, err := dm.getPhoto(job.PhotoIDs[0]); err != nil || p.Title != "test" {
+		t.Errorf("Expected the photo to be created, got %v", err)
+	}
+
+	if res := get(location, otherToken); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the job of another user, got %d", res.Code)
+	}
+}
+
+func TestBulkUpload(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.processing = newProcessingPool(&config{ProcessingWorkers: 1, ProcessingQueueSize: 10, ProcessingUserLimit: 1})
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type file struct{ name, contentType string }
+
+	upload := func(files []file) *uploadStatus {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("taglist", "bulk")
+		for _, f := range files {
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", `form-data; name="photo"; filename="`+f.name+`"`)
+			h.Set("Content-Type", f.contentType)
+			part, _ := form.CreatePart(h)
+			part.Write([]byte("not really an image"))
+		}
+		form.Close()
+
+		req, _ := http.NewRequest("POST", "http://localhost/api/uploads/", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d: %s", res.Code, res.Body.String())
+		}
+
+		status := &uploadStatus{}
+		parseJSONBody(res, status)
+		for i := 0; status.Status == jobQueued || status.Status == jobProcessing; i++ {
+			if i == 100 {
+				t.Fatalf("Expected the upload to be processed, got %+v", status)
+			}
+			time.Sleep(10 * time.Millisecond)
+			req, _ := http.NewRequest("GET", "http://localhost"+res.Header().Get("Location"), nil)
+			req.Header.Set(tokenHeader, token)
+			req.Header.Set("Accept-Language", "fr")
+			status = &uploadStatus{}
+			res := httptest.NewRecorder()
+			app.router.ServeHTTP(res, req)
+			parseJSONBody(res, status)
+		}
+		return status
+	}
+
+	status := upload([]file{{"beach.png", "image/png"}, {"notes.txt", "text/plain"}, {"sunset.jpg", "image/jpeg"}})
+	if status.Status != jobDone || len(status.PhotoIDs) != 2 {
+		t.Fatalf("Expected two photos, got %+v", status)
+	}
+	if p, err := dm.getPhoto(status.PhotoIDs[0]); err != nil || p.Title != "beach" {
+		t.Errorf("Expected the photo to be titled from its filename, got %+v (%v)", p, err)
+	}
+	if len(status.Errors) != 1 || status.Errors["notes.txt"] != "Seuls les fichiers JPEG ou PNG sont autorisés" {
+		t.Errorf("Expected the translated error of the text file, got %v", status.Errors)
+	}
+
+	status = upload([]file{{"notes.txt", "text/plain"}})
+	if status.Status != jobFailed || len(status.PhotoIDs) != 0 || status.Error == "" || len(status.Errors) != 1 {
+		t.Errorf("Expected the upload to fail with the error of the file, got %+v", status)
+	}
+}
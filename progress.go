@@ -0,0 +1,111 @@
+package photoshare
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// Clients show progress bars for uploads by sending an X-Upload-ID header of
+// their choosing with each upload. Messages of type "upload_progress" with
+// that id are then sent to the user over /api/messages: as the body is
+// received, a percent at a time, as the photo is processed and stored, and
+// finally done, with the photo ID, or failed, with the error.
+
+const (
+	uploadIDHeader = "X-Upload-ID"
+
+	// bytes between progress messages of bodies without a Content-Length
+	uploadProgressStep = 1 << 20
+
+	uploadReceiving  = "receiving"
+	uploadProcessing = "processing"
+	uploadStoring    = "storing"
+	uploadDone       = "done"
+	uploadFailed     = "failed"
+)
+
+var uploadIDRegex = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+type uploadProgressMessage struct {
+	Receiver string `json:"receiver"`
+	Type     string `json:"type"`
+	UploadID string `json:"uploadID"`
+	Stage    string `json:"stage"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Total    int64  `json:"total,omitempty"` // 0 if unknown
+	PhotoID  int64  `json:"photoID,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sends the progress of an upload to its owner; nil if the client didn't
+// ask for it, so that its methods do nothing
+type uploadProgress struct {
+	siteID             int64
+	receiver, uploadID string
+}
+
+func newUploadProgress(ctx *context, r *http.Request) (*uploadProgress, error) {
+	uploadID := r.Header.Get(uploadIDHeader)
+	if uploadID == "" {
+		return nil, nil
+	}
+	if !uploadIDRegex.MatchString(uploadID) {
+		return nil, httpError{http.StatusBadRequest, "Invalid upload ID"}
+	}
+	return &uploadProgress{ctx.site.ID, ctx.user.Name, uploadID}, nil
+}
+
+func (p *uploadProgress) send(msg *uploadProgressMessage) {
+	if p == nil {
+		return
+	}
+	msg.Receiver = p.receiver
+	msg.Type = "upload_progress"
+	msg.UploadID = p.uploadID
+	sendMessage(p.siteID, msg)
+}
+
+// reports the start of a stage of processing
+func (p *uploadProgress) stage(stage string) {
+	p.send(&uploadProgressMessage{Stage: stage})
+}
+
+// reports the photo created by the upload, or the error that failed it
+func (p *uploadProgress) finish(photo *photo, err error) {
+	if err == nil {
+		p.send(&uploadProgressMessage{Stage: uploadDone, PhotoID: photo.ID})
+		return
+	}
+	msg, _ := uploadErrorMessages(err)
+	p.send(&uploadProgressMessage{Stage: uploadFailed, Error: msg})
+}
+
+// returns the body, reporting its bytes as they are read
+func (p *uploadProgress) reader(body io.ReadCloser, total int64) io.ReadCloser {
+	if p == nil {
+		return body
+	}
+	step := int64(uploadProgressStep)
+	if total > 0 {
+		step = total / 100
+	}
+	return &progressReader{ReadCloser: body, progress: p, total: total, step: step}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress       *uploadProgress
+	read, reported int64
+	total, step    int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	if r.read > r.reported && (r.read-r.reported >= r.step || err == io.EOF) {
+		r.reported = r.read
+		r.progress.send(&uploadProgressMessage{Stage: uploadReceiving, Bytes: r.read, Total: r.total})
+	}
+	return n, err
+}
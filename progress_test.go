@@ -0,0 +1,110 @@
+package photoshare
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// returns the progress messages of the upload until it is done or failed
+func readUploadProgress(t *testing.T, messages <-chan interface{}, uploadID string) []*uploadProgressMessage {
+	var progress []*uploadProgressMessage
+	for {
+		select {
+		case msg := <-messages:
+			if msg, ok := msg.(*siteMessage).body.(*uploadProgressMessage); ok && msg.UploadID == uploadID {
+				progress = append(progress, msg)
+				if msg.Stage == uploadDone || msg.Stage == uploadFailed {
+					return progress
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Upload %s not finished, got %d messages", uploadID, len(progress))
+		}
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "owner", Email: "owner@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, unsubscribe := pub.SubChannel(nil)
+	defer unsubscribe()
+
+	upload := func(uploadID string, withPhoto bool) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("title", "test")
+		if withPhoto {
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", `form-data; name="photo"; filename="test.png"`)
+			h.Set("Content-Type", "image/png")
+			part, _ := form.CreatePart(h)
+			part.Write(bytes.Repeat([]byte("x"), 200000))
+		}
+		form.Close()
+
+		req, _ := http.NewRequest("POST", "http://localhost/api/photos/", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set(tokenHeader, token)
+		req.Header.Set(uploadIDHeader, uploadID)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := upload("first", true)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	value := &photo{}
+	parseJSONBody(res, value)
+
+	progress := readUploadProgress(t, messages, "first")
+	var received int64
+	var stages []string
+	for _, msg := range progress {
+		if msg.Receiver != "owner" || msg.Type != "upload_progress" {
+			t.Errorf("Expected progress for the owner, got %+v", msg)
+		}
+		if msg.Stage != uploadReceiving {
+			stages = append(stages, msg.Stage)
+			continue
+		}
+		if msg.Bytes <= received || msg.Total == 0 {
+			t.Errorf("Expected more of the total received, got %+v after %d", msg, received)
+		}
+		received = msg.Bytes
+	}
+	if len(progress)-len(stages) < 10 || received != progress[0].Total {
+		t.Errorf("Expected progress in chunks up to the total, got %d messages up to %d", len(progress)-len(stages), received)
+	}
+	if len(stages) != 3 || stages[0] != uploadProcessing || stages[1] != uploadStoring || stages[2] != uploadDone {
+		t.Errorf("Expected processing, storing and done, got %v", stages)
+	}
+	if last := progress[len(progress)-1]; last.PhotoID != value.ID {
+		t.Errorf("Expected the photo %d when done, got %d", value.ID, last.PhotoID)
+	}
+
+	if res := upload("second", false); res.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without a photo, got %d", res.Code)
+	}
+	progress = readUploadProgress(t, messages, "second")
+	if last := progress[len(progress)-1]; last.Stage != uploadFailed || last.Error != "Invalid photo" {
+		t.Errorf("Expected the upload to fail, got %+v", last)
+	}
+
+	if res := upload("not valid!", true); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid upload ID, got %d", res.Code)
+	}
+}
@@ -0,0 +1,84 @@
+package photoshare
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Rewrites the client address and scheme of requests forwarded by a trusted
+// reverse proxy, so getRemoteIP and getScheme see the real client.
+type trustedProxies struct {
+	networks []*net.IPNet
+}
+
+// parses a comma-separated list of IP addresses and CIDR ranges
+func newTrustedProxies(s string) (*trustedProxies, error) {
+	p := &trustedProxies{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s", item)
+		}
+		p.networks = append(p.networks, network)
+	}
+	return p, nil
+}
+
+func (p *trustedProxies) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the address of the client, the rightmost address in
+// X-Forwarded-For not added by a trusted proxy
+func (p *trustedProxies) clientIP(r *http.Request) string {
+	ip := getRemoteIP(r)
+	if !p.isTrusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		ip = addr
+		if !p.isTrusted(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+// negroni middleware
+func (p *trustedProxies) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if len(p.networks) > 0 && p.isTrusted(getRemoteIP(r)) {
+		r.RemoteAddr = net.JoinHostPort(p.clientIP(r), "0")
+		switch proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto {
+		case "http", "https":
+			r.URL.Scheme = proto
+		}
+	}
+	next(w, r)
+}
@@ -0,0 +1,35 @@
+package photoshare
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrustedProxyClientIP(t *testing.T) {
+	p, err := newTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr, forwarded, expected string
+	}{
+		{"1.2.3.4:1000", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1000", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1000", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"192.168.1.1:1000", "", "192.168.1.1"},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if ip := p.clientIP(req); ip != tc.expected {
+			t.Errorf("%s via %s: expected %s, got %s", tc.forwarded, tc.remoteAddr, tc.expected, ip)
+		}
+	}
+
+	if _, err := newTrustedProxies("not-an-ip"); err == nil {
+		t.Error("Invalid proxy address should be an error")
+	}
+}
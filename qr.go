@@ -0,0 +1,98 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"rsc.io/qr"
+	"strconv"
+)
+
+// QR codes of the shortlinks of photos (see shortlinks.go), for galleries
+// and prints: /api/photos/{id}/qr as PNG, or as SVG with ?format=svg, about
+// ?size= pixels wide.
+
+const (
+	defaultQRSize = 256
+	maxQRSize     = 2048
+	qrQuietZone   = 4 // modules of white around the code
+)
+
+// returns the number of pixels per module for a code about size pixels wide
+func qrScale(code *qr.Code, size int) int {
+	scale := size / (code.Size + 2*qrQuietZone)
+	if scale < 1 {
+		return 1
+	}
+	return scale
+}
+
+// writes the code as an SVG path of its dark modules
+func writeQRSVG(code *qr.Code, size int) []byte {
+	width := code.Size + 2*qrQuietZone
+	pixels := width * qrScale(code, size)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		pixels, pixels, width, width)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, width)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(buf, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+func getPhotoQR(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	size := defaultQRSize
+	if value := r.FormValue("size"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size <= 0 || size > maxQRSize {
+			return httpError{http.StatusBadRequest, "Invalid size"}
+		}
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		return httpError{http.StatusBadRequest, "Invalid format"}
+	}
+
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	link, err := getOrCreateShortlink(ctx, photo.ID)
+	if err != nil {
+		return err
+	}
+
+	code, err := qr.Encode(fmt.Sprintf("%s/p/%s", getBaseURL(r), link.Code), qr.M)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = writeQRSVG(code, size)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		code.Scale = qrScale(code, size)
+		body = code.PNG()
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	return err
+}
@@ -0,0 +1,52 @@
+package photoshare
+
+import (
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPhotoQR(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	p := &photo{Title: "heron", OwnerID: 1}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/api/photos/%d/qr%s", p.ID, query), nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("?size=300")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected a PNG, got %d %s", res.Code, res.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// whole pixels per module, so no wider than asked
+	if width := img.Bounds().Dx(); width > 300 || width < 200 {
+		t.Errorf("Expected about 300 pixels, got %d", width)
+	}
+
+	res = get("?format=svg")
+	if res.Code != http.StatusOK || !strings.HasPrefix(res.Body.String(), "<svg") {
+		t.Errorf("Expected an SVG, got %d %s", res.Code, res.Body.String())
+	}
+
+	for _, query := range []string{"?size=0", "?size=100000", "?format=gif"} {
+		if res := get(query); res.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, res.Code)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package photoshare
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reads (GET and HEAD requests) are limited per window of
+// RATE_LIMIT_WINDOW seconds, with a quota for each tier of client:
+// anonymous users by IP address, logged in users by account, and clients
+// sending one of API_KEYS in the X-Api-Key header by key. A quota of 0 is
+// unlimited. Responses carry the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers; counts are kept in memory, by each server.
+
+const apiKeyHeader = "X-Api-Key"
+
+var (
+	errTooManyRequests = httpError{http.StatusTooManyRequests, "Too many requests, please try again later"}
+	errInvalidAPIKey   = httpError{http.StatusUnauthorized, "Invalid API key"}
+)
+
+type rateWindow struct {
+	count int
+	reset time.Time
+	ids   map[int64]bool // counted once each, by previewTracker
+}
+
+// counts requests by key in fixed windows
+type rateLimiter struct {
+	sync.Mutex
+	window  time.Duration
+	windows map[string]*rateWindow
+	swept   time.Time
+}
+
+func newRateLimiter(window time.Duration) *rateLimiter {
+	return &rateLimiter{window: window, windows: make(map[string]*rateWindow)}
+}
+
+// returns the window of the key, starting a new one if it has ended; the
+// limiter must be locked
+func (l *rateLimiter) current(key string, now time.Time) *rateWindow {
+
+	// forget the windows which have ended, once a window
+	if now.Sub(l.swept) >= l.window {
+		for k, w := range l.windows {
+			if !now.Before(w.reset) {
+				delete(l.windows, k)
+			}
+		}
+		l.swept = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.reset) {
+		w = &rateWindow{reset: now.Add(l.window)}
+		l.windows[key] = w
+	}
+	return w
+}
+
+// counts a request for the key, returning the requests left in the window
+// and when it resets, and false if the request is over the limit
+func (l *rateLimiter) take(key string, limit int, now time.Time) (int, time.Time, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	w := l.current(key, now)
+	if w.count >= limit {
+		return 0, w.reset, false
+	}
+	w.count++
+	return limit - w.count, w.reset, true
+}
+
+// returns true if the requests counted for the key have reached the limit
+// in its window, without counting one
+func (l *rateLimiter) isLimited(key string, limit int, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	w, ok := l.windows[key]
+	return ok && now.Before(w.reset) && w.count >= limit
+}
+
+// returns the key counting requests of the client, and its quota
+func (app *app) rateTier(r *http.Request, site *site) (string, int, error) {
+
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		for i, apiKey := range strings.Split(app.cfg.APIKeys, ",") {
+			apiKey = strings.TrimSpace(apiKey)
+			if apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+				return fmt.Sprintf("%d:key:%d", site.ID, i), app.cfg.RateLimitAPIKey, nil
+			}
+		}
+		return "", 0, errInvalidAPIKey
+	}
+
+	// a bad token is only refused later, by the handlers needing the user
+	if userID, _, err := app.session.readToken(r); err == nil && userID != 0 {
+		return fmt.Sprintf("%d:user:%d", site.ID, userID), app.cfg.RateLimitUser, nil
+	}
+	return fmt.Sprintf("%d:ip:%s", site.ID, getRemoteIP(r)), app.cfg.RateLimitAnonymous, nil
+}
+
+// counts the read in the quota of the client, setting the RateLimit
+// headers, and refuses it if over the quota
+func (app *app) checkRateLimit(w http.ResponseWriter, r *http.Request, site *site) error {
+
+	if app.limiter == nil || (r.Method != "GET" && r.Method != "HEAD") {
+		return nil
+	}
+
+	key, limit, err := app.rateTier(r, site)
+	if err != nil || limit == 0 {
+		return err
+	}
+
+	now := time.Now()
+	remaining, reset, ok := app.limiter.take(key, limit, now)
+	seconds := strconv.Itoa(int(math.Ceil(reset.Sub(now).Seconds())))
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", seconds)
+	if !ok {
+		w.Header().Set("Retry-After", seconds)
+		return errTooManyRequests
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	l := newRateLimiter(time.Minute)
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		if remaining, _, ok := l.take("a", 3, now); !ok || remaining != i {
+			t.Errorf("Expected %d remaining, got %d %v", i, remaining, ok)
+		}
+	}
+	if _, reset, ok := l.take("a", 3, now); ok || !reset.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the fourth request refused until %s, got %v %s", now.Add(time.Minute), ok, reset)
+	}
+	if _, _, ok := l.take("b", 3, now); !ok {
+		t.Error("Another key should have its own count")
+	}
+	if _, _, ok := l.take("a", 3, now.Add(time.Minute)); !ok {
+		t.Error("Count should start again in the next window")
+	}
+}
+
+func TestRateLimitTiers(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.limiter = newRateLimiter(time.Minute)
+	app.cfg.RateLimitAnonymous = 1
+	app.cfg.RateLimitUser = 2
+	app.cfg.RateLimitAPIKey = 0
+	app.cfg.APIKeys = "key1, key2"
+
+	owner := &user{Name: "tester", Email: "tester@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "heron", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/api/photos/%d", p.ID), nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("", "")
+	if res.Code != http.StatusOK || res.Header().Get("RateLimit-Limit") != "1" || res.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected anonymous response %d %v", res.Code, res.Header())
+	}
+	res = get("", "")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected 429 with Retry-After, got %d %v", res.Code, res.Header())
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := get(tokenHeader, token); res.Code != http.StatusOK || res.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("Expected the user quota, got %d %v", res.Code, res.Header())
+		}
+	}
+	if res := get(tokenHeader, token); res.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over the user quota, got %d", res.Code)
+	}
+
+	for i := 0; i < 5; i++ {
+		if res := get(apiKeyHeader, "key2"); res.Code != http.StatusOK || res.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("API key should be unlimited, got %d %v", res.Code, res.Header())
+		}
+	}
+	if res := get(apiKeyHeader, "other"); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown API key, got %d", res.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// A panic in a handler is recovered in the request, answered with a 500 giving
+// the ID of the report, and reported with its stack trace to the reporter set
+// with ERROR_REPORT_URL, e.g. a Sentry-style collector.
+
+const errorReportTimeout = 10 * time.Second
+
+type errorReport struct {
+	ID        string    `json:"id"`
+	Message   string    `json:"message"`
+	Stack     string    `json:"stack"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type errorReporter interface {
+	report(*errorReport) error
+}
+
+// returns the reporter set in the config, or nil if there is none
+func newErrorReporter(cfg *config) errorReporter {
+	if cfg.ErrorReportURL == "" {
+		return nil
+	}
+	return &httpErrorReporter{
+		url:    cfg.ErrorReportURL,
+		token:  cfg.ErrorReportToken,
+		client: &http.Client{Timeout: errorReportTimeout},
+	}
+}
+
+// posts reports as JSON, with an optional bearer token
+type httpErrorReporter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (e *httpErrorReporter) report(report *errorReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("error reporter returned %s", res.Status)
+	}
+	return nil
+}
+
+// recovers a panic of the request, if any; deferred by handler
+func (app *app) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	report := &errorReport{
+		ID:        uniuri.New(),
+		Message:   fmt.Sprint(value),
+		Stack:     string(debug.Stack()),
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		CreatedAt: utcNow(),
+	}
+	log.Printf("Panic %s: %s\n%s", report.ID, report.Message, report.Stack)
+
+	if app.reporter != nil {
+		go func() {
+			if err := app.reporter.report(report); err != nil {
+				logError(err)
+			}
+		}()
+	}
+
+	lang := app.translator.negotiate(r)
+	w.Header().Set("Content-Language", lang)
+	renderJSON(w, map[string]string{
+		"error":    app.translator.translate(lang, "Sorry, an error occurred"),
+		"reportId": report.ID,
+	}, http.StatusInternalServerError)
+}
@@ -0,0 +1,71 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeErrorReporter struct {
+	reports chan *errorReport
+}
+
+func (e *fakeErrorReporter) report(report *errorReport) error {
+	e.reports <- report
+	return nil
+}
+
+func panicky(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	panic("something broke")
+}
+
+func TestRecoverPanic(t *testing.T) {
+
+	app := newTestApp(newMemoryDataMapper())
+	reporter := &fakeErrorReporter{make(chan *errorReport, 1)}
+	app.reporter = reporter
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/panic", nil)
+	res := httptest.NewRecorder()
+	app.handler(panicky, authLevelIgnore)(res, req)
+
+	if res.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, got %d", res.Code)
+	}
+	body := make(map[string]string)
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	report := <-reporter.reports
+	if body["reportId"] != report.ID || report.Message != "something broke" || report.URL != "http://localhost/api/panic" {
+		t.Errorf("Unexpected report %+v for %v", report, body)
+	}
+	if !strings.Contains(report.Stack, "panicky") {
+		t.Errorf("Report should have the stack trace, got %s", report.Stack)
+	}
+}
+
+func TestHTTPErrorReporter(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := &errorReport{}
+		if err := json.NewDecoder(r.Body).Decode(report); err != nil || report.ID != "abc" {
+			t.Errorf("Unexpected report %+v: %v", report, err)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Token should be sent, got %q", r.Header.Get("Authorization"))
+		}
+	}))
+	defer srv.Close()
+
+	e := newErrorReporter(&config{ErrorReportURL: srv.URL, ErrorReportToken: "secret"})
+	if err := e.report(&errorReport{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if newErrorReporter(&config{}) != nil {
+		t.Error("Reporting should be disabled without a URL")
+	}
+}
@@ -0,0 +1,93 @@
+package photoshare
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Recovery codes emailed to reset a password are guessed at most
+// recoveryCodeAttempts times in each recoveryCodeWindow by IP address:
+// failed attempts are counted and written to the audit log, and further
+// attempts refused with a 429 until the window ends. A code is used once,
+// claimed as the password is changed, so that two requests with the same
+// code can't both change it. Only the hash of a code is stored, so that the
+// codes in a copy of the database can't be used.
+
+const (
+	recoveryCodeAttempts = 5
+	recoveryCodeWindow   = 15 * time.Minute
+)
+
+var (
+	errInvalidRecoveryCode  = httpError{http.StatusNotFound, "Invalid recovery code"}
+	errTooManyRecoveryCodes = httpError{http.StatusTooManyRequests, "Too many attempts, please try again later"}
+)
+
+// returns the hash of the code stored and looked up. Codes are random, so
+// a hash without salt is enough and lets codes be found by their hash.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// returns true if the code is the recovery code of the user, comparing
+// their hashes in constant time
+func (user *user) checkRecoveryCode(code string) bool {
+	return user.RecoveryCode.Valid && code != "" &&
+		subtle.ConstantTimeCompare([]byte(user.RecoveryCode.String), []byte(hashRecoveryCode(code))) == 1
+}
+
+// returns the key counting the failed attempts of the client
+func recoveryCodeKey(ctx *context) string {
+	return fmt.Sprintf("%d:%s", ctx.site.ID, ctx.remoteIP)
+}
+
+// returns the user of the recovery code, counting a failure against the IP
+// address of the client
+func getUserByRecoveryCode(ctx *context, code string) (*user, error) {
+
+	key := recoveryCodeKey(ctx)
+	now := time.Now()
+
+	if ctx.recoveryLimiter.isLimited(key, recoveryCodeAttempts, now) {
+		if err := writeAuditLog(ctx, "recovery_code_throttled", 0, ""); err != nil {
+			return nil, err
+		}
+		return nil, errTooManyRecoveryCodes
+	}
+
+	user, err := ctx.datamapper.getUserByRecoveryCode(hashRecoveryCode(code))
+	if err != nil && !isErrSqlNoRows(err) {
+		return nil, err
+	}
+	if err == nil && user.checkRecoveryCode(code) {
+		return user, nil
+	}
+	return nil, failRecoveryCode(ctx, key, now)
+}
+
+// counts the failed attempt, returning the error for the client
+func failRecoveryCode(ctx *context, key string, now time.Time) error {
+	ctx.recoveryLimiter.take(key, recoveryCodeAttempts, now)
+	if err := writeAuditLog(ctx, "recovery_code_failed", 0, ""); err != nil {
+		return err
+	}
+	return errInvalidRecoveryCode
+}
+
+// claims the recovery code of the user, so that it is used only once
+func claimRecoveryCode(ctx *context, user *user, code string) error {
+	ok, err := ctx.datamapper.clearRecoveryCode(user.ID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return failRecoveryCode(ctx, recoveryCodeKey(ctx), time.Now())
+	}
+	user.resetRecoveryCode()
+	return nil
+}
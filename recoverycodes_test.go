@@ -0,0 +1,64 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@example.com"}
+	if _, err := dm.login(owner); err != nil {
+		t.Fatal(err)
+	}
+	code, err := owner.generateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.RecoveryCode.String == code || owner.RecoveryCode.String != hashRecoveryCode(code) {
+		t.Errorf("Expected only the hash of the code to be stored, got %q", owner.RecoveryCode.String)
+	}
+	if err := dm.updateUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(ip, code string) *httptest.ResponseRecorder {
+		body := `{"password": "new password", "code": "` + code + `"}`
+		req, _ := http.NewRequest("PUT", "http://localhost/api/auth/changepass", strings.NewReader(body))
+		req.RemoteAddr = ip + ":1234"
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	for i := 0; i < recoveryCodeAttempts; i++ {
+		if res := send("10.0.0.1", "wrong"); res.Code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for a wrong code, got %d", res.Code)
+		}
+	}
+	if res := send("10.0.0.1", code); res.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected further attempts to be refused, got %d", res.Code)
+	}
+
+	if res := send("10.0.0.2", code); res.Code != http.StatusOK {
+		t.Fatalf("Expected the code to change the password, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := send("10.0.0.2", code); res.Code != http.StatusNotFound {
+		t.Errorf("Expected the code to be used once, got %d", res.Code)
+	}
+
+	failed := 0
+	for _, e := range dm.audit {
+		if e.Action == "recovery_code_failed" {
+			failed++
+		}
+	}
+	if failed != recoveryCodeAttempts+1 {
+		t.Errorf("Expected failed attempts in the audit log, got %d", failed)
+	}
+}
@@ -0,0 +1,236 @@
+package photoshare
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With STORAGE_REPLICA set, uploads are kept in a second storage as well as
+// the uploads directory: another directory, e.g. on another disk, mirroring
+// the uploads and thumbnails, or an S3 bucket (see s3.go). Uploads are
+// stored in the uploads directory as before and copied to the replica in the
+// background, retried a few times if the replica fails. Files that cannot be
+// read from the uploads directory are read from the replica, and restored
+// from it by the checks of the storage (see checksums.go). The replicate
+// command copies the files missing from the replica, e.g. when one is added.
+
+const (
+	replicationQueue    = 1000
+	replicationAttempts = 5
+)
+
+// delay before the first retry of a copy, doubled for each retry after
+var replicationRetryDelay = 10 * time.Second
+
+type replicationTask struct {
+	name, contentType string
+	remove            bool
+	attempts          int
+}
+
+type replicatedStorage struct {
+	primary, replica fileStorage
+	tasks            chan *replicationTask
+	pending          sync.WaitGroup
+	mu               sync.Mutex
+	closed           bool
+}
+
+// returns the storage of the replica of STORAGE_REPLICA
+func newReplicaStorage(cfg *config, processor imageProcessor, sealer *sealer) (fileStorage, error) {
+	if strings.HasPrefix(cfg.StorageReplica, "s3://") {
+		return newS3Storage(cfg)
+	}
+	return &defaultFileStorage{
+		cfg.StorageReplica,
+		path.Join(cfg.StorageReplica, "thumbnails"),
+		path.Join(cfg.StorageReplica, "variants"),
+		processor,
+		sealer,
+	}, nil
+}
+
+func newReplicatedStorage(primary, replica fileStorage) *replicatedStorage {
+	s := &replicatedStorage{
+		primary: primary,
+		replica: replica,
+		tasks:   make(chan *replicationTask, replicationQueue),
+	}
+	// one worker, so that the copy and removal of a file stay in order
+	go s.work()
+	return s
+}
+
+// returns the content type of the file from its extension
+func contentTypeOf(name string) string {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
+
+// queues the task, unless the queue is full or closed. Files left out are
+// copied by the replicate command.
+func (s *replicatedStorage) queue(task *replicationTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.pending.Add(1)
+	select {
+	case s.tasks <- task:
+	default:
+		s.pending.Done()
+		logError(fmt.Errorf("replication queue full, %s not replicated", task.name))
+	}
+}
+
+func (s *replicatedStorage) work() {
+	for task := range s.tasks {
+		if err := s.replicate(task); err != nil {
+			task.attempts++
+			if task.attempts < replicationAttempts {
+				delay := replicationRetryDelay << uint(task.attempts-1)
+				time.AfterFunc(delay, func() { s.tasks <- task })
+				continue
+			}
+			logError(fmt.Errorf("replication of %s failed after %d attempts: %v", task.name, task.attempts, err))
+		}
+		s.pending.Done()
+	}
+}
+
+// copies the file to the replica, or removes it from there. Files gone
+// from the uploads directory before they are copied are left to the checks
+// of the storage.
+func (s *replicatedStorage) replicate(task *replicationTask) error {
+	if task.remove {
+		err := s.replica.clean(task.name)
+		if err != nil {
+			// not copied, or removed already
+			f, openErr := s.replica.open(task.name)
+			if openErr != nil {
+				return nil
+			}
+			f.Close()
+		}
+		return err
+	}
+	f, err := s.primary.open(task.name)
+	if err != nil {
+		log.Printf("Not replicating %s: %v", task.name, err)
+		return nil
+	}
+	defer f.Close()
+	return s.replica.store(f, task.name, task.contentType)
+}
+
+// waits for the files queued to be copied
+func (s *replicatedStorage) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.pending.Wait()
+}
+
+func (s *replicatedStorage) store(src readable, name, contentType string) error {
+	if err := s.primary.store(src, name, contentType); err != nil {
+		return err
+	}
+	s.queue(&replicationTask{name: name, contentType: contentType})
+	return nil
+}
+
+func (s *replicatedStorage) clean(name string) error {
+	s.queue(&replicationTask{name: name, remove: true})
+	return s.primary.clean(name)
+}
+
+func (s *replicatedStorage) list() ([]string, error) {
+	return s.primary.list()
+}
+
+// opens the file, from the replica if the uploads directory fails
+func (s *replicatedStorage) open(name string) (readableFile, error) {
+	f, err := s.primary.open(name)
+	if err == nil {
+		return f, nil
+	}
+	f, replicaErr := s.replica.open(name)
+	if replicaErr != nil {
+		return nil, err
+	}
+	log.Printf("Read %s from the replica: %v", name, err)
+	return f, nil
+}
+
+// opens the thumbnail, from the replica if the uploads directory fails. S3
+// replicas have no thumbnails.
+func (s *replicatedStorage) openThumbnail(name string) (readableFile, error) {
+	f, err := s.primary.openThumbnail(name)
+	if err == nil {
+		return f, nil
+	}
+	f, replicaErr := s.replica.openThumbnail(name)
+	if replicaErr != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// encrypts the files of both storages, see encryptableStorage
+func (s *replicatedStorage) encryptFiles() (int, error) {
+	num, err := encryptStorage(s.primary)
+	if err != nil {
+		return num, err
+	}
+	_, err = encryptStorage(s.replica)
+	return num, err
+}
+
+// restores the file from the replica, see checkPhotoFile
+func (s *replicatedStorage) repair(name string) error {
+	f, err := s.replica.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.primary.store(f, name, contentTypeOf(name))
+}
+
+// copies the files missing from the replica, returning their number
+func (s *replicatedStorage) replicateMissing() (int, error) {
+
+	names, err := s.primary.list()
+	if err != nil {
+		return 0, err
+	}
+	replicated, err := s.replica.list()
+	if err != nil {
+		return 0, err
+	}
+
+	found := make(map[string]bool)
+	for _, name := range replicated {
+		found[name] = true
+	}
+
+	var num int
+	for _, name := range names {
+		if found[name] {
+			continue
+		}
+		if err := s.replicate(&replicationTask{name: name, contentType: contentTypeOf(name)}); err != nil {
+			return num, err
+		}
+		num++
+	}
+	return num, nil
+}
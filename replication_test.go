@@ -0,0 +1,107 @@
+package photoshare
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fails the first stores
+type flakyStorage struct {
+	*memoryFileStorage
+	failures int
+}
+
+func (f *flakyStorage) store(src readable, filename, contentType string) error {
+	f.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.Unlock()
+		return errors.New("replica unavailable")
+	}
+	f.Unlock()
+	return f.memoryFileStorage.store(src, filename, contentType)
+}
+
+func TestReplicatedStorage(t *testing.T) {
+
+	primary := newMemoryFileStorage(&fakeImageProcessor{})
+	replica := newMemoryFileStorage(&fakeImageProcessor{})
+	s := newReplicatedStorage(primary, replica)
+
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := s.store(strings.NewReader("image "+name), name, "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.clean("b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	if string(replica.files["a.jpg"]) != "image a.jpg" {
+		t.Errorf("Expected the file to be copied to the replica, got %q", replica.files["a.jpg"])
+	}
+	if _, ok := replica.files["b.jpg"]; ok {
+		t.Error("Expected the removed file to be removed from the replica")
+	}
+
+	// read from the replica while missing
+	delete(primary.files, "a.jpg")
+	f, err := s.open("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(f); string(body) != "image a.jpg" {
+		t.Errorf("Expected the file of the replica, got %q", body)
+	}
+
+	if err := s.repair("a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if string(primary.files["a.jpg"]) != "image a.jpg" {
+		t.Errorf("Expected the file to be restored, got %q", primary.files["a.jpg"])
+	}
+	if _, err := s.open("missing.jpg"); err == nil {
+		t.Error("Expected an error for a file in neither storage")
+	}
+}
+
+func TestReplicationRetry(t *testing.T) {
+
+	defer func(delay time.Duration) { replicationRetryDelay = delay }(replicationRetryDelay)
+	replicationRetryDelay = time.Millisecond
+
+	primary := newMemoryFileStorage(&fakeImageProcessor{})
+	replica := &flakyStorage{newMemoryFileStorage(&fakeImageProcessor{}), 2}
+	s := newReplicatedStorage(primary, replica)
+
+	if err := s.store(strings.NewReader("image"), "a.jpg", "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if _, ok := replica.files["a.jpg"]; !ok {
+		t.Error("Expected the file to be copied after the replica failed")
+	}
+}
+
+func TestReplicateMissing(t *testing.T) {
+
+	primary := newMemoryFileStorage(&fakeImageProcessor{})
+	replica := newMemoryFileStorage(&fakeImageProcessor{})
+	for _, name := range []string{"a.jpg", "b.png"} {
+		primary.store(strings.NewReader("image "+name), name, contentTypeOf(name))
+	}
+	replica.store(strings.NewReader("image a.jpg"), "a.jpg", "image/jpeg")
+
+	s := newReplicatedStorage(primary, replica)
+	num, err := s.replicateMissing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 || string(replica.files["b.png"]) != "image b.png" {
+		t.Errorf("Expected the missing file to be copied, got %d", num)
+	}
+}
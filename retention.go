@@ -0,0 +1,143 @@
+package photoshare
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Accounts inactive for RETENTION_INACTIVE_DAYS are closed, after a warning
+// mailed RETENTION_WARNING_DAYS before; logging in or using the site in the
+// meantime cancels the warning. Accounts with photos are deactivated, keeping
+// their photos, until an admin reactivates them; others are deleted. Admins
+// are never closed, and may exempt other accounts. The job also empties the
+// trash, see purgeSiteTrash.
+
+const (
+	retentionInterval = time.Hour
+	retentionDay      = 24 * time.Hour
+)
+
+// warns and closes the inactive accounts of each site, if enabled, and
+// removes photos in the trash for too long
+func applyRetention(app *app) {
+	sites, err := app.datamapper.getSites()
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, s := range sites {
+		datamapper := app.datamapper.forSite(s.ID)
+
+		if app.cfg.RetentionInactiveDays > 0 {
+			warned, closed, err := applySiteRetention(app.cfg, app.mailer, datamapper, &s, utcNow())
+			if err != nil {
+				logError(err)
+			}
+			if warned > 0 || closed > 0 {
+				log.Printf("Warned %d and closed %d inactive accounts of site %d", warned, closed, s.ID)
+			}
+		}
+
+		num, err := purgeSiteTrash(datamapper, app.filestore, utcNow())
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if num > 0 {
+			log.Printf("Removed %d photos from the trash of site %d", num, s.ID)
+		}
+	}
+}
+
+// returns the number of accounts warned and closed
+func applySiteRetention(cfg *config, m *mailer, datamapper dataMapper, s *site, now time.Time) (int, int, error) {
+
+	var (
+		inactive = time.Duration(cfg.RetentionInactiveDays) * retentionDay
+		warning  = time.Duration(cfg.RetentionWarningDays) * retentionDay
+		warned   int
+		closed   int
+	)
+
+	users, err := datamapper.getInactiveUsers(now.Add(warning - inactive))
+	if err != nil {
+		return warned, closed, err
+	}
+	for i := range users {
+		u := &users[i].user
+		// accounts are only closed after the warning was sent
+		if err := m.sendInactivityMail(u, s.Hostname, cfg.RetentionWarningDays, users[i].NumPhotos > 0); err != nil {
+			logError(err)
+			continue
+		}
+		u.InactivityWarnedAt = &now
+		if err := datamapper.updateUser(u); err != nil {
+			return warned, closed, err
+		}
+		warned++
+	}
+
+	users, err = datamapper.getWarnedUsers(now.Add(-inactive), now.Add(-warning))
+	if err != nil {
+		return warned, closed, err
+	}
+	for i := range users {
+		u := &users[i].user
+		if users[i].NumPhotos > 0 {
+			u.IsActive = false
+			err = datamapper.updateUser(u)
+		} else {
+			err = datamapper.removeUser(u)
+		}
+		if err != nil {
+			return warned, closed, err
+		}
+		closed++
+	}
+	return warned, closed, nil
+}
+
+// applies the retention policy until the server stops
+func runRetention(app *app) {
+	for range time.Tick(retentionInterval) {
+		applyRetention(app)
+	}
+}
+
+// exempts a user from the retention policy, or reactivates a user closed by it
+func setUserRetention(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Exempt     bool `json:"exempt"`
+		Reactivate bool `json:"reactivate"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	target.RetentionExempt = s.Exempt
+	if s.Reactivate && !target.IsActive {
+		target.IsActive = true
+		target.LastActiveAt = utcNow()
+		target.InactivityWarnedAt = nil
+	}
+
+	if err := ctx.datamapper.updateUser(target); err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("exempt=%t reactivate=%t", s.Exempt, s.Reactivate)
+	if err := writeAuditLog(ctx, "retention", target.ID, details); err != nil {
+		return err
+	}
+
+	return renderJSON(w, newAdminUser(target), http.StatusOK)
+}
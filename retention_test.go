@@ -0,0 +1,128 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingSender struct {
+	messages []*message
+}
+
+func (s *recordingSender) send(msg *message) error {
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func TestApplySiteRetention(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	sender := &recordingSender{}
+	app.mailer.sender = sender
+
+	cfg := &config{RetentionInactiveDays: 365, RetentionWarningDays: 30}
+	s := &site{Hostname: "photos.example.com"}
+	now := time.Now()
+
+	newUser := func(name string, lastActive time.Time, withPhoto bool) *user {
+		u := &user{Name: name, Email: name + "@localhost"}
+		if err := dm.createUser(u); err != nil {
+			t.Fatal(err)
+		}
+		u.LastActiveAt = lastActive
+		if err := dm.updateUser(u); err != nil {
+			t.Fatal(err)
+		}
+		if withPhoto {
+			if err := dm.createPhoto(&photo{Title: "test", Filename: "test.jpg", OwnerID: u.ID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return u
+	}
+
+	longAgo := now.Add(-400 * retentionDay)
+	active := newUser("active", now.Add(-100*retentionDay), false)
+	photographer := newUser("photographer", longAgo, true)
+	lurker := newUser("lurker", longAgo, false)
+	exempt := newUser("exempt", longAgo, false)
+	exempt.RetentionExempt = true
+	dm.updateUser(exempt)
+
+	warned, closed, err := applySiteRetention(cfg, app.mailer, dm, s, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warned != 2 || closed != 0 || len(sender.messages) != 2 {
+		t.Fatalf("Expected 2 warnings and no accounts closed, got %d and %d", warned, closed)
+	}
+	if !strings.Contains(string(sender.messages[0].body), "deactivated") ||
+		!strings.Contains(string(sender.messages[1].body), "deleted") {
+		t.Errorf("Warnings should say what happens to the account, got %s", sender.messages)
+	}
+
+	// not closed until the warning period is over
+	if _, closed, _ := applySiteRetention(cfg, app.mailer, dm, s, now.Add(29*retentionDay)); closed != 0 {
+		t.Errorf("Accounts should not be closed yet, got %d", closed)
+	}
+	warned, closed, err = applySiteRetention(cfg, app.mailer, dm, s, now.Add(31*retentionDay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warned != 0 || closed != 2 {
+		t.Errorf("Expected 2 accounts closed, got %d", closed)
+	}
+
+	if u, err := dm.getUser(photographer.ID); err != nil || u.IsActive {
+		t.Error("Accounts with photos should be deactivated")
+	}
+	if _, err := dm.getUser(lurker.ID); err == nil {
+		t.Error("Accounts without photos should be deleted")
+	}
+	for _, u := range []*user{active, exempt} {
+		if u, _ := dm.getUser(u.ID); !u.IsActive || u.InactivityWarnedAt != nil {
+			t.Errorf("%s should be kept", u.Name)
+		}
+	}
+}
+
+func TestReactivateUser(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	token, err := dm.login(&user{Name: "admin", Email: "admin@localhost", IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &user{Name: "target", Email: "target@localhost"}
+	if err := dm.createUser(target); err != nil {
+		t.Fatal(err)
+	}
+	target.IsActive = false
+	dm.updateUser(target)
+
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/admin/users/%d/retention", target.ID),
+		strings.NewReader(`{"exempt": true, "reactivate": true}`))
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	if u, _ := dm.getUser(target.ID); !u.IsActive || !u.RetentionExempt {
+		t.Errorf("User should be reactivated and exempt, got %+v", u)
+	}
+	if strings.Contains(res.Body.String(), `"password"`) {
+		t.Errorf("Password hash should not be rendered, got %s", res.Body.String())
+	}
+	if len(dm.audit) != 1 {
+		t.Error("Change should be audited")
+	}
+}
@@ -0,0 +1,308 @@
+package photoshare
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Uploads are copied to an S3 bucket, or any service with the S3 API such
+// as MinIO, when STORAGE_REPLICA is s3://bucket/prefix (see replication.go).
+// Only the originals are kept there: thumbnails are made again from them
+// when a file is restored. Requests are signed with AWS Signature Version 4
+// and use path-style URLs, so that the endpoint needn't support bucket
+// subdomains.
+
+const s3Timeout = 60 * time.Second
+
+type s3Storage struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	sealer    *sealer // nil if not encrypted
+}
+
+func newS3Storage(cfg *config) (*s3Storage, error) {
+	replica, err := url.Parse(cfg.StorageReplica)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newSealer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		client:    &http.Client{Timeout: s3Timeout},
+		endpoint:  endpoint,
+		bucket:    replica.Host,
+		prefix:    strings.Trim(replica.Path, "/"),
+		region:    cfg.S3Region,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		sealer:    sealer,
+	}, nil
+}
+
+// returns the start of the keys of the objects
+func (s *s3Storage) keyPrefix() string {
+	if s.prefix == "" {
+		return ""
+	}
+	return s.prefix + "/"
+}
+
+func (s *s3Storage) key(name string) string {
+	return s.keyPrefix() + path.Base(name)
+}
+
+// sends a signed request for the object, or the bucket if the key is empty
+func (s *s3Storage) do(method, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, utcNow())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s", method, u.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// adds the AWS Signature Version 4 of the request, signing the host, the
+// content type and range if set, and the x-amz- headers
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// escapes each segment of the path as S3 expects
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *s3Storage) store(src readable, name, contentType string) error {
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	return s.put(name, body, contentType)
+}
+
+// uploads the object, encrypted if STORAGE_MASTER_KEY is set
+func (s *s3Storage) put(name string, body []byte, contentType string) error {
+	if s.sealer != nil {
+		sealed, err := s.sealer.seal(body)
+		if err != nil {
+			return err
+		}
+		body = sealed
+	}
+	resp, err := s.do("PUT", s.key(name), nil, body, contentType)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3Object struct {
+	*bytes.Reader
+}
+
+func (o s3Object) Close() error { return nil }
+
+// reads the whole object, so that it can be seeked
+func (s *s3Storage) open(name string) (readableFile, error) {
+	body, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.sealer != nil {
+		if body, err = s.sealer.open(body); err != nil {
+			return nil, err
+		}
+	}
+	return s3Object{bytes.NewReader(body)}, nil
+}
+
+// returns the object as stored
+func (s *s3Storage) get(name string) ([]byte, error) {
+	resp, err := s.do("GET", s.key(name), nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// thumbnails are not kept in the bucket
+func (s *s3Storage) openThumbnail(name string) (readableFile, error) {
+	return nil, os.ErrNotExist
+}
+
+// encrypts the objects stored before STORAGE_MASTER_KEY was set, see
+// encryptableStorage
+func (s *s3Storage) encryptFiles() (int, error) {
+
+	if s.sealer == nil {
+		return 0, errors.New("STORAGE_MASTER_KEY is not set")
+	}
+	names, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var num int
+	for _, name := range names {
+		body, err := s.get(name)
+		if err != nil {
+			return num, err
+		}
+		if isSealed(body) {
+			continue
+		}
+		if err := s.put(name, body, contentTypeOf(name)); err != nil {
+			return num, err
+		}
+		num++
+	}
+	return num, nil
+}
+
+func (s *s3Storage) clean(name string) error {
+	resp, err := s.do("DELETE", s.key(name), nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// returns the names of all objects under the prefix
+func (s *s3Storage) list() ([]string, error) {
+
+	var (
+		names []string
+		token string
+	)
+
+	prefix := s.keyPrefix()
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, "")
+		if err != nil {
+			return names, err
+		}
+		result := &struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		err = xml.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return names, err
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,497 @@
+package photoshare
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Enterprise identity providers, such as Okta or Azure AD, create, update
+// and deactivate users with SCIM 2.0 (RFC 7643 and 7644) at /scim/v2/Users,
+// sending SCIM_TOKEN as a bearer token. The userName of a SCIM user is the
+// user name, the primary email their email, active whether they can log in,
+// and the "admin" role makes them an admin. Users are deactivated rather than
+// deleted, so their photos are kept.
+
+const (
+	scimContentType  = "application/scim+json"
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimAdminRole    = "admin"
+	scimMaxPageCount = 100
+)
+
+// the filters identity providers use to find a user before creating them
+var scimFilterRegex = regexp.MustCompile(`(?i)^\s*(userName|emails|emails\.value)\s+eq\s+"([^"]*)"\s*$`)
+
+type scimValue struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	Location     string    `json:"location"`
+}
+
+type scimUser struct {
+	Schemas  []string    `json:"schemas"`
+	ID       string      `json:"id,omitempty"`
+	UserName string      `json:"userName"`
+	Emails   []scimValue `json:"emails"`
+	Active   *bool       `json:"active,omitempty"`
+	Roles    []scimValue `json:"roles"`
+	Password string      `json:"password,omitempty"`
+	Meta     *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []scimUser `json:"Resources"`
+}
+
+type scimPatchOp struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+func newSCIMUser(baseURL string, u *user) scimUser {
+	active := u.IsActive
+	s := scimUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       strconv.FormatInt(u.ID, 10),
+		UserName: u.Name,
+		Emails:   []scimValue{{Value: u.Email, Primary: true}},
+		Active:   &active,
+		Roles:    []scimValue{},
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			Location:     baseURL + "/scim/v2/Users/" + strconv.FormatInt(u.ID, 10),
+		},
+	}
+	if u.IsAdmin {
+		s.Roles = append(s.Roles, scimValue{Value: scimAdminRole})
+	}
+	return s
+}
+
+// returns the primary email, or the first if none is primary
+func (s *scimUser) email() string {
+	for _, e := range s.Emails {
+		if e.Primary {
+			return strings.ToLower(strings.TrimSpace(e.Value))
+		}
+	}
+	if len(s.Emails) > 0 {
+		return strings.ToLower(strings.TrimSpace(s.Emails[0].Value))
+	}
+	return ""
+}
+
+func (s *scimUser) isAdmin() bool {
+	for _, role := range s.Roles {
+		if role.Value == scimAdminRole {
+			return true
+		}
+	}
+	return false
+}
+
+// applies an operation of a PATCH request. Azure AD sends active as a string
+// and emails by the filter emails[type eq "work"].value.
+func (s *scimUser) patch(op, path string, value json.RawMessage) error {
+
+	invalid := httpError{http.StatusBadRequest, "Unsupported patch operation"}
+
+	op, path = strings.ToLower(op), strings.ToLower(path)
+	if strings.HasPrefix(path, "emails[") {
+		path = "emails"
+	}
+
+	if op == "remove" {
+		if path != "roles" {
+			return invalid
+		}
+		s.Roles = []scimValue{}
+		return nil
+	}
+	if op != "add" && op != "replace" {
+		return invalid
+	}
+
+	var err error
+	switch path {
+	case "":
+		err = json.Unmarshal(value, s)
+	case "username":
+		err = json.Unmarshal(value, &s.UserName)
+	case "active":
+		var active interface{}
+		if err = json.Unmarshal(value, &active); err == nil {
+			switch v := active.(type) {
+			case bool:
+				s.Active = &v
+			case string:
+				var b bool
+				b, err = strconv.ParseBool(v)
+				s.Active = &b
+			default:
+				return invalid
+			}
+		}
+	case "emails":
+		var email string
+		if json.Unmarshal(value, &email) == nil {
+			s.Emails = []scimValue{{Value: email, Primary: true}}
+		} else {
+			err = json.Unmarshal(value, &s.Emails)
+		}
+	case "roles":
+		var roles []scimValue
+		if err = json.Unmarshal(value, &roles); err == nil {
+			if op == "add" {
+				roles = append(s.Roles, roles...)
+			}
+			s.Roles = roles
+		}
+	default:
+		return invalid
+	}
+	if err != nil {
+		return invalid
+	}
+	return nil
+}
+
+// wraps the handlers of the SCIM endpoint, checking the bearer token and
+// rendering errors as SCIM errors
+func scim(h handlerFunc) handlerFunc {
+	return func(ctx *context, w http.ResponseWriter, r *http.Request) error {
+		err := checkSCIMToken(ctx.cfg, r)
+		if err == nil {
+			err = h(ctx, w, r)
+		}
+		if err == nil {
+			return nil
+		}
+
+		status, scimType, detail := http.StatusInternalServerError, "", ""
+		switch e := err.(type) {
+		case httpError:
+			status, detail = e.Status, e.Error()
+		case validationFailure:
+			status = http.StatusBadRequest
+			var messages []string
+			for _, msg := range e.Errors {
+				if strings.HasSuffix(msg, "already taken") {
+					status, scimType = http.StatusConflict, "uniqueness"
+				}
+				messages = append(messages, msg)
+			}
+			sort.Strings(messages)
+			detail = strings.Join(messages, ", ")
+		default:
+			if !isErrSqlNoRows(err) {
+				return err
+			}
+			status, detail = http.StatusNotFound, "Not found"
+		}
+
+		return renderSCIM(w, &struct {
+			Schemas  []string `json:"schemas"`
+			Status   string   `json:"status"`
+			ScimType string   `json:"scimType,omitempty"`
+			Detail   string   `json:"detail"`
+		}{[]string{scimErrorSchema}, strconv.Itoa(status), scimType, detail}, status)
+	}
+}
+
+func checkSCIMToken(cfg *config, r *http.Request) error {
+	if cfg.SCIMToken == "" {
+		return httpError{http.StatusNotFound, "SCIM is not enabled"}
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SCIMToken)) != 1 {
+		return httpError{http.StatusUnauthorized, "Invalid SCIM token"}
+	}
+	return nil
+}
+
+func renderSCIM(w http.ResponseWriter, value interface{}, status int) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, body, status, scimContentType)
+}
+
+// identity providers send application/scim+json, and attributes we do not
+// map, such as name and externalId
+func decodeSCIM(r *http.Request, value interface{}) error {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxJSONSize))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, value); err != nil {
+		return httpError{http.StatusBadRequest, "Invalid SCIM request"}
+	}
+	return nil
+}
+
+// lists the users, or finds them by user name or email
+func getSCIMUsers(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	users, err := ctx.datamapper.getAllUsers()
+	if err != nil {
+		return err
+	}
+
+	if filter := r.FormValue("filter"); filter != "" {
+		match := scimFilterRegex.FindStringSubmatch(filter)
+		if match == nil {
+			return httpError{http.StatusBadRequest, "Unsupported filter"}
+		}
+		var found []user
+		for _, u := range users {
+			if strings.EqualFold(match[1], "userName") && strings.EqualFold(u.Name, match[2]) ||
+				!strings.EqualFold(match[1], "userName") && strings.EqualFold(u.Email, match[2]) {
+				found = append(found, u)
+			}
+		}
+		users = found
+	}
+
+	// startIndex is 1-based
+	start, _ := strconv.Atoi(r.FormValue("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count > scimMaxPageCount {
+		count = scimMaxPageCount
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	result := &scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(users),
+		StartIndex:   start,
+		Resources:    []scimUser{},
+	}
+	baseURL := getBaseURL(r)
+	for i := start - 1; i < len(users) && len(result.Resources) < count; i++ {
+		result.Resources = append(result.Resources, newSCIMUser(baseURL, &users[i]))
+	}
+	result.ItemsPerPage = len(result.Resources)
+	return renderSCIM(w, result, http.StatusOK)
+}
+
+func getSCIMUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	target, err := ctx.datamapper.getUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderSCIM(w, newSCIMUser(getBaseURL(r), target), http.StatusOK)
+}
+
+func createSCIMUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &scimUser{}
+	if err := decodeSCIM(r, s); err != nil {
+		return err
+	}
+
+	target := &user{
+		Name:    strings.TrimSpace(s.UserName),
+		Email:   s.email(),
+		IsAdmin: s.isAdmin(),
+	}
+	// users log in with the identity provider, unless it gives a password
+	if s.Password == "" {
+		if err := target.setRandomPassword(); err != nil {
+			return err
+		}
+	} else if err := target.changePassword(s.Password); err != nil {
+		return err
+	}
+	if err := ctx.validate(target, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.createUser(target); err != nil {
+		return err
+	}
+
+	if s.Active != nil && !*s.Active {
+		target.IsActive = false
+		if err := ctx.datamapper.updateUser(target); err != nil {
+			return err
+		}
+	}
+
+	details := fmt.Sprintf("active=%t admin=%t", target.IsActive, target.IsAdmin)
+	if err := writeAuditLog(ctx, "scim_create", target.ID, details); err != nil {
+		return err
+	}
+
+	result := newSCIMUser(getBaseURL(r), target)
+	w.Header().Set("Location", result.Meta.Location)
+	return renderSCIM(w, result, http.StatusCreated)
+}
+
+// replaces the attributes of the user
+func replaceSCIMUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &scimUser{}
+	if err := decodeSCIM(r, s); err != nil {
+		return err
+	}
+
+	return updateSCIMUser(ctx, w, r, target, s)
+}
+
+// changes the attributes of the user given by the operations
+func patchSCIMUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	p := &scimPatchOp{}
+	if err := decodeSCIM(r, p); err != nil {
+		return err
+	}
+
+	s := newSCIMUser(getBaseURL(r), target)
+	for _, op := range p.Operations {
+		if err := s.patch(op.Op, op.Path, op.Value); err != nil {
+			return err
+		}
+	}
+
+	return updateSCIMUser(ctx, w, r, target, &s)
+}
+
+// deactivates the user, keeping their photos
+func deleteSCIMUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	target, err := ctx.datamapper.getUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if target.IsActive {
+		target.IsActive = false
+		if err := ctx.datamapper.updateUser(target); err != nil {
+			return err
+		}
+		if err := writeAuditLog(ctx, "scim_deactivate", target.ID, ""); err != nil {
+			return err
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// applies the attributes of the SCIM user to the user. Roles are left alone
+// if not given, so admins made here are not demoted by providers that do not
+// send roles.
+func updateSCIMUser(ctx *context, w http.ResponseWriter, r *http.Request, target *user, s *scimUser) error {
+
+	oldName := target.Name
+	name := strings.TrimSpace(s.UserName)
+
+	errors := make(map[string]string)
+	if name != oldName {
+		if err := validateNewName(ctx, name, errors); err != nil {
+			return err
+		}
+	}
+	email := s.email()
+	if email != target.Email && email != "" {
+		if msg := checkEmailDomain(ctx.cfg, email); msg != "" {
+			errors["email"] = msg
+		}
+	}
+	if len(errors) > 0 {
+		return validationFailure{errors}
+	}
+
+	target.Name, target.Email = name, email
+	wasAdmin := target.IsAdmin
+	if s.Roles != nil {
+		target.IsAdmin = s.isAdmin()
+	}
+	if s.Active != nil && *s.Active != target.IsActive {
+		target.IsActive = *s.Active
+		// so the retention policy does not close them again
+		if target.IsActive {
+			target.LastActiveAt = utcNow()
+			target.InactivityWarnedAt = nil
+		}
+	}
+	if s.Password != "" {
+		if err := target.changePassword(s.Password); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.validate(target, r); err != nil {
+		return err
+	}
+
+	var err error
+	if name != oldName {
+		err = ctx.datamapper.changeUserName(target, oldName)
+	} else {
+		err = ctx.datamapper.updateUser(target)
+	}
+	if err != nil {
+		return err
+	}
+
+	// see sessionBinding
+	if target.IsAdmin != wasAdmin {
+		if err := ctx.datamapper.deleteUserSessions(target.ID); err != nil {
+			return err
+		}
+	}
+
+	details := fmt.Sprintf("active=%t admin=%t", target.IsActive, target.IsAdmin)
+	if err := writeAuditLog(ctx, "scim_update", target.ID, details); err != nil {
+		return err
+	}
+
+	if name != oldName {
+		if err := ctx.cache.clear(); err != nil {
+			logError(err)
+		}
+	}
+
+	return renderSCIM(w, newSCIMUser(getBaseURL(r), target), http.StatusOK)
+}
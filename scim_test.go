@@ -0,0 +1,94 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSCIMUsers(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.cfg.SCIMToken = "token"
+
+	call := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		req.Header.Set("Content-Type", scimContentType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := call("GET", "/scim/v2/Users", "other", ""); res.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without the token, got %d", res.Code)
+	}
+
+	res := call("POST", "/scim/v2/Users", "token", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "jane_doe",
+		"name": {"givenName": "Jane"},
+		"emails": [{"value": "Jane@example.com", "primary": true}],
+		"active": true
+	}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	created := &scimUser{}
+	json.Unmarshal(res.Body.Bytes(), created)
+	if created.ID == "" || created.email() != "jane@example.com" || res.Header().Get("Location") != created.Meta.Location {
+		t.Errorf("Expected the created user, got %s", res.Body.String())
+	}
+
+	if res := call("POST", "/scim/v2/Users", "token", `{"userName": "jane_doe", "emails": [{"value": "other@example.com"}]}`); res.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a taken name, got %d: %s", res.Code, res.Body.String())
+	}
+
+	res = call("GET", `/scim/v2/Users?filter=userName+eq+"JANE_DOE"`, "token", "")
+	list := &scimListResponse{}
+	json.Unmarshal(res.Body.Bytes(), list)
+	if res.Code != http.StatusOK || list.TotalResults != 1 || list.Resources[0].ID != created.ID {
+		t.Errorf("Expected the user found by name, got %d: %s", res.Code, res.Body.String())
+	}
+
+	url := "/scim/v2/Users/" + created.ID
+	res = call("PATCH", url, "token", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "Replace", "path": "active", "value": "False"},
+			{"op": "add", "path": "roles", "value": [{"value": "admin"}]}
+		]
+	}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	jane, _ := dm.getUser(1)
+	if jane.IsActive || !jane.IsAdmin {
+		t.Errorf("Expected the user deactivated and made an admin, got %+v", jane)
+	}
+
+	// roles are kept when not given
+	res = call("PUT", url, "token", `{"userName": "jane_smith", "emails": [{"value": "jane@example.com"}], "active": true}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	jane, _ = dm.getUser(1)
+	if !jane.IsActive || !jane.IsAdmin || jane.Name != "jane_smith" {
+		t.Errorf("Expected the user renamed and reactivated, got %+v", jane)
+	}
+
+	if res := call("DELETE", url, "token", ""); res.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", res.Code)
+	}
+	if jane, _ := dm.getUser(1); jane == nil || jane.IsActive {
+		t.Errorf("Expected the user deactivated and kept, got %+v", jane)
+	}
+
+	res = call("GET", "/scim/v2/Users/99", "token", "")
+	if res.Code != http.StatusNotFound || !strings.Contains(res.Body.String(), scimErrorSchema) {
+		t.Errorf("Expected a SCIM 404, got %d: %s", res.Code, res.Body.String())
+	}
+}
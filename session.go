@@ -5,7 +5,9 @@ import (
 	"github.com/juju/errgo"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,12 +16,77 @@ const (
 	expiry      = 60 // minutes
 )
 
+// the token carries the user ID and the key of the session record
 type sessionManager interface {
-	readToken(*http.Request) (int64, error)
-	createToken(int64) (string, error)
-	writeToken(http.ResponseWriter, int64) error
+	readToken(*http.Request) (int64, string, error)
+	createToken(int64, string) (string, error)
+	writeToken(http.ResponseWriter, int64, string) error
+
+	// returns true if the session may be used by the client of the request,
+	// see sessionBinding
+	allows(*session, *http.Request) bool
+}
+
+// Sessions are bound to the client they were created for, so that a token
+// taken from it is refused elsewhere: "lax" binds them to the browser and
+// platform of the user agent, so that browser updates don't log users out,
+// "strict" to the exact user agent and the IP address, and "off" to neither.
+// Session keys are also rotated: logging in replaces the session the client
+// had, changing the password gives the session a new key and ends the other
+// sessions of the user, and the sessions of a user made an admin, or no
+// longer one, are ended.
+type sessionBinding string
+
+const (
+	sessionBindingOff    sessionBinding = "off"
+	sessionBindingLax    sessionBinding = "lax"
+	sessionBindingStrict sessionBinding = "strict"
+)
+
+func (b sessionBinding) allows(s *session, r *http.Request) bool {
+	switch b {
+	case sessionBindingStrict:
+		return s.UserAgent == r.UserAgent() && s.IP == getRemoteIP(r)
+	case sessionBindingLax:
+		return browserFingerprint(s.UserAgent) == browserFingerprint(r.UserAgent())
+	}
+	return true
 }
 
+// browsers and platforms told apart by lax session binding, matched in
+// order against the lowercased user agent, as e.g. Edge also names Chrome
+var (
+	browserFamilies = [][2]string{
+		{"edg", "edge"}, {"opr/", "opera"}, {"opera", "opera"}, {"firefox", "firefox"},
+		{"fxios", "firefox"}, {"chrome", "chrome"}, {"crios", "chrome"}, {"safari", "safari"},
+	}
+	browserPlatforms = [][2]string{
+		{"android", "android"}, {"iphone", "ios"}, {"ipad", "ios"}, {"windows", "windows"},
+		{"macintosh", "macos"}, {"mac os x", "macos"}, {"cros", "chromeos"}, {"linux", "linux"},
+	}
+)
+
+// returns the browser family and platform of the user agent, without
+// versions; other user agents are returned without their version numbers
+func browserFingerprint(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	match := func(names [][2]string) string {
+		for _, name := range names {
+			if strings.Contains(ua, name[0]) {
+				return name[1]
+			}
+		}
+		return ""
+	}
+	family, platform := match(browserFamilies), match(browserPlatforms)
+	if family == "" && platform == "" {
+		return strings.TrimSpace(versionRegex.ReplaceAllString(ua, ""))
+	}
+	return family + "/" + platform
+}
+
+var versionRegex = regexp.MustCompile(`[0-9][0-9._]*`)
+
 // Basic user session info
 type sessionInfo struct {
 	ID       int64  `json:"id"`
@@ -27,6 +94,10 @@ type sessionInfo struct {
 	Email    string `json:"email"`
 	IsAdmin  bool   `json:"isAdmin"`
 	LoggedIn bool   `json:"loggedIn"`
+	Timezone string `json:"timezone"`
+
+	// the admin acting as the user, see impersonation.go
+	Impersonator *impersonator `json:"impersonator,omitempty"`
 }
 
 func newSessionInfo(user *user) *sessionInfo {
@@ -34,11 +105,11 @@ func newSessionInfo(user *user) *sessionInfo {
 		return &sessionInfo{}
 	}
 
-	return &sessionInfo{user.ID, user.Name, user.Email, user.IsAdmin, true}
+	return &sessionInfo{user.ID, user.Name, user.Email, user.IsAdmin, true, user.location().String(), user.Impersonator}
 }
 
 func newSessionManager(cfg *config) (sessionManager, error) {
-	mgr := &defaultSessionManager{}
+	mgr := &defaultSessionManager{sessionBinding: sessionBinding(cfg.SessionBinding)}
 	var err error
 	mgr.signKey, err = ioutil.ReadFile(cfg.PrivateKey)
 	if err != nil {
@@ -52,13 +123,14 @@ func newSessionManager(cfg *config) (sessionManager, error) {
 }
 
 type defaultSessionManager struct {
+	sessionBinding
 	verifyKey, signKey []byte
 }
 
-func (m *defaultSessionManager) readToken(r *http.Request) (int64, error) {
+func (m *defaultSessionManager) readToken(r *http.Request) (int64, string, error) {
 	tokenString := r.Header.Get(tokenHeader)
 	if tokenString == "" {
-		return 0, nil
+		return 0, "", nil
 	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return m.verifyKey, nil
@@ -66,24 +138,26 @@ func (m *defaultSessionManager) readToken(r *http.Request) (int64, error) {
 	switch err.(type) {
 	case nil:
 		if !token.Valid {
-			return 0, nil
+			return 0, "", nil
 		}
-		token := token.Claims["uid"].(string)
-		userID, err := strconv.ParseInt(token, 10, 0)
+		uid, _ := token.Claims["uid"].(string)
+		userID, err := strconv.ParseInt(uid, 10, 0)
 		if err != nil {
-			return 0, nil
+			return 0, "", nil
 		}
-		return userID, nil
+		sessionKey, _ := token.Claims["sid"].(string)
+		return userID, sessionKey, nil
 	case *jwt.ValidationError:
-		return 0, nil
+		return 0, "", nil
 	default:
-		return 0, errgo.Mask(err)
+		return 0, "", errgo.Mask(err)
 	}
 }
 
-func (m *defaultSessionManager) createToken(userID int64) (string, error) {
+func (m *defaultSessionManager) createToken(userID int64, sessionKey string) (string, error) {
 	token := jwt.New(jwt.GetSigningMethod("RS256"))
 	token.Claims["uid"] = strconv.FormatInt(userID, 10)
+	token.Claims["sid"] = sessionKey
 	token.Claims["exp"] = time.Now().Add(time.Minute * expiry).Unix()
 	tokenString, err := token.SignedString(m.signKey)
 	if err != nil {
@@ -92,8 +166,8 @@ func (m *defaultSessionManager) createToken(userID int64) (string, error) {
 	return tokenString, nil
 }
 
-func (m *defaultSessionManager) writeToken(w http.ResponseWriter, userID int64) error {
-	tokenString, err := m.createToken(userID)
+func (m *defaultSessionManager) writeToken(w http.ResponseWriter, userID int64, sessionKey string) error {
+	tokenString, err := m.createToken(userID, sessionKey)
 	if err != nil {
 		return err
 	}
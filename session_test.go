@@ -0,0 +1,127 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSessionBinding(t *testing.T) {
+	s := &session{IP: "10.0.0.1", UserAgent: "firefox"}
+
+	request := func(ip, userAgent string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("User-Agent", userAgent)
+		return req
+	}
+
+	if !sessionBindingOff.allows(s, request("10.0.0.2", "chrome")) {
+		t.Error("Expected sessions not to be bound with binding off")
+	}
+	if !sessionBindingLax.allows(s, request("10.0.0.2", "firefox")) || sessionBindingLax.allows(s, request("10.0.0.1", "chrome")) {
+		t.Error("Expected sessions to be bound to the user agent")
+	}
+	if !sessionBindingStrict.allows(s, request("10.0.0.1", "firefox")) || sessionBindingStrict.allows(s, request("10.0.0.2", "firefox")) {
+		t.Error("Expected sessions to be bound to the user agent and IP address")
+	}
+
+	s.UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:130.0) Gecko/20100101 Firefox/130.0"
+	if !sessionBindingLax.allows(s, request("10.0.0.1",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0")) {
+		t.Error("Expected sessions to outlast browser updates")
+	}
+	if sessionBindingLax.allows(s, request("10.0.0.1",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.6; rv:131.0) Gecko/20100101 Firefox/131.0")) {
+		t.Error("Expected sessions to be bound to the platform")
+	}
+	if sessionBindingLax.allows(s, request("10.0.0.1", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) "+
+		"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.0.0")) {
+		t.Error("Expected sessions to be bound to the browser")
+	}
+	if sessionBindingStrict.allows(s, request("10.0.0.1",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0")) {
+		t.Error("Expected strict sessions to be bound to the exact user agent")
+	}
+}
+
+func TestBrowserFingerprint(t *testing.T) {
+	for ua, expected := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36":                         "chrome/windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1": "safari/ios",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.6668.81 Mobile Safari/537.36":                        "chrome/android",
+		"curl/8.5.0": "curl/",
+	} {
+		if fingerprint := browserFingerprint(ua); fingerprint != expected {
+			t.Errorf("%s: expected %s, got %s", ua, expected, fingerprint)
+		}
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+	app.session = &fakeSessionManager{sessionBindingLax}
+
+	owner := &user{Name: "owner", Email: "owner@example.com"}
+	if err := owner.changePassword("password"); err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loggedIn := func(token, userAgent string) bool {
+		req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+		req.Header.Set(tokenHeader, token)
+		req.Header.Set("User-Agent", userAgent)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return strings.Contains(res.Body.String(), `"loggedIn":true`)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		req.Header.Set(tokenHeader, token)
+		req.Header.Set("User-Agent", "firefox")
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send("POST", "/api/auth/", oldToken, `{"identifier": "owner", "password": "password"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	token := res.Header().Get(tokenHeader)
+	if loggedIn(oldToken, "firefox") || !loggedIn(token, "firefox") {
+		t.Error("Expected the session before login to be replaced")
+	}
+
+	res = send("POST", "/api/auth/", "", `{"identifier": "owner", "password": "password"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	otherToken := res.Header().Get(tokenHeader)
+
+	res = send("PUT", "/api/auth/changepass", token, `{"password": "new password"}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	rotated := res.Header().Get(tokenHeader)
+	if rotated == "" || rotated == token {
+		t.Fatalf("Expected a new token, got %q", rotated)
+	}
+	if loggedIn(token, "firefox") || !loggedIn(rotated, "firefox") {
+		t.Error("Expected the old key to be replaced by the new one")
+	}
+	if loggedIn(otherToken, "firefox") {
+		t.Error("Expected the other sessions of the user to be ended")
+	}
+	if loggedIn(rotated, "chrome") {
+		t.Error("Expected the session to be refused to another browser")
+	}
+}
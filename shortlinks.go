@@ -0,0 +1,98 @@
+package photoshare
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+// Photos are shared with compact URLs, /p/{code}, redirecting to the
+// photo. The code is made at random the first time the shortlink of a
+// photo is asked for, and the owner sees how many times it was followed.
+
+const (
+	shortcodeLength     = 7
+	shortcodeCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shortcodeAttempts   = 3
+)
+
+// returns a random base62 code
+func generateShortcode() (string, error) {
+	code := make([]byte, shortcodeLength)
+	max := big.NewInt(int64(len(shortcodeCharacters)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortcodeCharacters[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// returns the shortlink of the photo, creating it if it has none
+func getOrCreateShortlink(ctx *context, photoID int64) (*shortlink, error) {
+
+	link, err := ctx.datamapper.getShortlink(photoID)
+	if err == nil || !isErrSqlNoRows(err) {
+		return link, err
+	}
+
+	for i := 0; ; i++ {
+		code, err := generateShortcode()
+		if err != nil {
+			return nil, err
+		}
+		link = &shortlink{Code: code, PhotoID: photoID}
+		if err = ctx.datamapper.createShortlink(link); err == nil {
+			return link, nil
+		}
+		// another request may have created it first, else the code was taken
+		if existing, e := ctx.datamapper.getShortlink(photoID); e == nil {
+			return existing, nil
+		}
+		if i == shortcodeAttempts-1 {
+			return nil, err
+		}
+	}
+}
+
+func getShortlink(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	link, err := getOrCreateShortlink(ctx, photo.ID)
+	if err != nil {
+		return err
+	}
+
+	result := &struct {
+		Code   string `json:"code"`
+		URL    string `json:"url"`
+		Clicks *int64 `json:"clicks,omitempty"`
+	}{
+		Code: link.Code,
+		URL:  fmt.Sprintf("%s/p/%s", getBaseURL(r), link.Code),
+	}
+	if photo.OwnerID == ctx.userID() {
+		result.Clicks = &link.Clicks
+	}
+	return renderJSON(w, result, http.StatusOK)
+}
+
+// counts the click and redirects to the photo
+func followShortlink(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	link, err := ctx.datamapper.followShortlink(ctx.params.get("code"))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, fmt.Sprintf("/#/detail/%d", link.PhotoID), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,80 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShortlinks(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "heron", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost"+url, nil)
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	type result struct {
+		Code   string `json:"code"`
+		URL    string `json:"url"`
+		Clicks *int64 `json:"clicks"`
+	}
+	getShortlink := func(token string) *result {
+		res := get(fmt.Sprintf("/api/photos/%d/shortlink", p.ID), token)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+		}
+		link := &result{}
+		if err := json.NewDecoder(res.Body).Decode(link); err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	link := getShortlink("")
+	if len(link.Code) != shortcodeLength || link.URL != "http://localhost/p/"+link.Code {
+		t.Errorf("Unexpected shortlink %+v", link)
+	}
+	if link.Clicks != nil {
+		t.Error("Clicks should only be shown to the owner")
+	}
+
+	for i := 0; i < 2; i++ {
+		res := get("/p/"+link.Code, "")
+		if res.Code != http.StatusFound || res.Header().Get("Location") != fmt.Sprintf("/#/detail/%d", p.ID) {
+			t.Errorf("Expected a redirect to the photo, got %d %s", res.Code, res.Header().Get("Location"))
+		}
+	}
+
+	owned := getShortlink(ownerToken)
+	if owned.Code != link.Code {
+		t.Errorf("Photo should keep its code %s, got %s", link.Code, owned.Code)
+	}
+	if owned.Clicks == nil || *owned.Clicks != 2 {
+		t.Errorf("Expected 2 clicks, got %v", owned.Clicks)
+	}
+
+	if res := get("/p/unknown", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown code, got %d", res.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package photoshare
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One deployment can host several independent sites, each with its own
+// users, photos, tags and feeds. The site of a request is found from its
+// host name; a site with an empty host name serves any other host.
+
+const defaultSiteID = 1
+
+// how often the list of sites is reloaded
+const sitesRefresh = 30 * time.Second
+
+var errUnknownSite = httpError{http.StatusNotFound, "Unknown site"}
+
+type siteResolver interface {
+	resolve(string) (*site, error)
+}
+
+func newSiteResolver(datamapper dataMapper) siteResolver {
+	return &defaultSiteResolver{datamapper: datamapper}
+}
+
+type defaultSiteResolver struct {
+	sync.Mutex
+	datamapper dataMapper
+	sites      map[string]*site
+	loadedAt   time.Time
+}
+
+// returns the site for the host name of a request
+func (r *defaultSiteResolver) resolve(host string) (*site, error) {
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.sites == nil || time.Since(r.loadedAt) > sitesRefresh {
+		sites, err := r.datamapper.getSites()
+		if err != nil {
+			return nil, err
+		}
+		r.sites = make(map[string]*site)
+		for i := range sites {
+			r.sites[strings.ToLower(sites[i].Hostname)] = &sites[i]
+		}
+		r.loadedAt = time.Now()
+	}
+
+	if site, ok := r.sites[host]; ok {
+		return site, nil
+	}
+	if site, ok := r.sites[""]; ok {
+		return site, nil
+	}
+	return nil, errUnknownSite
+}
+
+// finds a site by its exact host name, for admin commands
+func findSite(app *app, hostname string) (*site, error) {
+	sites, err := app.datamapper.getSites()
+	if err != nil {
+		return nil, err
+	}
+	for i := range sites {
+		if strings.EqualFold(sites[i].Hostname, hostname) {
+			return &sites[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no site with host name %q", hostname)
+}
+
+// prefixes cache keys with the site, so pages of one site are never served
+// to another
+type siteCache struct {
+	cache
+	siteID int64
+}
+
+func (c *siteCache) key(key string) string {
+	return fmt.Sprintf("site:%d:%s", c.siteID, key)
+}
+
+func (c *siteCache) set(key string, obj interface{}) ([]byte, error) {
+	return c.cache.set(c.key(key), obj)
+}
+
+func (c *siteCache) get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return c.cache.get(c.key(key), fn)
+}
+
+func (c *siteCache) render(w http.ResponseWriter, status int, key string, fn func() (interface{}, error)) error {
+	return c.cache.render(w, status, c.key(key), fn)
+}
+
+func getSite(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return renderJSON(w, ctx.site, http.StatusOK)
+}
@@ -0,0 +1,34 @@
+package photoshare
+
+import (
+	"testing"
+)
+
+type sitesDataMapper struct {
+	mockDataMapper
+}
+
+func (m *sitesDataMapper) getSites() ([]site, error) {
+	return []site{
+		{ID: 1, Name: "Default", Hostname: ""},
+		{ID: 2, Name: "Birds", Hostname: "birds.example.com"},
+	}, nil
+}
+
+func TestResolveSite(t *testing.T) {
+	r := newSiteResolver(&sitesDataMapper{})
+	for _, tc := range []struct {
+		host string
+		id   int64
+	}{
+		{"birds.example.com", 2},
+		{"Birds.Example.com:8080", 2},
+		{"example.com", 1},
+		{"localhost:5000", 1},
+	} {
+		s, err := r.resolve(tc.host)
+		if err != nil || s.ID != tc.id {
+			t.Errorf("%s: expected site %d, got %v (%v)", tc.host, tc.id, s, err)
+		}
+	}
+}
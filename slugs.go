@@ -0,0 +1,141 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Users may pick a slug for a profile URL, /u/{slug}, and for each album of
+// their portfolio. Previous slugs are kept, so old links redirect to the
+// current URL; the previous slugs of a user are reserved for them.
+
+const (
+	minSlugLength = 3
+	maxSlugLength = 40
+)
+
+var (
+	slugRegex   = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	digitsRegex = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// returns true for lower case letters, digits and single dashes; digits
+// alone are left for IDs
+func validateSlug(slug string) bool {
+	return len(slug) >= minSlugLength && len(slug) <= maxSlugLength &&
+		slugRegex.MatchString(slug) && !digitsRegex.MatchString(slug)
+}
+
+// returns the slug given, or nil if it is blank
+func normalizeSlug(slug *string) *string {
+	if slug == nil {
+		return nil
+	}
+	s := strings.ToLower(strings.TrimSpace(*slug))
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// redirects permanently to the named route
+func redirectRoute(ctx *context, w http.ResponseWriter, r *http.Request, name string, pairs ...string) error {
+	url, err := ctx.router.Get(name).URL(pairs...)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+	return nil
+}
+
+// returns the user with the slug in the URL. A previous slug redirects to
+// the named route with the current slug, and the other pairs, returning nil.
+func getSlugUser(ctx *context, w http.ResponseWriter, r *http.Request, route string, pairs ...string) (*user, error) {
+
+	slug := ctx.params.get("slug")
+
+	user, err := ctx.datamapper.getUserBySlug(slug)
+	if err == nil || !isErrSqlNoRows(err) {
+		return user, err
+	}
+
+	user, err = ctx.datamapper.getUserByPreviousSlug(slug)
+	if err != nil {
+		return nil, err
+	}
+	if user.Slug == nil {
+		return nil, httpError{http.StatusNotFound, "Not found"}
+	}
+	return nil, redirectRoute(ctx, w, r, route, append([]string{"slug", *user.Slug}, pairs...)...)
+}
+
+func changeSlug(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Slug *string `json:"slug"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	oldSlug := ctx.user.Slug
+	slug := normalizeSlug(s.Slug)
+
+	if slug == nil && oldSlug == nil || slug != nil && oldSlug != nil && *slug == *oldSlug {
+		return renderJSON(w, newProfile(ctx.user), http.StatusOK)
+	}
+
+	if slug != nil {
+		if !validateSlug(*slug) {
+			return validationFailure{map[string]string{"slug": "Slug must be 3 to 40 lower case letters, digits or dashes"}}
+		}
+		ctx.user.Slug = slug
+		ok, err := ctx.datamapper.isUserSlugAvailable(ctx.user)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return validationFailure{map[string]string{"slug": "Slug already taken"}}
+		}
+	}
+	ctx.user.Slug = slug
+
+	if err := ctx.datamapper.changeUserSlug(ctx.user, oldSlug); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, newProfile(ctx.user), http.StatusOK)
+}
+
+// returns the public profile for a slug
+func getSlugProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	user, err := getSlugUser(ctx, w, r, "slugProfile")
+	if err != nil || user == nil {
+		return err
+	}
+	return renderProfile(ctx, w, user)
+}
+
+// sends the short profile URL on to the profile page of the frontend
+func redirectSlug(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	slug := ctx.params.get("slug")
+
+	user, err := ctx.datamapper.getUserBySlug(slug)
+	if isErrSqlNoRows(err) {
+		user, err = ctx.datamapper.getUserByPreviousSlug(slug)
+	}
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/#/user/%d/%s", user.ID, user.Name), http.StatusFound)
+	return nil
+}
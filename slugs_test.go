@@ -0,0 +1,124 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateSlug(t *testing.T) {
+	for slug, valid := range map[string]bool{
+		"jane":         true,
+		"jane-doe-2":   true,
+		"ja":           false,
+		"123":          false,
+		"jane--doe":    false,
+		"-jane":        false,
+		"Jane":         false,
+		"jane_doe":     false,
+		"2024-travels": true,
+	} {
+		if validateSlug(slug) != valid {
+			t.Errorf("Expected %q valid=%v", slug, valid)
+		}
+	}
+}
+
+func TestSlugs(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	ownerToken, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &user{Name: "other", Email: "other@localhost"}
+	otherToken, err := dm.login(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "heron", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := send("PUT", "/api/user/slug", ownerToken, `{"slug": "no way"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid slug, got %d", res.Code)
+	}
+	if res := send("PUT", "/api/user/slug", ownerToken, `{"slug": "Jane"}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := send("PUT", "/api/user/slug", ownerToken, `{"slug": "jane-doe"}`); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	// previous slugs are kept for their owner
+	if res := send("PUT", "/api/user/slug", otherToken, `{"slug": "jane"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Previous slug of another user should be taken, got %d", res.Code)
+	}
+
+	if res := send("GET", "/api/u/jane-doe", "", ""); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"name":"owner"`) {
+		t.Errorf("Expected the profile, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := send("GET", "/api/u/jane/portfolio", "", ""); res.Code != http.StatusMovedPermanently ||
+		res.Header().Get("Location") != "/api/u/jane-doe/portfolio" {
+		t.Errorf("Expected a redirect to the current slug, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+	if res := send("GET", "/u/jane", "", ""); res.Code != http.StatusFound ||
+		res.Header().Get("Location") != fmt.Sprintf("/#/user/%d/owner", owner.ID) {
+		t.Errorf("Expected a redirect to the profile page, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+	if res := send("GET", "/api/u/nobody", "", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown slug, got %d", res.Code)
+	}
+
+	body := fmt.Sprintf(`{"albums": [{"title": "Birds", "slug": "birds", "photoIds": [%d]}, {"title": "More", "slug": "birds"}]}`, p.ID)
+	if res := send("PUT", "/api/user/portfolio", ownerToken, body); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for albums with the same slug, got %d", res.Code)
+	}
+	body = fmt.Sprintf(`{"albums": [{"title": "Birds", "slug": "birds", "photoIds": [%d]}]}`, p.ID)
+	if res := send("PUT", "/api/user/portfolio", ownerToken, body); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	albumID := dm.portfolios[owner.ID][0].ID
+
+	body = fmt.Sprintf(`{"albums": [{"id": %d, "title": "Birds", "slug": "water-birds", "photoIds": [%d]}]}`, albumID, p.ID)
+	if res := send("PUT", "/api/user/portfolio", ownerToken, body); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if id := dm.portfolios[owner.ID][0].ID; id != albumID {
+		t.Errorf("Album should keep its ID %d, got %d", albumID, id)
+	}
+
+	for _, url := range []string{
+		"/api/u/jane-doe/albums/water-birds",
+		fmt.Sprintf("/api/users/%d/albums/%d", owner.ID, albumID),
+	} {
+		if res := send("GET", url, "", ""); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"title":"Birds"`) {
+			t.Errorf("%s: expected the album, got %d: %s", url, res.Code, res.Body.String())
+		}
+	}
+	if res := send("GET", "/api/u/jane/albums/birds", "", ""); res.Code != http.StatusMovedPermanently ||
+		res.Header().Get("Location") != "/api/u/jane-doe/albums/birds" {
+		t.Errorf("Expected a redirect to the current user slug, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+	if res := send("GET", "/api/u/jane-doe/albums/birds", "", ""); res.Code != http.StatusMovedPermanently ||
+		res.Header().Get("Location") != "/api/u/jane-doe/albums/water-birds" {
+		t.Errorf("Expected a redirect to the current album slug, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+}
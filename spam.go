@@ -0,0 +1,117 @@
+package photoshare
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Uploads are scored for spam from the recent uploads of the owner and the
+// links in the title. Suspicious uploads are held until an admin approves
+// them, and the most suspicious are refused so bots are slowed down.
+
+const (
+	// scores at which uploads are held or refused
+	spamHoldScore   = 50
+	spamRejectScore = 100
+
+	// uploads with the same title within this time count as duplicates
+	spamDuplicateWindow = 24 * time.Hour
+
+	// uploads within this time beyond spamBurstUploads count as a burst
+	spamBurstWindow  = 10 * time.Minute
+	spamBurstUploads = 10
+)
+
+var linkRegex = regexp.MustCompile(`(?i)https?://|www\.`)
+
+// what is known of an upload and its owner's recent uploads
+type spamSignals struct {
+	DuplicateTitles int64 `db:"duplicate_titles"`
+	RecentUploads   int64 `db:"recent_uploads"`
+	Links           int   `db:"-"`
+}
+
+// e.g. a title with a link is held when uploaded twice in a day, and any
+// title is refused when uploaded six times
+func (s *spamSignals) score() int {
+	score := 20*int(s.DuplicateTitles) + 30*s.Links
+	if s.RecentUploads >= spamBurstUploads {
+		score += 10 * int(s.RecentUploads-spamBurstUploads+1)
+	}
+	return score
+}
+
+// scores the photo before it is stored, refusing it if the score is too
+// high and marking it held if suspicious. Uploads by admins are trusted.
+func checkSpam(ctx *context, photo *photo) error {
+
+	if ctx.user.IsAdmin {
+		return nil
+	}
+
+	signals, err := ctx.datamapper.getSpamSignals(photo.OwnerID, photo.Title)
+	if err != nil {
+		return err
+	}
+	signals.Links = len(linkRegex.FindAllString(photo.Title, -1))
+
+	photo.SpamScore = signals.score()
+
+	if photo.SpamScore >= spamRejectScore {
+		return httpError{http.StatusTooManyRequests, "Too many suspicious uploads, please try again later"}
+	}
+	if photo.SpamScore >= spamHoldScore {
+		now := utcNow()
+		photo.HeldAt = &now
+	}
+	return nil
+}
+
+// returns the photos held for review, most suspicious first
+func getHeldPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	photos, err := ctx.datamapper.getHeldPhotos(getPage(r))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photos, http.StatusOK)
+}
+
+// publishes a held photo. Held photos are rejected by deleting them.
+func approvePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if photo.HeldAt == nil {
+		return httpError{http.StatusBadRequest, "Photo is not held for review"}
+	}
+
+	photo.HeldAt = nil
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(ctx, "approve_photo", photo.ID, ""); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	owner, err := ctx.datamapper.getActiveUser(photo.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	if isFederated(ctx.app, owner) {
+		go deliverPhoto(ctx.app, owner, photo, getBaseURL(r))
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{owner.Name, "", photo.ID, "photo_uploaded"})
+	return renderJSON(w, photo, http.StatusOK)
+}
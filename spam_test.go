@@ -0,0 +1,102 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+)
+
+func TestSpamScore(t *testing.T) {
+	for _, tc := range []struct {
+		signals spamSignals
+		score   int
+	}{
+		{spamSignals{}, 0},
+		{spamSignals{DuplicateTitles: 2, Links: 1}, 70},
+		{spamSignals{RecentUploads: spamBurstUploads - 1}, 0},
+		{spamSignals{RecentUploads: spamBurstUploads + 4}, 50},
+		{spamSignals{DuplicateTitles: 5}, 100},
+	} {
+		if score := tc.signals.score(); score != tc.score {
+			t.Errorf("%+v: expected %d, got %d", tc.signals, tc.score, score)
+		}
+	}
+}
+
+func newUploadRequest(title, token string) *http.Request {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("title", title)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="photo"; filename="test.png"`)
+	h.Set("Content-Type", "image/png")
+	part, _ := form.CreatePart(h)
+	part.Write([]byte("not really a png"))
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/photos/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(tokenHeader, token)
+	return req
+}
+
+func TestUploadSpam(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken, err := dm.login(&user{Name: "admin", Email: "admin@localhost", IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const title = "Cheap watches at www.example.com"
+
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, newUploadRequest(title, token))
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	first := &photo{}
+	parseJSONBody(res, first)
+	if first.HeldAt != nil {
+		t.Error("A single link should not hold the upload")
+	}
+
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, newUploadRequest(title, token))
+	held := &photo{}
+	parseJSONBody(res, held)
+	if res.Code != http.StatusCreated || held.HeldAt == nil {
+		t.Fatalf("Repeated upload should be held, got %d: %s", res.Code, res.Body.String())
+	}
+
+	for i := 0; i < 3; i++ {
+		res = httptest.NewRecorder()
+		app.router.ServeHTTP(res, newUploadRequest(title, token))
+	}
+	if res.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", res.Code)
+	}
+
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/admin/photos/%d/approve", held.ID), nil)
+	req.Header.Set(tokenHeader, adminToken)
+	res = httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if p, _ := dm.getPhoto(held.ID); p.HeldAt != nil {
+		t.Error("Approved photo should not be held")
+	}
+}
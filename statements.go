@@ -0,0 +1,202 @@
+package photoshare
+
+import (
+	"database/sql"
+	"github.com/coopernurse/gorp"
+	"github.com/juju/errgo"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The hot queries of photo lists, searches and photo details run as
+// prepared statements, so PostgreSQL parses and plans them once per
+// connection rather than on every request. gorp only runs SQL text, so their
+// rows are scanned here into the fields of the db tags, calling the PostGet
+// hooks, as gorp does.
+
+// searches give a statement for each combination of their terms, so past
+// this many statements the others run unprepared
+const maxPreparedStatements = 500
+
+// prepared statements of a database by SQL
+type statementCache struct {
+	sync.Mutex
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+func newStatementCache(db *sql.DB) *statementCache {
+	return &statementCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// returns the prepared statement of the query, or nil if the cache is full
+func (c *statementCache) prepare(query string) (*sql.Stmt, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	if len(c.stmts) >= maxPreparedStatements {
+		return nil, nil
+	}
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// column indexes of the fields of struct types, see fieldIndexes
+var columnFieldIndexes sync.Map
+
+// returns the index of the field of each column of the struct type. As with
+// gorp, fields of embedded structs are included, and the column of a field
+// without a db tag is its name.
+func fieldIndexes(t reflect.Type) map[string][]int {
+	if indexes, ok := columnFieldIndexes.Load(t); ok {
+		return indexes.(map[string][]int)
+	}
+
+	indexes := make(map[string][]int)
+	var walk func(t reflect.Type, parent []int)
+	walk = func(t reflect.Type, parent []int) {
+		var embedded []int
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				embedded = append(embedded, i)
+				continue
+			}
+			column := f.Tag.Get("db")
+			if column == "-" || f.PkgPath != "" {
+				continue
+			}
+			if column == "" {
+				column = f.Name
+			}
+			// fields of the outer struct win over embedded ones
+			if _, ok := indexes[strings.ToLower(column)]; !ok {
+				indexes[strings.ToLower(column)] = append(append([]int{}, parent...), i)
+			}
+		}
+		for _, i := range embedded {
+			walk(t.Field(i).Type, append(append([]int{}, parent...), i))
+		}
+	}
+	walk(t, nil)
+
+	columnFieldIndexes.Store(t, indexes)
+	return indexes
+}
+
+// returns the fields of the struct to scan the columns into, discarding
+// columns without a field
+func scanFields(row reflect.Value, columns []string) []interface{} {
+	indexes := fieldIndexes(row.Type())
+	fields := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if index, ok := indexes[strings.ToLower(column)]; ok {
+			fields[i] = row.FieldByIndex(index).Addr().Interface()
+		} else {
+			fields[i] = new(interface{})
+		}
+	}
+	return fields
+}
+
+// calls the PostGet hook of the row, if it has one
+func (d *defaultDataMapper) postGet(row reflect.Value) error {
+	if hook, ok := row.Addr().Interface().(gorp.HasPostGet); ok {
+		return hook.PostGet(d.DbMap)
+	}
+	return nil
+}
+
+// runs the query as a prepared statement, unless the data mapper has no
+// statement cache or it is full
+func (d *defaultDataMapper) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if d.stmts != nil {
+		stmt, err := d.stmts.prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		if stmt != nil {
+			return stmt.Query(args...)
+		}
+	}
+	return d.Db.Query(query, args...)
+}
+
+// appends the rows of the query to the slice of structs
+func (d *defaultDataMapper) selectPrepared(dest interface{}, query string, args ...interface{}) error {
+	rows, err := d.query(query, args...)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	slice := reflect.ValueOf(dest).Elem()
+	for rows.Next() {
+		row := reflect.New(slice.Type().Elem()).Elem()
+		if err := rows.Scan(scanFields(row, columns)...); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := d.postGet(row); err != nil {
+			return errgo.Mask(err)
+		}
+		slice.Set(reflect.Append(slice, row))
+	}
+	return errgo.Mask(rows.Err())
+}
+
+// scans the first row of the query into the struct, returning
+// sql.ErrNoRows if there is none
+func (d *defaultDataMapper) selectOnePrepared(dest interface{}, query string, args ...interface{}) error {
+	rows, err := d.query(query, args...)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return errgo.Mask(err)
+		}
+		return sql.ErrNoRows
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	row := reflect.ValueOf(dest).Elem()
+	if err := rows.Scan(scanFields(row, columns)...); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(d.postGet(row))
+}
+
+// returns the integer of the query, such as a count
+func (d *defaultDataMapper) selectIntPrepared(query string, args ...interface{}) (int64, error) {
+	rows, err := d.query(query, args...)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	var n sql.NullInt64
+	if rows.Next() {
+		if err := rows.Scan(&n); err != nil {
+			return 0, errgo.Mask(err)
+		}
+	}
+	return n.Int64, errgo.Mask(rows.Err())
+}
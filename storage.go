@@ -1,9 +1,12 @@
 package photoshare
 
 import (
+	"bytes"
 	"code.google.com/p/graphics-go/graphics"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"github.com/dchest/uniuri"
 	"github.com/disintegration/gift"
 	"github.com/juju/errgo"
 	"image"
@@ -11,8 +14,12 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 )
 
 const (
@@ -25,6 +32,12 @@ type readable interface {
 	io.Seeker
 }
 
+// an opened upload, seekable so that it can be served in ranges
+type readableFile interface {
+	readable
+	io.Closer
+}
+
 var allowedContentTypes = []string{
 	"image/png",
 	"image/jpeg",
@@ -40,64 +53,144 @@ func isAllowedContentType(contentType string) bool {
 	return false
 }
 
-func generateRandomFilename(contentType string) string {
+// extensions of the stored files by their type
+var contentTypeExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
 
-	var ext string
+var errNoStorageNameKey = errors.New("no key to name stored files")
 
-	switch contentType {
-	case "image/jpeg":
+// Files are named by their contents: the HMAC-SHA256 of the file under
+// STORAGE_NAME_KEY, so that names can't be told from the contents, in hex,
+// with the extension of the type sniffed from the file rather than the one
+// given by the client. The same file uploaded again is stored once (see
+// storeChecked), and removed only once no photo of any site uses it (see
+// cleanUnusedFile).
+func contentFilename(cfg *config, src readable, contentType string) (string, error) {
 
-		ext = ".jpg"
-	case "image/png":
-		ext = ".png"
+	if cfg.StorageNameKey == "" {
+		return "", errNoStorageNameKey
+	}
 
-	case "image/gif":
-		ext = ".gif"
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", errgo.Mask(err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", errgo.Mask(err)
 	}
 
-	return uniuri.New() + ext
-}
+	h := hmac.New(sha256.New, []byte(cfg.StorageNameKey))
+	if _, err := io.Copy(h, src); err != nil {
+		return "", errgo.Mask(err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", errgo.Mask(err)
+	}
 
-type fileStorage interface {
-	clean(string) error
-	store(readable, string, string) error
+	ext, ok := contentTypeExtensions[http.DetectContentType(head[:n])]
+	if !ok {
+		ext = contentTypeExtensions[contentType]
+	}
+	return hex.EncodeToString(h.Sum(nil)) + ext, nil
 }
 
-func newFileStorage(cfg *config) fileStorage {
-	return &defaultFileStorage{
-		cfg.UploadsDir,
-		cfg.ThumbnailsDir,
+// returns the key naming stored files when STORAGE_NAME_KEY is not set, an
+// HMAC of the private key signing the sessions, kept secret as well
+func deriveStorageNameKey(cfg *config) (string, error) {
+	privateKey, err := ioutil.ReadFile(cfg.PrivateKey)
+	if err != nil {
+		return "", errgo.Mask(err)
 	}
+	mac := hmac.New(sha256.New, privateKey)
+	mac.Write([]byte("storage names"))
+	return hex.EncodeToString(mac.Sum(nil)), nil
 }
 
-type defaultFileStorage struct {
-	uploadsDir, thumbnailsDir string
+// stores the file of a new photo and creates the photo, locking the file so
+// that it is not removed as unused in between by cleanUnusedFile
+func storePhotoFile(datamapper dataMapper, filestore fileStorage, src readable, photo *photo, contentType string,
+	create func() error) error {
+	return datamapper.withFileLock(photo.Filename, func() (err error) {
+		if photo.Checksum, err = storeChecked(filestore, src, photo.Filename, contentType); err != nil {
+			return err
+		}
+		return create()
+	})
 }
 
-func (f *defaultFileStorage) clean(name string) error {
+// removes the file unless a photo still uses it, as photos of the same
+// contents share their file. The file is locked while checked and removed,
+// so that a photo of it being created meanwhile keeps it.
+func cleanUnusedFile(datamapper dataMapper, filestore fileStorage, name string) error {
+	return datamapper.withFileLock(name, func() error {
+		used, err := datamapper.isFileUsed(name)
+		if err != nil || used {
+			return err
+		}
+		return filestore.clean(name)
+	})
+}
 
-	imagePath := path.Join(f.uploadsDir, name)
-	thumbnailPath := path.Join(f.thumbnailsDir, name)
+type fileStorage interface {
+	clean(string) error
+	store(readable, string, string) error
+	list() ([]string, error)
+	open(string) (readableFile, error)
+	openThumbnail(string) (readableFile, error)
+}
 
-	if err := os.Remove(imagePath); err != nil {
-		return errgo.Mask(err)
+// makes thumbnails of uploaded images
+type imageProcessor interface {
+	thumbnail(io.Reader, io.Writer, string) error
+}
+
+// returns the storage of the uploads directory, copied to STORAGE_REPLICA
+// if set (see replication.go), and encrypted if STORAGE_MASTER_KEY is set
+// (see encryption.go)
+func newFileStorage(cfg *config) (fileStorage, error) {
+	processor := newImageProcessor(cfg)
+	sealer, err := newSealer(cfg)
+	if err != nil {
+		return nil, err
 	}
-	if err := os.Remove(thumbnailPath); err != nil {
-		return errgo.Mask(err)
+	store := &defaultFileStorage{
+		cfg.UploadsDir,
+		cfg.ThumbnailsDir,
+		cfg.VariantsDir,
+		processor,
+		sealer,
 	}
-	return nil
+	if cfg.StorageReplica == "" {
+		return store, nil
+	}
+	replica, err := newReplicaStorage(cfg, processor, sealer)
+	if err != nil {
+		return nil, err
+	}
+	return newReplicatedStorage(store, replica), nil
 }
 
-func (f *defaultFileStorage) store(src readable, filename, contentType string) error {
-	if err := os.MkdirAll(f.uploadsDir, 0777); err != nil && !os.IsExist(err) {
-		return errgo.Mask(err)
+// returns the processor of IMAGE_PROCESSOR, or the Go processor if libvips
+// is wanted but not available (see vips.go)
+func newImageProcessor(cfg *config) imageProcessor {
+	if cfg.ImageProcessor == "vips" {
+		p, err := newVipsImageProcessor()
+		if err == nil {
+			return p
+		}
+		log.Println("Using the Go image processor:", err)
 	}
+	return &defaultImageProcessor{}
+}
 
-	if err := os.MkdirAll(f.thumbnailsDir, 0777); err != nil && !os.IsExist(err) {
-		return errgo.Mask(err)
-	}
+type defaultImageProcessor struct{}
+
+func (p *defaultImageProcessor) thumbnail(src io.Reader, dst io.Writer, contentType string) error {
 
-	// make thumbnail
 	var (
 		img image.Image
 		err error
@@ -127,20 +220,9 @@ func (f *defaultFileStorage) store(src readable, filename, contentType string) e
 	thumb := image.NewRGBA(image.Rect(0, 0, thumbnailWidth, thumbnailHeight))
 	graphics.Thumbnail(thumb, img)
 
-	dst, err := os.Create(path.Join(f.thumbnailsDir, filename))
-	if err != nil {
-		return errgo.Mask(err)
-	}
-
 	g := gift.New(gift.Contrast(-30))
 	g.Draw(thumb, thumb)
 
-	if err != nil {
-		return errgo.Mask(err)
-	}
-
-	defer dst.Close()
-
 	switch contentType {
 	case "image/png":
 		err = png.Encode(dst, thumb)
@@ -155,25 +237,176 @@ func (f *defaultFileStorage) store(src readable, filename, contentType string) e
 		err = gif.Encode(dst, thumb, nil)
 	}
 
-	if err != nil {
+	return errgo.Mask(err)
+}
+
+type defaultFileStorage struct {
+	uploadsDir, thumbnailsDir, variantsDir string
+	processor                              imageProcessor
+	sealer                                 *sealer // nil if not encrypted
+}
+
+func (f *defaultFileStorage) clean(name string) error {
+
+	imagePath := path.Join(f.uploadsDir, name)
+	thumbnailPath := path.Join(f.thumbnailsDir, name)
+
+	if err := os.Remove(imagePath); err != nil {
 		return errgo.Mask(err)
 	}
+	// the thumbnail may be missing, e.g. if thumbnailing failed
+	if err := os.Remove(thumbnailPath); err != nil && !os.IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	// WebP and AVIF files served in place of the image, see variants.go
+	variants, _ := filepath.Glob(path.Join(f.variantsDir, name+"-*"))
+	for _, variantPath := range variants {
+		if err := os.Remove(variantPath); err != nil && !os.IsNotExist(err) {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
 
-	src.Seek(0, 0)
+// opens the original uploaded file
+func (f *defaultFileStorage) open(name string) (readableFile, error) {
+	return f.read(path.Join(f.uploadsDir, path.Base(name)))
+}
 
-	dst, err = os.Create(path.Join(f.uploadsDir, filename))
+func (f *defaultFileStorage) openThumbnail(name string) (readableFile, error) {
+	return f.read(path.Join(f.thumbnailsDir, path.Base(name)))
+}
 
+// opens the file, decrypted in memory if encrypted
+func (f *defaultFileStorage) read(filePath string) (readableFile, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
+	if f.sealer == nil {
+		return file, nil
+	}
+	defer file.Close()
+	decrypted, err := f.sealer.openFrom(file)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return decrypted, nil
+}
 
-	defer dst.Close()
+// writes the file, encrypted if STORAGE_MASTER_KEY is set
+func (f *defaultFileStorage) write(filePath string, src io.Reader) error {
+	if f.sealer != nil {
+		body, err := f.sealer.sealFrom(src)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(ioutil.WriteFile(filePath, body, 0666))
+	}
 
-	_, err = io.Copy(dst, src)
+	dst, err := os.Create(filePath)
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	defer dst.Close()
 
+	if _, err := io.Copy(dst, src); err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
+}
 
+// returns the names of all uploaded files
+func (f *defaultFileStorage) list() ([]string, error) {
+	var names []string
+
+	files, err := ioutil.ReadDir(f.uploadsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return names, nil
+		}
+		return names, errgo.Mask(err)
+	}
+
+	for _, info := range files {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (f *defaultFileStorage) store(src readable, filename, contentType string) error {
+	if err := os.MkdirAll(f.uploadsDir, 0777); err != nil && !os.IsExist(err) {
+		return errgo.Mask(err)
+	}
+
+	if err := os.MkdirAll(f.thumbnailsDir, 0777); err != nil && !os.IsExist(err) {
+		return errgo.Mask(err)
+	}
+
+	// make thumbnail
+	thumb := &bytes.Buffer{}
+	if err := f.processor.thumbnail(src, thumb, contentType); err != nil {
+		return err
+	}
+	if err := f.write(path.Join(f.thumbnailsDir, filename), thumb); err != nil {
+		return err
+	}
+
+	src.Seek(0, 0)
+
+	return f.write(path.Join(f.uploadsDir, filename), src)
+}
+
+// encrypts the uploads and thumbnails stored before STORAGE_MASTER_KEY was
+// set, returning the number of uploads encrypted
+func (f *defaultFileStorage) encryptFiles() (int, error) {
+
+	if f.sealer == nil {
+		return 0, errors.New("STORAGE_MASTER_KEY is not set")
+	}
+	names, err := f.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var num int
+	for _, name := range names {
+		encrypted, err := f.encryptFile(path.Join(f.uploadsDir, name))
+		if err != nil {
+			return num, err
+		}
+		if _, err := f.encryptFile(path.Join(f.thumbnailsDir, name)); err != nil && !os.IsNotExist(err) {
+			return num, err
+		}
+		if encrypted {
+			num++
+		}
+	}
+	return num, nil
+}
+
+// replaces the file by its encrypted content, unless encrypted already
+func (f *defaultFileStorage) encryptFile(filePath string) (bool, error) {
+
+	body, err := ioutil.ReadFile(filePath)
+	if err != nil || isSealed(body) {
+		return false, err
+	}
+	sealed, err := f.sealer.seal(body)
+	if err != nil {
+		return false, err
+	}
+
+	// written aside, so that the file is never left half encrypted
+	tmpPath := path.Join(path.Dir(filePath), "."+path.Base(filePath)+".encrypting")
+	if err := ioutil.WriteFile(tmpPath, sealed, 0666); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	return true, nil
 }
@@ -0,0 +1,136 @@
+package photoshare
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a PNG signature, sniffed as image/png
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+func TestContentFilename(t *testing.T) {
+	cfg := &config{}
+
+	if _, err := contentFilename(cfg, strings.NewReader("image"), "image/jpeg"); err != errNoStorageNameKey {
+		t.Errorf("Expected files not named without a key, got %v", err)
+	}
+
+	cfg.StorageNameKey = "secret"
+	name, err := contentFilename(cfg, strings.NewReader("image"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HMAC-SHA256 of "image" under "secret"
+	if name != "23856515b888df7483f9cd21d38a6e064aff7fc2ca54a74c99d3949c1d69f28e.jpg" {
+		t.Errorf("Expected the HMAC of the file as its name, got %s", name)
+	}
+
+	name, err = contentFilename(cfg, strings.NewReader(pngHeader+"image"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(name, ".png") {
+		t.Errorf("Expected the extension of the sniffed type, got %s", name)
+	}
+	if other, _ := contentFilename(cfg, strings.NewReader(pngHeader+"other"), "image/png"); other == name {
+		t.Error("Expected files of other contents to be named apart")
+	}
+
+	cfg.StorageNameKey = "other"
+	if other, _ := contentFilename(cfg, strings.NewReader(pngHeader+"image"), "image/png"); other == name {
+		t.Error("Expected names under another key to differ")
+	}
+}
+
+func TestCleanUnusedFile(t *testing.T) {
+	dm := newMemoryDataMapper()
+	store := newMemoryFileStorage(&fakeImageProcessor{})
+
+	name, _ := contentFilename(&config{StorageNameKey: "secret"}, strings.NewReader("image"), "image/jpeg")
+	photos := []*photo{{OwnerID: 1, Filename: name}, {OwnerID: 2, Filename: name}}
+	for _, p := range photos {
+		sum, err := storeChecked(store, strings.NewReader("image"), name, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Checksum = sum
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dm.removePhoto(photos[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanUnusedFile(dm, store, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.open(name); err != nil {
+		t.Fatal("Expected the file kept for the other photo")
+	}
+
+	if err := dm.removePhoto(photos[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanUnusedFile(dm, store, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.open(name); err == nil {
+		t.Error("Expected the file removed with the last photo")
+	}
+}
+
+func TestCleanUnusedFileWhileStored(t *testing.T) {
+	dm := newMemoryDataMapper()
+	store := newMemoryFileStorage(&fakeImageProcessor{})
+
+	p := &photo{OwnerID: 1, Filename: "image.jpg"}
+	cleaned := make(chan error, 1)
+	err := storePhotoFile(dm, store, strings.NewReader("image"), p, "image/jpeg", func() error {
+		// the file is stored, but no photo uses it yet
+		go func() {
+			cleaned <- cleanUnusedFile(dm, store, p.Filename)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		return dm.createPhoto(p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-cleaned; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.open(p.Filename); err != nil {
+		t.Error("Expected the file kept for the photo created meanwhile")
+	}
+}
+
+func TestCleanWithoutThumbnail(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &defaultFileStorage{dir, path.Join(dir, "thumbnails"), path.Join(dir, "variants"), &fakeImageProcessor{}, nil}
+	if err := os.Mkdir(store.variantsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "variants/a.jpg-640.webp"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte("image"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.clean("a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "variants/a.jpg-640.webp")); !os.IsNotExist(err) {
+		t.Error("Expected the variant removed")
+	}
+}
@@ -0,0 +1,97 @@
+package photoshare
+
+import (
+	"net/http"
+	"time"
+)
+
+// Offline clients keep their copy of the site's photos in step with
+// GET /api/sync?since=CHECKPOINT, which returns the photos created and
+// updated since the checkpoint of the previous sync, and the ids of photos
+// deleted or hidden from the user since, with the checkpoint of the next
+// sync. Without since, every photo is returned, a page at a time.
+
+const (
+	syncPageSize = 500
+
+	// changes made this long before a sync are returned again by the next,
+	// in case transactions still running commit changes made earlier
+	syncMargin = time.Minute
+)
+
+type syncResult struct {
+	Created    []photoDetail `json:"created"`
+	Updated    []photoDetail `json:"updated"`
+	Deleted    []int64       `json:"deleted"`
+	Checkpoint time.Time     `json:"checkpoint"`
+
+	// more changes are returned by syncing again from the checkpoint
+	HasMore bool `json:"hasMore"`
+}
+
+func getSync(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return httpError{http.StatusBadRequest, "Invalid checkpoint"}
+		}
+	}
+	start := utcNow()
+
+	changes, err := ctx.datamapper.getChangedPhotos(since, syncPageSize+1)
+	if err != nil {
+		return err
+	}
+
+	result := &syncResult{
+		Created:    []photoDetail{},
+		Updated:    []photoDetail{},
+		Deleted:    []int64{},
+		Checkpoint: start.Add(-syncMargin),
+	}
+	if len(changes) > syncPageSize {
+		changes = changes[:syncPageSize]
+		result.Checkpoint = changes[len(changes)-1].UpdatedAt
+		result.HasMore = true
+	}
+	if result.Checkpoint.Before(since) {
+		result.Checkpoint = since
+	}
+
+	var photoIDs []int64
+	for _, change := range changes {
+		photoIDs = append(photoIDs, change.ID)
+	}
+
+	// photos in the trash are not returned, and so are deleted
+	photos, err := ctx.datamapper.getPhotoDetails(photoIDs, ctx.user)
+	if err != nil {
+		return err
+	}
+
+	found := make(map[int64]bool)
+	for _, photo := range photos {
+		found[photo.ID] = true
+		photo.Created = newDisplayTime(photo.CreatedAt, ctx.user.location())
+		if photo.CreatedAt.After(since) {
+			result.Created = append(result.Created, photo)
+		} else {
+			result.Updated = append(result.Updated, photo)
+		}
+	}
+	for _, id := range photoIDs {
+		if !found[id] {
+			result.Deleted = append(result.Deleted, id)
+		}
+	}
+
+	deleted, err := ctx.datamapper.getDeletedPhotoIDs(since)
+	if err != nil {
+		return err
+	}
+	result.Deleted = append(result.Deleted, deleted...)
+
+	return renderJSON(w, result, http.StatusOK)
+}
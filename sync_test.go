@@ -0,0 +1,94 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(since time.Time) *syncResult {
+		u := "http://localhost/api/sync"
+		if !since.IsZero() {
+			u += "?since=" + url.QueryEscape(since.Format(time.RFC3339Nano))
+		}
+		req, _ := http.NewRequest("GET", u, nil)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+		}
+		result := &syncResult{}
+		if err := json.Unmarshal(res.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	var photos []*photo
+	for i := 0; i < 3; i++ {
+		p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+		if err := dm.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		photos = append(photos, p)
+	}
+
+	result := sync(time.Time{})
+	if len(result.Created) != 3 || len(result.Deleted) != 0 || result.HasMore {
+		t.Fatalf("Expected every photo created, got %+v", result)
+	}
+
+	// changes since the first sync
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	photos[0].Title = "edited"
+	if err := dm.updatePhoto(photos[0]); err != nil {
+		t.Fatal(err)
+	}
+	photos[1].Private = true
+	if err := dm.updatePhoto(photos[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.removePhoto(photos[2]); err != nil {
+		t.Fatal(err)
+	}
+	created := &photo{Title: "new", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(created); err != nil {
+		t.Fatal(err)
+	}
+
+	result = sync(since)
+	if len(result.Created) != 1 || result.Created[0].ID != created.ID {
+		t.Errorf("Expected the new photo created, got %+v", result.Created)
+	}
+	if len(result.Updated) != 1 || result.Updated[0].Title != "edited" {
+		t.Errorf("Expected the edited photo updated, got %+v", result.Updated)
+	}
+	// the private photo is hidden from other users
+	if len(result.Deleted) != 2 || result.Deleted[0] != photos[1].ID || result.Deleted[1] != photos[2].ID {
+		t.Errorf("Expected the private and removed photos deleted, got %v", result.Deleted)
+	}
+	if result.Checkpoint.Before(since) {
+		t.Errorf("Expected the checkpoint no earlier than since, got %s", result.Checkpoint)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/sync?since=yesterday", nil)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid checkpoint, got %d", res.Code)
+	}
+}
@@ -0,0 +1,318 @@
+package photoshare
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Imports the data exports ("takeouts") of other photo sites. Each format
+// reads the ZIP into takeoutPhotos, which are then stored for a user.
+
+const maxTitleLength = 200
+
+type takeoutPhoto struct {
+	file      *zip.File
+	title     string
+	tags      []string
+	takenAt   *time.Time
+	latitude  *float64
+	longitude *float64
+}
+
+var takeoutReaders = map[string]func(*zip.Reader) ([]takeoutPhoto, error){
+	"flickr":    readFlickrTakeout,
+	"instagram": readInstagramTakeout,
+}
+
+// Sidecar values are strings in some exports and numbers in others
+type flexibleFloat float64
+
+func (f *flexibleFloat) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*f = flexibleFloat(v)
+	return nil
+}
+
+func readZipJSON(f *zip.File, value interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(value); err != nil {
+		return fmt.Errorf("%s: %s", f.Name, err)
+	}
+	return nil
+}
+
+// sets the location unless it is missing (Flickr uses 0,0 for none)
+func (p *takeoutPhoto) setLocation(lat, lng flexibleFloat) {
+	if lat == 0 && lng == 0 {
+		return
+	}
+	latitude, longitude := float64(lat), float64(lng)
+	p.latitude, p.longitude = &latitude, &longitude
+}
+
+var flickrSidecarRegex = regexp.MustCompile(`^photo_(\d+)\.json$`)
+
+// Flickr exports hold images named "<title>_<id>_o.<ext>" and a sidecar
+// "photo_<id>.json" for each
+func readFlickrTakeout(zr *zip.Reader) ([]takeoutPhoto, error) {
+
+	images := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		ext := path.Ext(name)
+		parts := strings.Split(strings.TrimSuffix(name, ext), "_")
+		if len(parts) >= 2 && ext != ".json" {
+			// the ID is the part before the size suffix, or the last part
+			id := parts[len(parts)-1]
+			if id == "o" {
+				id = parts[len(parts)-2]
+			}
+			images[id] = f
+		}
+	}
+
+	var photos []takeoutPhoto
+
+	for _, f := range zr.File {
+		m := flickrSidecarRegex.FindStringSubmatch(path.Base(f.Name))
+		if m == nil {
+			continue
+		}
+
+		sidecar := &struct {
+			Name      string `json:"name"`
+			DateTaken string `json:"date_taken"`
+			Tags      []struct {
+				Tag string `json:"tag"`
+			} `json:"tags"`
+			Geo []struct {
+				Latitude  flexibleFloat `json:"latitude"`
+				Longitude flexibleFloat `json:"longitude"`
+			} `json:"geo"`
+		}{}
+
+		if err := readZipJSON(f, sidecar); err != nil {
+			return photos, err
+		}
+
+		image, ok := images[m[1]]
+		if !ok {
+			log.Printf("No image for %s", f.Name)
+			continue
+		}
+
+		p := takeoutPhoto{file: image, title: sidecar.Name}
+		for _, tag := range sidecar.Tags {
+			p.tags = append(p.tags, tag.Tag)
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", sidecar.DateTaken); err == nil {
+			p.takenAt = &t
+		}
+		if len(sidecar.Geo) > 0 {
+			p.setLocation(sidecar.Geo[0].Latitude, sidecar.Geo[0].Longitude)
+		}
+		photos = append(photos, p)
+	}
+	return photos, nil
+}
+
+var hashtagRegex = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+// Instagram escapes each byte of UTF-8 text as a separate character
+func fixInstagramText(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 255 {
+			return s
+		}
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+// Instagram exports list posts in posts_1.json (posts_2.json...) with the
+// media of each post given by path in the ZIP. Hashtags in captions are tags.
+func readInstagramTakeout(zr *zip.Reader) ([]takeoutPhoto, error) {
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var photos []takeoutPhoto
+
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if !strings.HasPrefix(name, "posts_") || path.Ext(name) != ".json" {
+			continue
+		}
+
+		var posts []struct {
+			Title             string `json:"title"`
+			CreationTimestamp int64  `json:"creation_timestamp"`
+			Media             []struct {
+				URI               string `json:"uri"`
+				Title             string `json:"title"`
+				CreationTimestamp int64  `json:"creation_timestamp"`
+				MediaMetadata     struct {
+					PhotoMetadata struct {
+						ExifData []struct {
+							Latitude  flexibleFloat `json:"latitude"`
+							Longitude flexibleFloat `json:"longitude"`
+						} `json:"exif_data"`
+					} `json:"photo_metadata"`
+				} `json:"media_metadata"`
+			} `json:"media"`
+		}
+
+		if err := readZipJSON(f, &posts); err != nil {
+			return photos, err
+		}
+
+		for _, post := range posts {
+			for _, media := range post.Media {
+				image, ok := files[media.URI]
+				if !ok {
+					log.Printf("No image for %s", media.URI)
+					continue
+				}
+
+				caption := post.Title
+				if caption == "" {
+					caption = media.Title
+				}
+				caption = fixInstagramText(caption)
+
+				p := takeoutPhoto{file: image, title: caption}
+				for _, m := range hashtagRegex.FindAllStringSubmatch(caption, -1) {
+					p.tags = append(p.tags, m[1])
+				}
+
+				timestamp := media.CreationTimestamp
+				if timestamp == 0 {
+					timestamp = post.CreationTimestamp
+				}
+				if timestamp > 0 {
+					t := time.Unix(timestamp, 0)
+					p.takenAt = &t
+				}
+
+				for _, exif := range media.MediaMetadata.PhotoMetadata.ExifData {
+					p.setLocation(exif.Latitude, exif.Longitude)
+				}
+				photos = append(photos, p)
+			}
+		}
+	}
+	return photos, nil
+}
+
+// returns a title for the photo, defaulting to the file name
+func (p *takeoutPhoto) getTitle() string {
+	title := strings.TrimSpace(p.title)
+	if title == "" {
+		name := path.Base(p.file.Name)
+		title = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if len(title) > maxTitleLength {
+		// cut at the start of a character, so as not to split it
+		n := maxTitleLength
+		for n > 0 && !utf8.RuneStart(title[n]) {
+			n--
+		}
+		title = strings.TrimSpace(title[:n])
+	}
+	return title
+}
+
+// imports the photos of a takeout ZIP for the user
+func importTakeout(app *app, userID int64, filename, format string) error {
+
+	readTakeout, ok := takeoutReaders[format]
+	if !ok {
+		return fmt.Errorf("unknown takeout format %s", format)
+	}
+
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	photos, err := readTakeout(&zr.Reader)
+	if err != nil {
+		return err
+	}
+
+	var num int
+
+	for _, p := range photos {
+		if err := storeTakeoutPhoto(app, userID, &p); err != nil {
+			log.Printf("%s: %s", p.file.Name, err)
+			continue
+		}
+		num++
+	}
+
+	log.Printf("Imported %d of %d photos", num, len(photos))
+	return app.cache.clear()
+}
+
+func storeTakeoutPhoto(app *app, userID int64, p *takeoutPhoto) error {
+
+	r, err := p.file.Open()
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	contentType := http.DetectContentType(body)
+	if !isAllowedContentType(contentType) {
+		return fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	filename, err := contentFilename(app.cfg, bytes.NewReader(body), contentType)
+	if err != nil {
+		return err
+	}
+
+	photo := &photo{
+		OwnerID:   userID,
+		Title:     p.getTitle(),
+		Filename:  filename,
+		Tags:      p.tags,
+		TakenAt:   p.takenAt,
+		Latitude:  p.latitude,
+		Longitude: p.longitude,
+	}
+
+	return storePhotoFile(app.datamapper, app.filestore, bytes.NewReader(body), photo, contentType, func() error {
+		return app.datamapper.createPhoto(photo)
+	})
+}
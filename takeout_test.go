@@ -0,0 +1,104 @@
+package photoshare
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func makeZip(t *testing.T, files map[string]string) *zip.Reader {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, body := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(body))
+	}
+	w.Close()
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func TestReadFlickrTakeout(t *testing.T) {
+	zr := makeZip(t, map[string]string{
+		"beach_12345_o.jpg": "image",
+		"photo_12345.json": `{"name": "Beach", "date_taken": "2015-06-01 12:30:00",
+			"tags": [{"tag": "sea"}, {"tag": "summer"}],
+			"geo": [{"latitude": "50.5", "longitude": "-1.25"}]}`,
+	})
+
+	photos, err := readFlickrTakeout(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photos) != 1 {
+		t.Fatalf("Expected 1 photo, got %d", len(photos))
+	}
+	p := photos[0]
+	if p.getTitle() != "Beach" || len(p.tags) != 2 || p.file.Name != "beach_12345_o.jpg" {
+		t.Errorf("Unexpected photo %+v", p)
+	}
+	if p.takenAt == nil || p.takenAt.Year() != 2015 {
+		t.Error("Date taken should be set")
+	}
+	if p.latitude == nil || *p.latitude != 50.5 || *p.longitude != -1.25 {
+		t.Error("Location should be set")
+	}
+}
+
+func TestReadInstagramTakeout(t *testing.T) {
+	zr := makeZip(t, map[string]string{
+		"media/posts/201901/abc.jpg": "image",
+		"content/posts_1.json": `[{"title": "CafÃ© #coffee #morning", "creation_timestamp": 1546300800,
+			"media": [{"uri": "media/posts/201901/abc.jpg", "title": ""}]}]`,
+	})
+
+	photos, err := readInstagramTakeout(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photos) != 1 {
+		t.Fatalf("Expected 1 photo, got %d", len(photos))
+	}
+	p := photos[0]
+	if p.title != "Café #coffee #morning" {
+		t.Errorf("Caption should be decoded, got %q", p.title)
+	}
+	if len(p.tags) != 2 || p.tags[0] != "coffee" {
+		t.Errorf("Hashtags should be tags, got %v", p.tags)
+	}
+	if p.takenAt == nil || p.takenAt.Unix() != 1546300800 {
+		t.Error("Date taken should be set")
+	}
+	if p.latitude != nil {
+		t.Error("Location should not be set")
+	}
+}
+
+func TestTakeoutTitle(t *testing.T) {
+	p := &takeoutPhoto{title: "a" + strings.Repeat("é", maxTitleLength)}
+	title := p.getTitle()
+	if len(title) > maxTitleLength || !utf8.ValidString(title) {
+		t.Errorf("Title should be cut between characters, got %d bytes", len(title))
+	}
+	if len(title) != maxTitleLength-1 {
+		t.Errorf("Title should be cut before the last whole character, got %d bytes", len(title))
+	}
+}
+
+func TestHashtags(t *testing.T) {
+	var tags []string
+	for _, m := range hashtagRegex.FindAllStringSubmatch("Café #café #東京 #summer_2019!", -1) {
+		tags = append(tags, m[1])
+	}
+	if len(tags) != 3 || tags[0] != "café" || tags[1] != "東京" || tags[2] != "summer_2019" {
+		t.Errorf("Hashtags should include letters of any script, got %v", tags)
+	}
+}
@@ -19,9 +19,11 @@ type testDB struct {
 	dbMap *gorp.DbMap
 }
 
+// all tables, in the order rows can be deleted
+var testTables = []string{"comments", "strike_thresholds", "moderation_notes", "reports", "shortlinks", "slug_history", "portfolio_album_photos", "portfolio_albums", "purchases", "idempotency_keys", "blocked_words", "photo_suggestions", "tag_details", "photo_votes", "push_subscriptions", "notification_preferences", "contest_votes", "contests", "group_photos", "group_members", "groups", "followers", "actor_keys", "feature_flags", "username_history", "sessions", "audit_log", "blocks", "notifications", "mentions", "photo_tags", "tags", "photos", "photo_deletions", "users"}
+
 func (tdb *testDB) clean() {
-	var tables = []string{"photo_tags", "tags", "photos", "users"}
-	for _, table := range tables {
+	for _, table := range testTables {
 		if _, err := tdb.dbMap.Exec("DELETE FROM " + table); err != nil {
 			panic(err)
 		}
@@ -32,7 +34,7 @@ func (tdb *testDB) clean() {
 func makeTestDB(cfg *config) (tdb *testDB) {
 	var err error
 
-	db, err := sql.Open("postgres", fmt.Sprintf("user=%s dbname=%s password=%s host=%s",
+	db, err := sql.Open("postgres", fmt.Sprintf("user=%s dbname=%s password=%s host=%s timezone=UTC",
 		cfg.TestDBUser,
 		cfg.TestDBName,
 		cfg.TestDBPassword,
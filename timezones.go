@@ -0,0 +1,52 @@
+package photoshare
+
+import (
+	"time"
+)
+
+// Times are stored and returned in UTC. Each user has a timezone, used to
+// add the local time to the times shown to them, so clients can display
+// it without knowing the timezone database.
+
+const defaultTimezone = "UTC"
+
+// returns the current time in UTC
+func utcNow() time.Time {
+	return time.Now().UTC()
+}
+
+// a time in UTC with its local time in the timezone of the user
+type displayTime struct {
+	UTC      time.Time `json:"utc"`
+	Local    string    `json:"local"`
+	Timezone string    `json:"timezone"`
+}
+
+func newDisplayTime(t time.Time, loc *time.Location) *displayTime {
+	return &displayTime{
+		UTC:      t.UTC(),
+		Local:    t.In(loc).Format(time.RFC3339),
+		Timezone: loc.String(),
+	}
+}
+
+// returns true if the name is in the timezone database, e.g. "Europe/Paris"
+func isValidTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// returns the location of the user's timezone, or UTC if not set or unknown
+func (user *user) location() *time.Location {
+	if user == nil || user.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
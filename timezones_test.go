@@ -0,0 +1,40 @@
+package photoshare
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDisplayTime(t *testing.T) {
+	u := &user{Timezone: "Europe/Paris"}
+	created := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	d := newDisplayTime(created, u.location())
+	if d.Local != "2026-07-01T14:00:00+02:00" || d.Timezone != "Europe/Paris" {
+		t.Errorf("Unexpected local time %+v", d)
+	}
+	if !d.UTC.Equal(created) || d.UTC.Location() != time.UTC {
+		t.Errorf("Expected UTC time, got %s", d.UTC)
+	}
+}
+
+func TestUserLocationFallsBackToUTC(t *testing.T) {
+	for _, tz := range []string{"", "Not/AZone"} {
+		if loc := (&user{Timezone: tz}).location(); loc != time.UTC {
+			t.Errorf("%q: expected UTC, got %s", tz, loc)
+		}
+	}
+}
+
+func TestIsValidTimezone(t *testing.T) {
+	for tz, valid := range map[string]bool{
+		"America/New_York": true,
+		"UTC":              true,
+		"Local":            false,
+		"":                 false,
+		"Mars/Olympus":     false,
+	} {
+		if isValidTimezone(tz) != valid {
+			t.Errorf("%q: expected %v", tz, valid)
+		}
+	}
+}
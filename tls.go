@@ -0,0 +1,73 @@
+package photoshare
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// redirects HTTP requests to the same URL on the HTTPS port
+func httpsRedirect(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		url := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, url, http.StatusMovedPermanently)
+	})
+}
+
+func newCertManager(cfg *config) *autocert.Manager {
+	var domains []string
+	for _, domain := range strings.Split(cfg.ACMEDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+}
+
+// serves HTTPS, with HTTP/2 negotiated by the TLS server. The HTTP port
+// redirects to HTTPS and answers ACME challenges.
+func listenAndServeTLS(cfg *config, handler http.Handler) error {
+
+	redirect := httpsRedirect(cfg.HTTPSPort)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.HTTPSPort),
+		Handler: handler,
+	}
+
+	if cfg.ACMEDomains != "" {
+		m := newCertManager(cfg)
+		server.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	} else {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	go func() {
+		addr := fmt.Sprintf(":%d", cfg.ServerPort)
+		log.Printf("Redirecting %s to HTTPS", addr)
+		if err := http.ListenAndServe(addr, redirect); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	log.Printf("Listening on %s (HTTPS)", server.Addr)
+	return server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+}
@@ -0,0 +1,64 @@
+package photoshare
+
+import (
+	"net/http"
+	"time"
+)
+
+// Photos deleted by their owner go to the trash, where only the owner sees
+// them and may restore them. The retention job removes photos, with their
+// files, once they have been in the trash for trashRetention.
+
+const trashRetention = 30 * retentionDay
+
+func getTrash(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	photos, err := ctx.datamapper.getTrash(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photos, http.StatusOK)
+}
+
+func restorePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getTrashedPhoto(ctx.params.getInt("id"), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.restorePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(ctx.site.ID, &socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderJSON(w, photo, http.StatusOK)
+}
+
+// removes the photos of the site in the trash since before now less
+// trashRetention, returning their number
+func purgeSiteTrash(datamapper dataMapper, filestore fileStorage, now time.Time) (int, error) {
+
+	trashed, err := datamapper.getTrashedBefore(now.Add(-trashRetention))
+	if err != nil || len(trashed) == 0 {
+		return 0, err
+	}
+
+	photos := make([]*photo, len(trashed))
+	for i := range trashed {
+		photos[i] = &trashed[i]
+	}
+	if err := datamapper.removePhotos(photos); err != nil {
+		return 0, err
+	}
+
+	for _, photo := range photos {
+		if err := cleanUnusedFile(datamapper, filestore, photo.Filename); err != nil {
+			logError(err)
+		}
+	}
+	return len(photos), nil
+}
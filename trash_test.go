@@ -0,0 +1,125 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	token, err := dm.login(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+	app.filestore.store(strings.NewReader("image"), p.Filename, "image/jpeg")
+
+	send := func(method, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, nil)
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := send("DELETE", fmt.Sprintf("/api/photos/%d", p.ID)); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if _, err := dm.getPhoto(p.ID); err == nil {
+		t.Error("Deleted photo should be hidden")
+	}
+	if _, err := app.filestore.open(p.Filename); err != nil {
+		t.Error("File of a photo in the trash should be kept")
+	}
+
+	res := send("GET", "/api/user/trash")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.Code)
+	}
+	trash := &photoList{}
+	if err := json.Unmarshal(res.Body.Bytes(), trash); err != nil {
+		t.Fatal(err)
+	}
+	if trash.Total != 1 || trash.Items[0].ID != p.ID {
+		t.Fatalf("Photo should be in the trash, got %+v", trash)
+	}
+
+	if res := send("POST", fmt.Sprintf("/api/user/trash/%d/restore", p.ID)); res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if _, err := dm.getPhoto(p.ID); err != nil {
+		t.Error("Restored photo should be visible")
+	}
+	if res := send("POST", fmt.Sprintf("/api/user/trash/%d/restore", p.ID)); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a photo not in the trash, got %d", res.Code)
+	}
+
+	// photos are removed with their files once in the trash for too long
+	stored, _ := dm.getPhoto(p.ID)
+	if err := dm.trashPhotos([]*photo{stored}); err != nil {
+		t.Fatal(err)
+	}
+	num, err := purgeSiteTrash(dm, app.filestore, time.Now())
+	if err != nil || num != 0 {
+		t.Fatalf("Recently deleted photo should be kept, got %d %v", num, err)
+	}
+	num, err = purgeSiteTrash(dm, app.filestore, time.Now().Add(trashRetention+time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Errorf("Expected 1 photo purged, got %d", num)
+	}
+	if trash, _ := dm.getTrash(&page{index: 1}, owner.ID); trash.Total != 0 {
+		t.Error("Trash should be empty")
+	}
+	if _, err := app.filestore.open(p.Filename); err == nil {
+		t.Error("File of the purged photo should be removed")
+	}
+}
+
+func TestAdminDeleteSkipsTrash(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	admin := &user{Name: "admin", Email: "admin@localhost", IsAdmin: true}
+	token, err := dm.login(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("http://localhost/api/photos/%d", p.ID), nil)
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	if trash, _ := dm.getTrash(&page{index: 1}, owner.ID); trash.Total != 0 {
+		t.Error("Photo deleted by an admin should not be restorable")
+	}
+}
@@ -1,9 +1,14 @@
 package photoshare
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/juju/errgo"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -30,18 +35,82 @@ func renderString(w http.ResponseWriter, status int, msg string) error {
 }
 
 func getScheme(r *http.Request) string {
+	// set by trustedProxies from X-Forwarded-Proto
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
 	if r.TLS == nil {
 		return "http"
 	}
 	return "https"
 }
 
+// returns the IP address of the client. Behind a trusted proxy, RemoteAddr
+// has already been set to the forwarded address.
+func getRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func getBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", getScheme(r), r.Host)
 }
 
+// largest JSON request body accepted, in bytes
+const maxJSONSize = 1 << 20
+
+// decodes a JSON request body, returning a 4xx httpError describing any
+// problem with the payload
 func decodeJSON(r *http.Request, value interface{}) error {
-	return errgo.Mask(json.NewDecoder(r.Body).Decode(value))
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			return httpError{http.StatusUnsupportedMediaType, "Content-Type must be application/json"}
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxJSONSize+1))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(body) > maxJSONSize {
+		return httpError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must be no larger than %d bytes", maxJSONSize)}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(value); err != nil {
+		return httpError{http.StatusBadRequest, describeJSONError(err)}
+	}
+	if dec.More() {
+		return httpError{http.StatusBadRequest, "Request body must contain a single JSON object"}
+	}
+	return nil
+}
+
+func describeJSONError(err error) string {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Sprintf("Malformed JSON at position %d", err.Offset)
+	case *json.UnmarshalTypeError:
+		if err.Field != "" {
+			return fmt.Sprintf("Invalid value for field %q", err.Field)
+		}
+		return fmt.Sprintf("Invalid JSON value at position %d", err.Offset)
+	}
+	switch {
+	case err == io.EOF:
+		return "Request body is empty"
+	case err == io.ErrUnexpectedEOF:
+		return "Malformed JSON"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	return "Invalid JSON"
 }
 
 // Converts a Pg Array (returned as string) to an int slice
@@ -72,5 +141,11 @@ func getPage(r *http.Request) *page {
 	if err != nil {
 		pageNum = 1
 	}
-	return newPage(pageNum)
+	page := newPage(pageNum)
+	page.exact, _ = strconv.ParseBool(r.FormValue("exact"))
+	return page
+}
+
+func getOrdering(r *http.Request) *ordering {
+	return newOrdering(r.FormValue("orderBy"), r.FormValue("window"))
 }
@@ -1,7 +1,10 @@
 package photoshare
 
 import (
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPgArrToIntSlice(t *testing.T) {
@@ -19,3 +22,67 @@ func TestIntSliceToPgArr(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestDecodeJSONErrors(t *testing.T) {
+	for _, tc := range []struct {
+		body, contentType string
+		status            int
+	}{
+		{`{"title": "ok"}`, "application/json; charset=UTF-8", 0},
+		{``, "application/json", http.StatusBadRequest},
+		{`{"title": `, "application/json", http.StatusBadRequest},
+		{`{"title": 1}`, "application/json", http.StatusBadRequest},
+		{`{"title": "ok", "owner": 1}`, "application/json", http.StatusBadRequest},
+		{`{"title": "ok"} {}`, "application/json", http.StatusBadRequest},
+		{`{"title": "ok"}`, "text/plain", http.StatusUnsupportedMediaType},
+		{`{"title": "` + strings.Repeat("x", maxJSONSize) + `"}`, "", http.StatusRequestEntityTooLarge},
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+
+		s := &struct {
+			Title string `json:"title"`
+		}{}
+
+		err := decodeJSON(req, s)
+		if tc.status == 0 {
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			continue
+		}
+		if err, ok := err.(httpError); !ok || err.Status != tc.status {
+			t.Errorf("Expected status %d for %.20q, got %v", tc.status, tc.body, err)
+		}
+	}
+}
+
+func TestGetOrdering(t *testing.T) {
+	for _, tc := range []struct {
+		query, sort, window string
+	}{
+		{"", orderNew, "all"},
+		{"?orderBy=hot&window=day", orderHot, "all"},
+		{"?orderBy=votes", orderTop, "all"},
+		{"?orderBy=top&window=week", orderTop, "week"},
+		{"?orderBy=controversial&window=month", orderControversial, "month"},
+		{"?orderBy=top&window=year", orderTop, "all"},
+		{"?orderBy=oldest", orderNew, "all"},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/api/photos/"+tc.query, nil)
+		order := getOrdering(req)
+		if order.sort != tc.sort || order.window != tc.window {
+			t.Errorf("%q: got %s/%s, want %s/%s", tc.query, order.sort, order.window, tc.sort, tc.window)
+		}
+	}
+}
+
+func TestOrderingSince(t *testing.T) {
+	now := utcNow()
+	if !newOrdering(orderTop, "all").since(now).IsZero() {
+		t.Error("All should not limit photos")
+	}
+	if since := newOrdering(orderTop, "day").since(now); !since.Equal(now.Add(-24 * time.Hour)) {
+		t.Errorf("Day should start 24 hours ago, got %s", since)
+	}
+}
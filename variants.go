@@ -0,0 +1,183 @@
+package photoshare
+
+import (
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"github.com/juju/errgo"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Modern browsers take WebP and AVIF, which are a good deal smaller than
+// JPEG and PNG at the same quality. With IMAGE_FORMATS set, e.g. to
+// "avif,webp", /uploads/ serves each JPEG and PNG in the first of those
+// formats the Accept header of the browser lists, encoded on first request
+// and kept in VARIANTS_DIR, or the original if it is smaller. Responses
+// vary by Accept, so shared caches keep a copy for each format. GIFs are
+// always served as they are, to keep their animation.
+
+const (
+	webpQuality = 80
+	avifQuality = 60
+	avifSpeed   = 6 // 0 is slowest and smallest, 10 fastest
+)
+
+type imageFormat struct {
+	contentType string
+	ext         string
+	encode      func(io.Writer, image.Image) error
+}
+
+// formats of IMAGE_FORMATS by name
+var imageFormats = map[string]imageFormat{
+	"avif": {"image/avif", ".avif", func(w io.Writer, img image.Image) error {
+		return avif.Encode(w, img, avif.Options{Quality: avifQuality, Speed: avifSpeed})
+	}},
+	"webp": {"image/webp", ".webp", func(w io.Writer, img image.Image) error {
+		return webp.Encode(w, img, webp.Options{Quality: webpQuality})
+	}},
+}
+
+// returns the names of the formats of IMAGE_FORMATS, in order of preference
+func (cfg *config) imageFormats() []string {
+	var names []string
+	for _, name := range strings.Split(cfg.ImageFormats, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// returns the first of the formats whose content type the Accept header
+// lists without q=0, or "" if none. Wildcards don't count, as browsers send
+// */* for images they cannot show.
+func negotiateImageFormat(accept string, formats []string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		accepted[mediaType] = true
+	}
+	for _, name := range formats {
+		if format, ok := imageFormats[name]; ok && accepted[format.contentType] {
+			return name
+		}
+	}
+	return ""
+}
+
+// returns the format to serve the upload in, or "" for its own
+func uploadFormat(cfg *config, r *http.Request, filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png":
+		return negotiateImageFormat(r.Header.Get("Accept"), cfg.imageFormats())
+	}
+	return ""
+}
+
+// encodes of variants in progress by path, so that each is encoded once
+var variantLocks sync.Map
+
+// returns the path of the variant of the upload in the format, scaled down
+// to fit max pixels unless max is 0, encoding it if it is not yet kept
+func uploadVariant(ctx *context, filename string, max int, name string) (string, error) {
+	format := imageFormats[name]
+	filename = path.Base(filename)
+	variantPath := path.Join(ctx.cfg.VariantsDir, filename+"-"+strconv.Itoa(max)+format.ext)
+
+	lock, _ := variantLocks.LoadOrStore(variantPath, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer func() {
+		lock.(*sync.Mutex).Unlock()
+		variantLocks.Delete(variantPath)
+	}()
+
+	if _, err := os.Stat(variantPath); err == nil {
+		return variantPath, nil
+	}
+
+	file, err := ctx.filestore.open(filename)
+	if err != nil {
+		return "", httpError{http.StatusNotFound, "Not found"}
+	}
+	defer file.Close()
+
+	src, _, err := decodeImage(ctx.cfg, file)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if max > 0 {
+		src = fitImage(src, max)
+	}
+
+	if err := os.MkdirAll(ctx.cfg.VariantsDir, 0777); err != nil && !os.IsExist(err) {
+		return "", errgo.Mask(err)
+	}
+	// written aside and renamed, so that a variant is never served half
+	// written
+	tmp, err := ioutil.TempFile(ctx.cfg.VariantsDir, ".encoding-")
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := format.encode(tmp, src); err != nil {
+		tmp.Close()
+		return "", errgo.Mask(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", errgo.Mask(err)
+	}
+	if err := os.Rename(tmp.Name(), variantPath); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return variantPath, nil
+}
+
+// serves the variant of the upload in the format
+func serveVariant(w http.ResponseWriter, r *http.Request, variantPath, name string) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", imageFormats[name].contentType)
+	http.ServeFile(w, r, variantPath)
+}
+
+// serves uploaded files in the format negotiated with the browser, or the
+// originals; registered when IMAGE_FORMATS is set without PUBLIC_MAX_SIZE
+func getUpload(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	filename := path.Base(ctx.params.get("filename"))
+	originalPath := path.Join(ctx.cfg.UploadsDir, filename)
+	w.Header().Add("Vary", "Accept")
+
+	if name := uploadFormat(ctx.cfg, r, filename); name != "" {
+		variantPath, err := uploadVariant(ctx, filename, 0, name)
+		if err != nil {
+			return err
+		}
+		variant, err := os.Stat(variantPath)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if original, err := os.Stat(originalPath); err != nil || variant.Size() < original.Size() {
+			serveVariant(w, r, variantPath, name)
+			return nil
+		}
+	}
+
+	http.ServeFile(w, r, originalPath)
+	return nil
+}
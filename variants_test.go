@@ -0,0 +1,115 @@
+package photoshare
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNegotiateImageFormat(t *testing.T) {
+	formats := []string{"avif", "webp"}
+	for _, tc := range []struct {
+		accept, format string
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "avif"},
+		{"image/webp,*/*", "webp"},
+		{"image/avif;q=0,image/webp", "webp"},
+		{"image/*,*/*;q=0.8", ""},
+		{"", ""},
+	} {
+		if format := negotiateImageFormat(tc.accept, formats); format != tc.format {
+			t.Errorf("%q: expected %q, got %q", tc.accept, tc.format, format)
+		}
+	}
+	if format := negotiateImageFormat("image/avif,image/webp", []string{"webp"}); format != "webp" {
+		t.Errorf("Expected only the configured formats, got %q", format)
+	}
+}
+
+func TestUploadVariants(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := newTestApp(newMemoryDataMapper())
+	app.cfg.ImageFormats = "avif,webp"
+	app.cfg.UploadsDir = dir
+	app.cfg.VariantsDir = path.Join(dir, "variants")
+	app.initRouter()
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.filestore.store(bytes.NewReader(buf.Bytes()), "test.png", "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "test.png"), buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/uploads/test.png", nil)
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, tc := range []struct {
+		accept, contentType string
+	}{
+		{"image/avif,image/webp,*/*", "image/avif"},
+		{"image/webp,*/*", "image/webp"},
+		{"*/*", "image/png"},
+	} {
+		res := get(tc.accept)
+		if res.Code != http.StatusOK {
+			t.Errorf("%q: expected 200, got %d", tc.accept, res.Code)
+			continue
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != tc.contentType {
+			t.Errorf("%q: expected %s, got %s", tc.accept, tc.contentType, contentType)
+		}
+		if res.Header().Get("Vary") != "Accept" {
+			t.Errorf("%q: expected Vary: Accept, got %q", tc.accept, res.Header().Get("Vary"))
+		}
+		if tc.contentType != "image/png" && res.Body.Len() >= buf.Len() {
+			t.Errorf("%q: expected fewer bytes than the original %d, got %d", tc.accept, buf.Len(), res.Body.Len())
+		}
+	}
+
+	for _, name := range []string{"test.png-0.avif", "test.png-0.webp"} {
+		if _, err := os.Stat(path.Join(app.cfg.VariantsDir, name)); err != nil {
+			t.Errorf("Expected the variant %s to be kept: %v", name, err)
+		}
+	}
+
+	if res := get("image/webp"); res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("Expected the kept variant, got %d %s", res.Code, res.Header().Get("Content-Type"))
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/uploads/missing.png", nil)
+	req.Header.Set("Accept", "image/webp")
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing upload, got %d", res.Code)
+	}
+}
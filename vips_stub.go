@@ -0,0 +1,10 @@
+//go:build !vips
+// +build !vips
+
+package photoshare
+
+import "errors"
+
+func newVipsImageProcessor() (imageProcessor, error) {
+	return nil, errors.New("built without libvips, build with -tags vips")
+}
@@ -0,0 +1,12 @@
+//go:build !vips
+// +build !vips
+
+package photoshare
+
+import "testing"
+
+func TestImageProcessorFallback(t *testing.T) {
+	if _, ok := newImageProcessor(&config{ImageProcessor: "vips"}).(*defaultImageProcessor); !ok {
+		t.Error("Expected the Go processor without libvips")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build vips
+// +build vips
+
+package photoshare
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestVipsThumbnail(t *testing.T) {
+
+	p, ok := newImageProcessor(&config{ImageProcessor: "vips"}).(*vipsImageProcessor)
+	if !ok {
+		t.Fatal("Expected the libvips processor")
+	}
+
+	src := &bytes.Buffer{}
+	if err := png.Encode(src, image.NewRGBA(image.Rect(0, 0, 1200, 800))); err != nil {
+		t.Fatal(err)
+	}
+	dst := &bytes.Buffer{}
+	if err := p.thumbnail(src, dst, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, format, err := image.DecodeConfig(dst)
+	if err != nil || format != "png" || cfg.Width != thumbnailWidth || cfg.Height != thumbnailHeight {
+		t.Errorf("Expected a %dx%d PNG, got %s %dx%d (%v)", thumbnailWidth, thumbnailHeight, format, cfg.Width, cfg.Height, err)
+	}
+
+	if err := p.thumbnail(bytes.NewReader([]byte("not an image")), &bytes.Buffer{}, "image/png"); err == nil {
+		t.Error("Expected an error for an invalid image")
+	}
+}
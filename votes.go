@@ -0,0 +1,61 @@
+package photoshare
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// The up and down votes of a photo are counted on the photo for sorting,
+// and each vote is recorded in photo_votes. If the counts drift, e.g. after
+// a failed write or a manual fix, they are recomputed from the recorded votes
+// periodically or by an admin.
+
+const scoreReconcileInterval = time.Hour
+
+var errAlreadyVoted = httpError{http.StatusForbidden, "You're not allowed to vote on this photo"}
+
+// recomputes the scores of photos of each site, logging the number fixed
+func reconcileScores(app *app) {
+	sites, err := app.datamapper.getSites()
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, s := range sites {
+		num, err := app.datamapper.forSite(s.ID).recomputeScores()
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if num > 0 {
+			log.Printf("Recomputed scores of %d photos of site %d", num, s.ID)
+		}
+	}
+}
+
+// reconciles scores until the server stops
+func runScoreReconciliation(app *app) {
+	for range time.Tick(scoreReconcileInterval) {
+		reconcileScores(app)
+	}
+}
+
+func recomputeScores(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	num, err := ctx.datamapper.recomputeScores()
+	if err != nil {
+		return err
+	}
+
+	if num > 0 {
+		if err := ctx.cache.clear(); err != nil {
+			logError(err)
+		}
+	}
+
+	if err := writeAuditLog(ctx, "recompute_scores", 0, ""); err != nil {
+		return err
+	}
+	return renderJSON(w, map[string]int64{"updated": num}, http.StatusOK)
+}
@@ -0,0 +1,61 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVote(t *testing.T) {
+
+	dm := newMemoryDataMapper()
+	app := newTestApp(dm)
+
+	owner := &user{Name: "owner", Email: "owner@localhost"}
+	if err := dm.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	voter := &user{Name: "voter", Email: "voter@localhost"}
+	token, err := dm.login(voter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &photo{Title: "test", Filename: "test.jpg", OwnerID: owner.ID}
+	if err := dm.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusForbidden} {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/upvote", p.ID), nil)
+		req.Header.Set(tokenHeader, token)
+		res := httptest.NewRecorder()
+		app.router.ServeHTTP(res, req)
+		if res.Code != status {
+			t.Errorf("Expected %d, got %d", status, res.Code)
+		}
+	}
+
+	if p, _ := dm.getPhoto(p.ID); p.UpVotes != 1 {
+		t.Errorf("Vote should be counted once, got %d", p.UpVotes)
+	}
+	if len(dm.notifications) != 1 {
+		t.Errorf("Owner should be notified once, got %d", len(dm.notifications))
+	}
+	if err := dm.recordVote(p, voter, -1); err != errAlreadyVoted {
+		t.Errorf("Second vote should fail, got %v", err)
+	}
+
+	private := &photo{Title: "private", Filename: "private.jpg", OwnerID: owner.ID, Private: true}
+	if err := dm.createPhoto(private); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://localhost/api/photos/%d/upvote", private.ID), nil)
+	req.Header.Set(tokenHeader, token)
+	res := httptest.NewRecorder()
+	app.router.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Votes on private photos should return 404, got %d", res.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/SherClockHolmes/webpush-go"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Web Push notifications are sent to browsers which subscribed through the
+// service worker of the UI. Messages are signed with the VAPID keys of the
+// config; without keys push notifications are disabled.
+
+const pushTTL = 24 * 60 * 60 // seconds a push service keeps an undelivered message
+
+// the payload shown by the service worker
+type pushMessage struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+}
+
+// returns the message of the notification; follows have no photo and link
+// to the profile of the recipient
+func newPushMessage(kind string, sender string, recipient *user, photo *photo) *pushMessage {
+	msg := &pushMessage{Type: kind}
+	if photo == nil {
+		msg.URL = fmt.Sprintf("/#/user/%d/%s", recipient.ID, recipient.Name)
+	} else {
+		msg.URL = fmt.Sprintf("/#/detail/%d", photo.ID)
+		msg.Body = photo.Title
+	}
+	switch kind {
+	case notificationUpvote:
+		msg.Title = sender + " voted up your photo"
+	case notificationDownvote:
+		msg.Title = sender + " voted down your photo"
+	case notificationMention:
+		msg.Title = sender + " mentioned you"
+	case notificationComment:
+		msg.Title = sender + " commented on your photo"
+	case notificationFollow:
+		msg.Title = sender + " followed you"
+	}
+	return msg
+}
+
+// sends the message to every browser of the user, removing subscriptions
+// the push service no longer accepts
+func sendPush(app *app, userID int64, msg *pushMessage) {
+
+	if !app.cfg.pushEnabled() {
+		return
+	}
+
+	subs, err := app.datamapper.getPushSubscriptions(userID)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		logError(err)
+		return
+	}
+
+	options := &webpush.Options{
+		HTTPClient:      app.fetcher,
+		Subscriber:      app.cfg.VAPIDSubject,
+		VAPIDPublicKey:  app.cfg.VAPIDPublicKey,
+		VAPIDPrivateKey: app.cfg.VAPIDPrivateKey,
+		TTL:             pushTTL,
+	}
+
+	for _, s := range subs {
+		res, err := webpush.SendNotification(payload, &webpush.Subscription{
+			Endpoint: s.Endpoint,
+			Keys:     webpush.Keys{Auth: s.Auth, P256dh: s.P256dh},
+		}, options)
+		if err != nil {
+			log.Printf("Push to %s failed: %s", s.Endpoint, err)
+			continue
+		}
+		res.Body.Close()
+
+		switch {
+		case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+			if err := app.datamapper.removePushEndpoint(s.Endpoint); err != nil {
+				logError(err)
+			}
+		case res.StatusCode >= 300:
+			log.Printf("Push to %s failed: %s", s.Endpoint, res.Status)
+		}
+	}
+}
+
+// returns the public key browsers subscribe with
+func getPushKey(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if !ctx.cfg.pushEnabled() {
+		return httpError{http.StatusNotFound, "Push notifications are not enabled"}
+	}
+	return renderJSON(w, map[string]string{"publicKey": ctx.cfg.VAPIDPublicKey}, http.StatusOK)
+}
+
+func getPushSubscriptions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	subs, err := ctx.datamapper.getPushSubscriptions(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, subs, http.StatusOK)
+}
+
+// stores the PushSubscription of a browser, as serialized by its toJSON()
+func subscribePush(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if !ctx.cfg.pushEnabled() {
+		return httpError{http.StatusNotFound, "Push notifications are not enabled"}
+	}
+
+	s := &webpush.Subscription{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return httpError{http.StatusBadRequest, "Invalid push endpoint"}
+	}
+	if s.Keys.Auth == "" || s.Keys.P256dh == "" {
+		return httpError{http.StatusBadRequest, "Missing subscription keys"}
+	}
+
+	sub := &pushSubscription{
+		UserID:   ctx.user.ID,
+		Endpoint: s.Endpoint,
+		Auth:     s.Keys.Auth,
+		P256dh:   s.Keys.P256dh,
+	}
+
+	if err := ctx.datamapper.savePushSubscription(sub); err != nil {
+		return err
+	}
+	return renderJSON(w, sub, http.StatusCreated)
+}
+
+func unsubscribePush(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.removePushSubscription(ctx.user.ID, ctx.params.getInt("id")); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Unsubscribed")
+}
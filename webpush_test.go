@@ -0,0 +1,40 @@
+package photoshare
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewPushMessage(t *testing.T) {
+	msg := newPushMessage(notificationUpvote, "tester", &user{ID: 1, Name: "owner"}, &photo{ID: 3, Title: "Sunset"})
+	if msg.Title != "tester voted up your photo" || msg.Body != "Sunset" || msg.URL != "/#/detail/3" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+}
+
+func TestSubscribePushInvalidEndpoint(t *testing.T) {
+	dm := &mockDataMapper{}
+	c := &context{
+		app: &app{
+			cfg:        &config{VAPIDPublicKey: "public", VAPIDPrivateKey: "private"},
+			datamapper: dm,
+		},
+		user:       &user{ID: 1, IsAuthenticated: true},
+		datamapper: dm,
+	}
+
+	for _, body := range []string{
+		`{"endpoint": "http://push.example.com/1", "keys": {"auth": "a", "p256dh": "b"}}`,
+		`{"endpoint": "https://push.example.com/1", "keys": {"auth": ""}}`,
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost/api/user/push", bytes.NewBufferString(body))
+		res := httptest.NewRecorder()
+
+		err := subscribePush(c, res, req)
+		if e, ok := err.(httpError); !ok || e.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %v", body, err)
+		}
+	}
+}